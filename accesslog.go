@@ -0,0 +1,208 @@
+// Copyright 2014 Chris McGee <sirnewton_01@yahoo.ca>. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"flag"
+	"io"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Request of the access log with accessLogFormat json
+type AccessEntry struct {
+	Time      string `json:"time"`
+	Client    string `json:"client"`
+	User      string `json:"user,omitempty"`
+	Method    string `json:"method"`
+	Uri       string `json:"uri"`
+	Proto     string `json:"proto"`
+	Status    int    `json:"status"`
+	Bytes     int64  `json:"bytes"`
+	Referer   string `json:"referer,omitempty"`
+	UserAgent string `json:"userAgent,omitempty"`
+	// Microseconds that the request took
+	Duration int64 `json:"duration"`
+}
+
+// Records the status and size of the response for the access log
+type accessRecorder struct {
+	http.ResponseWriter
+	req    *http.Request
+	start  time.Time
+	status int
+	bytes  int64
+}
+
+var (
+	accessLog       = flag.String("accessLog", "", "File of the access log of the web server, - for standard output. The file is rotated like the log. (empty disables)")
+	accessLogFormat = flag.String("accessLogFormat", "combined", "Format of the access log: combined, which is Apache's combined format followed by the microseconds of the request, or json.")
+
+	accessMutex  sync.Mutex
+	accessOutput io.Writer
+	accessFile   *rotatingWriter
+)
+
+// Opens the access log of the flags, again when the configuration is
+// reloaded
+func configureAccessLog() error {
+	if *accessLogFormat != "combined" && *accessLogFormat != "json" {
+		return errors.New("Invalid access log format: " + *accessLogFormat)
+	}
+
+	accessMutex.Lock()
+	defer accessMutex.Unlock()
+
+	if accessFile != nil && accessFile.path != *accessLog {
+		accessFile.close()
+		accessFile = nil
+	}
+
+	switch *accessLog {
+	case "":
+		accessOutput = nil
+	case "-":
+		accessOutput = os.Stdout
+	default:
+		if accessFile == nil {
+			err := os.MkdirAll(filepath.Dir(*accessLog), 0700)
+			if err != nil {
+				return err
+			}
+			w := &rotatingWriter{path: *accessLog}
+			err = w.open()
+			if err != nil {
+				return err
+			}
+			accessFile = w
+		}
+		accessFile.maxSize = int64(*logMaxSize) << 20
+		accessFile.maxFiles = *logMaxFiles
+		accessOutput = accessFile
+	}
+
+	return nil
+}
+
+func startAccess(writer http.ResponseWriter, req *http.Request) *accessRecorder {
+	return &accessRecorder{ResponseWriter: writer, req: req, start: time.Now()}
+}
+
+func (w *accessRecorder) WriteHeader(code int) {
+	if w.status == 0 {
+		w.status = code
+	}
+	w.ResponseWriter.WriteHeader(code)
+}
+
+func (w *accessRecorder) Write(b []byte) (int, error) {
+	if w.status == 0 {
+		w.status = 200
+	}
+	n, err := w.ResponseWriter.Write(b)
+	w.bytes += int64(n)
+
+	return n, err
+}
+
+func (w *accessRecorder) Flush() {
+	if flusher, ok := w.ResponseWriter.(http.Flusher); ok {
+		flusher.Flush()
+	}
+}
+
+// WebSockets take the connection over, for the log the response switched
+// protocols
+func (w *accessRecorder) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+	hijacker, ok := w.ResponseWriter.(http.Hijacker)
+	if !ok {
+		return nil, nil, errors.New("The connection can't be taken over")
+	}
+
+	conn, rw, err := hijacker.Hijack()
+	if err == nil && w.status == 0 {
+		w.status = http.StatusSwitchingProtocols
+	}
+	return conn, rw, err
+}
+
+func (w *accessRecorder) Unwrap() http.ResponseWriter {
+	return w.ResponseWriter
+}
+
+// The user of a request with a valid key, - for the others
+func accessUser(req *http.Request) string {
+	if hostName == loopbackHost {
+		return "-"
+	}
+	cookie, err := req.Cookie("MAGIC" + *port)
+	if err != nil || !validMagicKey(cookie.Value) {
+		return "-"
+	}
+
+	return requestUser(req)
+}
+
+func accessField(value string) string {
+	if value == "" {
+		return `"-"`
+	}
+
+	return strings.Replace(strconv.Quote(value), `\"`, `\x22`, -1)
+}
+
+// Writes the line of the request once it is answered
+func (w *accessRecorder) log() {
+	if *accessLog == "" {
+		return
+	}
+
+	status := w.status
+	if status == 0 {
+		status = 200
+	}
+	duration := time.Since(w.start).Nanoseconds() / 1000
+	req := w.req
+
+	line := ""
+	if *accessLogFormat == "json" {
+		entry := AccessEntry{Time: w.start.Format(time.RFC3339), Client: clientIP(req), Method: req.Method,
+			Uri: req.RequestURI, Proto: req.Proto, Status: status, Bytes: w.bytes, Referer: req.Referer(),
+			UserAgent: req.UserAgent(), Duration: duration}
+		if user := accessUser(req); user != "-" {
+			entry.User = user
+		}
+		b, err := json.Marshal(entry)
+		if err != nil {
+			return
+		}
+		line = string(b) + "\n"
+	} else {
+		bytes := "-"
+		if w.bytes > 0 {
+			bytes = strconv.FormatInt(w.bytes, 10)
+		}
+		line = clientIP(req) + " - " + strings.Replace(accessUser(req), " ", "_", -1) + " [" +
+			w.start.Format("02/Jan/2006:15:04:05 -0700") + "] " +
+			accessField(req.Method+" "+req.RequestURI+" "+req.Proto) + " " + strconv.Itoa(status) + " " + bytes + " " +
+			accessField(req.Referer()) + " " + accessField(req.UserAgent()) + " " + strconv.FormatInt(duration, 10) + "\n"
+	}
+
+	accessMutex.Lock()
+	defer accessMutex.Unlock()
+
+	if accessOutput != nil {
+		io.WriteString(accessOutput, line)
+	}
+}
@@ -0,0 +1,454 @@
+// Copyright 2014 Chris McGee <sirnewton_01@yahoo.ca>. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"crypto/pbkdf2"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sync"
+	"time"
+
+	_ "github.com/mattn/go-sqlite3"
+)
+
+const (
+	passwordIterations = 100000
+	minPasswordLength  = 8
+)
+
+// Account of a user other than the remoteAccount. Each account has a
+// workspace of its own, laid out like a GOPATH, and logs in with its
+// password or with a login URL of a key that the admin hands out. The
+// services that work with import paths (build, test, debug) still use the
+// GOPATH of the server.
+type Account struct {
+	Name string
+	// Directory of the workspace, its src directory is what the account
+	//  sees of the file system
+	Workspace   string
+	Created     int64
+	Disabled    bool `json:",omitempty"`
+	HasPassword bool
+}
+
+type AccountRequest struct {
+	Name     string
+	Password string
+	// Defaults to a directory in the data directory of the user
+	Workspace string `json:",omitempty"`
+	// Role that the account gets, the default role of roles.json otherwise
+	Role     string `json:",omitempty"`
+	Disabled *bool  `json:",omitempty"`
+}
+
+var (
+	accountsMutex sync.Mutex
+	accountsDb    *sql.DB
+	// Accounts by name, so that requests don't have to go to the database
+	accounts map[string]*Account
+
+	validAccountName = regexp.MustCompile(`^[A-Za-z0-9][A-Za-z0-9@._-]*$`)
+)
+
+func accountsDbFile() string {
+	return filepath.Join(godevDataDir(), "accounts.db")
+}
+
+// Opens the database and reads the accounts, the mutex must be held
+func openAccounts() error {
+	if accountsDb != nil {
+		return nil
+	}
+
+	err := os.MkdirAll(godevDataDir(), 0700)
+	if err != nil {
+		return err
+	}
+
+	db, err := sql.Open("sqlite3", accountsDbFile())
+	if err != nil {
+		return err
+	}
+
+	_, err = db.Exec(`CREATE TABLE IF NOT EXISTS accounts (name TEXT PRIMARY KEY, workspace TEXT NOT NULL,
+		salt BLOB, hash BLOB, created INTEGER NOT NULL, disabled INTEGER NOT NULL DEFAULT 0)`)
+	if err != nil {
+		db.Close()
+		return err
+	}
+
+	rows, err := db.Query("SELECT name, workspace, hash IS NOT NULL, created, disabled FROM accounts")
+	if err != nil {
+		db.Close()
+		return err
+	}
+	defer rows.Close()
+
+	loaded := make(map[string]*Account)
+	for rows.Next() {
+		account := &Account{}
+		err = rows.Scan(&account.Name, &account.Workspace, &account.HasPassword, &account.Created, &account.Disabled)
+		if err != nil {
+			db.Close()
+			return err
+		}
+		loaded[account.Name] = account
+	}
+	if err = rows.Err(); err != nil {
+		db.Close()
+		return err
+	}
+
+	accountsDb = db
+	accounts = loaded
+	return nil
+}
+
+// The account of a user, nil for the remoteAccount, anonymous and the
+// users that don't have one
+func lookupAccount(user string) *Account {
+	accountsMutex.Lock()
+	defer accountsMutex.Unlock()
+
+	if accounts == nil {
+		// Nobody has an account before the database exists
+		if _, err := os.Stat(accountsDbFile()); err != nil {
+			return nil
+		}
+		if err := openAccounts(); err != nil {
+			logger.Printf("Unable to read the accounts: %v\n", err)
+			return nil
+		}
+	}
+
+	account := accounts[user]
+	if account == nil {
+		return nil
+	}
+
+	result := *account
+	return &result
+}
+
+func requestAccount(req *http.Request) *Account {
+	return lookupAccount(requestUser(req))
+}
+
+// Source directories that the request sees, the workspace of its account
+// or the GOPATH
+func requestSrcDirs(req *http.Request) []string {
+	return userSrcDirs(requestUser(req))
+}
+
+// Source directories of the user's workspace, for the work that goes on
+// after the request such as tests and debug sessions
+func userSrcDirs(user string) []string {
+	if account := lookupAccount(user); account != nil {
+		return []string{accountSrcDir(account)}
+	}
+
+	// A copy, appending to the shared one would race with other requests
+	return append([]string{}, srcDirs...)
+}
+
+func accountSrcDir(account *Account) string {
+	return filepath.Join(account.Workspace, "src")
+}
+
+func listAccounts() ([]Account, error) {
+	accountsMutex.Lock()
+	defer accountsMutex.Unlock()
+
+	if err := openAccounts(); err != nil {
+		return nil, err
+	}
+
+	list := []Account{}
+	for _, account := range accounts {
+		list = append(list, *account)
+	}
+
+	return list, nil
+}
+
+func hashPassword(password string, salt []byte) ([]byte, error) {
+	return pbkdf2.Key(sha256.New, password, salt, passwordIterations, 32)
+}
+
+func createAccount(accountReq AccountRequest) (*Account, error) {
+	if !validAccountName.MatchString(accountReq.Name) || accountReq.Name == "anonymous" || accountReq.Name == *remoteAccount {
+		return nil, errors.New("Invalid account name: " + accountReq.Name)
+	}
+	if accountReq.Password != "" && len(accountReq.Password) < minPasswordLength {
+		return nil, errors.New("The password is too short")
+	}
+
+	workspace := accountReq.Workspace
+	if workspace == "" {
+		workspace = filepath.Join(userDataDir(accountReq.Name), "workspace")
+	}
+	workspace, err := filepath.Abs(workspace)
+	if err != nil {
+		return nil, err
+	}
+
+	account := &Account{Name: accountReq.Name, Workspace: workspace, Created: time.Now().Unix() * 1000}
+	if accountReq.Disabled != nil {
+		account.Disabled = *accountReq.Disabled
+	}
+
+	accountsMutex.Lock()
+	defer accountsMutex.Unlock()
+
+	if err := openAccounts(); err != nil {
+		return nil, err
+	}
+	if accounts[account.Name] != nil {
+		return nil, errors.New("The account already exists: " + account.Name)
+	}
+
+	err = os.MkdirAll(accountSrcDir(account), 0700)
+	if err != nil {
+		return nil, err
+	}
+
+	_, err = accountsDb.Exec("INSERT INTO accounts (name, workspace, created, disabled) VALUES (?, ?, ?, ?)",
+		account.Name, account.Workspace, account.Created, account.Disabled)
+	if err != nil {
+		return nil, err
+	}
+	accounts[account.Name] = account
+
+	if accountReq.Password != "" {
+		err = setAccountPassword(account.Name, accountReq.Password)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	result := *account
+	return &result, nil
+}
+
+// Sets the password of the account, the mutex must be held
+func setAccountPassword(name string, password string) error {
+	if len(password) < minPasswordLength {
+		return errors.New("The password is too short")
+	}
+
+	salt := make([]byte, 16)
+	_, err := rand.Read(salt)
+	if err != nil {
+		return err
+	}
+	hash, err := hashPassword(password, salt)
+	if err != nil {
+		return err
+	}
+
+	_, err = accountsDb.Exec("UPDATE accounts SET salt = ?, hash = ? WHERE name = ?", salt, hash, name)
+	if err != nil {
+		return err
+	}
+	accounts[name].HasPassword = true
+
+	return nil
+}
+
+func updateAccount(name string, accountReq AccountRequest) (*Account, error) {
+	accountsMutex.Lock()
+	defer accountsMutex.Unlock()
+
+	if err := openAccounts(); err != nil {
+		return nil, err
+	}
+	account := accounts[name]
+	if account == nil {
+		return nil, os.ErrNotExist
+	}
+
+	if accountReq.Password != "" {
+		err := setAccountPassword(name, accountReq.Password)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	if accountReq.Disabled != nil {
+		_, err := accountsDb.Exec("UPDATE accounts SET disabled = ? WHERE name = ?", *accountReq.Disabled, name)
+		if err != nil {
+			return nil, err
+		}
+		account.Disabled = *accountReq.Disabled
+	}
+
+	result := *account
+	return &result, nil
+}
+
+// Removes the account, its workspace and data stay on disk
+func deleteAccount(name string) error {
+	accountsMutex.Lock()
+	defer accountsMutex.Unlock()
+
+	if err := openAccounts(); err != nil {
+		return err
+	}
+	if accounts[name] == nil {
+		return os.ErrNotExist
+	}
+
+	_, err := accountsDb.Exec("DELETE FROM accounts WHERE name = ?", name)
+	if err != nil {
+		return err
+	}
+	delete(accounts, name)
+
+	return nil
+}
+
+// Whether the password is the one of the enabled account
+func checkAccountPassword(name string, password string) bool {
+	accountsMutex.Lock()
+	defer accountsMutex.Unlock()
+
+	if err := openAccounts(); err != nil {
+		logger.Printf("Unable to read the accounts: %v\n", err)
+		return false
+	}
+	account := accounts[name]
+	if account == nil || account.Disabled || !account.HasPassword {
+		return false
+	}
+
+	var salt, hash []byte
+	err := accountsDb.QueryRow("SELECT salt, hash FROM accounts WHERE name = ?", name).Scan(&salt, &hash)
+	if err != nil {
+		return false
+	}
+
+	given, err := hashPassword(password, salt)
+	return err == nil && subtle.ConstantTimeCompare(given, hash) == 1
+}
+
+// Changes to the accounts end the sessions that they no longer allow
+func endAccountSessions(name string) {
+	keysMutex.Lock()
+	defer keysMutex.Unlock()
+
+	for _, k := range append([]*MagicKey{}, magicKeys...) {
+		if k.User == name {
+			removeMagicKey(k.Id)
+		}
+	}
+}
+
+func adminAccountsHandler(writer http.ResponseWriter, req *http.Request, path string, pathSegs []string) bool {
+	switch {
+	case req.Method == "GET" && len(pathSegs) == 2:
+		list, err := listAccounts()
+		if err != nil {
+			ShowError(writer, 500, "Unable to read the accounts", err)
+			return true
+		}
+
+		ShowJson(writer, 200, list)
+		return true
+	case req.Method == "POST" && len(pathSegs) == 2:
+		accountReq := AccountRequest{}
+		err := json.NewDecoder(req.Body).Decode(&accountReq)
+		if err != nil {
+			ShowError(writer, 400, "Invalid account", err)
+			return true
+		}
+		if accountReq.Role != "" && rolePermissions[accountReq.Role] == nil {
+			ShowError(writer, 400, "No such role: "+accountReq.Role, nil)
+			return true
+		}
+
+		account, err := createAccount(accountReq)
+		if err != nil {
+			ShowError(writer, 400, "Unable to create the account", err)
+			return true
+		}
+
+		if accountReq.Role != "" {
+			err = setUserRole(account.Name, accountReq.Role)
+			if err != nil {
+				ShowError(writer, 500, "Unable to save the role of the account", err)
+				return true
+			}
+		}
+
+		ShowJson(writer, 201, account)
+		return true
+	case req.Method == "PUT" && len(pathSegs) == 3:
+		accountReq := AccountRequest{}
+		err := json.NewDecoder(req.Body).Decode(&accountReq)
+		if err != nil {
+			ShowError(writer, 400, "Invalid account", err)
+			return true
+		}
+
+		account, err := updateAccount(pathSegs[2], accountReq)
+		if os.IsNotExist(err) {
+			ShowError(writer, 404, "No such account", nil)
+			return true
+		}
+		if err != nil {
+			ShowError(writer, 400, "Unable to change the account", err)
+			return true
+		}
+
+		if account.Disabled || accountReq.Password != "" {
+			endAccountSessions(account.Name)
+		}
+
+		ShowJson(writer, 200, account)
+		return true
+	case req.Method == "POST" && len(pathSegs) == 4 && pathSegs[3] == "key":
+		// A login URL for an account without a password, or a new device
+		account := lookupAccount(pathSegs[2])
+		if account == nil {
+			ShowError(writer, 404, "No such account", nil)
+			return true
+		}
+		if account.Disabled {
+			ShowError(writer, 400, "The account is disabled", nil)
+			return true
+		}
+
+		key := addUserMagicKey(account.Name, "Pairing", *pairingTimeout, true)
+		ShowJson(writer, 201, MagicKeyGrant{Key: *key, Url: loginUrl(key.Key)})
+		return true
+	case req.Method == "DELETE" && len(pathSegs) == 3:
+		err := deleteAccount(pathSegs[2])
+		if os.IsNotExist(err) {
+			ShowError(writer, 404, "No such account", nil)
+			return true
+		}
+		if err != nil {
+			ShowError(writer, 500, "Unable to remove the account", err)
+			return true
+		}
+
+		endAccountSessions(pathSegs[2])
+		releaseClaims(pathSegs[2])
+
+		writer.WriteHeader(204)
+		return true
+	}
+
+	return false
+}
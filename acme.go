@@ -0,0 +1,102 @@
+// Copyright 2014 Chris McGee <sirnewton_01@yahoo.ca>. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"errors"
+	"net"
+	"net/http"
+	"path/filepath"
+
+	"golang.org/x/crypto/acme"
+	"golang.org/x/crypto/acme/autocert"
+)
+
+// Certificates of a public host name that are obtained and renewed with
+// ACME, from Let's Encrypt unless another directory is given. The CA
+// checks that the host is ours through the HTTP port, or through the TLS
+// port when godev serves 443 itself.
+type AcmeConfig struct {
+	// Contact address for the CA about problems with the certificates
+	Email string `json:",omitempty"`
+	// Where the account key and certificates are kept, defaults to acme in
+	//  the data directory
+	CacheDir string `json:",omitempty"`
+	// Directory URL of the CA, e.g. the staging environment of Let's
+	//  Encrypt for trying things out
+	DirectoryUrl string `json:",omitempty"`
+	// Port of the HTTP challenges, 80 unless given. The other requests to
+	//  it are redirected to godev.
+	HttpPort string `json:",omitempty"`
+}
+
+var (
+	acmeManager *autocert.Manager
+)
+
+func validateAcmeConfig(config *AcmeConfig) error {
+	if config == nil {
+		return nil
+	}
+	if config.HttpPort != "" {
+		if _, err := net.LookupPort("tcp", config.HttpPort); err != nil {
+			return errors.New("Invalid ACME HttpPort: " + config.HttpPort)
+		}
+	}
+
+	return nil
+}
+
+// Sets up the certificate manager of the host and answers the HTTP
+// challenges of the CA
+func startAcme(config AcmeConfig, host string) error {
+	if net.ParseIP(host) != nil {
+		return errors.New("ACME certificates need a host name, not an address: " + host)
+	}
+
+	cache := config.CacheDir
+	if cache == "" {
+		cache = filepath.Join(godevDataDir(), "acme")
+	}
+
+	acmeManager = &autocert.Manager{
+		Prompt:     autocert.AcceptTOS,
+		Cache:      autocert.DirCache(cache),
+		HostPolicy: autocert.HostWhitelist(host),
+		Email:      config.Email,
+	}
+	if config.DirectoryUrl != "" {
+		acmeManager.Client = &acme.Client{DirectoryURL: config.DirectoryUrl}
+	}
+
+	httpPort := config.HttpPort
+	if httpPort == "" {
+		httpPort = "80"
+	}
+
+	redirect := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		http.Redirect(w, r, "https://"+host+":"+*port+r.URL.RequestURI(), http.StatusMovedPermanently)
+	})
+
+	go func() {
+		err := http.ListenAndServe(net.JoinHostPort("", httpPort), acmeManager.HTTPHandler(redirect))
+		if err != nil {
+			logger.Printf("Unable to answer ACME challenges on port %v: %v\n", httpPort, err)
+		}
+	}()
+
+	logger.Printf("Certificates of %v come from ACME, cached in %v\n", host, cache)
+	return nil
+}
+
+// Protocol of the TLS server that lets the CA check the host through the
+// TLS port
+func acmeNextProtos() []string {
+	if acmeManager == nil {
+		return nil
+	}
+
+	return []string{acme.ALPNProto}
+}
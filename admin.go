@@ -0,0 +1,95 @@
+// Copyright 2014 Chris McGee <sirnewton_01@yahoo.ca>. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"net/http"
+	"os"
+	"time"
+)
+
+func adminHandler(writer http.ResponseWriter, req *http.Request, path string, pathSegs []string) bool {
+	if len(pathSegs) < 2 {
+		return false
+	}
+
+	switch {
+	case pathSegs[1] == "backup" || pathSegs[1] == "restore":
+		return adminBackupHandler(writer, req, path, pathSegs)
+	case pathSegs[1] == "keys":
+		return adminKeysHandler(writer, req, path, pathSegs)
+	case pathSegs[1] == "accounts":
+		return adminAccountsHandler(writer, req, path, pathSegs)
+	case req.Method == "GET" && pathSegs[1] == "usage":
+		if !*usageStats {
+			ShowError(writer, 404, "Usage statistics are not enabled. Start godev with the -usageStats flag to collect them.", nil)
+			return true
+		}
+
+		ShowJson(writer, 200, usageSummary())
+		return true
+	case req.Method == "GET" && pathSegs[1] == "shell-audit":
+		entries, err := shellAuditEntries(maxShellAuditEntries)
+		if err != nil {
+			ShowError(writer, 500, "Unable to read the shell audit log", err)
+			return true
+		}
+
+		ShowJson(writer, 200, entries)
+		return true
+	case req.Method == "GET" && pathSegs[1] == "env":
+		ctx, cancel := operationContext(req, *toolTimeout)
+		defer cancel()
+
+		ShowJson(writer, 200, envReport(ctx))
+		return true
+	case req.Method == "GET" && pathSegs[1] == "config":
+		ShowJson(writer, 200, currentServerConfig().redacted())
+		return true
+	case req.Method == "POST" && pathSegs[1] == "reload":
+		config, err := reloadServerConfig()
+		if err != nil {
+			ShowError(writer, 400, "Unable to reload the configuration", err)
+			return true
+		}
+
+		ShowJson(writer, 200, config.redacted())
+		return true
+	case req.Method == "POST" && pathSegs[1] == "shutdown":
+		// The response goes out while the server drains, a process manager
+		//  can start it again for a restart
+		ShowJson(writer, 202, map[string]string{"Message": "Shutting down"})
+		shutdownServer()
+		return true
+	case req.Method == "GET" && pathSegs[1] == "mirror":
+		ShowJson(writer, 200, currentMirrorStatus())
+		return true
+	case req.Method == "POST" && pathSegs[1] == "gc":
+		retention := *historyRetention
+
+		if r := req.URL.Query().Get("retention"); r != "" {
+			d, err := time.ParseDuration(r)
+			if err != nil {
+				ShowError(writer, 400, "Invalid retention", err)
+				return true
+			}
+			retention = d
+		}
+
+		ShowJson(writer, 200, collectGarbage(retention))
+		return true
+	case req.Method == "DELETE" && pathSegs[1] == "usage":
+		usageMutex.Lock()
+		usage = &UsageSummary{Since: time.Now().Unix() * 1000, Operations: []OperationStats{}}
+		usageMutex.Unlock()
+
+		os.Remove(usageFile())
+
+		writer.WriteHeader(204)
+		return true
+	}
+
+	return false
+}
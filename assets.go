@@ -0,0 +1,263 @@
+// Copyright 2014 Chris McGee <sirnewton_01@yahoo.ca>. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"net/http"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"text/template"
+	"time"
+)
+
+// Static files of the bundles under URLs that contain the hash of their
+// content so that browsers can cache them forever.
+type AssetManifest struct {
+	Version string
+	Assets  map[string]string
+}
+
+// Pages and scripts the service worker fetches up front so that the IDE
+// shell comes up without the network.
+var shellAssets = []string{
+	"/index.html",
+	"/edit/edit.html",
+	"/requirejs/require.js",
+	"/godev/debug/debug.html",
+}
+
+var (
+	assetsMutex    sync.Mutex
+	assetManifest  *AssetManifest
+	assetsBuiltFor string
+)
+
+func assetHash(content []byte) string {
+	hash := sha256.Sum256(content)
+	return hex.EncodeToString(hash[:])[:16]
+}
+
+// Hashes the files of the bundle directories. Generated files and earlier
+// bundles shadow later ones in the same way as the ChainedFileSystem does.
+func buildAssetManifest(dirs []string, layers []http.FileSystem, overlay memFS) *AssetManifest {
+	manifest := &AssetManifest{Assets: make(map[string]string)}
+
+	for logicalPath, entry := range overlay {
+		manifest.Assets[logicalPath] = "/assets/" + assetHash(entry.content) + logicalPath
+	}
+
+	for idx, dir := range dirs {
+		walkBundle(layers[idx], dir, func(logicalPath string, read func() ([]byte, error)) {
+			if _, exists := manifest.Assets[logicalPath]; exists {
+				return
+			}
+
+			content, err := read()
+			if err != nil {
+				return
+			}
+
+			manifest.Assets[logicalPath] = "/assets/" + assetHash(content) + logicalPath
+		})
+	}
+
+	paths := []string{}
+	for p := range manifest.Assets {
+		paths = append(paths, p)
+	}
+	sort.Strings(paths)
+
+	version := sha256.New()
+	for _, p := range paths {
+		version.Write([]byte(manifest.Assets[p] + "\n"))
+	}
+	manifest.Version = hex.EncodeToString(version.Sum(nil))[:16]
+
+	return manifest
+}
+
+// The manifest is rebuilt whenever bundles come or go
+func currentAssetManifest(fs *ChainedFileSystem) *AssetManifest {
+	data := fs.snapshot()
+	dirs := data.dirs
+	overlay := data.overlay
+
+	assetsMutex.Lock()
+	defer assetsMutex.Unlock()
+
+	key := strings.Join(dirs, string(filepath.ListSeparator))
+	if assetManifest == nil || assetsBuiltFor != key {
+		start := time.Now()
+		assetManifest = buildAssetManifest(dirs, data.fs, overlay)
+		assetsBuiltFor = key
+		logger.Printf("Asset manifest %v built in %v\n", assetManifest.Version, time.Since(start))
+	}
+
+	return assetManifest
+}
+
+// Serves the hashed assets and their manifest
+func (h *Handlers) assetsHandler(writer http.ResponseWriter, req *http.Request) {
+	manifest := currentAssetManifest(h.fs)
+
+	if req.URL.Path == "/assets/manifest.json" {
+		writer.Header().Set("Cache-Control", "no-cache")
+		ShowJson(writer, 200, manifest)
+		return
+	}
+
+	// /assets/<hash>/<path>
+	segs := strings.SplitN(strings.TrimPrefix(req.URL.Path, "/assets/"), "/", 2)
+	if len(segs) != 2 {
+		http.NotFound(writer, req)
+		return
+	}
+	logicalPath := "/" + segs[1]
+
+	file, err := h.fs.Open(logicalPath)
+	if err != nil {
+		http.NotFound(writer, req)
+		return
+	}
+	defer file.Close()
+
+	info, err := file.Stat()
+	if err != nil || info.IsDir() {
+		http.NotFound(writer, req)
+		return
+	}
+
+	// An old hash still gets the file but not the promise that it never changes
+	if manifest.Assets[logicalPath] == req.URL.Path {
+		writer.Header().Set("Cache-Control", "public, max-age=31536000, immutable")
+	} else {
+		writer.Header().Set("Cache-Control", "no-cache")
+	}
+
+	if acceptsGzip(req) {
+		if servePrecompressed(writer, req, h.fs, logicalPath) {
+			return
+		}
+		if req.Method == "GET" && compressible(logicalPath) {
+			gz := &gzipWriter{ResponseWriter: writer}
+			defer gz.Close()
+			writer = gz
+		}
+	}
+
+	http.ServeContent(writer, req, info.Name(), info.ModTime(), file)
+}
+
+// Generates the service worker for the current version of the assets
+func (h *Handlers) serviceWorkerHandler(writer http.ResponseWriter, req *http.Request) {
+	manifest := currentAssetManifest(h.fs)
+
+	shell := []string{}
+	for _, p := range shellAssets {
+		if _, ok := manifest.Assets[p]; ok {
+			shell = append(shell, p)
+		}
+	}
+
+	assets, _ := json.Marshal(manifest.Assets)
+	shellJson, _ := json.Marshal(shell)
+
+	writer.Header().Set("Content-Type", "application/javascript")
+	writer.Header().Set("Cache-Control", "no-cache")
+	writer.WriteHeader(200)
+
+	err := serviceWorkerTemplate.Execute(writer, map[string]string{
+		"Version": manifest.Version,
+		"Assets":  string(assets),
+		"Shell":   string(shellJson),
+	})
+	if err != nil {
+		logger.Printf("Unable to generate the service worker: %v\n", err)
+	}
+}
+
+var serviceWorkerTemplate = template.Must(template.New("service-worker").Parse(`// Generated by godev for assets version {{.Version}}
+var ASSETS = {{.Assets}};
+var SHELL = {{.Shell}};
+var ASSET_CACHE = "godev-assets";
+var CONTENT_CACHE = "godev-content";
+
+self.addEventListener("install", function(event) {
+	event.waitUntil(caches.open(ASSET_CACHE).then(function(cache) {
+		return cache.addAll(SHELL.map(function(path) { return ASSETS[path]; }));
+	}).then(function() {
+		return self.skipWaiting();
+	}));
+});
+
+// Assets of previous versions are no longer needed
+self.addEventListener("activate", function(event) {
+	var current = {};
+	Object.keys(ASSETS).forEach(function(path) {
+		current[new URL(ASSETS[path], self.location).href] = true;
+	});
+
+	event.waitUntil(caches.open(ASSET_CACHE).then(function(cache) {
+		return cache.keys().then(function(requests) {
+			return Promise.all(requests.filter(function(request) {
+				return !current[request.url];
+			}).map(function(request) {
+				return cache.delete(request);
+			}));
+		});
+	}).then(function() {
+		return self.clients.claim();
+	}));
+});
+
+self.addEventListener("fetch", function(event) {
+	var request = event.request;
+	var url = new URL(request.url);
+
+	if (request.method !== "GET" || url.origin !== self.location.origin) {
+		return;
+	}
+
+	// Static files come from the cache under their hashed URL
+	var hashed = ASSETS[url.pathname === "/" ? "/index.html" : url.pathname];
+	if (hashed) {
+		event.respondWith(caches.open(ASSET_CACHE).then(function(cache) {
+			return cache.match(hashed).then(function(cached) {
+				return cached || fetch(hashed).then(function(response) {
+					if (response.ok) {
+						cache.put(hashed, response.clone());
+					}
+					return response;
+				});
+			});
+		}));
+		return;
+	}
+
+	// Browsing falls back to whatever was last seen when offline
+	if (/^\/(file|workspace)(\/|$)/.test(url.pathname)) {
+		event.respondWith(fetch(request).then(function(response) {
+			if (response.ok) {
+				var copy = response.clone();
+				caches.open(CONTENT_CACHE).then(function(cache) {
+					cache.put(request, copy);
+				});
+			}
+			return response;
+		}).catch(function() {
+			return caches.open(CONTENT_CACHE).then(function(cache) {
+				return cache.match(request);
+			}).then(function(cached) {
+				return cached || Response.error();
+			});
+		}));
+	}
+});
+`))
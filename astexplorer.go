@@ -0,0 +1,235 @@
+// Copyright 2014 Chris McGee <sirnewton_01@yahoo.ca>. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"go/ast"
+	"go/parser"
+	"go/token"
+	"go/types"
+	"io/ioutil"
+	"net/http"
+	"reflect"
+	"strconv"
+)
+
+// Node of the syntax tree as the AST explorer shows it
+type AstNode struct {
+	// Go type of the node, e.g. *ast.CallExpr
+	Type  string
+	Start int
+	End   int
+	Line  int
+	// Field of the parent that holds the node, e.g. Args[1]
+	Field string `json:",omitempty"`
+	// Names, literal values, operators and other plain fields
+	Attributes map[string]string `json:",omitempty"`
+	// What the type checker knows about an expression or identifier
+	TypeInfo *AstTypeInfo `json:",omitempty"`
+	Children []*AstNode
+}
+
+type AstTypeInfo struct {
+	Type string `json:",omitempty"`
+	// Constant value
+	Value string `json:",omitempty"`
+	// The object an identifier defines or uses, e.g. "var x int"
+	Object string `json:",omitempty"`
+	// type, value, variable, constant, builtin, void or nil
+	Mode string `json:",omitempty"`
+}
+
+var (
+	astNodeType = reflect.TypeOf((*ast.Node)(nil)).Elem()
+	posType     = reflect.TypeOf(token.NoPos)
+)
+
+// POST /go/ast parses the buffer, /go/ast/file/<path>?types=true also type
+// checks it with its package. With start and end only the innermost node
+// that encloses the range is returned.
+func astHandler(writer http.ResponseWriter, req *http.Request, path string, pathSegs []string) bool {
+	switch {
+	case req.Method == "POST":
+		buffer, err := ioutil.ReadAll(req.Body)
+		if err != nil {
+			ShowError(writer, 500, "Error reading the buffer", err)
+			return true
+		}
+
+		filePath := ""
+		if len(pathSegs) > 3 {
+			filePath, err = bufferPath(requestSrcDirs(req), pathSegs)
+			if err != nil {
+				ShowError(writer, 400, "Invalid resource", err)
+				return true
+			}
+		}
+
+		var checked *checkedBuffer
+		if req.URL.Query().Get("types") == "true" && filePath != "" {
+			checked, err = typeCheckBuffer(buffer, filePath)
+		} else {
+			checked, err = parseOnly(buffer, filePath)
+		}
+		if err != nil {
+			ShowError(writer, 400, "Error parsing go source", err)
+			return true
+		}
+
+		var root ast.Node = checked.file
+		if req.URL.Query().Get("start") != "" {
+			start, end, err := requestRange(req, len(buffer))
+			if err != nil {
+				ShowError(writer, 400, "Invalid range", err)
+				return true
+			}
+			root = enclosingNode(checked, start, end)
+		}
+
+		ShowJson(writer, 200, astTree(checked, root, ""))
+		return true
+	}
+
+	return false
+}
+
+// A buffer without type information
+func parseOnly(buffer []byte, filePath string) (*checkedBuffer, error) {
+	fileset := token.NewFileSet()
+	file, err := parser.ParseFile(fileset, filePath, buffer, parser.AllErrors|parser.ParseComments)
+	if file == nil {
+		return nil, err
+	}
+
+	return &checkedBuffer{fileset: fileset, file: file}, nil
+}
+
+func enclosingNode(checked *checkedBuffer, start int, end int) ast.Node {
+	var innermost ast.Node = checked.file
+
+	ast.Inspect(checked.file, func(n ast.Node) bool {
+		if n == nil || checked.offset(n.Pos()) > start || checked.offset(n.End()) < end {
+			return false
+		}
+		innermost = n
+		return true
+	})
+
+	return innermost
+}
+
+func astTree(checked *checkedBuffer, n ast.Node, field string) *AstNode {
+	pos := checked.fileset.Position(n.Pos())
+	node := &AstNode{
+		Type:       reflect.TypeOf(n).String(),
+		Start:      pos.Offset,
+		End:        checked.offset(n.End()),
+		Line:       pos.Line,
+		Field:      field,
+		Attributes: make(map[string]string),
+		Children:   []*AstNode{},
+	}
+
+	if checked.info != nil {
+		node.TypeInfo = astTypeInfo(checked, n)
+	}
+
+	v := reflect.ValueOf(n)
+	for v.Kind() == reflect.Ptr {
+		if v.IsNil() {
+			return node
+		}
+		v = v.Elem()
+	}
+	if v.Kind() != reflect.Struct {
+		return node
+	}
+
+	for i := 0; i < v.NumField(); i++ {
+		name := v.Type().Field(i).Name
+		f := v.Field(i)
+
+		switch {
+		case f.Type() == posType:
+			// Positions are covered by the offsets
+		case f.Type().Implements(astNodeType) && f.Kind() != reflect.Struct:
+			if !f.IsNil() {
+				node.Children = append(node.Children, astTree(checked, f.Interface().(ast.Node), name))
+			}
+		case f.Kind() == reflect.Slice && f.Type().Elem().Implements(astNodeType):
+			for j := 0; j < f.Len(); j++ {
+				if child, ok := f.Index(j).Interface().(ast.Node); ok && !f.Index(j).IsNil() {
+					node.Children = append(node.Children, astTree(checked, child, name+"["+strconv.Itoa(j)+"]"))
+				}
+			}
+		case f.Type() == reflect.TypeOf(token.ILLEGAL):
+			node.Attributes[name] = f.Interface().(token.Token).String()
+		case f.Kind() == reflect.String:
+			node.Attributes[name] = f.String()
+		case f.Kind() == reflect.Bool:
+			node.Attributes[name] = strconv.FormatBool(f.Bool())
+		case f.Type() == reflect.TypeOf(ast.ChanDir(0)):
+			node.Attributes[name] = strconv.Itoa(int(f.Int()))
+		}
+	}
+
+	return node
+}
+
+func astTypeInfo(checked *checkedBuffer, n ast.Node) *AstTypeInfo {
+	typeInfo := &AstTypeInfo{}
+	qualifier := func(p *types.Package) string {
+		if p == checked.pkg {
+			return ""
+		}
+		return p.Name()
+	}
+
+	if expr, ok := n.(ast.Expr); ok {
+		if tv, ok := checked.info.Types[expr]; ok {
+			if tv.Type != nil {
+				typeInfo.Type = checked.typeString(tv.Type)
+			}
+			if tv.Value != nil {
+				typeInfo.Value = tv.Value.String()
+			}
+
+			switch {
+			case tv.IsVoid():
+				typeInfo.Mode = "void"
+			case tv.IsType():
+				typeInfo.Mode = "type"
+			case tv.IsBuiltin():
+				typeInfo.Mode = "builtin"
+			case tv.IsNil():
+				typeInfo.Mode = "nil"
+			case tv.Value != nil:
+				typeInfo.Mode = "constant"
+			case tv.Addressable():
+				typeInfo.Mode = "variable"
+			default:
+				typeInfo.Mode = "value"
+			}
+		}
+	}
+
+	if ident, ok := n.(*ast.Ident); ok {
+		obj := checked.info.Defs[ident]
+		if obj == nil {
+			obj = checked.info.Uses[ident]
+		}
+		if obj != nil {
+			typeInfo.Object = types.ObjectString(obj, qualifier)
+			if typeInfo.Type == "" && obj.Type() != nil {
+				typeInfo.Type = checked.typeString(obj.Type())
+			}
+		}
+	}
+
+	if *typeInfo == (AstTypeInfo{}) {
+		return nil
+	}
+	return typeInfo
+}
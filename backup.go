@@ -0,0 +1,298 @@
+// Copyright 2014 Chris McGee <sirnewton_01@yahoo.ca>. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"archive/zip"
+	"bufio"
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/pbkdf2"
+	"crypto/rand"
+	"crypto/sha256"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+const (
+	backupMagic      = "GODEVBAK1"
+	backupIterations = 100000
+	maxBackupSize    = 256 * 1024 * 1024
+)
+
+// Archives the server state (preferences with the installed plugins, and
+// the data directory: bookmarks, history, sessions, keys) and encrypts it
+// with the passphrase. What can be downloaded or built again and the
+// checkouts of the workspaces are left out.
+func createBackup(passphrase string) ([]byte, error) {
+	buf := &bytes.Buffer{}
+	archive := zip.NewWriter(buf)
+
+	addFile := func(name string, file string) error {
+		content, err := ioutil.ReadFile(file)
+		if err != nil {
+			return err
+		}
+
+		w, err := archive.Create(name)
+		if err != nil {
+			return err
+		}
+
+		_, err = w.Write(content)
+		return err
+	}
+
+	if _, err := os.Stat(prefsFile()); err == nil {
+		err = addFile("prefs.txt", prefsFile())
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	dataRoot := godevDataDir()
+	err := filepath.Walk(dataRoot, func(path string, info os.FileInfo, err error) error {
+		if os.IsNotExist(err) {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		relPath, err := filepath.Rel(dataRoot, path)
+		if err != nil {
+			return err
+		}
+
+		if info.IsDir() {
+			if backupExcluded(filepath.ToSlash(relPath)) {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+		// Links of the project GOPATHs and sockets
+		if !info.Mode().IsRegular() {
+			return nil
+		}
+
+		return addFile("data/"+filepath.ToSlash(relPath), path)
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	err = archive.Close()
+	if err != nil {
+		return nil, err
+	}
+
+	salt := make([]byte, 16)
+	_, err = rand.Read(salt)
+	if err != nil {
+		return nil, err
+	}
+
+	gcm, err := backupCipher(passphrase, salt)
+	if err != nil {
+		return nil, err
+	}
+
+	nonce := make([]byte, gcm.NonceSize())
+	_, err = rand.Read(nonce)
+	if err != nil {
+		return nil, err
+	}
+
+	result := append([]byte(backupMagic), salt...)
+	result = append(result, nonce...)
+	return gcm.Seal(result, nonce, buf.Bytes(), []byte(backupMagic)), nil
+}
+
+// Directories of the data directory that the backup leaves out: the build
+// caches, the installed bundles with their module cache, the GOPATHs of the
+// projects, the worktrees and the default workspaces of the accounts
+func backupExcluded(relPath string) bool {
+	switch relPath {
+	case "cache", "bundles", "projects", "worktrees":
+		return true
+	}
+
+	segs := strings.Split(relPath, "/")
+	return len(segs) == 3 && segs[0] == "users" && segs[2] == "workspace"
+}
+
+func backupCipher(passphrase string, salt []byte) (cipher.AEAD, error) {
+	key, err := pbkdf2.Key(sha256.New, passphrase, salt, backupIterations, 32)
+	if err != nil {
+		return nil, err
+	}
+
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+
+	return cipher.NewGCM(block)
+}
+
+// Decrypts a backup and puts its contents back in place, overwriting the
+// current state of the same name.
+func restoreBackup(backup []byte, passphrase string) error {
+	if !bytes.HasPrefix(backup, []byte(backupMagic)) || len(backup) < len(backupMagic)+16 {
+		return errors.New("Not a godev backup")
+	}
+	backup = backup[len(backupMagic):]
+
+	gcm, err := backupCipher(passphrase, backup[:16])
+	if err != nil {
+		return err
+	}
+	backup = backup[16:]
+
+	if len(backup) < gcm.NonceSize() {
+		return errors.New("Not a godev backup")
+	}
+
+	content, err := gcm.Open(nil, backup[:gcm.NonceSize()], backup[gcm.NonceSize():], []byte(backupMagic))
+	if err != nil {
+		return errors.New("Wrong passphrase or corrupt backup")
+	}
+
+	archive, err := zip.NewReader(bytes.NewReader(content), int64(len(content)))
+	if err != nil {
+		return err
+	}
+
+	for _, zFile := range archive.File {
+		target := ""
+
+		if zFile.Name == "prefs.txt" {
+			target = prefsFile()
+		} else if strings.HasPrefix(zFile.Name, "data/") {
+			target = filepath.Join(godevDataDir(), filepath.FromSlash(zFile.Name[5:]))
+
+			// Don't let a crafted archive write outside of the data directory
+			if !strings.HasPrefix(target, filepath.Clean(godevDataDir())+string(filepath.Separator)) {
+				return errors.New("Invalid entry in backup: " + zFile.Name)
+			}
+		} else {
+			continue
+		}
+
+		err = os.MkdirAll(filepath.Dir(target), 0700)
+		if err != nil {
+			return err
+		}
+
+		r, err := zFile.Open()
+		if err != nil {
+			return err
+		}
+		entry, err := ioutil.ReadAll(r)
+		r.Close()
+		if err != nil {
+			return err
+		}
+
+		err = ioutil.WriteFile(target, entry, 0600)
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func backupPassphrase() string {
+	passphrase := os.Getenv("GODEV_PASSPHRASE")
+	if passphrase != "" {
+		return passphrase
+	}
+
+	fmt.Print("Passphrase: ")
+	line, _ := bufio.NewReader(os.Stdin).ReadString('\n')
+	return strings.TrimRight(line, "\r\n")
+}
+
+// Implements the "godev backup <file>" and "godev restore <file>" commands
+func backupCommand(command string, args []string) error {
+	if len(args) != 1 {
+		return errors.New("Usage: godev " + command + " <file>")
+	}
+
+	passphrase := backupPassphrase()
+	if passphrase == "" {
+		return errors.New("A passphrase is required, provide it on the prompt or in the GODEV_PASSPHRASE environment variable")
+	}
+
+	if command == "backup" {
+		backup, err := createBackup(passphrase)
+		if err != nil {
+			return err
+		}
+
+		return ioutil.WriteFile(args[0], backup, 0600)
+	}
+
+	backup, err := ioutil.ReadFile(args[0])
+	if err != nil {
+		return err
+	}
+
+	return restoreBackup(backup, passphrase)
+}
+
+func adminBackupHandler(writer http.ResponseWriter, req *http.Request, path string, pathSegs []string) bool {
+	// The passphrase travels in a header to keep it out of any logged URLs
+	passphrase := req.Header.Get("X-Backup-Passphrase")
+
+	switch {
+	case req.Method == "POST" && pathSegs[1] == "backup":
+		if passphrase == "" {
+			ShowError(writer, 400, "No passphrase provided", nil)
+			return true
+		}
+
+		backup, err := createBackup(passphrase)
+		if err != nil {
+			ShowError(writer, 500, "Unable to create backup", err)
+			return true
+		}
+
+		writer.Header().Set("Content-Type", "application/octet-stream")
+		writer.Header().Set("Content-Disposition", `attachment; filename="godev.backup"`)
+		writer.WriteHeader(200)
+		writer.Write(backup)
+		return true
+	case req.Method == "POST" && pathSegs[1] == "restore":
+		if passphrase == "" {
+			ShowError(writer, 400, "No passphrase provided", nil)
+			return true
+		}
+
+		backup, err := ioutil.ReadAll(io.LimitReader(req.Body, maxBackupSize))
+		if err != nil {
+			ShowError(writer, 400, "Unable to read backup", err)
+			return true
+		}
+
+		err = restoreBackup(backup, passphrase)
+		if err != nil {
+			ShowError(writer, 400, "Unable to restore backup", err)
+			return true
+		}
+
+		writer.WriteHeader(204)
+		return true
+	}
+
+	return false
+}
@@ -6,6 +6,7 @@ package main
 
 import (
 	"bufio"
+	"context"
 	"encoding/json"
 	"net/http"
 	"os"
@@ -54,8 +55,8 @@ func blameHandler(writer http.ResponseWriter, req *http.Request, path string, pa
 	case req.Method == "GET" && pathSegs[1] == "file":
 		localFilePath := ""
 
-		for _, srcDir := range srcDirs {
-			path := filepath.Join(srcDir, strings.Join(pathSegs[2:], "/"))
+		for _, srcDir := range requestSrcDirs(req) {
+			path := filepath.Join(srcDir, filepath.Clean("/"+strings.Join(pathSegs[2:], "/")))
 
 			_, err := os.Stat(path)
 
@@ -104,8 +105,11 @@ func blameHandler(writer http.ResponseWriter, req *http.Request, path string, pa
 		blame := []Blame{}
 		var err error = nil
 
+		ctx, cancel := operationContext(req, *blameTimeout)
+		defer cancel()
+
 		if scmType == git {
-			blame, err = loadGitBlame(localFilePath)
+			blame, err = loadGitBlame(ctx, localFilePath)
 			if err != nil {
 				ShowError(writer, 400, "Unable to get git blame for file", err)
 				return true
@@ -113,7 +117,7 @@ func blameHandler(writer http.ResponseWriter, req *http.Request, path string, pa
 		}
 
 		if scmType == lscm {
-			blame, err = loadLscmBlame(localFilePath)
+			blame, err = loadLscmBlame(ctx, localFilePath)
 			if err != nil {
 				ShowError(writer, 400, "Unable to get jazz scm blame for file", err)
 				return true
@@ -121,7 +125,7 @@ func blameHandler(writer http.ResponseWriter, req *http.Request, path string, pa
 		}
 
 		if scmType == hg {
-			blame, err = loadHgBlame(localFilePath)
+			blame, err = loadHgBlame(ctx, localFilePath)
 			if err != nil {
 				ShowError(writer, 400, "Unable to get mercurial blame for file", err)
 				return true
@@ -135,8 +139,8 @@ func blameHandler(writer http.ResponseWriter, req *http.Request, path string, pa
 	return false
 }
 
-func loadGitBlame(path string) (blames []Blame, err error) {
-	cmd := exec.Command("git", "blame", path, "-p")
+func loadGitBlame(ctx context.Context, path string) (blames []Blame, err error) {
+	cmd := exec.CommandContext(ctx, "git", "blame", path, "-p")
 	// Start git in the directory so that it picks up the .git directory
 	cmd.Dir = filepath.Dir(path)
 	output, err := cmd.StdoutPipe()
@@ -265,8 +269,8 @@ func loadGitBlame(path string) (blames []Blame, err error) {
 	return blames, nil
 }
 
-func loadLscmBlame(path string) (blames []Blame, err error) {
-	cmd := exec.Command("lscm", "annotate", path, "--json")
+func loadLscmBlame(ctx context.Context, path string) (blames []Blame, err error) {
+	cmd := exec.CommandContext(ctx, "lscm", "annotate", path, "--json")
 	// Start the lscm command in the directory so that it picks up the correct
 	//  sandbox
 	cmd.Dir = filepath.Dir(path)
@@ -360,8 +364,8 @@ func loadLscmBlame(path string) (blames []Blame, err error) {
 	return blames, nil
 }
 
-func loadHgBlame(path string) (blames []Blame, err error) {
-	cmd := exec.Command("hg", "blame", "-vduc", path)
+func loadHgBlame(ctx context.Context, path string) (blames []Blame, err error) {
+	cmd := exec.CommandContext(ctx, "hg", "blame", "-vduc", path)
 	// Start git in the directory so that it picks up the .git directory
 	cmd.Dir = filepath.Dir(path)
 	output, err := cmd.StdoutPipe()
@@ -419,7 +423,7 @@ func loadHgBlame(path string) (blames []Blame, err error) {
 		summary := csSummary[blame.Name]
 		if summary == "" {
 			// Retrieve the change set summary
-			logCmd := exec.Command("hg", "log", "-r"+blame.Name)
+			logCmd := exec.CommandContext(ctx, "hg", "log", "-r"+blame.Name)
 			logCmd.Dir = filepath.Dir(path)
 			b, err := logCmd.Output()
 			if err == nil {
@@ -0,0 +1,224 @@
+// Copyright 2014 Chris McGee <sirnewton_01@yahoo.ca>. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+)
+
+type Bookmark struct {
+	Id       string
+	Name     string
+	Location string
+	Line     int
+	Label    string
+	Color    string
+}
+
+type Annotation struct {
+	Id       string
+	Location string
+	Line     int
+	Text     string
+	Color    string
+}
+
+type BookmarkData struct {
+	Bookmarks   []Bookmark
+	Annotations []Annotation
+}
+
+type BookmarkEvent struct {
+	Action     string
+	Bookmark   *Bookmark   `json:",omitempty"`
+	Annotation *Annotation `json:",omitempty"`
+}
+
+func bookmarksHandler(writer http.ResponseWriter, req *http.Request, path string, pathSegs []string) bool {
+	user := requestUser(req)
+
+	userDataMutex.Lock()
+	defer userDataMutex.Unlock()
+
+	data := BookmarkData{Bookmarks: []Bookmark{}, Annotations: []Annotation{}}
+	err := loadUserData(user, "bookmarks", &data)
+	if err != nil {
+		ShowError(writer, 500, "Unable to load bookmarks", err)
+		return true
+	}
+
+	isAnnotation := len(pathSegs) > 1 && pathSegs[1] == "annotations"
+	id := ""
+	if isAnnotation && len(pathSegs) > 2 {
+		id = pathSegs[2]
+	} else if !isAnnotation && len(pathSegs) > 1 {
+		id = pathSegs[1]
+	}
+
+	switch {
+	case req.Method == "GET" && id == "":
+		location := req.URL.Query().Get("location")
+		result := BookmarkData{Bookmarks: []Bookmark{}, Annotations: []Annotation{}}
+
+		for _, b := range data.Bookmarks {
+			if location == "" || b.Location == location {
+				result.Bookmarks = append(result.Bookmarks, b)
+			}
+		}
+		for _, a := range data.Annotations {
+			if location == "" || a.Location == location {
+				result.Annotations = append(result.Annotations, a)
+			}
+		}
+
+		if isAnnotation {
+			ShowJson(writer, 200, result.Annotations)
+		} else {
+			ShowJson(writer, 200, result.Bookmarks)
+		}
+		return true
+	case req.Method == "POST" && id == "" && !isAnnotation:
+		bookmark := Bookmark{}
+		err := json.NewDecoder(req.Body).Decode(&bookmark)
+		if err != nil || bookmark.Location == "" {
+			ShowError(writer, 400, "Invalid bookmark", err)
+			return true
+		}
+
+		bookmark.Id = newId()
+		data.Bookmarks = append(data.Bookmarks, bookmark)
+		if !saveBookmarks(writer, user, &data) {
+			return true
+		}
+
+		publishEvent(Event{Type: "bookmarks", User: user, Data: BookmarkEvent{Action: "added", Bookmark: &bookmark}})
+
+		writer.Header().Set("Location", "/bookmarks/"+bookmark.Id)
+		ShowJson(writer, 201, bookmark)
+		return true
+	case req.Method == "POST" && id == "" && isAnnotation:
+		annotation := Annotation{}
+		err := json.NewDecoder(req.Body).Decode(&annotation)
+		if err != nil || annotation.Location == "" {
+			ShowError(writer, 400, "Invalid annotation", err)
+			return true
+		}
+
+		annotation.Id = newId()
+		data.Annotations = append(data.Annotations, annotation)
+		if !saveBookmarks(writer, user, &data) {
+			return true
+		}
+
+		publishEvent(Event{Type: "bookmarks", User: user, Data: BookmarkEvent{Action: "added", Annotation: &annotation}})
+
+		writer.Header().Set("Location", "/bookmarks/annotations/"+annotation.Id)
+		ShowJson(writer, 201, annotation)
+		return true
+	case req.Method == "PUT" && id != "" && !isAnnotation:
+		for idx := range data.Bookmarks {
+			if data.Bookmarks[idx].Id != id {
+				continue
+			}
+
+			bookmark := Bookmark{}
+			err := json.NewDecoder(req.Body).Decode(&bookmark)
+			if err != nil {
+				ShowError(writer, 400, "Invalid bookmark", err)
+				return true
+			}
+
+			bookmark.Id = id
+			data.Bookmarks[idx] = bookmark
+			if !saveBookmarks(writer, user, &data) {
+				return true
+			}
+
+			publishEvent(Event{Type: "bookmarks", User: user, Data: BookmarkEvent{Action: "changed", Bookmark: &bookmark}})
+
+			ShowJson(writer, 200, bookmark)
+			return true
+		}
+
+		ShowError(writer, 404, "Bookmark not found", nil)
+		return true
+	case req.Method == "PUT" && id != "" && isAnnotation:
+		for idx := range data.Annotations {
+			if data.Annotations[idx].Id != id {
+				continue
+			}
+
+			annotation := Annotation{}
+			err := json.NewDecoder(req.Body).Decode(&annotation)
+			if err != nil {
+				ShowError(writer, 400, "Invalid annotation", err)
+				return true
+			}
+
+			annotation.Id = id
+			data.Annotations[idx] = annotation
+			if !saveBookmarks(writer, user, &data) {
+				return true
+			}
+
+			publishEvent(Event{Type: "bookmarks", User: user, Data: BookmarkEvent{Action: "changed", Annotation: &annotation}})
+
+			ShowJson(writer, 200, annotation)
+			return true
+		}
+
+		ShowError(writer, 404, "Annotation not found", nil)
+		return true
+	case req.Method == "DELETE" && id != "" && !isAnnotation:
+		for idx := range data.Bookmarks {
+			if data.Bookmarks[idx].Id != id {
+				continue
+			}
+
+			bookmark := data.Bookmarks[idx]
+			data.Bookmarks = append(data.Bookmarks[:idx], data.Bookmarks[idx+1:]...)
+			if !saveBookmarks(writer, user, &data) {
+				return true
+			}
+
+			publishEvent(Event{Type: "bookmarks", User: user, Data: BookmarkEvent{Action: "removed", Bookmark: &bookmark}})
+			break
+		}
+
+		writer.WriteHeader(204)
+		return true
+	case req.Method == "DELETE" && id != "" && isAnnotation:
+		for idx := range data.Annotations {
+			if data.Annotations[idx].Id != id {
+				continue
+			}
+
+			annotation := data.Annotations[idx]
+			data.Annotations = append(data.Annotations[:idx], data.Annotations[idx+1:]...)
+			if !saveBookmarks(writer, user, &data) {
+				return true
+			}
+
+			publishEvent(Event{Type: "bookmarks", User: user, Data: BookmarkEvent{Action: "removed", Annotation: &annotation}})
+			break
+		}
+
+		writer.WriteHeader(204)
+		return true
+	}
+
+	return false
+}
+
+func saveBookmarks(writer http.ResponseWriter, user string, data *BookmarkData) bool {
+	err := saveUserData(user, "bookmarks", data)
+	if err != nil {
+		ShowError(writer, 500, "Unable to save bookmarks", err)
+		return false
+	}
+
+	return true
+}
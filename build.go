@@ -7,25 +7,107 @@ package main
 import (
 	"bufio"
 	"bytes"
-	"io/ioutil"
+	"context"
+	"fmt"
 	"net/http"
 	"os"
 	"os/exec"
 	"path/filepath"
+	"regexp"
 	"strconv"
 	"strings"
+	"time"
 )
 
+// The go command, whose compilers and test binaries are its children. They
+// are killed with it once the context is done.
+func goCommand(ctx context.Context, args ...string) *exec.Cmd {
+	cmd := exec.CommandContext(ctx, "go", args...)
+	killGroupOnCancel(cmd)
+
+	return cmd
+}
+
 type CompileError struct {
 	Location string
 	Line     int64
 	Column   int64
 	Msg      string
+	// SEV_ERR for compile errors, SEV_WARN for the findings of go vet
+	Severity string
+	// Analyzer of a go vet finding
+	Code string `json:",omitempty"`
+	// Other places that the message refers to, such as the other
+	//  declaration of a name that is declared twice
+	Related []CompileNote `json:",omitempty"`
+}
+
+type CompileNote struct {
+	Location string
+	Line     int64
+	Column   int64
+	Msg      string
+}
+
+var (
+	// Position in an indented line that goes with the error above it, e.g.
+	//  "./a.go:3:6: other declaration of x" or "previous declaration at ./a.go:3:6"
+	buildNotePosition = regexp.MustCompile(`((?:[A-Za-z]:)?[^\s:]+\.go):(\d+)(?::(\d+))?`)
+)
+
+// Location in the workspace or GOROOT of a file of the build output
+func buildLocation(file string, workingDir string) string {
+	if !filepath.IsAbs(file) {
+		file = filepath.Join(workingDir, file)
+	}
+	file = filepath.Clean(file)
+
+	location := ""
+
+	for _, srcDir := range srcDirs {
+		pkgLoc := strings.Index(file, srcDir)
+		if pkgLoc == 0 {
+			location = filepath.Join("/file", file[len(srcDir):])
+		}
+	}
+
+	// Check the GOROOT for this error
+	if location == "" {
+		pkgLoc := strings.Index(file, goroot)
+		if pkgLoc == 0 {
+			location = filepath.Join("/file/GOROOT", file[len(goroot):])
+		}
+	}
+
+	return filepath.ToSlash(location)
 }
 
-func parseBuildOutput(cmd *exec.Cmd) (compileErrors []CompileError, err error) {
+// The note of an indented line that has a position, the rest of the line
+// is the message
+func buildNote(line string, workingDir string) (CompileNote, bool) {
+	match := buildNotePosition.FindStringSubmatchIndex(line)
+	if match == nil {
+		return CompileNote{}, false
+	}
+
+	note := CompileNote{Location: buildLocation(line[match[2]:match[3]], workingDir)}
+	note.Line, _ = strconv.ParseInt(line[match[4]:match[5]], 10, 64)
+	if match[6] != -1 {
+		note.Column, _ = strconv.ParseInt(line[match[6]:match[7]], 10, 64)
+	}
+
+	msg := strings.TrimSpace(line[:match[0]]) + " " + strings.TrimSpace(strings.TrimPrefix(line[match[1]:], ":"))
+	note.Msg = strings.TrimSpace(strings.TrimSuffix(strings.TrimSpace(msg), " at"))
+	return note, true
+}
+
+func parseBuildOutput(ctx context.Context, cmd *exec.Cmd) (compileErrors []CompileError, err error) {
 	buffer, _ := cmd.CombinedOutput()
 
+	if ctx.Err() != nil {
+		return []CompileError{}, ctx.Err()
+	}
+
 	reader := bytes.NewReader(buffer)
 	bufReader := bufio.NewReader(reader)
 
@@ -47,10 +129,14 @@ func parseBuildOutput(cmd *exec.Cmd) (compileErrors []CompileError, err error) {
 		if strings.HasPrefix(line, "#") {
 			// Skip comment lines
 		} else if strings.HasPrefix(line, "\t") && len(compileErrors) > 0 {
-			// Continuation of previous error message comment
-			prevCompileError := compileErrors[len(compileErrors)-1]
-			prevCompileError.Msg = prevCompileError.Msg + " " + line
-			compileErrors[len(compileErrors)-1] = prevCompileError
+			// Continuation of previous error message comment, the lines
+			//  with a position are related locations of the same error
+			prevCompileError := &compileErrors[len(compileErrors)-1]
+			if note, ok := buildNote(line, workingDir); ok {
+				prevCompileError.Related = append(prevCompileError.Related, note)
+			} else {
+				prevCompileError.Msg = prevCompileError.Msg + " " + line
+			}
 		} else if strings.Contains(line, ":") {
 			// Compile Error
 			pieces := strings.Split(line, ":")
@@ -62,27 +148,7 @@ func parseBuildOutput(cmd *exec.Cmd) (compileErrors []CompileError, err error) {
 				pieces = pieces[1:]
 			}
 
-			if !filepath.IsAbs(file) {
-				file = filepath.Join(workingDir, file)
-			}
-			file = filepath.Clean(file)
-
-			location := ""
-
-			for _, srcDir := range srcDirs {
-				pkgLoc := strings.Index(file, srcDir)
-				if pkgLoc == 0 {
-					location = filepath.Join("/file", file[len(srcDir):])
-				}
-			}
-
-			// Check the GOROOT for this error
-			if location == "" {
-				pkgLoc := strings.Index(file, goroot)
-				if pkgLoc == 0 {
-					location = filepath.Join("/file/GOROOT", file[len(goroot):])
-				}
-			}
+			location := buildLocation(file, workingDir)
 
 			l := pieces[1]
 			lineNum, err := strconv.ParseInt(l, 10, 64)
@@ -101,9 +167,8 @@ func parseBuildOutput(cmd *exec.Cmd) (compileErrors []CompileError, err error) {
 			}
 
 			msg := strings.Join(pieces, ":")
-			location = filepath.ToSlash(location)
 			error := CompileError{Location: location, Line: lineNum,
-				Column: columnNum, Msg: msg}
+				Column: columnNum, Msg: msg, Severity: SEV_ERR}
 			compileErrors = append(compileErrors, error)
 		}
 	}
@@ -115,20 +180,41 @@ func buildHandler(writer http.ResponseWriter, req *http.Request, path string, pa
 	switch {
 	case req.Method == "GET":
 		qValues := req.URL.Query()
-		pkg := qValues.Get("pkg")
+		pkg := workspacePackage(qValues.Get("pkg"))
 		install := qValues.Get("install")
 		race := qValues.Get("race")
+		vet := qValues.Get("vet")
+		user := requestUser(req)
+
+		ctx, cancel := operationContext(req, *buildTimeout)
+		defer cancel()
+		start := time.Now()
 
-		tmpFile, err := ioutil.TempFile("", "godev-build-temp")
+		// A rebuild starts from an empty build cache of the workspace
+		if qValues.Get("rebuild") == "true" {
+			err := clearWorkspaceCache(user, true, false)
+			if err != nil {
+				ShowError(writer, 500, "Unable to clear the build cache", err)
+				return true
+			}
+		}
+		defer func() {
+			go trimWorkspaceCache(user)
+		}()
+		env := workspaceEnv(user)
+
+		tmpFile, err := workspaceTempFile(user, "godev-build-temp")
 		if err != nil {
 			ShowError(writer, 500, "Unable to create temporary file for build", err)
 			return true
 		}
+		tmpFile.Close()
 
 		// Compile the regular parts of the package
 		tmpFileName := tmpFile.Name()
-		cmd := exec.Command("go", "build", "-o", tmpFileName, pkg)
-		compileErrors, err := parseBuildOutput(cmd)
+		cmd := goCommand(ctx, "build", "-o", tmpFileName, pkg)
+		cmd.Env = env
+		compileErrors, err := parseBuildOutput(ctx, cmd)
 		os.Remove(tmpFileName)
 
 		if err != nil {
@@ -141,9 +227,10 @@ func buildHandler(writer http.ResponseWriter, req *http.Request, path string, pa
 		// Too bad "go build" doesn't have a "-t" parameters to include the tests.
 		// Too bad that "go test -c" doesn't handle collisions, while "go test" does.
 		os.Mkdir(tmpFileName, os.ModeDir|0700)
-		cmd = exec.Command("go", "test", "-c", pkg)
+		cmd = goCommand(ctx, "test", "-c", pkg)
 		cmd.Dir = tmpFileName
-		testCompileErrors, err := parseBuildOutput(cmd)
+		cmd.Env = env
+		testCompileErrors, err := parseBuildOutput(ctx, cmd)
 		for _, newError := range testCompileErrors {
 			if strings.HasSuffix(newError.Location, "_test.go") {
 				compileErrors = append(compileErrors, newError)
@@ -157,10 +244,11 @@ func buildHandler(writer http.ResponseWriter, req *http.Request, path string, pa
 		}
 
 		if install == "true" && len(compileErrors) == 0 {
-			cmd := exec.Command("go", "install", pkg)
+			cmd := goCommand(ctx, "install", pkg)
 			if race == "true" {
-				cmd = exec.Command("go", "install", "-race", pkg)
+				cmd = goCommand(ctx, "install", "-race", pkg)
 			}
+			cmd.Env = env
 			err = cmd.Run()
 
 			if err != nil {
@@ -169,6 +257,21 @@ func buildHandler(writer http.ResponseWriter, req *http.Request, path string, pa
 			}
 		}
 
+		// Vet only has something to add once the package compiles
+		if vet == "true" && len(compileErrors) == 0 {
+			compileErrors, err = vetPackage(ctx, user, pkg)
+			if err != nil {
+				ShowError(writer, 500, "Error running go vet", err)
+				return true
+			}
+		}
+
+		if len(compileErrors) == 0 {
+			notifyFinished("Build succeeded", pkg, time.Since(start))
+		} else {
+			notifyFinished("Build failed", fmt.Sprintf("%v: %v problems", pkg, len(compileErrors)), time.Since(start))
+		}
+
 		ShowJson(writer, 200, compileErrors)
 		return true
 	}
@@ -0,0 +1,75 @@
+// Copyright 2014 Chris McGee <sirnewton_01@yahoo.ca>. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"context"
+	"os/exec"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestBuildNote(t *testing.T) {
+	workspace := filepath.Join(t.TempDir(), "src")
+	defer func(dirs []string) { srcDirs = dirs }(srcDirs)
+	srcDirs = []string{workspace}
+	dir := filepath.Join(workspace, "project")
+
+	tests := []struct {
+		line string
+		note CompileNote
+		ok   bool
+	}{
+		{"\t./a.go:3:6: other declaration of x", CompileNote{"/file/project/a.go", 3, 6, "other declaration of x"}, true},
+		{"\tprevious declaration at ./a.go:3:6", CompileNote{"/file/project/a.go", 3, 6, "previous declaration"}, true},
+		{"\t" + filepath.Join(dir, "pkg", "b.go") + ":12: imported here", CompileNote{"/file/project/pkg/b.go", 12, 0, "imported here"}, true},
+		{"\thave (int)", CompileNote{}, false},
+		{"\twant (string)", CompileNote{}, false},
+		{"\tsee the notes in a.txt:3", CompileNote{}, false},
+	}
+
+	for _, test := range tests {
+		note, ok := buildNote(test.line, dir)
+		if ok != test.ok || note != test.note {
+			t.Errorf("buildNote(%q) = %+v, %v, expected %+v, %v", test.line, note, ok, test.note, test.ok)
+		}
+	}
+}
+
+func TestParseBuildOutput(t *testing.T) {
+	workspace := filepath.Join(t.TempDir(), "src")
+	defer func(dirs []string) { srcDirs = dirs }(srcDirs)
+	srcDirs = []string{workspace}
+	file := filepath.Join(workspace, "project", "a.go")
+
+	output := strings.Join([]string{
+		"# example.com/project",
+		file + ":5:6: x redeclared in this block",
+		"\t" + file + ":3:6: other declaration of x",
+		file + ":9:2: cannot use s (variable of type string) as int value in assignment",
+		file + ":12: missing return",
+		"\thave (int)",
+		"",
+	}, "\n")
+
+	cmd := exec.Command("cat")
+	cmd.Stdin = strings.NewReader(output)
+	compileErrors, err := parseBuildOutput(context.Background(), cmd)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	expected := []CompileError{
+		{Location: "/file/project/a.go", Line: 5, Column: 6, Msg: " x redeclared in this block", Severity: SEV_ERR,
+			Related: []CompileNote{{"/file/project/a.go", 3, 6, "other declaration of x"}}},
+		{Location: "/file/project/a.go", Line: 9, Column: 2, Msg: " cannot use s (variable of type string) as int value in assignment", Severity: SEV_ERR},
+		{Location: "/file/project/a.go", Line: 12, Msg: " missing return \thave (int)", Severity: SEV_ERR},
+	}
+	if !reflect.DeepEqual(compileErrors, expected) {
+		t.Errorf("parseBuildOutput = %+v, expected %+v", compileErrors, expected)
+	}
+}
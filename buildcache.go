@@ -0,0 +1,206 @@
+// Copyright 2014 Chris McGee <sirnewton_01@yahoo.ca>. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"flag"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+)
+
+// Builds, tests and vet of each workspace (the GOPATH, a project of
+// "godev <dir>" or the workspace of an account) get a build cache and a
+// temporary directory of their own, so that the workspaces don't pollute
+// each other's cache and a clean build really starts from nothing.
+type WorkspaceCache struct {
+	Workspace  string
+	BuildCache string
+	TempDir    string
+	// Sizes in bytes
+	BuildCacheSize int64
+	TempDirSize    int64
+	// Size in bytes that the build cache is trimmed to, 0 for no limit
+	Limit int64
+}
+
+var (
+	cacheDir   = flag.String("cacheDir", "", "Directory of the build caches and temporary directories of the workspaces. (defaults to cache in the datadir)")
+	cacheLimit = flag.Int64("cacheLimit", 2048, "Size in megabytes that the build cache of a workspace is trimmed to after its builds and tests. (0 disables)")
+
+	cacheMutex sync.Mutex
+)
+
+// Name of the workspace that the user works in
+func workspaceName(user string) string {
+	if account := lookupAccount(user); account != nil {
+		return "account-" + unsafeNameChars.ReplaceAllString(account.Name, "_")
+	}
+	if projectDir != "" {
+		sum := sha256.Sum256([]byte(projectDir))
+		return "project-" + unsafeNameChars.ReplaceAllString(filepath.Base(projectDir), "_") + "-" + hex.EncodeToString(sum[:4])
+	}
+
+	return "gopath"
+}
+
+func workspaceCacheDirs(user string) (string, string) {
+	root := *cacheDir
+	if root == "" {
+		root = filepath.Join(godevDataDir(), "cache")
+	}
+	dir := filepath.Join(root, workspaceName(user))
+
+	return filepath.Join(dir, "build"), filepath.Join(dir, "tmp")
+}
+
+// Environment of the go commands of the user's workspace
+func workspaceEnv(user string) []string {
+	buildCache, tempDir := workspaceCacheDirs(user)
+	os.MkdirAll(buildCache, 0700)
+	os.MkdirAll(tempDir, 0700)
+
+	return append(os.Environ(), "GOCACHE="+buildCache, "GOTMPDIR="+tempDir, "TMPDIR="+tempDir)
+}
+
+// Temporary directory of the user's workspace
+func workspaceTempDir(user string) string {
+	_, tempDir := workspaceCacheDirs(user)
+	os.MkdirAll(tempDir, 0700)
+
+	return tempDir
+}
+
+func dirSize(dir string) int64 {
+	size := int64(0)
+	filepath.Walk(dir, func(path string, info os.FileInfo, err error) error {
+		if err == nil && !info.IsDir() {
+			size += info.Size()
+		}
+		return nil
+	})
+
+	return size
+}
+
+func workspaceCacheInfo(user string) WorkspaceCache {
+	buildCache, tempDir := workspaceCacheDirs(user)
+
+	return WorkspaceCache{Workspace: workspaceName(user), BuildCache: buildCache, TempDir: tempDir,
+		BuildCacheSize: dirSize(buildCache), TempDirSize: dirSize(tempDir), Limit: *cacheLimit << 20}
+}
+
+// Removes what is in the build cache, the temporary directory or both
+func clearWorkspaceCache(user string, build bool, temp bool) error {
+	cacheMutex.Lock()
+	defer cacheMutex.Unlock()
+
+	buildCache, tempDir := workspaceCacheDirs(user)
+	dirs := []string{}
+	if build {
+		dirs = append(dirs, buildCache)
+	}
+	if temp {
+		dirs = append(dirs, tempDir)
+	}
+
+	for _, dir := range dirs {
+		err := os.RemoveAll(dir)
+		if err != nil {
+			return err
+		}
+		err = os.MkdirAll(dir, 0700)
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// Removes the least recently used entries of the build cache until it is
+// within the limit. The go command keeps the modification times of the
+// entries that it uses up to date, and builds whatever is missing again.
+func trimWorkspaceCache(user string) {
+	if *cacheLimit <= 0 {
+		return
+	}
+
+	cacheMutex.Lock()
+	defer cacheMutex.Unlock()
+
+	buildCache, _ := workspaceCacheDirs(user)
+
+	files := []os.FileInfo{}
+	paths := make(map[os.FileInfo]string)
+	size := int64(0)
+	filepath.Walk(buildCache, func(path string, info os.FileInfo, err error) error {
+		if err == nil && info.Mode().IsRegular() && filepath.Dir(path) != buildCache {
+			files = append(files, info)
+			paths[info] = path
+			size += info.Size()
+		}
+		return nil
+	})
+
+	limit := *cacheLimit << 20
+	if size <= limit {
+		return
+	}
+
+	sort.Slice(files, func(i, j int) bool {
+		return files[i].ModTime().Before(files[j].ModTime())
+	})
+	for _, info := range files {
+		if size <= limit {
+			break
+		}
+		if os.Remove(paths[info]) == nil {
+			size -= info.Size()
+		}
+	}
+
+	buildLog.Infof("Trimmed the build cache of %v to %v bytes\n", workspaceName(user), size)
+}
+
+// GET /go/cache has the build cache and temporary directory of the
+// workspace. DELETE /go/cache clears both, or just one of them with
+// ?part=build or ?part=temp, so that the next build is a clean one.
+func cacheHandler(writer http.ResponseWriter, req *http.Request, path string, pathSegs []string) bool {
+	user := requestUser(req)
+
+	switch {
+	case req.Method == "GET" && len(pathSegs) == 2:
+		ShowJson(writer, 200, workspaceCacheInfo(user))
+		return true
+	case req.Method == "DELETE" && len(pathSegs) == 2:
+		part := req.URL.Query().Get("part")
+		if part != "" && part != "build" && part != "temp" {
+			ShowError(writer, 400, "Invalid part: "+part, nil)
+			return true
+		}
+
+		err := clearWorkspaceCache(user, part != "temp", part != "build")
+		if err != nil {
+			ShowError(writer, 500, "Unable to clear the cache", err)
+			return true
+		}
+
+		ShowJson(writer, 200, workspaceCacheInfo(user))
+		return true
+	}
+
+	return false
+}
+
+// Temporary file of the workspace, which is removed with the cache
+func workspaceTempFile(user string, prefix string) (*os.File, error) {
+	return ioutil.TempFile(workspaceTempDir(user), prefix)
+}
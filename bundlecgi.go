@@ -0,0 +1,90 @@
+// Copyright 2014 Chris McGee <sirnewton_01@yahoo.ca>. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/textproto"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+// Copies the CGI response, its header and then its body, to the writer. True
+// once the response has started.
+func copyCgiResponse(writer http.ResponseWriter, stdout io.Reader) (bool, error) {
+	response := bufio.NewReader(stdout)
+	header, err := textproto.NewReader(response).ReadMIMEHeader()
+	if err != nil {
+		return false, err
+	}
+
+	code := http.StatusOK
+	if status := header.Get("Status"); status != "" {
+		code, err = strconv.Atoi(strings.Fields(status + " ")[0])
+		if err != nil {
+			return false, errors.New("Invalid status of the CGI response: " + status)
+		}
+		header.Del("Status")
+	} else if header.Get("Location") != "" {
+		code = http.StatusFound
+	}
+	for name, values := range header {
+		for _, value := range values {
+			writer.Header().Add(name, value)
+		}
+	}
+	writer.WriteHeader(code)
+
+	_, err = io.Copy(writer, response)
+	return true, err
+}
+
+// Runs the CGI command for the request. Unlike with net/http/cgi the command
+// and its children are killed once the context is done, even when they
+// hang without writing anything.
+func serveCGI(ctx context.Context, writer http.ResponseWriter, req *http.Request, path string) {
+	cmd := exec.CommandContext(ctx, path, "-godev")
+	killGroupOnCancel(cmd)
+	// Like net/http/cgi, the command runs in its own directory
+	cmd.Dir = filepath.Dir(path)
+	cmd.Env = []string{"PATH=" + os.Getenv("PATH"), "GOPATH=" + os.Getenv("GOPATH")}
+	for name, value := range fcgiRequestParams(req, path) {
+		cmd.Env = append(cmd.Env, name+"="+value)
+	}
+	cmd.Stdin = req.Body
+	cmd.Stderr = handlersLog.std().Writer()
+
+	stdout, err := cmd.StdoutPipe()
+	if err == nil {
+		err = cmd.Start()
+	}
+	if err != nil {
+		ShowError(writer, 500, "Unable to run the bundle command", err)
+		return
+	}
+
+	started, err := copyCgiResponse(writer, stdout)
+	if err != nil {
+		handlersLog.Warnf("GODEV CGI CALL %v FAILED: %v\n", path, err)
+		if !started {
+			ShowError(writer, 502, "The bundle command failed", err)
+		}
+		// The rest of the output is of no use but the command can't exit
+		//  while it is blocked writing it
+		io.Copy(ioutil.Discard, stdout)
+	}
+
+	if err := cmd.Wait(); err != nil {
+		handlersLog.Printf("GODEV CGI EXITED: %v %v\n", path, err)
+	}
+}
@@ -0,0 +1,474 @@
+// Copyright 2014 Chris McGee <sirnewton_01@yahoo.ca>. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"bufio"
+	"context"
+	"encoding/binary"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"runtime"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Bundle commands that the bundle.json lists as FastCGI stay running and
+// serve the requests of /go/bundle-cgi over FastCGI, so that they can keep
+// their caches warm. The listening socket is their standard input like
+// FastCGI servers expect, a Go command only has to call fcgi.Serve(nil,
+// handler) instead of cgi.Serve(handler).
+
+const (
+	fcgiVersion = 1
+
+	fcgiBeginRequest = 1
+	fcgiEndRequest   = 3
+	fcgiParams       = 4
+	fcgiStdin        = 5
+	fcgiStdout       = 6
+	fcgiStderr       = 7
+
+	fcgiResponder = 1
+	// Every connection has one request
+	fcgiRequestId = 1
+
+	maxFcgiContent = 65535
+)
+
+// Running process of a FastCGI command and the socket that it serves on
+type fcgiProcess struct {
+	cmd    *exec.Cmd
+	proc   *ChildProcess
+	socket string
+	// The command that was started, a new build of it replaces the process
+	modTime time.Time
+	exited  chan struct{}
+}
+
+// The processes of a command, requests go to them in turn
+type fcgiPool struct {
+	path      string
+	mutex     sync.Mutex
+	processes []*fcgiProcess
+	next      int
+}
+
+var (
+	fcgiPoolsMutex sync.Mutex
+	fcgiPools      = make(map[string]*fcgiPool)
+)
+
+func init() {
+	registerGcTask("fastcgi", gcFcgi)
+}
+
+// Processes of the FastCGI command of a bundle, 0 when it is a plain CGI
+// command
+func (data *cfsData) fastcgiProcesses(command string) int {
+	for _, manifest := range data.manifests {
+		if manifest == nil {
+			continue
+		}
+		for _, fastcgi := range manifest.FastCGI {
+			if fastcgi != command {
+				continue
+			}
+
+			processes := manifest.Processes
+			if processes < 1 {
+				processes = 1
+			}
+			if processes > runtime.NumCPU() {
+				processes = runtime.NumCPU()
+			}
+			return processes
+		}
+	}
+
+	return 0
+}
+
+func fcgiPoolFor(path string) *fcgiPool {
+	fcgiPoolsMutex.Lock()
+	defer fcgiPoolsMutex.Unlock()
+
+	pool, ok := fcgiPools[path]
+	if !ok {
+		pool = &fcgiPool{path: path}
+		fcgiPools[path] = pool
+	}
+
+	return pool
+}
+
+func (p *fcgiProcess) running() bool {
+	select {
+	case <-p.exited:
+		return false
+	default:
+		return true
+	}
+}
+
+// Starts the command with a listening socket as its standard input
+func startFcgiProcess(path string, modTime time.Time) (*fcgiProcess, error) {
+	// Short path since sockets have a limit on their path
+	dir, err := newTempDir("godev-fcgi")
+	if err != nil {
+		return nil, err
+	}
+	socket := filepath.Join(dir, "fcgi.sock")
+
+	listener, err := net.ListenUnix("unix", &net.UnixAddr{Name: socket, Net: "unix"})
+	if err != nil {
+		removeTempDir(dir)
+		return nil, err
+	}
+	f, err := listener.File()
+	// The process listens from now on, the socket stays
+	listener.SetUnlinkOnClose(false)
+	listener.Close()
+	if err != nil {
+		removeTempDir(dir)
+		return nil, err
+	}
+	defer f.Close()
+
+	cmd := exec.Command(path, "-godev")
+	cmd.Stdin = f
+	cmd.Stdout = handlersLog.std().Writer()
+	cmd.Stderr = handlersLog.std().Writer()
+	// The same environment as the CGI commands
+	cmd.Env = []string{"PATH=" + os.Getenv("PATH"), "GOPATH=" + os.Getenv("GOPATH")}
+	if err := cmd.Start(); err != nil {
+		removeTempDir(dir)
+		return nil, err
+	}
+
+	p := &fcgiProcess{cmd: cmd, socket: socket, modTime: modTime, exited: make(chan struct{})}
+	// Idle processes are reaped like those of the sessions and started again
+	//  when they are needed. They serve every user, so they belong to the
+	//  server and not to whoever started them.
+	p.proc = registerProcess(serverProcessUser, "fastcgi", cmd, nil)
+	go func() {
+		cmd.Wait()
+		p.proc.unregister()
+		removeTempDir(dir)
+		close(p.exited)
+		handlersLog.Printf("GODEV FASTCGI EXITED: %v\n", path)
+	}()
+
+	handlersLog.Printf("GODEV FASTCGI STARTED: %v\n", path)
+	return p, nil
+}
+
+// A running process for the next request, the processes that exited or run
+// an older build of the command are replaced
+func (pool *fcgiPool) acquire(size int) (*fcgiProcess, error) {
+	info, err := os.Stat(pool.path)
+	if err != nil {
+		return nil, err
+	}
+
+	pool.mutex.Lock()
+	defer pool.mutex.Unlock()
+
+	processes := []*fcgiProcess{}
+	for _, p := range pool.processes {
+		switch {
+		case !p.running():
+		case !p.modTime.Equal(info.ModTime()) || len(processes) >= size:
+			p.proc.kill()
+		default:
+			processes = append(processes, p)
+		}
+	}
+	for len(processes) < size {
+		p, err := startFcgiProcess(pool.path, info.ModTime())
+		if err != nil {
+			if len(processes) > 0 {
+				break
+			}
+			pool.processes = processes
+			return nil, err
+		}
+		processes = append(processes, p)
+	}
+	pool.processes = processes
+
+	pool.next = (pool.next + 1) % len(processes)
+	p := processes[pool.next]
+	p.proc.touch()
+
+	return p, nil
+}
+
+// Pools of the commands that were removed and the sockets of processes
+// that are gone, such as those of a server that didn't shut down. The
+// sockets of other servers still accept connections.
+func gcFcgi(cutoff time.Time, result *GcResult) error {
+	fcgiPoolsMutex.Lock()
+	for path, pool := range fcgiPools {
+		if _, err := os.Stat(path); !os.IsNotExist(err) {
+			continue
+		}
+
+		pool.mutex.Lock()
+		for _, p := range pool.processes {
+			p.proc.kill()
+		}
+		pool.mutex.Unlock()
+
+		delete(fcgiPools, path)
+		result.Removed++
+	}
+	fcgiPoolsMutex.Unlock()
+
+	infos, err := ioutil.ReadDir(os.TempDir())
+	if err != nil {
+		return err
+	}
+
+	for _, info := range infos {
+		dir := filepath.Join(os.TempDir(), info.Name())
+		if !strings.HasPrefix(info.Name(), "godev-fcgi") || !info.ModTime().Before(cutoff) {
+			continue
+		}
+
+		tempDirsMutex.Lock()
+		inUse := tempDirsInUse[dir]
+		tempDirsMutex.Unlock()
+		if inUse {
+			continue
+		}
+
+		conn, err := net.DialTimeout("unix", filepath.Join(dir, "fcgi.sock"), time.Second)
+		if err == nil {
+			conn.Close()
+			continue
+		}
+		gcRemove(dir, result)
+	}
+
+	return nil
+}
+
+func writeFcgiRecord(w io.Writer, recordType byte, content []byte) error {
+	padding := (8 - len(content)%8) % 8
+	header := []byte{fcgiVersion, recordType, 0, fcgiRequestId, 0, 0, byte(padding), 0}
+	binary.BigEndian.PutUint16(header[4:6], uint16(len(content)))
+
+	if _, err := w.Write(header); err != nil {
+		return err
+	}
+	if _, err := w.Write(content); err != nil {
+		return err
+	}
+	_, err := w.Write(make([]byte, padding))
+	return err
+}
+
+// Writes the content as a stream of records, ended by an empty one
+func writeFcgiStream(w io.Writer, recordType byte, content []byte) error {
+	for len(content) > 0 {
+		n := len(content)
+		if n > maxFcgiContent {
+			n = maxFcgiContent
+		}
+		if err := writeFcgiRecord(w, recordType, content[:n]); err != nil {
+			return err
+		}
+		content = content[n:]
+	}
+
+	return writeFcgiRecord(w, recordType, nil)
+}
+
+func fcgiPairLength(b []byte, n int) []byte {
+	if n < 128 {
+		return append(b, byte(n))
+	}
+
+	length := make([]byte, 4)
+	binary.BigEndian.PutUint32(length, uint32(n)|1<<31)
+	return append(b, length...)
+}
+
+// The CGI variables of the request for the CGI and FastCGI commands, as
+// net/http/cgi passes them
+func fcgiRequestParams(req *http.Request, path string) map[string]string {
+	params := map[string]string{
+		"SERVER_SOFTWARE":   "go",
+		"SERVER_PROTOCOL":   "HTTP/1.1",
+		"GATEWAY_INTERFACE": "CGI/1.1",
+		"REQUEST_METHOD":    req.Method,
+		"QUERY_STRING":      req.URL.RawQuery,
+		"REQUEST_URI":       req.URL.RequestURI(),
+		"SCRIPT_NAME":       "",
+		"SCRIPT_FILENAME":   path,
+		"PATH_INFO":         req.URL.Path,
+		"HTTP_HOST":         req.Host,
+	}
+
+	host, port, err := net.SplitHostPort(req.Host)
+	if err != nil {
+		host, port = req.Host, "80"
+	}
+	params["SERVER_NAME"], params["SERVER_PORT"] = host, port
+
+	if remoteHost, remotePort, err := net.SplitHostPort(req.RemoteAddr); err == nil {
+		params["REMOTE_ADDR"], params["REMOTE_HOST"], params["REMOTE_PORT"] = remoteHost, remoteHost, remotePort
+	}
+	if req.TLS != nil {
+		params["HTTPS"] = "on"
+	}
+
+	for name, values := range req.Header {
+		name = strings.ToUpper(strings.Replace(name, "-", "_", -1))
+		// Proxy would become HTTP_PROXY for the command's HTTP clients
+		if name == "PROXY" {
+			continue
+		}
+		params["HTTP_"+name] = strings.Join(values, ", ")
+	}
+	if req.ContentLength > 0 {
+		params["CONTENT_LENGTH"] = strconv.FormatInt(req.ContentLength, 10)
+	}
+	if contentType := req.Header.Get("Content-Type"); contentType != "" {
+		params["CONTENT_TYPE"] = contentType
+	}
+
+	return params
+}
+
+// Sends the request to the process and copies its CGI response to the
+// writer, true once the response has started
+func fcgiServe(ctx context.Context, writer http.ResponseWriter, req *http.Request, p *fcgiProcess, path string) (bool, error) {
+	conn, err := net.DialTimeout("unix", p.socket, 5*time.Second)
+	if err != nil {
+		return false, err
+	}
+	defer conn.Close()
+
+	// A request that is done takes the connection down with it
+	stop := make(chan struct{})
+	defer close(stop)
+	go func() {
+		select {
+		case <-ctx.Done():
+			conn.Close()
+		case <-stop:
+		}
+	}()
+
+	w := bufio.NewWriter(conn)
+	begin := []byte{0, fcgiResponder, 0, 0, 0, 0, 0, 0}
+	if err := writeFcgiRecord(w, fcgiBeginRequest, begin); err != nil {
+		return false, err
+	}
+	params := []byte{}
+	for name, value := range fcgiRequestParams(req, path) {
+		params = fcgiPairLength(fcgiPairLength(params, len(name)), len(value))
+		params = append(append(params, name...), value...)
+	}
+	if err := writeFcgiStream(w, fcgiParams, params); err != nil {
+		return false, err
+	}
+	if err := w.Flush(); err != nil {
+		return false, err
+	}
+
+	// The body goes out while the response comes in, a large response
+	//  could otherwise block the process before it has read the body. The
+	//  body belongs to the request, so the closed connection stops the
+	//  sending before this returns.
+	bodySent := make(chan struct{})
+	go func() {
+		defer close(bodySent)
+		buf := make([]byte, maxFcgiContent)
+		for req.Body != nil {
+			n, err := req.Body.Read(buf)
+			if n > 0 && (writeFcgiRecord(w, fcgiStdin, buf[:n]) != nil || w.Flush() != nil) {
+				return
+			}
+			if err != nil {
+				break
+			}
+		}
+		writeFcgiRecord(w, fcgiStdin, nil)
+		w.Flush()
+	}()
+	defer func() {
+		conn.Close()
+		<-bodySent
+	}()
+
+	stdout, stdoutWriter := io.Pipe()
+	go func() {
+		stdoutWriter.CloseWithError(readFcgiRecords(conn, stdoutWriter))
+	}()
+	defer stdout.Close()
+
+	return copyCgiResponse(writer, stdout)
+}
+
+// Reads the records of the response until the end of the request, the
+// output goes to stdout and the errors to the log
+func readFcgiRecords(conn io.Reader, stdout io.Writer) error {
+	r := bufio.NewReader(conn)
+	header := make([]byte, 8)
+	for {
+		if _, err := io.ReadFull(r, header); err != nil {
+			return err
+		}
+		length := int(binary.BigEndian.Uint16(header[4:6]))
+		content := make([]byte, length+int(header[6]))
+		if _, err := io.ReadFull(r, content); err != nil {
+			return err
+		}
+		content = content[:length]
+
+		switch header[1] {
+		case fcgiStdout:
+			if _, err := stdout.Write(content); err != nil {
+				return err
+			}
+		case fcgiStderr:
+			if len(content) > 0 {
+				handlersLog.Printf("GODEV FASTCGI: %s\n", strings.TrimSpace(string(content)))
+			}
+		case fcgiEndRequest:
+			return io.EOF
+		}
+	}
+}
+
+// Serves the request with a process of the FastCGI command, false when no
+// process could be started so that it runs as a CGI command instead
+func serveFastCGI(ctx context.Context, writer http.ResponseWriter, req *http.Request, path string, processes int) bool {
+	p, err := fcgiPoolFor(path).acquire(processes)
+	if err != nil {
+		handlersLog.Warnf("Unable to start the FastCGI command %v, running it as CGI: %v\n", path, err)
+		return false
+	}
+
+	started, err := fcgiServe(ctx, writer, req, p, path)
+	if err != nil {
+		handlersLog.Warnf("GODEV FASTCGI CALL %v FAILED: %v\n", path, err)
+		if !started {
+			ShowError(writer, 502, "The bundle command failed", err)
+		}
+	}
+
+	return true
+}
@@ -0,0 +1,342 @@
+// Copyright 2014 Chris McGee <sirnewton_01@yahoo.ca>. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"unicode"
+)
+
+// Bundle of the chained file system as GET /bundles lists it
+type BundleInfo struct {
+	Name      string
+	Version   string `json:",omitempty"`
+	Priority  int    `json:",omitempty"`
+	PluginKey string `json:",omitempty"`
+	// The module of an installed bundle and its version, the bundles of
+	//  the workspace and the core ones aren't installed
+	ImportPath    string `json:",omitempty"`
+	ModuleVersion string `json:",omitempty"`
+	Installed     bool
+	Dir           string
+}
+
+type BundleList struct {
+	Bundles []BundleInfo
+	// Why each bundle that can't be loaded was rejected, by its path
+	Rejected map[string]string
+}
+
+type BundleInstallRequest struct {
+	// Path of the module with the godev-bundle and its version, the latest
+	//  by default
+	ImportPath string
+	Version    string
+}
+
+// Installed bundles are kept apart from the workspace so that they don't
+// show up in it. The modules are downloaded to a module cache of their own
+// and their commands go to its bin directory.
+func bundleInstallDir() string {
+	return filepath.Join(godevDataDir(), "bundles")
+}
+
+func bundleModuleDir() string {
+	return filepath.Join(bundleInstallDir(), "pkg", "mod")
+}
+
+// The bin directory of the installed bundles' commands is next to this
+// directory like for the source directories of the GOPATH
+func bundleSrcDir() string {
+	return filepath.Join(bundleInstallDir(), "src")
+}
+
+// Module of an installed bundle and its version, empty for the other
+// bundles. The directories of the module cache are the escaped module path
+// with @<version>.
+func installedModule(dir string) (string, string) {
+	relPath, err := filepath.Rel(bundleModuleDir(), dir)
+	if err != nil || relPath == "." || strings.HasPrefix(relPath, "..") {
+		return "", ""
+	}
+
+	parts := strings.Split(filepath.ToSlash(relPath), "/")
+	for idx, part := range parts {
+		if at := strings.LastIndex(part, "@"); at != -1 {
+			modulePath := strings.Join(append(append([]string{}, parts[:idx]...), part[:at]), "/")
+			return unescapeModulePath(modulePath), unescapeModulePath(part[at+1:])
+		}
+	}
+
+	return "", ""
+}
+
+// Upper case letters of module paths are !<letter> in the module cache
+func escapeModulePath(modulePath string) string {
+	escaped := strings.Builder{}
+	for _, r := range modulePath {
+		if unicode.IsUpper(r) {
+			escaped.WriteRune('!')
+			r = unicode.ToLower(r)
+		}
+		escaped.WriteRune(r)
+	}
+	return escaped.String()
+}
+
+func unescapeModulePath(escaped string) string {
+	modulePath := strings.Builder{}
+	upper := false
+	for _, r := range escaped {
+		switch {
+		case r == '!':
+			upper = true
+			continue
+		case upper:
+			r = unicode.ToUpper(r)
+		}
+		upper = false
+		modulePath.WriteRune(r)
+	}
+	return modulePath.String()
+}
+
+func validBundleImportPath(importPath string, version string) error {
+	switch {
+	case importPath == "":
+		return errors.New("Missing import path")
+	case strings.HasPrefix(importPath, "-") || strings.HasPrefix(importPath, "/") || strings.HasPrefix(importPath, "."):
+		return errors.New("Invalid import path: " + importPath)
+	case strings.Contains(importPath, "..") || strings.ContainsAny(importPath, "\\ @!"):
+		return errors.New("Invalid import path: " + importPath)
+	case strings.HasPrefix(version, "-") || strings.ContainsAny(version, "/\\ @"):
+		return errors.New("Invalid version: " + version)
+	}
+
+	return nil
+}
+
+func (data *cfsData) bundleList() BundleList {
+	list := BundleList{Bundles: []BundleInfo{}, Rejected: data.Rejected}
+
+	for idx, dir := range data.dirs {
+		info := BundleInfo{Name: data.names[idx], PluginKey: data.pluginKeys[idx], Dir: dir}
+		if manifest := data.manifests[idx]; manifest != nil {
+			info.Version, info.Priority = manifest.Version, manifest.Priority
+		}
+		if modulePath, version := installedModule(dir); modulePath != "" {
+			info.ImportPath, info.ModuleVersion, info.Installed = modulePath, version, true
+		}
+		list.Bundles = append(list.Bundles, info)
+	}
+
+	return list
+}
+
+// The godev-bundle directories and archives of a module
+func moduleBundles(moduleDir string) []string {
+	bundles := []string{}
+	filepath.Walk(moduleDir, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return nil
+		}
+		if info.IsDir() && path != moduleDir && strings.HasPrefix(info.Name(), ".") {
+			return filepath.SkipDir
+		}
+		if info.Name() == "godev-bundle" || info.Name() == "godev-bundle.zip" {
+			bundles = append(bundles, path)
+		}
+		return nil
+	})
+
+	return bundles
+}
+
+// Downloads the module like go get does and installs its commands, for the
+// bundles that call them through /go/bundle-cgi. Other versions of the
+// module are uninstalled since their bundles have the same plugins. The
+// module's bundles are returned.
+func installBundle(ctx context.Context, importPath string, version string) ([]string, error) {
+	installDir := bundleInstallDir()
+	if err := os.MkdirAll(bundleSrcDir(), 0700); err != nil {
+		return nil, err
+	}
+
+	// The module cache is writable so that uninstalling can remove it
+	env := append(os.Environ(), "GOMODCACHE="+bundleModuleDir(), "GOBIN="+filepath.Join(installDir, "bin"),
+		"GOFLAGS=-modcacherw", "GO111MODULE=on", "GIT_TERMINAL_PROMPT=0")
+
+	cmd := exec.CommandContext(ctx, "go", "mod", "download", "-json", importPath+"@"+version)
+	cmd.Env = env
+	cmd.Dir = installDir
+	out, err := cmd.Output()
+	module := struct {
+		Path    string
+		Version string
+		Dir     string
+		Error   string
+	}{}
+	json.Unmarshal(out, &module)
+	if err != nil || module.Error != "" || module.Dir == "" {
+		if ctx.Err() != nil {
+			return nil, ctx.Err()
+		}
+		if module.Error != "" {
+			return nil, errors.New(module.Error)
+		}
+		if exitErr, ok := err.(*exec.ExitError); ok {
+			return nil, fmt.Errorf("%v\n%s", err, exitErr.Stderr)
+		}
+		return nil, fmt.Errorf("Unable to download %v: %v", importPath, err)
+	}
+
+	bundles := moduleBundles(module.Dir)
+	if len(bundles) == 0 {
+		return nil, errors.New("The module " + module.Path + " has no godev-bundle")
+	}
+
+	// Only some modules have commands, those without don't stop the bundles
+	//  from working
+	cmd = exec.CommandContext(ctx, "go", "install", module.Path+"/...@"+module.Version)
+	cmd.Env = env
+	cmd.Dir = installDir
+	if out, err := cmd.CombinedOutput(); err != nil {
+		cfsLog.Warnf("Unable to install the commands of the bundle %v: %v\n%s", module.Path, err, out)
+	}
+
+	versions, _ := filepath.Glob(filepath.Join(bundleModuleDir(), escapeModulePath(module.Path)+"@*"))
+	for _, dir := range versions {
+		if dir != module.Dir {
+			if err := os.RemoveAll(dir); err != nil {
+				cfsLog.Warnf("Unable to uninstall %v: %v\n", dir, err)
+			}
+		}
+	}
+
+	return bundles, nil
+}
+
+// Removes the module of an installed bundle, the bundle goes away with the
+// next clean up of the stale bundles
+func uninstallBundle(dir string) error {
+	modulePath, version := installedModule(dir)
+	if modulePath == "" {
+		return errors.New("The bundle isn't installed: " + dir)
+	}
+
+	moduleDir := filepath.Join(bundleModuleDir(), escapeModulePath(modulePath)+"@"+version)
+	return os.RemoveAll(moduleDir)
+}
+
+// GET /bundles lists the bundles that are loaded with their versions and
+// the ones that were rejected. POST /bundles installs the bundles of the
+// module with the ImportPath and Version of the body, like go get, and loads
+// them right away. DELETE /bundles/<name> uninstalls the module of the
+// bundle, only installed bundles can be uninstalled.
+func (h *Handlers) bundlesHandler(writer http.ResponseWriter, req *http.Request, path string, pathSegs []string) bool {
+	switch {
+	case req.Method == "GET" && (len(pathSegs) == 1 || (len(pathSegs) == 2 && pathSegs[1] == "")):
+		ShowJson(writer, 200, h.fs.snapshot().bundleList())
+		return true
+	case req.Method == "POST" && (len(pathSegs) == 1 || (len(pathSegs) == 2 && pathSegs[1] == "")):
+		request := BundleInstallRequest{}
+		if err := json.NewDecoder(req.Body).Decode(&request); err != nil {
+			ShowError(writer, 400, "Invalid bundle request", err)
+			return true
+		}
+		request.ImportPath = strings.TrimSuffix(strings.TrimSpace(request.ImportPath), "/")
+		if request.Version == "" {
+			request.Version = "latest"
+		}
+		if err := validBundleImportPath(request.ImportPath, request.Version); err != nil {
+			ShowError(writer, 400, err.Error(), nil)
+			return true
+		}
+
+		ctx, cancel := operationContext(req, *buildTimeout)
+		defer cancel()
+
+		cfsLog.Infof("INSTALLING BUNDLE %v@%v for %v\n", request.ImportPath, request.Version, requestUser(req))
+		dirs, err := installBundle(ctx, request.ImportPath, request.Version)
+		if ctx.Err() == context.DeadlineExceeded {
+			ShowError(writer, 504, "The bundle did not install in time", ctx.Err())
+			return true
+		}
+		if err != nil {
+			ShowError(writer, 400, "Unable to install the bundle "+request.ImportPath, err)
+			return true
+		}
+
+		// The bundles of the version that was replaced go first
+		h.fs.cleanStalePaths()
+		for _, dir := range dirs {
+			h.fs.checkNewPath(dir)
+		}
+
+		data := h.fs.snapshot()
+		installed := []BundleInfo{}
+		rejected := map[string]string{}
+		for _, dir := range dirs {
+			for _, info := range data.bundleList().Bundles {
+				if info.Dir == dir {
+					installed = append(installed, info)
+				}
+			}
+			// A bundle that is rejected stays installed, it loads once it or
+			//  godev is updated
+			if problem, ok := data.Rejected[dir]; ok {
+				rejected[dir] = problem
+			}
+		}
+		if len(installed) == 0 && len(rejected) == 0 {
+			ShowError(writer, 409, "The bundles of "+request.ImportPath+" have the same plugins as bundles that are loaded", nil)
+			return true
+		}
+
+		ShowJson(writer, 201, BundleList{Bundles: installed, Rejected: rejected})
+		return true
+	case req.Method == "DELETE" && len(pathSegs) == 2 && pathSegs[1] != "":
+		dir := ""
+		found := false
+		data := h.fs.snapshot()
+		for idx, name := range data.names {
+			if name == pathSegs[1] {
+				found = true
+				if modulePath, _ := installedModule(data.dirs[idx]); modulePath != "" {
+					dir = data.dirs[idx]
+					break
+				}
+			}
+		}
+		if !found {
+			ShowError(writer, 404, "No bundle is named "+pathSegs[1], nil)
+			return true
+		}
+		if dir == "" {
+			ShowError(writer, 409, "The bundle "+pathSegs[1]+" is found in the workspace or is a core bundle, it isn't installed", nil)
+			return true
+		}
+
+		cfsLog.Infof("UNINSTALLING BUNDLE %v for %v\n", dir, requestUser(req))
+		if err := uninstallBundle(dir); err != nil {
+			ShowError(writer, 500, "Unable to uninstall the bundle", err)
+			return true
+		}
+		h.fs.cleanStalePaths()
+
+		writer.WriteHeader(204)
+		return true
+	}
+
+	return false
+}
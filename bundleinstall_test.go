@@ -0,0 +1,48 @@
+// Copyright 2014 Chris McGee <sirnewton_01@yahoo.ca>. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"testing"
+)
+
+func TestValidBundleImportPath(t *testing.T) {
+	tests := []struct {
+		importPath string
+		version    string
+		valid      bool
+	}{
+		{"github.com/user/bundle", "", true},
+		{"github.com/user/bundle", "latest", true},
+		{"github.com/user/bundle", "v1.2.3", true},
+		{"github.com/user/bundle/sub", "v0.0.0-20200101000000-abcdef123456", true},
+		{"example.com/Bundle_v2", "master", true},
+		{"", "", false},
+		{"-toolexec=cmd", "", false},
+		{"/etc/bundle", "", false},
+		{"./bundle", "", false},
+		{".hidden/bundle", "", false},
+		{"github.com/user/../../bundle", "", false},
+		{"github.com\\user\\bundle", "", false},
+		{"github.com/user/bundle extra", "", false},
+		{"github.com/user/bundle@v1.0.0", "", false},
+		{"github.com/user/!bundle", "", false},
+		{"github.com/user/bundle", "-x", false},
+		{"github.com/user/bundle", "v1/../../x", false},
+		{"github.com/user/bundle", "v1\\x", false},
+		{"github.com/user/bundle", "v1 v2", false},
+		{"github.com/user/bundle", "v1@latest", false},
+	}
+
+	for _, test := range tests {
+		err := validBundleImportPath(test.importPath, test.version)
+		if test.valid && err != nil {
+			t.Errorf("%q at %q was refused: %v", test.importPath, test.version, err)
+		}
+		if !test.valid && err == nil {
+			t.Errorf("%q at %q was allowed", test.importPath, test.version)
+		}
+	}
+}
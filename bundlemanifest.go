@@ -0,0 +1,193 @@
+// Copyright 2014 Chris McGee <sirnewton_01@yahoo.ca>. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// The optional bundle.json of a bundle, next to its bundle.html or, for a
+// core bundle, next to its web directory:
+//
+//	{"Name": "lint", "Version": "1.2.0", "Priority": 10, "Requires": "1.0", "Commands": ["golintcgi"],
+//	 "FastCGI": ["golintcgi"], "Processes": 2}
+type BundleManifest struct {
+	// Name of the bundle under /bundle/<name>/, its directory by default
+	Name    string `json:",omitempty"`
+	Version string `json:",omitempty"`
+	// Bundles with a higher priority come first and shadow the files of the
+	//  others, bundles of the same priority keep the order they are found in
+	Priority int `json:",omitempty"`
+	// Lowest version of godev that the bundle works with
+	Requires string `json:",omitempty"`
+	// Commands of the bin directories of the GOPATH that the bundle calls
+	//  through /go/bundle-cgi
+	Commands []string `json:",omitempty"`
+	// Commands that stay running and serve their requests over FastCGI
+	//  instead of starting for each request, and how many processes each of
+	//  them has, 1 by default
+	FastCGI   []string `json:",omitempty"`
+	Processes int      `json:",omitempty"`
+}
+
+var (
+	// Set for a release with -ldflags "-X main.godevVersion=<version>"
+	godevVersion = "1.0.0"
+)
+
+// Reads the manifest of a bundle, nil when it has none
+func readBundleManifest(layer http.FileSystem, name string) (*BundleManifest, error) {
+	f, err := layer.Open(name)
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	b, err := ioutil.ReadAll(f)
+	if err != nil {
+		return nil, err
+	}
+
+	manifest := &BundleManifest{}
+	if err := json.Unmarshal(b, manifest); err != nil {
+		return nil, errors.New("Invalid bundle.json: " + err.Error())
+	}
+
+	return manifest, nil
+}
+
+// Compares versions like 1.2.3 by their numbers, a missing number is 0
+func compareVersions(a string, b string) (int, error) {
+	parse := func(version string) ([]int, error) {
+		numbers := []int{}
+		for _, part := range strings.Split(strings.TrimPrefix(strings.TrimSpace(version), "v"), ".") {
+			// Pre-release and build suffixes don't count
+			if idx := strings.IndexAny(part, "-+"); idx != -1 {
+				part = part[:idx]
+			}
+			n, err := strconv.Atoi(part)
+			if err != nil || n < 0 {
+				return nil, errors.New("Invalid version: " + version)
+			}
+			numbers = append(numbers, n)
+		}
+		return numbers, nil
+	}
+
+	va, err := parse(a)
+	if err != nil {
+		return 0, err
+	}
+	vb, err := parse(b)
+	if err != nil {
+		return 0, err
+	}
+
+	for idx := 0; idx < len(va) || idx < len(vb); idx++ {
+		na, nb := 0, 0
+		if idx < len(va) {
+			na = va[idx]
+		}
+		if idx < len(vb) {
+			nb = vb[idx]
+		}
+		if na != nb {
+			if na < nb {
+				return -1, nil
+			}
+			return 1, nil
+		}
+	}
+
+	return 0, nil
+}
+
+// Why the bundle of the manifest can't be loaded, empty when it can
+func (manifest *BundleManifest) problem() string {
+	if manifest == nil {
+		return ""
+	}
+
+	if strings.ContainsAny(manifest.Name, "/\\") || strings.HasPrefix(manifest.Name, ".") {
+		return "Invalid bundle name " + manifest.Name + " in bundle.json"
+	}
+	if manifest.Version != "" {
+		if _, err := compareVersions(manifest.Version, "0"); err != nil {
+			return err.Error() + " in bundle.json"
+		}
+	}
+
+	if required := strings.TrimPrefix(strings.TrimSpace(manifest.Requires), ">="); required != "" {
+		order, err := compareVersions(godevVersion, required)
+		if err != nil {
+			return err.Error() + " in the Requires of bundle.json"
+		}
+		if order < 0 {
+			return fmt.Sprintf("The bundle needs godev %v or later, this is godev %v", required, godevVersion)
+		}
+	}
+
+	return ""
+}
+
+// Warns about the commands of the manifest that can't be found, the bundle
+// still loads since the command can be installed while godev runs
+func (manifest *BundleManifest) checkCommands(bundle string) {
+	if manifest == nil {
+		return
+	}
+
+	for _, command := range manifest.Commands {
+		found := false
+		for _, srcDir := range append(append([]string{}, srcDirs...), bundleSrcDir()) {
+			if _, err := os.Stat(filepath.Join(srcDir, "../bin", command)); err == nil {
+				found = true
+				break
+			}
+		}
+		if !found {
+			cfsLog.Warnf("The bundle %v calls the command %v, which isn't in the bin directory of the GOPATH\n", bundle, command)
+		}
+	}
+}
+
+// Orders the bundles of a copy that isn't published yet by their priority
+func (data *cfsData) sortBundles() {
+	order := make([]int, len(data.dirs))
+	for idx := range order {
+		order[idx] = idx
+	}
+	priority := func(idx int) int {
+		if data.manifests[idx] == nil {
+			return 0
+		}
+		return data.manifests[idx].Priority
+	}
+	sort.SliceStable(order, func(i, j int) bool { return priority(order[i]) > priority(order[j]) })
+
+	fs := make([]http.FileSystem, len(order))
+	dirs := make([]string, len(order))
+	names := make([]string, len(order))
+	pluginKeys := make([]string, len(order))
+	manifests := make([]*BundleManifest, len(order))
+	for idx, from := range order {
+		fs[idx], dirs[idx], names[idx] = data.fs[from], data.dirs[from], data.names[from]
+		pluginKeys[idx], manifests[idx] = data.pluginKeys[from], data.manifests[from]
+	}
+
+	data.fs, data.dirs, data.names, data.pluginKeys, data.manifests = fs, dirs, names, pluginKeys, manifests
+}
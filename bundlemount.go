@@ -0,0 +1,85 @@
+// Copyright 2014 Chris McGee <sirnewton_01@yahoo.ca>. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"flag"
+	"net/http"
+	"os"
+	"sort"
+	"strings"
+)
+
+// A file that more than one bundle has at the merged root. The first bundle
+// in the order of the bundles serves it, the others are shadowed.
+type BundleConflict struct {
+	Path     string
+	Served   string
+	Shadowed []string
+}
+
+var (
+	bundleMounts = flag.Bool("bundleMounts", false, "Also serve each bundle on its own under /bundle/<name>/, whatever the other bundles have at the same paths.")
+)
+
+// Opens /bundle/<name>/<path> from the bundle of that name, ok tells whether
+// the name is one of these
+func (data *cfsData) openMounted(name string) (http.File, bool, error) {
+	if !*bundleMounts || !strings.HasPrefix(name, "/bundle/") {
+		return nil, false, nil
+	}
+
+	segs := strings.SplitN(strings.TrimPrefix(name, "/bundle/"), "/", 2)
+	for idx, bundleName := range data.names {
+		if bundleName != segs[0] {
+			continue
+		}
+
+		path := "/"
+		if len(segs) == 2 {
+			path += segs[1]
+		}
+		f, err := data.fs[idx].Open(path)
+		if err != nil {
+			return nil, true, err
+		}
+		return noReaddirFile{f}, true, nil
+	}
+
+	return nil, true, os.ErrNotExist
+}
+
+// Files at the merged root that more than one bundle has
+func (data *cfsData) conflicts() []BundleConflict {
+	bundles := make(map[string][]string)
+	for idx, dir := range data.dirs {
+		walkBundle(data.fs[idx], dir, func(relPath string, read func() ([]byte, error)) {
+			bundles[relPath] = append(bundles[relPath], data.names[idx])
+		})
+	}
+
+	conflicts := []BundleConflict{}
+	for path, names := range bundles {
+		if len(names) > 1 {
+			conflicts = append(conflicts, BundleConflict{Path: path, Served: names[0], Shadowed: names[1:]})
+		}
+	}
+	sort.Slice(conflicts, func(i, j int) bool {
+		return conflicts[i].Path < conflicts[j].Path
+	})
+
+	return conflicts
+}
+
+// GET /plugins/conflicts has the files that bundles shadow in each other
+func (h *Handlers) bundleConflictsHandler(writer http.ResponseWriter, req *http.Request, path string, pathSegs []string) bool {
+	switch {
+	case req.Method == "GET" && len(pathSegs) == 2:
+		ShowJson(writer, 200, h.fs.snapshot().conflicts())
+		return true
+	}
+
+	return false
+}
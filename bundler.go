@@ -0,0 +1,424 @@
+// Copyright 2014 Chris McGee <sirnewton_01@yahoo.ca>. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"os"
+	"path"
+	"regexp"
+	"sort"
+	"strings"
+	"time"
+)
+
+// Files generated at startup that shadow the files of the bundles
+type memFS map[string]*memEntry
+
+type memEntry struct {
+	content []byte
+	modTime time.Time
+}
+
+func (fs memFS) Open(name string) (http.File, error) {
+	name = path.Clean("/" + name)
+	entry, ok := fs[name]
+	if !ok {
+		return nil, os.ErrNotExist
+	}
+
+	return &memFile{Reader: bytes.NewReader(entry.content), name: name, entry: entry}, nil
+}
+
+type memFile struct {
+	*bytes.Reader
+	name  string
+	entry *memEntry
+}
+
+func (f *memFile) Close() error {
+	return nil
+}
+
+func (f *memFile) Readdir(count int) ([]os.FileInfo, error) {
+	return nil, errors.New("Not a directory")
+}
+
+func (f *memFile) Stat() (os.FileInfo, error) {
+	return memFileInfo{f}, nil
+}
+
+type memFileInfo struct {
+	file *memFile
+}
+
+func (i memFileInfo) Name() string       { return path.Base(i.file.name) }
+func (i memFileInfo) Size() int64        { return int64(len(i.file.entry.content)) }
+func (i memFileInfo) Mode() os.FileMode  { return 0444 }
+func (i memFileInfo) ModTime() time.Time { return i.file.entry.modTime }
+func (i memFileInfo) IsDir() bool        { return false }
+func (i memFileInfo) Sys() interface{}   { return nil }
+
+var (
+	anonymousDefine = regexp.MustCompile(`(?m)^(\s*)define\(\s*([\[{]|function)`)
+	requireScript   = regexp.MustCompile(`<script[^>]*src="[^"]*requirejs/require\.js"[^>]*></script>`)
+	packedSkipDirs  = []string{"/requirejs/", "/js-tests/", "/examplePages/", "/androidapp/", "/test/", "/tests/"}
+)
+
+type bundleSource struct {
+	bundle      string
+	logicalPath string
+	read        func() ([]byte, error)
+}
+
+// Packs the AMD modules of each bundle into one script, minifies the style
+// sheets and makes the pages load the packed scripts. Each module gets its
+// id so that requirejs finds it already defined instead of fetching it.
+func packBundles(cfs *ChainedFileSystem) error {
+	data := cfs.snapshot()
+
+	overlay := make(memFS)
+	now := time.Now()
+
+	// Earlier bundles shadow later ones just like in the file system
+	sources := []bundleSource{}
+	seen := make(map[string]bool)
+	for idx, dir := range data.dirs {
+		bundle := bundlePackName(dir)
+		walkBundle(data.fs[idx], dir, func(logicalPath string, read func() ([]byte, error)) {
+			if !seen[logicalPath] {
+				seen[logicalPath] = true
+				sources = append(sources, bundleSource{bundle, logicalPath, read})
+			}
+		})
+	}
+
+	type pack struct {
+		lines   []string
+		mapping []sourceLine
+		sources []string
+	}
+	packs := make(map[string]*pack)
+	pages := []bundleSource{}
+
+	for _, source := range sources {
+		switch path.Ext(source.logicalPath) {
+		case ".js":
+			if skipPacking(source.logicalPath) {
+				continue
+			}
+
+			content, err := source.read()
+			if err != nil {
+				return err
+			}
+
+			// Only modules with a single anonymous define can be named safely
+			src := string(content)
+			if len(anonymousDefine.FindAllStringIndex(src, -1)) != 1 || strings.Count(src, "define(") != 1 {
+				continue
+			}
+
+			id := strings.TrimSuffix(source.logicalPath[1:], ".js")
+			src = anonymousDefine.ReplaceAllString(src, `${1}define("`+id+`", ${2}`)
+
+			p := packs[source.bundle]
+			if p == nil {
+				p = &pack{}
+				packs[source.bundle] = p
+			}
+
+			sourceIdx := len(p.sources)
+			p.sources = append(p.sources, source.logicalPath)
+			for _, line := range minifyJs(src) {
+				p.lines = append(p.lines, line.text)
+				p.mapping = append(p.mapping, sourceLine{sourceIdx, line.line})
+			}
+			// Guard against modules that don't end their last statement
+			p.lines = append(p.lines, ";")
+			p.mapping = append(p.mapping, sourceLine{-1, 0})
+		case ".css":
+			content, err := source.read()
+			if err != nil {
+				return err
+			}
+			overlay[source.logicalPath] = &memEntry{[]byte(minifyCss(string(content))), now}
+		case ".html":
+			if !strings.Contains(strings.ToLower(source.logicalPath), "plugin") && !skipPacking(source.logicalPath) {
+				pages = append(pages, source)
+			}
+		}
+	}
+
+	bundles := []string{}
+	for bundle := range packs {
+		bundles = append(bundles, bundle)
+	}
+	sort.Strings(bundles)
+
+	scripts := []string{}
+	for _, bundle := range bundles {
+		p := packs[bundle]
+		content := strings.Join(p.lines, "\n") + "\n"
+		name := "/packed/" + bundle + "-" + assetHash([]byte(content)) + ".js"
+
+		// Source maps lead the browser's debugger back to the original files
+		if *debug {
+			sourceMap, err := json.Marshal(map[string]interface{}{
+				"version":  3,
+				"file":     path.Base(name),
+				"sources":  p.sources,
+				"mappings": sourceMapMappings(p.mapping),
+			})
+			if err != nil {
+				return err
+			}
+
+			overlay[name+".map"] = &memEntry{sourceMap, now}
+			content += "//# sourceMappingURL=" + path.Base(name) + ".map\n"
+		}
+
+		overlay[name] = &memEntry{[]byte(content), now}
+		scripts = append(scripts, `<script src="`+name+`"></script>`)
+
+		logger.Printf("Packed %v modules of %v into %v\n", len(p.sources), bundle, name)
+	}
+
+	for _, page := range pages {
+		content, err := page.read()
+		if err != nil {
+			return err
+		}
+
+		loc := requireScript.FindIndex(content)
+		if loc == nil {
+			continue
+		}
+
+		// The packed modules can only be defined once requirejs is there
+		injected := string(content[:loc[1]]) + "\n" + strings.Join(scripts, "\n") + string(content[loc[1]:])
+		overlay[page.logicalPath] = &memEntry{[]byte(injected), now}
+	}
+
+	precompressOverlay(overlay)
+
+	cfs.update(func(data *cfsData) bool {
+		data.overlay = overlay
+		return true
+	})
+
+	return nil
+}
+
+func skipPacking(logicalPath string) bool {
+	for _, dir := range packedSkipDirs {
+		if strings.Contains(logicalPath, dir) {
+			return true
+		}
+	}
+	return false
+}
+
+type minifiedLine struct {
+	text string
+	line int
+}
+
+type sourceLine struct {
+	source int
+	line   int
+}
+
+// Removes comments, indentation and blank lines from a script. Line breaks
+// are kept so that automatic semicolon insertion works as it did before and
+// so that each line maps back to a single line of the original.
+func minifyJs(src string) []minifiedLine {
+	const (
+		code = iota
+		lineComment
+		blockComment
+		str
+		regex
+		regexClass
+	)
+
+	result := []minifiedLine{}
+	state := code
+	quote := byte(0)
+	line := &bytes.Buffer{}
+	lineNum := 0
+	lineStartsRaw := false
+	lastSignificant := byte(0)
+	lastWord := ""
+
+	flush := func() {
+		text := line.String()
+		if !lineStartsRaw {
+			text = strings.TrimLeft(text, " \t")
+		}
+		if state != str {
+			text = strings.TrimRight(text, " \t\r")
+		}
+		if text != "" || state == str {
+			result = append(result, minifiedLine{text, lineNum})
+		}
+		line.Reset()
+		lineStartsRaw = state == str
+	}
+
+	// A slash starts a regular expression where an operand is expected
+	regexAllowed := func() bool {
+		switch lastWord {
+		case "return", "typeof", "case", "in", "of", "delete", "void", "throw", "new":
+			return true
+		}
+		return lastSignificant == 0 || strings.IndexByte("(,=:[!&|?{};+-*%<>~^", lastSignificant) != -1
+	}
+
+	for i := 0; i < len(src); i++ {
+		c := src[i]
+
+		if c == '\n' {
+			if state == lineComment {
+				state = code
+			}
+			flush()
+			lineNum++
+			continue
+		}
+
+		switch state {
+		case code:
+			switch {
+			case c == '/' && i+1 < len(src) && src[i+1] == '/':
+				state = lineComment
+				i++
+				continue
+			case c == '/' && i+1 < len(src) && src[i+1] == '*':
+				state = blockComment
+				i++
+				continue
+			case c == '/' && regexAllowed():
+				state = regex
+			case c == '"' || c == '\'' || c == '`':
+				state = str
+				quote = c
+			}
+
+			line.WriteByte(c)
+
+			if c != ' ' && c != '\t' && c != '\r' {
+				if isIdentChar(c) {
+					if i == 0 || !isIdentChar(src[i-1]) {
+						lastWord = ""
+					}
+					lastWord += string(c)
+				} else {
+					lastWord = ""
+				}
+				lastSignificant = c
+			}
+		case lineComment:
+		case blockComment:
+			if c == '*' && i+1 < len(src) && src[i+1] == '/' {
+				state = code
+				i++
+				// Keep the tokens on either side of the comment apart
+				line.WriteByte(' ')
+			}
+		case str:
+			line.WriteByte(c)
+			if c == '\\' && i+1 < len(src) && src[i+1] != '\n' {
+				i++
+				line.WriteByte(src[i])
+			} else if c == quote {
+				state = code
+				lastSignificant = c
+				lastWord = ""
+			}
+		case regex, regexClass:
+			line.WriteByte(c)
+			switch {
+			case c == '\\' && i+1 < len(src) && src[i+1] != '\n':
+				i++
+				line.WriteByte(src[i])
+			case c == '[':
+				state = regexClass
+			case c == ']' && state == regexClass:
+				state = regex
+			case c == '/' && state == regex:
+				state = code
+				lastSignificant = c
+				lastWord = ""
+			}
+		}
+	}
+
+	flush()
+	return result
+}
+
+func isIdentChar(c byte) bool {
+	return c == '_' || c == '$' || (c >= 'a' && c <= 'z') || (c >= 'A' && c <= 'Z') || (c >= '0' && c <= '9')
+}
+
+var (
+	cssComment    = regexp.MustCompile(`(?s)/\*.*?\*/`)
+	cssWhitespace = regexp.MustCompile(`\s+`)
+	cssPunctSpace = regexp.MustCompile(`\s*([{};,])\s*`)
+)
+
+// Strips comments and whitespace from a style sheet
+func minifyCss(src string) string {
+	src = cssComment.ReplaceAllString(src, "")
+	src = cssWhitespace.ReplaceAllString(src, " ")
+	src = cssPunctSpace.ReplaceAllString(src, "$1")
+	return strings.TrimSpace(src) + "\n"
+}
+
+const base64Vlq = "ABCDEFGHIJKLMNOPQRSTUVWXYZabcdefghijklmnopqrstuvwxyz0123456789+/"
+
+func vlq(value int) string {
+	if value < 0 {
+		value = (-value << 1) | 1
+	} else {
+		value <<= 1
+	}
+
+	encoded := ""
+	for {
+		digit := value & 31
+		value >>= 5
+		if value > 0 {
+			digit |= 32
+		}
+		encoded += string(base64Vlq[digit])
+		if value == 0 {
+			return encoded
+		}
+	}
+}
+
+// Mappings of a source map where every generated line starts at the
+// beginning of a line of one of the sources.
+func sourceMapMappings(lines []sourceLine) string {
+	mappings := []string{}
+	lastSource, lastLine := 0, 0
+
+	for _, l := range lines {
+		if l.source < 0 {
+			mappings = append(mappings, "")
+			continue
+		}
+
+		mappings = append(mappings, "A"+vlq(l.source-lastSource)+vlq(l.line-lastLine)+"A")
+		lastSource, lastLine = l.source, l.line
+	}
+
+	return strings.Join(mappings, ";")
+}
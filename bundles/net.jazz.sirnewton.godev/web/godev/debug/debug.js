@@ -2,9 +2,9 @@
 /*jslint */
 define(['orion/bootstrap', 'orion/status', 'orion/progress', 'orion/commandRegistry', 'orion/fileClient', 'orion/operationsClient',
 		'orion/searchClient', 'orion/globalCommands', 'orion/sites/siteUtils', 'orion/sites/siteCommands', 
-		'orion/sites/viewOnSiteTree', 'orion/PageUtil', 'orion/webui/littlelib', 'orion/xhr', 'terminal/term'],
+		'orion/sites/viewOnSiteTree', 'orion/PageUtil', 'orion/webui/littlelib', 'orion/xhr', 'terminal/term', 'godev/taskstream'],
 	function(mBootstrap, mStatus, mProgress, mCommandRegistry, mFileClient, mOperationsClient, mSearchClient, mGlobalCommands,
-			mSiteUtils, mSiteCommands, ViewOnSiteTree, PageUtil, lib, xhr, terminal) {
+			mSiteUtils, mSiteCommands, ViewOnSiteTree, PageUtil, lib, xhr, terminal, taskstream) {
 				
 	mBootstrap.startup().then(function(core) {
 		var serviceRegistry = core.serviceRegistry;
@@ -32,6 +32,10 @@ define(['orion/bootstrap', 'orion/status', 'orion/progress', 'orion/commandRegis
 		var debugButton = document.getElementById("debug");
 		var raceButton = document.getElementById("race");
 		var argumentsInput = document.getElementById("argInput");
+		var testPackageInput = document.getElementById("testPackageInput");
+		var testNameInput = document.getElementById("testNameInput");
+		var debugTestButton = document.getElementById("debugTest");
+		var recordCheckbox = document.getElementById("record");
 		
 		var currentHash = window.location.hash;
 		var currentExecutable = "";
@@ -48,6 +52,14 @@ define(['orion/bootstrap', 'orion/status', 'orion/progress', 'orion/commandRegis
 				}
 			}
 			
+			// #test=<package>&name=<test or benchmark> from the editor
+			if (currentHash.indexOf("#test=") === 0) {
+				var testMatch = /test=([^&]+)/.exec(currentHash);
+				var nameMatch = /name=([^&]+)/.exec(currentHash);
+				testPackageInput.value = testMatch ? decodeURIComponent(testMatch[1]) : "";
+				testNameInput.value = nameMatch ? decodeURIComponent(nameMatch[1]) : "";
+			}
+			
 			if (currentHash.indexOf("args=") !== -1) {
 				var argsMatch = /args=([^&]+)/.exec(currentHash);
 				if (argsMatch) {
@@ -89,27 +101,170 @@ define(['orion/bootstrap', 'orion/status', 'orion/progress', 'orion/commandRegis
 		var term = null;
 		var ws = null;
 		
-		var executeFunc = function(e, debug, race) {
-			if (executables.selectedIndex < 0) {
-				return;
-			}
+		// Commands of the Delve console and the frames they send
+		var dlvHelp = "Commands: break <file>:<line> [cond], clear <id>, breakpoints, continue, next, step, stepout, halt,\r\n" +
+			"  goroutines, stack [goroutine], locals, args, print <expr>, goroutine <id>, frame <n>,\r\n" +
+			"  watch <expr>, pin <expr>, unwatch <id>, watches, expand <expr> [start] [count]\r\n" +
+			"  x <address|expr> [length], disassemble [count] [address]\r\n";
+		var dlvRecordHelp = "Recorded: rewind, rev next|step|stepout, checkpoint [note], checkpoints,\r\n" +
+			"  clear-checkpoint <id>, restart c<id>\r\n";
+		var dlvScope = {GoroutineId: -1, Frame: 0};
+		var dlvNextId = 1;
+		var dlvPending = {};
+		var dlvRunCommands = {"continue": true, next: true, step: true, stepout: true, halt: true,
+			rewind: true, reversenext: true, reversestep: true, reversestepout: true, restoreCheckpoint: true};
+		
+		var dlvRequest = function(line) {
+			var words = line.trim().split(/\s+/);
+			var rest = line.trim().substring(words[0].length).trim();
+			var simple = {c: "continue", "continue": "continue", n: "next", next: "next", s: "step", step: "step",
+				so: "stepout", stepout: "stepout", halt: "halt", bp: "listBreakpoints", breakpoints: "listBreakpoints",
+				gr: "goroutines", goroutines: "goroutines", locals: "locals", args: "args", watches: "watches",
+				rw: "rewind", rewind: "rewind", checkpoints: "listCheckpoints"};
 			
-			var arguments = [];
-			var cmd = executables.options[executables.selectedIndex].value;
-			if (cmd === "<None>") {
-				return;
+			if (simple[words[0]]) {
+				return {Command: simple[words[0]], Args: dlvScope};
 			}
 			
-			// Update the hash on the window
-			currentExecutable = executables.options[executables.selectedIndex].innerHTML;
-			currentArgs = argumentsInput.value;
-			window.location.hash = "#exec="+currentExecutable+"&args="+currentArgs;
+			switch (words[0]) {
+			case "b":
+			case "break":
+				var match = /^(\S+):(\d+)\s*(.*)$/.exec(rest);
+				if (!match) {
+					return null;
+				}
+				var file = match[1];
+				// Files of the command's own package by their name
+				if (file.indexOf("/file/") !== 0) {
+					file = "/file/" + currentExecutable + "/" + file;
+				}
+				return {Command: "createBreakpoint", Args: {File: file, Line: parseInt(match[2], 10), Cond: match[3]}};
+			case "clear":
+				return {Command: "clearBreakpoint", Args: {BreakpointId: parseInt(rest, 10)}};
+			case "bt":
+			case "stack":
+				return {Command: "stacktrace", Args: {GoroutineId: rest ? parseInt(rest, 10) : dlvScope.GoroutineId}};
+			case "p":
+			case "print":
+				return {Command: "eval", Args: {GoroutineId: dlvScope.GoroutineId, Frame: dlvScope.Frame, Expr: rest}};
+			case "watch":
+			case "pin":
+				// Pinned watches stay in the goroutine and frame of the console
+				return {Command: "addWatch", Args: {Expr: rest, Pinned: words[0] === "pin", GoroutineId: dlvScope.GoroutineId, Frame: dlvScope.Frame}};
+			case "unwatch":
+				return {Command: "removeWatch", Args: {WatchId: parseInt(rest, 10)}};
+			case "expand":
+				var page = /^(.*?)(?:\s+(\d+))?(?:\s+(\d+))?$/.exec(rest);
+				return {Command: "expand", Args: {GoroutineId: dlvScope.GoroutineId, Frame: dlvScope.Frame, Expr: page[1],
+					Start: page[2] ? parseInt(page[2], 10) : 0, Count: page[3] ? parseInt(page[3], 10) : 0}};
+			case "rev":
+				if (["next", "step", "stepout"].indexOf(rest) === -1) {
+					return null;
+				}
+				return {Command: "reverse" + rest, Args: dlvScope};
+			case "checkpoint":
+				return {Command: "checkpoint", Args: {Where: rest}};
+			case "clear-checkpoint":
+				return {Command: "clearCheckpoint", Args: {CheckpointId: parseInt(rest, 10)}};
+			case "restart":
+				var checkpoint = /^c(\d+)$/.exec(rest);
+				if (!checkpoint) {
+					return null;
+				}
+				return {Command: "restoreCheckpoint", Args: {CheckpointId: parseInt(checkpoint[1], 10)}};
+			case "x":
+				var memory = /^(.*?)(?:\s+(\d+))?$/.exec(rest);
+				return {Command: "memory", Args: {GoroutineId: dlvScope.GoroutineId, Frame: dlvScope.Frame, Address: memory[1],
+					Length: memory[2] ? parseInt(memory[2], 10) : 0}};
+			case "disass":
+			case "disassemble":
+				return {Command: "disassemble", Args: {GoroutineId: dlvScope.GoroutineId, Frame: dlvScope.Frame,
+					Count: words[1] ? parseInt(words[1], 10) : 0, Address: words[2] || ""}};
+			case "goroutine":
+				dlvScope.GoroutineId = parseInt(rest, 10);
+				dlvScope.Frame = 0;
+				return {};
+			case "frame":
+				dlvScope.Frame = parseInt(rest, 10);
+				return {};
+			}
 			
-			var inputSplit = argumentsInput.value.split(" ");
+			return null;
+		};
+		
+		var dlvFormat = function(value) {
+			return JSON.stringify(value, null, 2).replace(/\n/g, "\r\n") + "\r\n";
+		};
+		
+		// One line for each watch, the whole value is a print or expand away
+		var dlvFormatWatches = function(watches) {
+			return watches.map(function(watch) {
+				var value = watch.Error;
+				if (!value) {
+					value = watch.Value.value || watch.Value.type;
+					// Arrays, maps and slices by their reflect.Kind
+					if (watch.Value.kind === 17 || watch.Value.kind === 21 || watch.Value.kind === 23) {
+						value = watch.Value.type + " len " + watch.Value.len;
+					}
+				}
+				return "#" + watch.Id + (watch.Pinned ? " (pinned)" : "") + " " + watch.Expr + " = " + value + "\r\n";
+			}).join("");
+		};
+		
+		var dlvFormatMemory = function(memory) {
+			return memory.Dump.join("\r\n") + "\r\n";
+		};
+		
+		// Source lines followed by their instructions, the PC is marked with =>
+		var dlvFormatDisassembly = function(disassembly) {
+			var text = "TEXT " + disassembly.Function + "\r\n";
+			disassembly.Lines.forEach(function(line) {
+				text = text + line.Location + ":" + line.Line + "\t" + line.Source.trim() + "\r\n";
+				line.Instructions.forEach(function(instruction) {
+					text = text + (instruction.AtPc ? "=>" : "  ") + (instruction.Breakpoint ? "* " : "  ") +
+						instruction.Pc + "\t" + instruction.Text + "\r\n";
+				});
+			});
+			return text;
+		};
+		
+		// Regular expression that selects only the named test, each level of
+		//  a subtest is matched separately
+		var testPattern = function(name) {
+			return name.split("/").map(function(part) {
+				return "^" + part.replace(/[.*+?^${}()|[\]\\]/g, "\\$&") + "$";
+			}).join("/");
+		};
+		
+		var executeFunc = function(e, debug, race, dlv, test) {
+			var arguments = [];
+			var cmd = "";
 			
-			// TODO handling for quotes
-			for (var idx = 0; idx < inputSplit.length; idx++) {
-				arguments.push(inputSplit[idx]);
+			if (test) {
+				// Breakpoints by file name are in the package of the test
+				currentExecutable = test.pkg;
+				window.location.hash = "#test=" + encodeURIComponent(test.pkg) + "&name=" + encodeURIComponent(test.name);
+			} else {
+				if (executables.selectedIndex < 0) {
+					return;
+				}
+				
+				cmd = executables.options[executables.selectedIndex].value;
+				if (cmd === "<None>") {
+					return;
+				}
+				
+				// Update the hash on the window
+				currentExecutable = executables.options[executables.selectedIndex].innerHTML;
+				currentArgs = argumentsInput.value;
+				window.location.hash = "#exec="+currentExecutable+"&args="+currentArgs;
+				
+				var inputSplit = argumentsInput.value.split(" ");
+				
+				// TODO handling for quotes
+				for (var idx = 0; idx < inputSplit.length; idx++) {
+					arguments.push(inputSplit[idx]);
+				}
 			}
 			
 			var request = {};
@@ -124,20 +279,73 @@ define(['orion/bootstrap', 'orion/status', 'orion/progress', 'orion/commandRegis
 			
 			term.reset();
 			
-			var wsUrl = document.URL.replace("http://", "ws://");
-			wsUrl = wsUrl.replace("https://", "wss://");
-			wsUrl = wsUrl.substring(0, wsUrl.indexOf("/godev")) + "/debug/socket?debug="+request.Debug+"&race="+request.Race+"&cmd="+cmd+"&params="+arguments.join(" ");
-			ws = new WebSocket(wsUrl);
+			var query = "?debug="+request.Debug+"&race="+request.Race+"&cmd="+cmd+"&params="+arguments.join(" ");
+			if (dlv) {
+				query = query + "&dlv=true";
+				if (recordCheckbox.checked) {
+					query = query + "&record=true";
+				}
+			}
+			if (test) {
+				// Benchmarks run on their own, without the tests
+				var kind = test.name.indexOf("Benchmark") === 0 ? "&testBench=" : "&testRun=";
+				query = query + "&test=" + encodeURIComponent(test.pkg) + kind + encodeURIComponent(testPattern(test.name));
+			}
+			ws = taskstream.open("/debug/socket" + query, "/debug/stream" + query, !dlv);
 			
 			ws.onopen = function(evt) {
 				term.write("[Process Started - Press Ctrl-C to stop]\r\n");
 				executeButton.disabled = true;
 				debugButton.disabled = true;
 				raceButton.disabled = true;
+				debugTestButton.disabled = true;
 			};
 			
 			ws.onmessage = function(evt) {
-				term.write(evt.data);
+				if (!dlv) {
+					term.write(evt.data);
+					return;
+				}
+				
+				var frame = JSON.parse(evt.data);
+				if (frame.Event === "output") {
+					term.write(frame.Output.replace(/\r?\n/g, "\r\n"));
+				} else if (frame.Event === "started") {
+					var recorded = frame.Result && frame.Result.Recorded;
+					term.write("[Delve session started" + (recorded ? " on a recording" : "") + "]\r\n" + dlvHelp +
+						(recorded ? dlvRecordHelp : "") + "(dlv) ");
+				} else if (frame.Event === "state" || frame.Event === "exited") {
+					var state = frame.Result || {};
+					if (frame.Error) {
+						term.write(frame.Error.replace(/\n/g, "\r\n") + "\r\n");
+					} else if (state.exited) {
+						term.write("[Program exited with status " + state.exitStatus + "]\r\n");
+					} else if (state.currentThread) {
+						dlvScope.GoroutineId = state.currentGoroutine ? state.currentGoroutine.id : -1;
+						dlvScope.Frame = 0;
+						term.write("> " + state.currentThread.file + ":" + state.currentThread.line + "\r\n(dlv) ");
+					}
+				} else if (frame.Event === "watches") {
+					if (frame.Result.length > 0) {
+						term.write("\r" + dlvFormatWatches(frame.Result) + "(dlv) ");
+					}
+				} else if (dlvPending[frame.Id] === "watches" && !frame.Error) {
+					delete dlvPending[frame.Id];
+					term.write(dlvFormatWatches(frame.Result) + "(dlv) ");
+				} else if (dlvPending[frame.Id] === "memory" && !frame.Error) {
+					delete dlvPending[frame.Id];
+					term.write(dlvFormatMemory(frame.Result) + "(dlv) ");
+				} else if (dlvPending[frame.Id] === "disassemble" && !frame.Error) {
+					delete dlvPending[frame.Id];
+					term.write(dlvFormatDisassembly(frame.Result) + "(dlv) ");
+				} else if (dlvRunCommands[dlvPending[frame.Id]] && !frame.Error) {
+					// The state event that follows shows where the program stopped
+					delete dlvPending[frame.Id];
+				} else if (frame.Error) {
+					term.write("Error: " + frame.Error + "\r\n(dlv) ");
+				} else {
+					term.write(dlvFormat(frame.Result) + "(dlv) ");
+				}
 			};
 			
 			ws.onclose = function(evt) {
@@ -145,11 +353,40 @@ define(['orion/bootstrap', 'orion/status', 'orion/progress', 'orion/commandRegis
 				executeButton.disabled = false;
 				debugButton.disabled = false;
 				raceButton.disabled = false;
+				debugTestButton.disabled = false;
 				term.off('data', ws.termListener);
 			};
 			
+			var line = "";
 			ws.termListener = function(data) {
-				ws.send(data);
+				if (!dlv) {
+					ws.send(data);
+					return;
+				}
+				
+				// The console edits a line at a time
+				if (data === "\r") {
+					term.write("\r\n");
+					var request = dlvRequest(line);
+					line = "";
+					if (request === null) {
+						term.write(dlvHelp + "(dlv) ");
+					} else if (!request.Command) {
+						term.write("(dlv) ");
+					} else {
+						request.Id = dlvNextId++;
+						dlvPending[request.Id] = request.Command;
+						ws.send(JSON.stringify(request));
+					}
+				} else if (data === "\x7f" || data === "\b") {
+					if (line.length > 0) {
+						line = line.substring(0, line.length - 1);
+						term.write("\b \b");
+					}
+				} else {
+					line = line + data;
+					term.write(data);
+				}
 			};
 			
 			term.on('data', ws.termListener);
@@ -166,15 +403,29 @@ define(['orion/bootstrap', 'orion/status', 'orion/progress', 'orion/commandRegis
 		// Execute button to launch the process
 		executeButton.addEventListener("click", executeFunc);
 		
+		// Delve records with rr, which only runs on Linux
+		var recordSupported = function(debuggers) {
+			if (recordCheckbox.checked && debuggers.indexOf("rr") === -1) {
+				window.alert("Recording needs Delve and rr, which runs on Linux. See https://rr-project.org to install rr.");
+				return false;
+			}
+			return true;
+		};
+		
 		// Debug button to start up a debugging session
 		debugButton.addEventListener("click", function(e) {
 			xhr("GET", "/debug/debugSupport", {
 				headers: {},
 				timeout: 60000
 			}).then(function(result) {
-				executeFunc(e, true);
+				// Delve is preferred over godbg
+				var debuggers = JSON.parse(result.response);
+				if (!recordSupported(debuggers)) {
+					return;
+				}
+				executeFunc(e, true, false, debuggers.indexOf("dlv") !== -1);
 			}, function(error) {
-				window.alert("Debug support is not available because the godbg tool is not installed or is not on the system path. Fetch it by running 'go get github.com/sirnewton01/godbg.'");
+				window.alert("Debug support is not available because neither dlv nor godbg is installed on the system path. Install Delve by running 'go install github.com/go-delve/delve/cmd/dlv@latest'.");
 			});
 		});
 		
@@ -182,6 +433,32 @@ define(['orion/bootstrap', 'orion/status', 'orion/progress', 'orion/commandRegis
 			executeFunc(e, false, true);
 		});
 		
+		// Tests and benchmarks are only debugged with Delve
+		var debugTestFunc = function(e) {
+			var test = {pkg: testPackageInput.value.trim(), name: testNameInput.value.trim()};
+			if (test.pkg === "") {
+				return;
+			}
+			
+			xhr("GET", "/debug/debugSupport", {
+				headers: {},
+				timeout: 60000
+			}).then(function(result) {
+				var debuggers = JSON.parse(result.response);
+				if (debuggers.indexOf("dlv") === -1) {
+					window.alert("Debugging tests needs Delve. Install it by running 'go install github.com/go-delve/delve/cmd/dlv@latest'.");
+					return;
+				}
+				if (!recordSupported(debuggers)) {
+					return;
+				}
+				executeFunc(e, true, false, true, test);
+			}, function(error) {
+				window.alert("Debug support is not available because dlv is not installed on the system path. Install Delve by running 'go install github.com/go-delve/delve/cmd/dlv@latest'.");
+			});
+		};
+		debugTestButton.addEventListener("click", debugTestFunc);
+		
 		// Initialize
 		(function() {
 			term = new Terminal({
@@ -191,6 +468,11 @@ define(['orion/bootstrap', 'orion/status', 'orion/progress', 'orion/commandRegis
 				screenKeys: true
 			});
 			term.open(document.getElementById("terminal"));
+			
+			// Opened from the editor to debug a test
+			if (currentHash.indexOf("#test=") === 0) {
+				debugTestFunc();
+			}
 		}());
 	});
 });
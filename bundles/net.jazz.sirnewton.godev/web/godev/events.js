@@ -0,0 +1,68 @@
+/*global window define document WebSocket EventSource*/
+/*browser:true*/
+
+// Subscribes the page to the event bus of the server. The events arrive
+//  over a WebSocket or, where those are blocked, an event stream.
+define([], function() {
+	var origin = window.location.protocol + "//" + window.location.host;
+	var listeners = {};
+	var connected = false;
+
+	function dispatch(data) {
+		var e = JSON.parse(data);
+		var callbacks = listeners[e.Type] || [];
+		for (var idx = 0; idx < callbacks.length; idx++) {
+			callbacks[idx](e.Data);
+		}
+	}
+
+	function connect() {
+		var opened = false;
+		var ws;
+
+		var openEventSource = function() {
+			var source = new EventSource(origin + "/events/stream");
+			source.addEventListener("event", function(evt) {
+				dispatch(evt.data);
+			});
+		};
+
+		try {
+			ws = new WebSocket(origin.replace(/^http/, "ws") + "/events/socket");
+		} catch (e) {
+			openEventSource();
+			return;
+		}
+
+		ws.onopen = function() {
+			opened = true;
+		};
+		ws.onmessage = function(evt) {
+			dispatch(evt.data);
+		};
+		ws.onerror = function() {
+			if (!opened) {
+				ws.onclose = null;
+				openEventSource();
+			}
+		};
+		ws.onclose = function() {
+			// Reconnect after the server restarts
+			window.setTimeout(connect, 5000);
+		};
+	}
+
+	return {
+		on: function(type, callback) {
+			if (!listeners[type]) {
+				listeners[type] = [];
+			}
+			listeners[type].push(callback);
+
+			if (!connected) {
+				connected = true;
+				connect();
+			}
+		}
+	};
+});
@@ -0,0 +1,153 @@
+/*global window define document*/
+/*browser:true*/
+
+define(['orion/bootstrap', 'orion/xhr'], 
+function(mBootstrap, xhr) {
+
+	mBootstrap.startup().then(function(core) {
+		// explain.html?resource=<location>&line=<line>&sel=<selection>
+		var param = function(name) {
+			var match = new RegExp("[?&]" + name + "=([^&]*)").exec(document.URL);
+			return match ? decodeURIComponent(match[1]) : "";
+		};
+		
+		var resource = param("resource");
+		var line = parseInt(param("line"));
+		var selectionInt = parseInt(param("sel"));
+		
+		// Canceling the dialog preserves the selection the user had before
+		//  opening the dialog
+		var cancel = function() {
+			window.setTimeout(function() {
+				var result = {selection: {start: selectionInt, end: selectionInt}};
+				
+				window.parent.postMessage(JSON.stringify({
+				   pageService: "orion.page.delegatedUI",
+				   source: "go.explain",
+				   result: result
+				}), "*");
+			}, 100);
+		};
+		
+		// The editor could be showing another file after following a link
+		var shutdown = function() {
+			window.setTimeout(function() {
+				window.parent.postMessage(JSON.stringify({
+				   pageService: "orion.page.delegatedUI",
+				   source: "go.explain",
+				   cancelled: true
+				}), "*");
+			}, 100);
+		};
+		
+		document.addEventListener("keyup", function(evt) {
+			if (evt.keyCode === 27) {
+				cancel();
+			}
+		});
+		
+		document.getElementById("closeDialog").addEventListener("click", function(evt) {
+			shutdown();
+		});
+		
+		var explainAreaNode = document.getElementById("explainArea");
+		
+		var addText = function(parent, className, text) {
+			if (!text) {
+				return;
+			}
+			var node = document.createElement("div");
+			node.className = className;
+			node.textContent = text;
+			parent.appendChild(node);
+		};
+		
+		var addExplanations = function(error, explanations) {
+			var section = document.createElement("div");
+			section.style.marginBottom = "10px";
+			
+			var header = document.createElement("div");
+			header.style.fontWeight = "bold";
+			header.textContent = error.Msg;
+			section.appendChild(header);
+			
+			if (explanations.length === 0) {
+				addText(section, "", "There is no explanation for this message yet.");
+			}
+			
+			// The first explanation is the best one, the others are more general
+			explanations.slice(0, 1).forEach(function(explanation) {
+				addText(section, "explainTitle", explanation.Title);
+				addText(section, "", explanation.Explanation);
+				addText(section, "explainFix", explanation.Fix);
+				addText(section, "explainExample", explanation.Example);
+				
+				if (explanation.Link) {
+					var link = document.createElement("a");
+					link.setAttribute("target", "_blank");
+					link.setAttribute("href", explanation.Link);
+					link.textContent = "More";
+					section.appendChild(link);
+				}
+			});
+			
+			(error.Related || []).forEach(function(note) {
+				var row = document.createElement("div");
+				var link = document.createElement("a");
+				link.setAttribute("tabindex", "0");
+				link.setAttribute("target", "_top");
+				link.setAttribute("href", "/edit/edit.html#" + note.Location + ",line=" + note.Line + ",random=" + Math.random());
+				link.textContent = note.Location.replace("/file", "") + ":" + note.Line;
+				link.addEventListener("mouseup", function(evt) {
+					if (!evt.ctrlKey) {
+						shutdown();
+					}
+				});
+				row.appendChild(link);
+				row.appendChild(document.createTextNode(" " + note.Msg));
+				section.appendChild(row);
+			});
+			
+			explainAreaNode.appendChild(section);
+		};
+		
+		var showError = function(error) {
+			var message = "Error: " + error.status;
+			try {
+				message = JSON.parse(error.response).Message;
+			} catch (e) {
+			}
+			explainAreaNode.textContent = message;
+		};
+		
+		var pkgSegs = resource.replace(/^\/file\//g, "").split("/");
+		var pkg = pkgSegs.splice(0, pkgSegs.length-1).join("/");
+		
+		xhr("GET", "/go/build?pkg=" + pkg + "&clean=true&vet=true", {
+			headers: {},
+			timeout: 60000
+		}).then(function(result) {
+			var errors = JSON.parse(result.response).filter(function(error) {
+				return error.Location === resource && error.Line === line;
+			});
+			
+			explainAreaNode.textContent = "";
+			if (errors.length === 0) {
+				explainAreaNode.textContent = "There are no errors or warnings on line " + line + ".";
+				return;
+			}
+			
+			errors.forEach(function(error) {
+				// The message without the analyzer that go vet puts at the end
+				var msg = error.Msg.replace(/ \(\w+\)$/, "");
+				
+				xhr("GET", "/go/explain?msg=" + encodeURIComponent(msg) + "&code=" + encodeURIComponent(error.Code || ""), {
+					headers: {},
+					timeout: 15000
+				}).then(function(result) {
+					addExplanations(error, JSON.parse(result.response));
+				}, showError);
+			});
+		}, showError);
+	});
+});
@@ -9,6 +9,12 @@ define(['orion/xhr', 'orion/plugin', 'orion/form'], function (xhr, PluginProvide
     };
     
     var provider = new PluginProvider(headers);
+
+    // The service worker caches the IDE shell so that it loads instantly
+    //  and the workspace can still be browsed offline.
+    if ("serviceWorker" in navigator) {
+        navigator.serviceWorker.register("/service-worker.js", {scope: "/"});
+    }
     
     provider.registerServiceProvider("orion.page.link", {}, {
         name: "Go Doc",
@@ -24,7 +30,21 @@ define(['orion/xhr', 'orion/plugin', 'orion/form'], function (xhr, PluginProvide
         uriTemplate: "{+OrionHome}/godev/debug/debug.html"
         });
 
-	// Run a build to check for compile errors
+    provider.registerServiceProvider("orion.page.link", {}, {
+        name: "Logs",
+        id: "godev.logs",
+        category: "shell",
+        uriTemplate: "{+OrionHome}/godev/logs/logs.html"
+        });
+
+    provider.registerServiceProvider("orion.page.link", {}, {
+        name: "Project Setup",
+        id: "godev.onboarding",
+        category: "shell",
+        uriTemplate: "{+OrionHome}/godev/onboarding/onboarding.html"
+        });
+
+	// Run a build to check for compile errors and go vet warnings
     provider.registerServiceProvider("orion.edit.validator", {
             checkSyntax: function (title, contents) {
                 // title is a relative URI for the file
@@ -33,7 +53,7 @@ define(['orion/xhr', 'orion/plugin', 'orion/form'], function (xhr, PluginProvide
                 var pkgSegs = pkg.split('/');
 			    pkg = pkgSegs.splice(0,pkgSegs.length-1).join('/');
                 
-	            var d = xhr("GET", "/go/build?pkg=" + pkg + "&clean=true", {
+	            var d = xhr("GET", "/go/build?pkg=" + pkg + "&clean=true&vet=true", {
 	                    headers: {},
 	                    timeout: 60000
 	                }).then(function (result) {
@@ -42,15 +62,46 @@ define(['orion/xhr', 'orion/plugin', 'orion/form'], function (xhr, PluginProvide
 	                    
 	                    for (var idx = 0; idx < errors.length; idx++) {
 	                        var error = errors[idx];
+	                        var severity = error.Severity === "Warning" ? "warning" : "error";
+	                        var related = error.Related || [];
+	                        var inFile = error.Location === title;
+	                        
+	                        // The places that the message refers to get a marker
+	                        //  of their own that leads back to it
+	                        for (var noteIdx = 0; noteIdx < related.length; noteIdx++) {
+	                            var note = related[noteIdx];
+	                            if (note.Location === title) {
+	                                problems.push({
+	                                    description: note.Msg + " (" + (inFile ? "line " + error.Line : error.Location + ":" + error.Line) + ": " + error.Msg + ")",
+	                                    line: note.Line,
+	                                    start: note.Column,
+	                                    end: 80,
+	                                    severity: severity
+	                                });
+	                                inFile = true;
+	                            }
+	                        }
 	                        
 	                        if (error.Location === title) {
+	                            var description = error.Msg;
+	                            for (noteIdx = 0; noteIdx < related.length; noteIdx++) {
+	                                description = description + "; " + related[noteIdx].Msg + " at " +
+	                                    (related[noteIdx].Location === title ? "line " : related[noteIdx].Location + ":") + related[noteIdx].Line;
+	                            }
 			                    problems.push({
-			                        description: error.Msg,
+			                        description: description,
 			                        line: error.Line,
 			                        start: error.Column,
 			                        end: 80,
-			                        severity: "error"
+			                        severity: severity
 			                    });
+			                // Errors of other files that refer to this one are marked
+			                //  where they refer to it
+		                    } else if (inFile) {
+		                        continue;
+			                // Warnings of the other files show up in their own editors
+		                    } else if (error.Severity === "Warning") {
+		                        continue;
 			                // There is another problem unrelated to this file
 			                //  Put a marker at the top of the file.
 		                    } else {
@@ -106,56 +157,72 @@ define(['orion/xhr', 'orion/plugin', 'orion/form'], function (xhr, PluginProvide
             contentType: ["text/x-go"]
         });
         
+    // Run the linters configured on the server
+    provider.registerServiceProvider("orion.edit.validator", {
+            checkSyntax: function (title, contents) {
+	            var d = xhr("GET", "/go/lint?file=" + encodeURIComponent(title), {
+	                    headers: {},
+	                    timeout: 60000
+	                }).then(function (result) {
+	                    var findings = JSON.parse(result.response);
+	                    var problems = [];
+	                    
+	                    for (var idx = 0; idx < findings.length; idx++) {
+	                        problems.push({
+	                            description: findings[idx].Msg,
+	                            line: findings[idx].Line,
+	                            start: findings[idx].Column,
+	                            end: 80,
+	                            severity: findings[idx].Severity === "Error" ? "error" : "warning"
+	                        });
+	                    }
+	                    return {problems: problems};
+	                });
+	
+	            return d;
+            }
+        }, {
+            contentType: ["text/x-go"]
+        });
+        
     provider.registerServiceProvider("orion.edit.contentAssist", {
             computeProposals: function (buffer, offset, context) {
                 // TODO provide the path for the editor buffer for better results
-                var d = xhr("POST", "/completion?offset=" + offset + 
+                var d = xhr("POST", "/completion?ranked=true&offset=" + offset + 
                                                "&path=" + context.title, {
 	                    headers: {},
 	                    timeout: 60000,
 	                    data: buffer
 	                }).then(function (result) {
-	                    var completions = JSON.parse(result.response);
+	                    var completions = JSON.parse(result.response).Completions;
 	                    var proposals = [];
 	                    
-	                    var name, type, proposal, positions;
+	                    var completion, start, positions;
 	                    
-	                    if (completions.length < 2) {
-	                        return proposals;
-	                    }
+	                    // The completions are replacing the prefix that was typed, which is
+	                    //  matched fuzzily and the best matches come first.
+	                    start = offset - context.prefix.length;
 	                    
-	                    for (var idx = 0; idx < completions[1].length; idx++) {
-	                        name = completions[1][idx].name;
-	                        type = completions[1][idx].type;
+	                    for (var idx = 0; idx < completions.length; idx++) {
+	                        completion = completions[idx];
+	                        positions = null;
 	                        
-	                        // The proposal is just the name for now
-	                        proposal = name;
+	                        if (completion.Placeholders && completion.Placeholders.length > 0) {
+	                            positions = [];
+	                            for (var j = 0; j < completion.Placeholders.length; j++) {
+	                                positions.push({offset: start + completion.Placeholders[j].Offset,
+	                                    length: completion.Placeholders[j].Length});
+	                            }
+	                        }
 	                        
-	                        // Positions are only necessary for functions
-	                        positions = null;
-		                    
-		                    // This is a function, 
-		                    if (type.indexOf("func") === 0) {
-		                        var signature = type.substring(type.indexOf("(")+1, type.indexOf(")"));
-		                        var parameters = signature.split(",");
-		          
-		                        if (parameters.length !== 1 || parameters[0] !== "") {
-			                        var parameterOffset = 0;         
-			                        positions = [];
-			                        for (var j = 0; j < parameters.length; j++) {
-			                            positions.push({offset: offset + proposal.length + 1 + parameterOffset - context.prefix.length, length: parameters[j].length});
-			                            parameterOffset = parameterOffset + parameters[j].length + 1;
-			                        }
-		                        }
-		                        
-		                        proposal = proposal + "(" + signature + ")";
-		                    }
-		                    
-		                    proposals.push({
-	                            proposal: proposal,
-	                            description: name + " " + type,
+	                        proposals.push({
+	                            proposal: completion.InsertText,
+	                            description: completion.Name + " " + completion.Detail +
+	                                (completion.ImportPath ? " (import \"" + completion.ImportPath + "\")" : ""),
+	                            hover: completion.Documentation ? {content: completion.Documentation, type: "markdown"} : undefined,
 	                            positions: positions,
-	                            escapePosition: offset + proposal.length - context.prefix.length,
+	                            additionalEdits: completion.AdditionalEdits,
+	                            escapePosition: start + completion.Escape,
 	                            overwrite: true
 	                        });
                         }
@@ -178,6 +245,56 @@ define(['orion/xhr', 'orion/plugin', 'orion/form'], function (xhr, PluginProvide
             contentType: ["text/x-go"]
         });
 
+    provider.registerServiceProvider("orion.edit.occurrences", {
+            computeOccurrences: function (editorContext, context) {
+                return editorContext.getText().then(function (text) {
+                    // The server works with the byte offsets of UTF-8
+                    var utf8Length = function (code) {
+                        return code < 0x80 ? 1 : code < 0x800 ? 2 : (code >= 0xD800 && code <= 0xDBFF) ? 4 : 3;
+                    };
+                    var toBytes = function (offset) {
+                        var bytes = 0;
+                        for (var i = 0; i < offset; i++) {
+                            var code = text.charCodeAt(i);
+                            bytes += utf8Length(code);
+                            if (code >= 0xD800 && code <= 0xDBFF) {
+                                i++;
+                            }
+                        }
+                        return bytes;
+                    };
+                    var fromBytes = function (byteOffset) {
+                        var bytes = 0, offset = 0;
+                        while (offset < text.length && bytes < byteOffset) {
+                            var code = text.charCodeAt(offset);
+                            bytes += utf8Length(code);
+                            offset += (code >= 0xD800 && code <= 0xDBFF) ? 2 : 1;
+                        }
+                        return offset;
+                    };
+                    
+                    return xhr("POST", "/go/occurrences" + context.title + "?offset=" + toBytes(context.selection.start), {
+                        headers: {},
+                        timeout: 15000,
+                        data: text
+                    }).then(function (result) {
+                        return JSON.parse(result.response).map(function (occurrence) {
+                            var start = fromBytes(occurrence.Offset);
+                            return {
+                                start: start,
+                                end: start + occurrence.Length,
+                                readAccess: occurrence.Kind === "read"
+                            };
+                        });
+                    }, function (error) {
+                        return [];
+                    });
+                });
+            }
+        }, {
+            contentType: ["text/x-go"]
+        });
+
     provider.registerServiceProvider("orion.edit.outliner", {
             getOutline: function (contents, title) {
                 var d = xhr("POST", "/go/outline", {
@@ -291,6 +408,92 @@ define(['orion/xhr', 'orion/plugin', 'orion/form'], function (xhr, PluginProvide
             ]
         });
         
+    // Go Clean shell command, the next build of the workspace starts over
+    var cleanCmdImpl = {
+        callback: function (args, cwd) {
+            var d = xhr("DELETE", "/go/cache", {
+                    headers: {},
+                    timeout: 60000
+                }).then(function (result) {
+                    return "Cleared the build cache and temporary files of the workspace";
+                }, function (error) {
+                    return "Error clearing the build cache";
+                });
+
+            return d;
+        }
+    };
+
+    provider.registerServiceProvider(
+        "orion.shell.command",
+        cleanCmdImpl, {
+            name: "go clean",
+            description: "Clear the build cache of the workspace",
+            parameters: []
+        });
+
+    // Invite shell command, a guest gets a URL to the file or directory and
+    //  optionally the terminals that are open, which expires after two hours
+    var inviteCmdImpl = {
+        callback: function (args, cwd) {
+            var invite = {
+                Label: "Guest",
+                Paths: [args.path ? args.path.path : cwd.cwd],
+                Terminals: [],
+                Write: !!args.write
+            };
+
+            var terminals = args.terminals ? xhr("GET", "/docker/sessions", {
+                    headers: {},
+                    timeout: 15000
+                }).then(function (result) {
+                    invite.Terminals = JSON.parse(result.response).map(function (session) {
+                        return session.Id;
+                    });
+                }) : null;
+
+            var send = function () {
+                return xhr("POST", "/invites", {
+                        headers: {},
+                        timeout: 15000,
+                        data: JSON.stringify(invite)
+                    }).then(function (result) {
+                        return "Share this URL with your guest: " + JSON.parse(result.response).Url;
+                    }, function (error) {
+                        var message = "Error creating the invite";
+                        try {
+                            message = JSON.parse(error.response).Message || message;
+                        } catch (e) {}
+                        return message;
+                    });
+            };
+
+            return terminals ? terminals.then(send, send) : send();
+        }
+    };
+
+    provider.registerServiceProvider(
+        "orion.shell.command",
+        inviteCmdImpl, {
+            name: "invite",
+            description: "Invite a guest to a file or directory for two hours",
+            parameters: [{
+                    name: "path",
+                    type: {name: "file", exist: true},
+                    description: "The file or directory to share",
+                    defaultValue: null
+                }, {
+                    name: "write",
+                    type: "boolean",
+                    description: "Whether the guest can change the files and type in the terminals"
+                }, {
+                    name: "terminals",
+                    type: "boolean",
+                    description: "Also share the terminals that are open"
+                }
+            ]
+        });
+
     // Go Install shell command
     var installCmdImpl = {
         callback: function (args, cwd) {
@@ -338,6 +541,121 @@ define(['orion/xhr', 'orion/plugin', 'orion/form'], function (xhr, PluginProvide
                 }
             ]
         });
+
+    // Runs one of the commands that the server allows (go, git, make by
+    //  default) in the current directory
+    var execCmdImpl = {
+        callback: function (args, cwd) {
+            // Words separated by spaces, quotes keep them together
+            var words = [];
+            var re = /"([^"]*)"|'([^']*)'|(\S+)/g;
+            var match;
+            while ((match = re.exec(args.commandLine)) !== null) {
+                words.push(match[1] !== undefined ? match[1] : (match[2] !== undefined ? match[2] : match[3]));
+            }
+            if (words.length === 0) {
+                return "No command given";
+            }
+
+            var d = xhr("POST", "/shell/exec", {
+                    headers: {},
+                    timeout: 600000,
+                    data: JSON.stringify({
+                        Command: words[0],
+                        Args: words.slice(1),
+                        Dir: cwd.cwd
+                    })
+                }).then(function (result) {
+                    var execution = JSON.parse(result.response);
+                    var output = execution.Output || "";
+                    if (execution.ExitCode !== 0) {
+                        output = output + "exit status " + execution.ExitCode + "\n";
+                    }
+                    return output.replace(/\n/g, "\r\n");
+                }, function (error) {
+                    try {
+                        return JSON.parse(error.response).Message;
+                    } catch (e) {
+                        return "Error running " + words[0];
+                    }
+                });
+
+            return d;
+        }
+    };
+
+    provider.registerServiceProvider(
+        "orion.shell.command",
+        execCmdImpl, {
+            name: "exec",
+            description: "Run a command such as go, git or make in the current directory",
+            parameters: [{
+                    name: "commandLine",
+                    type: "string",
+                    description: "The command and its arguments"
+                }
+            ]
+        });
+
+    // Go Eval shell command, the statements and declarations of earlier
+    //  evaluations stay in the REPL session until ":reset"
+    var replSession = null;
+    var evalCmdImpl = {
+        callback: function (args, cwd) {
+            var evaluate = function () {
+                return xhr("POST", "/repl/" + replSession, {
+                    headers: {},
+                    timeout: 120000,
+                    data: args.code
+                });
+            };
+
+            var newSession = function () {
+                return xhr("POST", "/repl", {
+                    headers: {},
+                    timeout: 15000
+                }).then(function (result) {
+                    replSession = JSON.parse(result.response).Id;
+                    return evaluate();
+                });
+            };
+
+            var d = (replSession ? evaluate().then(null, function (error) {
+                    // The session went away while the user was idle
+                    if (error.status === 404) {
+                        return newSession();
+                    }
+                    throw error;
+                }) : newSession()).then(function (result) {
+                    var evaluation = JSON.parse(result.response);
+                    var output = evaluation.Output;
+                    if (evaluation.Errors) {
+                        output = output + evaluation.Errors;
+                    }
+                    if (evaluation.TimedOut) {
+                        output = output + "Timed out\n";
+                    }
+                    return output.replace(/\n/g, "\r\n");
+                }, function (error) {
+                    return "Error evaluating the Go code";
+                });
+
+            return d;
+        }
+    };
+
+    provider.registerServiceProvider(
+        "orion.shell.command",
+        evalCmdImpl, {
+            name: "go eval",
+            description: "Evaluate Go expressions, statements, declarations and imports in a REPL session",
+            parameters: [{
+                    name: "code",
+                    type: "string",
+                    description: "The Go code to evaluate (:reset starts a new session)"
+                }
+            ]
+        });
         
 	provider.registerService(
 		"orion.edit.command", 
@@ -480,6 +798,51 @@ define(['orion/xhr', 'orion/plugin', 'orion/form'], function (xhr, PluginProvide
 			contentType: ["text/x-go"]
 		});
 		
+	[
+		{mode: "refs", name: "References", tooltip: "Find the references to the selected item in the GOPATH (Shift-F3)", key: [114, false, true]},
+		{mode: "callers", name: "Callers", tooltip: "Find the calls to the selected function"},
+		{mode: "callees", name: "Callees", tooltip: "Find the functions that the selected call can go to"}
+	].forEach(function(command) {
+		provider.registerService(
+		"orion.edit.command", 
+		{
+			run: function(selectedText, text, selection, resource) {
+				// guru works on the saved file, which takes byte offsets
+				var byteOffset = 0;
+				for (var i = 0; i < selection.start; i++) {
+					byteOffset = byteOffset + (text.charCodeAt(i) > 0x7F ? 2 : 1);
+				}
+				
+				return {uriTemplate: "/godev/refs/refs.html?mode="+command.mode+"&resource="+resource+"&o="+byteOffset+"&sel="+selection.start, width: "600px", height: "300px"};
+			}
+		},
+		{
+			name: command.name,
+			id: "go." + command.mode,
+			tooltip: command.tooltip,
+			key: command.key,
+			contentType: ["text/x-go"]
+		});
+	});
+		
+	provider.registerService(
+		"orion.edit.command", 
+		{
+			run: function(selectedText, text, selection, resource) {
+				// The problems of the build are by line
+				var line = text.substring(0, selection.start).split("\n").length;
+				
+				return {uriTemplate: "/godev/explain/explain.html?resource="+resource+"&line="+line+"&sel="+selection.start, width: "600px", height: "300px"};
+			}
+		},
+		{
+			name: "Explain Error",
+			id: "go.explain",
+			tooltip: "Explain the compile errors and vet warnings of the current line (Ctrl-Shift-E)",
+			key: ["E", true, true],
+			contentType: ["text/x-go"]
+		});
+		
 	provider.registerService(
 		"orion.edit.command", 
 		{
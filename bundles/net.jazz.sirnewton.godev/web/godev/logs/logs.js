@@ -0,0 +1,137 @@
+/*global define document window */
+/*jslint */
+define(['orion/bootstrap', 'orion/status', 'orion/progress', 'orion/commandRegistry', 'orion/fileClient', 'orion/operationsClient',
+		'orion/searchClient', 'orion/globalCommands', 'godev/taskstream'],
+	function(mBootstrap, mStatus, mProgress, mCommandRegistry, mFileClient, mOperationsClient, mSearchClient, mGlobalCommands,
+			taskstream) {
+
+	// Lines kept on the page, the oldest ones are dropped beyond that
+	var maxLines = 5000;
+
+	mBootstrap.startup().then(function(core) {
+		var serviceRegistry = core.serviceRegistry;
+		var preferences = core.preferences;
+
+		var commandRegistry = new mCommandRegistry.CommandRegistry({});
+		var fileClient = new mFileClient.FileClient(serviceRegistry);
+		var searcher = new mSearchClient.Searcher({
+			serviceRegistry: serviceRegistry,
+			commandService: commandRegistry,
+			fileService: fileClient
+		});
+		var operationsClient = new mOperationsClient.OperationsClient(serviceRegistry);
+		new mStatus.StatusReportingService(serviceRegistry, operationsClient, "statusPane", "notifications", "notificationArea"); //$NON-NLS-2$ //$NON-NLS-1$ //$NON-NLS-0$
+		new mProgress.ProgressService(serviceRegistry, operationsClient, commandRegistry);
+		mGlobalCommands.generateBanner("logs-main", serviceRegistry, commandRegistry, preferences, searcher); //$NON-NLS-0$
+		mGlobalCommands.setPageTarget({
+			task: "Logs",
+			serviceRegistry: serviceRegistry,
+			commandService: commandRegistry
+		});
+
+		var fileInput = document.getElementById("fileInput");
+		var filterInput = document.getElementById("filterInput");
+		var followInput = document.getElementById("follow");
+		var jsonInput = document.getElementById("json");
+		var fieldsInput = document.getElementById("fieldsInput");
+		var whereInput = document.getElementById("whereInput");
+		var tailButton = document.getElementById("tail");
+		var logLines = document.getElementById("logLines");
+		var rightPane = document.getElementById("rightPane");
+		var conn = null;
+
+		// The hash names the file, e.g. #/file/github.com/user/project/app.log
+		if (window.location.hash.indexOf("#/file/") === 0) {
+			fileInput.value = window.location.hash.substring(1);
+		}
+
+		// Records are shown as the field=value pairs of a logfmt line
+		var recordText = function(record) {
+			var text = "";
+			for (var field in record) {
+				if (record.hasOwnProperty(field)) {
+					var value = record[field];
+					if (typeof value !== "string") {
+						value = JSON.stringify(value);
+					}
+					text = text + (text === "" ? "" : " ") + field + "=" + value;
+				}
+			}
+			return text;
+		};
+
+		var addLines = function(lines) {
+			// Keep following the end unless the user has scrolled up
+			var atEnd = rightPane.scrollTop + rightPane.clientHeight >= rightPane.scrollHeight - 5;
+
+			for (var i = 0; i < lines.length; i++) {
+				var div = document.createElement("div");
+				if (lines[i].Error) {
+					div.className = "error";
+					div.textContent = lines[i].Error;
+				} else {
+					div.className = lines[i].Class || "";
+					div.textContent = (lines[i].Record ? recordText(lines[i].Record) : lines[i].Text) || " ";
+				}
+				logLines.appendChild(div);
+			}
+
+			while (logLines.childNodes.length > maxLines) {
+				logLines.removeChild(logLines.firstChild);
+			}
+
+			if (atEnd) {
+				rightPane.scrollTop = rightPane.scrollHeight;
+			}
+		};
+
+		var tail = function() {
+			if (conn) {
+				conn.onclose = null;
+				conn.close();
+			}
+			logLines.innerHTML = "";
+
+			var query = "?file=" + encodeURIComponent(fileInput.value) +
+				"&filter=" + encodeURIComponent(filterInput.value) +
+				"&follow=" + followInput.checked;
+			if (jsonInput.checked) {
+				query = query + "&json=true" +
+					"&fields=" + encodeURIComponent(fieldsInput.value.replace(/\s/g, "")) +
+					"&where=" + encodeURIComponent(whereInput.value);
+			}
+			window.location.hash = fileInput.value;
+
+			conn = taskstream.open("/logs/tail" + query, "/logs/stream" + query);
+			conn.onmessage = function(evt) {
+				addLines(JSON.parse(evt.data));
+			};
+			conn.onclose = function() {
+				conn = null;
+			};
+		};
+
+		tailButton.addEventListener("click", tail);
+		fileInput.addEventListener("keyup", function(evt) {
+			if (evt.keyCode === 13) {
+				tail();
+			}
+		});
+
+		// A new filter applies to the lines that follow
+		filterInput.addEventListener("keyup", function(evt) {
+			if (evt.keyCode !== 13) {
+				return;
+			}
+			if (conn) {
+				conn.send(JSON.stringify({Filter: filterInput.value}));
+			} else {
+				tail();
+			}
+		});
+
+		if (fileInput.value !== "") {
+			tail();
+		}
+	});
+});
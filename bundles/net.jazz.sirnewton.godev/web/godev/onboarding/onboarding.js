@@ -0,0 +1,132 @@
+/*global define document window */
+/*jslint */
+define(['orion/bootstrap', 'orion/status', 'orion/progress', 'orion/commandRegistry', 'orion/fileClient', 'orion/operationsClient',
+		'orion/searchClient', 'orion/globalCommands', 'orion/xhr'],
+	function(mBootstrap, mStatus, mProgress, mCommandRegistry, mFileClient, mOperationsClient, mSearchClient, mGlobalCommands,
+			xhr) {
+
+	mBootstrap.startup().then(function(core) {
+		var serviceRegistry = core.serviceRegistry;
+		var preferences = core.preferences;
+
+		var commandRegistry = new mCommandRegistry.CommandRegistry({});
+		var fileClient = new mFileClient.FileClient(serviceRegistry);
+		var searcher = new mSearchClient.Searcher({
+			serviceRegistry: serviceRegistry,
+			commandService: commandRegistry,
+			fileService: fileClient
+		});
+		var operationsClient = new mOperationsClient.OperationsClient(serviceRegistry);
+		new mStatus.StatusReportingService(serviceRegistry, operationsClient, "statusPane", "notifications", "notificationArea"); //$NON-NLS-2$ //$NON-NLS-1$ //$NON-NLS-0$
+		new mProgress.ProgressService(serviceRegistry, operationsClient, commandRegistry);
+		mGlobalCommands.generateBanner("onboarding-main", serviceRegistry, commandRegistry, preferences, searcher); //$NON-NLS-0$
+		mGlobalCommands.setPageTarget({
+			task: "Project Setup",
+			serviceRegistry: serviceRegistry,
+			commandService: commandRegistry
+		});
+
+		var reportsNode = document.getElementById("reports");
+
+		var errorMessage = function(error) {
+			try {
+				return JSON.parse(error.response).Message;
+			} catch (e) {
+				return "Error: " + error.status;
+			}
+		};
+
+		// Runs the action of a finding, shell commands show their output
+		var runAction = function(action, button, resultNode) {
+			button.disabled = true;
+			resultNode.textContent = " ...";
+
+			xhr(action.Method, action.Url, {
+				headers: {"Content-Type": "application/json"},
+				timeout: 600000,
+				data: JSON.stringify(action.Body)
+			}).then(function(result) {
+				var value = JSON.parse(result.response);
+				if (value.ExitCode) {
+					resultNode.className = "Error";
+					resultNode.textContent = " Failed: " + value.Output;
+					button.disabled = false;
+					return;
+				}
+				resultNode.textContent = " Done";
+			}, function(error) {
+				resultNode.className = "Error";
+				resultNode.textContent = " " + errorMessage(error);
+				button.disabled = false;
+			});
+		};
+
+		var addReport = function(report) {
+			var header = document.createElement("h2");
+			header.textContent = report.Location.replace("/file/", "") + " (" + new Date(report.Analyzed).toLocaleString() + ")";
+			reportsNode.appendChild(header);
+
+			var again = document.createElement("button");
+			again.textContent = "Analyze again";
+			again.addEventListener("click", function() {
+				again.disabled = true;
+				xhr("POST", "/onboarding?location=" + encodeURIComponent(report.Location), {
+					headers: {},
+					timeout: 15000
+				});
+			});
+			header.appendChild(again);
+
+			if (report.Findings.length === 0) {
+				var none = document.createElement("div");
+				none.textContent = "Everything is set up";
+				reportsNode.appendChild(none);
+			}
+
+			report.Findings.forEach(function(finding) {
+				var row = document.createElement("div");
+				row.className = "finding";
+
+				var message = document.createElement("span");
+				message.className = finding.Severity;
+				message.textContent = finding.Message;
+				row.appendChild(message);
+
+				if (finding.Action) {
+					var button = document.createElement("button");
+					var resultNode = document.createElement("span");
+					button.textContent = finding.Action.Label;
+					button.addEventListener("click", function() {
+						runAction(finding.Action, button, resultNode);
+					});
+					row.appendChild(button);
+					row.appendChild(resultNode);
+				}
+				reportsNode.appendChild(row);
+			});
+		};
+
+		var load = function() {
+			// The hash names the project, e.g. #/file/github.com/user/project
+			var location = window.location.hash.substring(1);
+
+			xhr("GET", "/onboarding" + (location ? "?location=" + encodeURIComponent(location) : ""), {
+				headers: {},
+				timeout: 15000
+			}).then(function(result) {
+				var value = JSON.parse(result.response);
+				reportsNode.textContent = "";
+				var reports = location ? [value] : value;
+				if (reports.length === 0) {
+					reportsNode.textContent = "New projects are analyzed when they are added to the workspace.";
+				}
+				reports.forEach(addReport);
+			}, function(error) {
+				reportsNode.textContent = errorMessage(error);
+			});
+		};
+
+		window.addEventListener("hashchange", load);
+		load();
+	});
+});
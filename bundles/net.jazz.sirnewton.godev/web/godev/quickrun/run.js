@@ -1,8 +1,8 @@
 /*global window define document*/
 /*browser:true*/
 
-define(['orion/bootstrap', 'orion/xhr', 'terminal/term'], 
-function(mBootstrap, xhr, terminal) {
+define(['orion/bootstrap', 'orion/xhr', 'terminal/term', 'godev/taskstream'], 
+function(mBootstrap, xhr, terminal, taskstream) {
 
 	mBootstrap.startup().then(function(core) {
 		var term;
@@ -73,13 +73,11 @@ function(mBootstrap, xhr, terminal) {
 		
 		term.open(termAreaNode);
 
-		var wsUrl = document.URL.replace("http://", "ws://");
-		wsUrl = wsUrl.replace("https://", "wss://");
-		wsUrl = wsUrl.substring(0, wsUrl.indexOf("/godev")) + "/debug/socket?run="+resource.substring(5);
+		var query = "?run="+resource.substring(5);
 		
 		term.write("[Process Started - Press Ctrl-C to stop]\r\n");
 		
-		ws = new WebSocket(wsUrl);
+		ws = taskstream.open("/debug/socket" + query, "/debug/stream" + query, true);
 		
 		ws.onopen = function(evt) {
 		};
@@ -0,0 +1,118 @@
+/*global window define document*/
+/*browser:true*/
+
+define(['orion/bootstrap', 'orion/xhr'], 
+function(mBootstrap, xhr) {
+
+	mBootstrap.startup().then(function(core) {
+		// refs.html?mode=refs|callers|callees&resource=<location>&o=<byte offset>&sel=<selection>
+		var param = function(name) {
+			var match = new RegExp("[?&]" + name + "=([^&]*)").exec(document.URL);
+			return match ? decodeURIComponent(match[1]) : "";
+		};
+		
+		var mode = param("mode") || "refs";
+		var resource = param("resource");
+		var offset = param("o");
+		var selectionInt = parseInt(param("sel"));
+		
+		var titles = {refs: "References", callers: "Callers", callees: "Callees"};
+		document.getElementById("title").textContent = titles[mode];
+		
+		// Canceling the dialog preserves the selection the user had before
+		//  opening the dialog
+		var cancel = function() {
+			window.setTimeout(function() {
+				var result = {selection: {start: selectionInt, end: selectionInt}};
+				
+				window.parent.postMessage(JSON.stringify({
+				   pageService: "orion.page.delegatedUI",
+				   source: "go." + mode,
+				   result: result
+				}), "*");
+			}, 100);
+		};
+		
+		// The editor could be showing another file after following a link
+		var shutdown = function() {
+			window.setTimeout(function() {
+				window.parent.postMessage(JSON.stringify({
+				   pageService: "orion.page.delegatedUI",
+				   source: "go." + mode,
+				   cancelled: true
+				}), "*");
+			}, 100);
+		};
+		
+		document.addEventListener("keyup", function(evt) {
+			if (evt.keyCode === 27) {
+				cancel();
+			}
+		});
+		
+		document.getElementById("closeDialog").addEventListener("click", function(evt) {
+			shutdown();
+		});
+		
+		var linkAreaNode = document.getElementById("linkArea");
+		
+		var addLink = function(ref, label) {
+			var row = document.createElement("div");
+			var link = document.createElement("a");
+			link.setAttribute("tabindex", "0");
+			link.setAttribute("target", "_top");
+			link.setAttribute("href", "/edit/edit.html#" + ref.Location + ",line=" + ref.Line + ",random=" + Math.random());
+			link.textContent = ref.Location.replace("/file", "") + ":" + ref.Line;
+			link.addEventListener("mouseup", function(evt) {
+				if (!evt.ctrlKey) {
+					shutdown();
+				}
+			});
+			row.appendChild(link);
+			
+			if (label) {
+				var text = document.createElement("span");
+				text.textContent = " " + label;
+				row.appendChild(text);
+			}
+			linkAreaNode.appendChild(row);
+		};
+		
+		xhr("POST", "/go/" + mode + resource + "?o=" + offset, {
+			headers: {},
+			timeout: 120000
+		}).then(function(result) {
+			var value = JSON.parse(result.response);
+			linkAreaNode.textContent = "";
+			
+			if (mode === "refs") {
+				var header = document.createElement("div");
+				header.textContent = value.Desc;
+				linkAreaNode.appendChild(header);
+				
+				value.References.forEach(function(ref) {
+					if (ref.Location !== "") {
+						addLink(ref, ref.Text);
+					}
+				});
+				return;
+			}
+			
+			if (value.Calls.length === 0) {
+				linkAreaNode.textContent = "No calls found";
+			}
+			value.Calls.forEach(function(call) {
+				if (call.Location !== "") {
+					addLink(call, call.Name);
+				}
+			});
+		}, function(error) {
+			var message = "Error running guru. Try installing it with 'go get golang.org/x/tools/cmd/guru'";
+			try {
+				message = JSON.parse(error.response).Message;
+			} catch (e) {
+			}
+			linkAreaNode.textContent = message;
+		});
+	});
+});
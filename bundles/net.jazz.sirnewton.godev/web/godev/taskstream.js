@@ -0,0 +1,193 @@
+/*global window define document WebSocket EventSource XMLHttpRequest TextDecoder TextEncoder*/
+/*browser:true*/
+
+// Connects to a task (run, debug or test) on the server. A WebSocket is used
+//  whenever possible. When the upgrade fails, as it does behind some proxies,
+//  the task is streamed with server-sent events and the input is posted back.
+//  Either way the returned connection looks like a WebSocket to the caller.
+//  Terminals ask for binary frames, deflated when the browser can inflate
+//  them, and acknowledge the output so that the server holds it back on a
+//  slow link instead of flooding it.
+define([], function() {
+	var origin = window.location.protocol + "//" + window.location.host;
+	var frameWindow = 262144;
+
+	function framesUrl(url) {
+		var query = "frames=binary&window=" + frameWindow;
+		if (window.DecompressionStream) {
+			query = query + "&compress=deflate";
+		}
+		return url + (url.indexOf("?") === -1 ? "?" : "&") + query;
+	}
+
+	// Turns the binary frames into text for deliver, acknowledging each
+	//  piece of output once it is delivered
+	function frameReader(ws, deliver) {
+		var decoder = new TextDecoder();
+		var ack = function(n) {
+			ws.send(JSON.stringify({Ack: n}));
+		};
+
+		if (!window.DecompressionStream) {
+			return function(data) {
+				var bytes = new Uint8Array(data);
+				deliver(decoder.decode(bytes, {stream: true}));
+				ack(bytes.length);
+			};
+		}
+
+		var inflater = new window.DecompressionStream("deflate-raw");
+		var writer = inflater.writable.getWriter();
+		var reader = inflater.readable.getReader();
+		var pump = function() {
+			reader.read().then(function(result) {
+				if (result.done) {
+					return;
+				}
+				deliver(decoder.decode(result.value, {stream: true}));
+				ack(result.value.length);
+				pump();
+			});
+		};
+		pump();
+
+		return function(data) {
+			writer.write(new Uint8Array(data));
+		};
+	}
+
+	// A WebSocket at the url, which speaks binary frames when binary is set
+	function openSocket(conn, url, binary) {
+		var ws = new WebSocket(binary ? framesUrl(url) : url);
+		var encoder = binary ? new TextEncoder() : null;
+		var read = null;
+
+		if (binary) {
+			ws.binaryType = "arraybuffer";
+			read = frameReader(ws, function(text) {
+				if (conn.onmessage) {
+					conn.onmessage({data: text});
+				}
+			});
+		}
+
+		ws.onmessage = function(evt) {
+			if (read !== null && typeof evt.data !== "string") {
+				read(evt.data);
+			} else if (conn.onmessage) {
+				conn.onmessage(evt);
+			}
+		};
+
+		ws.onclose = function(evt) {
+			if (conn.onclose) {
+				conn.onclose(evt);
+			}
+		};
+
+		conn.send = function(data) {
+			ws.send(encoder !== null ? encoder.encode(data) : data);
+		};
+
+		conn.close = function() {
+			ws.close();
+		};
+
+		return ws;
+	}
+
+	function openEventSource(conn, streamPath) {
+		var source = new EventSource(origin + streamPath);
+		var inputPath = null;
+		var closed = false;
+
+		var finish = function(evt) {
+			if (closed) {
+				return;
+			}
+			closed = true;
+			source.close();
+			if (conn.onclose) {
+				conn.onclose(evt);
+			}
+		};
+
+		source.addEventListener("stream", function(evt) {
+			inputPath = streamPath.replace(/\?.*$/, "") + "/" + JSON.parse(evt.data).Id;
+			if (conn.onopen) {
+				conn.onopen(evt);
+			}
+		});
+
+		source.addEventListener("output", function(evt) {
+			if (conn.onmessage) {
+				conn.onmessage({data: JSON.parse(evt.data)});
+			}
+		});
+
+		source.addEventListener("end", finish);
+		source.onerror = finish;
+
+		conn.send = function(data) {
+			if (inputPath === null) {
+				return;
+			}
+			var request = new XMLHttpRequest();
+			request.open("POST", origin + inputPath);
+			request.send(data);
+		};
+
+		conn.close = finish;
+	}
+
+	return {
+		open: function(socketPath, streamPath, binary) {
+			var conn = {};
+			var opened = false;
+			var ws;
+
+			try {
+				ws = openSocket(conn, origin.replace(/^http/, "ws") + socketPath, binary);
+			} catch (e) {
+				openEventSource(conn, streamPath);
+				return conn;
+			}
+
+			ws.onopen = function(evt) {
+				opened = true;
+				if (conn.onopen) {
+					conn.onopen(evt);
+				}
+			};
+
+			ws.onerror = function(evt) {
+				if (!opened) {
+					// The upgrade was refused, fall back to an event stream
+					ws.onclose = null;
+					openEventSource(conn, streamPath);
+				}
+			};
+
+			return conn;
+		},
+
+		// A terminal at the WebSocket url, which has no event stream
+		socket: function(url) {
+			var conn = {};
+			var ws = openSocket(conn, url, true);
+
+			ws.onopen = function(evt) {
+				if (conn.onopen) {
+					conn.onopen(evt);
+				}
+			};
+			ws.onerror = function(evt) {
+				if (conn.onerror) {
+					conn.onerror(evt);
+				}
+			};
+
+			return conn;
+		}
+	};
+});
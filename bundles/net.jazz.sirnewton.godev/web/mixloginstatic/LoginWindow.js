@@ -384,6 +384,15 @@ define(['domReady', 'orion/xhr', 'orion/PageUtil', 'orion/webui/littlelib', 'per
 					forceUserEmail = responseObject.ForceEmail;
 					document.getElementById("create_email").setAttribute("aria-required", forceUserEmail);
 					registrationURI = responseObject.RegistrationURI;
+					// BEGIN GODEV CUSTOMIZATION
+					(responseObject.Providers || []).forEach(function(provider) {
+						var link = document.createElement("a");
+						link.className = "loginIcon";
+						link.href = ".." + provider.Url;
+						link.textContent = "Sign in with " + provider.Title;
+						document.getElementById("orionOpen").querySelector(".orion-open-images").appendChild(link);
+					});
+					// END GODEV CUSTOMIZATION
 					if (!userCreationEnabled && !registrationURI) {
 						formatForNoUserCreation();
 					}
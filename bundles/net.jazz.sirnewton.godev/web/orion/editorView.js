@@ -38,7 +38,8 @@ define([
 	'orion/keyBinding',
 	'orion/uiUtils',
 	'orion/util',
-	'orion/objects'
+	'orion/objects',
+	'godev/events'
 ], function(
 	messages,
 	mEditor, mTextView, mTextModel, mProjectionTextModel, mEditorFeatures, mContentAssist, mEmacs, mVI,
@@ -46,7 +47,7 @@ define([
 	mSearcher, mEditorCommands, mGlobalCommands,
 	mDispatcher, EditorContext, TypeDefRegistry, Highlight,
 	mMarkOccurrences, mSyntaxchecker,
-	mKeyBinding, mUIUtils, util, objects
+	mKeyBinding, mUIUtils, util, objects, events
 ) {
 
 	function parseNumericParams(input, params) {
@@ -99,6 +100,21 @@ define([
 				this.editor.resize();
 			}
 		}.bind(this));
+		// Files opened from outside of the browser, e.g. "godev open"
+		events.on("open", function(data) {
+			window.location.hash = data.Location + (data.Line ? ",line=" + data.Line : "");
+			window.focus();
+		});
+		// Findings of the analysis of a newly added project
+		events.on("onboarding", function(report) {
+			var name = report.Location.replace("/file/", "").replace(/&/g, "&amp;").replace(/</g, "&lt;");
+			this.statusService.setProgressResult({
+				Message: "Project " + name + " needs some setup: <a href=\"/godev/onboarding/onboarding.html#" +
+					encodeURI(report.Location) + "\">" + report.Findings.length + " suggestion(s)</a>",
+				Severity: "Warning",
+				HTML: true
+			});
+		}.bind(this));
 		this.settings = {};
 		this._init();
 	}
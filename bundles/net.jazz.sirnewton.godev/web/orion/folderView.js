@@ -26,11 +26,13 @@ define([
 	'orion/projects/projectView',
 	// BEGIN GODEV CUSTOMIZATIONS
 	'orion/xhr',
+	'godev/taskstream',
 	// END GODEV CUSTOMIZATION
 	'orion/section'
 ], function(messages, mGlobalCommands, mExplorerTable, mNavigatorRenderer, Selection, FileCommands, mMarkdownView, mProjectEditor, PageUtil, URITemplate, lib, objects, Deferred, mProjectView,
 // BEGIN GODEV CUSTOMIZATIONS
 xhr,
+taskstream,
 // END GODEV CUSTOMIZATIONS
 mSection) {
 	
@@ -573,13 +575,10 @@ mSection) {
 					
 					div2.setAttribute("style", "");
 
-					var wsUrl = document.URL.replace("http://", "ws://") + "output";
-					wsUrl = wsUrl.replace("https://", "wss://");
-					wsUrl = wsUrl.substring(0, wsUrl.indexOf("/edit/edit.html#/file"));
-					wsUrl = wsUrl + "/test?pkg=" +pkg;
+					var query = "?pkg=" +pkg;
 					
 					if (race) {
-						wsUrl = wsUrl + "&race=true";
+						query = query + "&race=true";
 					}
 					
 					var table;
@@ -596,7 +595,7 @@ mSection) {
 						content.appendChild(text);
 					}
 					
-					var websocket = new WebSocket(wsUrl);
+					var websocket = taskstream.open("/test" + query, "/test/stream" + query);
 					websocket.onopen = function(evt) {
 						table = document.createElement("table");
 						var tr;
@@ -176,9 +176,50 @@ define("orion/editor/contentAssist", [ //$NON-NLS-0$
 			this.setState(State.INACTIVE);
 			var proposalText = typeof proposal === "string" ? proposal : proposal.proposal; //$NON-NLS-0$
 			view.setText(proposalText, start, end);
+			if (proposal.additionalEdits && proposal.additionalEdits.length > 0) {
+				data.proposal = this._applyAdditionalEdits(proposal, start);
+			}
 			this.dispatchEvent({type: "ProposalApplied", data: data}); //$NON-NLS-0$
 			return true;
 		},
+		/**
+		 * Applies the additional edits of a proposal (e.g. adding an import), which have to come before it
+		 * in the buffer, and moves the positions of the proposal along with the text.
+		 * @private
+		 */
+		_applyAdditionalEdits: function(proposal, start) {
+			var view = this.textView;
+			var edits = proposal.additionalEdits.slice().sort(function(a, b) {
+				return b.offset - a.offset;
+			});
+			var shift = 0;
+			for (var i = 0; i < edits.length; i++) {
+				var edit = edits[i];
+				if (edit.offset + edit.length > start) {
+					continue;
+				}
+				view.setText(edit.text, edit.offset, edit.offset + edit.length);
+				shift += edit.text.length - edit.length;
+			}
+			if (shift === 0) {
+				return proposal;
+			}
+			var shifted = {};
+			for (var key in proposal) {
+				if (proposal.hasOwnProperty(key)) {
+					shifted[key] = proposal[key];
+				}
+			}
+			if (proposal.positions) {
+				shifted.positions = proposal.positions.map(function(position) {
+					return {offset: position.offset + shift, length: position.length};
+				});
+			}
+			if (typeof proposal.escapePosition === "number") { //$NON-NLS-0$
+				shifted.escapePosition = proposal.escapePosition + shift;
+			}
+			return shifted;
+		},
 		activate: function(providerInfoArray, autoTriggered) {
 			if (this.state === State.INACTIVE) {
 				this._autoTriggered = autoTriggered ? true : false;
@@ -86,7 +86,8 @@ define([
 					occurrenceTimer = null;
 					var editor = self.editor;
 					var context = {
-						selection: editor.getSelection()	
+						selection: editor.getSelection(),
+						title: self.inputManager.getInput()
 					};
 					occurrencesService.computeOccurrences(EditorContext.getEditorContext(self.registry), context).then(function (occurrences) {
 						self.editor.showOccurrences(occurrences);
@@ -193,6 +193,8 @@ function Terminal(options) {
   this.y = 0;
   this.cursorState = 0;
   this.cursorHidden = false;
+  this.bracketedPaste = false;
+  this._trueColors = null;
   this.convertEol;
   this.state = 0;
   this.queue = '';
@@ -394,7 +396,10 @@ Terminal.defaults = {
   scrollback: 1000,
   screenKeys: false,
   debug: false,
-  useStyle: false
+  useStyle: false,
+  // What OSC 52 may do with the system clipboard: 'off', 'write' or
+  // 'readwrite'
+  clipboard: 'off'
   // programFeatures: false,
   // focusKeys: false,
 };
@@ -491,9 +496,9 @@ Terminal.bindPaste = function(document) {
     var term = Terminal.focus;
     if (!term) return;
     if (ev.clipboardData) {
-      term.send(ev.clipboardData.getData('text/plain'));
+      term.sendPaste(ev.clipboardData.getData('text/plain'));
     } else if (term.context.clipboardData) {
-      term.send(term.context.clipboardData.getData('Text'));
+      term.sendPaste(term.context.clipboardData.getData('Text'));
     }
     // Not necessary. Do it anyway for good measure.
     term.element.contentEditable = 'inherit';
@@ -1779,6 +1784,7 @@ Terminal.prototype.write = function(data) {
               break;
             case 52:
               // manipulate selection data
+              this.selectionData(this.params[1]);
               break;
             case 104:
             case 105:
@@ -2669,6 +2675,70 @@ Terminal.prototype.send = function(data) {
   this.queue += data;
 };
 
+// Pasted text goes in brackets when the program asked for them, without
+// anything in it that would end the brackets early.
+Terminal.prototype.sendPaste = function(data) {
+  if (!this.bracketedPaste) {
+    this.send(data);
+    return;
+  }
+
+  this.send('\x1b[200~' + data.replace(/\x1b\[20[01]~/g, '') + '\x1b[201~');
+};
+
+// OSC 52 ; Pc ; Pd - sets the clipboard to the base64 data, or answers
+// with it when the data is '?', as far as the clipboard option allows.
+Terminal.prototype.selectionData = function(param) {
+  var self = this
+    , clipboard = this.context.navigator && this.context.navigator.clipboard
+    , data = String(param || '').split(';')[1];
+
+  if (!clipboard || data == null) return;
+
+  if (data === '?') {
+    if (this.clipboard !== 'readwrite' || !clipboard.readText) return;
+    clipboard.readText().then(function(text) {
+      self.send('\x1b]52;c;'
+        + self.context.btoa(unescape(encodeURIComponent(text)))
+        + '\x07');
+    });
+    return;
+  }
+
+  if (this.clipboard !== 'write' && this.clipboard !== 'readwrite') return;
+  if (!clipboard.writeText) return;
+
+  try {
+    clipboard.writeText(decodeURIComponent(escape(this.context.atob(data))));
+  } catch (e) {
+    this.log('Invalid OSC 52 data.');
+  }
+};
+
+// 24-bit colors get slots of their own after the palette and the default
+// colors as long as there are free ones, the closest palette color after
+// that.
+Terminal.prototype.trueColor = function(r, g, b) {
+  var key = (r << 16) | (g << 8) | b
+    , idx;
+
+  if (!this._trueColors) {
+    this._trueColors = {};
+    this._trueColorNext = 258;
+    this.colors = this.colors.slice();
+  }
+
+  idx = this._trueColors[key];
+  if (idx != null) return idx;
+
+  // 0x1ff is the default color
+  if (this._trueColorNext >= 0x1ff) return matchColor(r, g, b);
+
+  idx = this._trueColorNext++;
+  this.colors[idx] = '#' + ((1 << 24) | key).toString(16).slice(1);
+  return this._trueColors[key] = idx;
+};
+
 Terminal.prototype.bell = function() {
   if (!this.visualBell) return;
   var self = this;
@@ -3195,7 +3265,7 @@ Terminal.prototype.charAttributes = function(params) {
       // fg color 256
       if (params[i + 1] === 2) {
         i += 2;
-        fg = matchColor(
+        fg = this.trueColor(
           params[i] & 0xff,
           params[i + 1] & 0xff,
           params[i + 2] & 0xff);
@@ -3210,7 +3280,7 @@ Terminal.prototype.charAttributes = function(params) {
       // bg color 256
       if (params[i + 1] === 2) {
         i += 2;
-        bg = matchColor(
+        bg = this.trueColor(
           params[i] & 0xff,
           params[i + 1] & 0xff,
           params[i + 2] & 0xff);
@@ -3742,6 +3812,9 @@ Terminal.prototype.setMode = function(params) {
       case 25: // show cursor
         this.cursorHidden = false;
         break;
+      case 2004: // bracketed paste
+        this.bracketedPaste = true;
+        break;
       case 1049: // alt screen buffer cursor
         //this.saveCursor();
         ; // FALL-THROUGH
@@ -3921,6 +3994,9 @@ Terminal.prototype.resetMode = function(params) {
       case 25: // hide cursor
         this.cursorHidden = true;
         break;
+      case 2004: // bracketed paste
+        this.bracketedPaste = false;
+        break;
       case 1049: // alt screen buffer cursor
         ; // FALL-THROUGH
       case 47: // normal screen buffer
@@ -14,10 +14,10 @@
 
 define(["require", "orion/browserCompatibility", "orion/bootstrap", "orion/xhr", "orion/Deferred",
 	"orion/commandRegistry", "orion/fileClient", "orion/searchClient", "orion/globalCommands",
-	"orion/status", "orion/progress", "orion/operationsClient", "terminal/term"],
+	"orion/status", "orion/progress", "orion/operationsClient", "terminal/term", "godev/taskstream"],
 
 function(require, mBrowserCompatibility, mBootstrap, xhr, Deferred, mCommandRegistry, mFileClient,
-mSearchClient, mGlobalCommands, mStatus, mProgress, mOperationsClient, terminal) {
+mSearchClient, mGlobalCommands, mStatus, mProgress, mOperationsClient, terminal, taskstream) {
 
 	var orionTerminal = {
 		connect: function() {
@@ -68,8 +68,17 @@ mSearchClient, mGlobalCommands, mStatus, mProgress, mOperationsClient, terminal)
 			orionTerminal.connect().then(function(result) {
 				var jsonObject = JSON.parse(result.responseText);
 				var attachWsURI = jsonObject.attachWsURI;
+				term.options.clipboard = jsonObject.clipboard || "off";
 				term.reset();
-				websocket = new WebSocket(attachWsURI);
+				// #record keeps a recording of the session in /terminal/recordings,
+				//  #attach=<id> joins a terminal that was shared with an invite
+				var attach = /^#attach=(.+)$/.exec(window.location.hash);
+				if (attach) {
+					attachWsURI = attachWsURI + "?attach=" + attach[1];
+				} else if (window.location.hash === "#record") {
+					attachWsURI = attachWsURI + "?record=true";
+				}
+				websocket = taskstream.socket(attachWsURI);
 				websocket.onopen = function(evt) {
 					onOpen(evt);
 				};
@@ -138,7 +147,8 @@ mSearchClient, mGlobalCommands, mStatus, mProgress, mOperationsClient, terminal)
 				cols: 80,
 				rows: 24,
 				useStyle: true,
-				screenKeys: true
+				screenKeys: true,
+				termName: "xterm-256color"
 			});
 			term.open(document.getElementById("terminal"));
 
@@ -0,0 +1,245 @@
+// Copyright 2014 Chris McGee <sirnewton_01@yahoo.ca>. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"archive/zip"
+	"bytes"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// A bundle that is a zip file, either <name>.zip in the bundles directory
+// or a godev-bundle.zip in the source directories. The root of the archive
+// is the root of the bundle's files, like the web directory of the core
+// bundles or a godev-bundle directory. The archive is read again when it
+// changes.
+type zipFileSystem struct {
+	path string
+
+	mutex   sync.Mutex
+	size    int64
+	modTime time.Time
+	files   map[string]*zip.File
+	// Names of the entries of each directory
+	dirs map[string]map[string]os.FileInfo
+}
+
+// Directory of an archive, which doesn't need an entry of its own
+type zipDirInfo struct {
+	name    string
+	modTime time.Time
+}
+
+func (info zipDirInfo) Name() string       { return info.name }
+func (info zipDirInfo) Size() int64        { return 0 }
+func (info zipDirInfo) Mode() os.FileMode  { return os.ModeDir | 0555 }
+func (info zipDirInfo) ModTime() time.Time { return info.modTime }
+func (info zipDirInfo) IsDir() bool        { return true }
+func (info zipDirInfo) Sys() interface{}   { return nil }
+
+type zipHttpFile struct {
+	*bytes.Reader
+	info    os.FileInfo
+	entries []os.FileInfo
+}
+
+func (f *zipHttpFile) Close() error {
+	return nil
+}
+
+func (f *zipHttpFile) Readdir(count int) ([]os.FileInfo, error) {
+	if count > 0 && len(f.entries) == 0 {
+		return nil, io.EOF
+	}
+
+	entries := f.entries
+	if count > 0 && count < len(entries) {
+		entries = entries[:count]
+	}
+	f.entries = f.entries[len(entries):]
+
+	return entries, nil
+}
+
+func (f *zipHttpFile) Stat() (os.FileInfo, error) {
+	return f.info, nil
+}
+
+func isZipBundle(dir string) bool {
+	return strings.HasSuffix(dir, ".zip")
+}
+
+func openZipFileSystem(zipPath string) (*zipFileSystem, error) {
+	z := &zipFileSystem{path: zipPath}
+
+	z.mutex.Lock()
+	defer z.mutex.Unlock()
+
+	if err := z.load(); err != nil {
+		return nil, err
+	}
+
+	return z, nil
+}
+
+// Reads the archive unless it is the same as the last time, the mutex must
+// be held. The whole archive is kept in memory so that no file stays open
+// for it.
+func (z *zipFileSystem) load() error {
+	info, err := os.Stat(z.path)
+	if err != nil {
+		return err
+	}
+	if z.files != nil && info.Size() == z.size && info.ModTime().Equal(z.modTime) {
+		return nil
+	}
+
+	b, err := ioutil.ReadFile(z.path)
+	if err != nil {
+		return err
+	}
+	reader, err := zip.NewReader(bytes.NewReader(b), int64(len(b)))
+	if err != nil {
+		return err
+	}
+
+	files := make(map[string]*zip.File)
+	dirs := map[string]map[string]os.FileInfo{"/": {}}
+	addDir := func(name string) {
+		for dir := name; dir != "/"; dir = path.Dir(dir) {
+			if _, ok := dirs[dir]; !ok {
+				dirs[dir] = make(map[string]os.FileInfo)
+			}
+			dirs[path.Dir(dir)][path.Base(dir)] = zipDirInfo{path.Base(dir), info.ModTime()}
+		}
+	}
+
+	for _, f := range reader.File {
+		// Cleaning keeps the names inside of the archive
+		name := path.Clean("/" + f.Name)
+		if name == "/" {
+			continue
+		}
+		if f.FileInfo().IsDir() {
+			addDir(name)
+			continue
+		}
+
+		addDir(path.Dir(name))
+		files[name] = f
+		dirs[path.Dir(name)][path.Base(name)] = f.FileInfo()
+	}
+
+	z.files, z.dirs = files, dirs
+	z.size, z.modTime = info.Size(), info.ModTime()
+	cfsLog.Printf("Bundle archive %v loaded with %v files\n", z.path, len(files))
+
+	return nil
+}
+
+func (z *zipFileSystem) Open(name string) (http.File, error) {
+	name = path.Clean("/" + name)
+
+	z.mutex.Lock()
+	defer z.mutex.Unlock()
+
+	if err := z.load(); err != nil {
+		return nil, err
+	}
+
+	if entries, ok := z.dirs[name]; ok {
+		infos := []os.FileInfo{}
+		for _, info := range entries {
+			infos = append(infos, info)
+		}
+		sort.Slice(infos, func(i, j int) bool { return infos[i].Name() < infos[j].Name() })
+
+		return &zipHttpFile{Reader: bytes.NewReader(nil), info: zipDirInfo{path.Base(name), z.modTime}, entries: infos}, nil
+	}
+
+	f, ok := z.files[name]
+	if !ok {
+		return nil, os.ErrNotExist
+	}
+	content, err := z.read(f)
+	if err != nil {
+		return nil, err
+	}
+
+	return &zipHttpFile{Reader: bytes.NewReader(content), info: f.FileInfo()}, nil
+}
+
+func (z *zipFileSystem) read(f *zip.File) ([]byte, error) {
+	r, err := f.Open()
+	if err != nil {
+		return nil, err
+	}
+	defer r.Close()
+
+	return ioutil.ReadAll(r)
+}
+
+// Passes each file of the archive to fn, sorted by name
+func (z *zipFileSystem) walk(fn func(logicalPath string, read func() ([]byte, error))) {
+	z.mutex.Lock()
+	if err := z.load(); err != nil {
+		z.mutex.Unlock()
+		return
+	}
+	files := z.files
+	z.mutex.Unlock()
+
+	names := []string{}
+	for name := range files {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	for _, name := range names {
+		f := files[name]
+		fn(name, func() ([]byte, error) { return z.read(f) })
+	}
+}
+
+// Passes each file of a bundle to fn with its path at the root of the
+// bundles, whether the bundle is a directory or an archive
+func walkBundle(layer http.FileSystem, dir string, fn func(logicalPath string, read func() ([]byte, error))) {
+	if z, ok := layer.(*zipFileSystem); ok {
+		z.walk(fn)
+		return
+	}
+
+	filepath.Walk(dir, func(p string, info os.FileInfo, err error) error {
+		if err != nil || info.IsDir() {
+			return nil
+		}
+
+		relPath, err := filepath.Rel(dir, p)
+		if err != nil {
+			return nil
+		}
+
+		fn("/"+filepath.ToSlash(relPath), func() ([]byte, error) { return ioutil.ReadFile(p) })
+		return nil
+	})
+}
+
+// Name of the bundle of a directory or an archive for its packed scripts
+func bundlePackName(dir string) string {
+	if isZipBundle(dir) && filepath.Base(dir) != "godev-bundle.zip" {
+		return strings.TrimSuffix(filepath.Base(dir), ".zip")
+	}
+
+	return filepath.Base(filepath.Dir(dir))
+}
@@ -1,84 +1,292 @@
 package main
 
 import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
 	"errors"
+	"fmt"
 	"net/http"
 	"os"
 	"path/filepath"
 	"sort"
+	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
+
+	"github.com/fsnotify/fsnotify"
 )
 
+// Snapshot of the bundles. A snapshot is never changed once it is
+// published, changes make a copy and swap it in, so that requests read the
+// bundles without taking a lock.
 type cfsData struct {
-	fs         []http.FileSystem
-	dirs       []string
+	// Generated files that shadow all of the bundles
+	overlay memFS
+	fs      []http.FileSystem
+	dirs    []string
+	// Name of each bundle, its directory in the bundles or the directory
+	//  next to its bundle.html
+	names      []string
 	pluginKeys []string
-	Plugins    map[string]bool `json:"/plugins"`
+	// The bundle.json of each bundle, nil for those without one
+	manifests []*BundleManifest
+	Plugins   map[string]bool `json:"/plugins"`
+	// Why each bundle that can't be loaded was rejected, by its path
+	Rejected map[string]string `json:"/godev/rejectedBundles"`
+	// The JSON of defaults.pref
+	defaults []byte
 }
 
 type ChainedFileSystem struct {
+	// Serializes the changes, readers only load the snapshot
 	mutex sync.Mutex
-	data  *cfsData
+	data  atomic.Pointer[cfsData]
+	// Files of the bundles that were served recently
+	cache *fileCache
+}
+
+func (data *cfsData) clone() *cfsData {
+	plugins := make(map[string]bool, len(data.Plugins))
+	for key, value := range data.Plugins {
+		plugins[key] = value
+	}
+
+	rejected := make(map[string]string, len(data.Rejected))
+	for key, value := range data.Rejected {
+		rejected[key] = value
+	}
+
+	return &cfsData{
+		overlay:    data.overlay,
+		fs:         append([]http.FileSystem{}, data.fs...),
+		dirs:       append([]string{}, data.dirs...),
+		names:      append([]string{}, data.names...),
+		pluginKeys: append([]string{}, data.pluginKeys...),
+		manifests:  append([]*BundleManifest{}, data.manifests...),
+		Plugins:    plugins,
+		Rejected:   rejected,
+	}
 }
 
 ///////////////////////////////////////////////////////////////////////////////
-//
+// The current bundles, which must not be modified
 ///////////////////////////////////////////////////////////////////////////////
-func (cfs *ChainedFileSystem) Open(name string) (http.File, error) {
+func (cfs *ChainedFileSystem) snapshot() *cfsData {
+	return cfs.data.Load()
+}
+
+///////////////////////////////////////////////////////////////////////////////
+// Applies a change to a copy of the bundles, published if it changed them
+///////////////////////////////////////////////////////////////////////////////
+func (cfs *ChainedFileSystem) update(change func(data *cfsData) bool) {
 	cfs.mutex.Lock()
 	defer cfs.mutex.Unlock()
 
-	data := cfs.data
+	data := cfs.data.Load().clone()
+	if !change(data) {
+		return
+	}
+
+	cfs.publish(data)
+}
+
+// Stores the snapshot with its defaults, the mutex must be held
+func (cfs *ChainedFileSystem) publish(data *cfsData) {
+	b, err := json.Marshal(data)
+	if err != nil {
+		cfsLog.Errorf("Unable to marshal defaults: %v\n", err)
+	}
+	data.defaults = b
+
+	cfs.data.Store(data)
+	cfs.cache.clear()
+}
+
+///////////////////////////////////////////////////////////////////////////////
+//
+///////////////////////////////////////////////////////////////////////////////
+func (cfs *ChainedFileSystem) Open(name string) (http.File, error) {
+	f, _, err := cfs.openFrom(name)
+	return f, err
+}
+
+///////////////////////////////////////////////////////////////////////////////
+// Opens the file along with the name of what it came from, the generated
+//  files, a mounted bundle or the directory of a bundle.
+///////////////////////////////////////////////////////////////////////////////
+func (cfs *ChainedFileSystem) openFrom(name string) (http.File, string, error) {
+	// The cache is read before the snapshot, so that a file of bundles that
+	//  change meanwhile isn't cached
+	key := cacheKey(name)
+	cached, generation := cfs.cache.get(key)
+	data := cfs.snapshot()
+
+	if f, ok, err := data.openMounted(name); ok {
+		return f, "mounted", err
+	}
+
+	if data.overlay != nil {
+		f, err := data.overlay.Open(name)
+		if err == nil {
+			cfsLog.Printf("Hit (generated): %v\n", name)
+			return f, "generated", nil
+		}
+	}
+
+	if cached != nil {
+		if f, err := cached.open(); err == nil {
+			cfsLog.Printf("Hit (cached): %v\n", name)
+			return f, cached.from, nil
+		}
+	}
 
 	var lastIdx = len(data.fs) - 1
 
 	for i := range data.fs {
 		f, err := data.fs[i].Open(name)
 		if i == lastIdx && err != nil {
-			logger.Printf("Miss: %v\n", name)
-			return nil, err
+			cfsLog.Printf("Miss: %v\n", name)
+			return nil, "", err
 		} else if err == nil {
-			logger.Printf("Hit: %v\n", name)
-			return noReaddirFile{f}, nil
+			cfsLog.Printf("Hit: %v\n", name)
+			if _, onDisk := data.fs[i].(http.Dir); onDisk && cfs.cache.enabled() {
+				f, err = cfs.cache.add(key, data.dirs[i], f, generation)
+				if err != nil {
+					return nil, "", err
+				}
+			}
+			return noReaddirFile{f}, data.dirs[i], nil
 		}
 	}
 
-	return nil, errors.New("Algorithm failure")
+	return nil, "", errors.New("Algorithm failure")
 }
 
 ///////////////////////////////////////////////////////////////////////////////
-//
+// Weak ETag of a file, which changes with the file and when another bundle
+//  starts serving it. Empty for directories and files that don't exist.
 ///////////////////////////////////////////////////////////////////////////////
-func (cfs *ChainedFileSystem) checkNewPath(path string) {
-	cfs.mutex.Lock()
-	defer cfs.mutex.Unlock()
+func (cfs *ChainedFileSystem) fileETag(name string) string {
+	f, from, err := cfs.openFrom(name)
+	if err != nil {
+		return ""
+	}
+	defer f.Close()
 
-	data := cfs.data
+	info, err := f.Stat()
+	if err != nil || info.IsDir() {
+		return ""
+	}
+
+	sum := sha256.Sum256([]byte(fmt.Sprintf("%v\x00%v\x00%v", from, info.Size(), info.ModTime().UnixNano())))
+	return `W/"` + hex.EncodeToString(sum[:8]) + `"`
+}
 
-	for _, existingPath := range data.dirs {
+///////////////////////////////////////////////////////////////////////////////
+// Opens the file from the last file system that has it so that plugins can
+//  override files of the core bundles.
+///////////////////////////////////////////////////////////////////////////////
+func (cfs *ChainedFileSystem) OpenLast(name string) (http.File, error) {
+	data := cfs.snapshot()
+
+	for i := len(data.fs) - 1; i >= 0; i-- {
+		f, err := data.fs[i].Open(name)
+		if err == nil {
+			return f, nil
+		}
+	}
+
+	return nil, os.ErrNotExist
+}
+
+///////////////////////////////////////////////////////////////////////////////
+// Files of the given name next to the bundle.html of each bundle.
+///////////////////////////////////////////////////////////////////////////////
+func (cfs *ChainedFileSystem) bundleFiles(name string) []string {
+	files := []string{}
+	for _, dir := range cfs.snapshot().dirs {
+		matches, _ := filepath.Glob(filepath.Join(dir, "*", name))
+		files = append(files, matches...)
+	}
+
+	return files
+}
+
+///////////////////////////////////////////////////////////////////////////////
+//
+///////////////////////////////////////////////////////////////////////////////
+func (cfs *ChainedFileSystem) checkNewPath(path string) {
+	for _, existingPath := range cfs.snapshot().dirs {
 		if path == existingPath {
 			break
 		}
 	}
 
-	bundle_dir, _ := os.Open(path)
-	subdirs, _ := bundle_dir.Readdirnames(-1)
+	var layer http.FileSystem = http.Dir(path)
+	if isZipBundle(path) {
+		zfs, err := openZipFileSystem(path)
+		if err != nil {
+			cfsLog.Warnf("Unable to open the bundle %v: %v\n", path, err)
+			return
+		}
+		layer = zfs
+	}
+
+	subdirs := []string{}
+	if bundle_dir, err := layer.Open("/"); err == nil {
+		infos, _ := bundle_dir.Readdir(-1)
+		bundle_dir.Close()
+		for _, info := range infos {
+			subdirs = append(subdirs, info.Name())
+		}
+	}
 
 	// There should only be one subdir with a unique name and a bundle html in it
 	if len(subdirs) == 1 {
-		_, err := os.Stat(filepath.Join(path, subdirs[0], "bundle.html"))
+		f, err := layer.Open("/" + subdirs[0] + "/bundle.html")
 
 		if err == nil {
+			f.Close()
 			pluginKey := subdirs[0] + "/bundle.html"
-			_, exists := data.Plugins[pluginKey]
-			if !exists {
-				logger.Printf("ADDED BUNDLE %v\n", pluginKey)
+
+			manifest, err := readBundleManifest(layer, "/"+subdirs[0]+"/bundle.json")
+			problem := manifest.problem()
+			if err != nil {
+				problem = err.Error()
+			}
+			name := subdirs[0]
+			if manifest != nil && manifest.Name != "" {
+				name = manifest.Name
+			}
+
+			cfs.update(func(data *cfsData) bool {
+				if problem != "" {
+					if data.Rejected[path] == problem {
+						return false
+					}
+
+					cfsLog.Warnf("REJECTED BUNDLE %v: %v\n", path, problem)
+					data.Rejected[path] = problem
+					return true
+				}
+				if _, exists := data.Plugins[pluginKey]; exists {
+					return false
+				}
+
+				cfsLog.Infof("ADDED BUNDLE %v\n", pluginKey)
+				manifest.checkCommands(name)
+				delete(data.Rejected, path)
 				data.Plugins[pluginKey] = true
 				data.pluginKeys = append(data.pluginKeys, pluginKey)
 				data.dirs = append(data.dirs, path)
-				data.fs = append(data.fs, http.Dir(path))
-			}
+				data.names = append(data.names, name)
+				data.fs = append(data.fs, layer)
+				data.manifests = append(data.manifests, manifest)
+				data.sortBundles()
+				return true
+			})
 		}
 	}
 }
@@ -87,33 +295,50 @@ func (cfs *ChainedFileSystem) checkNewPath(path string) {
 //
 ///////////////////////////////////////////////////////////////////////////////
 func (cfs *ChainedFileSystem) cleanStalePaths() {
-	cfs.mutex.Lock()
-	defer cfs.mutex.Unlock()
+	cfs.update(func(data *cfsData) bool {
+		newDirs := []string{}
+		newNames := []string{}
+		newFs := []http.FileSystem{}
+		newKeys := []string{}
+		newManifests := []*BundleManifest{}
 
-	data := cfs.data
-
-	newDirs := []string{}
-	newFs := []http.FileSystem{}
-	newKeys := []string{}
+		for idx, _ := range data.dirs {
+			_, err := os.Stat(data.dirs[idx])
+			if err == nil {
+				newDirs = append(newDirs, data.dirs[idx])
+				newNames = append(newNames, data.names[idx])
+				newFs = append(newFs, data.fs[idx])
+				newKeys = append(newKeys, data.pluginKeys[idx])
+				newManifests = append(newManifests, data.manifests[idx])
+			} else {
+				key := data.pluginKeys[idx]
+				if key != "" {
+					cfsLog.Infof("REMOVED BUNDLE %v\n", key)
+					delete(data.Plugins, key)
+				}
+			}
+		}
 
-	for idx, _ := range data.dirs {
-		_, err := os.Stat(data.dirs[idx])
-		if err == nil {
-			newDirs = append(newDirs, data.dirs[idx])
-			newFs = append(newFs, data.fs[idx])
-			newKeys = append(newKeys, data.pluginKeys[idx])
-		} else {
-			key := data.pluginKeys[idx]
-			if key != "" {
-				logger.Printf("REMOVED BUNDLE %v\n", key)
-				delete(data.Plugins, key)
+		// Bundles that were rejected and are gone
+		forgotten := false
+		for path := range data.Rejected {
+			if _, err := os.Stat(path); err != nil {
+				delete(data.Rejected, path)
+				forgotten = true
 			}
 		}
-	}
 
-	data.dirs = newDirs
-	data.fs = newFs
-	data.pluginKeys = newKeys
+		if len(newDirs) == len(data.dirs) && !forgotten {
+			return false
+		}
+
+		data.dirs = newDirs
+		data.names = newNames
+		data.fs = newFs
+		data.pluginKeys = newKeys
+		data.manifests = newManifests
+		return true
+	})
 }
 
 ///////////////////////////////////////////////////////////////////////////////
@@ -130,18 +355,12 @@ func CFSInitialize(dir string) (*ChainedFileSystem, error) {
 	// Sort the bundle names to guarantee that file overrides/shadowing happen in that order
 	sort.Strings(bundleNames)
 
-	bundleFileSystems := make([]http.FileSystem, len(bundleNames), len(bundleNames))
-	bundleDirs := make([]string, len(bundleNames), len(bundleNames))
-	pluginKeys := make([]string, len(bundleNames), len(bundleNames))
+	bundleFileSystems := make([]http.FileSystem, 0, len(bundleNames))
+	bundleDirs := make([]string, 0, len(bundleNames))
+	names := make([]string, 0, len(bundleNames))
+	pluginKeys := make([]string, 0, len(bundleNames))
 
-	for idx, bundleName := range bundleNames {
-		bundleDirs[idx] = filepath.Clean(bundle_root_dir + "/" + bundleName + "/web")
-		bundleFileSystems[idx] = http.Dir(bundleDirs[idx])
-		pluginKeys[idx] = ""
-		logger.Printf("Bundle path %v added\n", bundle_root_dir+"/"+bundleName+"/web")
-	}
-
-	cfs := &ChainedFileSystem{data: &cfsData{fs: bundleFileSystems, dirs: bundleDirs, pluginKeys: pluginKeys, Plugins: map[string]bool{
+	plugins := map[string]bool{
 		"plugins/authenticationPlugin.html":        true,
 		"plugins/fileClientPlugin.html":            true,
 		"plugins/jslintPlugin.html":                true,
@@ -157,24 +376,234 @@ func CFSInitialize(dir string) (*ChainedFileSystem, error) {
 		"search/plugins/searchPagePlugin.html":     true,
 		"golang/plugins/go-core.html":              true,
 		"godev/go-godev.html":                      true,
-	}}}
+	}
 
-	// Poll the filesystem every so often to update the bundle caches
-	go func() {
-		for {
-			for _, srcDir := range srcDirs {
-				filepath.Walk(srcDir, func(path string, info os.FileInfo, err error) error {
-					cfs.cleanStalePaths()
-					if filepath.Base(path) == "godev-bundle" {
-						cfs.checkNewPath(path)
+	manifests := make([]*BundleManifest, 0, len(bundleNames))
+	rejected := make(map[string]string)
+
+	for _, bundleName := range bundleNames {
+		bundleDir := filepath.Clean(bundle_root_dir + "/" + bundleName + "/web")
+		var layer http.FileSystem = http.Dir(bundleDir)
+		name := bundleName
+		pluginKey := ""
+		manifestLayer, manifestName := http.FileSystem(http.Dir(filepath.Join(bundle_root_dir, bundleName))), "/bundle.json"
+
+		// A third party bundle can be a zip of its files, which has a
+		//  directory with the bundle.html of its plugin like a godev-bundle
+		if isZipBundle(bundleName) {
+			bundleDir = filepath.Join(bundle_root_dir, bundleName)
+			zfs, err := openZipFileSystem(bundleDir)
+			if err != nil {
+				cfsLog.Warnf("Unable to open the bundle %v: %v\n", bundleDir, err)
+				continue
+			}
+			layer, manifestLayer = zfs, zfs
+			name = strings.TrimSuffix(bundleName, ".zip")
+
+			if root, err := zfs.Open("/"); err == nil {
+				infos, _ := root.Readdir(-1)
+				root.Close()
+				if len(infos) == 1 {
+					if f, err := zfs.Open("/" + infos[0].Name() + "/bundle.html"); err == nil {
+						f.Close()
+						pluginKey = infos[0].Name() + "/bundle.html"
+						manifestName = "/" + infos[0].Name() + "/bundle.json"
 					}
+				}
+			}
+		}
 
-					return nil
-				})
+		manifest, err := readBundleManifest(manifestLayer, manifestName)
+		problem := manifest.problem()
+		if err != nil {
+			problem = err.Error()
+		}
+		if problem != "" {
+			cfsLog.Warnf("REJECTED BUNDLE %v: %v\n", bundleDir, problem)
+			rejected[bundleDir] = problem
+			continue
+		}
+		if manifest != nil && manifest.Name != "" {
+			name = manifest.Name
+		}
+		manifest.checkCommands(name)
+
+		if pluginKey != "" {
+			plugins[pluginKey] = true
+		}
+		bundleDirs = append(bundleDirs, bundleDir)
+		bundleFileSystems = append(bundleFileSystems, layer)
+		names = append(names, name)
+		pluginKeys = append(pluginKeys, pluginKey)
+		manifests = append(manifests, manifest)
+		cfsLog.Printf("Bundle path %v added\n", bundleDir)
+	}
+
+	data := &cfsData{fs: bundleFileSystems, dirs: bundleDirs, names: names, pluginKeys: pluginKeys, manifests: manifests,
+		Plugins: plugins, Rejected: rejected}
+	data.sortBundles()
+
+	cfs := &ChainedFileSystem{cache: newFileCache(*bundleCacheSize << 20)}
+	cfs.publish(data)
+
+	cfs.scanBundles()
+	go cfs.watchBundles()
+
+	return cfs, nil
+}
+
+///////////////////////////////////////////////////////////////////////////////
+// Walks the source directories and the installed bundles for godev-bundle
+//  directories
+///////////////////////////////////////////////////////////////////////////////
+func (cfs *ChainedFileSystem) scanBundles() {
+	cfs.cleanStalePaths()
+
+	// The installed bundles are in a module cache of their own
+	for _, srcDir := range append(append([]string{}, srcDirs...), bundleModuleDir()) {
+		filepath.Walk(srcDir, func(path string, info os.FileInfo, err error) error {
+			if filepath.Base(path) == "godev-bundle" || filepath.Base(path) == "godev-bundle.zip" {
+				cfs.checkNewPath(path)
 			}
+
+			return nil
+		})
+	}
+
+	for _, path := range configuredBundles() {
+		cfs.checkNewPath(path)
+	}
+}
+
+///////////////////////////////////////////////////////////////////////////////
+// Updates the bundles as the directories of the source directories change.
+//  Changes come in bursts, such as a git checkout, so the bundles are only
+//  checked once things settle down. A full scan catches up on whatever the
+//  watcher could have missed and replaces it when the system can't watch.
+///////////////////////////////////////////////////////////////////////////////
+func (cfs *ChainedFileSystem) watchBundles() {
+	watcher, err := fsnotify.NewWatcher()
+	if err != nil {
+		cfsLog.Warnf("Unable to watch for bundles, polling instead: %v\n", err)
+		for {
 			<-time.After(5 * time.Second)
+			cfs.scanBundles()
 		}
-	}()
+	}
+	defer watcher.Close()
 
-	return cfs, nil
+	// Watches the directory and those below it, returning the bundle
+	//  directories that it finds.
+	watch := func(dir string) (bundles []string, ok bool) {
+		ok = true
+		filepath.Walk(dir, func(path string, info os.FileInfo, err error) error {
+			if err != nil {
+				return nil
+			}
+			if !info.IsDir() {
+				if info.Name() == "godev-bundle.zip" {
+					bundles = append(bundles, path)
+				}
+				return nil
+			}
+			// Version control metadata never has bundles
+			if path != dir && strings.HasPrefix(info.Name(), ".") {
+				return filepath.SkipDir
+			}
+
+			if watcher.Add(path) != nil {
+				// Out of watches most likely
+				ok = false
+			}
+			if info.Name() == "godev-bundle" {
+				bundles = append(bundles, path)
+			}
+			return nil
+		})
+		return
+	}
+
+	complete := true
+	for _, srcDir := range srcDirs {
+		if _, ok := watch(srcDir); !ok {
+			complete = false
+		}
+	}
+	if !complete {
+		cfsLog.Warnf("Not all of the source directories can be watched for bundles, they are also scanned every minute\n")
+	}
+
+	// The symbol index follows the same changes
+	symbolIndexMutex.Lock()
+	symbolIndexWatched = complete
+	symbolIndexMutex.Unlock()
+
+	changed := make(map[string]bool)
+	rescan := false
+	var settled <-chan time.Time
+	var fallback <-chan time.Time
+	if !complete {
+		fallback = time.Tick(time.Minute)
+	}
+
+	for {
+		select {
+		case event, ok := <-watcher.Events:
+			if !ok {
+				return
+			}
+
+			changed[event.Name] = true
+			settled = time.After(500 * time.Millisecond)
+		case err, ok := <-watcher.Errors:
+			if !ok {
+				return
+			}
+
+			// Events were dropped
+			cfsLog.Warnf("Error watching for bundles: %v\n", err)
+			rescan = true
+			settled = time.After(500 * time.Millisecond)
+		case <-fallback:
+			cfs.scanBundles()
+		case <-settled:
+			if rescan {
+				cfs.scanBundles()
+				rebuildSymbolIndex()
+			}
+
+			cfs.cleanStalePaths()
+			for path := range changed {
+				if !rescan {
+					updateSymbolIndex(path)
+				}
+				cfs.invalidateCached(path)
+
+				if info, err := os.Stat(path); err == nil && info.IsDir() {
+					bundles, _ := watch(path)
+					for _, bundle := range bundles {
+						cfs.checkNewPath(bundle)
+					}
+				}
+
+				if filepath.Base(path) == "godev-bundle.zip" {
+					if _, err := os.Stat(path); err == nil {
+						cfs.checkNewPath(path)
+					}
+				}
+
+				// The bundle directory appears before its contents
+				for dir := path; len(dir) > 1 && dir != filepath.Dir(dir); dir = filepath.Dir(dir) {
+					if filepath.Base(dir) == "godev-bundle" {
+						cfs.checkNewPath(dir)
+						break
+					}
+				}
+			}
+
+			changed = make(map[string]bool)
+			rescan = false
+			settled = nil
+		}
+	}
 }
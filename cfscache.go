@@ -0,0 +1,235 @@
+// Copyright 2014 Chris McGee <sirnewton_01@yahoo.ca>. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"bytes"
+	"container/list"
+	"flag"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"sync"
+)
+
+const (
+	// Larger files are only remembered by where they are, not their content
+	maxCachedFileSize = 1 << 20
+)
+
+var (
+	bundleCacheSize = flag.Int64("bundleCacheSize", 64, "Megabytes of bundle files that are kept in memory, the ones used most recently. (0 disables)")
+)
+
+// Where a file of the bundles was found, and its content unless it is too
+// large. An entry is used as long as the file has the same size and time,
+// which takes one stat instead of trying each bundle in turn.
+type cachedFile struct {
+	name string
+	// Bundle directory that served it and the file on disk
+	from     string
+	diskPath string
+	info     os.FileInfo
+	content  []byte
+}
+
+// Least recently used files of the bundles. The whole cache is dropped when
+// the bundles change and the files that the bundle watcher sees change are
+// dropped from it.
+type fileCache struct {
+	mutex    sync.Mutex
+	entries  map[string]*list.Element
+	order    *list.List
+	size     int64
+	maxBytes int64
+	// Counts the times the cache was dropped, so that a file that was
+	//  looked up in bundles that are gone isn't added afterwards
+	generation int
+}
+
+type cachedHttpFile struct {
+	*bytes.Reader
+	info os.FileInfo
+}
+
+func (f *cachedHttpFile) Close() error {
+	return nil
+}
+
+func (f *cachedHttpFile) Readdir(count int) ([]os.FileInfo, error) {
+	return nil, nil
+}
+
+func (f *cachedHttpFile) Stat() (os.FileInfo, error) {
+	return f.info, nil
+}
+
+func newFileCache(maxBytes int64) *fileCache {
+	return &fileCache{entries: make(map[string]*list.Element), order: list.New(), maxBytes: maxBytes}
+}
+
+// The names of the requests are cleaned the way http.Dir does
+func cacheKey(name string) string {
+	return path.Clean("/" + name)
+}
+
+func (c *fileCache) enabled() bool {
+	return c != nil && c.maxBytes > 0
+}
+
+// The file of the name if it hasn't changed since it was cached
+func (c *fileCache) get(name string) (*cachedFile, int) {
+	if !c.enabled() {
+		return nil, 0
+	}
+
+	c.mutex.Lock()
+	element, ok := c.entries[name]
+	generation := c.generation
+	if ok {
+		c.order.MoveToFront(element)
+	}
+	c.mutex.Unlock()
+
+	if !ok {
+		return nil, generation
+	}
+
+	entry := element.Value.(*cachedFile)
+	info, err := os.Stat(entry.diskPath)
+	if err != nil || info.Size() != entry.info.Size() || !info.ModTime().Equal(entry.info.ModTime()) {
+		c.remove(name)
+		return nil, generation
+	}
+
+	return entry, generation
+}
+
+func (c *fileCache) put(entry *cachedFile, generation int) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	// The bundles changed while the file was looked up
+	if generation != c.generation {
+		return
+	}
+	if element, ok := c.entries[entry.name]; ok {
+		c.size -= int64(len(element.Value.(*cachedFile).content))
+		c.order.Remove(element)
+	}
+
+	c.entries[entry.name] = c.order.PushFront(entry)
+	c.size += int64(len(entry.content))
+
+	for c.size > c.maxBytes && c.order.Len() > 0 {
+		oldest := c.order.Back()
+		c.order.Remove(oldest)
+		evicted := oldest.Value.(*cachedFile)
+		delete(c.entries, evicted.name)
+		c.size -= int64(len(evicted.content))
+	}
+}
+
+func (c *fileCache) remove(name string) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	if element, ok := c.entries[name]; ok {
+		c.size -= int64(len(element.Value.(*cachedFile).content))
+		c.order.Remove(element)
+		delete(c.entries, name)
+	}
+}
+
+func (c *fileCache) clear() {
+	if !c.enabled() {
+		return
+	}
+
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	c.entries = make(map[string]*list.Element)
+	c.order.Init()
+	c.size = 0
+	c.generation++
+}
+
+// Drops the files of the names at or below the name, or all of them for an
+// empty name
+func (c *fileCache) invalidate(name string) {
+	if !c.enabled() {
+		return
+	}
+
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	for key, element := range c.entries {
+		if name == "" || key == name || strings.HasPrefix(key, name+"/") {
+			c.size -= int64(len(element.Value.(*cachedFile).content))
+			c.order.Remove(element)
+			delete(c.entries, key)
+		}
+	}
+	c.generation++
+}
+
+// Drops the cached files that a change on disk can affect. A file that is
+// added can shadow the one of another bundle, so the name goes whichever
+// bundle served it.
+func (cfs *ChainedFileSystem) invalidateCached(diskPath string) {
+	for _, dir := range cfs.snapshot().dirs {
+		rel, err := filepath.Rel(dir, diskPath)
+		if err != nil || rel == ".." || strings.HasPrefix(rel, ".."+string(filepath.Separator)) {
+			continue
+		}
+		if rel == "." {
+			cfs.cache.invalidate("")
+			continue
+		}
+		cfs.cache.invalidate("/" + filepath.ToSlash(rel))
+	}
+}
+
+func (entry *cachedFile) open() (http.File, error) {
+	if entry.content == nil {
+		f, err := os.Open(entry.diskPath)
+		if err != nil {
+			return nil, err
+		}
+		return noReaddirFile{f}, nil
+	}
+
+	return &cachedHttpFile{Reader: bytes.NewReader(entry.content), info: entry.info}, nil
+}
+
+// Remembers the file that a bundle directory served, reading it into memory
+// unless it is large. The file is returned in place of the one that was
+// opened.
+func (c *fileCache) add(name string, from string, f http.File, generation int) (http.File, error) {
+	info, err := f.Stat()
+	if err != nil || info.IsDir() {
+		return f, nil
+	}
+
+	entry := &cachedFile{name: name, from: from, info: info, diskPath: filepath.Join(from, filepath.FromSlash(name))}
+	if info.Size() <= maxCachedFileSize {
+		content, err := ioutil.ReadAll(f)
+		f.Close()
+		if err != nil {
+			return nil, err
+		}
+		entry.content = content
+		c.put(entry, generation)
+		return entry.open()
+	}
+
+	c.put(entry, generation)
+	return f, nil
+}
@@ -0,0 +1,203 @@
+// Copyright 2014 Chris McGee <sirnewton_01@yahoo.ca>. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"crypto/sha256"
+	"fmt"
+	"math/bits"
+	"net/http"
+	"sync"
+	"time"
+)
+
+const (
+	freeLoginAttempts   = 5
+	loginFailureWindow  = 15 * time.Minute
+	baseDifficulty      = 16
+	maxDifficulty       = 22
+	challengeExpiration = 5 * time.Minute
+)
+
+// Instead of locking out an address after failed logins, which would also
+// lock out everyone else behind the same NAT, further attempts have to pay
+// for themselves with a proof-of-work that gets harder with each failure.
+type LoginChallenge struct {
+	Challenge  string
+	Difficulty int
+}
+
+type loginFailures struct {
+	count int
+	last  time.Time
+}
+
+type pendingChallenge struct {
+	ip         string
+	difficulty int
+	expires    time.Time
+}
+
+var (
+	challengeMutex sync.Mutex
+	failedLogins   = make(map[string]*loginFailures)
+	challenges     = make(map[string]pendingChallenge)
+)
+
+// Whether the request tries to log in as opposed to just asking about the
+// login options.
+func loginAttempt(r *http.Request) bool {
+	return r.FormValue("MAGIC") != "" || r.FormValue("assertion") != "" || r.FormValue("password") != "" || r.FormValue("code") != ""
+}
+
+func recordLoginFailure(r *http.Request) {
+	challengeMutex.Lock()
+	defer challengeMutex.Unlock()
+
+	// Forget the addresses that stopped failing long enough ago
+	for address, failures := range failedLogins {
+		if time.Since(failures.last) > loginFailureWindow {
+			delete(failedLogins, address)
+		}
+	}
+
+	ip := clientIP(r)
+	failures := failedLogins[ip]
+	if failures == nil {
+		failures = &loginFailures{}
+		failedLogins[ip] = failures
+	}
+
+	failures.count++
+	failures.last = time.Now()
+
+	logger.Printf("Failed login %v from %v\n", failures.count, ip)
+
+	if failures.count == freeLoginAttempts {
+		sendMailAsync("alert", MailData{Address: ip,
+			Message: fmt.Sprintf("There were %v failed attempts to log in to godev, further attempts now require a proof-of-work.", failures.count)})
+	}
+}
+
+func clearLoginFailures(r *http.Request) {
+	challengeMutex.Lock()
+	defer challengeMutex.Unlock()
+
+	delete(failedLogins, clientIP(r))
+}
+
+// Difficulty of the challenge the client must solve, zero if none is needed
+func loginDifficulty(r *http.Request) int {
+	challengeMutex.Lock()
+	defer challengeMutex.Unlock()
+
+	failures := failedLogins[clientIP(r)]
+	if failures == nil || failures.count < freeLoginAttempts || time.Since(failures.last) > loginFailureWindow {
+		return 0
+	}
+
+	difficulty := baseDifficulty + failures.count - freeLoginAttempts
+	if difficulty > maxDifficulty {
+		difficulty = maxDifficulty
+	}
+
+	return difficulty
+}
+
+func newLoginChallenge(r *http.Request, difficulty int) LoginChallenge {
+	challengeMutex.Lock()
+	defer challengeMutex.Unlock()
+
+	// Forget the challenges that nobody solved in time
+	for c, pending := range challenges {
+		if time.Now().After(pending.expires) {
+			delete(challenges, c)
+		}
+	}
+
+	challenge := newId() + newId()
+	challenges[challenge] = pendingChallenge{ip: clientIP(r), difficulty: difficulty,
+		expires: time.Now().Add(challengeExpiration)}
+
+	return LoginChallenge{Challenge: challenge, Difficulty: difficulty}
+}
+
+func leadingZeroBits(b []byte) int {
+	count := 0
+	for _, v := range b {
+		if v != 0 {
+			return count + bits.LeadingZeros8(v)
+		}
+		count += 8
+	}
+	return count
+}
+
+// Checks the solution of the challenge provided with the request. Each
+// challenge can only be used once.
+func solvedChallenge(r *http.Request, difficulty int) bool {
+	challenge := r.FormValue("challenge")
+	nonce := r.FormValue("nonce")
+
+	challengeMutex.Lock()
+	pending, ok := challenges[challenge]
+	delete(challenges, challenge)
+	challengeMutex.Unlock()
+
+	if !ok || pending.ip != clientIP(r) || time.Now().After(pending.expires) || pending.difficulty < difficulty {
+		return false
+	}
+
+	hash := sha256.Sum256([]byte(challenge + nonce))
+	return leadingZeroBits(hash[:]) >= pending.difficulty
+}
+
+// Browsers following a login link get a page that solves the challenge and
+// retries, everything else gets the challenge to solve on its own.
+func serveLoginChallenge(w http.ResponseWriter, r *http.Request, difficulty int) {
+	challenge := newLoginChallenge(r, difficulty)
+
+	if r.Method != "GET" {
+		ShowJson(w, 429, challenge)
+		return
+	}
+
+	query := r.URL.Query()
+	query.Del("challenge")
+	query.Del("nonce")
+	query.Set("challenge", challenge.Challenge)
+
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	w.WriteHeader(429)
+	fmt.Fprintf(w, loginChallengePage, challenge.Challenge, challenge.Difficulty, r.URL.Path+"?"+query.Encode())
+}
+
+const loginChallengePage = `<!DOCTYPE html>
+<html>
+<head><title>godev</title></head>
+<body>
+<p>Too many failed logins from this address, verifying your browser...</p>
+<script>
+(async function() {
+	var challenge = %q, difficulty = %d, target = %q;
+	var encoder = new TextEncoder();
+	for (var nonce = 0; ; nonce++) {
+		var hash = new Uint8Array(await crypto.subtle.digest("SHA-256", encoder.encode(challenge + nonce)));
+		var zeros = 0;
+		for (var i = 0; i < hash.length; i++) {
+			if (hash[i] === 0) { zeros += 8; continue; }
+			zeros += Math.clz32(hash[i]) - 24;
+			break;
+		}
+		if (zeros >= difficulty) {
+			window.location.replace(target + "&nonce=" + nonce);
+			return;
+		}
+	}
+})();
+</script>
+</body>
+</html>
+`
@@ -0,0 +1,204 @@
+// Copyright 2014 Chris McGee <sirnewton_01@yahoo.ca>. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// A claim announces that a user is editing a file. Soft claims only warn
+// others while hard claims (binary files only) reject their changes.
+type Claim struct {
+	Location string
+	User     string
+	Since    int64
+	Hard     bool
+}
+
+type ClaimResult struct {
+	Claim     Claim
+	Conflicts []Claim
+}
+
+type ClaimEvent struct {
+	Action string
+	Claim  Claim
+}
+
+var (
+	claimsMutex sync.Mutex
+	claims      = make(map[string][]Claim)
+)
+
+func init() {
+	// Users that have gone away shouldn't block anyone
+	idleUserHooks = append(idleUserHooks, releaseClaims)
+}
+
+func releaseClaims(user string) {
+	claimsMutex.Lock()
+	defer claimsMutex.Unlock()
+
+	for location := range claims {
+		releaseClaim(location, user)
+	}
+}
+
+// Must be called with the claims mutex held
+func releaseClaim(location string, user string) {
+	remaining := []Claim{}
+
+	for _, c := range claims[location] {
+		if c.User == user {
+			publishEvent(Event{Type: "claims", Data: ClaimEvent{Action: "released", Claim: c}})
+		} else {
+			remaining = append(remaining, c)
+		}
+	}
+
+	if len(remaining) == 0 {
+		delete(claims, location)
+	} else {
+		claims[location] = remaining
+	}
+}
+
+// Returns the hard claim of another user that prevents the user from
+// changing the file, or one of the files of the directory, if there is one.
+func lockingClaim(user string, location string) *Claim {
+	location = strings.TrimSuffix(location, "/")
+
+	claimsMutex.Lock()
+	defer claimsMutex.Unlock()
+
+	for l, cs := range claims {
+		if l != location && !strings.HasPrefix(l, location+"/") {
+			continue
+		}
+		for _, c := range cs {
+			if c.Hard && c.User != user {
+				return &c
+			}
+		}
+	}
+
+	return nil
+}
+
+// Refuses the request when the location, or a file of the directory, is
+// locked by another user
+func showLocked(writer http.ResponseWriter, req *http.Request, location string) bool {
+	claim := lockingClaim(requestUser(req), location)
+	if claim == nil {
+		return false
+	}
+
+	ShowError(writer, 423, "File "+claim.Location+" is locked by "+claim.User, nil)
+	return true
+}
+
+func isBinaryFile(srcDirs []string, location string) bool {
+	relPath := strings.TrimPrefix(location, "/file")
+
+	for _, srcDir := range srcDirs {
+		file, err := os.Open(filepath.Join(srcDir, relPath))
+		if err != nil {
+			continue
+		}
+		defer file.Close()
+
+		buf := make([]byte, 512, 512)
+		n, _ := file.Read(buf)
+		contentType := http.DetectContentType(buf[:n])
+
+		return !strings.HasPrefix(contentType, "text/")
+	}
+
+	return false
+}
+
+func claimsHandler(writer http.ResponseWriter, req *http.Request, path string, pathSegs []string) bool {
+	user := requestUser(req)
+
+	switch {
+	case req.Method == "GET" && len(pathSegs) == 1:
+		location := req.URL.Query().Get("location")
+		result := []Claim{}
+
+		claimsMutex.Lock()
+		for l, c := range claims {
+			if location == "" || location == l {
+				result = append(result, c...)
+			}
+		}
+		claimsMutex.Unlock()
+
+		sort.Slice(result, func(i, j int) bool { return result[i].Since < result[j].Since })
+
+		ShowJson(writer, 200, result)
+		return true
+	case req.Method == "POST" && len(pathSegs) == 1:
+		claim := Claim{}
+		err := json.NewDecoder(req.Body).Decode(&claim)
+		if err != nil || !strings.HasPrefix(claim.Location, "/file/") {
+			ShowError(writer, 400, "Invalid claim", err)
+			return true
+		}
+
+		// Text files can be merged by hand, only binaries get locked
+		if claim.Hard && !isBinaryFile(requestSrcDirs(req), claim.Location) {
+			ShowError(writer, 400, "Hard claims are only supported for binary files", nil)
+			return true
+		}
+
+		claim.User = user
+		claim.Since = time.Now().Unix() * 1000
+
+		claimsMutex.Lock()
+		defer claimsMutex.Unlock()
+
+		result := ClaimResult{Claim: claim, Conflicts: []Claim{}}
+		for _, c := range claims[claim.Location] {
+			if c.User == user {
+				continue
+			}
+			if c.Hard || claim.Hard {
+				ShowJson(writer, 409, ClaimResult{Claim: claim, Conflicts: []Claim{c}})
+				return true
+			}
+			result.Conflicts = append(result.Conflicts, c)
+		}
+
+		releaseClaim(claim.Location, user)
+		claims[claim.Location] = append(claims[claim.Location], claim)
+
+		publishEvent(Event{Type: "claims", Data: ClaimEvent{Action: "claimed", Claim: claim}})
+
+		ShowJson(writer, 201, result)
+		return true
+	case req.Method == "DELETE" && len(pathSegs) == 1:
+		location := req.URL.Query().Get("location")
+		if location == "" {
+			ShowError(writer, 400, "No location provided", nil)
+			return true
+		}
+
+		claimsMutex.Lock()
+		releaseClaim(location, user)
+		claimsMutex.Unlock()
+
+		writer.WriteHeader(204)
+		return true
+	}
+
+	return false
+}
@@ -0,0 +1,43 @@
+// Copyright 2014 Chris McGee <sirnewton_01@yahoo.ca>. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"testing"
+)
+
+func TestLockingClaim(t *testing.T) {
+	claimsMutex.Lock()
+	defer func(c map[string][]Claim) { claims = c }(claims)
+	claims = map[string][]Claim{
+		"/file/project/assets/logo.png": {{Location: "/file/project/assets/logo.png", User: "bob", Hard: true}},
+		"/file/project/main.go":         {{Location: "/file/project/main.go", User: "bob"}},
+	}
+	claimsMutex.Unlock()
+
+	tests := []struct {
+		user     string
+		location string
+		locked   bool
+	}{
+		{"alice", "/file/project/assets/logo.png", true},
+		{"bob", "/file/project/assets/logo.png", false},
+		// The directories that have the file
+		{"alice", "/file/project/assets", true},
+		{"alice", "/file/project/assets/", true},
+		{"alice", "/file/project", true},
+		{"alice", "/file/project/assets/logo.png.orig", false},
+		{"alice", "/file/project/asset", false},
+		// Soft claims only warn
+		{"alice", "/file/project/main.go", false},
+		{"alice", "/file/other", false},
+	}
+
+	for _, test := range tests {
+		if claim := lockingClaim(test.user, test.location); (claim != nil) != test.locked {
+			t.Errorf("%v at %v: the claim is %+v, expected locked %v", test.user, test.location, claim, test.locked)
+		}
+	}
+}
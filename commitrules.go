@@ -0,0 +1,291 @@
+// Copyright 2014 Chris McGee <sirnewton_01@yahoo.ca>. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+// Rules that the commit messages of a repository have to follow. The
+// configuration has the rules of all repositories, a repository can change
+// them in its git config, e.g. git config godev.conventionalCommits true:
+//
+//	godev.maxSubjectLength     CommitRules.MaxSubjectLength
+//	godev.maxBodyLineLength    CommitRules.MaxBodyLineLength
+//	godev.conventionalCommits  CommitRules.Conventional
+//	godev.commitTypes          CommitRules.Types, separated by commas
+//	godev.requireBody          CommitRules.RequireBody
+//	godev.signOff              CommitRules.SignOff
+type CommitRules struct {
+	// Longest subject line, 0 for no limit
+	MaxSubjectLength  int `json:",omitempty"`
+	MaxBodyLineLength int `json:",omitempty"`
+	// Subjects like "fix(parser): summary" of the Conventional Commits
+	Conventional bool `json:",omitempty"`
+	// Types of the conventional subjects, the usual ones unless given
+	Types []string `json:",omitempty"`
+	// An explanation after the subject
+	RequireBody bool `json:",omitempty"`
+	// A Signed-off-by trailer of the committer is added to each commit
+	SignOff bool `json:",omitempty"`
+}
+
+// What the commit page needs to write a message for the repository
+type CommitMessageInfo struct {
+	// Of the commit.template of the repository, empty if it has none
+	Template string
+	Rules    CommitRules
+	// The message with its trailers and the problems with it, for a
+	//  message that is checked
+	Message  string   `json:",omitempty"`
+	Problems []string `json:",omitempty"`
+}
+
+var (
+	defaultCommitTypes = []string{"feat", "fix", "docs", "style", "refactor", "perf", "test", "build", "ci", "chore", "revert"}
+
+	commitType          = regexp.MustCompile(`^[a-z]+$`)
+	conventionalSubject = regexp.MustCompile(`^([a-z]+)(\([^()\n]+\))?!?: \S`)
+	trailerLine         = regexp.MustCompile(`^[A-Za-z][A-Za-z0-9-]*: `)
+	trailerIdentity     = regexp.MustCompile(`^[^<>\n]+ <[^<>\s]+>$`)
+)
+
+func validateCommitRules(rules *CommitRules) error {
+	if rules == nil {
+		return nil
+	}
+	if rules.MaxSubjectLength < 0 || rules.MaxBodyLineLength < 0 {
+		return errors.New("Invalid commit rules, the lengths can't be negative")
+	}
+	for _, typ := range rules.Types {
+		if !commitType.MatchString(typ) {
+			return errors.New("Invalid commit type: " + typ)
+		}
+	}
+
+	return nil
+}
+
+// Rules of the configuration with the changes of the repository's git
+// config
+func repositoryCommitRules(ctx context.Context, target gitTarget) CommitRules {
+	rules := CommitRules{}
+	if configured := currentServerConfig().CommitRules; configured != nil {
+		rules = *configured
+	}
+
+	out, err := runGit(ctx, target.dir, "config", "--get-regexp", `^godev\.`)
+	if err != nil {
+		// No godev settings
+		return rules
+	}
+
+	for _, line := range strings.Split(strings.TrimSpace(string(out)), "\n") {
+		fields := strings.SplitN(line, " ", 2)
+		if len(fields) != 2 {
+			continue
+		}
+		key, value := fields[0], strings.TrimSpace(fields[1])
+		enabled := value == "true" || value == "yes" || value == "on" || value == "1"
+
+		switch key {
+		case "godev.maxsubjectlength":
+			rules.MaxSubjectLength, _ = strconv.Atoi(value)
+		case "godev.maxbodylinelength":
+			rules.MaxBodyLineLength, _ = strconv.Atoi(value)
+		case "godev.conventionalcommits":
+			rules.Conventional = enabled
+		case "godev.committypes":
+			rules.Types = nil
+			for _, typ := range strings.Split(value, ",") {
+				if typ = strings.TrimSpace(typ); typ != "" {
+					rules.Types = append(rules.Types, typ)
+				}
+			}
+		case "godev.requirebody":
+			rules.RequireBody = enabled
+		case "godev.signoff":
+			rules.SignOff = enabled
+		}
+	}
+
+	return rules
+}
+
+// The commit.template of the repository, a relative path is relative to
+// the top of the repository
+func commitTemplate(ctx context.Context, target gitTarget) string {
+	out, err := runGit(ctx, target.dir, "config", "--path", "--get", "commit.template")
+	if err != nil {
+		return ""
+	}
+
+	path := strings.TrimSpace(string(out))
+	if !filepath.IsAbs(path) {
+		path = filepath.Join(target.dir, path)
+	}
+
+	b, err := ioutil.ReadFile(path)
+	if err != nil {
+		logger.Printf("Unable to read the commit template %v: %v\n", path, err)
+		return ""
+	}
+
+	return string(b)
+}
+
+// What is wrong with the message, in a way that tells how to fix it
+func commitMessageProblems(message string, rules CommitRules) []string {
+	problems := []string{}
+
+	lines := strings.Split(strings.TrimSpace(message), "\n")
+	subject := strings.TrimSpace(lines[0])
+	if subject == "" {
+		return append(problems, "The first line of the message has to be a subject that sums up the change")
+	}
+
+	if rules.MaxSubjectLength > 0 && len([]rune(subject)) > rules.MaxSubjectLength {
+		problems = append(problems, fmt.Sprintf("The subject is %v characters long, shorten it to at most %v and explain the rest in the body", len([]rune(subject)), rules.MaxSubjectLength))
+	}
+
+	if rules.Conventional {
+		types := rules.Types
+		if len(types) == 0 {
+			types = defaultCommitTypes
+		}
+
+		m := conventionalSubject.FindStringSubmatch(subject)
+		known := false
+		for _, typ := range types {
+			if m != nil && m[1] == typ {
+				known = true
+			}
+		}
+		if !known {
+			problems = append(problems, "Start the subject with one of the types "+strings.Join(types, ", ")+" and an optional scope, e.g. \""+types[0]+"(parser): "+subject+"\"")
+		}
+	}
+
+	body := lines[1:]
+	structured := rules.MaxSubjectLength > 0 || rules.Conventional || rules.RequireBody
+	if structured && len(body) > 0 && strings.TrimSpace(body[0]) != "" {
+		problems = append(problems, "Leave the second line empty to separate the subject from the body")
+	}
+
+	hasBody := false
+	for idx, line := range body {
+		if strings.TrimSpace(line) != "" && !trailerLine.MatchString(line) {
+			hasBody = true
+		}
+		if rules.MaxBodyLineLength > 0 && len([]rune(line)) > rules.MaxBodyLineLength && !strings.Contains(line, "://") {
+			problems = append(problems, fmt.Sprintf("Line %v of the message is longer than %v characters, wrap it", idx+2, rules.MaxBodyLineLength))
+		}
+	}
+	if rules.RequireBody && !hasBody {
+		problems = append(problems, "Explain what the change does and why in a body after an empty line")
+	}
+
+	return problems
+}
+
+// Who signs off the commits made in the repository, the committer of the
+// request or git's user
+func commitSignOff(ctx context.Context, target gitTarget, request GitRequest) (string, error) {
+	if request.CommitterName != "" && request.CommitterEmail != "" {
+		return request.CommitterName + " <" + request.CommitterEmail + ">", nil
+	}
+
+	name, err := runGit(ctx, target.dir, "config", "--get", "user.name")
+	if err != nil {
+		return "", errors.New("Set user.name and user.email in git to sign off the commits")
+	}
+	email, err := runGit(ctx, target.dir, "config", "--get", "user.email")
+	if err != nil {
+		return "", errors.New("Set user.name and user.email in git to sign off the commits")
+	}
+
+	return strings.TrimSpace(string(name)) + " <" + strings.TrimSpace(string(email)) + ">", nil
+}
+
+// The message of the request with the comments of a template removed and
+// its trailers added: Signed-off-by when the rules or the request ask for
+// it and Co-authored-by of the CoAuthors
+func prepareCommitMessage(ctx context.Context, target gitTarget, request GitRequest, rules CommitRules) (string, error) {
+	message := request.Message
+
+	// With -m git keeps what looks like comments
+	if commitTemplate(ctx, target) != "" {
+		out, err := runGitInput(ctx, target.dir, []byte(message), "stripspace", "--strip-comments")
+		if err != nil {
+			return "", err
+		}
+		message = string(out)
+	}
+
+	trailers := []string{}
+	if rules.SignOff || bool(request.SignOff) {
+		signer, err := commitSignOff(ctx, target, request)
+		if err != nil {
+			return "", err
+		}
+		trailers = append(trailers, "--trailer", "Signed-off-by: "+signer)
+	}
+	for _, coAuthor := range request.CoAuthors {
+		if !trailerIdentity.MatchString(coAuthor) {
+			return "", errors.New("Co-authors are given as 'Name <email>': " + coAuthor)
+		}
+		trailers = append(trailers, "--trailer", "Co-authored-by: "+coAuthor)
+	}
+	if len(trailers) == 0 {
+		return message, nil
+	}
+
+	args := append([]string{"interpret-trailers", "--if-exists", "addIfDifferent"}, trailers...)
+	out, err := runGitInput(ctx, target.dir, []byte(message), args...)
+	if err != nil {
+		return "", err
+	}
+
+	return string(out), nil
+}
+
+// GET /gitapi/commitmessage/file/<repository> has the template and rules
+// of the repository's commit messages. POST checks the Message of the body
+// and adds its trailers without committing.
+func commitMessageRequest(ctx context.Context, writer http.ResponseWriter, req *http.Request, pathSegs []string, request GitRequest) bool {
+	params, target, err := gitapiParams(req, pathSegs)
+	if err != nil || len(params) != 0 {
+		ShowError(writer, 404, "Invalid commit message location", err)
+		return true
+	}
+
+	info := CommitMessageInfo{Template: commitTemplate(ctx, target), Rules: repositoryCommitRules(ctx, target)}
+
+	switch req.Method {
+	case "GET":
+		ShowJson(writer, 200, info)
+		return true
+	case "POST":
+		info.Message, err = prepareCommitMessage(ctx, target, request, info.Rules)
+		if err != nil {
+			ShowError(writer, 400, err.Error(), nil)
+			return true
+		}
+		info.Problems = commitMessageProblems(info.Message, info.Rules)
+
+		ShowJson(writer, 200, info)
+		return true
+	}
+
+	return false
+}
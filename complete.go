@@ -5,28 +5,91 @@
 package main
 
 import (
-	"io"
+	"bytes"
+	"encoding/json"
+	"go/ast"
+	"go/build"
+	"go/doc"
+	"go/parser"
+	"go/printer"
+	"go/token"
 	"io/ioutil"
 	"net/http"
 	"os"
 	"os/exec"
 	"path/filepath"
+	"sort"
+	"strconv"
 	"strings"
+	"sync"
+	"time"
+	"unicode"
 )
 
+type gocodeCandidate struct {
+	Class string `json:"class"`
+	Name  string `json:"name"`
+	Type  string `json:"type"`
+}
+
+type Completion struct {
+	Name string
+	// func, var, const, type or package
+	Kind          string
+	Detail        string
+	Documentation string
+	// Text that replaces the prefix with the parameters of functions filled
+	//  in by their names.
+	InsertText   string
+	Placeholders []Placeholder
+	// Offset in the insert text where the cursor goes once the placeholders
+	//  are filled in.
+	Escape int
+	// The insert text with ${1:name} style placeholders for editors that
+	//  understand snippets.
+	Snippet string
+	Score   int
+	// Indexes of the characters of the name that matched the prefix
+	Matches []int
+	// Package that has to be imported for the completion and the edit of
+	//  the buffer that does it.
+	ImportPath      string
+	AdditionalEdits []TextEdit
+}
+
+// Replaces the text at the offset of the buffer
+type TextEdit struct {
+	Offset int
+	Length int
+	Text   string
+}
+
+// Parameter in the insert text that the user is expected to type over,
+// the offset is relative to the start of the insert text.
+type Placeholder struct {
+	Offset int
+	Length int
+}
+
+type CompletionResult struct {
+	Prefix      string
+	Completions []Completion
+}
+
 func completionHandler(writer http.ResponseWriter, req *http.Request, path string, pathSegs []string) bool {
 	switch {
 	case req.Method == "POST":
 		qValues := req.URL.Query()
 		path := qValues.Get("path")
 		offset := qValues.Get("offset")
+		ranked := qValues.Get("ranked") == "true"
 
 		path = strings.Replace(path, "/file", "", -1)
 		realPath := ""
 
 		// Find the correct location on disk for the provided path location
-		for _, srcDir := range srcDirs {
-			joinedPath := filepath.Join(srcDir, path)
+		for _, srcDir := range requestSrcDirs(req) {
+			joinedPath := filepath.Join(srcDir, filepath.Clean("/"+path))
 
 			_, err := os.Stat(joinedPath)
 
@@ -36,8 +99,11 @@ func completionHandler(writer http.ResponseWriter, req *http.Request, path strin
 			}
 		}
 
+		ctx, cancel := operationContext(req, *toolTimeout)
+		defer cancel()
+
 		// Check if gocode exists
-		cmd := exec.Command("gocode")
+		cmd := exec.CommandContext(ctx, "gocode")
 		err := cmd.Run()
 
 		if err != nil {
@@ -45,22 +111,35 @@ func completionHandler(writer http.ResponseWriter, req *http.Request, path strin
 			return true
 		}
 
-		// Copy the buffer into a temporary file to create a reader for the
-		//  standard in of the gocode command
-		tmpFile, err := ioutil.TempFile("", "godev-complete-temp")
-		_, err = io.Copy(tmpFile, req.Body)
-
+		// The buffer is the standard input of the gocode command
+		buffer, err := ioutil.ReadAll(req.Body)
 		if err != nil {
-			ShowError(writer, 500, "Error copying buffer to temporary file", err)
+			ShowError(writer, 500, "Error reading the buffer", err)
 			return true
 		}
-		tmpFile.Close()
-		tmpFile, err = os.Open(tmpFile.Name())
+
+		prefix := ""
+		if ranked {
+			offsetNum, err := strconv.Atoi(offset)
+			if err != nil || offsetNum < 0 || offsetNum > len(buffer) {
+				ShowError(writer, 400, "Invalid offset", err)
+				return true
+			}
+
+			// Gocode only returns the names that start with the prefix so it
+			//  is asked for everything at the start of the identifier
+			//  instead and the fuzzy matching is done here.
+			start := offsetNum
+			for start > 0 && isIdentChar(buffer[start-1]) {
+				start--
+			}
+			prefix = string(buffer[start:offsetNum])
+			offset = strconv.Itoa(start)
+		}
 
 		// Invoke the gocode client to get the completions from the server
-		cmd = exec.Command("gocode", "-f=json", "autocomplete", realPath, offset)
-		// Standard input is the buffer
-		cmd.Stdin = tmpFile
+		cmd = exec.CommandContext(ctx, "gocode", "-f=json", "autocomplete", realPath, offset)
+		cmd.Stdin = bytes.NewReader(buffer)
 
 		outputBuffer, err := cmd.Output()
 		if err != nil {
@@ -68,17 +147,350 @@ func completionHandler(writer http.ResponseWriter, req *http.Request, path strin
 			return true
 		}
 
-		tmpFile.Close()
-		os.Remove(tmpFile.Name())
+		if !ranked {
+			// The completions go directly to the web client as JSON
+			writer.Header().Add("Content-Type", "application/json")
+			writer.WriteHeader(200)
+			writer.Write(outputBuffer)
+			return true
+		}
 
-		// The completions go directly to the web client as JSON
-		writer.WriteHeader(200)
-		writer.Header().Add("Content-Type", "application/json")
-		writer.Write(outputBuffer)
+		// Gocode responds with [prefix length, candidates] or [] if there
+		//  are none.
+		candidates := []gocodeCandidate{}
+		response := []json.RawMessage{}
+		err = json.Unmarshal(outputBuffer, &response)
+		if err == nil && len(response) == 2 {
+			err = json.Unmarshal(response[1], &candidates)
+		}
+		if err != nil {
+			ShowError(writer, 500, "Unable to understand the gocode completions", err)
+			return true
+		}
+
+		offsetNum, _ := strconv.Atoi(offset)
+		docs := selectorDocs(buffer, offsetNum, filepath.Dir(realPath))
 
-		// TODO maybe add extra data to the JSON such as stripping out the types from the function arguments and provided the offsets of the placeholder parameters?
+		result := rankCompletions(prefix, candidates, docs)
+
+		// Nothing to complete for a selector is often a package that still
+		//  needs to be imported.
+		if len(result.Completions) == 0 {
+			result.Completions = importCompletions(buffer, offsetNum, prefix, filepath.Dir(realPath))
+		}
+
+		result.Completions = append(result.Completions, postfixCompletions(buffer, offsetNum, prefix, realPath, requestUser(req))...)
+		sortCompletions(result.Completions)
+
+		ShowJson(writer, 200, result)
 		return true
 	}
 
 	return false
 }
+
+func rankCompletions(prefix string, candidates []gocodeCandidate, docs map[string]string) CompletionResult {
+	result := CompletionResult{Prefix: prefix, Completions: []Completion{}}
+
+	for _, candidate := range candidates {
+		score, matches, ok := fuzzyScore(prefix, candidate.Name)
+		if !ok {
+			continue
+		}
+
+		completion := Completion{
+			Name:          candidate.Name,
+			Kind:          candidate.Class,
+			Detail:        candidate.Type,
+			Documentation: docs[candidate.Name],
+			InsertText:    candidate.Name,
+			Snippet:       candidate.Name,
+			Score:         score,
+			Matches:       matches,
+		}
+
+		if candidate.Class == "func" {
+			completion.InsertText, completion.Snippet, completion.Placeholders = callTemplate(candidate.Name, candidate.Type)
+		}
+		completion.Escape = len(completion.InsertText)
+
+		result.Completions = append(result.Completions, completion)
+	}
+
+	sortCompletions(result.Completions)
+	return result
+}
+
+// Best matches first, the order of gocode is kept for equal ones
+func sortCompletions(completions []Completion) {
+	sort.SliceStable(completions, func(i, j int) bool {
+		a, b := completions[i], completions[j]
+		if a.Score != b.Score {
+			return a.Score > b.Score
+		}
+		return a.Name < b.Name
+	})
+}
+
+// Scores how well the pattern matches the name when its characters appear
+// in order but not necessarily next to each other. Matches at the start of
+// the name and its words, runs of consecutive characters and matching case
+// score higher, gaps lower.
+func fuzzyScore(pattern string, name string) (int, []int, bool) {
+	if pattern == "" {
+		return 0, []int{}, true
+	}
+
+	p := []rune(pattern)
+	n := []rune(name)
+	if len(p) > len(n) {
+		return 0, nil, false
+	}
+
+	const none = -1 << 30
+
+	// best[i][j] is the best score with p[i] matched to n[j]
+	best := make([][]int, len(p))
+	from := make([][]int, len(p))
+	for i := range p {
+		best[i] = make([]int, len(n))
+		from[i] = make([]int, len(n))
+
+		for j := range n {
+			best[i][j] = none
+			if unicode.ToLower(p[i]) != unicode.ToLower(n[j]) {
+				continue
+			}
+
+			bonus := 1
+			if p[i] == n[j] {
+				bonus++
+			}
+			switch {
+			case j == 0:
+				bonus += 8
+			case n[j-1] == '_' || (unicode.IsLower(n[j-1]) && unicode.IsUpper(n[j])) ||
+				(unicode.IsDigit(n[j-1]) && !unicode.IsDigit(n[j])):
+				bonus += 6
+			}
+
+			if i == 0 {
+				// Skipping the start of the name costs a little
+				best[i][j] = bonus - j
+				from[i][j] = -1
+				continue
+			}
+
+			for k := i - 1; k < j; k++ {
+				if best[i-1][k] == none {
+					continue
+				}
+
+				score := best[i-1][k] + bonus
+				if k == j-1 {
+					score += 4
+				} else {
+					gap := j - k - 1
+					if gap > 3 {
+						gap = 3
+					}
+					score -= gap
+				}
+
+				if score > best[i][j] {
+					best[i][j] = score
+					from[i][j] = k
+				}
+			}
+		}
+	}
+
+	last := len(p) - 1
+	end := -1
+	for j := range n {
+		if best[last][j] != none && (end == -1 || best[last][j] > best[last][end]) {
+			end = j
+		}
+	}
+	if end == -1 {
+		return 0, nil, false
+	}
+
+	// Shorter names are a better match for the same characters
+	score := best[last][end] - (len(n)-len(p))/4
+
+	matches := make([]int, len(p))
+	for i, j := last, end; i >= 0; i-- {
+		matches[i] = j
+		j = from[i][j]
+	}
+
+	return score, matches, true
+}
+
+// Builds the call of a function with its parameter names as placeholders
+// from the type that gocode reports, e.g. "func(a int, b ...string) error".
+func callTemplate(name string, funcType string) (string, string, []Placeholder) {
+	insert := name + "()"
+	snippet := name + "($0)"
+
+	expr, err := parser.ParseExpr(funcType)
+	if err != nil {
+		return insert, snippet, nil
+	}
+	fType, ok := expr.(*ast.FuncType)
+	if !ok || fType.Params == nil || len(fType.Params.List) == 0 {
+		return insert, snippet, nil
+	}
+
+	params := []string{}
+	for _, field := range fType.Params.List {
+		if len(field.Names) == 0 {
+			// Unnamed parameters are shown by their type
+			typeStr := &bytes.Buffer{}
+			printer.Fprint(typeStr, token.NewFileSet(), field.Type)
+			params = append(params, typeStr.String())
+			continue
+		}
+
+		for _, paramName := range field.Names {
+			params = append(params, paramName.Name)
+		}
+	}
+
+	insertBuf := bytes.NewBufferString(name + "(")
+	snippetBuf := bytes.NewBufferString(name + "(")
+	placeholders := []Placeholder{}
+
+	for idx, param := range params {
+		if idx > 0 {
+			insertBuf.WriteString(", ")
+			snippetBuf.WriteString(", ")
+		}
+
+		placeholders = append(placeholders, Placeholder{Offset: insertBuf.Len(), Length: len(param)})
+		insertBuf.WriteString(param)
+		snippetBuf.WriteString("${" + strconv.Itoa(idx+1) + ":" + strings.Replace(param, "}", "\\}", -1) + "}")
+	}
+
+	insertBuf.WriteString(")")
+	snippetBuf.WriteString(")$0")
+
+	return insertBuf.String(), snippetBuf.String(), placeholders
+}
+
+type packageDocs struct {
+	modTime time.Time
+	docs    map[string]string
+}
+
+var (
+	packageDocsMutex sync.Mutex
+	packageDocsCache = make(map[string]*packageDocs)
+)
+
+// Documentation of the members of the package when the completion is for
+// a selector on an imported package (e.g. "fmt.Pr").
+func selectorDocs(buffer []byte, offset int, srcDir string) map[string]string {
+	if offset < 2 || offset > len(buffer) || buffer[offset-1] != '.' {
+		return nil
+	}
+
+	start := offset - 1
+	for start > 0 && isIdentChar(buffer[start-1]) {
+		start--
+	}
+	selector := string(buffer[start : offset-1])
+	if selector == "" {
+		return nil
+	}
+
+	file, err := parser.ParseFile(token.NewFileSet(), "", buffer, parser.ImportsOnly)
+	if err != nil && file == nil {
+		return nil
+	}
+
+	for _, spec := range file.Imports {
+		importPath, err := strconv.Unquote(spec.Path.Value)
+		if err != nil {
+			continue
+		}
+
+		pkg, err := build.Import(importPath, srcDir, 0)
+		if err != nil {
+			continue
+		}
+
+		name := pkg.Name
+		if spec.Name != nil {
+			name = spec.Name.Name
+		}
+
+		if name == selector {
+			return loadPackageDocs(pkg)
+		}
+	}
+
+	return nil
+}
+
+func loadPackageDocs(pkg *build.Package) map[string]string {
+	info, err := os.Stat(pkg.Dir)
+	if err != nil {
+		return nil
+	}
+
+	packageDocsMutex.Lock()
+	defer packageDocsMutex.Unlock()
+
+	cached := packageDocsCache[pkg.Dir]
+	if cached != nil && cached.modTime.Equal(info.ModTime()) {
+		return cached.docs
+	}
+
+	fileset := token.NewFileSet()
+	astPkgs, err := parser.ParseDir(fileset, pkg.Dir, func(fi os.FileInfo) bool {
+		for _, goFile := range pkg.GoFiles {
+			if fi.Name() == goFile {
+				return true
+			}
+		}
+		return false
+	}, parser.ParseComments)
+	if err != nil {
+		return nil
+	}
+
+	astPkg := astPkgs[pkg.Name]
+	if astPkg == nil {
+		return nil
+	}
+
+	docPkg := doc.New(astPkg, pkg.ImportPath, 0)
+	docs := make(map[string]string)
+
+	values := append(docPkg.Consts, docPkg.Vars...)
+	for _, fn := range docPkg.Funcs {
+		docs[fn.Name] = fn.Doc
+	}
+	for _, t := range docPkg.Types {
+		docs[t.Name] = t.Doc
+		for _, fn := range t.Funcs {
+			docs[fn.Name] = fn.Doc
+		}
+		values = append(values, t.Consts...)
+		values = append(values, t.Vars...)
+	}
+	for _, value := range values {
+		for _, name := range value.Names {
+			docs[name] = value.Doc
+		}
+	}
+
+	for name, text := range docs {
+		docs[name] = strings.TrimSpace(text)
+	}
+
+	packageDocsCache[pkg.Dir] = &packageDocs{info.ModTime(), docs}
+	return docs
+}
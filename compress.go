@@ -0,0 +1,225 @@
+// Copyright 2014 Chris McGee <sirnewton_01@yahoo.ca>. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"bytes"
+	"compress/gzip"
+	"flag"
+	"mime"
+	"net/http"
+	"os"
+	"path"
+	"strconv"
+	"strings"
+)
+
+const (
+	// Smaller files aren't worth compressing
+	minGzipSize = 1024
+)
+
+var (
+	gzipAssets = flag.Bool("gzip", true, "Compress the scripts, style sheets and pages of the bundles for browsers that accept gzip. A <file>.gz next to a file in a bundle is served in its place.")
+	http2      = flag.Bool("http2", true, "Serve HTTP/2 to browsers over TLS.")
+
+	compressibleTypes = map[string]bool{
+		".js": true, ".css": true, ".html": true, ".json": true, ".map": true,
+		".svg": true, ".txt": true, ".xml": true, ".pref": true,
+	}
+)
+
+// Opens the .gz of the file from the file system that serves the file, so
+// that a bundle doesn't get the compressed file of another one. A .gz that
+// is older than its file is stale and isn't used.
+func (cfs *ChainedFileSystem) OpenCompressed(name string) (http.File, error) {
+	data := cfs.snapshot()
+
+	layers := []http.FileSystem{}
+	if data.overlay != nil {
+		layers = append(layers, data.overlay)
+	}
+	layers = append(layers, data.fs...)
+
+	for _, layer := range layers {
+		f, err := layer.Open(name)
+		if err != nil {
+			continue
+		}
+		info, err := f.Stat()
+		f.Close()
+		if err != nil || info.IsDir() {
+			return nil, os.ErrNotExist
+		}
+
+		gz, err := layer.Open(name + ".gz")
+		if err != nil {
+			return nil, err
+		}
+		gzInfo, err := gz.Stat()
+		if err != nil || gzInfo.ModTime().Before(info.ModTime()) {
+			gz.Close()
+			return nil, os.ErrNotExist
+		}
+		return gz, nil
+	}
+
+	return nil, os.ErrNotExist
+}
+
+// Whether the response to the request can be compressed, ranges are left
+// to the file server
+func acceptsGzip(req *http.Request) bool {
+	if !*gzipAssets || (req.Method != "GET" && req.Method != "HEAD") || req.Header.Get("Range") != "" {
+		return false
+	}
+
+	for _, encoding := range strings.Split(req.Header.Get("Accept-Encoding"), ",") {
+		params := strings.Split(encoding, ";")
+		if strings.TrimSpace(params[0]) != "gzip" {
+			continue
+		}
+		for _, param := range params[1:] {
+			if q := strings.TrimSpace(param); q == "q=0" || q == "q=0.0" {
+				return false
+			}
+		}
+		return true
+	}
+
+	return false
+}
+
+func compressible(name string) bool {
+	return compressibleTypes[strings.ToLower(path.Ext(name))]
+}
+
+// Serves the .gz of the file if there is one
+func servePrecompressed(writer http.ResponseWriter, req *http.Request, cfs *ChainedFileSystem, name string) bool {
+	f, err := cfs.OpenCompressed(name)
+	if err != nil {
+		return false
+	}
+	defer f.Close()
+
+	info, err := f.Stat()
+	if err != nil {
+		return false
+	}
+
+	contentType := mime.TypeByExtension(path.Ext(name))
+	if contentType == "" {
+		contentType = "application/octet-stream"
+	}
+	writer.Header().Set("Content-Type", contentType)
+	writer.Header().Set("Content-Encoding", "gzip")
+	writer.Header().Add("Vary", "Accept-Encoding")
+
+	http.ServeContent(writer, req, name, info.ModTime(), f)
+	return true
+}
+
+// Compresses a successful response on the fly, the others go out as they
+// are
+type gzipWriter struct {
+	http.ResponseWriter
+	gz      *gzip.Writer
+	decided bool
+}
+
+func (w *gzipWriter) WriteHeader(code int) {
+	if !w.decided {
+		w.decided = true
+
+		header := w.Header()
+		header.Add("Vary", "Accept-Encoding")
+		size, err := strconv.Atoi(header.Get("Content-Length"))
+		if code == 200 && header.Get("Content-Encoding") == "" && (err != nil || size >= minGzipSize) {
+			header.Del("Content-Length")
+			header.Set("Content-Encoding", "gzip")
+			w.gz = gzip.NewWriter(w.ResponseWriter)
+		}
+	}
+
+	w.ResponseWriter.WriteHeader(code)
+}
+
+func (w *gzipWriter) Write(b []byte) (int, error) {
+	if !w.decided {
+		w.WriteHeader(200)
+	}
+	if w.gz != nil {
+		return w.gz.Write(b)
+	}
+
+	return w.ResponseWriter.Write(b)
+}
+
+func (w *gzipWriter) Close() error {
+	if w.gz == nil {
+		return nil
+	}
+
+	return w.gz.Close()
+}
+
+// Serves the files of the bundles compressed to browsers that accept gzip
+func compressedFiles(cfs *ChainedFileSystem, delegate http.Handler) http.Handler {
+	return http.HandlerFunc(func(writer http.ResponseWriter, req *http.Request) {
+		if !acceptsGzip(req) {
+			delegate.ServeHTTP(writer, req)
+			return
+		}
+
+		name := req.URL.Path
+		if strings.HasSuffix(name, "/") {
+			name += "index.html"
+		}
+		if servePrecompressed(writer, req, cfs, name) {
+			return
+		}
+		if req.Method != "GET" || !compressible(name) {
+			delegate.ServeHTTP(writer, req)
+			return
+		}
+
+		gz := &gzipWriter{ResponseWriter: writer}
+		defer gz.Close()
+		delegate.ServeHTTP(gz, req)
+	})
+}
+
+func gzipBytes(content []byte) []byte {
+	buf := &bytes.Buffer{}
+	gz, _ := gzip.NewWriterLevel(buf, gzip.BestCompression)
+	gz.Write(content)
+	gz.Close()
+
+	return buf.Bytes()
+}
+
+// Adds the .gz of the generated files, which are compressed once instead
+// of for each request
+func precompressOverlay(overlay memFS) {
+	if !*gzipAssets {
+		return
+	}
+
+	for name, entry := range overlay {
+		if compressible(name) && len(entry.content) >= minGzipSize {
+			overlay[name+".gz"] = &memEntry{gzipBytes(entry.content), entry.modTime}
+		}
+	}
+}
+
+// Protocols of the TLS server, HTTP/2 unless it is disabled
+func serverNextProtos() []string {
+	protos := []string{"http/1.1"}
+	if *http2 {
+		protos = []string{"h2", "http/1.1"}
+	}
+
+	return append(protos, acmeNextProtos()...)
+}
@@ -0,0 +1,339 @@
+// Copyright 2014 Chris McGee <sirnewton_01@yahoo.ca>. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"crypto/tls"
+	"encoding/json"
+	"errors"
+	"flag"
+	"io/ioutil"
+	"log"
+	"net"
+	"os"
+	"os/signal"
+	"path/filepath"
+	"sync"
+	"syscall"
+)
+
+// Server configuration, read from config.json in the data directory.
+// Flags and environment variables given on the command line take
+// precedence over it:
+//
+//	{
+//		"Listen": "0.0.0.0:2022",
+//		"CertFile": "/etc/godev/cert.pem",
+//		"KeyFile": "/etc/godev/key.pem",
+//		"Acme": {"Email": "me@example.com"},
+//		"Cors": {"AllowedOrigins": ["https://app.example.com"], "AllowCredentials": true},
+//		"MaxRatePerSecond": 20,
+//		"RateBurst": 100,
+//		"RemoteAccount": "me@example.com",
+//		"LoginProviders": [{"Name": "google", "Issuer": "https://accounts.google.com", "ClientId": "...", "ClientSecret": "..."}],
+//		"AllowedEmails": ["you@example.com", "@example.org"],
+//		"CommitRules": {"MaxSubjectLength": 72, "Conventional": true, "SignOff": true},
+//		"Linters": [{"Name": "errcheck", "Command": "errcheck", "Args": ["{{pkg}}"]}],
+//		"Bundles": ["/home/me/bundles/godev-bundle"],
+//		"Flags": {"buildTimeout": "5m", "shellCommands": "go,git", "logLevel": "info", "logFile": "/var/log/godev/godev.log"}
+//	}
+//
+// Everything but the listen address is applied again on SIGHUP or POST
+// /admin/reload.
+type ServerConfig struct {
+	// Host and port of the web server, GOHOST and the port flag
+	Listen string `json:",omitempty"`
+	// Certificate and key of a host other than loopback, GOCERTFILE and
+	//  GOKEYFILE
+	CertFile string `json:",omitempty"`
+	KeyFile  string `json:",omitempty"`
+	// Certificates from Let's Encrypt or another ACME CA instead
+	Acme *AcmeConfig `json:",omitempty"`
+	// Origins of other web applications that may use the APIs
+	Cors *CorsConfig `json:",omitempty"`
+	// Requests per second of each client on another machine, which can
+	//  send up to RateBurst at once before they are refused
+	MaxRatePerSecond int    `json:",omitempty"`
+	RateBurst        int    `json:",omitempty"`
+	RemoteAccount    string `json:",omitempty"`
+	// Identity providers that remote users can log in with
+	LoginProviders []LoginProvider `json:",omitempty"`
+	// Email addresses, or @domain for everyone of a domain, that may log
+	//  in with a login provider besides the RemoteAccount
+	AllowedEmails []string `json:",omitempty"`
+	// Rules of the commit messages of the repositories
+	CommitRules *CommitRules `json:",omitempty"`
+	// Linters of /go/lint when there is no linters.json
+	Linters []Linter `json:",omitempty"`
+	// godev-bundle directories outside of the source directories
+	Bundles []string `json:",omitempty"`
+	// Values of other flags by name
+	Flags map[string]string `json:",omitempty"`
+}
+
+var (
+	configFile = flag.String("config", "", "Server configuration file, flags and environment variables take precedence over it. (defaults to config.json in the datadir)")
+
+	configMutex  sync.Mutex
+	serverConfig = ServerConfig{}
+	// Flags of the command line, which the configuration doesn't override
+	explicitFlags = make(map[string]bool)
+
+	// Flags that are only read at startup, changing them takes a restart
+	startupFlags = map[string]bool{
+		"config": true, "datadir": true, "srcdir": true, "port": true, "debug": true, "lsp": true,
+		"lspPort": true, "bundleAssets": true, "readOnly": true, "idleTimeout": true, "gcInterval": true,
+		"usageStats": true, "mirrorTo": true, "mirrorInterval": true, "mailer": true, "nextFreePort": true,
+	}
+
+	serverCertMutex sync.Mutex
+	serverCert      *tls.Certificate
+)
+
+func serverConfigFile() string {
+	if *configFile != "" {
+		return *configFile
+	}
+	return filepath.Join(godevDataDir(), "config.json")
+}
+
+func loadServerConfig() (ServerConfig, error) {
+	config := ServerConfig{}
+
+	b, err := ioutil.ReadFile(serverConfigFile())
+	if os.IsNotExist(err) && *configFile == "" {
+		return config, nil
+	}
+	if err != nil {
+		return config, err
+	}
+
+	err = json.Unmarshal(b, &config)
+	if err != nil {
+		return config, err
+	}
+
+	if config.Listen != "" {
+		if _, _, err := net.SplitHostPort(config.Listen); err != nil {
+			return config, errors.New("Invalid listen address: " + config.Listen)
+		}
+	}
+	for name := range config.Flags {
+		if flag.Lookup(name) == nil {
+			return config, errors.New("No such flag: " + name)
+		}
+	}
+	if err := validateAcmeConfig(config.Acme); err != nil {
+		return config, err
+	}
+	if err := validateCorsConfig(config.Cors); err != nil {
+		return config, err
+	}
+	if err := validateCommitRules(config.CommitRules); err != nil {
+		return config, err
+	}
+	for _, provider := range config.LoginProviders {
+		if err := validateLoginProvider(provider); err != nil {
+			return config, err
+		}
+	}
+
+	return config, nil
+}
+
+// Reads the configuration at startup, after the flags are parsed
+func initServerConfig() error {
+	flag.Visit(func(f *flag.Flag) {
+		explicitFlags[f.Name] = true
+	})
+
+	config, err := loadServerConfig()
+	if err != nil {
+		return err
+	}
+
+	if config.Listen != "" && !explicitFlags["port"] {
+		_, listenPort, _ := net.SplitHostPort(config.Listen)
+		flag.Set("port", listenPort)
+	}
+
+	return applyServerConfig(config, true)
+}
+
+// The host of the listen address, unless it is given by GOHOST
+func configuredHost() string {
+	configMutex.Lock()
+	defer configMutex.Unlock()
+
+	host, _, _ := net.SplitHostPort(serverConfig.Listen)
+	return host
+}
+
+// A configured value unless the environment variable is set
+func configuredEnv(name string, value string) string {
+	if env := os.Getenv(name); env != "" {
+		return env
+	}
+	return value
+}
+
+func applyServerConfig(config ServerConfig, startup bool) error {
+	configMutex.Lock()
+	defer configMutex.Unlock()
+
+	for name, value := range config.Flags {
+		if explicitFlags[name] {
+			continue
+		}
+		if !startup && startupFlags[name] {
+			if serverConfig.Flags[name] != value {
+				logger.Printf("The %v setting only changes with a restart\n", name)
+			}
+			continue
+		}
+
+		err := flag.Set(name, value)
+		if err != nil {
+			return errors.New("Invalid value of " + name + ": " + err.Error())
+		}
+	}
+
+	if config.RemoteAccount != serverConfig.RemoteAccount && !explicitFlags["remoteAccount"] {
+		flag.Set("remoteAccount", config.RemoteAccount)
+	}
+
+	rate := defaultRatePerSecond
+	if config.MaxRatePerSecond > 0 {
+		rate = config.MaxRatePerSecond
+	}
+	burst := defaultRateBurst
+	if config.RateBurst > 0 {
+		burst = config.RateBurst
+	}
+	setRateLimit(rate, burst)
+
+	// The log level, format and files follow the flags
+	err := configureLogging()
+	if err != nil {
+		return err
+	}
+	err = configureAccessLog()
+	if err != nil {
+		return err
+	}
+
+	if !startup && config.Listen != serverConfig.Listen {
+		logger.Printf("The listen address only changes with a restart\n")
+	}
+	if !startup && (config.Acme == nil) != (serverConfig.Acme == nil) {
+		logger.Printf("ACME certificates are only turned on or off with a restart\n")
+	}
+
+	serverConfig = config
+	return nil
+}
+
+// Reads the configuration again and applies it to the running server
+func reloadServerConfig() (ServerConfig, error) {
+	config, err := loadServerConfig()
+	if err != nil {
+		return config, err
+	}
+
+	// The new certificate has to be good before anything changes, ACME
+	//  certificates renew on their own
+	if hostName != loopbackHost && acmeManager == nil {
+		newCertFile, newKeyFile, err := serverCertFiles(config)
+		if err != nil {
+			return config, err
+		}
+		cert, err := tls.LoadX509KeyPair(newCertFile, newKeyFile)
+		if err != nil {
+			return config, err
+		}
+
+		serverCertMutex.Lock()
+		serverCert = &cert
+		serverCertMutex.Unlock()
+	}
+
+	err = applyServerConfig(config, false)
+	if err != nil {
+		return config, err
+	}
+
+	if handlers != nil {
+		handlers.fs.scanBundles()
+	}
+
+	logger.Printf("Reloaded the configuration from %v\n", serverConfigFile())
+	return config, nil
+}
+
+func currentServerConfig() ServerConfig {
+	configMutex.Lock()
+	defer configMutex.Unlock()
+
+	return serverConfig
+}
+
+// The configuration without the client secrets of the login providers, to
+// show it to the admin
+func (config ServerConfig) redacted() ServerConfig {
+	providers := []LoginProvider{}
+	for _, provider := range config.LoginProviders {
+		provider.ClientSecret = "********"
+		providers = append(providers, provider)
+	}
+	config.LoginProviders = providers
+
+	return config
+}
+
+// The configured godev-bundle directories
+func configuredBundles() []string {
+	return currentServerConfig().Bundles
+}
+
+// Linters of the configuration, nil if it doesn't have any
+func configuredLinters() []Linter {
+	return currentServerConfig().Linters
+}
+
+// Serves the certificate that was loaded last, so that a renewed one is
+// picked up by a reload
+func serverCertificate(hello *tls.ClientHelloInfo) (*tls.Certificate, error) {
+	if acmeManager != nil {
+		return acmeManager.GetCertificate(hello)
+	}
+
+	serverCertMutex.Lock()
+	defer serverCertMutex.Unlock()
+
+	if serverCert == nil {
+		cert, err := tls.LoadX509KeyPair(certFile, keyFile)
+		if err != nil {
+			return nil, err
+		}
+		serverCert = &cert
+	}
+
+	return serverCert, nil
+}
+
+// Reloads the configuration on SIGHUP
+func startConfigReloader() {
+	hup := make(chan os.Signal, 1)
+	signal.Notify(hup, syscall.SIGHUP)
+
+	go func() {
+		for range hup {
+			_, err := reloadServerConfig()
+			if err != nil {
+				log.Printf("Unable to reload the configuration: %v\n", err)
+			}
+		}
+	}()
+}
@@ -0,0 +1,113 @@
+// Copyright 2014 Chris McGee <sirnewton_01@yahoo.ca>. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"errors"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+)
+
+// Cross-origin access to the APIs, for a web application on another origin
+// that builds, edits and completes with godev. It is off unless the
+// configuration has it.
+type CorsConfig struct {
+	// Origins such as https://app.example.com, or * for any origin. With
+	//  credentials * doesn't allow anything, since it would let any site
+	//  act as the user.
+	AllowedOrigins []string
+	// Methods of the requests, GET, POST, PUT and DELETE unless given
+	AllowedMethods []string `json:",omitempty"`
+	// Whether the browser sends godev's cookie along
+	AllowCredentials bool `json:",omitempty"`
+	// Seconds that the browser can keep the answer of a preflight request
+	MaxAge int `json:",omitempty"`
+}
+
+var (
+	defaultCorsMethods = []string{"GET", "POST", "PUT", "DELETE"}
+)
+
+func validateCorsConfig(config *CorsConfig) error {
+	if config == nil {
+		return nil
+	}
+
+	for _, origin := range config.AllowedOrigins {
+		if origin == "*" {
+			continue
+		}
+		u, err := url.Parse(origin)
+		if err != nil || u.Scheme == "" || u.Host == "" || (u.Path != "" && u.Path != "/") {
+			return errors.New("Invalid CORS origin: " + origin)
+		}
+	}
+	for _, method := range config.AllowedMethods {
+		if method == "" || strings.ToUpper(method) != method {
+			return errors.New("Invalid CORS method: " + method)
+		}
+	}
+	if config.MaxAge < 0 {
+		return errors.New("Invalid CORS MaxAge: " + strconv.Itoa(config.MaxAge))
+	}
+
+	return nil
+}
+
+func corsOriginAllowed(config *CorsConfig, origin string) bool {
+	for _, allowed := range config.AllowedOrigins {
+		if allowed == "*" && !config.AllowCredentials {
+			return true
+		}
+		if strings.EqualFold(strings.TrimSuffix(allowed, "/"), origin) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// Adds the CORS headers to the response of a request from an allowed
+// origin. Preflight requests are answered here, before the login is
+// checked, since browsers send them without the cookie.
+func handleCors(writer http.ResponseWriter, req *http.Request) bool {
+	config := currentServerConfig().Cors
+	origin := req.Header.Get("Origin")
+	if config == nil || origin == "" {
+		return false
+	}
+
+	writer.Header().Add("Vary", "Origin")
+	if !corsOriginAllowed(config, origin) {
+		return false
+	}
+
+	methods := config.AllowedMethods
+	if len(methods) == 0 {
+		methods = defaultCorsMethods
+	}
+
+	writer.Header().Set("Access-Control-Allow-Origin", origin)
+	if config.AllowCredentials {
+		writer.Header().Set("Access-Control-Allow-Credentials", "true")
+	}
+
+	if req.Method != "OPTIONS" || req.Header.Get("Access-Control-Request-Method") == "" {
+		return false
+	}
+
+	writer.Header().Set("Access-Control-Allow-Methods", strings.Join(methods, ", "))
+	if headers := req.Header.Get("Access-Control-Request-Headers"); headers != "" {
+		writer.Header().Set("Access-Control-Allow-Headers", headers)
+	}
+	if config.MaxAge > 0 {
+		writer.Header().Set("Access-Control-Max-Age", strconv.Itoa(config.MaxAge))
+	}
+	writer.WriteHeader(204)
+
+	return true
+}
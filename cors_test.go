@@ -0,0 +1,42 @@
+// Copyright 2014 Chris McGee <sirnewton_01@yahoo.ca>. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"testing"
+)
+
+func TestCorsOriginAllowed(t *testing.T) {
+	origins := &CorsConfig{AllowedOrigins: []string{"https://app.example.com", "http://localhost:8080/"}}
+	anyOrigin := &CorsConfig{AllowedOrigins: []string{"*"}}
+	anyWithCredentials := &CorsConfig{AllowedOrigins: []string{"*"}, AllowCredentials: true}
+	originsWithCredentials := &CorsConfig{AllowedOrigins: []string{"*", "https://app.example.com"}, AllowCredentials: true}
+
+	tests := []struct {
+		config  *CorsConfig
+		origin  string
+		allowed bool
+	}{
+		{origins, "https://app.example.com", true},
+		{origins, "HTTPS://APP.EXAMPLE.COM", true},
+		{origins, "http://localhost:8080", true},
+		{origins, "http://app.example.com", false},
+		{origins, "https://app.example.com:8443", false},
+		{origins, "https://evil.example.com", false},
+		{origins, "https://app.example.com.evil.com", false},
+		{origins, "null", false},
+		{anyOrigin, "https://evil.example.com", true},
+		{anyWithCredentials, "https://evil.example.com", false},
+		{originsWithCredentials, "https://app.example.com", true},
+		{originsWithCredentials, "https://evil.example.com", false},
+		{&CorsConfig{}, "https://app.example.com", false},
+	}
+
+	for _, test := range tests {
+		if allowed := corsOriginAllowed(test.config, test.origin); allowed != test.allowed {
+			t.Errorf("%v with %v: allowed is %v, expected %v", test.origin, test.config.AllowedOrigins, allowed, test.allowed)
+		}
+	}
+}
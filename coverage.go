@@ -0,0 +1,368 @@
+// Copyright 2014 Chris McGee <sirnewton_01@yahoo.ca>. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/sha1"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Coverage of the last test run of a package with its profile
+type CoverageReport struct {
+	// set, count or atomic
+	Mode string
+	// When the tests ran, in milliseconds
+	Time    int64
+	Percent float64
+	Files   []CoverageFile
+}
+
+type CoverageFile struct {
+	// Workspace location, empty for files outside of the workspace
+	Location string `json:",omitempty"`
+	// Name of the file in the profile, e.g. github.com/user/project/main.go
+	File       string
+	Statements int
+	Covered    int
+	// Lines that ran and those that didn't, a line with both is covered
+	CoveredLines   []CoverageRange
+	UncoveredLines []CoverageRange
+}
+
+type CoverageRange struct {
+	StartLine int
+	EndLine   int
+}
+
+// Block of a cover profile, e.g. "main.go:10.13,12.3 2 1"
+type coverageBlock struct {
+	startLine, startCol int
+	endLine, endCol     int
+	statements          int
+	count               int
+}
+
+var (
+	coverageMutex sync.Mutex
+)
+
+// The packages have their profile stored under the directory they are in,
+// or the import path if that can't be found.
+func coverageKey(srcDirs []string, request GoTestRequest) (string, error) {
+	if request.Dir != "" {
+		return shellDir(srcDirs, request.Dir)
+	}
+
+	if dir, err := packageDir(srcDirs, request.Package); err == nil {
+		return dir, nil
+	}
+
+	return "pkg:" + request.Package, nil
+}
+
+func coverageFile(user string, key string) string {
+	hash := sha1.Sum([]byte(key))
+	return filepath.Join(userDataDir(user), "coverage", hex.EncodeToString(hash[:]))
+}
+
+// Keeps the profile of the latest run, replacing the one before
+func saveCoverageProfile(user string, key string, profile []byte) error {
+	coverageMutex.Lock()
+	defer coverageMutex.Unlock()
+
+	p := coverageFile(user, key)
+	err := os.MkdirAll(filepath.Dir(p), 0700)
+	if err != nil {
+		return err
+	}
+
+	return ioutil.WriteFile(p, profile, 0600)
+}
+
+func loadCoverageReport(user string, key string) (*CoverageReport, error) {
+	coverageMutex.Lock()
+	p := coverageFile(user, key)
+	profile, err := ioutil.ReadFile(p)
+	info, statErr := os.Stat(p)
+	coverageMutex.Unlock()
+
+	if err != nil {
+		return nil, err
+	}
+
+	report, err := parseCoverProfile(userSrcDirs(user), profile, key)
+	if err != nil {
+		return nil, err
+	}
+	if statErr == nil {
+		report.Time = info.ModTime().Unix() * 1000
+	}
+
+	return report, nil
+}
+
+// Finds the workspace location of a file of the profile. Files of the
+// package itself are next to the key when the import path is of a module
+// that isn't laid out in the GOPATH.
+func coverageFileLocation(srcDirs []string, file string, key string) string {
+	if location := stackFileLocation(srcDirs, file, ""); location != "" {
+		return location
+	}
+
+	p := filepath.Join(key, filepath.Base(file))
+	if _, err := os.Stat(p); err == nil {
+		return workspaceLocation(p)
+	}
+
+	return ""
+}
+
+// Lines of the blocks grouped into ranges, a line that ran in any of the
+// blocks counts as covered
+func coverageRanges(blocks []coverageBlock) ([]CoverageRange, []CoverageRange) {
+	covered := make(map[int]bool)
+	for _, b := range blocks {
+		// Blocks that end at the start of a line don't include it
+		endLine := b.endLine
+		if b.endCol <= 1 && endLine > b.startLine {
+			endLine--
+		}
+
+		for line := b.startLine; line <= endLine; line++ {
+			covered[line] = covered[line] || b.count > 0
+		}
+	}
+
+	lines := []int{}
+	for line := range covered {
+		lines = append(lines, line)
+	}
+	sort.Ints(lines)
+
+	coveredLines := []CoverageRange{}
+	uncoveredLines := []CoverageRange{}
+	for _, line := range lines {
+		ranges := &uncoveredLines
+		if covered[line] {
+			ranges = &coveredLines
+		}
+
+		if n := len(*ranges); n > 0 && (*ranges)[n-1].EndLine == line-1 {
+			(*ranges)[n-1].EndLine = line
+		} else {
+			*ranges = append(*ranges, CoverageRange{line, line})
+		}
+	}
+
+	return coveredLines, uncoveredLines
+}
+
+func parseCoverProfile(srcDirs []string, profile []byte, key string) (*CoverageReport, error) {
+	report := &CoverageReport{Files: []CoverageFile{}}
+
+	// Runs of several packages can list a block more than once
+	blocks := make(map[string]map[coverageBlock]int)
+	files := []string{}
+
+	scanner := bufio.NewScanner(bytes.NewReader(profile))
+	for scanner.Scan() {
+		line := scanner.Text()
+		if strings.HasPrefix(line, "mode: ") {
+			report.Mode = line[6:]
+			continue
+		}
+		if line == "" {
+			continue
+		}
+
+		colon := strings.LastIndex(line, ":")
+		if colon == -1 {
+			return nil, errors.New("Invalid cover profile line: " + line)
+		}
+
+		b := coverageBlock{}
+		_, err := fmt.Sscanf(line[colon+1:], "%d.%d,%d.%d %d %d", &b.startLine, &b.startCol, &b.endLine, &b.endCol, &b.statements, &b.count)
+		if err != nil {
+			return nil, errors.New("Invalid cover profile line: " + line)
+		}
+		count := b.count
+		b.count = 0
+
+		file := line[:colon]
+		if blocks[file] == nil {
+			blocks[file] = make(map[coverageBlock]int)
+			files = append(files, file)
+		}
+		blocks[file][b] += count
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+
+	statements, covered := 0, 0
+	sort.Strings(files)
+	for _, file := range files {
+		f := CoverageFile{File: file, Location: coverageFileLocation(srcDirs, file, key)}
+
+		fileBlocks := []coverageBlock{}
+		for b, count := range blocks[file] {
+			f.Statements += b.statements
+			if count > 0 {
+				f.Covered += b.statements
+			}
+
+			b.count = count
+			fileBlocks = append(fileBlocks, b)
+		}
+		f.CoveredLines, f.UncoveredLines = coverageRanges(fileBlocks)
+
+		statements += f.Statements
+		covered += f.Covered
+		report.Files = append(report.Files, f)
+	}
+
+	if statements > 0 {
+		report.Percent = float64(covered) * 100 / float64(statements)
+	}
+
+	return report, nil
+}
+
+func gcCoverage(cutoff time.Time, result *GcResult) error {
+	coverageMutex.Lock()
+	defer coverageMutex.Unlock()
+
+	for _, user := range dataUsers() {
+		dir := filepath.Join(userDataDir(user), "coverage")
+		infos, _ := ioutil.ReadDir(dir)
+		for _, info := range infos {
+			if info.ModTime().Before(cutoff) {
+				gcRemove(filepath.Join(dir, info.Name()), result)
+			}
+		}
+	}
+
+	return nil
+}
+
+// GET /go/coverage?dir=<location> or ?pkg=<import path> has the coverage of
+// the last test run of the package with cover turned on, ?file=<location>
+// only that of one of its files. POST /go/coverage runs the tests of the
+// GoTestRequest in the body for it first.
+func coverageHandler(writer http.ResponseWriter, req *http.Request, path string, pathSegs []string) bool {
+	switch {
+	case req.Method == "GET" && len(pathSegs) == 2:
+		user := requestUser(req)
+		query := req.URL.Query()
+
+		location := query.Get("file")
+		key := ""
+		if location != "" {
+			if !strings.HasPrefix(location, "/file/") {
+				ShowError(writer, 400, "Not a workspace file: "+location, nil)
+				return true
+			}
+
+			p, err := bufferPath(requestSrcDirs(req), append([]string{"go", "coverage"}, strings.Split(location[1:], "/")...))
+			if err != nil {
+				ShowError(writer, 400, err.Error(), nil)
+				return true
+			}
+			key = filepath.Dir(p)
+		} else if query.Get("pkg") == "" && query.Get("dir") == "" {
+			ShowError(writer, 400, "No package provided", nil)
+			return true
+		} else {
+			var err error
+			key, err = coverageKey(requestSrcDirs(req), GoTestRequest{Package: query.Get("pkg"), Dir: query.Get("dir")})
+			if err != nil {
+				ShowError(writer, 400, err.Error(), nil)
+				return true
+			}
+		}
+
+		report, err := loadCoverageReport(user, key)
+		if os.IsNotExist(err) {
+			ShowError(writer, 404, "There is no coverage for the package, run its tests with coverage first", nil)
+			return true
+		}
+		if err != nil {
+			ShowError(writer, 500, "Unable to read the coverage profile", err)
+			return true
+		}
+
+		if location == "" {
+			ShowJson(writer, 200, report)
+			return true
+		}
+
+		for _, f := range report.Files {
+			if f.Location == location {
+				ShowJson(writer, 200, f)
+				return true
+			}
+		}
+
+		ShowError(writer, 404, "The file isn't part of the coverage of its package", nil)
+		return true
+	case req.Method == "POST" && len(pathSegs) == 2:
+		request := GoTestRequest{}
+		err := json.NewDecoder(req.Body).Decode(&request)
+		if err != nil {
+			ShowError(writer, 400, "Invalid test request", err)
+			return true
+		}
+		request.Cover = true
+
+		if _, _, err := goTestArgs(requestSrcDirs(req), request); err != nil {
+			ShowError(writer, 400, err.Error(), nil)
+			return true
+		}
+		key, err := coverageKey(requestSrcDirs(req), request)
+		if err != nil {
+			ShowError(writer, 400, err.Error(), nil)
+			return true
+		}
+
+		ctx, cancel := operationContext(req, *testTimeout)
+		defer cancel()
+
+		user := requestUser(req)
+		start := time.Now().Unix() * 1000
+		testReport := runGoTest(ctx, user, request, nil, func(GoTestEvent) {})
+		if testReport.Cancelled {
+			ShowError(writer, 500, "The test run was cancelled", nil)
+			return true
+		}
+
+		// A run that fails to build leaves the profile of the one before
+		report, err := loadCoverageReport(user, key)
+		if err == nil && report.Time < start {
+			err = errors.New("The cover profile wasn't written")
+		}
+		if err != nil {
+			ShowError(writer, 500, "The tests produced no coverage: "+testReport.Error, err)
+			return true
+		}
+
+		ShowJson(writer, 200, report)
+		return true
+	}
+
+	return false
+}
@@ -16,6 +16,12 @@ import (
 )
 
 func debugSocket(ws *websocket.Conn) {
+	debugTask(framedSocket(ws))
+}
+
+// Installs and runs a command of the debug page, or a single file for the
+// quick run, over the connection to the browser.
+func debugTask(ws taskConn) {
 	url := ws.Request().URL
 
 	// Short circuit for "go run" case
@@ -24,6 +30,12 @@ func debugSocket(ws *websocket.Conn) {
 		return
 	}
 
+	// Delve sessions speak JSON frames instead of a terminal
+	if url.Query().Get("dlv") == "true" {
+		delveTask(ws)
+		return
+	}
+
 	debug := url.Query().Get("debug") == "true"
 	race := url.Query().Get("race") == "true"
 	cmd := url.Query().Get("cmd")
@@ -94,11 +106,14 @@ func debugSocket(ws *websocket.Conn) {
 		cmd = "godbg"
 	}
 
+	debugLog.Infof("Running %v %v\n", cmd, strings.Join(paramList, " "))
 	c := exec.Command(cmd, paramList...)
 	out, in, err := start(c)
 	if err != nil {
 		panic(err)
 	}
+	proc := registerProcess(requestUser(ws.Request()), "debug", c, ws)
+	defer proc.unregister()
 
 	go func() {
 		for {
@@ -112,6 +127,7 @@ func debugSocket(ws *websocket.Conn) {
 			if err != nil {
 				break
 			}
+			proc.touch()
 		}
 
 		ws.Close()
@@ -123,6 +139,7 @@ func debugSocket(ws *websocket.Conn) {
 		if err != nil {
 			break
 		}
+		proc.touch()
 
 		n, err = in.Write(buf[:n])
 		if err != nil {
@@ -135,7 +152,7 @@ func debugSocket(ws *websocket.Conn) {
 	c.Wait()
 }
 
-func goRun(ws *websocket.Conn, file string) {
+func goRun(ws taskConn, file string) {
 	var ospath string
 	gopaths := filepath.SplitList(build.Default.GOPATH)
 
@@ -158,6 +175,8 @@ func goRun(ws *websocket.Conn, file string) {
 	if err != nil {
 		panic(err)
 	}
+	proc := registerProcess(requestUser(ws.Request()), "run", c, ws)
+	defer proc.unregister()
 
 	go func() {
 		for {
@@ -171,6 +190,7 @@ func goRun(ws *websocket.Conn, file string) {
 			if err != nil {
 				break
 			}
+			proc.touch()
 		}
 
 		ws.Close()
@@ -182,6 +202,7 @@ func goRun(ws *websocket.Conn, file string) {
 		if err != nil {
 			break
 		}
+		proc.touch()
 
 		n, err = in.Write(buf[:n])
 		if err != nil {
@@ -196,9 +217,19 @@ func goRun(ws *websocket.Conn, file string) {
 
 func debugHandler(writer http.ResponseWriter, req *http.Request, path string, pathSegs []string) bool {
 	switch {
+	case req.Method == "GET" && len(pathSegs) == 2 && pathSegs[1] == "stream":
+		// Same as the socket for browsers that can't open WebSockets
+		serveTaskStream(writer, req, debugTask)
+		return true
+	case req.Method == "POST" && len(pathSegs) == 3 && pathSegs[1] == "stream":
+		taskStreamInput(writer, req, pathSegs[2])
+		return true
 	case req.Method == "GET" && len(pathSegs) == 2 && pathSegs[1] == "commands":
 		commands := []string{}
 
+		ctx, cancel := operationContext(req, *searchTimeout)
+		defer cancel()
+
 		srcDirs := build.Default.SrcDirs()
 
 		for _, srcDir := range srcDirs {
@@ -208,6 +239,10 @@ func debugHandler(writer http.ResponseWriter, req *http.Request, path string, pa
 			}
 
 			filepath.Walk(srcDir, func(path string, info os.FileInfo, err error) error {
+				if ctx.Err() != nil {
+					return ctx.Err()
+				}
+
 				if info.IsDir() {
 					pkg, err := build.Default.ImportDir(path, 0)
 
@@ -222,14 +257,44 @@ func debugHandler(writer http.ResponseWriter, req *http.Request, path string, pa
 		ShowJson(writer, 200, commands)
 		return true
 	case req.Method == "GET" && len(pathSegs) == 2 && pathSegs[1] == "debugSupport":
+		// The debuggers that are available
+		debuggers := []string{}
+		if dlvAvailable() {
+			debuggers = append(debuggers, "dlv")
+			// Delve can record with it
+			if rrAvailable() {
+				debuggers = append(debuggers, "rr")
+			}
+		}
+
 		godbgtest := exec.Command("godbg")
 		err := godbgtest.Run()
-		if err != nil {
-			ShowError(writer, 404, "godbg command could not be found on the system path. Install using 'go get github.com/sirnewton01/godbg', install it and add the binary to the path for debugging support.", err)
+		if err == nil {
+			debuggers = append(debuggers, "godbg")
+		}
+
+		if len(debuggers) == 0 {
+			ShowError(writer, 404, "Neither dlv nor godbg could be found on the system path. Install Delve using 'go install github.com/go-delve/delve/cmd/dlv@latest' and add the binary to the path for debugging support.", err)
+			return true
+		}
+
+		ShowJson(writer, 200, debuggers)
+		return true
+	case req.Method == "GET" && len(pathSegs) == 2 && pathSegs[1] == "sessions":
+		ShowJson(writer, 200, listDebugSessions(requestUser(req)))
+		return true
+	case req.Method == "GET" && len(pathSegs) == 2 && pathSegs[1] == "processes":
+		ShowJson(writer, 200, listProcesses(requestUser(req)))
+		return true
+	case req.Method == "DELETE" && len(pathSegs) == 3 && pathSegs[1] == "processes":
+		proc := findProcess(pathSegs[2])
+		if proc == nil || proc.User != requestUser(req) {
+			ShowError(writer, 404, "Process not found", nil)
 			return true
 		}
 
-		ShowJson(writer, 200, []string{})
+		proc.kill()
+		writer.WriteHeader(204)
 		return true
 	}
 
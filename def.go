@@ -34,9 +34,9 @@ func definitionHandler(writer http.ResponseWriter, req *http.Request, path strin
 		if pathSegs[3] == "GOROOT" {
 			workingDir = filepath.Join(goroot+"/src/pkg", strings.Join(pathSegs[4:len(pathSegs)-1], "/"))
 		} else {
-			dirRelPath := filepath.Clean(strings.Join(pathSegs[3:len(pathSegs)-1], "/"))
+			dirRelPath := filepath.Clean("/" + strings.Join(pathSegs[3:len(pathSegs)-1], "/"))
 
-			for _, srcDir := range srcDirs {
+			for _, srcDir := range requestSrcDirs(req) {
 				dirPath := filepath.Join(srcDir, dirRelPath)
 				_, err := os.Stat(dirPath)
 
@@ -52,7 +52,10 @@ func definitionHandler(writer http.ResponseWriter, req *http.Request, path strin
 			return true
 		}
 
-		cmd := exec.Command("godef", "-o="+offsetStr, "-i=true", "-t=true")
+		ctx, cancel := operationContext(req, *toolTimeout)
+		defer cancel()
+
+		cmd := exec.CommandContext(ctx, "godef", "-o="+offsetStr, "-i=true", "-t=true")
 		cmd.Dir = workingDir
 		cmd.Stdin = req.Body
 
@@ -0,0 +1,925 @@
+// Copyright 2014 Chris McGee <sirnewton_01@yahoo.ca>. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"bufio"
+	"context"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/rpc"
+	"net/rpc/jsonrpc"
+	"net/url"
+	"os/exec"
+	"path/filepath"
+	"runtime"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	dlvStartTimeout = 30 * time.Second
+)
+
+// Debug session of a workspace command under Delve. The browser sends
+// commands as JSON frames and gets back their results along with events
+// for the output of the program and changes to its state.
+type DebugSession struct {
+	Id   string
+	User string
+	// Import path of the command, the package and name of the test, or the
+	//  process that was attached to
+	Target  string
+	Started int64
+	// Recorded with rr, the program can run backwards and be returned to
+	//  checkpoints
+	Recorded bool `json:",omitempty"`
+
+	client     *rpc.Client
+	conn       taskConn
+	writeMutex sync.Mutex
+
+	watchMutex  sync.Mutex
+	watches     []DebugWatch
+	nextWatchId int
+}
+
+// Expression that is evaluated each time the program stops. It follows the
+// current goroutine unless it is pinned to the goroutine and frame where it
+// was added, so that a value stays in view while stepping elsewhere.
+type DebugWatch struct {
+	Id          int
+	Expr        string
+	Pinned      bool  `json:",omitempty"`
+	GoroutineId int64 `json:",omitempty"`
+	Frame       int   `json:",omitempty"`
+}
+
+type DebugWatchValue struct {
+	DebugWatch
+	Value interface{} `json:",omitempty"`
+	Error string      `json:",omitempty"`
+}
+
+// Raw memory as read from the process
+type DebugMemory struct {
+	Address      string
+	Bytes        string
+	LittleEndian bool
+	// Hex dump with 16 bytes to a line
+	Dump []string
+}
+
+// Disassembly of the function around a PC, with the instructions grouped
+// under the source lines they come from
+type DebugDisassembly struct {
+	Function string
+	Pc       string
+	Lines    []DebugAsmLine
+}
+
+type DebugAsmLine struct {
+	Location     string
+	Line         int
+	Source       string
+	Instructions []DebugInstruction
+}
+
+type DebugInstruction struct {
+	Pc         string
+	Text       string
+	Bytes      string
+	AtPc       bool `json:",omitempty"`
+	Breakpoint bool `json:",omitempty"`
+}
+
+// A page of the elements of a large slice, array or map
+type DebugPage struct {
+	Expr  string
+	Start int
+	// Elements of the whole value
+	Len      int64
+	Children interface{}
+}
+
+// Command frame from the browser, e.g.
+//
+//	{"Id": 3, "Command": "createBreakpoint", "Args": {"File": "/file/x/main.go", "Line": 12}}
+type DebugRequest struct {
+	Id      int
+	Command string
+	Args    json.RawMessage
+}
+
+// Frame to the browser, either the answer to a request or an event
+// ("started", "output", "state", "watches" or "exited").
+type DebugFrame struct {
+	Id     int         `json:",omitempty"`
+	Event  string      `json:",omitempty"`
+	Result interface{} `json:",omitempty"`
+	Output string      `json:",omitempty"`
+	Error  string      `json:",omitempty"`
+}
+
+// Arguments of the commands, each uses the fields it needs
+type debugArgs struct {
+	File         string
+	Line         int
+	Cond         string
+	BreakpointId int
+	GoroutineId  int64
+	Frame        int
+	Depth        int
+	Expr         string
+	WatchId      int
+	Pinned       bool
+	// Page of the expand command, instructions around the PC for
+	//  disassemble
+	Start int
+	Count int
+	// Hexadecimal address or an expression of the variable at it
+	Address string
+	Length  int
+	// go, intel or gnu
+	Flavour string
+	// Note of a new checkpoint
+	Where        string
+	CheckpointId int
+}
+
+var (
+	debugSessionsMutex sync.Mutex
+	debugSessions      = make(map[string]*DebugSession)
+
+	// How much of variables Delve loads
+	dlvLoadConfig = map[string]interface{}{
+		"FollowPointers":     true,
+		"MaxVariableRecurse": 1,
+		"MaxStringLen":       256,
+		"MaxArrayValues":     64,
+		"MaxStructFields":    -1,
+	}
+
+	// Watches are shown on every stop so they load less, the rest of a
+	//  value is paged in with the expand command
+	dlvWatchLoadConfig = map[string]interface{}{
+		"FollowPointers":     true,
+		"MaxVariableRecurse": 1,
+		"MaxStringLen":       128,
+		"MaxArrayValues":     16,
+		"MaxStructFields":    -1,
+	}
+
+	// Commands that let the program run, their results are its new state
+	dlvRunCommands = map[string]string{
+		"continue": "continue",
+		"next":     "next",
+		"step":     "step",
+		"stepout":  "stepOut",
+		"halt":     "halt",
+		// Recorded sessions only
+		"rewind":         "rewind",
+		"reversenext":    "reverseNext",
+		"reversestep":    "reverseStep",
+		"reversestepout": "reverseStepOut",
+	}
+
+	// Commands that need a recording
+	dlvRecordCommands = map[string]bool{
+		"rewind":            true,
+		"reversenext":       true,
+		"reversestep":       true,
+		"reversestepout":    true,
+		"checkpoint":        true,
+		"listCheckpoints":   true,
+		"clearCheckpoint":   true,
+		"restoreCheckpoint": true,
+	}
+)
+
+func dlvAvailable() bool {
+	_, err := exec.LookPath("dlv")
+	return err == nil
+}
+
+// Delve records and replays with rr, which only runs on Linux
+func rrAvailable() bool {
+	_, err := exec.LookPath("rr")
+	return err == nil && runtime.GOOS == "linux"
+}
+
+func listDebugSessions(user string) []DebugSession {
+	debugSessionsMutex.Lock()
+	defer debugSessionsMutex.Unlock()
+
+	result := []DebugSession{}
+	for _, s := range debugSessions {
+		if s.User == user {
+			result = append(result, DebugSession{Id: s.Id, User: s.User, Target: s.Target, Started: s.Started, Recorded: s.Recorded})
+		}
+	}
+
+	sort.Slice(result, func(i, j int) bool { return result[i].Started < result[j].Started })
+	return result
+}
+
+func (s *DebugSession) send(frame DebugFrame) error {
+	b, err := json.Marshal(frame)
+	if err != nil {
+		return err
+	}
+
+	s.writeMutex.Lock()
+	defer s.writeMutex.Unlock()
+
+	_, err = s.conn.Write(b)
+	return err
+}
+
+// Builds the command or the test binary of a package without optimizations
+// (or finds the process to attach to) and runs it under a headless Delve
+// that the session talks to.
+func delveTask(ws taskConn) {
+	query := ws.Request().URL.Query()
+	user := requestUser(ws.Request())
+
+	fail := func(msg string) {
+		b, _ := json.Marshal(DebugFrame{Event: "exited", Error: msg})
+		ws.Write(b)
+		ws.Close()
+	}
+
+	if !dlvAvailable() {
+		fail("The dlv command could not be found on the system path. Install it using 'go install github.com/go-delve/delve/cmd/dlv@latest'.")
+		return
+	}
+
+	listen := []string{"--headless", "--api-version=2", "--listen=127.0.0.1:0"}
+	// The whole run is recorded before Delve listens, the program has
+	//  until the build timeout
+	record := query.Get("record") == "true"
+	startTimeout := dlvStartTimeout
+	if record {
+		if query.Get("attach") != "" || !rrAvailable() {
+			fail("Recording needs the rr command on Linux and a program that godev starts. See https://rr-project.org for rr.")
+			return
+		}
+		listen = append(listen, "--backend=rr")
+		startTimeout = *buildTimeout
+	}
+	var args []string
+	target := query.Get("cmd")
+	// Working directory of the program
+	dir := ""
+
+	if attach := query.Get("attach"); attach != "" {
+		// Only processes that godev launched for the same user
+		proc := findProcess(attach)
+		if proc == nil || proc.User != user || proc.cmd.Process == nil {
+			fail("Process not found")
+			return
+		}
+
+		target = proc.Command
+		args = append([]string{"attach", strconv.Itoa(proc.cmd.Process.Pid)}, listen...)
+	} else {
+		tmpDir, err := newTempDir("godev-debug")
+		if err != nil {
+			fail("Unable to create a directory for the build: " + err.Error())
+			return
+		}
+		defer removeTempDir(tmpDir)
+
+		ctx, cancel := context.WithTimeout(ws.Request().Context(), *buildTimeout)
+		defer cancel()
+
+		binary := filepath.Join(tmpDir, scratchExecutable)
+		buildArgs := []string{"build", "-gcflags=all=-N -l", "-o", binary}
+		if query.Get("race") == "true" {
+			buildArgs = append(buildArgs, "-race")
+		}
+		buildTarget := target
+		programArgs := []string{}
+
+		if pkg := query.Get("test"); pkg != "" {
+			programArgs, err = debugTestArgs(query)
+			if err != nil {
+				fail(err.Error())
+				return
+			}
+			// The test binary of the package, which runs in its
+			//  directory like go test does so that testdata is found
+			dir, err = packageDir(userSrcDirs(user), pkg)
+			if err != nil {
+				fail(err.Error())
+				return
+			}
+			buildArgs = append([]string{"test", "-c"}, buildArgs[1:]...)
+			buildTarget = "."
+			target = strings.TrimSpace(pkg + " " + query.Get("testBench") + query.Get("testRun"))
+		}
+
+		build := exec.CommandContext(ctx, "go", append(buildArgs, buildTarget)...)
+		build.Dir = dir
+		out, err := build.CombinedOutput()
+		if err != nil {
+			fail("Error building the command: " + err.Error() + "\n" + string(out))
+			return
+		}
+
+		args = append(append(append([]string{"exec", binary}, listen...), "--"), programArgs...)
+		if params := strings.TrimSpace(query.Get("params")); params != "" {
+			args = append(args, strings.Split(params, " ")...)
+		}
+	}
+
+	dlv := exec.Command("dlv", args...)
+	dlv.Dir = dir
+	output, outputWriter := io.Pipe()
+	dlv.Stdout = outputWriter
+	dlv.Stderr = outputWriter
+
+	err := dlv.Start()
+	if err != nil {
+		fail("Unable to start dlv: " + err.Error())
+		return
+	}
+
+	proc := registerProcess(user, "debug", dlv, ws)
+	defer proc.unregister()
+
+	exited := make(chan bool)
+	go func() {
+		dlv.Wait()
+		outputWriter.Close()
+		close(exited)
+	}()
+
+	// Delve tells where it listens before anything else
+	lines := bufio.NewReader(output)
+	addr := make(chan string, 1)
+	go func() {
+		for {
+			line, err := lines.ReadString('\n')
+			if err != nil {
+				close(addr)
+				return
+			}
+			if idx := strings.Index(line, "listening at:"); idx != -1 {
+				addr <- strings.TrimSpace(line[idx+len("listening at:"):])
+				return
+			}
+		}
+	}()
+
+	var client *rpc.Client
+	select {
+	case a, ok := <-addr:
+		if ok {
+			client, err = jsonrpc.Dial("tcp", a)
+		}
+		if !ok || err != nil {
+			dlv.Process.Kill()
+			fail("Unable to connect to dlv")
+			return
+		}
+	case <-time.After(startTimeout):
+		dlv.Process.Kill()
+		fail("Timed out waiting for dlv to start")
+		return
+	}
+
+	s := &DebugSession{Id: proc.Id, User: user, Target: target, Started: time.Now().Unix() * 1000, Recorded: record, client: client, conn: ws}
+
+	debugSessionsMutex.Lock()
+	debugSessions[s.Id] = s
+	debugSessionsMutex.Unlock()
+
+	defer func() {
+		debugSessionsMutex.Lock()
+		delete(debugSessions, s.Id)
+		debugSessionsMutex.Unlock()
+
+		// Detaching with kill ends the program that was launched, an
+		//  attached process carries on.
+		client.Call("RPCServer.Detach", map[string]interface{}{"Kill": query.Get("attach") == ""}, &map[string]interface{}{})
+		client.Close()
+
+		select {
+		case <-exited:
+		case <-time.After(5 * time.Second):
+			dlv.Process.Kill()
+		}
+		ws.Close()
+	}()
+
+	s.send(DebugFrame{Event: "started", Result: DebugSession{Id: s.Id, User: s.User, Target: s.Target, Started: s.Started, Recorded: s.Recorded}})
+
+	// Output of the program
+	go func() {
+		buf := make([]byte, 1024)
+		for {
+			n, err := lines.Read(buf)
+			if err != nil {
+				break
+			}
+			s.send(DebugFrame{Event: "output", Output: string(buf[:n])})
+			proc.touch()
+		}
+
+		// Delve went away on its own
+		ws.Close()
+	}()
+
+	decoder := json.NewDecoder(ws)
+	for {
+		request := DebugRequest{}
+		err := decoder.Decode(&request)
+		if err != nil {
+			if _, ok := err.(*json.SyntaxError); ok {
+				s.send(DebugFrame{Error: "Invalid request: " + err.Error()})
+				decoder = json.NewDecoder(ws)
+				continue
+			}
+			break
+		}
+		proc.touch()
+
+		// Commands run side by side so that a halt can interrupt a continue
+		go func(request DebugRequest) {
+			result, err := s.execute(request)
+			frame := DebugFrame{Id: request.Id, Result: result}
+			if err != nil {
+				frame.Error = err.Error()
+			}
+			s.send(frame)
+
+			_, ok := dlvRunCommands[request.Command]
+			if (ok || request.Command == "restoreCheckpoint") && err == nil {
+				if state, ok := result.(map[string]interface{}); ok && state["exited"] == true {
+					s.send(DebugFrame{Event: "exited", Result: state})
+				} else {
+					s.send(DebugFrame{Event: "state", Result: result})
+					s.send(DebugFrame{Event: "watches", Result: s.evalWatches()})
+				}
+			}
+		}(request)
+	}
+}
+
+// Arguments of a test binary that runs the tests matching testRun, or the
+// benchmarks matching testBench and no tests
+func debugTestArgs(query url.Values) ([]string, error) {
+	pkg := query.Get("test")
+	if strings.HasPrefix(pkg, "-") || pkg == "all" || pkg == "std" {
+		return nil, errors.New("Invalid package: " + pkg)
+	}
+
+	args := []string{"-test.v"}
+	if bench := query.Get("testBench"); bench != "" {
+		return append(args, "-test.run=^$", "-test.bench="+bench, "-test.benchmem"), nil
+	}
+	if run := query.Get("testRun"); run != "" {
+		args = append(args, "-test.run="+run)
+	}
+
+	return args, nil
+}
+
+// Runs one command of the browser against Delve
+func (s *DebugSession) execute(request DebugRequest) (interface{}, error) {
+	args := debugArgs{}
+	if len(request.Args) > 0 {
+		err := json.Unmarshal(request.Args, &args)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	scope := map[string]interface{}{"GoroutineID": args.GoroutineId, "Frame": args.Frame}
+	call := func(method string, in interface{}, field string) (interface{}, error) {
+		out := map[string]interface{}{}
+		err := s.client.Call("RPCServer."+method, in, &out)
+		if err != nil {
+			return nil, err
+		}
+		if field == "" {
+			return debugLocations(out), nil
+		}
+		return debugLocations(out[field]), nil
+	}
+
+	if dlvRecordCommands[request.Command] && !s.Recorded {
+		return nil, errors.New("The session was not recorded, " + request.Command + " needs a recorded session")
+	}
+
+	if name, ok := dlvRunCommands[request.Command]; ok {
+		return call("Command", map[string]interface{}{"name": name}, "State")
+	}
+
+	switch request.Command {
+	case "state":
+		return call("State", map[string]interface{}{"NonBlocking": true}, "State")
+	case "createBreakpoint":
+		file, err := debugFilePath(userSrcDirs(s.User), args.File)
+		if err != nil {
+			return nil, err
+		}
+		breakpoint := map[string]interface{}{"file": file, "line": args.Line, "Cond": args.Cond}
+		return call("CreateBreakpoint", map[string]interface{}{"Breakpoint": breakpoint}, "Breakpoint")
+	case "clearBreakpoint":
+		return call("ClearBreakpoint", map[string]interface{}{"Id": args.BreakpointId}, "Breakpoint")
+	case "listBreakpoints":
+		return call("ListBreakpoints", map[string]interface{}{}, "Breakpoints")
+	case "goroutines":
+		return call("ListGoroutines", map[string]interface{}{"Start": 0, "Count": 0}, "Goroutines")
+	case "stacktrace":
+		depth := args.Depth
+		if depth <= 0 {
+			depth = 50
+		}
+		return call("Stacktrace", map[string]interface{}{"Id": args.GoroutineId, "Depth": depth, "Cfg": dlvLoadConfig}, "Locations")
+	case "locals":
+		return call("ListLocalVars", map[string]interface{}{"Scope": scope, "Cfg": dlvLoadConfig}, "Variables")
+	case "args":
+		return call("ListFunctionArgs", map[string]interface{}{"Scope": scope, "Cfg": dlvLoadConfig}, "Args")
+	case "eval":
+		return call("Eval", map[string]interface{}{"Scope": scope, "Expr": args.Expr, "Cfg": dlvLoadConfig}, "Variable")
+	case "addWatch":
+		if strings.TrimSpace(args.Expr) == "" {
+			return nil, errors.New("No expression provided")
+		}
+
+		s.watchMutex.Lock()
+		s.nextWatchId++
+		watch := DebugWatch{Id: s.nextWatchId, Expr: args.Expr, Pinned: args.Pinned}
+		if watch.Pinned {
+			watch.GoroutineId = args.GoroutineId
+			watch.Frame = args.Frame
+		}
+		s.watches = append(s.watches, watch)
+		s.watchMutex.Unlock()
+
+		return s.evalWatch(watch), nil
+	case "removeWatch":
+		s.watchMutex.Lock()
+		defer s.watchMutex.Unlock()
+
+		for idx, watch := range s.watches {
+			if watch.Id == args.WatchId {
+				s.watches = append(s.watches[:idx], s.watches[idx+1:]...)
+				return watch, nil
+			}
+		}
+		return nil, errors.New("No such watch: " + strconv.Itoa(args.WatchId))
+	case "watches":
+		return s.evalWatches(), nil
+	case "expand":
+		return s.expand(scope, args)
+	case "checkpoint":
+		return call("Checkpoint", map[string]interface{}{"Where": args.Where}, "")
+	case "listCheckpoints":
+		return call("ListCheckpoints", map[string]interface{}{}, "Checkpoints")
+	case "clearCheckpoint":
+		return call("ClearCheckpoint", map[string]interface{}{"ID": args.CheckpointId}, "")
+	case "restoreCheckpoint":
+		// Replays the recording up to the checkpoint, the breakpoints stay
+		_, err := call("Restart", map[string]interface{}{"Position": "c" + strconv.Itoa(args.CheckpointId)}, "")
+		if err != nil {
+			return nil, err
+		}
+		return call("State", map[string]interface{}{"NonBlocking": true}, "State")
+	case "memory":
+		return s.memory(scope, args)
+	case "disassemble":
+		return s.disassemble(scope, args)
+	}
+
+	return nil, errors.New("Unknown command " + request.Command)
+}
+
+func (s *DebugSession) evalWatch(watch DebugWatch) DebugWatchValue {
+	// The current goroutine is -1 for Delve
+	scope := map[string]interface{}{"GoroutineID": -1, "Frame": 0}
+	if watch.Pinned {
+		scope = map[string]interface{}{"GoroutineID": watch.GoroutineId, "Frame": watch.Frame}
+	}
+
+	out := map[string]interface{}{}
+	err := s.client.Call("RPCServer.Eval", map[string]interface{}{"Scope": scope, "Expr": watch.Expr, "Cfg": dlvWatchLoadConfig}, &out)
+	if err != nil {
+		// Variables go in and out of scope as the program runs
+		return DebugWatchValue{DebugWatch: watch, Error: err.Error()}
+	}
+
+	return DebugWatchValue{DebugWatch: watch, Value: debugLocations(out["Variable"])}
+}
+
+func (s *DebugSession) evalWatches() []DebugWatchValue {
+	s.watchMutex.Lock()
+	watches := append([]DebugWatch{}, s.watches...)
+	s.watchMutex.Unlock()
+
+	values := []DebugWatchValue{}
+	for _, watch := range watches {
+		values = append(values, s.evalWatch(watch))
+	}
+
+	return values
+}
+
+// Loads Count elements of a slice, array or map from Start, Delve can slice
+// all of them
+func (s *DebugSession) expand(scope map[string]interface{}, args debugArgs) (interface{}, error) {
+	count := args.Count
+	if count <= 0 || count > 1000 {
+		count = 64
+	}
+	if args.Start < 0 {
+		return nil, errors.New("Invalid start: " + strconv.Itoa(args.Start))
+	}
+
+	// The length without loading anything
+	whole := map[string]interface{}{}
+	cfg := map[string]interface{}{"MaxVariableRecurse": 0, "MaxArrayValues": 0, "MaxStructFields": 0}
+	err := s.client.Call("RPCServer.Eval", map[string]interface{}{"Scope": scope, "Expr": args.Expr, "Cfg": cfg}, &whole)
+	if err != nil {
+		return nil, err
+	}
+	variable, _ := whole["Variable"].(map[string]interface{})
+	length, _ := variable["len"].(float64)
+
+	page := map[string]interface{}{}
+	cfg = map[string]interface{}{}
+	for key, value := range dlvLoadConfig {
+		cfg[key] = value
+	}
+	cfg["MaxArrayValues"] = count
+	end := int64(args.Start + count)
+	if end > int64(length) {
+		end = int64(length)
+	}
+	if int64(args.Start) > end {
+		return nil, errors.New("The start is past the end")
+	}
+	expr := "(" + args.Expr + ")[" + strconv.Itoa(args.Start) + ":" + strconv.FormatInt(end, 10) + "]"
+	err = s.client.Call("RPCServer.Eval", map[string]interface{}{"Scope": scope, "Expr": expr, "Cfg": cfg}, &page)
+	if err != nil {
+		return nil, err
+	}
+	variable, _ = page["Variable"].(map[string]interface{})
+
+	return DebugPage{Expr: args.Expr, Start: args.Start, Len: int64(length), Children: debugLocations(variable["children"])}, nil
+}
+
+// The address of the arguments, a number or the address of the variable of
+// an expression
+func (s *DebugSession) address(scope map[string]interface{}, address string) (uint64, error) {
+	if n, err := strconv.ParseUint(address, 0, 64); err == nil {
+		return n, nil
+	}
+
+	out := map[string]interface{}{}
+	cfg := map[string]interface{}{"MaxVariableRecurse": 0, "MaxArrayValues": 0, "MaxStructFields": 0}
+	err := s.client.Call("RPCServer.Eval", map[string]interface{}{"Scope": scope, "Expr": address, "Cfg": cfg}, &out)
+	if err != nil {
+		return 0, err
+	}
+	variable, _ := out["Variable"].(map[string]interface{})
+	addr, _ := variable["addr"].(float64)
+	if addr == 0 {
+		return 0, errors.New("The expression has no address: " + address)
+	}
+
+	return uint64(addr), nil
+}
+
+func (s *DebugSession) memory(scope map[string]interface{}, args debugArgs) (interface{}, error) {
+	address, err := s.address(scope, args.Address)
+	if err != nil {
+		return nil, err
+	}
+	// Delve reads at most 1000 bytes at a time
+	length := args.Length
+	if length <= 0 || length > 1000 {
+		length = 256
+	}
+
+	out := struct {
+		Mem            []byte
+		IsLittleEndian bool
+	}{}
+	err = s.client.Call("RPCServer.ExamineMemory", map[string]interface{}{"Address": address, "Length": length}, &out)
+	if err != nil {
+		return nil, err
+	}
+
+	memory := DebugMemory{Address: "0x" + strconv.FormatUint(address, 16), Bytes: hex.EncodeToString(out.Mem), LittleEndian: out.IsLittleEndian, Dump: []string{}}
+	for offset := 0; offset < len(out.Mem); offset += 16 {
+		line := out.Mem[offset:]
+		if len(line) > 16 {
+			line = line[:16]
+		}
+
+		text := []byte{}
+		for _, b := range line {
+			if b < 32 || b > 126 {
+				b = '.'
+			}
+			text = append(text, b)
+		}
+		memory.Dump = append(memory.Dump, fmt.Sprintf("%#016x  %-47s  |%s|", address+uint64(offset), fmt.Sprintf("% x", line), text))
+	}
+
+	return memory, nil
+}
+
+// The PC of the frame of the scope
+func (s *DebugSession) framePc(scope map[string]interface{}) (uint64, error) {
+	goroutineId, _ := scope["GoroutineID"].(int64)
+	frame, _ := scope["Frame"].(int)
+
+	if goroutineId < 0 {
+		state := struct {
+			SelectedGoroutine *struct {
+				Id int64 `json:"id"`
+			} `json:"currentGoroutine"`
+		}{}
+		err := s.client.Call("RPCServer.State", map[string]interface{}{"NonBlocking": true}, &struct {
+			State interface{}
+		}{&state})
+		if err != nil {
+			return 0, err
+		}
+		if state.SelectedGoroutine == nil {
+			return 0, errors.New("The program is not stopped")
+		}
+		goroutineId = state.SelectedGoroutine.Id
+	}
+
+	out := struct {
+		Locations []struct {
+			Pc uint64 `json:"pc"`
+		}
+	}{}
+	err := s.client.Call("RPCServer.Stacktrace", map[string]interface{}{"Id": goroutineId, "Depth": frame + 1}, &out)
+	if err != nil {
+		return 0, err
+	}
+	if frame >= len(out.Locations) {
+		return 0, errors.New("No such frame: " + strconv.Itoa(frame))
+	}
+
+	return out.Locations[frame].Pc, nil
+}
+
+// Disassembles the function of the PC of the frame, or of the address, and
+// keeps Count instructions on each side of it
+func (s *DebugSession) disassemble(scope map[string]interface{}, args debugArgs) (interface{}, error) {
+	var pc uint64
+	var err error
+	if args.Address != "" {
+		pc, err = strconv.ParseUint(args.Address, 0, 64)
+	} else {
+		pc, err = s.framePc(scope)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	flavour := map[string]int{"intel": 0, "gnu": 1, "go": 2}[args.Flavour]
+	if args.Flavour == "" {
+		flavour = 2
+	}
+
+	out := struct {
+		Disassemble []struct {
+			Loc struct {
+				Pc       uint64 `json:"pc"`
+				File     string `json:"file"`
+				Line     int    `json:"line"`
+				Function *struct {
+					Name string `json:"name"`
+				} `json:"function"`
+			}
+			Text       string
+			Bytes      []byte
+			Breakpoint bool
+			AtPC       bool
+		}
+	}{}
+	err = s.client.Call("RPCServer.Disassemble", map[string]interface{}{"Scope": scope, "StartPC": pc, "EndPC": 0, "Flavour": flavour}, &out)
+	if err != nil {
+		return nil, err
+	}
+
+	instructions := out.Disassemble
+	at := 0
+	for idx, instruction := range instructions {
+		if instruction.Loc.Pc == pc {
+			at = idx
+		}
+	}
+	count := args.Count
+	if count <= 0 {
+		count = 20
+	}
+	if at+count+1 < len(instructions) {
+		instructions = instructions[:at+count+1]
+	}
+	if at > count {
+		instructions = instructions[at-count:]
+	}
+
+	result := DebugDisassembly{Pc: "0x" + strconv.FormatUint(pc, 16), Lines: []DebugAsmLine{}}
+	sources := make(map[string][]string)
+	for _, instruction := range instructions {
+		if instruction.Loc.Function != nil && result.Function == "" {
+			result.Function = instruction.Loc.Function.Name
+		}
+
+		location := workspaceLocation(instruction.Loc.File)
+		if len(result.Lines) == 0 || result.Lines[len(result.Lines)-1].Line != instruction.Loc.Line ||
+			result.Lines[len(result.Lines)-1].Location != location {
+
+			// The source of the line, from the file on disk
+			lines, ok := sources[instruction.Loc.File]
+			if !ok {
+				b, _ := ioutil.ReadFile(instruction.Loc.File)
+				lines = strings.Split(string(b), "\n")
+				sources[instruction.Loc.File] = lines
+			}
+			source := ""
+			if instruction.Loc.Line > 0 && instruction.Loc.Line <= len(lines) {
+				source = strings.TrimRight(lines[instruction.Loc.Line-1], "\r")
+			}
+
+			result.Lines = append(result.Lines, DebugAsmLine{Location: location, Line: instruction.Loc.Line, Source: source, Instructions: []DebugInstruction{}})
+		}
+
+		line := &result.Lines[len(result.Lines)-1]
+		line.Instructions = append(line.Instructions, DebugInstruction{"0x" + strconv.FormatUint(instruction.Loc.Pc, 16),
+			instruction.Text, hex.EncodeToString(instruction.Bytes), instruction.AtPC, instruction.Breakpoint})
+	}
+
+	return result, nil
+}
+
+// Location on disk of a file of the workspace, e.g. /file/x/main.go
+func debugFilePath(srcDirs []string, location string) (string, error) {
+	segs := strings.Split(strings.TrimPrefix(location, "/"), "/")
+	if len(segs) < 2 || segs[0] != "file" {
+		return location, nil
+	}
+
+	return bufferPath(srcDirs, append([]string{"debug", "breakpoint"}, segs...))
+}
+
+// Replaces the paths on disk in a result of Delve with workspace locations
+func debugLocations(v interface{}) interface{} {
+	switch x := v.(type) {
+	case map[string]interface{}:
+		for key, value := range x {
+			if file, ok := value.(string); ok && key == "file" {
+				if location := workspaceLocation(file); location != "" {
+					x[key] = location
+				}
+				continue
+			}
+			x[key] = debugLocations(value)
+		}
+	case []interface{}:
+		for idx, value := range x {
+			x[idx] = debugLocations(value)
+		}
+	}
+
+	return v
+}
+
+// The /file location of a file on disk, or nothing if it is outside of
+// the GOPATH and GOROOT
+func workspaceLocation(file string) string {
+	file = filepath.Clean(file)
+
+	for _, srcDir := range srcDirs {
+		if strings.HasPrefix(file, srcDir+string(filepath.Separator)) {
+			return filepath.ToSlash(filepath.Join("/file", file[len(srcDir):]))
+		}
+	}
+
+	if strings.HasPrefix(file, goroot) {
+		return filepath.ToSlash(filepath.Join("/file/GOROOT", file[len(goroot):]))
+	}
+
+	return ""
+}
@@ -79,16 +79,25 @@ func docHandler(writer http.ResponseWriter, req *http.Request, path string, path
 
 			gorootsrc := filepath.Join(goroot, "/src/pkg")
 
-			for _, srcDir := range append(srcDirs, gorootsrc) {
-				info, err := os.Stat(filepath.Join(srcDir, pkgName))
+			for _, srcDir := range append(requestSrcDirs(req), gorootsrc) {
+				info, err := os.Stat(filepath.Join(srcDir, filepath.Clean("/"+pkgName)))
 				if err == nil && info.IsDir() {
-					http.Redirect(writer, req, "/godoc/pkg/"+pkgName, 302)
+					http.Redirect(writer, req, requestPrefix(req)+"/godoc/pkg/"+pkgName, 302)
 					return true
 				}
 			}
 		}
 
-		resp, err := http.Get("http://127.0.0.1:6060" + delegatePath + "?" + queryParam)
+		ctx, cancel := operationContext(req, *toolTimeout)
+		defer cancel()
+
+		godocReq, err := http.NewRequestWithContext(ctx, "GET", "http://127.0.0.1:6060"+delegatePath+"?"+queryParam, nil)
+		if err != nil {
+			ShowError(writer, 500, "Error connecting to godoc server", err)
+			return true
+		}
+
+		resp, err := http.DefaultClient.Do(godocReq)
 		if err != nil {
 			ShowError(writer, 500, "Error connecting to godoc server", err)
 			return true
@@ -135,8 +144,8 @@ func docHandler(writer http.ResponseWriter, req *http.Request, path string, path
 
 		gorootsrc := filepath.Join(goroot, "/src/pkg")
 
-		for _, srcDir := range append(srcDirs, gorootsrc) {
-			potentialMatch := filepath.Join(srcDir, filepath.Join(pathSegs[3:]...))
+		for _, srcDir := range append(requestSrcDirs(req), gorootsrc) {
+			potentialMatch := filepath.Join(srcDir, filepath.Clean("/"+filepath.Join(pathSegs[3:]...)))
 
 			if _, err := os.Stat(potentialMatch); err == nil {
 				file, err := os.Open(potentialMatch)
@@ -181,7 +190,7 @@ func docHandler(writer http.ResponseWriter, req *http.Request, path string, path
 			redirectLocation = redirectLocation + ",line=" + lineNumber
 		}
 
-		http.Redirect(writer, req, "/edit/edit.html#"+redirectLocation, 302)
+		http.Redirect(writer, req, requestPrefix(req)+"/edit/edit.html#"+redirectLocation, 302)
 		return true
 
 	// Get the textual godoc for a package and optional name
@@ -194,7 +203,10 @@ func docHandler(writer http.ResponseWriter, req *http.Request, path string, path
 			return true
 		}
 
-		cmd := exec.Command("godoc", pkg, name)
+		ctx, cancel := operationContext(req, *toolTimeout)
+		defer cancel()
+
+		cmd := exec.CommandContext(ctx, "godoc", pkg, name)
 		output, err := cmd.Output()
 		if err != nil {
 			ShowError(writer, 500, "Error invoking godoc tool", err)
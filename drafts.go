@@ -0,0 +1,175 @@
+// Copyright 2014 Chris McGee <sirnewton_01@yahoo.ca>. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"crypto/sha1"
+	"encoding/hex"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+const (
+	maxDraftSize = 10 * 1024 * 1024
+)
+
+type DraftInfo struct {
+	Location string
+	Saved    int64
+	Size     int64
+	// Time stamp of the file on disk when the draft was taken
+	FileTimeStamp int64
+	// The file has changed on disk since the draft was taken
+	Stale bool
+}
+
+func draftFile(user string, location string) string {
+	hash := sha1.Sum([]byte(location))
+	return filepath.Join(userDataDir(user), "drafts", hex.EncodeToString(hash[:]))
+}
+
+func draftDiskTimeStamp(srcDirs []string, location string) int64 {
+	relPath := strings.TrimPrefix(location, "/file")
+
+	for _, srcDir := range srcDirs {
+		info, err := os.Stat(filepath.Join(srcDir, relPath))
+		if err == nil {
+			return info.ModTime().Unix() * 1000
+		}
+	}
+
+	return 0
+}
+
+// Throws away the draft of a file, typically because it was just saved
+func discardDraft(user string, location string) {
+	userDataMutex.Lock()
+	defer userDataMutex.Unlock()
+
+	drafts := make(map[string]DraftInfo)
+	err := loadUserData(user, "drafts", &drafts)
+	if err != nil {
+		return
+	}
+
+	if _, ok := drafts[location]; !ok {
+		return
+	}
+
+	delete(drafts, location)
+	os.Remove(draftFile(user, location))
+	saveUserData(user, "drafts", drafts)
+}
+
+func draftsHandler(writer http.ResponseWriter, req *http.Request, path string, pathSegs []string) bool {
+	user := requestUser(req)
+	location := ""
+	if len(pathSegs) > 2 && pathSegs[1] == "file" {
+		location = "/" + strings.Join(pathSegs[1:], "/")
+	}
+
+	userDataMutex.Lock()
+	defer userDataMutex.Unlock()
+
+	drafts := make(map[string]DraftInfo)
+	err := loadUserData(user, "drafts", &drafts)
+	if err != nil {
+		ShowError(writer, 500, "Unable to load drafts", err)
+		return true
+	}
+
+	switch {
+	case req.Method == "GET" && len(pathSegs) == 1:
+		result := []DraftInfo{}
+
+		for _, draft := range drafts {
+			draft.Stale = draftDiskTimeStamp(requestSrcDirs(req), draft.Location) > draft.FileTimeStamp
+			result = append(result, draft)
+		}
+
+		ShowJson(writer, 200, result)
+		return true
+	case req.Method == "GET" && location != "":
+		if _, ok := drafts[location]; !ok {
+			ShowError(writer, 404, "No draft for "+location, nil)
+			return true
+		}
+
+		file, err := os.Open(draftFile(user, location))
+		if err != nil {
+			ShowError(writer, 500, "Unable to open draft", err)
+			return true
+		}
+		defer file.Close()
+
+		writer.WriteHeader(200)
+		io.Copy(writer, file)
+		return true
+	case req.Method == "PUT" && location != "":
+		fileName := draftFile(user, location)
+		err := os.MkdirAll(filepath.Dir(fileName), 0700)
+		if err != nil {
+			ShowError(writer, 500, "Unable to create drafts directory", err)
+			return true
+		}
+
+		content, err := ioutil.ReadAll(io.LimitReader(req.Body, maxDraftSize+1))
+		if err != nil {
+			ShowError(writer, 500, "Unable to read draft", err)
+			return true
+		}
+		if len(content) > maxDraftSize {
+			ShowError(writer, 413, "Draft is too large", nil)
+			return true
+		}
+
+		// Write a new copy before replacing the old one so that a crash
+		//  in the middle still leaves the previous draft intact.
+		err = ioutil.WriteFile(fileName+".tmp", content, 0600)
+		if err == nil {
+			err = os.Rename(fileName+".tmp", fileName)
+		}
+		if err != nil {
+			ShowError(writer, 500, "Unable to save draft", err)
+			return true
+		}
+
+		draft, exists := drafts[location]
+		if !exists {
+			draft = DraftInfo{Location: location, FileTimeStamp: draftDiskTimeStamp(requestSrcDirs(req), location)}
+		}
+		draft.Saved = time.Now().Unix() * 1000
+		draft.Size = int64(len(content))
+		drafts[location] = draft
+
+		err = saveUserData(user, "drafts", drafts)
+		if err != nil {
+			ShowError(writer, 500, "Unable to save drafts", err)
+			return true
+		}
+
+		writer.WriteHeader(204)
+		return true
+	case req.Method == "DELETE" && location != "":
+		delete(drafts, location)
+		os.Remove(draftFile(user, location))
+
+		err = saveUserData(user, "drafts", drafts)
+		if err != nil {
+			ShowError(writer, 500, "Unable to save drafts", err)
+			return true
+		}
+
+		writer.WriteHeader(204)
+		return true
+	}
+
+	return false
+}
@@ -0,0 +1,153 @@
+// Copyright 2014 Chris McGee <sirnewton_01@yahoo.ca>. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"go/build"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"regexp"
+	"runtime"
+	"strings"
+	"sync"
+)
+
+// What godev sees of its environment, for answering why a package or a
+// tool can't be found.
+type EnvReport struct {
+	Goroot  string
+	Gopath  []string
+	SrcDirs []string
+	// GO111MODULE of the go tool, default is on since go 1.16
+	ModuleMode string
+	GoEnv      map[string]string
+	Tools      []ToolInfo
+	System     SystemInfo
+	// Values of variables with sensitive looking names are redacted
+	Variables map[string]string
+}
+
+type ToolInfo struct {
+	Name    string
+	Path    string `json:",omitempty"`
+	Version string `json:",omitempty"`
+	Error   string `json:",omitempty"`
+}
+
+type SystemInfo struct {
+	OS        string
+	Arch      string
+	CPUs      int
+	Hostname  string
+	GoVersion string
+	WorkDir   string
+	DataDir   string
+}
+
+var (
+	// Tools that godev runs and how to ask them for their version, those
+	//  without a version flag are only looked up
+	envTools = []struct {
+		name string
+		args []string
+	}{
+		{"go", []string{"version"}},
+		{"git", []string{"--version"}},
+		{"hg", []string{"--version", "--quiet"}},
+		{"gocode", nil},
+		{"godef", nil},
+		{"gorename", nil},
+		{"guru", nil},
+		{"goimports", nil},
+		{"godoc", nil},
+		{"godbg", nil},
+		{"dlv", []string{"version"}},
+	}
+
+	sensitiveVariable = regexp.MustCompile(`(?i)secret|token|passw|key|credential|auth|cookie|session|magic|private`)
+)
+
+const redacted = "[redacted]"
+
+func envReport(ctx context.Context) EnvReport {
+	report := EnvReport{
+		Goroot:    goroot,
+		Gopath:    filepath.SplitList(build.Default.GOPATH),
+		SrcDirs:   srcDirs,
+		GoEnv:     map[string]string{},
+		Variables: map[string]string{},
+	}
+
+	wd, _ := os.Getwd()
+	hostname, _ := os.Hostname()
+	report.System = SystemInfo{runtime.GOOS, runtime.GOARCH, runtime.NumCPU(), hostname, runtime.Version(), wd, godevDataDir()}
+
+	for _, v := range os.Environ() {
+		pair := strings.SplitN(v, "=", 2)
+		if len(pair) != 2 {
+			continue
+		}
+		if sensitiveVariable.MatchString(pair[0]) {
+			pair[1] = redacted
+		}
+		report.Variables[pair[0]] = pair[1]
+	}
+
+	// Settings from the go env file don't show up in the environment
+	if out, err := exec.CommandContext(ctx, "go", "env", "-json").Output(); err == nil {
+		json.Unmarshal(out, &report.GoEnv)
+		for name := range report.GoEnv {
+			if sensitiveVariable.MatchString(name) {
+				report.GoEnv[name] = redacted
+			}
+		}
+	}
+
+	report.ModuleMode = report.GoEnv["GO111MODULE"]
+	if report.ModuleMode == "" {
+		report.ModuleMode = "default"
+	}
+
+	report.Tools = make([]ToolInfo, len(envTools))
+	wg := sync.WaitGroup{}
+	for idx, tool := range envTools {
+		wg.Add(1)
+		go func(idx int, name string, args []string) {
+			defer wg.Done()
+			report.Tools[idx] = toolInfo(ctx, name, args)
+		}(idx, tool.name, tool.args)
+	}
+	wg.Wait()
+
+	return report
+}
+
+func toolInfo(ctx context.Context, name string, args []string) ToolInfo {
+	info := ToolInfo{Name: name}
+
+	p, err := exec.LookPath(name)
+	if err != nil {
+		info.Error = err.Error()
+		return info
+	}
+	info.Path = p
+
+	if args == nil {
+		return info
+	}
+
+	out, err := exec.CommandContext(ctx, p, args...).CombinedOutput()
+	if err != nil {
+		info.Error = err.Error()
+	}
+	if lines := strings.SplitN(strings.TrimSpace(string(out)), "\n", 2); lines[0] != "" {
+		info.Version = lines[0]
+	}
+
+	return info
+}
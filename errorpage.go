@@ -0,0 +1,135 @@
+// Copyright 2014 Chris McGee <sirnewton_01@yahoo.ca>. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"html/template"
+	"io/ioutil"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+// Response writer that remembers its request so that error responses can
+// be negotiated with the client.
+type requestWriter struct {
+	http.ResponseWriter
+	req *http.Request
+}
+
+func (w requestWriter) Flush() {
+	if flusher, ok := w.ResponseWriter.(http.Flusher); ok {
+		flusher.Flush()
+	}
+}
+
+func (w requestWriter) Unwrap() http.ResponseWriter {
+	return w.ResponseWriter
+}
+
+type ErrorPage struct {
+	Code    uint
+	Title   string
+	Message string
+	Detail  string
+	// Path prefix when godev is served from behind a reverse proxy
+	Prefix string
+}
+
+// Browsers navigating to a page want HTML, API clients get the JSON status
+func wantsHtml(req *http.Request) bool {
+	return strings.Contains(req.Header.Get("Accept"), "text/html") &&
+		req.Header.Get("X-Requested-With") != "XMLHttpRequest"
+}
+
+// Path prefix of the proxy, or the base path of the prefix flag
+func requestPrefix(req *http.Request) string {
+	if prefix := forwardedHeader(req, "X-Forwarded-Prefix"); prefix != "" {
+		return strings.TrimRight(prefix, "/")
+	}
+
+	return routePrefix()
+}
+
+// Error pages come from the bundles as godev/error-<code>.html or
+// godev/error.html, with plugins taking precedence over the core bundles.
+func errorPageTemplate(code uint) *template.Template {
+	if handlers != nil {
+		for _, name := range []string{"/godev/error-" + strconv.Itoa(int(code)) + ".html", "/godev/error.html"} {
+			file, err := handlers.fs.OpenLast(name)
+			if err != nil {
+				continue
+			}
+
+			b, err := ioutil.ReadAll(file)
+			file.Close()
+			if err != nil {
+				continue
+			}
+
+			tmpl, err := template.New(name).Parse(string(b))
+			if err != nil {
+				logger.Printf("Invalid error page %v: %v\n", name, err)
+				continue
+			}
+
+			return tmpl
+		}
+	}
+
+	return defaultErrorPage
+}
+
+func showErrorPage(writer http.ResponseWriter, req *http.Request, httpCode uint, message string, detail string) {
+	page := ErrorPage{Code: httpCode, Title: http.StatusText(int(httpCode)), Message: message,
+		Detail: detail, Prefix: requestPrefix(req)}
+
+	writer.Header().Set("Content-Type", "text/html; charset=utf-8")
+	writer.WriteHeader(int(httpCode))
+
+	err := errorPageTemplate(httpCode).Execute(writer, page)
+	if err != nil {
+		logger.Printf("Unable to render the error page: %v\n", err)
+	}
+}
+
+// Replaces the plain text not found responses of the file server with the
+// error page for browsers.
+type notFoundWriter struct {
+	http.ResponseWriter
+	req      *http.Request
+	notFound bool
+}
+
+func (w *notFoundWriter) WriteHeader(code int) {
+	if code == 404 {
+		w.notFound = true
+		showErrorPage(w.ResponseWriter, w.req, 404, "There is nothing at "+w.req.URL.Path, "")
+		return
+	}
+
+	w.ResponseWriter.WriteHeader(code)
+}
+
+func (w *notFoundWriter) Write(b []byte) (int, error) {
+	if w.notFound {
+		return len(b), nil
+	}
+
+	return w.ResponseWriter.Write(b)
+}
+
+// Used when none of the bundles has an error page
+var defaultErrorPage = template.Must(template.New("error").Parse(`<!DOCTYPE html>
+<html>
+<head><title>{{.Code}} {{.Title}} - godev</title></head>
+<body>
+<h1>{{.Code}} {{.Title}}</h1>
+<p>{{.Message}}</p>
+{{if .Detail}}<pre>{{.Detail}}</pre>{{end}}
+<p><a href="{{.Prefix}}/">Back to godev</a></p>
+</body>
+</html>
+`))
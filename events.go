@@ -0,0 +1,102 @@
+// Copyright 2014 Chris McGee <sirnewton_01@yahoo.ca>. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"encoding/json"
+	"sync"
+
+	"code.google.com/p/go.net/websocket"
+)
+
+// Notification pushed to the connected browsers. Events without a user
+// are broadcast to everyone.
+type Event struct {
+	Type string
+	User string `json:",omitempty"`
+	Data interface{}
+}
+
+var (
+	eventsMutex      sync.Mutex
+	eventSubscribers = make(map[chan Event]string)
+)
+
+func subscribeEvents(user string) chan Event {
+	// Buffer a few events so that a slow browser doesn't hold up the publisher
+	c := make(chan Event, 32)
+
+	eventsMutex.Lock()
+	eventSubscribers[c] = user
+	eventsMutex.Unlock()
+
+	return c
+}
+
+func unsubscribeEvents(c chan Event) {
+	eventsMutex.Lock()
+	delete(eventSubscribers, c)
+	eventsMutex.Unlock()
+}
+
+// Publishes the event, returning the number of browsers that got it
+func publishEvent(e Event) int {
+	eventsMutex.Lock()
+	defer eventsMutex.Unlock()
+
+	delivered := 0
+	for c, user := range eventSubscribers {
+		if e.User != "" && e.User != user {
+			continue
+		}
+
+		select {
+		case c <- e:
+			delivered++
+		default:
+			logger.Printf("EVENT DROPPED FOR %v: %v\n", user, e.Type)
+		}
+	}
+
+	return delivered
+}
+
+func eventsSocket(ws *websocket.Conn) {
+	c := subscribeEvents(requestUser(ws.Request()))
+	defer unsubscribeEvents(c)
+
+	// The browser doesn't send anything on this socket, reading only
+	//  serves to find out when it goes away.
+	closed := make(chan bool)
+	go func() {
+		buf := make([]byte, 1024, 1024)
+		for {
+			_, err := ws.Read(buf)
+			if err != nil {
+				break
+			}
+		}
+		closed <- true
+	}()
+
+	for {
+		select {
+		case e := <-c:
+			output, err := json.Marshal(e)
+			if err != nil {
+				continue
+			}
+
+			_, err = ws.Write(output)
+			if err != nil {
+				ws.Close()
+				return
+			}
+		case <-closed:
+			ws.Close()
+			return
+		}
+	}
+}
@@ -0,0 +1,302 @@
+// Copyright 2014 Chris McGee <sirnewton_01@yahoo.ca>. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"path/filepath"
+	"regexp"
+)
+
+// Explanation of the compile errors and go vet findings whose message
+// matches the pattern. The named groups of the pattern can be used in the
+// texts, e.g. ${name}. Bundles add their own rules with an explain.json
+// next to their bundle.html:
+//
+//	{"Rules": [{
+//		"Id": "myorg-ctx-first",
+//		"Pattern": "context.Context should be the first parameter",
+//		"Title": "Context goes first",
+//		"Explanation": "..."
+//	}]}
+type ExplainRule struct {
+	Id      string
+	Pattern string `json:",omitempty"`
+	// Analyzer of the go vet findings of the rule, compile errors have none
+	Code        string `json:",omitempty"`
+	Title       string
+	Explanation string
+	Fix         string `json:",omitempty"`
+	Example     string `json:",omitempty"`
+	Link        string `json:",omitempty"`
+	// Bundle of the rule, empty for the rules of godev
+	Bundle string `json:",omitempty"`
+}
+
+type ExplainConfig struct {
+	Rules []ExplainRule
+}
+
+var builtinExplainRules = []ExplainRule{
+	{
+		Id:          "unused-variable",
+		Pattern:     `declared (?:and|but) not used`,
+		Title:       "Unused variable",
+		Explanation: "Go refuses to compile a function that declares a local variable and never reads it. An unused variable is usually a mistake, such as a result that was meant to be checked.",
+		Fix:         "Use the variable, remove it, or assign the value to the blank identifier _ if it really isn't needed.",
+		Example:     "n, err := f.Read(buf)\nif err != nil {\n\treturn err\n}\nfmt.Println(n)",
+	},
+	{
+		Id:          "unused-import",
+		Pattern:     `"(?P<path>[^"]+)" imported (?:and|but) not used`,
+		Title:       "Unused import",
+		Explanation: "The package ${path} is imported but nothing in the file refers to it. Imports are per file in Go and every import has to be used.",
+		Fix:         "Remove the import, the Imports command (Ctrl-I) does it for you. An import that is only needed for its side effects is written as _ \"${path}\".",
+	},
+	{
+		Id:          "undefined",
+		Pattern:     `undefined: (?P<name>[\w.]+)`,
+		Title:       "Undefined name",
+		Explanation: "Nothing called ${name} is declared where it is used. It could be misspelled, declared in an inner scope such as an if or for block, unexported in another package, or in a package that isn't imported.",
+		Fix:         "Check the spelling and the scope of the declaration. Names of other packages are written as package.Name and need an import, the Imports command (Ctrl-I) adds it.",
+	},
+	{
+		Id:          "missing-return",
+		Pattern:     `missing return`,
+		Title:       "Missing return",
+		Explanation: "A function with results has to end in a return statement (or a panic, or an endless for loop). The compiler doesn't work out that an if/else or switch covers every case.",
+		Fix:         "Add a return statement at the end of the function, or make the last if/else return in both branches.",
+		Example:     "func sign(n int) int {\n\tif n < 0 {\n\t\treturn -1\n\t}\n\treturn 1\n}",
+	},
+	{
+		Id:          "no-new-variables",
+		Pattern:     `no new variables on left side of :=`,
+		Title:       "Nothing new to declare",
+		Explanation: "The short variable declaration := declares at least one new variable. All of the variables on the left are already declared in this scope.",
+		Fix:         "Use = to assign to the existing variables.",
+	},
+	{
+		Id:          "redeclared",
+		Pattern:     `(?P<name>\w+) redeclared in this block`,
+		Title:       "Declared twice",
+		Explanation: "${name} is declared twice in the same scope. For package level names the other declaration can be in any file of the package, the related location of the error shows where.",
+		Fix:         "Rename one of them, or use = instead of := or var to assign to the existing variable.",
+	},
+	{
+		Id:          "assignment-mismatch",
+		Pattern:     `assignment mismatch: (?P<left>\d+) variables? but (?P<right>.+)`,
+		Title:       "Assignment mismatch",
+		Explanation: "The assignment has ${left} variable(s) on the left but ${right}. Functions that return several values have to be assigned to as many variables.",
+		Fix:         "Add variables for the other results, using _ for those that aren't needed, e.g. value, _ := m[key] or n, err := f().",
+	},
+	{
+		Id:          "map-field-assign",
+		Pattern:     `cannot assign to struct field (?P<field>.+) in map`,
+		Title:       "Assigning to a field of a map element",
+		Explanation: "The elements of a map are not addressable, so the field ${field} of an element can't be assigned to directly.",
+		Fix:         "Copy the element, change the copy and store it back, or make the map hold pointers to the structs.",
+		Example:     "p := people[name]\np.Age++\npeople[name] = p",
+	},
+	{
+		Id:          "cannot-use",
+		Pattern:     `cannot use .+ as (?P<want>.+?) value in (?P<context>.+)`,
+		Title:       "Wrong type",
+		Explanation: "The value has a different type than the ${want} needed in the ${context}. Go doesn't convert between types implicitly, not even between int and int64 or between a named type and its underlying type.",
+		Fix:         "Convert the value explicitly, e.g. int64(n) or string(b), or change the type of the variable, parameter or field.",
+	},
+	{
+		Id:          "does-not-implement",
+		Pattern:     `(?P<type>\S+) does not implement (?P<iface>\S+)`,
+		Title:       "Interface not implemented",
+		Explanation: "${type} doesn't have all of the methods of ${iface}, the message says which one is missing or wrong. A common cause is that the methods have a pointer receiver, then only the pointer type implements the interface.",
+		Fix:         "Add the missing method with the exact signature, or use a pointer (&value) when the methods have pointer receivers.",
+	},
+	{
+		Id:          "mismatched-types",
+		Pattern:     `invalid operation: .*\(mismatched types (?P<a>\S+) and (?P<b>[^)]+)\)`,
+		Title:       "Mismatched types",
+		Explanation: "Both operands of a binary operator need the same type, here they are ${a} and ${b}.",
+		Fix:         "Convert one of the operands, e.g. float64(n) * ratio.",
+	},
+	{
+		Id:          "argument-count",
+		Pattern:     `(?P<which>not enough|too many) arguments in call to (?P<func>\S+)`,
+		Title:       "Wrong number of arguments",
+		Explanation: "The call of ${func} has ${which} arguments for its parameters. The error lists what the call has and what the function wants.",
+		Fix:         "Pass one argument for each parameter. Variadic parameters take a slice with slice... .",
+	},
+	{
+		Id:          "unexported",
+		Pattern:     `not exported by package (?P<pkg>\S+)|cannot refer to unexported (?:name|field|method) (?P<name>\S+)`,
+		Title:       "Unexported name",
+		Explanation: "Only names that start with an upper case letter can be used outside of the package that declares them.",
+		Fix:         "Use an exported name of the package, or export the name if the package is yours.",
+	},
+	{
+		Id:          "import-cycle",
+		Pattern:     `import cycle not allowed`,
+		Title:       "Import cycle",
+		Explanation: "Packages import each other, directly or through other packages. Go needs the imports to form a tree.",
+		Fix:         "Move what both packages need into a third package, or have one of them take an interface instead of importing the other.",
+	},
+	{
+		Id:          "outside-function",
+		Pattern:     `non-declaration statement outside function body`,
+		Title:       "Statement outside of a function",
+		Explanation: "At the package level there can only be declarations (var, const, type, func and import). Short variable declarations with := and other statements only work inside functions.",
+		Fix:         "Use var name = value at the package level, or move the statement into a function such as init.",
+	},
+	{
+		Id:          "unused-value",
+		Pattern:     `is not used$`,
+		Title:       "Value not used",
+		Explanation: "The expression is evaluated and its value thrown away, which does nothing and is probably not what was meant.",
+		Fix:         "Assign the value, e.g. n = n + 1, or remove the statement.",
+	},
+	{
+		Id:          "non-boolean-condition",
+		Pattern:     `non-boolean condition in (?P<stmt>\w+) statement`,
+		Title:       "Condition is not a bool",
+		Explanation: "The condition of the ${stmt} statement has to be a bool, Go doesn't treat numbers, pointers or strings as true or false.",
+		Fix:         "Compare explicitly, e.g. if n != 0 or if p != nil.",
+	},
+	{
+		Id:          "loop-closure",
+		Code:        "loopclosure",
+		Pattern:     `loop variable (?P<name>\w+) captured by func literal`,
+		Title:       "Loop variable in a goroutine or deferred function",
+		Explanation: "Before Go 1.22 there is one ${name} for the whole loop, so a function literal that runs later sees the value of the last iteration.",
+		Fix:         "Pass ${name} to the function as an argument, or copy it first with ${name} := ${name}.",
+	},
+	{
+		Id:          "printf",
+		Code:        "printf",
+		Pattern:     `format %\S* has arg .* of wrong type|wrong number of args for format|call has arguments but no formatting directives|call needs \d+ args? but has \d+ args?`,
+		Title:       "Printf format and arguments don't match",
+		Explanation: "The verbs of the format string (%d, %s, %v, ...) don't match the arguments that follow it in number or type.",
+		Fix:         "Use one verb for each argument, %v prints any type. Println and Print take no format.",
+	},
+	{
+		Id:          "copylocks",
+		Code:        "copylocks",
+		Pattern:     `passes lock by value|copies lock value|range var .* copies lock|return copies lock value`,
+		Title:       "Lock copied",
+		Explanation: "A value that contains a sync.Mutex or another lock is copied. The copy has a lock of its own, so it doesn't protect anything shared with the original.",
+		Fix:         "Pass and store a pointer to the struct instead, and give its methods pointer receivers.",
+	},
+	{
+		Id:          "composites",
+		Code:        "composites",
+		Pattern:     `composite literal uses unkeyed fields`,
+		Title:       "Unkeyed fields",
+		Explanation: "The struct of another package is written without field names. It breaks when the package adds or reorders fields.",
+		Fix:         "Name the fields, e.g. Point{X: 1, Y: 2}.",
+	},
+	{
+		Id:          "unreachable",
+		Code:        "unreachable",
+		Pattern:     `unreachable code`,
+		Title:       "Unreachable code",
+		Explanation: "The statements follow a return, panic or endless loop and never run.",
+		Fix:         "Remove them, or fix the control flow that was meant to reach them.",
+	},
+	{
+		Id:          "lost-cancel",
+		Code:        "lostcancel",
+		Pattern:     `the cancel function .*is not used on all paths|the cancel function .*should be called`,
+		Title:       "Context never canceled",
+		Explanation: "The cancel function of context.WithCancel, WithTimeout or WithDeadline has to be called, or the resources of the context are only released when the parent is done.",
+		Fix:         "Call defer cancel() right after creating the context.",
+	},
+}
+
+// Rules of the bundles first so that they can refine the rules of godev,
+// the files are read each time so that they can be edited while godev runs
+func loadExplainRules() []ExplainRule {
+	rules := []ExplainRule{}
+
+	if handlers != nil {
+		for _, file := range handlers.fs.bundleFiles("explain.json") {
+			b, err := ioutil.ReadFile(file)
+			if err != nil {
+				continue
+			}
+
+			config := ExplainConfig{}
+			err = json.Unmarshal(b, &config)
+			if err != nil {
+				logger.Printf("Invalid explanations %v: %v\n", file, err)
+				continue
+			}
+
+			for _, rule := range config.Rules {
+				rule.Bundle = filepath.Base(filepath.Dir(file))
+				rules = append(rules, rule)
+			}
+		}
+	}
+
+	return append(rules, builtinExplainRules...)
+}
+
+// The explanations of the rules that match the message, with the named
+// groups of the patterns filled in
+func explainMessage(rules []ExplainRule, msg string, code string) []ExplainRule {
+	explanations := []ExplainRule{}
+
+	for _, rule := range rules {
+		if code != "" && rule.Code != "" && rule.Code != code {
+			continue
+		}
+
+		pattern, err := regexp.Compile(rule.Pattern)
+		if err != nil {
+			logger.Printf("Invalid pattern of the explanation %v: %v\n", rule.Id, err)
+			continue
+		}
+		match := pattern.FindStringSubmatchIndex(msg)
+		if match == nil {
+			continue
+		}
+
+		expand := func(text string) string {
+			return string(pattern.ExpandString(nil, text, msg, match))
+		}
+
+		explanation := rule
+		explanation.Pattern = ""
+		explanation.Title = expand(rule.Title)
+		explanation.Explanation = expand(rule.Explanation)
+		explanation.Fix = expand(rule.Fix)
+		explanations = append(explanations, explanation)
+	}
+
+	return explanations
+}
+
+// GET /go/explain?msg=<message>[&code=<analyzer>] has the explanations of
+// a compile error or go vet finding, the best first. GET /go/explain/rules
+// lists the rules of godev and the bundles.
+func explainHandler(writer http.ResponseWriter, req *http.Request, path string, pathSegs []string) bool {
+	switch {
+	case req.Method == "GET" && len(pathSegs) == 3 && pathSegs[2] == "rules":
+		ShowJson(writer, 200, loadExplainRules())
+		return true
+	case req.Method == "GET" && (len(pathSegs) == 2 || (len(pathSegs) == 3 && pathSegs[2] == "")):
+		query := req.URL.Query()
+		msg := query.Get("msg")
+		if msg == "" {
+			ShowError(writer, 400, "Missing message", nil)
+			return true
+		}
+
+		ShowJson(writer, 200, explainMessage(loadExplainRules(), msg, query.Get("code")))
+		return true
+	}
+
+	return false
+}
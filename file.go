@@ -28,6 +28,7 @@ type FileDetails struct {
 	Children         interface{} `json:",omitempty"`
 	ImportLocation   string
 	Git              *GitMeta
+	Lfs              *LfsInfo `json:",omitempty"`
 }
 
 type GitMeta struct {
@@ -44,6 +45,9 @@ type GitMeta struct {
 }
 
 func fileHandler(writer http.ResponseWriter, req *http.Request, path string, pathSegs []string) bool {
+	// Accounts only see their own workspace
+	srcDirs := requestSrcDirs(req)
+
 	switch {
 	case req.Method == "POST" && len(pathSegs) > 1:
 		fileRelPath := "/" + strings.Join(pathSegs[1:], "/")
@@ -78,6 +82,18 @@ func fileHandler(writer http.ResponseWriter, req *http.Request, path string, pat
 
 		createOptions := req.Header.Get("X-Create-Options")
 
+		// Neither the file that is moved nor the one that is overwritten can
+		//  be locked
+		locations := []string{"/file" + fileRelPath + "/" + newName}
+		if strings.Contains(createOptions, "move") {
+			locations = append(locations, details["Location"])
+		}
+		for _, location := range locations {
+			if showLocked(writer, req, filepath.ToSlash(filepath.Clean(location))) {
+				return true
+			}
+		}
+
 		// This is a move
 		if strings.Contains(createOptions, "move") {
 			oldPathSegs := strings.Split(details["Location"], "/")
@@ -242,6 +258,12 @@ func fileHandler(writer http.ResponseWriter, req *http.Request, path string, pat
 		return true
 	case req.Method == "DELETE" && len(pathSegs) > 1:
 		fileRelPath := "/" + strings.Join(pathSegs[1:], "/")
+
+		if claim := lockingClaim(requestUser(req), "/file"+fileRelPath); claim != nil {
+			ShowError(writer, 423, "File is locked by "+claim.User, nil)
+			return true
+		}
+
 		filePath := ""
 
 		for _, srcDir := range srcDirs {
@@ -264,10 +286,17 @@ func fileHandler(writer http.ResponseWriter, req *http.Request, path string, pat
 			ShowError(writer, 500, "Unable to remove file", err)
 			return true
 		}
+		updateSymbolIndex(filePath)
 		writer.WriteHeader(204)
 		return true
 	case req.Method == "PUT" && len(pathSegs) > 1:
 		fileRelPath := "/" + strings.Join(pathSegs[1:], "/")
+
+		if claim := lockingClaim(requestUser(req), "/file"+fileRelPath); claim != nil {
+			ShowError(writer, 423, "File is locked by "+claim.User, nil)
+			return true
+		}
+
 		filePath := ""
 
 		for _, srcDir := range srcDirs {
@@ -285,18 +314,21 @@ func fileHandler(writer http.ResponseWriter, req *http.Request, path string, pat
 			return true
 		}
 
-		file, err := os.Create(filePath)
+		body, err := uploadBody(req)
 		if err != nil {
-			ShowError(writer, 500, "Error writing to file", err)
+			showUploadError(writer, err)
 			return true
 		}
 
-		_, err = io.Copy(file, req.Body)
+		err = saveUpload(filePath, body)
+		if body.err != nil {
+			showUploadError(writer, body.err)
+			return true
+		}
 		if err != nil {
 			ShowError(writer, 500, "Error writing to file", err)
 			return true
 		}
-		file.Close()
 
 		fileinfo, err := os.Stat(filePath)
 		if err != nil {
@@ -334,6 +366,11 @@ func fileHandler(writer http.ResponseWriter, req *http.Request, path string, pat
 		info.ChildrenLocation = "/file" + fileRelPath + "?depth=1"
 
 		ShowJson(writer, 200, info)
+
+		user := requestUser(req)
+		discardDraft(user, info.Location)
+		recordRecentFile(user, info.Location, true)
+		updateSymbolIndex(filePath)
 		return true
 	case req.Method == "GET" && len(pathSegs) > 1:
 		fileRelPath := "/" + strings.Join(pathSegs[1:], "/")
@@ -383,6 +420,8 @@ func fileHandler(writer http.ResponseWriter, req *http.Request, path string, pat
 			if err != nil {
 				panic(err)
 			}
+
+			recordRecentFile(requestUser(req), "/file"+fileRelPath, false)
 			return true
 		}
 
@@ -419,6 +458,13 @@ func fileHandler(writer http.ResponseWriter, req *http.Request, path string, pat
 		info.Attributes["ReadOnly"] = isgoroot
 		info.Attributes["Executable"] = (fileinfo.Mode()&os.ModePerm)&0111 != 0
 
+		// Pointer files and files with their LFS content checked out
+		if !isgoroot {
+			ctx, cancel := operationContext(req, *gitTimeout)
+			info.Lfs = lfsFileInfo(ctx, srcDirs, filePath, info.Location, fileinfo)
+			cancel()
+		}
+
 		// Symlink check
 		fileinfo, err = os.Lstat(filePath)
 		if err != nil {
@@ -432,12 +478,12 @@ func fileHandler(writer http.ResponseWriter, req *http.Request, path string, pat
 
 		_, err = os.Stat(filePath + "/.git")
 		if err == nil {
-			// TODO handle more complicated branches and setup
+			branch := gitRefSeg(gitCurrentBranch(filePath))
 			info.Git = &GitMeta{}
 			info.Git.CloneLocation = "/gitapi/clone" + info.Location
-			info.Git.CommitLocation = "/gitapi/commit/master" + info.Location
+			info.Git.CommitLocation = "/gitapi/commit/" + branch + info.Location
 			info.Git.ConfigLocation = "/gitapi/config/clone" + info.Location
-			info.Git.DefaultRemoteBranchLocation = "/gitapi/remote/origin/master" + info.Location
+			info.Git.DefaultRemoteBranchLocation = "/gitapi/remote/origin/" + branch + info.Location
 			info.Git.DiffLocation = "/gitapi/diff/Default" + info.Location
 			info.Git.HeadLocation = "/gitapi/commit/HEAD" + info.Location
 			info.Git.IndexLocation = "/gitapi/index" + info.Location
@@ -470,6 +516,9 @@ func fileHandler(writer http.ResponseWriter, req *http.Request, path string, pat
 					childInfo.Attributes["ReadOnly"] = isgoroot
 					childInfo.Attributes["Executable"] = (fi.Mode()&os.ModePerm)&0111 != 0
 					childInfo.ChildrenLocation = "/file" + fileRelPath + "/" + fi.Name() + "?depth=1"
+					if !isgoroot {
+						childInfo.Lfs = lfsPointerInfo(filepath.Join(filePath, childName), childInfo.Location, fi)
+					}
 
 					// Provide a location to import into a directory
 					if childInfo.Directory {
@@ -5,6 +5,8 @@
 package main
 
 import (
+	"bytes"
+	"context"
 	"net/http"
 	"os"
 	"path/filepath"
@@ -46,6 +48,9 @@ type Result struct {
 	LastModified int64
 	Location     string
 	Path         string
+	// Symbol searches have the kind of declaration and its line
+	Kind string `json:",omitempty"`
+	Line int    `json:",omitempty"`
 }
 
 func filesearchHandler(writer http.ResponseWriter, req *http.Request, path string, pathSegs []string) bool {
@@ -67,6 +72,12 @@ func filesearchHandler(writer http.ResponseWriter, req *http.Request, path strin
 		filterparts[0] = strings.Replace(filterparts[0], "\\", "", -1)
 
 		results := []Result{}
+		found := func(result Result) {
+			results = append(results, result)
+		}
+
+		ctx, cancel := operationContext(req, *searchTimeout)
+		defer cancel()
 
 		searchDirs := []string{}
 		locations := []string{}
@@ -78,7 +89,7 @@ func filesearchHandler(writer http.ResponseWriter, req *http.Request, path strin
 			loc = strings.Replace(loc, "*", "", -1)
 
 			if !strings.HasPrefix(loc, "/GOROOT") {
-				for _, srcDir := range srcDirs {
+				for _, srcDir := range requestSrcDirs(req) {
 					searchDirs = append(searchDirs, filepath.Join(srcDir, loc))
 					locations = append(locations, filepath.Join("/file", loc))
 				}
@@ -88,7 +99,7 @@ func filesearchHandler(writer http.ResponseWriter, req *http.Request, path strin
 			searchDirs = append(searchDirs, filepath.Join(goroot, "/src/pkg", loc))
 			locations = append(locations, filepath.Join("/file/GOROOT", loc))
 		} else {
-			searchDirs = srcDirs
+			searchDirs = requestSrcDirs(req)
 			for _, _ = range searchDirs {
 				locations = append(locations, "/file")
 			}
@@ -97,29 +108,78 @@ func filesearchHandler(writer http.ResponseWriter, req *http.Request, path strin
 			locations = append(locations, "/file/GOROOT")
 		}
 
+		// Symbol:<wildcard> and Type:<wildcard> are answered by the index
+		var symbols []Result
+		field := strings.SplitN(filterparts[0], ":", 2)
+		// The index is of the GOPATH, accounts search their workspace instead
+		if kinds, ok := symbolIndexKinds[field[0]]; ok && len(field) == 2 && requestAccount(req) == nil {
+			symbolregex, err := regexp.Compile("(?i)^" + strings.Replace(strings.Replace(regexp.QuoteMeta(field[1]), "\\*", ".*", -1), "\\?", ".?", -1) + "$")
+			if err != nil {
+				ShowError(writer, 400, "Invalid wildcard", err)
+				return true
+			}
+
+			symbols, err = searchSymbols(ctx, symbolregex, kinds, locations[0])
+			if err != nil {
+				ShowError(writer, 504, "The symbol index is not ready yet", err)
+				return true
+			}
+		}
+
+		var nameregex *regexp.Regexp
 		if strings.HasPrefix(filterparts[0], "NameLower") {
 			matches := strings.Split(filterparts[0], ":")[1]
 
 			// Convert wildcard to regex and use the standard regex library
-			nameregex, err := regexp.Compile("^" + strings.Replace(strings.Replace(matches, "*", ".*", -1), "?", ".?", -1) + "$")
+			var err error
+			nameregex, err = regexp.Compile("^" + strings.Replace(strings.Replace(matches, "*", ".*", -1), "?", ".?", -1) + "$")
 			if err != nil {
 				ShowError(writer, 400, "Invalid wildcard", err)
 				return true
 			}
+		}
 
-			for idx, _ := range searchDirs {
-				path := ""
-				results = append(results, findNameMatches(searchDirs[idx], path, locations[idx], nameregex)...)
+		// Streamed results go out one per line as soon as they are found
+		var stream *JsonStream
+		if wantsJsonStream(req) {
+			stream = NewJsonStream(writer, req)
+			found = func(result Result) {
+				if stream.Send(result) != nil {
+					// The client is gone
+					cancel()
+				}
 			}
-		} else {
-			token := filterparts[0]
+		}
 
-			for idx, _ := range searchDirs {
-				path := ""
-				results = append(results, findContentMatches(searchDirs[idx], path, locations[idx], token)...)
+		for _, symbol := range symbols {
+			found(symbol)
+		}
+
+		for idx, _ := range searchDirs {
+			if symbols != nil {
+				break
+			}
+
+			path := ""
+			if nameregex != nil {
+				findNameMatches(ctx, searchDirs[idx], path, locations[idx], nameregex, found)
+			} else {
+				findContentMatches(ctx, searchDirs[idx], path, locations[idx], filterparts[0], found)
 			}
 		}
 
+		if stream != nil {
+			if ctx.Err() == context.DeadlineExceeded {
+				stream.Fail(504, "Search did not complete in time", ctx.Err())
+			}
+			return true
+		}
+
+		if ctx.Err() != nil {
+			ShowError(writer, 504, "Search did not complete in time", ctx.Err())
+			return true
+		}
+
 		retval := Blob{}
 		// TODO figure out what QTime means
 		retval.ResponseHeader = Header{Status: 0, QTime: 7}
@@ -142,12 +202,14 @@ func filesearchHandler(writer http.ResponseWriter, req *http.Request, path strin
 	return false
 }
 
-func findNameMatches(file string, path string, location string, nameregex *regexp.Regexp) []Result {
-	retval := []Result{}
+func findNameMatches(ctx context.Context, file string, path string, location string, nameregex *regexp.Regexp, found func(Result)) {
+	if ctx.Err() != nil {
+		return
+	}
 
 	stat, err := os.Stat(file)
 	if err != nil {
-		return retval
+		return
 	}
 
 	if stat.IsDir() {
@@ -158,7 +220,7 @@ func findNameMatches(file string, path string, location string, nameregex *regex
 			names, err := dir.Readdirnames(-1)
 			if err == nil {
 				for _, name := range names {
-					retval = append(retval, findNameMatches(file+"/"+name, path+"/"+name, location+"/"+name, nameregex)...)
+					findNameMatches(ctx, file+"/"+name, path+"/"+name, location+"/"+name, nameregex, found)
 				}
 			}
 		}
@@ -167,18 +229,18 @@ func findNameMatches(file string, path string, location string, nameregex *regex
 		result := Result{Id: "file:/" + file, Name: stat.Name(), Length: stat.Size(),
 			Directory: stat.IsDir(), LastModified: stat.ModTime().Unix() * 1000,
 			Location: location, Path: path}
-		retval = append(retval, result)
+		found(result)
 	}
-
-	return retval
 }
 
-func findContentMatches(file string, path string, location string, token string) []Result {
-	retval := []Result{}
+func findContentMatches(ctx context.Context, file string, path string, location string, token string, found func(Result)) {
+	if ctx.Err() != nil {
+		return
+	}
 
 	stat, err := os.Stat(file)
 	if err != nil {
-		return retval
+		return
 	}
 
 	if stat.IsDir() {
@@ -190,20 +252,21 @@ func findContentMatches(file string, path string, location string, token string)
 			names, err := dir.Readdirnames(-1)
 			if err == nil {
 				for _, name := range names {
-					retval = append(retval, findContentMatches(file+"/"+name, path+"/"+name, location+"/"+name, token)...)
+					findContentMatches(ctx, file+"/"+name, path+"/"+name, location+"/"+name, token, found)
 				}
 			}
 		}
 	} else {
 		f, err := os.Open(file)
 		if err != nil {
-			return retval
+			return
 		}
 		defer f.Close()
 
 		buffer := make([]byte, 4096, 4096)
 		matchIdx := 0
 		matches := false
+		first := true
 
 		for {
 			n, err := f.Read(buffer)
@@ -211,6 +274,13 @@ func findContentMatches(file string, path string, location string, token string)
 				break
 			}
 
+			// Like grep the binary files, e.g. the content of Git LFS files,
+			//  and the LFS pointers aren't searched
+			if first && (bytes.IndexByte(buffer[:n], 0) != -1 || isLfsPointer(buffer[:n])) {
+				break
+			}
+			first = false
+
 			for i := 0; i < n; i++ {
 				if buffer[i] == token[matchIdx] {
 					matchIdx++
@@ -234,9 +304,7 @@ func findContentMatches(file string, path string, location string, token string)
 			result := Result{Id: "file:/" + file, Name: stat.Name(), Length: stat.Size(),
 				Directory: stat.IsDir(), LastModified: stat.ModTime().Unix() * 1000,
 				Location: location, Path: path}
-			retval = append(retval, result)
+			found(result)
 		}
 	}
-
-	return retval
 }
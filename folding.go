@@ -0,0 +1,221 @@
+// Copyright 2014 Chris McGee <sirnewton_01@yahoo.ca>. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"go/ast"
+	"go/parser"
+	"go/token"
+	"io/ioutil"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+type FoldingRange struct {
+	Start     int
+	End       int
+	StartLine int
+	EndLine   int
+	// imports, comment or region
+	Kind string
+}
+
+// Range of the buffer that expanding the selection goes through
+type SelectionRange struct {
+	Start int
+	End   int
+}
+
+func parseBuffer(req *http.Request) (*token.FileSet, *ast.File, []byte, error) {
+	buffer, err := ioutil.ReadAll(req.Body)
+	if err != nil {
+		return nil, nil, nil, err
+	}
+
+	// The syntax before and after an error is still worth having
+	fileset := token.NewFileSet()
+	file, err := parser.ParseFile(fileset, "", buffer, parser.AllErrors|parser.ParseComments)
+	if file == nil {
+		return nil, nil, nil, err
+	}
+
+	return fileset, file, buffer, nil
+}
+
+func foldingHandler(writer http.ResponseWriter, req *http.Request, path string, pathSegs []string) bool {
+	switch {
+	case req.Method == "POST":
+		fileset, file, _, err := parseBuffer(req)
+		if err != nil {
+			ShowError(writer, 400, "Error parsing go source", err)
+			return true
+		}
+
+		ShowJson(writer, 200, foldingRanges(fileset, file))
+		return true
+	}
+
+	return false
+}
+
+func selectionHandler(writer http.ResponseWriter, req *http.Request, path string, pathSegs []string) bool {
+	switch {
+	case req.Method == "POST":
+		fileset, file, buffer, err := parseBuffer(req)
+		if err != nil {
+			ShowError(writer, 400, "Error parsing go source", err)
+			return true
+		}
+
+		// One chain of ranges for each of the offsets (e.g. offsets=10,52)
+		result := [][]SelectionRange{}
+		for _, o := range strings.Split(req.URL.Query().Get("offsets"), ",") {
+			offset, err := strconv.Atoi(o)
+			if err != nil || offset < 0 || offset > len(buffer) {
+				ShowError(writer, 400, "Invalid offset "+o, err)
+				return true
+			}
+
+			result = append(result, selectionRanges(fileset, file, len(buffer), offset))
+		}
+
+		ShowJson(writer, 200, result)
+		return true
+	}
+
+	return false
+}
+
+func foldingRanges(fileset *token.FileSet, file *ast.File) []FoldingRange {
+	ranges := []FoldingRange{}
+
+	add := func(start token.Pos, end token.Pos, kind string) {
+		if !start.IsValid() || !end.IsValid() {
+			return
+		}
+
+		startPos, endPos := fileset.Position(start), fileset.Position(end)
+		// Folding a single line hides nothing
+		if endPos.Line <= startPos.Line {
+			return
+		}
+
+		ranges = append(ranges, FoldingRange{startPos.Offset, endPos.Offset, startPos.Line, endPos.Line, kind})
+	}
+
+	for _, comments := range file.Comments {
+		add(comments.Pos(), comments.End(), "comment")
+	}
+
+	ast.Inspect(file, func(n ast.Node) bool {
+		switch x := n.(type) {
+		case *ast.GenDecl:
+			kind := "region"
+			if x.Tok == token.IMPORT {
+				kind = "imports"
+			}
+			add(x.Lparen, x.Rparen, kind)
+		case *ast.BlockStmt:
+			add(x.Lbrace, x.Rbrace, "region")
+		case *ast.CompositeLit:
+			add(x.Lbrace, x.Rbrace, "region")
+		case *ast.StructType:
+			add(x.Fields.Opening, x.Fields.Closing, "region")
+		case *ast.InterfaceType:
+			add(x.Methods.Opening, x.Methods.Closing, "region")
+		case *ast.CaseClause:
+			add(x.Colon, x.End(), "region")
+		case *ast.CommClause:
+			add(x.Colon, x.End(), "region")
+		case *ast.CallExpr:
+			// Arguments spread over several lines
+			add(x.Lparen, x.Rparen, "region")
+		}
+		return true
+	})
+
+	sort.SliceStable(ranges, func(i, j int) bool { return ranges[i].Start < ranges[j].Start })
+	return ranges
+}
+
+// The ranges of the syntax that contains the offset from the innermost
+// out to the whole buffer.
+func selectionRanges(fileset *token.FileSet, file *ast.File, size int, offset int) []SelectionRange {
+	enclosing := []SelectionRange{}
+
+	contains := func(n ast.Node) (int, int, bool) {
+		start, end := fileset.Position(n.Pos()).Offset, fileset.Position(n.End()).Offset
+		return start, end, n.Pos().IsValid() && start <= offset && offset <= end
+	}
+
+	ast.Inspect(file, func(n ast.Node) bool {
+		if n == nil {
+			return false
+		}
+		start, end, ok := contains(n)
+		if !ok {
+			return false
+		}
+
+		enclosing = append(enclosing, SelectionRange{start, end})
+
+		// The inside of blocks and parentheses before the whole of them
+		switch x := n.(type) {
+		case *ast.BlockStmt:
+			enclosing = append(enclosing, innerRange(fileset, x.Lbrace, x.Rbrace, offset)...)
+		case *ast.CallExpr:
+			enclosing = append(enclosing, innerRange(fileset, x.Lparen, x.Rparen, offset)...)
+		case *ast.CompositeLit:
+			enclosing = append(enclosing, innerRange(fileset, x.Lbrace, x.Rbrace, offset)...)
+		case *ast.FieldList:
+			enclosing = append(enclosing, innerRange(fileset, x.Opening, x.Closing, offset)...)
+		case *ast.ParenExpr:
+			enclosing = append(enclosing, innerRange(fileset, x.Lparen, x.Rparen, offset)...)
+		}
+		return true
+	})
+
+	for _, comments := range file.Comments {
+		for _, comment := range comments.List {
+			if start, end, ok := contains(comment); ok {
+				enclosing = append(enclosing, SelectionRange{start, end})
+			}
+		}
+		if start, end, ok := contains(comments); ok && len(comments.List) > 1 {
+			enclosing = append(enclosing, SelectionRange{start, end})
+		}
+	}
+
+	enclosing = append(enclosing, SelectionRange{0, size})
+
+	// Innermost first, each range only once
+	sort.SliceStable(enclosing, func(i, j int) bool {
+		return enclosing[i].End-enclosing[i].Start < enclosing[j].End-enclosing[j].Start
+	})
+
+	result := []SelectionRange{}
+	for _, r := range enclosing {
+		if len(result) == 0 || result[len(result)-1] != r {
+			result = append(result, r)
+		}
+	}
+
+	return result
+}
+
+func innerRange(fileset *token.FileSet, open token.Pos, close token.Pos, offset int) []SelectionRange {
+	if !open.IsValid() || !close.IsValid() {
+		return nil
+	}
+
+	start, end := fileset.Position(open).Offset+1, fileset.Position(close).Offset
+	if start <= offset && offset <= end && start < end {
+		return []SelectionRange{{start, end}}
+	}
+
+	return nil
+}
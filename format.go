@@ -14,13 +14,16 @@ import (
 )
 
 func formatHandler(writer http.ResponseWriter, req *http.Request, path string, pathSegs []string) bool {
+	ctx, cancel := operationContext(req, *toolTimeout)
+	defer cancel()
+
 	switch {
 	case req.Method == "GET":
 		qValues := req.URL.Query()
-		pkg := qValues.Get("pkg")
+		pkg := workspacePackage(qValues.Get("pkg"))
 
 		if pkg != "" {
-			cmd := exec.Command("go", "fmt", pkg)
+			cmd := exec.CommandContext(ctx, "go", "fmt", pkg)
 			err := cmd.Run()
 
 			if err != nil {
@@ -37,7 +40,7 @@ func formatHandler(writer http.ResponseWriter, req *http.Request, path string, p
 
 		// Simple case, provide the output from gofmt
 		if showLines != "true" {
-			cmd := exec.Command("gofmt")
+			cmd := exec.CommandContext(ctx, "gofmt")
 			cmd.Stdin = req.Body
 
 			output, err := cmd.Output()
@@ -52,7 +55,7 @@ func formatHandler(writer http.ResponseWriter, req *http.Request, path string, p
 			return true
 		} else {
 			// Get the specific line numbers where there are formatting problems
-			cmd := exec.Command("gofmt", "-d")
+			cmd := exec.CommandContext(ctx, "gofmt", "-d")
 			cmd.Stdin = req.Body
 
 			output, err := cmd.Output()
@@ -0,0 +1,12 @@
+// Copyright 2014 Chris McGee <sirnewton_01@yahoo.ca>. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+// +build !linux
+
+package main
+
+// Without /proc there is no telling which process listens on a port
+func listeningPorts(pids []int) (map[int]bool, bool) {
+	return nil, false
+}
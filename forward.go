@@ -0,0 +1,270 @@
+// Copyright 2014 Chris McGee <sirnewton_01@yahoo.ca>. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httputil"
+	"net/url"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Path of the godev server that is proxied to a port of this machine,
+// such as that of a web service under development. Only the user that
+// set it up can use it.
+type Forward struct {
+	// The forward is served under /forward/<Name>/
+	Name    string
+	Port    int
+	User    string
+	Created int64
+}
+
+var (
+	forwardsMutex sync.Mutex
+	forwards      = make(map[string]*Forward)
+
+	validForwardName = regexp.MustCompile(`^[A-Za-z0-9_-]+$`)
+)
+
+func init() {
+	// Nobody is previewing anything anymore
+	idleUserHooks = append(idleUserHooks, removeForwards)
+}
+
+func removeForwards(user string) {
+	forwardsMutex.Lock()
+	defer forwardsMutex.Unlock()
+
+	for name, forward := range forwards {
+		if forward.User == user {
+			delete(forwards, name)
+		}
+	}
+}
+
+func findForward(name string, user string) *Forward {
+	forwardsMutex.Lock()
+	defer forwardsMutex.Unlock()
+
+	forward := forwards[name]
+	if forward == nil || forward.User != user {
+		return nil
+	}
+
+	return forward
+}
+
+// The pids of the processes that the user started from godev
+func userPids(user string) []int {
+	processesMutex.Lock()
+	defer processesMutex.Unlock()
+
+	pids := []int{}
+	for _, p := range childProcesses {
+		if p.User == user && p.cmd.Process != nil {
+			pids = append(pids, p.cmd.Process.Pid)
+		}
+	}
+
+	return pids
+}
+
+// Whether one of the processes that the user started listens on the port,
+// true where that can't be told
+func userListens(user string, port int) bool {
+	ports, ok := listeningPorts(userPids(user))
+	return !ok || ports[port]
+}
+
+// Users can only forward to the programs that they run themselves, never
+// to godev or to another godev server
+func checkForwardPort(user string, forwardPort int) error {
+	if forwardPort <= 0 || forwardPort > 65535 || strconv.Itoa(forwardPort) == *port {
+		return errors.New("Invalid port: " + strconv.Itoa(forwardPort))
+	}
+
+	instancesMutex.Lock()
+	instances, err := readInstances()
+	instancesMutex.Unlock()
+	if err != nil {
+		return err
+	}
+	for _, instance := range instances {
+		if instance.Port == strconv.Itoa(forwardPort) {
+			return errors.New("Port " + strconv.Itoa(forwardPort) + " is that of another godev server")
+		}
+	}
+
+	if !userListens(user, forwardPort) {
+		return errors.New("None of your processes listens on port " + strconv.Itoa(forwardPort))
+	}
+
+	return nil
+}
+
+// Sends the request to the port without the credentials of godev, the
+// program learns where it is served from in X-Forwarded-Prefix.
+func proxyForward(writer http.ResponseWriter, req *http.Request, forward *Forward) {
+	prefix := requestPrefix(req) + "/forward/" + forward.Name
+	target := &url.URL{Scheme: "http", Host: loopbackHost + ":" + strconv.Itoa(forward.Port)}
+
+	proxy := &httputil.ReverseProxy{
+		Director: func(out *http.Request) {
+			out.URL.Scheme = target.Scheme
+			out.URL.Host = target.Host
+			// The path as it was escaped, after /forward/<name>
+			rest := "/"
+			if segs := strings.SplitN(req.URL.EscapedPath(), "/", 4); len(segs) == 4 {
+				rest = rest + segs[3]
+			}
+			out.URL.Path, _ = url.PathUnescape(rest)
+			out.URL.RawPath = rest
+			out.Host = target.Host
+
+			cookies := out.Cookies()
+			out.Header.Del("Cookie")
+			for _, cookie := range cookies {
+				if !strings.HasPrefix(cookie.Name, "MAGIC") {
+					out.AddCookie(cookie)
+				}
+			}
+			out.Header.Set("X-Forwarded-Prefix", prefix)
+		},
+		// Redirects within the program stay under the forward
+		ModifyResponse: func(resp *http.Response) error {
+			location := resp.Header.Get("Location")
+			if strings.HasPrefix(location, "/") && !strings.HasPrefix(location, "//") {
+				resp.Header.Set("Location", prefix+location)
+			}
+
+			// The program is served from godev's host, its pages get an origin
+			//  of their own like those of the previews so that their scripts
+			//  can't use godev's APIs
+			resp.Header.Set("Content-Security-Policy", "sandbox allow-scripts allow-forms allow-popups allow-modals allow-downloads")
+			resp.Header.Set("X-Content-Type-Options", "nosniff")
+			return nil
+		},
+		ErrorHandler: func(writer http.ResponseWriter, req *http.Request, err error) {
+			ShowError(writer, 502, "Nothing is answering on port "+strconv.Itoa(forward.Port), err)
+		},
+	}
+
+	// WebSockets need the connection itself, the first of the writers that
+	//  the handlers wrap it in that can take it over
+	for {
+		if _, ok := writer.(http.Hijacker); ok {
+			break
+		}
+		w, ok := writer.(interface{ Unwrap() http.ResponseWriter })
+		if !ok {
+			break
+		}
+		writer = w.Unwrap()
+	}
+
+	proxy.ServeHTTP(writer, req)
+}
+
+// GET /forward lists the forwards of the user, POST /forward sets one up
+// ({"Port": 8080, "Name": "api"}) and DELETE /forward/<name> removes it.
+// Everything under /forward/<name>/ goes to the port.
+func forwardHandler(writer http.ResponseWriter, req *http.Request, path string, pathSegs []string) bool {
+	user := requestUser(req)
+
+	switch {
+	case req.Method == "GET" && (len(pathSegs) == 1 || (len(pathSegs) == 2 && pathSegs[1] == "")):
+		result := []Forward{}
+
+		forwardsMutex.Lock()
+		for _, forward := range forwards {
+			if forward.User == user {
+				result = append(result, *forward)
+			}
+		}
+		forwardsMutex.Unlock()
+
+		sort.Slice(result, func(i, j int) bool { return result[i].Name < result[j].Name })
+		ShowJson(writer, 200, result)
+		return true
+	case req.Method == "POST" && (len(pathSegs) == 1 || (len(pathSegs) == 2 && pathSegs[1] == "")):
+		forward := Forward{}
+		err := json.NewDecoder(req.Body).Decode(&forward)
+		if err != nil {
+			ShowError(writer, 400, "Invalid forward", err)
+			return true
+		}
+
+		err = checkForwardPort(user, forward.Port)
+		if err != nil {
+			ShowError(writer, 400, err.Error(), nil)
+			return true
+		}
+		if forward.Name == "" {
+			forward.Name = strconv.Itoa(forward.Port)
+		}
+		if !validForwardName.MatchString(forward.Name) {
+			ShowError(writer, 400, "Invalid forward name: "+forward.Name, nil)
+			return true
+		}
+		forward.User = user
+		forward.Created = time.Now().Unix() * 1000
+
+		forwardsMutex.Lock()
+		defer forwardsMutex.Unlock()
+
+		if existing := forwards[forward.Name]; existing != nil && existing.User != user {
+			ShowError(writer, 409, "The name "+forward.Name+" is taken", nil)
+			return true
+		}
+		forwards[forward.Name] = &forward
+
+		ShowJson(writer, 201, forward)
+		return true
+	case req.Method == "DELETE" && len(pathSegs) == 2:
+		if findForward(pathSegs[1], user) == nil {
+			ShowError(writer, 404, "No such forward: "+pathSegs[1], nil)
+			return true
+		}
+
+		forwardsMutex.Lock()
+		delete(forwards, pathSegs[1])
+		forwardsMutex.Unlock()
+
+		writer.WriteHeader(204)
+		return true
+	case len(pathSegs) >= 3:
+		forward := findForward(pathSegs[1], user)
+		if forward == nil {
+			ShowError(writer, 404, "No such forward: "+pathSegs[1], nil)
+			return true
+		}
+		// The program may have stopped and something else taken its port
+		if !userListens(user, forward.Port) {
+			ShowError(writer, 502, "None of your processes listens on port "+strconv.Itoa(forward.Port), nil)
+			return true
+		}
+
+		proxyForward(writer, req, forward)
+		return true
+	case len(pathSegs) == 2:
+		// Relative links of the pages need the trailing slash
+		if findForward(pathSegs[1], user) == nil {
+			return false
+		}
+
+		http.Redirect(writer, req, requestPrefix(req)+"/forward/"+pathSegs[1]+"/", http.StatusFound)
+		return true
+	}
+
+	return false
+}
@@ -0,0 +1,74 @@
+// Copyright 2014 Chris McGee <sirnewton_01@yahoo.ca>. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"net"
+	"os"
+	"os/exec"
+	"testing"
+)
+
+func TestListeningPorts(t *testing.T) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listener.Close()
+	listening := listener.Addr().(*net.TCPAddr).Port
+
+	ports, ok := listeningPorts([]int{os.Getpid()})
+	if !ok {
+		t.Skip("The listening ports can't be told here")
+	}
+	if !ports[listening] {
+		t.Errorf("Port %v of the process is missing from %v", listening, ports)
+	}
+
+	// Nobody else's
+	ports, _ = listeningPorts([]int{})
+	if ports[listening] {
+		t.Errorf("Port %v is listed without any process", listening)
+	}
+}
+
+func TestCheckForwardPort(t *testing.T) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listener.Close()
+	listening := listener.Addr().(*net.TCPAddr).Port
+
+	if _, ok := listeningPorts(nil); !ok {
+		t.Skip("The listening ports can't be told here")
+	}
+
+	// The test stands in for a process that the user started
+	cmd := &exec.Cmd{Process: &os.Process{Pid: os.Getpid()}}
+	proc := registerProcess("alice", "run", cmd, nil)
+	defer proc.unregister()
+
+	tests := []struct {
+		user  string
+		port  int
+		valid bool
+	}{
+		{"alice", listening, true},
+		{"bob", listening, false},
+		{"alice", 0, false},
+		{"alice", 70000, false},
+	}
+
+	for _, test := range tests {
+		err := checkForwardPort(test.user, test.port)
+		if test.valid && err != nil {
+			t.Errorf("Port %v of %v was refused: %v", test.port, test.user, err)
+		}
+		if !test.valid && err == nil {
+			t.Errorf("Port %v of %v was allowed", test.port, test.user)
+		}
+	}
+}
@@ -0,0 +1,178 @@
+// Copyright 2014 Chris McGee <sirnewton_01@yahoo.ca>. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"bytes"
+	"compress/flate"
+	"encoding/json"
+	"io"
+	"net/http"
+	"strconv"
+	"sync"
+
+	"code.google.com/p/go.net/websocket"
+)
+
+const (
+	// Largest flow control window that a client can ask for
+	maxFrameWindow = 16 << 20
+)
+
+// The terminal and debug sockets send text frames unless the client asks
+// for more with the query of the socket:
+//
+//	frames=binary    output and input go in binary frames
+//	compress=deflate the output is a raw deflate stream that is flushed
+//	                 at the end of each frame
+//	window=<bytes>   output stops once this much of it hasn't been
+//	                 acknowledged with a {"Ack": <bytes>} text frame
+//
+// The acknowledged bytes are those of the uncompressed output, so that a
+// slow link holds back the process instead of piling up in buffers.
+type framedConn struct {
+	ws *websocket.Conn
+
+	writeMutex sync.Mutex
+	deflater   *flate.Writer
+	deflated   bytes.Buffer
+
+	// Input of a frame that didn't fit in the caller's buffer
+	pending []byte
+
+	flowMutex sync.Mutex
+	flow      *sync.Cond
+	window    int64
+	sent      int64
+	acked     int64
+	closed    bool
+}
+
+type frameAck struct {
+	Ack int64
+}
+
+type frame struct {
+	data        []byte
+	payloadType byte
+}
+
+var (
+	frameCodec = websocket.Codec{
+		Marshal: func(v interface{}) ([]byte, byte, error) {
+			return v.([]byte), websocket.BinaryFrame, nil
+		},
+		Unmarshal: func(data []byte, payloadType byte, v interface{}) error {
+			f := v.(*frame)
+			f.data = data
+			f.payloadType = payloadType
+			return nil
+		},
+	}
+)
+
+// The connection of a terminal or debug socket in the framing that its
+// client asked for
+func framedSocket(ws *websocket.Conn) taskConn {
+	query := ws.Request().URL.Query()
+	if query.Get("frames") != "binary" {
+		return ws
+	}
+
+	conn := &framedConn{ws: ws}
+	conn.flow = sync.NewCond(&conn.flowMutex)
+	ws.PayloadType = websocket.BinaryFrame
+
+	if query.Get("compress") == "deflate" {
+		conn.deflater, _ = flate.NewWriter(&conn.deflated, flate.BestSpeed)
+	}
+	if window, err := strconv.ParseInt(query.Get("window"), 10, 64); err == nil && window > 0 {
+		if window > maxFrameWindow {
+			window = maxFrameWindow
+		}
+		conn.window = window
+	}
+
+	return conn
+}
+
+func (conn *framedConn) Request() *http.Request {
+	return conn.ws.Request()
+}
+
+// Waits for the client to make room in the window
+func (conn *framedConn) waitWindow(n int) bool {
+	conn.flowMutex.Lock()
+	defer conn.flowMutex.Unlock()
+
+	for conn.window > 0 && !conn.closed && conn.sent-conn.acked >= conn.window {
+		conn.flow.Wait()
+	}
+	conn.sent += int64(n)
+
+	return !conn.closed
+}
+
+func (conn *framedConn) Write(p []byte) (int, error) {
+	if !conn.waitWindow(len(p)) {
+		return 0, io.ErrClosedPipe
+	}
+
+	conn.writeMutex.Lock()
+	defer conn.writeMutex.Unlock()
+
+	payload := p
+	if conn.deflater != nil {
+		conn.deflated.Reset()
+		conn.deflater.Write(p)
+		conn.deflater.Flush()
+		payload = conn.deflated.Bytes()
+	}
+
+	err := frameCodec.Send(conn.ws, payload)
+	if err != nil {
+		return 0, err
+	}
+
+	return len(p), nil
+}
+
+// Reads the input, acknowledgements are taken care of along the way
+func (conn *framedConn) Read(p []byte) (int, error) {
+	for len(conn.pending) == 0 {
+		f := frame{}
+		err := frameCodec.Receive(conn.ws, &f)
+		if err != nil {
+			return 0, err
+		}
+
+		if f.payloadType == websocket.TextFrame {
+			ack := frameAck{}
+			if json.Unmarshal(f.data, &ack) == nil && ack.Ack > 0 {
+				conn.flowMutex.Lock()
+				conn.acked += ack.Ack
+				conn.flow.Broadcast()
+				conn.flowMutex.Unlock()
+				continue
+			}
+		}
+
+		conn.pending = f.data
+	}
+
+	n := copy(p, conn.pending)
+	conn.pending = conn.pending[n:]
+
+	return n, nil
+}
+
+func (conn *framedConn) Close() error {
+	conn.flowMutex.Lock()
+	conn.closed = true
+	conn.flow.Broadcast()
+	conn.flowMutex.Unlock()
+
+	return conn.ws.Close()
+}
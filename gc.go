@@ -0,0 +1,261 @@
+// Copyright 2014 Chris McGee <sirnewton_01@yahoo.ca>. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+)
+
+type GcResult struct {
+	Task      string
+	Removed   int
+	Reclaimed int64
+	Error     string `json:",omitempty"`
+}
+
+type GcReport struct {
+	Results   []GcResult
+	Reclaimed int64
+}
+
+// A garbage collection task removes whatever it owns that is older than
+// the cutoff time and reports what it removed.
+type gcTask struct {
+	name string
+	run  func(cutoff time.Time, result *GcResult) error
+}
+
+var (
+	// Temporary directories of the sessions and transfers that are still
+	//  going on, the garbage collection leaves them alone however old
+	tempDirsMutex sync.Mutex
+	tempDirsInUse = make(map[string]bool)
+
+	gcMutex sync.Mutex
+	gcTasks = []gcTask{
+		{"drafts", gcDrafts},
+		{"history", gcHistory},
+		{"temp", gcTempFiles},
+		{"transfers", gcTransfers},
+		{"coverage", gcCoverage},
+	}
+)
+
+func registerGcTask(name string, run func(cutoff time.Time, result *GcResult) error) {
+	gcMutex.Lock()
+	gcTasks = append(gcTasks, gcTask{name, run})
+	gcMutex.Unlock()
+}
+
+func collectGarbage(retention time.Duration) GcReport {
+	gcMutex.Lock()
+	defer gcMutex.Unlock()
+
+	cutoff := time.Now().Add(-retention)
+	report := GcReport{Results: []GcResult{}}
+
+	for _, task := range gcTasks {
+		result := GcResult{Task: task.name}
+		err := task.run(cutoff, &result)
+		if err != nil {
+			result.Error = err.Error()
+		}
+
+		logger.Printf("GC %v: removed %v, reclaimed %v bytes\n", task.name, result.Removed, result.Reclaimed)
+		report.Results = append(report.Results, result)
+		report.Reclaimed += result.Reclaimed
+	}
+
+	return report
+}
+
+func startGc(interval time.Duration) {
+	if interval <= 0 {
+		return
+	}
+
+	go func() {
+		for {
+			<-time.After(interval)
+			collectGarbage(*historyRetention)
+		}
+	}()
+}
+
+// Removes a file or directory tree and adds it to the result
+func gcRemove(path string, result *GcResult) {
+	size := int64(0)
+	filepath.Walk(path, func(p string, info os.FileInfo, err error) error {
+		if err == nil && !info.IsDir() {
+			size += info.Size()
+		}
+		return nil
+	})
+
+	if os.RemoveAll(path) == nil {
+		result.Removed++
+		result.Reclaimed += size
+	}
+}
+
+// Users that have any data stored. Directory names are already safe so
+// they can be used as the user names.
+func dataUsers() []string {
+	dir, err := os.Open(filepath.Join(godevDataDir(), "users"))
+	if err != nil {
+		return []string{}
+	}
+	defer dir.Close()
+
+	names, err := dir.Readdirnames(-1)
+	if err != nil {
+		return []string{}
+	}
+
+	return names
+}
+
+func gcDrafts(cutoff time.Time, result *GcResult) error {
+	userDataMutex.Lock()
+	defer userDataMutex.Unlock()
+
+	for _, user := range dataUsers() {
+		drafts := make(map[string]DraftInfo)
+		err := loadUserData(user, "drafts", &drafts)
+		if err != nil {
+			return err
+		}
+
+		keep := make(map[string]bool)
+		for location, draft := range drafts {
+			if draft.Saved < cutoff.Unix()*1000 {
+				gcRemove(draftFile(user, location), result)
+				delete(drafts, location)
+			} else {
+				keep[filepath.Base(draftFile(user, location))] = true
+			}
+		}
+
+		// Draft files that lost their entry in the index
+		draftsDir := filepath.Join(userDataDir(user), "drafts")
+		infos, _ := ioutil.ReadDir(draftsDir)
+		for _, info := range infos {
+			if !keep[info.Name()] {
+				gcRemove(filepath.Join(draftsDir, info.Name()), result)
+			}
+		}
+
+		err = saveUserData(user, "drafts", drafts)
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func gcHistory(cutoff time.Time, result *GcResult) error {
+	userDataMutex.Lock()
+	defer userDataMutex.Unlock()
+
+	for _, user := range dataUsers() {
+		data, err := loadRecent(user)
+		if err != nil {
+			return err
+		}
+
+		files := []RecentFile{}
+		for _, f := range data.Files {
+			if f.Pinned || f.Opened >= cutoff.Unix()*1000 || f.Edited >= cutoff.Unix()*1000 {
+				files = append(files, f)
+			} else {
+				result.Removed++
+			}
+		}
+
+		if len(files) == len(data.Files) {
+			continue
+		}
+
+		data.Files = files
+		err = saveUserData(user, "recent", data)
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// Creates a temporary directory that stays until removeTempDir, the
+// garbage collection doesn't take it away from under its session
+func newTempDir(prefix string) (string, error) {
+	dir, err := ioutil.TempDir("", prefix)
+	if err != nil {
+		return "", err
+	}
+
+	tempDirsMutex.Lock()
+	tempDirsInUse[dir] = true
+	tempDirsMutex.Unlock()
+
+	return dir, nil
+}
+
+func removeTempDir(dir string) error {
+	tempDirsMutex.Lock()
+	delete(tempDirsInUse, dir)
+	tempDirsMutex.Unlock()
+
+	return os.RemoveAll(dir)
+}
+
+// Build outputs, uploads and editor buffers left behind in the temp
+// directory by requests that never got to clean up.
+func gcTempFiles(cutoff time.Time, result *GcResult) error {
+	infos, err := ioutil.ReadDir(os.TempDir())
+	if err != nil {
+		return err
+	}
+
+	for _, info := range infos {
+		path := filepath.Join(os.TempDir(), info.Name())
+
+		tempDirsMutex.Lock()
+		inUse := tempDirsInUse[path]
+		tempDirsMutex.Unlock()
+
+		// The sockets of the FastCGI processes have a task of their own
+		if strings.HasPrefix(info.Name(), "godev-fcgi") {
+			continue
+		}
+
+		if strings.HasPrefix(info.Name(), "godev-") && info.ModTime().Before(cutoff) && !inUse {
+			gcRemove(path, result)
+		}
+	}
+
+	return nil
+}
+
+// Completed transfers leave an empty record behind
+func gcTransfers(cutoff time.Time, result *GcResult) error {
+	lock.Lock()
+	defer lock.Unlock()
+
+	for idx, info := range transfers {
+		if info == nil {
+			delete(transfers, idx)
+			result.Removed++
+		}
+	}
+
+	return nil
+}
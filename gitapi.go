@@ -4,15 +4,25 @@
 
 package main
 
-/*import (
+import (
+	"bytes"
+	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
+	"io"
+	"io/ioutil"
 	"net/http"
+	"net/url"
 	"os"
 	"os/exec"
+	"path/filepath"
 	"strconv"
 	"strings"
-	"time"
+)
+
+const (
+	gitLogPageSize = 20
 )
 
 type ConfigResponse struct {
@@ -44,7 +54,18 @@ type BranchInfo struct {
 	Location       string
 	Name           string
 	RemoteLocation []RemoteLocationInfo
-	Type           string
+	// The branch that it tracks and how far the branch is ahead and behind
+	//  of it, as of the last fetch
+	Upstream     string `json:",omitempty"`
+	Ahead        int
+	Behind       int
+	UpstreamGone bool `json:",omitempty"`
+	Type         string
+}
+
+type RemoteResponse struct {
+	Children []RemoteLocationInfo
+	Type     string
 }
 
 type RemoteLocationInfo struct {
@@ -70,19 +91,34 @@ type RemoteBranchInfo struct {
 }
 
 type StatusInfo struct {
-	Added           []string
-	Changed         []string
+	Added           []StatusEntry
+	Changed         []StatusEntry
 	CloneLocation   string
 	CommitLocation  string
-	Conflicting     []string
+	Conflicting     []StatusEntry
 	IndexLocation   string
 	Location        string
-	Missing         []string
-	Modified        []string
-	Removed         []string
+	Missing         []StatusEntry
+	Modified        []StatusEntry
+	Removed         []StatusEntry
 	RepositoryState string
 	Type            string
-	Untracked       []string
+	Untracked       []StatusEntry
+}
+
+// A file in one of the groups of the status
+type StatusEntry struct {
+	// Path relative to the repository
+	Name     string
+	Path     string
+	Location string
+	Git      StatusEntryGit
+}
+
+type StatusEntryGit struct {
+	CommitLocation string
+	DiffLocation   string
+	IndexLocation  string
 }
 
 type CloneInfo struct {
@@ -108,375 +144,1455 @@ type CloneDataResponse struct {
 }
 
 type PostCloneRequest struct {
+	Name   string
+	GitUrl string
+	// Workspace location of the directory to clone into, defaults to the
+	//  name in the first GOPATH
+	Path string
+}
+
+type CommitInfo struct {
+	Name            string
+	AuthorName      string
+	AuthorEmail     string
+	CommitterName   string
+	CommitterEmail  string
+	Time            int64
+	Message         string
+	Parents         []CommitParent
+	Diffs           []CommitDiff
+	Location        string
+	ContentLocation string
+	DiffLocation    string
+	CloneLocation   string
+	Type            string
+}
+
+type CommitParent struct {
 	Name     string
-	GitUrl   string
 	Location string
 }
 
-type LocationData struct {
+type CommitDiff struct {
+	// One of ADD, DELETE, MODIFY, RENAME or COPY
+	ChangeType      string
+	NewPath         string
+	OldPath         string
+	DiffLocation    string
+	ContentLocation string
+	Type            string
+}
+
+type LogResponse struct {
+	Children         []CommitInfo
+	CloneLocation    string
+	Location         string
+	RepositoryPath   string
+	NextLocation     string `json:",omitempty"`
+	PreviousLocation string `json:",omitempty"`
+	// Branch of the log, either a BranchInfo or a RemoteBranchInfo
+	ToRef interface{} `json:"toRef,omitempty"`
+	Type  string
+}
+
+// Locations of the sides of a diff for the compare editor
+type DiffUris struct {
+	Base     string
+	New      string
+	Old      string
 	Location string
+	Type     string
 }
 
-type ResultData struct {
-	Code     int
-	HttpCode int
-	JsonData LocationData
-	Message  string
-	Severity string
+type TagResponse struct {
+	Children []TagInfo
+	Type     string
 }
 
-type PostCloneResponse struct {
-	Location         string
-	Result           ResultData
-	Expires          int64  `json:"expires"`
-	LengthComputable bool   `json:"lengthComputable"`
-	Timestamp        int64  `json:"timestamp"`
-	Type             string `json:"type"`
+type TagInfo struct {
+	Name     string
+	FullName string
+	// The commit of the tag, and for an annotated tag who made it, when
+	//  and why
+	Commit         string
+	Annotated      bool
+	Signed         bool   `json:",omitempty"`
+	Message        string `json:",omitempty"`
+	TaggerName     string `json:",omitempty"`
+	TaggerEmail    string `json:",omitempty"`
+	Time           int64  `json:",omitempty"`
+	Location       string
+	CommitLocation string
+	CloneLocation  string
+	Type           string
 }
 
-func gitapiHandler(writer http.ResponseWriter, req *http.Request, path string, pathSegs []string) bool {
-	switch {
-	case req.Method == "POST" && len(pathSegs) > 4 && pathSegs[1] == "commit":
-		body := make(map[string]string)
-		dec := json.NewDecoder(req.Body)
-		err := dec.Decode(&body)
+// Body of the requests that act on a repository, only the fields of the
+// operation are present. The ssh credentials that Orion can send are
+// ignored, git uses those of the user running godev.
+type GitRequest struct {
+	// Other end of a log or diff range
+	New string
+
+	// Commit
+	Message        string
+	Amend          gitFlag
+	AuthorName     string
+	AuthorEmail    string
+	CommitterName  string
+	CommitterEmail string
+	SignOff        gitFlag
+	// Co-authored-by trailers, each "Name <email>"
+	CoAuthors []string
+
+	// Hunks of the file to stage or unstage instead of the whole file
+	Hunks []HunkSelection
+
+	// Checkout and branch creation
+	Name            string
+	Branch          string
+	Tag             string
+	Path            []string
+	RemoveUntracked gitFlag
+
+	// Reset of the index
+	Reset  string
+	Commit string
+
+	// Remotes
+	Remote     string
+	RemoteURI  string
+	Fetch      gitFlag
+	Pull       gitFlag
+	PushSrcRef string
+	PushTags   gitFlag
+	Force      gitFlag
+
+	// Tags: an annotated tag has a Message, a signed one is signed with the
+	//  armored private key of the SigningKey secret or else the default key
+	//  of the server. The SigningPassphrase secret unlocks the key.
+	Sign              gitFlag
+	SigningKey        string
+	SigningPassphrase string
+
+	// Patches: the workspace location of a patch or mailbox to apply, or
+	//  the Operation, continue or skip, of an apply that stopped at a patch
+	Patch     string
+	Operation string
+
+	// Bisect: the commits that start it, or the Term (good, bad or skip)
+	//  that marks the Commit. A run tests each step with the Test or the
+	//  Command.
+	Bad     string
+	Good    []string
+	Term    string
+	Test    *GoTestRequest
+	Command *ShellRequest
+}
 
-		if err != nil {
-			ShowError(writer, 400, "Invalid input", err)
-			return true
-		}
+// Flag that Orion sends either as a boolean or as a string
+type gitFlag bool
+
+func (f *gitFlag) UnmarshalJSON(b []byte) error {
+	*f = gitFlag(strings.Trim(string(b), `"`) == "true")
+	return nil
+}
 
-		if body["New"] != "" {
-			response := make(map[string]string)
-			branch := pathSegs[2]
-			branch = strings.Replace(branch, "%", "%25", -1)
-			otherBranch := body["New"]
+// Repository of a workspace location and the file or directory within it
+type gitTarget struct {
+	// Directory of the repository on disk
+	dir string
+	// Workspace location of the repository, e.g. /file/github.com/user/project
+	location string
+	// Slash separated path relative to the repository, empty for the whole
+	//  repository
+	name string
+}
 
-			response["Location"] = "/gitapi/commit/" + branch + ".." + otherBranch + "/" + strings.Join(pathSegs[3:], "/")
+// Workspace location of the target
+func (t gitTarget) fileLocation() string {
+	if t.name == "" {
+		return t.location
+	}
 
-			writer.Header().Add("Location", response["Location"])
+	return t.location + "/" + t.name
+}
 
-			ShowJson(writer, 200, response)
-			return true
+// Path argument of git commands for the target
+func (t gitTarget) pathspec() string {
+	if t.name == "" {
+		return "."
+	}
+
+	return t.name
+}
+
+func (t gitTarget) cloneLocation() string {
+	return "/gitapi/clone" + t.location
+}
+
+// Finds the repository of a workspace location given as path segments
+// starting with "file". The file itself doesn't have to exist so that
+// deleted files can be staged.
+func resolveGitTarget(srcDirs []string, segs []string) (gitTarget, error) {
+	if len(segs) < 2 || segs[0] != "file" {
+		return gitTarget{}, errors.New("Not a workspace location: /" + strings.Join(segs, "/"))
+	}
+
+	relPath := filepath.Clean("/" + strings.Join(segs[1:], "/"))
+
+	for _, srcDir := range srcDirs {
+		if strings.HasPrefix(srcDir, goroot) {
+			continue
 		}
-	case req.Method == "GET" && len(pathSegs) > 4 && pathSegs[1] == "config":
-		if pathSegs[2] == "clone" {
-			response := ConfigResponse{}
-			response.Type = "Config"
 
-			loc := strings.Join(pathSegs[4:], "/")
+		p := filepath.Join(srcDir, relPath)
+		for dir := p; dir != srcDir && strings.HasPrefix(dir, srcDir); dir = filepath.Dir(dir) {
+			if _, err := os.Stat(filepath.Join(dir, ".git")); err != nil {
+				continue
+			}
+
+			target := gitTarget{dir: dir, location: workspaceLocation(dir)}
+			if dir != p {
+				target.name = filepath.ToSlash(p[len(dir)+1:])
+			}
+			return target, nil
+		}
+	}
+
+	return gitTarget{}, errors.New("No git repository at /" + strings.Join(segs, "/"))
+}
 
-			configCmd := exec.Command("git", "config", "-l")
-			configCmd.Dir = gopath + "/src/" + loc
-			configOutput, err := configCmd.Output()
+// Splits the path of /gitapi/<kind>/<params...>/file/<path> into the
+// unescaped parameters and the target in the workspace of the request
+func gitapiParams(req *http.Request, pathSegs []string) ([]string, gitTarget, error) {
+	for idx := 2; idx < len(pathSegs); idx++ {
+		if pathSegs[idx] != "file" {
+			continue
+		}
 
+		params := []string{}
+		for _, seg := range pathSegs[2:idx] {
+			param, err := url.PathUnescape(seg)
 			if err != nil {
-				ShowError(writer, 500, "Git config command files", err)
-				return true
+				return nil, gitTarget{}, err
+			}
+			if strings.HasPrefix(param, "-") {
+				return nil, gitTarget{}, errors.New("Invalid name: " + param)
 			}
+			params = append(params, param)
+		}
+
+		target, err := resolveGitTarget(requestSrcDirs(req), pathSegs[idx:])
+		return params, target, err
+	}
 
-			configOutputStr := string(configOutput)
-			configOutputStr = strings.Replace(configOutputStr, "\r", "", -1)
-			entryList := strings.Split(configOutputStr, "\n")
+	return nil, gitTarget{}, errors.New("Missing workspace location")
+}
 
-			fmt.Printf("[%v]\n", loc)
+// Ref or name in a location, escaped twice so that slashes survive the
+// decoding of the path
+func gitRefSeg(ref string) string {
+	return strings.Replace(url.PathEscape(ref), "%", "%25", -1)
+}
 
-			response.Children = make([]ConfigItemInfo, len(entryList)-1, len(entryList)-1)
+func runGit(ctx context.Context, dir string, args ...string) ([]byte, error) {
+	return runGitInput(ctx, dir, nil, args...)
+}
 
-			for idx, entry := range entryList[:len(entryList)-1] {
-				info := ConfigItemInfo{}
-				info.Type = "Config"
+// Runs git with the input on its standard input, e.g. a patch to apply
+func runGitInput(ctx context.Context, dir string, input []byte, args ...string) ([]byte, error) {
+	return runGitEnv(ctx, dir, nil, input, args...)
+}
 
-				keyValue := strings.Split(entry, "=")
-				info.Key = keyValue[0]
-				info.Value = keyValue[1]
+// Runs git with variables added to its environment
+func runGitEnv(ctx context.Context, dir string, env []string, input []byte, args ...string) ([]byte, error) {
+	cmd := exec.CommandContext(ctx, "git", args...)
+	cmd.Dir = dir
+	if input != nil {
+		cmd.Stdin = bytes.NewReader(input)
+	}
+	// Fail instead of waiting for credentials that nobody can type
+	cmd.Env = append(append(os.Environ(), "GIT_TERMINAL_PROMPT=0"), env...)
 
-				info.Location = "/gitapi/config/" + info.Key + "/clone/file/" + loc
-				info.CloneLocation = "/gitapi/clone/file/" + loc
+	stderr := &bytes.Buffer{}
+	cmd.Stderr = stderr
 
-				response.Children[idx] = info
-			}
+	out, err := cmd.Output()
+	if err != nil {
+		return out, fmt.Errorf("git %v: %v %v", args[0], err, strings.TrimSpace(stderr.String()))
+	}
 
-			ShowJson(writer, 200, response)
-			return true
-		} else if pathSegs[3] == "clone" {
-			//param := pathSegs[2]
+	return out, nil
+}
 
+// Checks the names that the requests pass on to git
+func validGitNames(names ...string) error {
+	for _, name := range names {
+		if strings.HasPrefix(name, "-") {
+			return errors.New("Invalid name: " + name)
 		}
-	case req.Method == "GET" && len(pathSegs) > 3 && pathSegs[1] == "branch":
-		response := BranchResponse{Type: "Branch"}
+	}
+
+	return nil
+}
 
-		name := strings.Join(pathSegs[3:], "/")
+// Remote URL without the credentials that are sometimes kept in it
+func gitUrlWithoutUser(remote string) string {
+	u, err := url.Parse(remote)
+	if err != nil || u.User == nil {
+		return remote
+	}
+	u.User = nil
 
-		branchCmd := exec.Command("git", "branch")
-		branchCmd.Dir = gopath + "/src/" + name
-		branchOutput, err := branchCmd.Output()
+	return u.String()
+}
 
-		if err != nil {
-			ShowError(writer, 500, "Git branch command failed", err)
-			return true
+// Git directory of a repository, which a worktree names in its .git file
+func gitDir(dir string) string {
+	dotGit := filepath.Join(dir, ".git")
+
+	b, err := ioutil.ReadFile(dotGit)
+	if err != nil || !strings.HasPrefix(string(b), "gitdir: ") {
+		return dotGit
+	}
+
+	gitdir := filepath.FromSlash(strings.TrimSpace(strings.TrimPrefix(string(b), "gitdir: ")))
+	if !filepath.IsAbs(gitdir) {
+		gitdir = filepath.Join(dir, gitdir)
+	}
+	return gitdir
+}
+
+// Name of the current branch, read from the HEAD file since this is asked
+// for every repository in a directory listing. It is HEAD when detached.
+func gitCurrentBranch(dir string) string {
+	head, err := ioutil.ReadFile(filepath.Join(gitDir(dir), "HEAD"))
+	if err != nil {
+		return "HEAD"
+	}
+
+	ref := strings.TrimSpace(string(head))
+	if !strings.HasPrefix(ref, "ref: refs/heads/") {
+		return "HEAD"
+	}
+
+	return strings.TrimPrefix(ref, "ref: refs/heads/")
+}
+
+func cloneInfo(ctx context.Context, dir string) CloneInfo {
+	loc := workspaceLocation(dir)
+
+	info := CloneInfo{Type: "Clone", Name: filepath.Base(dir)}
+	info.BranchLocation = "/gitapi/branch" + loc
+	info.CommitLocation = "/gitapi/commit/" + gitRefSeg(gitCurrentBranch(dir)) + loc
+	info.ConfigLocation = "/gitapi/config/clone" + loc
+	info.ContentLocation = loc + "/"
+	info.DiffLocation = "/gitapi/diff/Default" + loc
+	info.HeadLocation = "/gitapi/commit/HEAD" + loc
+	info.IndexLocation = "/gitapi/index" + loc
+	info.Location = "/gitapi/clone" + loc
+	info.RemoteLocation = "/gitapi/remote" + loc
+	info.StatusLocation = "/gitapi/status" + loc
+	info.TagLocation = "/gitapi/tag" + loc
+
+	// Repositories without an origin don't have a URL
+	if out, err := runGit(ctx, dir, "config", "--get", "remote.origin.url"); err == nil {
+		gitUrl := gitUrlWithoutUser(strings.TrimSpace(string(out)))
+		info.GitUrl = &gitUrl
+	}
+
+	return info
+}
+
+// Repositories of the workspace, which are found at the usual depth of
+// GOPATH projects
+func workspaceClones(srcDirs []string) []string {
+	dirs := []string{}
+
+	for _, srcDir := range srcDirs {
+		if strings.HasPrefix(srcDir, goroot) {
+			continue
 		}
 
-		branchOutputStr := string(branchOutput)
-		branchOutputStr = strings.Replace(branchOutputStr, "\r", "", -1)
-		branches := strings.Split(branchOutputStr, "\n")
+		filepath.Walk(srcDir, func(p string, info os.FileInfo, err error) error {
+			if err != nil || !info.IsDir() {
+				return nil
+			}
+			if p != srcDir && strings.HasPrefix(info.Name(), ".") {
+				return filepath.SkipDir
+			}
+
+			if _, err := os.Stat(filepath.Join(p, ".git")); err == nil {
+				dirs = append(dirs, p)
+				return filepath.SkipDir
+			}
 
-		if branchOutputStr != "" {
-			response.Children = make([]BranchInfo, len(branches)-1, len(branches)-1)
+			if strings.Count(p[len(srcDir):], string(filepath.Separator)) >= 3 {
+				return filepath.SkipDir
+			}
 
-			for idx, branch := range branches[:len(branches)-1] {
-				branchInfo := BranchInfo{Type: "Branch"}
+			return nil
+		})
+	}
 
-				if strings.Contains(branch, "* ") {
-					branchInfo.Current = true
-					branch = strings.Replace(branch, "* ", "", 1)
-				}
+	return dirs
+}
 
-				branchInfo.CloneLocation = "/gitapi/clone/file/" + name
+func statusEntry(target gitTarget, name string, diffScope string) StatusEntry {
+	entry := StatusEntry{Name: name, Path: name, Location: target.location + "/" + name}
+	entry.Git.CommitLocation = "/gitapi/commit/HEAD" + entry.Location
+	entry.Git.DiffLocation = "/gitapi/diff/" + diffScope + entry.Location
+	entry.Git.IndexLocation = "/gitapi/index" + entry.Location
 
-				showRefCmd := exec.Command("git", "show-ref", branch, "--heads")
-				showRefCmd.Dir = gopath + "/src/" + name
-				showRefOutput, err := showRefCmd.Output()
+	return entry
+}
 
-				if err != nil {
-					ShowError(writer, 500, "Error running git show-ref command: "+string(branch), err)
-					return true
-				}
+func gitStatus(ctx context.Context, target gitTarget) (StatusInfo, error) {
+	status := StatusInfo{Type: "Status", RepositoryState: "SAFE"}
+	status.CloneLocation = target.cloneLocation()
+	status.CommitLocation = "/gitapi/commit/HEAD" + target.location
+	status.IndexLocation = "/gitapi/index" + target.location
+	status.Location = "/gitapi/status" + target.fileLocation()
+
+	status.Added = []StatusEntry{}
+	status.Changed = []StatusEntry{}
+	status.Conflicting = []StatusEntry{}
+	status.Missing = []StatusEntry{}
+	status.Modified = []StatusEntry{}
+	status.Removed = []StatusEntry{}
+	status.Untracked = []StatusEntry{}
+
+	out, err := runGit(ctx, target.dir, "status", "--porcelain", "-z", "--untracked-files=all", "--", target.pathspec())
+	if err != nil {
+		return status, err
+	}
+
+	records := strings.Split(string(out), "\x00")
+	for idx := 0; idx < len(records); idx++ {
+		record := records[idx]
+		if len(record) < 4 {
+			continue
+		}
+		x, y, name := record[0], record[1], record[3:]
+
+		switch {
+		case x == '?':
+			status.Untracked = append(status.Untracked, statusEntry(target, name, "Default"))
+			continue
+		case x == 'U' || y == 'U' || (x == 'A' && y == 'A') || (x == 'D' && y == 'D'):
+			status.Conflicting = append(status.Conflicting, statusEntry(target, name, "Default"))
+			continue
+		}
 
-				branchFullName := string(showRefOutput)
-				branchFullName = strings.Replace(branchFullName, "\n", "", 1)
-				branchFullName = strings.Replace(branchFullName, "\r", "", 1)
-				branchFullName = strings.Split(branchFullName, " ")[1]
+		switch x {
+		case 'A', 'C':
+			status.Added = append(status.Added, statusEntry(target, name, "Cached"))
+		case 'M', 'T':
+			status.Changed = append(status.Changed, statusEntry(target, name, "Cached"))
+		case 'D':
+			status.Removed = append(status.Removed, statusEntry(target, name, "Cached"))
+		case 'R':
+			// The original name follows the renamed one
+			status.Added = append(status.Added, statusEntry(target, name, "Cached"))
+			idx++
+			if idx < len(records) {
+				status.Removed = append(status.Removed, statusEntry(target, records[idx], "Cached"))
+			}
+		}
 
-				branchInfo.CommitLocation = "/gitapi/commit/" + branchFullName + "/file/" + name
-				branchInfo.DiffLocation = "/gitapi/diff/" + branch + "/file/" + name
-				branchInfo.FullName = branchFullName
-				branchInfo.HeadLocation = "/gitapi/commit/HEAD/file/" + name
-				branchInfo.Location = "/gitapi/branch/" + branch + "/file/" + name
-				branchInfo.Name = branch
+		switch y {
+		case 'M', 'T':
+			status.Modified = append(status.Modified, statusEntry(target, name, "Default"))
+		case 'D':
+			status.Missing = append(status.Missing, statusEntry(target, name, "Default"))
+		}
+	}
 
-				showBranchCmd := exec.Command("git", "show", "--pretty=format:%at", "--summary", branch)
-				showBranchCmd.Dir = gopath + "/src/" + name
-				showBranch, err := showBranchCmd.Output()
+	if _, err := os.Stat(filepath.Join(target.dir, ".git", "MERGE_HEAD")); err == nil {
+		status.RepositoryState = "MERGING"
+	}
+	if _, err := os.Stat(filepath.Join(target.dir, ".git", "rebase-merge")); err == nil {
+		status.RepositoryState = "REBASING_MERGE"
+	}
+	// Patches of git am that stopped at a conflict
+	if _, err := os.Stat(filepath.Join(gitDir(target.dir), "rebase-apply", "applying")); err == nil {
+		status.RepositoryState = "APPLY"
+	}
 
-				if err != nil {
-					ShowError(writer, 500, "Error running git show command: "+string(showBranch), err)
-					return true
-				}
+	return status, nil
+}
 
-				ts := string(showBranch)
-				ts = strings.Split(ts, "\n")[0]
-				ts = strings.Replace(ts, "\r", "", -1)
+// The commits of a log, each with the files that it changed. Only the
+// changes of the target are listed when it isn't the whole repository.
+func gitLog(ctx context.Context, target gitTarget, args ...string) ([]CommitInfo, error) {
+	args = append([]string{"log", "-z", "-M", "--name-status", "--format=%x1e%H%x1f%P%x1f%an%x1f%ae%x1f%cn%x1f%ce%x1f%ct%x1f%B%x1f"}, args...)
+	args = append(args, "--", target.pathspec())
 
-				timestamp, err := strconv.ParseInt(ts, 10, 64)
+	out, err := runGit(ctx, target.dir, args...)
+	if err != nil {
+		return nil, err
+	}
 
-				if err != nil {
-					ShowError(writer, 500, "Error parsing git show command results", err)
-					return true
-				}
+	commits := []CommitInfo{}
+	for _, record := range strings.Split(string(out), "\x1e")[1:] {
+		fields := strings.Split(record, "\x1f")
+		if len(fields) < 9 {
+			continue
+		}
 
-				branchInfo.LocalTimeStamp = timestamp * 1000
+		commit := CommitInfo{Type: "Commit", Name: fields[0], AuthorName: fields[2], AuthorEmail: fields[3],
+			CommitterName: fields[4], CommitterEmail: fields[5], Message: strings.TrimSpace(fields[7])}
+		t, _ := strconv.ParseInt(fields[6], 10, 64)
+		commit.Time = t * 1000
+		commit.Location = "/gitapi/commit/" + commit.Name + target.location
+		commit.ContentLocation = "/gitapi/commit/" + commit.Name + target.fileLocation() + "?parts=body"
+		commit.DiffLocation = "/gitapi/diff/" + commit.Name + target.location
+		commit.CloneLocation = target.cloneLocation()
+
+		commit.Parents = []CommitParent{}
+		for _, parent := range strings.Fields(fields[1]) {
+			commit.Parents = append(commit.Parents, CommitParent{parent, "/gitapi/commit/" + parent + target.location})
+		}
 
-				remotesCmd := exec.Command("git", "remote")
-				remotesCmd.Dir = gopath + "/src/" + name
-				remotesOutput, err := remotesCmd.Output()
+		base := commit.Name + "^"
+		if len(commit.Parents) == 0 {
+			// Diff of the root commit against the empty tree
+			base = "4b825dc642cb6eb9a060e54bf8d69288fbee4904"
+		}
 
-				if err != nil {
-					ShowError(writer, 500, "Error running git remote command", err)
-					return true
+		commit.Diffs = []CommitDiff{}
+		changes := strings.Split(strings.TrimLeft(fields[8], "\x00\n"), "\x00")
+		for idx := 0; idx+1 < len(changes); idx += 2 {
+			diff := CommitDiff{Type: "Diff", OldPath: changes[idx+1], NewPath: changes[idx+1]}
+
+			switch changes[idx][0] {
+			case 'A':
+				diff.ChangeType = "ADD"
+			case 'D':
+				diff.ChangeType = "DELETE"
+			case 'R', 'C':
+				diff.ChangeType = "RENAME"
+				if changes[idx][0] == 'C' {
+					diff.ChangeType = "COPY"
+				}
+				idx++
+				if idx+1 < len(changes) {
+					diff.NewPath = changes[idx+1]
 				}
+			default:
+				diff.ChangeType = "MODIFY"
+			}
+
+			diff.DiffLocation = "/gitapi/diff/" + base + ".." + commit.Name + target.location + "/" + diff.NewPath
+			diff.ContentLocation = target.location + "/" + diff.NewPath
+			commit.Diffs = append(commit.Diffs, diff)
+		}
+
+		commits = append(commits, commit)
+	}
+
+	return commits, nil
+}
+
+func gitBranches(ctx context.Context, target gitTarget, pattern string) ([]BranchInfo, error) {
+	out, err := runGit(ctx, target.dir, "for-each-ref", "--format=%(refname:short)%00%(refname)%00%(committerdate:unix)%00%(HEAD)%00%(upstream:short)%00%(upstream:track,nobracket)", pattern)
+	if err != nil {
+		return nil, err
+	}
+
+	remotes, err := gitRemotes(ctx, target)
+	if err != nil {
+		return nil, err
+	}
+
+	// Each remote with its tracking branches
+	for idx, remote := range remotes {
+		remotes[idx].Children, err = gitRemoteBranches(ctx, target, remote.Name, "")
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	branches := []BranchInfo{}
+	for _, line := range strings.Split(strings.TrimSpace(string(out)), "\n") {
+		fields := strings.Split(line, "\x00")
+		// Patterns match whole path components, so refs/heads/a also
+		//  matches refs/heads/a/b
+		if len(fields) != 6 || !strings.HasSuffix(pattern, "/") && fields[1] != pattern {
+			continue
+		}
 
-				remotesStr := string(remotesOutput)
-				remotesStr = strings.Replace(remotesStr, "\r", "", -1)
-				remotes := strings.Split(remotesStr, "\n")
-
-				branchInfo.RemoteLocation = make([]RemoteLocationInfo, len(remotes)-1, len(remotes)-1)
-				for remoteIdx, remote := range remotes[:len(remotes)-1] {
-					remoteLocInfo := RemoteLocationInfo{Type: "Remote"}
-
-					remoteLocInfo.CloneLocation = "/gitapi/clone/file/" + name
-
-					configCmd := exec.Command("git", "config", "--get", "remote."+remote+".url")
-					configCmd.Dir = gopath + "/src/" + name
-					configOutput, err := configCmd.Output()
-
-					if err != nil {
-						ShowError(writer, 500, "Error running git config command", err)
-						return true
-					}
-
-					remoteLocInfo.GitUrl = string(configOutput)
-					remoteLocInfo.Location = "/gitapi/remote/" + remote + "/file/" + name
-					remoteLocInfo.Name = remote
-
-					remoteBranchIdCmd := exec.Command("git", "branch", "-r", "-v", "--list", "--no-abbrev", remote+"/"+branch)
-					remoteBranchIdCmd.Dir = gopath + "/src/" + name
-					remoteBranchIdOut, err := remoteBranchIdCmd.Output()
-
-					if err != nil {
-						ShowError(writer, 500, "Error running git branch command", err)
-						return true
-					}
-
-					remoteLocInfo.Children = make([]RemoteBranchInfo, 1, 1)
-					remoteBranchInfo := RemoteBranchInfo{Type: "RemoteTrackingBranch"}
-					remoteBranchInfo.Id = strings.Split(string(remoteBranchIdOut), " ")[2]
-					remoteBranchInfo.CloneLocation = "/gitapi/clone/file/" + name
-					remoteBranchInfo.CommitLocation = "/gitapi/commit/refs%252Fremotes%252F" + remote + "%252F" + branch + "/file/" + name
-					remoteBranchInfo.DiffLocation = "/gitapi/diff/" + remote + "%252F" + branch + "/file/" + name
-					remoteBranchInfo.FullName = "refs/remotes/" + remote + "/" + name
-					remoteBranchInfo.HeadLocation = "/gitapi/commit/HEAD/file/" + name
-					remoteBranchInfo.IndexLocation = "/gitapi/index/file/" + name
-					remoteBranchInfo.Location = "/gitapi/remote/" + remote + "/" + branch + "/file/" + name
-					remoteBranchInfo.Name = remote + "/" + branch
-
-					remoteLocInfo.Children[0] = remoteBranchInfo
-
-					branchInfo.RemoteLocation[remoteIdx] = remoteLocInfo
+		branch := BranchInfo{Type: "Branch", Name: fields[0], FullName: fields[1], Current: fields[3] == "*", Upstream: fields[4]}
+		branch.Ahead, branch.Behind, branch.UpstreamGone = parseUpstreamTrack(fields[5])
+		t, _ := strconv.ParseInt(fields[2], 10, 64)
+		branch.LocalTimeStamp = t * 1000
+		branch.CloneLocation = target.cloneLocation()
+		branch.CommitLocation = "/gitapi/commit/" + gitRefSeg(branch.FullName) + target.location
+		branch.DiffLocation = "/gitapi/diff/" + gitRefSeg(branch.Name) + target.location
+		branch.HeadLocation = "/gitapi/commit/HEAD" + target.location
+		branch.Location = "/gitapi/branch/" + gitRefSeg(branch.Name) + target.location
+
+		// The remote tracking branch of the same name in each remote
+		branch.RemoteLocation = []RemoteLocationInfo{}
+		for _, remote := range remotes {
+			tracking := remote
+			tracking.Children = []RemoteBranchInfo{}
+			for _, remoteBranch := range remote.Children {
+				if remoteBranch.Name == remote.Name+"/"+branch.Name {
+					tracking.Children = append(tracking.Children, remoteBranch)
 				}
+			}
+			branch.RemoteLocation = append(branch.RemoteLocation, tracking)
+		}
+
+		branches = append(branches, branch)
+	}
+
+	return branches, nil
+}
+
+func gitRemotes(ctx context.Context, target gitTarget) ([]RemoteLocationInfo, error) {
+	out, err := runGit(ctx, target.dir, "remote", "-v")
+	if err != nil {
+		return nil, err
+	}
+
+	remotes := []RemoteLocationInfo{}
+	for _, line := range strings.Split(string(out), "\n") {
+		fields := strings.Fields(line)
+		if len(fields) != 3 || fields[2] != "(fetch)" {
+			continue
+		}
+
+		remote := RemoteLocationInfo{Type: "Remote", Name: fields[0], GitUrl: gitUrlWithoutUser(fields[1]), Children: []RemoteBranchInfo{}}
+		remote.CloneLocation = target.cloneLocation()
+		remote.Location = "/gitapi/remote/" + gitRefSeg(remote.Name) + target.location
+		remotes = append(remotes, remote)
+	}
+
+	return remotes, nil
+}
+
+// Remote tracking branches of the remote, only the one of the branch name
+// unless it is empty
+func gitRemoteBranches(ctx context.Context, target gitTarget, remote string, branch string) ([]RemoteBranchInfo, error) {
+	pattern := "refs/remotes/" + remote + "/"
+	if branch != "" {
+		pattern = pattern + branch
+	}
+
+	out, err := runGit(ctx, target.dir, "for-each-ref", "--format=%(refname)%00%(objectname)", pattern)
+	if err != nil {
+		return nil, err
+	}
+
+	branches := []RemoteBranchInfo{}
+	for _, line := range strings.Split(strings.TrimSpace(string(out)), "\n") {
+		fields := strings.Split(line, "\x00")
+		if len(fields) != 2 || strings.HasSuffix(fields[0], "/HEAD") || branch != "" && fields[0] != pattern {
+			continue
+		}
+
+		name := strings.TrimPrefix(fields[0], "refs/remotes/")
+		info := RemoteBranchInfo{Type: "RemoteTrackingBranch", Name: name, FullName: fields[0], Id: fields[1]}
+		info.CloneLocation = target.cloneLocation()
+		info.CommitLocation = "/gitapi/commit/" + gitRefSeg(info.FullName) + target.location
+		info.DiffLocation = "/gitapi/diff/" + gitRefSeg(name) + target.location
+		info.HeadLocation = "/gitapi/commit/HEAD" + target.location
+		info.IndexLocation = "/gitapi/index" + target.location
+		info.Location = "/gitapi/remote/" + gitRefSeg(remote) + "/" + gitRefSeg(strings.TrimPrefix(name, remote+"/")) + target.location
+		branches = append(branches, info)
+	}
+
+	return branches, nil
+}
+
+// Branch of a ref for the header of the log, nil for commits and tags
+func gitLogRef(ctx context.Context, target gitTarget, ref string) interface{} {
+	out, err := runGit(ctx, target.dir, "rev-parse", "--symbolic-full-name", ref)
+	if err != nil {
+		return nil
+	}
+	fullName := strings.TrimSpace(string(out))
+
+	switch {
+	case strings.HasPrefix(fullName, "refs/heads/"):
+		branches, err := gitBranches(ctx, target, fullName)
+		if err == nil && len(branches) == 1 {
+			return branches[0]
+		}
+	case strings.HasPrefix(fullName, "refs/remotes/"):
+		name := strings.SplitN(strings.TrimPrefix(fullName, "refs/remotes/"), "/", 2)
+		if len(name) != 2 {
+			return nil
+		}
+		branches, err := gitRemoteBranches(ctx, target, name[0], name[1])
+		if err == nil && len(branches) == 1 {
+			return branches[0]
+		}
+	}
+
+	return nil
+}
+
+// Sides of a diff scope, which is Default for the working tree against
+// the index, Cached for the index against HEAD, a commit for the working
+// tree against it or a range of two commits.
+func diffUris(scope string, target gitTarget) DiffUris {
+	loc := target.fileLocation()
+	uris := DiffUris{Type: "Diff", Location: "/gitapi/diff/" + gitRefSeg(scope) + loc}
+
+	switch {
+	case scope == "Default":
+		uris.Old = "/gitapi/index" + loc
+		uris.New = loc
+	case scope == "Cached":
+		uris.Old = "/gitapi/commit/HEAD" + loc + "?parts=body"
+		uris.New = "/gitapi/index" + loc
+	case strings.Contains(scope, ".."):
+		commits := strings.SplitN(scope, "..", 2)
+		uris.Old = "/gitapi/commit/" + gitRefSeg(commits[0]) + loc + "?parts=body"
+		uris.New = "/gitapi/commit/" + gitRefSeg(commits[1]) + loc + "?parts=body"
+	default:
+		uris.Old = "/gitapi/commit/" + gitRefSeg(scope) + loc + "?parts=body"
+		uris.New = loc
+	}
+	uris.Base = uris.Old
+
+	return uris
+}
+
+func diffArgs(scope string) ([]string, error) {
+	switch {
+	case scope == "Default":
+		return []string{"diff"}, nil
+	case scope == "Cached":
+		return []string{"diff", "--cached"}, nil
+	case strings.Contains(scope, ".."):
+		commits := strings.SplitN(scope, "..", 2)
+		return []string{"diff", commits[0], commits[1]}, validGitNames(commits...)
+	}
+
+	return []string{"diff", scope}, validGitNames(scope)
+}
 
-				response.Children[idx] = branchInfo
+// Location of the range between a ref in the path and another one, e.g.
+// for the log of what a remote branch has that the local one doesn't
+func showRangeLocation(writer http.ResponseWriter, kind string, ref string, other string, target gitTarget) {
+	location := "/gitapi/" + kind + "/" + gitRefSeg(ref) + ".." + gitRefSeg(other) + target.fileLocation()
+
+	writer.Header().Add("Location", location)
+	ShowJson(writer, 200, map[string]string{"Location": location})
+}
+
+// Clones a repository into the workspace, or creates an empty one when
+// there is no URL
+func postClone(ctx context.Context, writer http.ResponseWriter, req *http.Request) {
+	clone := PostCloneRequest{}
+	err := json.NewDecoder(req.Body).Decode(&clone)
+	if err != nil {
+		ShowError(writer, 400, "Invalid input", err)
+		return
+	}
+
+	if clone.Name == "" && clone.GitUrl != "" {
+		clone.Name = strings.TrimSuffix(filepath.Base(clone.GitUrl), ".git")
+	}
+	if err = validGitNames(clone.Name, clone.GitUrl); err != nil || clone.Name == "" || strings.ContainsAny(clone.Name, `/\`) || clone.Name == ".." {
+		ShowError(writer, 400, "Invalid repository name", err)
+		return
+	}
+
+	dir := ""
+	if clone.Path != "" {
+		dir, err = shellDir(requestSrcDirs(req), clone.Path)
+		if err != nil {
+			ShowError(writer, 400, err.Error(), nil)
+			return
+		}
+		dir = filepath.Join(dir, clone.Name)
+	} else {
+		for _, srcDir := range requestSrcDirs(req) {
+			if !strings.HasPrefix(srcDir, goroot) {
+				dir = filepath.Join(srcDir, clone.Name)
+				break
 			}
+		}
+	}
+	if dir == "" {
+		ShowError(writer, 500, "There is no GOPATH to clone into", nil)
+		return
+	}
+
+	if clone.GitUrl != "" {
+		_, err = runGit(ctx, filepath.Dir(dir), "clone", "--", clone.GitUrl, dir)
+	} else {
+		_, err = runGit(ctx, filepath.Dir(dir), "init", "--", dir)
+	}
+	if err != nil {
+		ShowError(writer, 500, "Unable to create the repository", err)
+		return
+	}
+
+	if location := workspaceLocation(dir); filepath.Dir(location) == "/file" {
+		// A new project of the workspace
+		startOnboarding(requestUser(req), dir, location)
+	}
+
+	ShowJson(writer, 201, map[string]string{"Location": "/gitapi/clone" + workspaceLocation(dir)})
+}
+
+// Orion's git service, backed by the git command in the repositories of
+// the GOPATH. Locations have the form /gitapi/<kind>/<params...>/file/<path>.
+func gitapiHandler(writer http.ResponseWriter, req *http.Request, path string, pathSegs []string) bool {
+	if len(pathSegs) < 2 {
+		return false
+	}
+
+	ctx, cancel := operationContext(req, *gitTimeout)
+	defer cancel()
+
+	// Creating a repository has a body of its own
+	if req.Method == "POST" && len(pathSegs) <= 3 && pathSegs[1] == "clone" {
+		postClone(ctx, writer, req)
+		return true
+	}
+
+	request := GitRequest{}
+	if req.Method == "POST" || req.Method == "PUT" {
+		// Some operations have no body
+		err := json.NewDecoder(req.Body).Decode(&request)
+		if err != nil && err != io.EOF {
+			ShowError(writer, 400, "Invalid input", err)
+			return true
+		}
+	}
+
+	switch {
+	case len(pathSegs) > 3 && pathSegs[1] == "worktrees":
+		return worktreesRequest(ctx, writer, req, pathSegs, request)
+	case len(pathSegs) > 3 && pathSegs[1] == "bisect":
+		return bisectRequest(ctx, writer, req, pathSegs, request)
+	case len(pathSegs) > 3 && pathSegs[1] == "tag":
+		return tagRequest(ctx, writer, req, pathSegs, request)
+	case len(pathSegs) > 3 && pathSegs[1] == "patch":
+		return patchRequest(ctx, writer, req, pathSegs, request)
+	case len(pathSegs) > 3 && pathSegs[1] == "lfs":
+		return lfsRequest(ctx, writer, req, pathSegs, request)
+	case len(pathSegs) > 3 && pathSegs[1] == "commitmessage":
+		return commitMessageRequest(ctx, writer, req, pathSegs, request)
+	case req.Method == "GET" && len(pathSegs) > 2 && pathSegs[1] == "clone" && pathSegs[2] == "workspace":
+		response := CloneDataResponse{Type: "Clone", Children: []CloneInfo{}}
+		for _, dir := range workspaceClones(requestSrcDirs(req)) {
+			response.Children = append(response.Children, cloneInfo(ctx, dir))
+		}
+
+		ShowJson(writer, 200, response)
+		return true
+	case req.Method == "GET" && len(pathSegs) > 3 && pathSegs[1] == "clone":
+		response := CloneDataResponse{Type: "Clone", Children: []CloneInfo{}}
+
+		target, err := resolveGitTarget(requestSrcDirs(req), pathSegs[2:])
+		if err == nil {
+			response.Children = append(response.Children, cloneInfo(ctx, target.dir))
 		} else {
-			response.Children = make([]BranchInfo, 0, 0)
+			// The repositories within a folder that isn't one
+			prefix := filepath.Clean("/"+strings.Join(pathSegs[3:], "/")) + "/"
+			for _, dir := range workspaceClones(requestSrcDirs(req)) {
+				if strings.HasPrefix(workspaceLocation(dir)+"/", "/file"+prefix) {
+					response.Children = append(response.Children, cloneInfo(ctx, dir))
+				}
+			}
 		}
 
 		ShowJson(writer, 200, response)
 		return true
+	case req.Method == "PUT" && len(pathSegs) > 3 && pathSegs[1] == "clone":
+		target, err := resolveGitTarget(requestSrcDirs(req), pathSegs[2:])
+		if err != nil {
+			ShowError(writer, 404, err.Error(), nil)
+			return true
+		}
+
+		// A checkout of a branch can change any file of the repository, that
+		//  of paths only theirs
+		locked := []string{target.location}
+		if request.Tag == "" && request.Branch == "" {
+			locked = []string{}
+			for _, p := range request.Path {
+				locked = append(locked, target.location+filepath.ToSlash(filepath.Clean("/"+p)))
+			}
+		}
+		for _, location := range locked {
+			if showLocked(writer, req, location) {
+				return true
+			}
+		}
+
+		switch {
+		case request.Tag != "":
+			err = validGitNames(request.Tag, request.Branch)
+			if err == nil {
+				_, err = runGit(ctx, target.dir, "checkout", "-b", request.Branch, request.Tag)
+			}
+		case request.Branch != "":
+			err = validGitNames(request.Branch)
+			if err == nil {
+				_, err = runGit(ctx, target.dir, "checkout", request.Branch)
+			}
+		case len(request.Path) > 0:
+			// Discard the changes to the paths, removing those that aren't tracked
+			_, err = runGit(ctx, target.dir, append([]string{"checkout", "HEAD", "--"}, request.Path...)...)
+			if err != nil && bool(request.RemoveUntracked) {
+				_, err = runGit(ctx, target.dir, append([]string{"clean", "-f", "--"}, request.Path...)...)
+			}
+		default:
+			ShowError(writer, 400, "Nothing to check out", nil)
+			return true
+		}
+
+		if err != nil {
+			ShowError(writer, 500, "Checkout failed", err)
+			return true
+		}
+
+		ShowJson(writer, 200, cloneInfo(ctx, target.dir))
+		return true
+	case req.Method == "POST" && len(pathSegs) > 3 && pathSegs[1] == "clone" && bool(request.Pull):
+		target, err := resolveGitTarget(requestSrcDirs(req), pathSegs[2:])
+		if err != nil {
+			ShowError(writer, 404, err.Error(), nil)
+			return true
+		}
+
+		args := []string{"pull"}
+		if request.Force {
+			args = append(args, "--force")
+		}
+
+		out, err := runGit(ctx, target.dir, args...)
+		if err != nil {
+			ShowError(writer, 500, "Pull failed", err)
+			return true
+		}
+
+		ShowJson(writer, 200, map[string]string{"Result": "OK", "Message": strings.TrimSpace(string(out))})
+		return true
 	case req.Method == "GET" && len(pathSegs) > 3 && pathSegs[1] == "status":
-		response := StatusInfo{}
-		path := strings.Join(pathSegs[2:], "/")
-		response.CloneLocation = "/gitapi/clone/" + path
-		response.CommitLocation = "/gitapi/commit/HEAD/" + path
-		response.IndexLocation = "/gitapi/index/" + path
-		response.Location = "/gitapi/status/file/" + path
-		response.RepositoryState = "SAFE"
-		response.Type = "Status"
-
-		response.Added = make([]string, 0, 0)
-		response.Changed = make([]string, 0, 0)
-		response.Conflicting = make([]string, 0, 0)
-		response.Missing = make([]string, 0, 0)
-		response.Modified = make([]string, 0, 0)
-		response.Removed = make([]string, 0, 0)
-		response.Untracked = make([]string, 0, 0)
-
-		// FIXME invoke the correct git commands to produce the status output
+		target, err := resolveGitTarget(requestSrcDirs(req), pathSegs[2:])
+		if err != nil {
+			ShowError(writer, 404, err.Error(), nil)
+			return true
+		}
 
-		ShowJson(writer, 200, response)
+		status, err := gitStatus(ctx, target)
+		if err != nil {
+			ShowError(writer, 500, "Unable to get the status", err)
+			return true
+		}
+
+		ShowJson(writer, 200, status)
 		return true
-	case req.Method == "GET" && len(pathSegs) > 3 && pathSegs[1] == "clone":
-		response := CloneDataResponse{Type: "Clone"}
+	case req.Method == "GET" && len(pathSegs) > 3 && pathSegs[1] == "index":
+		target, err := resolveGitTarget(requestSrcDirs(req), pathSegs[2:])
+		if err != nil {
+			ShowError(writer, 404, err.Error(), nil)
+			return true
+		}
+
+		out, err := runGit(ctx, target.dir, "show", ":"+target.name)
+		if err != nil {
+			ShowError(writer, 404, "The file isn't in the index", err)
+			return true
+		}
 
-		gitfolders := []string{}
+		writer.Header().Set("Content-Type", "text/plain; charset=utf-8")
+		writer.Write(out)
+		return true
+	case req.Method == "PUT" && len(pathSegs) > 3 && pathSegs[1] == "index":
+		target, err := resolveGitTarget(requestSrcDirs(req), pathSegs[2:])
+		if err != nil {
+			ShowError(writer, 404, err.Error(), nil)
+			return true
+		}
 
-		if pathSegs[2] == "workspace" {
-			srcDir, err := os.Open(gopath + "/src")
+		if len(request.Hunks) > 0 {
+			err = stageHunks(ctx, target, request.Hunks, false)
 			if err != nil {
-				ShowError(writer, 500, "Unable to open GOPATH src directory", err)
+				ShowError(writer, 400, "Unable to stage the hunks", err)
 				return true
 			}
 
-			names, err := srcDir.Readdirnames(-1)
-			if err != nil {
-				ShowError(writer, 500, "Unable to read GOPATH src directory", err)
+			ShowJson(writer, 200, map[string]string{})
+			return true
+		}
+
+		paths := request.Path
+		if len(paths) == 0 {
+			paths = []string{target.pathspec()}
+		}
+
+		_, err = runGit(ctx, target.dir, append([]string{"add", "-A", "--"}, paths...)...)
+		if err != nil {
+			ShowError(writer, 500, "Unable to stage the changes", err)
+			return true
+		}
+
+		ShowJson(writer, 200, map[string]string{})
+		return true
+	case req.Method == "POST" && len(pathSegs) > 3 && pathSegs[1] == "index":
+		target, err := resolveGitTarget(requestSrcDirs(req), pathSegs[2:])
+		if err != nil {
+			ShowError(writer, 404, err.Error(), nil)
+			return true
+		}
+
+		switch {
+		case len(request.Hunks) > 0:
+			err = stageHunks(ctx, target, request.Hunks, true)
+		case request.Reset != "":
+			mode := strings.ToLower(request.Reset)
+			if mode != "mixed" && mode != "hard" && mode != "soft" {
+				ShowError(writer, 400, "Unknown reset type "+request.Reset, nil)
 				return true
 			}
 
-			for _, name := range names {
-				_, err := os.Stat(gopath + "/src/" + name + "/.git")
-				if err == nil {
-					gitfolders = append(gitfolders, name)
+			args := []string{"reset", "--" + mode}
+			if request.Commit != "" {
+				if err = validGitNames(request.Commit); err != nil {
+					ShowError(writer, 400, err.Error(), nil)
+					return true
 				}
+				args = append(args, request.Commit)
 			}
-		} else if pathSegs[2] == "file" {
-			gitfolders = append(gitfolders, strings.Join(pathSegs[3:], "/"))
-		} else {
-			// We don't know what to do with GET clone on something other than file or workspace
-			return false
+			_, err = runGit(ctx, target.dir, args...)
+		case len(request.Path) > 0:
+			_, err = runGit(ctx, target.dir, append([]string{"reset", "-q", "HEAD", "--"}, request.Path...)...)
+			if err != nil {
+				// Nothing has been committed yet
+				_, err = runGit(ctx, target.dir, append([]string{"rm", "-r", "-q", "--cached", "--"}, request.Path...)...)
+			}
+		default:
+			ShowError(writer, 400, "Nothing to unstage", nil)
+			return true
 		}
 
-		for _, name := range gitfolders {
-			cmd := exec.Command("git", "config", "--get", "remote.origin.url")
-			cmd.Dir = gopath + "/src/" + name
-			originUrlOutput, _ := cmd.Output()
+		if err != nil {
+			ShowError(writer, 500, "Unable to reset the index", err)
+			return true
+		}
 
-			// If the git config get command fails above it is likely due to the fact
-			//  that there is no origin repo for this repo.
+		ShowJson(writer, 200, map[string]string{})
+		return true
+	case req.Method == "GET" && len(pathSegs) > 4 && pathSegs[1] == "commit":
+		params, target, err := gitapiParams(req, pathSegs)
+		if err != nil || len(params) != 1 {
+			ShowError(writer, 404, "Invalid commit location", err)
+			return true
+		}
+		ref := params[0]
 
-			cloneInfo := CloneInfo{}
-			cloneInfo.BranchLocation = "/gitapi/branch/file/" + name
-			cloneInfo.CommitLocation = "/gitapi/commit/file/" + name
-			cloneInfo.ConfigLocation = "/gitapi/config/clone/file/" + name
-			cloneInfo.ContentLocation = "/file/" + name
-			cloneInfo.DiffLocation = "/gitapi/diff/Default/file/" + name
-			if len(originUrlOutput) > 0 {
-				url := string(originUrlOutput)
-				cloneInfo.GitUrl = &url
+		// Content of the file at the commit
+		if req.URL.Query().Get("parts") == "body" {
+			out, err := runGit(ctx, target.dir, "show", ref+":"+target.name)
+			if err != nil {
+				ShowError(writer, 404, "The file isn't in the commit", err)
+				return true
 			}
-			cloneInfo.HeadLocation = "/gitapi/commit/HEAD/file/" + name
-			cloneInfo.IndexLocation = "/gitapi/index/file/" + name
-			cloneInfo.Location = "/gitapi/clone/file/" + name
-			cloneInfo.Name = name
-			cloneInfo.RemoteLocation = "/gitapi/remote/file/" + name
-			cloneInfo.StatusLocation = "/gitapi/status/file/" + name
-			cloneInfo.TagLocation = "/gitapi/tag/file/" + name
-			cloneInfo.Type = "Clone"
 
-			response.Children = append(response.Children, cloneInfo)
+			writer.Header().Set("Content-Type", "text/plain; charset=utf-8")
+			writer.Write(out)
+			return true
+		}
+
+		page, _ := strconv.Atoi(req.URL.Query().Get("page"))
+		if page < 1 {
+			page = 1
+		}
+		pageSize, _ := strconv.Atoi(req.URL.Query().Get("pageSize"))
+		if pageSize < 1 {
+			pageSize = gitLogPageSize
+		}
+
+		// One commit more than the page tells whether there is a next page
+		commits, err := gitLog(ctx, target, "--skip="+strconv.Itoa((page-1)*pageSize), "-n", strconv.Itoa(pageSize+1), ref)
+		if err != nil {
+			ShowError(writer, 500, "Unable to get the log", err)
+			return true
+		}
+
+		response := LogResponse{Type: "Commit", Children: commits, Location: req.URL.EscapedPath(),
+			CloneLocation: target.cloneLocation(), RepositoryPath: target.name}
+		pageLocation := func(p int) string {
+			return response.Location + "?page=" + strconv.Itoa(p) + "&pageSize=" + strconv.Itoa(pageSize)
+		}
+		if len(commits) > pageSize {
+			response.Children = commits[:pageSize]
+			response.NextLocation = pageLocation(page + 1)
+		}
+		if page > 1 {
+			response.PreviousLocation = pageLocation(page - 1)
+		}
+		if !strings.Contains(ref, "..") {
+			response.ToRef = gitLogRef(ctx, target, ref)
 		}
 
 		ShowJson(writer, 200, response)
 		return true
-	case req.Method == "POST" && len(pathSegs) == 3 && pathSegs[1] == "clone":
-		request := PostCloneRequest{}
-		dec := json.NewDecoder(req.Body)
-		err := dec.Decode(&request)
+	case req.Method == "POST" && len(pathSegs) > 4 && pathSegs[1] == "commit":
+		params, target, err := gitapiParams(req, pathSegs)
+		if err != nil || len(params) != 1 {
+			ShowError(writer, 404, "Invalid commit location", err)
+			return true
+		}
+
+		if request.New != "" {
+			showRangeLocation(writer, "commit", params[0], request.New, target)
+			return true
+		}
+
+		if request.Message == "" {
+			ShowError(writer, 400, "The commit message is missing", nil)
+			return true
+		}
 
+		rules := repositoryCommitRules(ctx, target)
+		message, err := prepareCommitMessage(ctx, target, request, rules)
 		if err != nil {
-			ShowError(writer, 400, "Invalid input", err)
+			ShowError(writer, 400, err.Error(), nil)
+			return true
+		}
+		if problems := commitMessageProblems(message, rules); len(problems) > 0 {
+			ShowError(writer, 400, "The commit message doesn't follow the rules of the repository: "+strings.Join(problems, ". "), nil)
+			return true
+		}
+
+		args := []string{"commit", "-q", "--cleanup=whitespace", "-m", message}
+		if request.Amend {
+			args = append(args, "--amend")
+		}
+		if request.AuthorName != "" && request.AuthorEmail != "" {
+			args = append(args, "--author="+request.AuthorName+" <"+request.AuthorEmail+">")
+		}
+
+		_, err = runGit(ctx, target.dir, args...)
+		if err != nil {
+			ShowError(writer, 500, "Commit failed", err)
+			return true
+		}
+
+		commits, err := gitLog(ctx, target, "-n", "1", "HEAD")
+		if err != nil || len(commits) != 1 {
+			ShowError(writer, 500, "Unable to read the commit", err)
+			return true
+		}
+
+		ShowJson(writer, 200, commits[0])
+		return true
+	case req.Method == "GET" && len(pathSegs) > 4 && pathSegs[1] == "diff":
+		params, target, err := gitapiParams(req, pathSegs)
+		if err != nil || len(params) != 1 {
+			ShowError(writer, 404, "Invalid diff location", err)
 			return true
 		}
 
-		// TODO honour the location property if it happens to point somewhere other than the workspace
-		var name string
-		if request.GitUrl != "" {
-			urlSegments := strings.Split(request.GitUrl, "/")
-			name = urlSegments[len(urlSegments)-1]
-			name = strings.Replace(name, ".git", "", 1)
-			cmd := exec.Command("git", "clone", request.GitUrl, gopath+"/src/"+name)
-			err = cmd.Run()
+		if req.URL.Query().Get("parts") == "uris" {
+			ShowJson(writer, 200, diffUris(params[0], target))
+			return true
+		}
 
+		// The hunks that can be staged or unstaged one by one
+		if req.URL.Query().Get("parts") == "hunks" {
+			_, hunks, err := gitDiffHunks(ctx, target, params[0])
 			if err != nil {
-				ShowError(writer, 500, "Git clone failed", err)
+				ShowError(writer, 400, "Unable to get the hunks", err)
 				return true
 			}
-		} else {
-			name = request.Name
-			cmd := exec.Command("git", "init", gopath+"/src/"+name)
-			err = cmd.Run()
 
+			ShowJson(writer, 200, hunks)
+			return true
+		}
+
+		args, err := diffArgs(params[0])
+		if err != nil {
+			ShowError(writer, 400, err.Error(), nil)
+			return true
+		}
+
+		out, err := runGitEnv(ctx, target.dir, lfsDiffEnv, nil, append(args, "--", target.pathspec())...)
+		if err != nil {
+			ShowError(writer, 500, "Unable to get the diff", err)
+			return true
+		}
+
+		writer.Header().Set("Content-Type", "text/plain; charset=utf-8")
+		writer.Write(out)
+		return true
+	case req.Method == "GET" && len(pathSegs) > 4 && pathSegs[1] == "compare":
+		// /gitapi/compare/<base>..<head>/file/<path>
+		params, target, err := gitapiParams(req, pathSegs)
+		if err != nil || len(params) != 1 || !strings.Contains(params[0], "..") {
+			ShowError(writer, 404, "Invalid compare location", err)
+			return true
+		}
+		refs := strings.SplitN(params[0], "..", 2)
+		if err = validGitNames(refs...); err != nil || refs[0] == "" || refs[1] == "" {
+			ShowError(writer, 400, "Invalid refs to compare", err)
+			return true
+		}
+
+		limit, _ := strconv.Atoi(req.URL.Query().Get("limit"))
+		if limit < 1 {
+			limit = gitLogPageSize
+		}
+
+		result, err := gitCompare(ctx, target, refs[0], refs[1], limit)
+		if err != nil {
+			ShowError(writer, 400, "Unable to compare "+refs[0]+" and "+refs[1], err)
+			return true
+		}
+
+		ShowJson(writer, 200, result)
+		return true
+	case req.Method == "POST" && len(pathSegs) > 4 && pathSegs[1] == "diff":
+		params, target, err := gitapiParams(req, pathSegs)
+		if err != nil || len(params) != 1 || request.New == "" {
+			ShowError(writer, 400, "Invalid diff request", err)
+			return true
+		}
+
+		showRangeLocation(writer, "diff", params[0], request.New, target)
+		return true
+	case req.Method == "GET" && len(pathSegs) > 3 && pathSegs[1] == "branch":
+		params, target, err := gitapiParams(req, pathSegs)
+		if err != nil || len(params) > 1 {
+			ShowError(writer, 404, "Invalid branch location", err)
+			return true
+		}
+
+		pattern := "refs/heads/"
+		if len(params) == 1 {
+			pattern = pattern + params[0]
+		}
+
+		branches, err := gitBranches(ctx, target, pattern)
+		if err != nil {
+			ShowError(writer, 500, "Unable to list the branches", err)
+			return true
+		}
+
+		if len(params) == 1 {
+			if len(branches) != 1 {
+				ShowError(writer, 404, "No such branch "+params[0], nil)
+				return true
+			}
+			ShowJson(writer, 200, branches[0])
+			return true
+		}
+
+		ShowJson(writer, 200, BranchResponse{Type: "Branch", Children: branches})
+		return true
+	case req.Method == "POST" && len(pathSegs) > 3 && pathSegs[1] == "branch":
+		_, target, err := gitapiParams(req, pathSegs)
+		if err != nil {
+			ShowError(writer, 404, "Invalid branch location", err)
+			return true
+		}
+
+		if err = validGitNames(request.Name, request.Branch); err != nil || request.Name == "" {
+			ShowError(writer, 400, "Invalid branch name", err)
+			return true
+		}
+
+		args := []string{"branch", request.Name}
+		if request.Branch != "" {
+			args = append(args, request.Branch)
+		}
+		_, err = runGit(ctx, target.dir, args...)
+		if err != nil {
+			ShowError(writer, 500, "Unable to create the branch", err)
+			return true
+		}
+
+		branches, err := gitBranches(ctx, target, "refs/heads/"+request.Name)
+		if err != nil || len(branches) != 1 {
+			ShowError(writer, 500, "Unable to read the branch", err)
+			return true
+		}
+
+		writer.Header().Add("Location", branches[0].Location)
+		ShowJson(writer, 201, branches[0])
+		return true
+	case req.Method == "DELETE" && len(pathSegs) > 4 && pathSegs[1] == "branch":
+		params, target, err := gitapiParams(req, pathSegs)
+		if err != nil || len(params) != 1 {
+			ShowError(writer, 404, "Invalid branch location", err)
+			return true
+		}
+
+		// Branches that aren't merged have to be deleted with git itself
+		_, err = runGit(ctx, target.dir, "branch", "-d", params[0])
+		if err != nil {
+			ShowError(writer, 500, "Unable to delete the branch", err)
+			return true
+		}
+
+		ShowJson(writer, 200, map[string]string{})
+		return true
+	case req.Method == "GET" && len(pathSegs) > 3 && pathSegs[1] == "remote":
+		params, target, err := gitapiParams(req, pathSegs)
+		if err != nil {
+			ShowError(writer, 404, "Invalid remote location", err)
+			return true
+		}
+
+		remotes, err := gitRemotes(ctx, target)
+		if err != nil {
+			ShowError(writer, 500, "Unable to list the remotes", err)
+			return true
+		}
+
+		if len(params) == 0 {
+			ShowJson(writer, 200, RemoteResponse{Type: "Remote", Children: remotes})
+			return true
+		}
+
+		for _, remote := range remotes {
+			if remote.Name != params[0] {
+				continue
+			}
+
+			remote.Children, err = gitRemoteBranches(ctx, target, remote.Name, strings.Join(params[1:], "/"))
 			if err != nil {
-				ShowError(writer, 500, "Git init failed", err)
+				ShowError(writer, 500, "Unable to list the remote branches", err)
+				return true
+			}
+
+			if len(params) == 1 {
+				ShowJson(writer, 200, remote)
 				return true
 			}
+			if len(remote.Children) == 1 {
+				ShowJson(writer, 200, remote.Children[0])
+				return true
+			}
+		}
+
+		ShowError(writer, 404, "No such remote "+strings.Join(params, "/"), nil)
+		return true
+	case req.Method == "POST" && len(pathSegs) > 3 && pathSegs[1] == "remote":
+		params, target, err := gitapiParams(req, pathSegs)
+		if err != nil {
+			ShowError(writer, 404, "Invalid remote location", err)
+			return true
 		}
 
-		response := PostCloneResponse{}
-		response.Location = "/task/id/1"
-		responseData := ResultData{}
-		responseData.Code = 0
-		responseData.HttpCode = 200
-		locationData := LocationData{}
-		locationData.Location = "/gitapi/clone/file/cmcgee/1" + name
-		responseData.JsonData = locationData
-		responseData.Message = "OK"
-		responseData.Severity = "OK"
-		response.Result = responseData
-		response.Expires = time.Now().Add(10*time.Minute).Unix() * 1000
-		response.Timestamp = time.Now().Unix() * 1000
-		response.Type = "loadend"
-		response.LengthComputable = false
+		switch {
+		case len(params) == 0:
+			if err = validGitNames(request.Remote, request.RemoteURI); err != nil || request.Remote == "" || request.RemoteURI == "" {
+				ShowError(writer, 400, "Invalid remote", err)
+				return true
+			}
+
+			_, err = runGit(ctx, target.dir, "remote", "add", request.Remote, request.RemoteURI)
+			if err != nil {
+				ShowError(writer, 500, "Unable to add the remote", err)
+				return true
+			}
+
+			location := "/gitapi/remote/" + gitRefSeg(request.Remote) + target.location
+			writer.Header().Add("Location", location)
+			ShowJson(writer, 201, map[string]string{"Location": location})
+			return true
+		case bool(request.Fetch):
+			args := []string{"fetch", params[0]}
+			if request.Force {
+				args = append(args, "--force")
+			}
+			if len(params) > 1 {
+				branch := strings.Join(params[1:], "/")
+				args = append(args, "refs/heads/"+branch+":refs/remotes/"+params[0]+"/"+branch)
+			}
+
+			_, err = runGit(ctx, target.dir, args...)
+			if err != nil {
+				ShowError(writer, 500, "Fetch failed", err)
+				return true
+			}
+		case request.PushSrcRef != "" && len(params) > 1:
+			if err = validGitNames(request.PushSrcRef); err != nil {
+				ShowError(writer, 400, err.Error(), nil)
+				return true
+			}
+
+			args := []string{"push", params[0]}
+			if request.Force {
+				args = append(args, "--force")
+			}
+			if request.PushTags {
+				args = append(args, "--tags")
+			}
+			args = append(args, request.PushSrcRef+":refs/heads/"+strings.Join(params[1:], "/"))
+
+			_, err = runGit(ctx, target.dir, args...)
+			if err != nil {
+				ShowError(writer, 500, "Push failed", err)
+				return true
+			}
+		default:
+			ShowError(writer, 400, "Unknown remote operation", nil)
+			return true
+		}
+
+		ShowJson(writer, 200, map[string]string{"Result": "OK"})
+		return true
+	case req.Method == "DELETE" && len(pathSegs) > 4 && pathSegs[1] == "remote":
+		params, target, err := gitapiParams(req, pathSegs)
+		if err != nil || len(params) != 1 {
+			ShowError(writer, 404, "Invalid remote location", err)
+			return true
+		}
+
+		_, err = runGit(ctx, target.dir, "remote", "remove", params[0])
+		if err != nil {
+			ShowError(writer, 500, "Unable to remove the remote", err)
+			return true
+		}
+
+		ShowJson(writer, 200, map[string]string{})
+		return true
+	case req.Method == "GET" && len(pathSegs) > 4 && pathSegs[1] == "config":
+		params, target, err := gitapiParams(req, pathSegs)
+		if err != nil || len(params) != 1 || params[0] != "clone" {
+			ShowError(writer, 404, "Invalid config location", err)
+			return true
+		}
+
+		out, err := runGit(ctx, target.dir, "config", "-l", "-z")
+		if err != nil {
+			ShowError(writer, 500, "Unable to read the configuration", err)
+			return true
+		}
+
+		response := ConfigResponse{Type: "Config", Children: []ConfigItemInfo{}}
+		for _, entry := range strings.Split(string(out), "\x00") {
+			keyValue := strings.SplitN(entry, "\n", 2)
+			if len(keyValue) != 2 {
+				continue
+			}
+
+			// Credentials end up in the configuration, e.g. in the remote URLs
+			info := ConfigItemInfo{Type: "Config", Key: keyValue[0], Value: keyValue[1]}
+			info.Value = gitUrlWithoutUser(info.Value)
+			if sensitiveVariable.MatchString(info.Key) {
+				info.Value = redacted
+			}
+			info.Location = "/gitapi/config/" + gitRefSeg(info.Key) + "/clone" + target.location
+			info.CloneLocation = target.cloneLocation()
+
+			response.Children = append(response.Children, info)
+		}
 
 		ShowJson(writer, 200, response)
 		return true
@@ -484,4 +1600,3 @@ func gitapiHandler(writer http.ResponseWriter, req *http.Request, path string, p
 
 	return false
 }
-*/
@@ -0,0 +1,380 @@
+// Copyright 2014 Chris McGee <sirnewton_01@yahoo.ca>. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Where a bisect of a repository stands
+type BisectStatus struct {
+	Active bool
+	// The commits that are marked so far and the one checked out to test
+	Bad     string   `json:",omitempty"`
+	Good    []string `json:",omitempty"`
+	Current string   `json:",omitempty"`
+	// Commits that could still be the first bad one and about how many
+	//  more steps it takes to find it
+	Remaining int
+	Steps     int
+	// The first bad commit once it is found
+	Culprit       *CommitInfo `json:",omitempty"`
+	Log           string
+	CloneLocation string
+	Type          string
+}
+
+// Message of an automated bisect, the Type is step, output or done. Each
+// step has the commit that was tested and how it was marked.
+type BisectEvent struct {
+	Type   string
+	Commit string        `json:",omitempty"`
+	Term   string        `json:",omitempty"`
+	Output string        `json:",omitempty"`
+	Status *BisectStatus `json:",omitempty"`
+	Error  string        `json:",omitempty"`
+}
+
+const (
+	// Exit code of a command that can't test the commit, as with git bisect
+	//  run
+	bisectSkipCode = 125
+)
+
+var (
+	bisectTerms    = map[string]bool{"good": true, "bad": true, "skip": true}
+	bisectCulprit  = regexp.MustCompile(`(?m)^# first bad commit: \[([0-9a-f]+)\]`)
+	bisectVarsLine = regexp.MustCompile(`(?m)^bisect_(all|steps)=(\d+)$`)
+)
+
+func gitBisectStatus(ctx context.Context, target gitTarget) (BisectStatus, error) {
+	status := BisectStatus{Type: "Bisect", CloneLocation: target.cloneLocation()}
+
+	if _, err := os.Stat(filepath.Join(gitDir(target.dir), "BISECT_START")); err != nil {
+		return status, nil
+	}
+	status.Active = true
+
+	out, err := runGit(ctx, target.dir, "bisect", "log")
+	if err != nil {
+		return status, err
+	}
+	status.Log = string(out)
+
+	if m := bisectCulprit.FindStringSubmatch(status.Log); m != nil {
+		commits, err := gitLog(ctx, gitTarget{dir: target.dir, location: target.location}, "-n", "1", m[1])
+		if err != nil {
+			return status, err
+		}
+		if len(commits) == 1 {
+			status.Culprit = &commits[0]
+		}
+	}
+
+	if out, err := runGit(ctx, target.dir, "rev-parse", "--verify", "-q", "HEAD"); err == nil {
+		status.Current = strings.TrimSpace(string(out))
+	}
+	if out, err := runGit(ctx, target.dir, "rev-parse", "--verify", "-q", "refs/bisect/bad"); err == nil {
+		status.Bad = strings.TrimSpace(string(out))
+	}
+	if out, err := runGit(ctx, target.dir, "for-each-ref", "--format=%(objectname)", "refs/bisect/good-*"); err == nil {
+		status.Good = strings.Fields(string(out))
+	}
+
+	// Without both ends there is nothing to narrow down yet
+	if status.Bad == "" || len(status.Good) == 0 || status.Culprit != nil {
+		return status, nil
+	}
+
+	args := []string{"rev-list", "--bisect-vars", status.Bad}
+	for _, good := range status.Good {
+		args = append(args, "^"+good)
+	}
+	if out, err := runGit(ctx, target.dir, append(args, "--", target.pathspec())...); err == nil {
+		for _, m := range bisectVarsLine.FindAllStringSubmatch(string(out), -1) {
+			value, _ := strconv.Atoi(m[2])
+			if m[1] == "all" {
+				status.Remaining = value
+			} else {
+				status.Steps = value
+			}
+		}
+	}
+
+	return status, nil
+}
+
+// Starts a bisect between the bad commit and the good ones, only the
+// commits that change the target are tested
+func gitBisectStart(ctx context.Context, target gitTarget, bad string, good []string) error {
+	if err := validGitNames(append([]string{bad}, good...)...); err != nil {
+		return err
+	}
+
+	args := append([]string{"bisect", "start", bad}, good...)
+	_, err := runGit(ctx, target.dir, append(args, "--", target.pathspec())...)
+	return err
+}
+
+func gitBisectMark(ctx context.Context, target gitTarget, term string, commit string) error {
+	if !bisectTerms[term] {
+		return errors.New("Commits are marked good, bad or skip, not " + term)
+	}
+
+	args := []string{"bisect", term}
+	if commit != "" {
+		if err := validGitNames(commit); err != nil {
+			return err
+		}
+		args = append(args, commit)
+	}
+
+	_, err := runGit(ctx, target.dir, args...)
+	return err
+}
+
+// Tests the commit that is checked out with the tests or the command of the
+// request. Tests that fail make it bad, those that can't build skip it. A
+// command does the same as with git bisect run: 0 is good, 125 skips and
+// anything else is bad.
+func bisectTest(ctx context.Context, user string, target gitTarget, request GitRequest) (string, string, error) {
+	if request.Test != nil {
+		output := &cappedBuffer{limit: maxScratchOutput}
+		var mutex sync.Mutex
+		report := runGoTest(ctx, user, *request.Test, nil, func(event GoTestEvent) {
+			if event.Type == "output" {
+				mutex.Lock()
+				output.WriteString(event.Output)
+				mutex.Unlock()
+			}
+		})
+
+		switch {
+		case report.Cancelled || ctx.Err() != nil:
+			return "", output.String(), errors.New("The tests were cancelled")
+		case report.Failed > 0:
+			return "bad", output.String(), nil
+		case report.ExitCode != 0 && report.Passed == 0:
+			output.WriteString(report.Error)
+			return "skip", output.String(), nil
+		case report.ExitCode != 0:
+			return "bad", output.String(), nil
+		}
+		return "good", output.String(), nil
+	}
+
+	command := request.Command
+	entry := ShellAuditEntry{Time: time.Now().Unix() * 1000, User: user, Command: command.Command, Args: command.Args,
+		Dir: target.location}
+	if !shellAllowed(command.Command) {
+		entry.Denied = "The " + command.Command + " command isn't allowed"
+		recordShellAudit(entry)
+		return "", "", errors.New(entry.Denied)
+	}
+	if err := validateShellArgs(userSrcDirs(user), command.Command, command.Args, target.dir); err != nil {
+		entry.Denied = err.Error()
+		recordShellAudit(entry)
+		return "", "", err
+	}
+
+	cmd := exec.CommandContext(ctx, command.Command, command.Args...)
+	cmd.Dir = target.dir
+	cmd.Env = workspaceEnv(user)
+	output := &cappedBuffer{limit: maxScratchOutput}
+	cmd.Stdout = output
+	cmd.Stderr = output
+
+	start := time.Now()
+	if err := cmd.Start(); err != nil {
+		return "", "", err
+	}
+	proc := registerProcess(user, "bisect", cmd, nil)
+	err := cmd.Wait()
+	proc.unregister()
+
+	entry.Duration = int64(time.Since(start) / time.Millisecond)
+	if cmd.ProcessState != nil {
+		entry.ExitCode = cmd.ProcessState.ExitCode()
+	}
+	recordShellAudit(entry)
+
+	switch {
+	case ctx.Err() != nil:
+		return "", output.String(), errors.New("The command was cancelled")
+	case err == nil:
+		return "good", output.String(), nil
+	case entry.ExitCode == bisectSkipCode:
+		return "skip", output.String(), nil
+	case entry.ExitCode > 0 && entry.ExitCode < 128:
+		return "bad", output.String(), nil
+	}
+	// Killed by a signal, which says nothing about the commit
+	return "", output.String(), fmt.Errorf("The command failed: %v", err)
+}
+
+// Tests and marks the commits that the bisect checks out until the first
+// bad one is found. Each step is sent as it is marked.
+func runBisect(ctx context.Context, user string, target gitTarget, request GitRequest, send func(BisectEvent)) (BisectStatus, error) {
+	start := time.Now()
+	tested := make(map[string]bool)
+
+	for {
+		status, err := gitBisectStatus(ctx, target)
+		if err != nil {
+			return status, err
+		}
+		if !status.Active {
+			return status, errors.New("No bisect is started")
+		}
+		if status.Culprit != nil {
+			notifyFinished("Bisect finished", status.Culprit.Name+" is the first bad commit", time.Since(start))
+			return status, nil
+		}
+		if status.Bad == "" || len(status.Good) == 0 {
+			return status, errors.New("Mark a bad and a good commit before the bisect can run")
+		}
+		// Only skipped commits are left, git checks out one of them again
+		if tested[status.Current] {
+			return status, errors.New("The commits that are left can't be tested, the first bad commit is one of them")
+		}
+		tested[status.Current] = true
+
+		stepCtx, cancel := context.WithTimeout(ctx, *testTimeout)
+		term, output, err := bisectTest(stepCtx, user, target, request)
+		cancel()
+		if output != "" {
+			send(BisectEvent{Type: "output", Commit: status.Current, Output: output})
+		}
+		if err != nil {
+			return status, err
+		}
+
+		if err := gitBisectMark(ctx, target, term, ""); err != nil {
+			return status, err
+		}
+		send(BisectEvent{Type: "step", Commit: status.Current, Term: term})
+	}
+}
+
+// GET /gitapi/bisect/file/<repository> is where the bisect of the repository
+// stands. POST starts one with the Bad and Good commits of the body or marks
+// the Commit, the checked out one by default, with the Term good, bad or
+// skip. DELETE ends the bisect and checks out what was checked out before.
+//
+// POST /gitapi/bisect/run/file/<repository> tests each step with the Test or
+// the Command of the body and marks it, starting the bisect first when the
+// body has the commits. Clients that accept application/x-ndjson get the
+// steps as they are done, the others get the status at the end.
+func bisectRequest(ctx context.Context, writer http.ResponseWriter, req *http.Request, pathSegs []string, request GitRequest) bool {
+	params, target, err := gitapiParams(req, pathSegs)
+	if err != nil || len(params) > 1 || (len(params) == 1 && (params[0] != "run" || req.Method != "POST")) {
+		ShowError(writer, 404, "Invalid bisect location", err)
+		return true
+	}
+
+	switch {
+	case req.Method == "GET":
+		status, err := gitBisectStatus(ctx, target)
+		if err != nil {
+			ShowError(writer, 500, "Unable to get the bisect", err)
+			return true
+		}
+
+		ShowJson(writer, 200, status)
+		return true
+	case req.Method == "POST" && len(params) == 0:
+		switch {
+		case request.Bad != "":
+			err = gitBisectStart(ctx, target, request.Bad, request.Good)
+		case request.Term != "":
+			err = gitBisectMark(ctx, target, request.Term, request.Commit)
+		default:
+			ShowError(writer, 400, "Either the Bad and Good commits or a Term is needed", nil)
+			return true
+		}
+		if err != nil {
+			ShowError(writer, 400, "Unable to bisect", err)
+			return true
+		}
+
+		status, err := gitBisectStatus(ctx, target)
+		if err != nil {
+			ShowError(writer, 500, "Unable to get the bisect", err)
+			return true
+		}
+
+		ShowJson(writer, 200, status)
+		return true
+	case req.Method == "POST":
+		if (request.Test == nil) == (request.Command == nil) {
+			ShowError(writer, 400, "A run needs either a Test or a Command", nil)
+			return true
+		}
+		if request.Test != nil {
+			if _, _, err := goTestArgs(requestSrcDirs(req), *request.Test); err != nil {
+				ShowError(writer, 400, err.Error(), nil)
+				return true
+			}
+		}
+
+		// The git timeout is for each git command, the steps have the
+		//  timeout of the tests
+		ctx := req.Context()
+		if request.Bad != "" {
+			if err := gitBisectStart(ctx, target, request.Bad, request.Good); err != nil {
+				ShowError(writer, 400, "Unable to bisect", err)
+				return true
+			}
+		}
+
+		send := func(event BisectEvent) {}
+		var stream *JsonStream
+		if wantsJsonStream(req) {
+			stream = NewJsonStream(writer, req)
+			send = func(event BisectEvent) {
+				stream.Send(event)
+			}
+		}
+
+		status, err := runBisect(ctx, requestUser(req), target, request, send)
+		if stream != nil {
+			done := BisectEvent{Type: "done", Status: &status}
+			if err != nil {
+				done.Error = err.Error()
+			}
+			stream.Send(done)
+			return true
+		}
+
+		if err != nil {
+			ShowError(writer, 500, "The bisect did not finish", err)
+			return true
+		}
+
+		ShowJson(writer, 200, status)
+		return true
+	case req.Method == "DELETE":
+		if _, err := runGit(ctx, target.dir, "bisect", "reset"); err != nil {
+			ShowError(writer, 500, "Unable to end the bisect", err)
+			return true
+		}
+
+		writer.WriteHeader(204)
+		return true
+	}
+
+	return false
+}
@@ -0,0 +1,169 @@
+// Copyright 2014 Chris McGee <sirnewton_01@yahoo.ca>. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"context"
+	"flag"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// How two refs of a repository compare, e.g. a branch and the branch that
+// it is going to be merged into
+type CompareResult struct {
+	Base      string
+	Head      string
+	MergeBase string
+	// Commits that the head has and the base doesn't, and the other way round
+	Ahead  int
+	Behind int
+	// Those commits, newest first and at most the limit of the request
+	Commits       []CommitInfo
+	BehindCommits []CommitInfo
+	// Changes of the head since the merge base
+	Files         []DiffStat
+	Additions     int
+	Deletions     int
+	DiffLocation  string
+	CloneLocation string
+	Type          string
+}
+
+type DiffStat struct {
+	Path string
+	// Path before a rename
+	OldPath   string `json:",omitempty"`
+	Additions int
+	Deletions int
+	Binary    bool `json:",omitempty"`
+}
+
+var (
+	gitFetchInterval = flag.Duration("gitFetchInterval", 0, "How often the repositories of the workspace fetch from their remotes in the background, so that the branches are up to date with how far ahead and behind of their upstream they are. (0 disables)")
+)
+
+// Changed lines of each file between the refs, with git diff --numstat
+func gitDiffStats(ctx context.Context, target gitTarget, rangeSpec string) ([]DiffStat, error) {
+	out, err := runGitEnv(ctx, target.dir, lfsDiffEnv, nil, "diff", "--numstat", "-z", "-M", "--no-ext-diff", rangeSpec, "--", target.pathspec())
+	if err != nil {
+		return nil, err
+	}
+
+	stats := []DiffStat{}
+	fields := strings.Split(string(out), "\x00")
+	for idx := 0; idx < len(fields); idx++ {
+		counts := strings.SplitN(fields[idx], "\t", 3)
+		if len(counts) != 3 {
+			continue
+		}
+
+		stat := DiffStat{Path: counts[2]}
+		if counts[0] == "-" {
+			stat.Binary = true
+		} else {
+			stat.Additions, _ = strconv.Atoi(counts[0])
+			stat.Deletions, _ = strconv.Atoi(counts[1])
+		}
+
+		// A rename has the old and new paths in the next fields
+		if stat.Path == "" && idx+2 < len(fields) {
+			stat.OldPath, stat.Path = fields[idx+1], fields[idx+2]
+			idx += 2
+		}
+
+		stats = append(stats, stat)
+	}
+
+	return stats, nil
+}
+
+func gitCompare(ctx context.Context, target gitTarget, base string, head string, limit int) (CompareResult, error) {
+	result := CompareResult{Type: "Compare", Base: base, Head: head, CloneLocation: target.cloneLocation()}
+
+	out, err := runGit(ctx, target.dir, "merge-base", base, head)
+	if err != nil {
+		return result, err
+	}
+	result.MergeBase = strings.TrimSpace(string(out))
+	result.DiffLocation = "/gitapi/diff/" + gitRefSeg(result.MergeBase+".."+head) + target.fileLocation()
+
+	out, err = runGit(ctx, target.dir, "rev-list", "--left-right", "--count", base+"..."+head, "--", target.pathspec())
+	if err != nil {
+		return result, err
+	}
+	if counts := strings.Fields(string(out)); len(counts) == 2 {
+		result.Behind, _ = strconv.Atoi(counts[0])
+		result.Ahead, _ = strconv.Atoi(counts[1])
+	}
+
+	result.Commits, err = gitLog(ctx, target, "-n", strconv.Itoa(limit), base+".."+head)
+	if err != nil {
+		return result, err
+	}
+	result.BehindCommits, err = gitLog(ctx, target, "-n", strconv.Itoa(limit), head+".."+base)
+	if err != nil {
+		return result, err
+	}
+
+	result.Files, err = gitDiffStats(ctx, target, base+"..."+head)
+	if err != nil {
+		return result, err
+	}
+	for _, stat := range result.Files {
+		result.Additions += stat.Additions
+		result.Deletions += stat.Deletions
+	}
+
+	return result, nil
+}
+
+// Ahead and behind counts of %(upstream:track,nobracket), e.g. "ahead 2,
+// behind 1", or whether the upstream is gone
+func parseUpstreamTrack(track string) (int, int, bool) {
+	if track == "gone" {
+		return 0, 0, true
+	}
+
+	ahead, behind := 0, 0
+	for _, part := range strings.Split(track, ",") {
+		fields := strings.Fields(part)
+		if len(fields) != 2 {
+			continue
+		}
+		switch fields[0] {
+		case "ahead":
+			ahead, _ = strconv.Atoi(fields[1])
+		case "behind":
+			behind, _ = strconv.Atoi(fields[1])
+		}
+	}
+
+	return ahead, behind, false
+}
+
+// Fetches the remotes of the repositories of the workspace now and then.
+// Repositories that can't fetch without credentials just fail quietly.
+func startGitFetcher(interval time.Duration) {
+	if interval <= 0 {
+		return
+	}
+
+	go func() {
+		for {
+			<-time.After(interval)
+
+			for _, dir := range workspaceClones(srcDirs) {
+				ctx, cancel := context.WithTimeout(serverContext, *gitTimeout)
+				_, err := runGit(ctx, dir, "fetch", "--all", "--prune", "--quiet")
+				cancel()
+				if err != nil {
+					logger.Debugf("Unable to fetch %v: %v\n", dir, err)
+				}
+			}
+		}
+	}()
+}
@@ -0,0 +1,224 @@
+// Copyright 2014 Chris McGee <sirnewton_01@yahoo.ca>. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+// Hunk of the diff of a file
+type DiffHunk struct {
+	Index    int
+	Header   string
+	OldStart int
+	OldLines int
+	NewStart int
+	NewLines int
+	Lines    []DiffLine
+}
+
+type DiffLine struct {
+	// One of " ", "+", "-" or "\" for the no newline at the end marker
+	Type string
+	Text string
+}
+
+// The hunks of a file's diff that a staging request picks, with the
+// indexes of the lines within the hunk for only some of its changes
+type HunkSelection struct {
+	Index int
+	Lines []int
+}
+
+var (
+	hunkHeader = regexp.MustCompile(`^@@ -(\d+)(?:,(\d+))? \+(\d+)(?:,(\d+))? @@`)
+)
+
+// Splits the diff of one file into the lines before its first hunk and the
+// hunks
+func parseDiffHunks(diff string) ([]string, []DiffHunk, error) {
+	header := []string{}
+	hunks := []DiffHunk{}
+
+	lines := strings.Split(diff, "\n")
+	if len(lines) > 0 && lines[len(lines)-1] == "" {
+		lines = lines[:len(lines)-1]
+	}
+
+	for _, line := range lines {
+		if m := hunkHeader.FindStringSubmatch(line); m != nil {
+			hunk := DiffHunk{Index: len(hunks), Header: line, Lines: []DiffLine{}}
+			hunk.OldStart, _ = strconv.Atoi(m[1])
+			hunk.OldLines = 1
+			if m[2] != "" {
+				hunk.OldLines, _ = strconv.Atoi(m[2])
+			}
+			hunk.NewStart, _ = strconv.Atoi(m[3])
+			hunk.NewLines = 1
+			if m[4] != "" {
+				hunk.NewLines, _ = strconv.Atoi(m[4])
+			}
+			hunks = append(hunks, hunk)
+			continue
+		}
+
+		if len(hunks) == 0 {
+			if strings.HasPrefix(line, "diff --git ") && len(header) > 0 {
+				return nil, nil, errors.New("The diff has more than one file")
+			}
+			header = append(header, line)
+			continue
+		}
+
+		if line == "" {
+			// Some tools strip the space of empty context lines
+			line = " "
+		}
+		hunk := &hunks[len(hunks)-1]
+		hunk.Lines = append(hunk.Lines, DiffLine{Type: line[:1], Text: line[1:]})
+	}
+
+	if strings.Contains(strings.Join(header, "\n"), "\nBinary files ") {
+		return nil, nil, errors.New("Parts of binary files can't be staged")
+	}
+
+	return header, hunks, nil
+}
+
+// Patch of the selected hunks and lines. The changes that aren't selected
+// are left out of the patch: a removal becomes context since the line
+// stays, an addition is dropped. A reverse patch is applied backwards, so
+// it is the other way around.
+func selectedPatch(header []string, hunks []DiffHunk, selections []HunkSelection, reverse bool) (string, error) {
+	selected := make(map[int][]int)
+	for _, selection := range selections {
+		if selection.Index < 0 || selection.Index >= len(hunks) {
+			return "", fmt.Errorf("No hunk %v in the diff", selection.Index)
+		}
+		selected[selection.Index] = selection.Lines
+	}
+
+	patch := append([]string{}, header...)
+	changes := false
+	// Lines that the hunks so far add to the side that changes
+	offset := 0
+
+	for _, hunk := range hunks {
+		lines, ok := selected[hunk.Index]
+		if !ok {
+			continue
+		}
+		pick := make(map[int]bool)
+		for _, idx := range lines {
+			pick[idx] = true
+		}
+
+		body := []string{}
+		oldLines, newLines := 0, 0
+		hunkChanges := false
+		kept := false
+		for idx, line := range hunk.Lines {
+			typ := line.Type
+			if len(lines) > 0 && !pick[idx] && (typ == "+" || typ == "-") {
+				if (typ == "-") != reverse {
+					typ = " "
+				} else {
+					kept = false
+					continue
+				}
+			}
+
+			switch typ {
+			case "\\":
+				if !kept {
+					continue
+				}
+			case " ":
+				oldLines++
+				newLines++
+			case "-":
+				oldLines++
+				hunkChanges = true
+			case "+":
+				newLines++
+				hunkChanges = true
+			}
+			body = append(body, typ+line.Text)
+			kept = true
+		}
+		if !hunkChanges {
+			continue
+		}
+		changes = true
+
+		// The side that the patch is applied to keeps its line numbers
+		oldStart, newStart := hunk.OldStart, hunk.OldStart+offset
+		if reverse {
+			oldStart, newStart = hunk.NewStart-offset, hunk.NewStart
+		}
+		offset += newLines - oldLines
+		patch = append(patch, fmt.Sprintf("@@ -%v,%v +%v,%v @@", oldStart, oldLines, newStart, newLines))
+		patch = append(patch, body...)
+	}
+
+	if !changes {
+		return "", errors.New("Nothing is selected")
+	}
+
+	return strings.Join(patch, "\n") + "\n", nil
+}
+
+// Hunks of the file's diff in the scope
+func gitDiffHunks(ctx context.Context, target gitTarget, scope string) ([]string, []DiffHunk, error) {
+	args, err := diffArgs(scope)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	// The patches are made from plain diffs whatever the user's settings
+	out, err := runGitEnv(ctx, target.dir, lfsDiffEnv, nil, append(args, "--no-color", "--no-ext-diff", "--", target.pathspec())...)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	return parseDiffHunks(string(out))
+}
+
+// Stages the selected hunks of the changes of the file, or unstages them
+// from the changes in the index
+func stageHunks(ctx context.Context, target gitTarget, selections []HunkSelection, unstage bool) error {
+	if target.name == "" {
+		return errors.New("Hunks can only be staged for a file")
+	}
+
+	scope := "Default"
+	if unstage {
+		scope = "Cached"
+	}
+	header, hunks, err := gitDiffHunks(ctx, target, scope)
+	if err != nil {
+		return err
+	}
+	if len(hunks) == 0 {
+		return errors.New("The file has no changes in the scope " + scope)
+	}
+
+	patch, err := selectedPatch(header, hunks, selections, unstage)
+	if err != nil {
+		return err
+	}
+
+	args := []string{"apply", "--cached"}
+	if unstage {
+		args = append(args, "--reverse")
+	}
+	_, err = runGitInput(ctx, target.dir, []byte(patch), append(args, "-")...)
+	return err
+}
@@ -0,0 +1,297 @@
+// Copyright 2014 Chris McGee <sirnewton_01@yahoo.ca>. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	// Pointer files are small text files that start with the version of the
+	//  spec, anything bigger is the content itself
+	lfsPointerVersion = "version https://git-lfs.github.com/spec/v1"
+	lfsPointerMaxSize = 1024
+
+	// The locks are on the LFS server, asking it is kept short and its
+	//  answer is reused for a while
+	lfsLocksTimeout = 5 * time.Second
+	lfsLocksMaxAge  = time.Minute
+)
+
+var (
+	// Diffs of files with the lfs diff attribute are like those of binary
+	//  files instead of the text of their pointers
+	lfsDiffEnv = []string{"GIT_CONFIG_COUNT=1", "GIT_CONFIG_KEY_0=diff.lfs.binary", "GIT_CONFIG_VALUE_0=true"}
+
+	lfsLocksCache = map[string]lfsLocks{}
+	lfsLocksMutex sync.Mutex
+)
+
+// Git LFS details of a file of the workspace
+type LfsInfo struct {
+	// Id and size in bytes of the object, the size of the file in the working
+	//  tree once its content is checked out
+	Oid  string `json:",omitempty"`
+	Size int64
+	// The working tree only has the pointer, the content is at the
+	//  ContentLocation
+	Pointer         bool
+	Locked          bool
+	LockOwner       string `json:",omitempty"`
+	ContentLocation string
+}
+
+type LfsPointer struct {
+	Oid  string
+	Size int64
+}
+
+type lfsLocks struct {
+	time time.Time
+	// Owners of the locked files by their paths in the repository
+	owners map[string]string
+}
+
+func lfsAvailable() bool {
+	_, err := exec.LookPath("git-lfs")
+	return err == nil
+}
+
+// Parses the text of a pointer file, false when it isn't one
+func parseLfsPointer(b []byte) (LfsPointer, bool) {
+	pointer := LfsPointer{Size: -1}
+	if len(b) >= lfsPointerMaxSize || !isLfsPointer(b) {
+		return pointer, false
+	}
+
+	for _, line := range strings.Split(string(b), "\n") {
+		key, value := line, ""
+		if idx := strings.Index(line, " "); idx != -1 {
+			key, value = line[:idx], line[idx+1:]
+		}
+
+		switch key {
+		case "oid":
+			pointer.Oid = strings.TrimPrefix(value, "sha256:")
+			if pointer.Oid == value || len(pointer.Oid) != 64 {
+				return pointer, false
+			}
+		case "size":
+			size, err := strconv.ParseInt(value, 10, 64)
+			if err != nil || size < 0 {
+				return pointer, false
+			}
+			pointer.Size = size
+		}
+	}
+
+	return pointer, pointer.Oid != "" && pointer.Size != -1
+}
+
+// Whether the content starts like a pointer file, enough for the searches to
+// leave it out
+func isLfsPointer(head []byte) bool {
+	return bytes.HasPrefix(head, []byte(lfsPointerVersion))
+}
+
+func readLfsPointer(file string, size int64) (LfsPointer, bool) {
+	if size >= lfsPointerMaxSize || size < int64(len(lfsPointerVersion)) {
+		return LfsPointer{}, false
+	}
+
+	b, err := ioutil.ReadFile(file)
+	if err != nil {
+		return LfsPointer{}, false
+	}
+
+	return parseLfsPointer(b)
+}
+
+// Where the repository keeps the object once it is downloaded
+func lfsObjectPath(dir string, oid string) string {
+	return filepath.Join(gitDir(dir), "lfs", "objects", oid[0:2], oid[2:4], oid)
+}
+
+// LFS details of a file of a directory listing, only pointer files have them
+// since asking git for each child would be too slow
+func lfsPointerInfo(file string, location string, fileinfo os.FileInfo) *LfsInfo {
+	if !fileinfo.Mode().IsRegular() {
+		return nil
+	}
+
+	pointer, ok := readLfsPointer(file, fileinfo.Size())
+	if !ok {
+		return nil
+	}
+
+	return &LfsInfo{Oid: pointer.Oid, Size: pointer.Size, Pointer: true, ContentLocation: "/gitapi/lfs" + location}
+}
+
+// LFS details of the file, nil when it isn't an LFS file. Files with their
+// content checked out are found by their filter attribute, and the lock of
+// the file is looked up when git-lfs is installed.
+func lfsFileInfo(ctx context.Context, srcDirs []string, file string, location string, fileinfo os.FileInfo) *LfsInfo {
+	if !fileinfo.Mode().IsRegular() {
+		return nil
+	}
+
+	target, err := resolveGitTarget(srcDirs, strings.Split(strings.TrimPrefix(location, "/"), "/"))
+	if err != nil || target.name == "" {
+		return nil
+	}
+
+	info := lfsPointerInfo(file, location, fileinfo)
+	if info == nil {
+		out, err := runGit(ctx, target.dir, "check-attr", "filter", "--", target.name)
+		if err != nil || !strings.HasSuffix(strings.TrimSpace(string(out)), ": lfs") {
+			return nil
+		}
+		info = &LfsInfo{Size: fileinfo.Size(), ContentLocation: "/gitapi/lfs" + location}
+	}
+
+	if lfsAvailable() {
+		owner, locked := gitLfsLocks(ctx, target.dir)[target.name]
+		info.Locked, info.LockOwner = locked, owner
+	}
+
+	return info
+}
+
+// The locked files of the repository with their owners, none when the LFS
+// server can't be asked
+func gitLfsLocks(ctx context.Context, dir string) map[string]string {
+	lfsLocksMutex.Lock()
+	cached, ok := lfsLocksCache[dir]
+	lfsLocksMutex.Unlock()
+	if ok && time.Since(cached.time) < lfsLocksMaxAge {
+		return cached.owners
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, lfsLocksTimeout)
+	defer cancel()
+
+	owners := map[string]string{}
+	out, err := runGit(ctx, dir, "lfs", "locks", "--json")
+	if err != nil {
+		handlersLog.Debugf("Unable to list the LFS locks of %v: %v\n", dir, err)
+	} else {
+		locks := []struct {
+			Path  string `json:"path"`
+			Owner struct {
+				Name string `json:"name"`
+			} `json:"owner"`
+		}{}
+		if err := json.Unmarshal(out, &locks); err != nil {
+			handlersLog.Debugf("Unable to read the LFS locks of %v: %v\n", dir, err)
+		}
+		for _, lock := range locks {
+			owners[lock.Path] = lock.Owner.Name
+		}
+	}
+
+	// A failure is kept as well so that an unreachable server isn't asked for
+	//  each file
+	lfsLocksMutex.Lock()
+	lfsLocksCache[dir] = lfsLocks{time: time.Now(), owners: owners}
+	lfsLocksMutex.Unlock()
+
+	return owners
+}
+
+// Downloads the object of the pointer to the repository's LFS storage with
+// git lfs smudge, which fetches it from the LFS server of the remote
+func gitLfsFetch(ctx context.Context, target gitTarget, pointer []byte) error {
+	if !lfsAvailable() {
+		return errors.New("The content isn't downloaded and git-lfs isn't installed")
+	}
+
+	cmd := exec.CommandContext(ctx, "git", "lfs", "smudge", "--", target.name)
+	cmd.Dir = target.dir
+	cmd.Env = append(os.Environ(), "GIT_TERMINAL_PROMPT=0")
+	cmd.Stdin = bytes.NewReader(pointer)
+	// The content is served from the storage afterwards
+	cmd.Stdout = ioutil.Discard
+	stderr := &bytes.Buffer{}
+	cmd.Stderr = stderr
+
+	if err := cmd.Run(); err != nil {
+		return fmt.Errorf("git lfs smudge: %v %v", err, strings.TrimSpace(stderr.String()))
+	}
+
+	return nil
+}
+
+// GET /gitapi/lfs/file/<path> has the content of the LFS file, e.g. for a
+// preview of a file whose working tree only has the pointer. The object is
+// downloaded when the repository doesn't have it yet.
+func lfsRequest(ctx context.Context, writer http.ResponseWriter, req *http.Request, pathSegs []string, request GitRequest) bool {
+	if req.Method != "GET" {
+		return false
+	}
+
+	params, target, err := gitapiParams(req, pathSegs)
+	if err != nil || len(params) != 0 || target.name == "" {
+		ShowError(writer, 404, "Invalid LFS location", err)
+		return true
+	}
+
+	file := filepath.Join(target.dir, filepath.FromSlash(target.name))
+	fileinfo, err := os.Stat(file)
+	if err != nil || !fileinfo.Mode().IsRegular() {
+		ShowError(writer, 404, "No such file: "+target.name, err)
+		return true
+	}
+
+	// The content is already checked out
+	if _, ok := readLfsPointer(file, fileinfo.Size()); !ok {
+		http.ServeFile(writer, req, file)
+		return true
+	}
+
+	pointerText, err := ioutil.ReadFile(file)
+	if err != nil {
+		ShowError(writer, 500, "Unable to read the pointer", err)
+		return true
+	}
+	pointer, _ := parseLfsPointer(pointerText)
+
+	object := lfsObjectPath(target.dir, pointer.Oid)
+	if _, err := os.Stat(object); err != nil {
+		handlersLog.Infof("FETCHING LFS OBJECT %v of %v\n", pointer.Oid, file)
+		if err := gitLfsFetch(ctx, target, pointerText); err != nil {
+			ShowError(writer, 502, "Unable to fetch the content of "+target.name, err)
+			return true
+		}
+	}
+
+	f, err := os.Open(object)
+	if err != nil {
+		ShowError(writer, 502, "The LFS server doesn't have the content of "+target.name, err)
+		return true
+	}
+	defer f.Close()
+
+	objectinfo, err := f.Stat()
+	if err != nil || objectinfo.Size() != pointer.Size {
+		ShowError(writer, 500, "The downloaded content of "+target.name+" is incomplete", err)
+		return true
+	}
+
+	http.ServeContent(writer, req, filepath.Base(file), objectinfo.ModTime(), f)
+	return true
+}
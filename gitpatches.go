@@ -0,0 +1,269 @@
+// Copyright 2014 Chris McGee <sirnewton_01@yahoo.ca>. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"context"
+	"errors"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+// Where the patches that git am applies stand. When a patch doesn't apply,
+// even with a three-way merge, the apply stops at it with the conflicts in
+// the working tree like a merge.
+type PatchStatus struct {
+	Active bool
+	// Number of the patch that stopped the apply, how many there are and
+	//  the subject of the patch
+	Current int    `json:",omitempty"`
+	Total   int    `json:",omitempty"`
+	Subject string `json:",omitempty"`
+	// Files to resolve before the apply can continue
+	Conflicting []StatusEntry
+	// The commits of the patches that were applied
+	Applied        []CommitInfo `json:",omitempty"`
+	StatusLocation string
+	CloneLocation  string
+	Type           string
+}
+
+func gitPatchStatus(ctx context.Context, target gitTarget) (PatchStatus, error) {
+	repository := gitTarget{dir: target.dir, location: target.location}
+	status := PatchStatus{Type: "Patch", Conflicting: []StatusEntry{}, CloneLocation: target.cloneLocation(),
+		StatusLocation: "/gitapi/status" + target.location}
+
+	applyDir := filepath.Join(gitDir(target.dir), "rebase-apply")
+	if _, err := os.Stat(filepath.Join(applyDir, "applying")); err != nil {
+		return status, nil
+	}
+	status.Active = true
+
+	readNumber := func(name string) int {
+		b, _ := ioutil.ReadFile(filepath.Join(applyDir, name))
+		n, _ := strconv.Atoi(strings.TrimSpace(string(b)))
+		return n
+	}
+	status.Current, status.Total = readNumber("next"), readNumber("last")
+
+	// The headers of the mail of the patch
+	if b, err := ioutil.ReadFile(filepath.Join(applyDir, "info")); err == nil {
+		for _, line := range strings.Split(string(b), "\n") {
+			if strings.HasPrefix(line, "Subject: ") {
+				status.Subject = strings.TrimPrefix(line, "Subject: ")
+			}
+		}
+	}
+
+	workingTree, err := gitStatus(ctx, repository)
+	if err != nil {
+		return status, err
+	}
+	status.Conflicting = workingTree.Conflicting
+
+	return status, nil
+}
+
+// The commits as a mailbox of patches with git format-patch, only with the
+// changes of the target. One rev is a commit or a range like v1.0..HEAD,
+// several are the commits that are picked, oldest first.
+func gitFormatPatch(ctx context.Context, target gitTarget, revs []string) ([]byte, error) {
+	if err := validGitNames(revs...); err != nil {
+		return nil, err
+	}
+
+	format := func(args ...string) ([]byte, error) {
+		args = append([]string{"format-patch", "--stdout", "--no-color"}, args...)
+		return runGit(ctx, target.dir, append(args, "--", target.pathspec())...)
+	}
+
+	switch {
+	case len(revs) == 0:
+		return nil, errors.New("No commits to export")
+	case len(revs) == 1 && strings.Contains(revs[0], ".."):
+		return format(revs[0])
+	case len(revs) == 1:
+		return format("-1", revs[0])
+	}
+
+	out, err := runGit(ctx, target.dir, append([]string{"rev-list", "--no-walk=sorted", "--reverse"}, revs...)...)
+	if err != nil {
+		return nil, err
+	}
+
+	mbox := []byte{}
+	for _, commit := range strings.Fields(string(out)) {
+		patch, err := format("-1", commit)
+		if err != nil {
+			return nil, err
+		}
+		mbox = append(mbox, patch...)
+	}
+
+	return mbox, nil
+}
+
+// Applies the patches of a mailbox or patch file with git am, falling back
+// to a three-way merge for those that don't apply as they are
+func gitApplyPatches(ctx context.Context, target gitTarget, file string, signOff bool) (PatchStatus, error) {
+	repository := gitTarget{dir: target.dir, location: target.location}
+	before := ""
+	if out, err := runGit(ctx, target.dir, "rev-parse", "--verify", "-q", "HEAD"); err == nil {
+		before = strings.TrimSpace(string(out))
+	}
+
+	args := []string{"am", "--3way"}
+	if signOff {
+		args = append(args, "--signoff")
+	}
+	_, amErr := runGit(ctx, target.dir, append(args, "--", file)...)
+
+	status, err := gitPatchStatus(ctx, target)
+	if err != nil {
+		return status, err
+	}
+	if amErr != nil && !status.Active {
+		return status, amErr
+	}
+
+	logArgs := []string{"HEAD"}
+	if before != "" {
+		logArgs = []string{before + "..HEAD"}
+	}
+	if applied, err := gitLog(ctx, repository, logArgs...); err == nil {
+		status.Applied = applied
+	}
+
+	return status, nil
+}
+
+// Disk path of a file of the workspace location
+func patchFilePath(req *http.Request, location string) (string, error) {
+	relPath := strings.TrimPrefix(location, "/file/")
+	if relPath == location || relPath == "" {
+		return "", errors.New("The patch isn't a workspace location: " + location)
+	}
+
+	for _, srcDir := range requestSrcDirs(req) {
+		p := filepath.Join(srcDir, filepath.Clean("/"+relPath))
+		if info, err := os.Stat(p); err == nil && info.Mode().IsRegular() {
+			return p, nil
+		}
+	}
+
+	return "", errors.New("No such patch file: " + location)
+}
+
+// GET /gitapi/patch/<commit>/file/<repository> exports the commit, or a
+// range like v1.0..HEAD, as a mailbox of patches for an email workflow.
+// GET /gitapi/patch/file/<repository>?commit=<commit>&commit=... exports
+// the picked commits, without any it is where an apply of patches stands.
+//
+// POST /gitapi/patch/file/<repository> applies the patches of the file at
+// the Patch location of the body, e.g. one uploaded through /xfer, with git
+// am. A patch that doesn't apply stops the apply at it with 409 and the
+// conflicts to resolve in the status, POST with the Operation continue
+// carries on once they are resolved and staged and skip leaves the patch
+// out. DELETE gives up on the apply and goes back to where it started.
+func patchRequest(ctx context.Context, writer http.ResponseWriter, req *http.Request, pathSegs []string, request GitRequest) bool {
+	params, target, err := gitapiParams(req, pathSegs)
+	if err != nil || len(params) > 1 || (len(params) == 1 && req.Method != "GET") {
+		ShowError(writer, 404, "Invalid patch location", err)
+		return true
+	}
+
+	switch {
+	case req.Method == "GET" && (len(params) == 1 || len(req.URL.Query()["commit"]) > 0):
+		revs := req.URL.Query()["commit"]
+		if len(params) == 1 {
+			revs = params
+		}
+
+		mbox, err := gitFormatPatch(ctx, target, revs)
+		if err != nil {
+			ShowError(writer, 400, "Unable to export the patches", err)
+			return true
+		}
+
+		writer.Header().Set("Content-Type", "application/mbox")
+		writer.Header().Set("Content-Disposition", `attachment; filename="`+filepath.Base(target.dir)+`.patch"`)
+		writer.Write(mbox)
+		return true
+	case req.Method == "GET":
+		status, err := gitPatchStatus(ctx, target)
+		if err != nil {
+			ShowError(writer, 500, "Unable to get the status of the patches", err)
+			return true
+		}
+
+		ShowJson(writer, 200, status)
+		return true
+	case (req.Method == "POST" || req.Method == "DELETE") && showLocked(writer, req, target.location):
+		// The patches can change any file of the repository
+		return true
+	case req.Method == "POST":
+		var status PatchStatus
+		switch {
+		case request.Operation == "continue" || request.Operation == "skip":
+			if _, err := runGit(ctx, target.dir, "am", "--"+request.Operation); err != nil {
+				status, _ = gitPatchStatus(ctx, target)
+				if !status.Active {
+					ShowError(writer, 400, "Unable to "+request.Operation+" the patches", err)
+					return true
+				}
+				ShowJson(writer, 409, status)
+				return true
+			}
+			status, err = gitPatchStatus(ctx, target)
+		case request.Operation != "":
+			ShowError(writer, 400, "Patches are continued or skipped, not "+request.Operation, nil)
+			return true
+		case request.Patch != "":
+			file, err := patchFilePath(req, request.Patch)
+			if err != nil {
+				ShowError(writer, 404, err.Error(), nil)
+				return true
+			}
+			if current, _ := gitPatchStatus(ctx, target); current.Active {
+				ShowJson(writer, 409, current)
+				return true
+			}
+
+			status, err = gitApplyPatches(ctx, target, file, bool(request.SignOff))
+			if err != nil {
+				ShowError(writer, 400, "Unable to apply the patches", err)
+				return true
+			}
+		default:
+			ShowError(writer, 400, "Either a Patch or an Operation is needed", nil)
+			return true
+		}
+		if err != nil {
+			ShowError(writer, 500, "Unable to get the status of the patches", err)
+			return true
+		}
+
+		if status.Active {
+			ShowJson(writer, 409, status)
+			return true
+		}
+		ShowJson(writer, 200, status)
+		return true
+	case req.Method == "DELETE":
+		if _, err := runGit(ctx, target.dir, "am", "--abort"); err != nil {
+			ShowError(writer, 400, "No patches are being applied", err)
+			return true
+		}
+
+		writer.WriteHeader(204)
+		return true
+	}
+
+	return false
+}
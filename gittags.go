@@ -0,0 +1,297 @@
+// Copyright 2014 Chris McGee <sirnewton_01@yahoo.ca>. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+const (
+	// Fields of a tag from git for-each-ref, separated by NUL
+	tagFormat = "%(refname:short)%00%(refname)%00%(objecttype)%00%(objectname)%00%(*objectname)%00" +
+		"%(taggername)%00%(taggeremail)%00%(creatordate:unix)%00%(contents:subject)%00" +
+		"%(if)%(contents:signature)%(then)signed%(end)"
+)
+
+// The tags of the repository, newest first, or the one with the name
+func gitTags(ctx context.Context, target gitTarget, name string) ([]TagInfo, error) {
+	pattern := "refs/tags"
+	if name != "" {
+		pattern = "refs/tags/" + name
+	}
+
+	out, err := runGit(ctx, target.dir, "for-each-ref", "--sort=-creatordate", "--format="+tagFormat, pattern)
+	if err != nil {
+		return nil, err
+	}
+
+	tags := []TagInfo{}
+	for _, line := range strings.Split(strings.TrimSpace(string(out)), "\n") {
+		fields := strings.Split(line, "\x00")
+		if len(fields) != 10 || (name != "" && fields[1] != pattern) {
+			continue
+		}
+
+		tag := TagInfo{Type: "Tag", Name: fields[0], FullName: fields[1], Commit: fields[3],
+			Location: "/gitapi/tag/" + gitRefSeg(fields[0]) + target.location, CloneLocation: target.cloneLocation()}
+		// An annotated tag is an object of its own that points at the commit
+		if fields[2] == "tag" {
+			tag.Annotated, tag.Commit, tag.Signed = true, fields[4], fields[9] == "signed"
+			tag.Message, tag.TaggerName = fields[8], fields[5]
+			tag.TaggerEmail = strings.TrimSuffix(strings.TrimPrefix(fields[6], "<"), ">")
+		}
+		seconds, _ := strconv.ParseInt(fields[7], 10, 64)
+		tag.Time = seconds * 1000
+		tag.CommitLocation = "/gitapi/commit/" + gitRefSeg(tag.Commit) + target.location
+
+		tags = append(tags, tag)
+	}
+
+	return tags, nil
+}
+
+// Keyring for signing with the key of the SigningKey secret, made for the
+// tag and removed afterwards so that the key is never left on disk. The
+// environment points gpg to it and the fingerprint picks the key.
+func gpgSigningHome(ctx context.Context, user string, request GitRequest) (string, string, []string, error) {
+	key, ok := userSecret(user, request.SigningKey)
+	if !ok {
+		return "", "", nil, errors.New("No such secret: " + request.SigningKey)
+	}
+	secrets := []string{key}
+
+	// Short path since the agent's socket goes in it
+	home, err := newTempDir("godev-gpg")
+	if err != nil {
+		return "", "", nil, err
+	}
+
+	conf := "batch\nno-tty\n"
+	if request.SigningPassphrase != "" {
+		passphrase, ok := userSecret(user, request.SigningPassphrase)
+		if !ok {
+			removeTempDir(home)
+			return "", "", nil, errors.New("No such secret: " + request.SigningPassphrase)
+		}
+		secrets = append(secrets, passphrase)
+
+		passphraseFile := filepath.Join(home, "passphrase")
+		if err := ioutil.WriteFile(passphraseFile, []byte(passphrase), 0600); err != nil {
+			removeTempDir(home)
+			return "", "", nil, err
+		}
+		conf += "pinentry-mode loopback\npassphrase-file " + passphraseFile + "\n"
+	}
+	if err := ioutil.WriteFile(filepath.Join(home, "gpg.conf"), []byte(conf), 0600); err != nil {
+		removeTempDir(home)
+		return "", "", nil, err
+	}
+
+	gpg := func(input []byte, args ...string) ([]byte, error) {
+		cmd := exec.CommandContext(ctx, "gpg", append([]string{"--homedir", home}, args...)...)
+		cmd.Stdin = bytes.NewReader(input)
+		stderr := &bytes.Buffer{}
+		cmd.Stderr = stderr
+		out, err := cmd.Output()
+		if err != nil {
+			return out, fmt.Errorf("gpg: %v %v", err, maskSecrets(strings.TrimSpace(stderr.String()), secrets))
+		}
+		return out, nil
+	}
+
+	if _, err := gpg([]byte(key), "--import"); err != nil {
+		removeGpgHome(home)
+		return "", "", secrets, err
+	}
+	out, err := gpg(nil, "--with-colons", "--list-secret-keys")
+	if err != nil {
+		removeGpgHome(home)
+		return "", "", secrets, err
+	}
+
+	// The fingerprint of the first secret key
+	fingerprint := ""
+	for _, line := range strings.Split(string(out), "\n") {
+		fields := strings.Split(line, ":")
+		if len(fields) > 9 && fields[0] == "fpr" {
+			fingerprint = fields[9]
+			break
+		}
+	}
+	if fingerprint == "" {
+		removeGpgHome(home)
+		return "", "", secrets, errors.New("The secret " + request.SigningKey + " has no private key")
+	}
+
+	return home, fingerprint, secrets, nil
+}
+
+func removeGpgHome(home string) {
+	exec.Command("gpgconf", "--homedir", home, "--kill", "gpg-agent").Run()
+	removeTempDir(home)
+}
+
+// Creates the tag of the request at its Commit, HEAD by default. A tag with
+// a Message or a signature is annotated, the others are lightweight.
+func gitCreateTag(ctx context.Context, user string, target gitTarget, request GitRequest) error {
+	commit := request.Commit
+	if commit == "" {
+		commit = "HEAD"
+	}
+	if err := validGitNames(request.Name, commit); err != nil {
+		return err
+	}
+	if request.Name == "" {
+		return errors.New("Missing tag name")
+	}
+	if _, err := runGit(ctx, target.dir, "check-ref-format", "refs/tags/"+request.Name); err != nil {
+		return errors.New("Invalid tag name: " + request.Name)
+	}
+
+	args := []string{"tag"}
+	if request.Force {
+		args = append(args, "--force")
+	}
+
+	env := []string{}
+	secrets := []string{}
+	switch {
+	case bool(request.Sign) && request.SigningKey != "":
+		home, fingerprint, keySecrets, err := gpgSigningHome(ctx, user, request)
+		secrets = keySecrets
+		if err != nil {
+			return err
+		}
+		defer removeGpgHome(home)
+
+		// Whatever signing program the configuration has, the key is in the
+		//  keyring of gpg
+		env = append(env, "GNUPGHOME="+home, "GIT_CONFIG_COUNT=2", "GIT_CONFIG_KEY_0=gpg.format",
+			"GIT_CONFIG_VALUE_0=openpgp", "GIT_CONFIG_KEY_1=gpg.program", "GIT_CONFIG_VALUE_1=gpg")
+		args = append(args, "--sign", "--local-user", fingerprint)
+	case bool(request.Sign):
+		args = append(args, "--sign")
+	case request.Message != "":
+		args = append(args, "--annotate")
+	}
+
+	// Signed tags are annotated and need a message
+	message := request.Message
+	if message == "" && bool(request.Sign) {
+		message = request.Name
+	}
+	if message != "" {
+		args = append(args, "--file", "-")
+	}
+
+	_, err := runGitEnv(ctx, target.dir, env, []byte(message), append(args, "--", request.Name, commit)...)
+	if err != nil {
+		return errors.New(maskSecrets(err.Error(), secrets))
+	}
+
+	return nil
+}
+
+// GET /gitapi/tag/file/<repository> lists the tags of the repository and
+// GET /gitapi/tag/<name>/file/<repository> has the one tag. POST
+// /gitapi/tag/file/<repository> creates the tag with the Name of the body at
+// the Commit, annotated with the Message and signed with Sign. POST to the
+// tag pushes it to the Remote of the body. DELETE deletes the tag, and with
+// ?remote=<remote> deletes it from the remote as well.
+func tagRequest(ctx context.Context, writer http.ResponseWriter, req *http.Request, pathSegs []string, request GitRequest) bool {
+	params, target, err := gitapiParams(req, pathSegs)
+	if err != nil || len(params) > 1 {
+		ShowError(writer, 404, "Invalid tag location", err)
+		return true
+	}
+
+	switch {
+	case req.Method == "GET":
+		name := ""
+		if len(params) == 1 {
+			name = params[0]
+		}
+
+		tags, err := gitTags(ctx, target, name)
+		if err != nil {
+			ShowError(writer, 500, "Unable to list the tags", err)
+			return true
+		}
+
+		if name != "" {
+			if len(tags) == 0 {
+				ShowError(writer, 404, "No such tag: "+name, nil)
+				return true
+			}
+			ShowJson(writer, 200, tags[0])
+			return true
+		}
+
+		ShowJson(writer, 200, TagResponse{Type: "Tag", Children: tags})
+		return true
+	case req.Method == "POST" && len(params) == 0:
+		if err := gitCreateTag(ctx, requestUser(req), target, request); err != nil {
+			ShowError(writer, 400, "Unable to create the tag", err)
+			return true
+		}
+
+		tags, err := gitTags(ctx, target, request.Name)
+		if err != nil || len(tags) == 0 {
+			ShowError(writer, 500, "Unable to read the tag", err)
+			return true
+		}
+
+		writer.Header().Add("Location", tags[0].Location)
+		ShowJson(writer, 201, tags[0])
+		return true
+	case req.Method == "POST":
+		if err := validGitNames(request.Remote); err != nil || request.Remote == "" {
+			ShowError(writer, 400, "Invalid remote", err)
+			return true
+		}
+
+		args := []string{"push", request.Remote}
+		if request.Force {
+			args = append(args, "--force")
+		}
+		if _, err := runGit(ctx, target.dir, append(args, "refs/tags/"+params[0]+":refs/tags/"+params[0])...); err != nil {
+			ShowError(writer, 500, "Push failed", err)
+			return true
+		}
+
+		ShowJson(writer, 200, map[string]string{"Result": "OK"})
+		return true
+	case req.Method == "DELETE" && len(params) == 1:
+		if remote := req.URL.Query().Get("remote"); remote != "" {
+			if err := validGitNames(remote); err != nil {
+				ShowError(writer, 400, "Invalid remote", err)
+				return true
+			}
+			if _, err := runGit(ctx, target.dir, "push", remote, ":refs/tags/"+params[0]); err != nil {
+				ShowError(writer, 500, "Unable to delete the tag from "+remote, err)
+				return true
+			}
+		}
+
+		if _, err := runGit(ctx, target.dir, "tag", "--delete", "--", params[0]); err != nil {
+			ShowError(writer, 404, "Unable to delete the tag", err)
+			return true
+		}
+
+		writer.WriteHeader(204)
+		return true
+	}
+
+	return false
+}
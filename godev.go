@@ -5,11 +5,11 @@
 package main
 
 import (
+	"crypto/tls"
 	"encoding/json"
 	"flag"
 	"fmt"
 	"go/build"
-	"io/ioutil"
 	"log"
 	"math/rand"
 	"net/http"
@@ -18,9 +18,7 @@ import (
 	"path/filepath"
 	"runtime"
 
-	"strconv"
 	"strings"
-	"sync"
 	"time"
 )
 
@@ -28,46 +26,74 @@ import (
 //
 ///////////////////////////////////////////////////////////////////////////////
 const (
-	loopbackHost     = "127.0.0.1"
-	defaultPort      = "2022"
-	maxRatePerSecond = 1000
+	loopbackHost         = "127.0.0.1"
+	defaultPort          = "2022"
+	defaultRatePerSecond = 100
+	defaultRateBurst     = 200
 )
 
 ///////////////////////////////////////////////////////////////////////////////
 //
 ///////////////////////////////////////////////////////////////////////////////
 var (
-	goroot                       = ""
-	srcDirs                      = []string{}
-	bundle_root_dir              = ""
-	godev_src_dir                = flag.String("srcdir", "", "Source directory of godev if not in the standard location in GOPATH")
-	port                         = flag.String("port", defaultPort, "HTTP port number for the development server. (e.g. '2022')")
-	debug                        = flag.Bool("debug", false, "Put the development server in debug mode with detailed logging.")
-	remoteAccount                = flag.String("remoteAccount", "", "Email address of account that should be used to authenticate for remote access.")
-	logger           *log.Logger = nil
-	hostName                     = loopbackHost
-	magicKey                     = ""
-	certFile                     = ""
-	keyFile                      = ""
-	rateTracker                  = 0
-	rateTrackerMutex sync.Mutex
-	fileSystem       *ChainedFileSystem
-	handlers         *Handlers
+	goroot                        = runtime.GOROOT() + string(os.PathSeparator)
+	srcDirs                       = []string{}
+	bundle_root_dir               = ""
+	godev_src_dir                 = flag.String("srcdir", "", "Source directory of godev if not in the standard location in GOPATH")
+	port                          = flag.String("port", defaultPort, "HTTP port number for the development server. (e.g. '2022')")
+	listenAddr                    = flag.String("listen", "", "Address of the development server, host:port in place of GOHOST and the port, or unix:///path/to/godev.sock for a Unix domain socket that only the owner can connect to.")
+	debug                         = flag.Bool("debug", false, "Put the development server in debug mode with detailed logging.")
+	remoteAccount                 = flag.String("remoteAccount", "", "Email address of account that should be used to authenticate for remote access.")
+	dataDir                       = flag.String("datadir", "", "Directory where godev stores its server-side state. (defaults to ~/.godev)")
+	idleTimeout                   = flag.Duration("idleTimeout", 2*time.Hour, "Terminate the processes of browser sessions idle for longer than this. (0 disables)")
+	buildTimeout                  = flag.Duration("buildTimeout", 10*time.Minute, "Maximum duration of a build.")
+	testTimeout                   = flag.Duration("testTimeout", 10*time.Minute, "Maximum duration of a test run of the /go/test service.")
+	searchTimeout                 = flag.Duration("searchTimeout", 2*time.Minute, "Maximum duration of a file search.")
+	blameTimeout                  = flag.Duration("blameTimeout", 1*time.Minute, "Maximum duration of a blame.")
+	cgiTimeout                    = flag.Duration("cgiTimeout", 5*time.Minute, "Maximum duration of a bundle CGI command.")
+	historyRetention              = flag.Duration("historyRetention", 30*24*time.Hour, "Local history, drafts and other records older than this are pruned by garbage collection.")
+	gcInterval                    = flag.Duration("gcInterval", 24*time.Hour, "How often garbage collection runs in the background. (0 disables)")
+	usageStats                    = flag.Bool("usageStats", false, "Record counts and latencies of editor operations in a local file (nothing is reported anywhere).")
+	toolTimeout                   = flag.Duration("toolTimeout", 30*time.Second, "Maximum duration of editor tools (completion, formatting, definitions, etc.)")
+	mirrorTo                      = flag.String("mirrorTo", "", "Sync URL of a standby godev to replicate the workspace to (e.g. 'https://standby:2022/xfer/sync'). Its magic key is taken from GODEV_MAGIC.")
+	mirrorInterval                = flag.Duration("mirrorInterval", 15*time.Minute, "How often the workspace is replicated to the standby.")
+	pairingTimeout                = flag.Duration("pairingTimeout", 10*time.Minute, "How long the pairing URL printed at startup can be used to connect a device.")
+	mailerKind                    = flag.String("mailer", "", "How to mail access details and security alerts to the remoteAccount: 'smtp', 'sendmail' or 'dryrun' to only log them.")
+	smtpServer                    = flag.String("smtpServer", "", "SMTP server (host:port) of the smtp mailer.")
+	smtpUser                      = flag.String("smtpUser", "", "User name for the SMTP server, the password is taken from GODEV_SMTP_PASSWORD.")
+	mailFrom                      = flag.String("mailFrom", "godev@localhost", "Sender address of the mail from godev.")
+	maxUploadSize                 = flag.Int64("maxUploadSize", 512<<20, "Largest file in bytes that can be saved or uploaded, after any gzip encoding is removed.")
+	bundleAssets                  = flag.Bool("bundleAssets", false, "Pack and minify the scripts and style sheets of the bundles at startup to cut down on requests over remote connections.")
+	readOnly                      = flag.Bool("readOnly", false, "Serve the workspace as a read-only mirror that only accepts changes through replication.")
+	scratchTimeout                = flag.Duration("scratchTimeout", 10*time.Second, "Maximum duration of a scratch program run.")
+	scratchMemory                 = flag.Int64("scratchMemory", 256, "Memory limit in megabytes of a scratch program run.")
+	gitTimeout                    = flag.Duration("gitTimeout", 5*time.Minute, "Maximum duration of a git operation of the git pages, including clones and pushes.")
+	httpClientTimeout             = flag.Duration("httpClientTimeout", 1*time.Minute, "Maximum duration of a request sent by the HTTP client service.")
+	lsp                           = flag.Bool("lsp", false, "Serve the completion, definitions, formatting, imports and outline of godev to an editor with the Language Server Protocol on standard input and output, instead of the web server.")
+	lspPort                       = flag.String("lspPort", "", "Also serve the Language Server Protocol on this port of the loopback interface, to editors on the same machine. (empty disables)")
+	dbTimeout                     = flag.Duration("dbTimeout", 1*time.Minute, "Maximum duration of a query of the database client service.")
+	shellCommands                 = flag.String("shellCommands", "go,git,make", "Comma separated commands that the shell page can run in workspace directories. (empty disables)")
+	hostName                      = loopbackHost
+	magicKey                      = ""
+	certFile                      = ""
+	keyFile                       = ""
+	fileSystem        *ChainedFileSystem
+	handlers          *Handlers
 )
 
 ///////////////////////////////////////////////////////////////////////////////
-//
+// Reads the flags and the configuration of the server. It is left to main so
+//  that the tests can run without a godev installation.
 ///////////////////////////////////////////////////////////////////////////////
-func init() {
+func setup() {
 	flag.Parse()
 
-	if *debug {
-		logger = log.New(os.Stdout, "godev", log.LstdFlags)
-	} else {
-		logger = log.New(ioutil.Discard, "godev", log.LstdFlags)
+	if err := configureLogging(); err != nil {
+		log.Fatal(err)
+	}
+	if err := configureAccessLog(); err != nil {
+		log.Fatal(err)
 	}
-
-	goroot = runtime.GOROOT() + string(os.PathSeparator)
 
 	dirs := build.Default.SrcDirs()
 
@@ -88,6 +114,15 @@ func init() {
 		}
 	}
 
+	// The directory of "godev <dir>" replaces the GOPATH source directories
+	if dir := projectArg(); dir != "" {
+		err := openProject(dir)
+		if err != nil {
+			log.Fatal("Unable to open the project "+dir+": ", err)
+		}
+	}
+	registerWorktreesDir()
+
 	// Try the location provided by the srcdir flag
 	if bundle_root_dir == "" && *godev_src_dir != "" {
 		_, err := os.Stat(*godev_src_dir + "/bundles")
@@ -101,32 +136,45 @@ func init() {
 		log.Fatal("GOPATH variable doesn't contain the godev source.\nEither add the location to the godev source to your GOPATH or set the srcdir flag to the location.")
 	}
 
-	if os.Getenv("GOHOST") != "" {
-		hostName = os.Getenv("GOHOST")
+	err := initServerConfig()
+	if err != nil {
+		log.Fatal("Unable to read the configuration "+serverConfigFile()+": ", err)
+	}
 
-		certFile = os.Getenv("GOCERTFILE")
-		keyFile = os.Getenv("GOKEYFILE")
+	host, err := listenFlagHost()
+	if err != nil {
+		log.Fatal(err)
+	}
+	// A proxy in front of the socket takes care of remote access
+	if host == "" && socketPath == "" {
+		host = configuredEnv("GOHOST", configuredHost())
+	}
+
+	if host != "" {
+		hostName = host
 
 		// If the host name is not loopback then we must use a secure connection
-		//  with certificatns
-		if certFile == "" || keyFile == "" {
-			log.Fatal("When using a public port a certificate file (GOCERTFILE) and key file (GOKEYFILE) environment variables must be provided to secure the connection.")
+		//  with certificates, a self-signed one unless they are provided or come
+		//  from ACME
+		if hostName != loopbackHost && currentServerConfig().Acme == nil {
+			certFile, keyFile, err = serverCertFiles(currentServerConfig())
+			if err != nil {
+				log.Fatal("Unable to set up the certificate: ", err)
+			}
 		}
 
-		// Initialize the random magic key for this session
+		// Seed the identifiers and pick up the keys of the last run, the owner
+		//  keeps the primary key
 		rand.Seed(time.Now().UTC().UnixNano())
-		magicKey = strconv.FormatInt(rand.Int63(), 16)
+		loadMagicKeys()
+		magicKey = primaryMagicKey()
 	}
 
-	// Clear out the rate tracker every second.
-	// The rate tracking helps to prevent anyone from
-	//   trying to brute force the magic key.
+	// Clear out the rate limits of the clients that went quiet
 	go func() {
 		for {
-			<-time.After(1 * time.Second)
-			rateTrackerMutex.Lock()
-			rateTracker = 0
-			rateTrackerMutex.Unlock()
+			<-time.After(1 * time.Minute)
+			pruneRateBuckets()
 		}
 	}()
 }
@@ -152,12 +200,19 @@ type Status struct {
 // Helper function to write an Orion-compatible error message with an optional error object
 ///////////////////////////////////////////////////////////////////////////////
 func ShowError(writer http.ResponseWriter, httpCode uint, message string, err error) {
-	writer.Header().Add("Content-Type", "application/json")
-	writer.WriteHeader(int(httpCode))
 	errStr := ""
 	if err != nil {
 		errStr = err.Error()
 	}
+
+	// Browsers navigating to a service get a readable page instead
+	if rw, ok := writer.(requestWriter); ok && wantsHtml(rw.req) {
+		showErrorPage(writer, rw.req, httpCode, message, errStr)
+		return
+	}
+
+	writer.Header().Add("Content-Type", "application/json")
+	writer.WriteHeader(int(httpCode))
 	status := Status{SEV_ERR, httpCode, message, errStr}
 	bytes, err := json.Marshal(status)
 	if err != nil {
@@ -189,7 +244,7 @@ func ShowJson(writer http.ResponseWriter, httpCode uint, obj interface{}) {
 //
 ///////////////////////////////////////////////////////////////////////////////
 func getLogicalPos(localPos string) (logicalPos string) {
-	for _, path := range append(srcDirs, filepath.Join(goroot, "/src/pkg")) {
+	for _, path := range append(append([]string{}, srcDirs...), filepath.Join(goroot, "/src/pkg")) {
 		match := path
 		if match[len(match)-1] != filepath.Separator {
 			match = match + string(filepath.Separator)
@@ -226,25 +281,139 @@ func (file noReaddirFile) Readdir(count int) ([]os.FileInfo, error) {
 //
 ///////////////////////////////////////////////////////////////////////////////
 func main() {
+	setup()
+
+	// Commands that work on the server state instead of serving it
+	switch flag.Arg(0) {
+	case "backup", "restore":
+		err := backupCommand(flag.Arg(0), flag.Args()[1:])
+		if err != nil {
+			log.Fatal(err)
+		}
+		return
+	case "sync":
+		err := syncCommand(flag.Args()[1:])
+		if err != nil {
+			log.Fatal(err)
+		}
+		return
+	case "open":
+		err := openCommand(flag.Args()[1:])
+		if err != nil {
+			log.Fatal(err)
+		}
+		return
+	case "list":
+		err := listCommand(flag.Args()[1:])
+		if err != nil {
+			log.Fatal(err)
+		}
+		return
+	}
+	if flag.NArg() > 0 && projectDir == "" {
+		log.Fatal("No such command or directory: " + flag.Arg(0))
+	}
 
 	fileSystem, err := CFSInitialize(bundle_root_dir)
 	if err != nil {
 		log.Fatal(err)
 	}
 
+	if *bundleAssets {
+		err = packBundles(fileSystem)
+		if err != nil {
+			log.Fatal(err)
+		}
+	}
+
 	handlers, err = HandlersInitialize(fileSystem)
 	if err != nil {
 		log.Fatal(err)
 	}
 
-	if hostName == loopbackHost {
-		fmt.Printf("http://%v:%v\n", hostName, *port)
-		err = http.ListenAndServe(hostName+":"+*port, nil)
+	if *mailerKind != "" {
+		_, err = currentMailer()
+		if err != nil {
+			log.Fatal(err)
+		}
+	}
+
+	if *lsp {
+		err = serveLspStdio()
+		if err != nil {
+			log.Fatal(err)
+		}
+		return
+	}
+
+	// The LSP has no login, editors of other machines don't get to use it
+	if *lspPort != "" && hostName == loopbackHost {
+		go listenLsp(*lspPort)
+	} else if *lspPort != "" {
+		log.Fatal("The lspPort can't be used when serving other machines with GOHOST.")
+	}
+
+	startReaper(*idleTimeout)
+	startUsageStats()
+	startGc(*gcInterval)
+	startMirror(*mirrorTo, *mirrorInterval)
+	startSymbolIndex()
+	startConfigReloader()
+	startGitFetcher(*gitFetchInterval)
+
+	if acmeConfig := currentServerConfig().Acme; acmeConfig != nil && hostName != loopbackHost {
+		err = startAcme(*acmeConfig, hostName)
+		if err != nil {
+			log.Fatal(err)
+		}
+	}
+
+	listener, err := listenServer(hostName)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	setServerReady()
+
+	httpServer = newServer(prefixHandler(http.DefaultServeMux))
+	stopOnSignals()
+
+	if socketPath != "" {
+		// Plain HTTP for a proxy such as nginx in front of it
+		fmt.Println("unix://" + socketPath)
+		registerInstance("unix://" + socketPath)
+		err = httpServer.Serve(listener)
+	} else if hostName == loopbackHost {
+		url := fmt.Sprintf("http://%v:%v%v", hostName, *port, routePrefix())
+		fmt.Println(url)
+		registerInstance(url)
+		if *openBrowser {
+			go openBrowserWhenReady(url, url)
+		}
+		err = httpServer.Serve(listener)
 	} else {
-		fmt.Printf("https://%v:%v/login?MAGIC=%v\n", hostName, *port, magicKey)
-		err = http.ListenAndServeTLS(hostName+":"+*port, certFile, keyFile, nil)
+		fmt.Println(loginUrl(magicKey))
+		if selfSignedFingerprint != "" {
+			fmt.Println("Self-signed certificate, SHA-256 fingerprint " + selfSignedFingerprint)
+		}
+		printPairing()
+		sendMailAsync("login", MailData{Url: loginUrl(magicKey)})
+		registerInstance(fmt.Sprintf("https://%v:%v%v", hostName, *port, routePrefix()))
+		if *openBrowser {
+			go openBrowserWhenReady(fmt.Sprintf("https://%v:%v%v", hostName, *port, routePrefix()), loginUrl(magicKey))
+		}
+		// The certificate can be replaced by reloading the configuration
+		httpServer.TLSConfig = &tls.Config{GetCertificate: serverCertificate, NextProtos: serverNextProtos()}
+		if !*http2 {
+			httpServer.TLSNextProto = map[string]func(*http.Server, *tls.Conn, http.Handler){}
+		}
+		err = httpServer.ServeTLS(listener, "", "")
 	}
 
+	if err == http.ErrServerClosed {
+		<-shutdownDone
+		return
+	}
 	if err != nil {
 		log.Fatal(err)
 	}
@@ -0,0 +1,415 @@
+// Copyright 2014 Chris McGee <sirnewton_01@yahoo.ca>. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"code.google.com/p/go.net/websocket"
+)
+
+const (
+	// Most output kept for each test and for the errors of the go command
+	maxTestOutput = 64 << 10
+)
+
+// Tests to run, from the query of the socket or the body of a POST
+type GoTestRequest struct {
+	// Import path of the package, or the workspace location of its
+	//  directory in Dir
+	Package string `json:",omitempty"`
+	Dir     string `json:",omitempty"`
+	// Regular expression selecting the tests, as with go test -run
+	Run  string `json:",omitempty"`
+	Race bool   `json:",omitempty"`
+	// Keeps a cover profile of the run for /go/coverage
+	Cover bool `json:",omitempty"`
+}
+
+// Message of a test run, the Type is start, output, result or done
+type GoTestEvent struct {
+	Type string
+	// Id of the run to cancel it with, in the start message
+	Id      string `json:",omitempty"`
+	Package string `json:",omitempty"`
+	Test    string `json:",omitempty"`
+	// Output as it is printed, what the go command itself reports comes
+	//  on stderr
+	Output string `json:",omitempty"`
+	Stderr bool   `json:",omitempty"`
+	// pass, fail or skip and the duration in seconds
+	Result  string        `json:",omitempty"`
+	Elapsed float64       `json:",omitempty"`
+	Report  *GoTestReport `json:",omitempty"`
+}
+
+// Result of a test, or of a whole package when the Test is empty
+type GoTestResult struct {
+	Package string
+	Test    string `json:",omitempty"`
+	Result  string
+	Elapsed float64
+	Output  string `json:",omitempty"`
+}
+
+type GoTestReport struct {
+	Passed    int
+	Failed    int
+	Skipped   int
+	Cancelled bool `json:",omitempty"`
+	// Build failures and other errors of the go command
+	Error    string `json:",omitempty"`
+	ExitCode int
+	// Seconds
+	Elapsed float64
+	// Percentage of the statements covered, when the run had cover on
+	Coverage float64 `json:",omitempty"`
+	Results  []GoTestResult
+}
+
+// Line of go test -json, see go doc test2json
+type testJsonEvent struct {
+	Action  string
+	Package string
+	Test    string
+	Elapsed float64
+	Output  string
+}
+
+// Cancels the run when the reaper or the user ends its process
+type testRunCloser struct {
+	cancel context.CancelFunc
+	conn   io.Closer
+}
+
+func (c testRunCloser) Close() error {
+	c.cancel()
+	if c.conn != nil {
+		return c.conn.Close()
+	}
+
+	return nil
+}
+
+// The go test arguments and working directory of the request
+func goTestArgs(srcDirs []string, request GoTestRequest) ([]string, string, error) {
+	args := []string{"test", "-json"}
+	if request.Race {
+		args = append(args, "-race")
+	}
+	if request.Run != "" {
+		args = append(args, "-run="+request.Run)
+	}
+
+	if request.Dir != "" {
+		dir, err := shellDir(srcDirs, request.Dir)
+		if err != nil {
+			return nil, "", err
+		}
+		return append(args, "."), dir, nil
+	}
+
+	switch {
+	case request.Package == "":
+		return nil, "", errors.New("No package provided")
+	case strings.HasPrefix(request.Package, "-"):
+		return nil, "", errors.New("Invalid package: " + request.Package)
+	case request.Package == "all" || request.Package == "std":
+		// Would take way too long to run
+		return nil, "", errors.New("Service doesn't support running tests against all packages")
+	}
+
+	return append(args, request.Package), "", nil
+}
+
+// Runs the tests, sending the output and results as they come. The
+// report is also returned for clients that wait for the end of the run.
+func runGoTest(ctx context.Context, user string, request GoTestRequest, conn io.Closer, send func(GoTestEvent)) GoTestReport {
+	report := GoTestReport{Results: []GoTestResult{}}
+
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	args, dir, err := goTestArgs(userSrcDirs(user), request)
+	if err != nil {
+		report.Error = err.Error()
+		report.ExitCode = -1
+		return report
+	}
+
+	// The profile is kept once the run has written it
+	profile := ""
+	if request.Cover {
+		f, err := workspaceTempFile(user, "godev-cover")
+		if err != nil {
+			report.Error = err.Error()
+			report.ExitCode = -1
+			return report
+		}
+		f.Close()
+		profile = f.Name()
+		defer os.Remove(profile)
+
+		args = append(args[:2], append([]string{"-coverprofile=" + profile}, args[2:]...)...)
+	}
+
+	cmd := goCommand(ctx, args...)
+	cmd.Dir = dir
+	cmd.Env = workspaceEnv(user)
+	defer func() {
+		go trimWorkspaceCache(user)
+	}()
+	stdout, err := cmd.StdoutPipe()
+	if err != nil {
+		report.Error = err.Error()
+		report.ExitCode = -1
+		return report
+	}
+	stderr, err := cmd.StderrPipe()
+	if err != nil {
+		report.Error = err.Error()
+		report.ExitCode = -1
+		return report
+	}
+
+	start := time.Now()
+	err = cmd.Start()
+	if err != nil {
+		report.Error = "Go test failed to start: " + err.Error()
+		report.ExitCode = -1
+		return report
+	}
+	proc := registerProcess(user, "test", cmd, testRunCloser{cancel, conn})
+	defer proc.unregister()
+
+	send(GoTestEvent{Type: "start", Id: proc.Id, Package: request.Package})
+
+	stderrOutput := &cappedBuffer{limit: maxTestOutput}
+	wg := sync.WaitGroup{}
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+
+		reader := bufio.NewReader(stderr)
+		for {
+			line, err := reader.ReadString('\n')
+			if line != "" {
+				proc.touch()
+				stderrOutput.WriteString(line)
+				send(GoTestEvent{Type: "output", Output: line, Stderr: true})
+			}
+			if err != nil {
+				return
+			}
+		}
+	}()
+
+	outputs := make(map[string]*cappedBuffer)
+	reader := bufio.NewReader(stdout)
+	for {
+		line, err := reader.ReadString('\n')
+		if line == "" && err != nil {
+			break
+		}
+		proc.touch()
+
+		event := testJsonEvent{}
+		if json.Unmarshal([]byte(line), &event) != nil {
+			// Not everything goes through test2json, e.g. build output
+			send(GoTestEvent{Type: "output", Output: line})
+			continue
+		}
+
+		key := event.Package + " " + event.Test
+		switch event.Action {
+		case "output":
+			output := outputs[key]
+			if output == nil {
+				output = &cappedBuffer{limit: maxTestOutput}
+				outputs[key] = output
+			}
+			output.WriteString(event.Output)
+
+			send(GoTestEvent{Type: "output", Package: event.Package, Test: event.Test, Output: event.Output})
+		case "pass", "fail", "skip":
+			result := GoTestResult{Package: event.Package, Test: event.Test, Result: event.Action, Elapsed: event.Elapsed}
+			if output := outputs[key]; output != nil {
+				result.Output = output.String()
+				delete(outputs, key)
+			}
+			report.Results = append(report.Results, result)
+
+			if event.Test != "" {
+				switch event.Action {
+				case "pass":
+					report.Passed++
+				case "fail":
+					report.Failed++
+				case "skip":
+					report.Skipped++
+				}
+			}
+
+			send(GoTestEvent{Type: "result", Package: event.Package, Test: event.Test, Result: event.Action, Elapsed: event.Elapsed})
+		}
+	}
+
+	wg.Wait()
+	err = cmd.Wait()
+	report.Elapsed = time.Since(start).Seconds()
+
+	report.Error = stderrOutput.String()
+	if cmd.ProcessState != nil {
+		report.ExitCode = cmd.ProcessState.ExitCode()
+	}
+	if ctx.Err() != nil {
+		report.Cancelled = true
+	} else if err != nil && cmd.ProcessState == nil {
+		report.Error = report.Error + err.Error()
+	}
+
+	if b, err := ioutil.ReadFile(profile); err == nil && len(b) > 0 && !report.Cancelled {
+		key, err := coverageKey(userSrcDirs(user), request)
+		if err == nil {
+			err = saveCoverageProfile(user, key, b)
+		}
+		if err != nil {
+			buildLog.Warnf("Unable to keep the cover profile of %v: %v\n", request, err)
+		}
+
+		if coverage, err := parseCoverProfile(userSrcDirs(user), b, key); err == nil {
+			report.Coverage = coverage.Percent
+		}
+	}
+
+	if !report.Cancelled {
+		title := "Tests passed"
+		if report.Failed > 0 || report.ExitCode != 0 {
+			title = "Tests failed"
+		}
+		notifyFinished(title, fmt.Sprintf("%v%v: %v passed, %v failed", request.Package, request.Dir, report.Passed, report.Failed),
+			time.Since(start))
+	}
+
+	return report
+}
+
+func goTestSocket(ws *websocket.Conn) {
+	goTestTask(ws)
+}
+
+// Runs the tests of the pkg or dir query parameter with the run, race and
+// cover parameters of go test. Sending "cancel" or closing the connection stops
+// the run.
+func goTestTask(ws taskConn) {
+	defer ws.Close()
+
+	query := ws.Request().URL.Query()
+	request := GoTestRequest{Package: workspacePackage(query.Get("pkg")), Dir: query.Get("dir"), Run: query.Get("run"), Race: query.Get("race") == "true",
+		Cover: query.Get("cover") == "true"}
+
+	ctx, cancel := context.WithTimeout(ws.Request().Context(), *testTimeout)
+	defer cancel()
+
+	go func() {
+		buf := make([]byte, maxSseInput)
+		for {
+			n, err := ws.Read(buf)
+			if err != nil || strings.TrimSpace(string(buf[:n])) == "cancel" {
+				cancel()
+				return
+			}
+		}
+	}()
+
+	mutex := sync.Mutex{}
+	send := func(event GoTestEvent) {
+		b, err := json.Marshal(event)
+		if err != nil {
+			return
+		}
+
+		mutex.Lock()
+		ws.Write(b)
+		mutex.Unlock()
+	}
+
+	report := runGoTest(ctx, requestUser(ws.Request()), request, ws, send)
+	send(GoTestEvent{Type: "done", Report: &report})
+}
+
+// POST /go/test runs the tests of a GoTestRequest. Clients that accept
+// application/x-ndjson get the messages of the socket as they come, the
+// others get the report at the end. GET /go/test/stream is the socket
+// for browsers without WebSockets and DELETE /go/test/<id> cancels a run.
+func goTestHandler(writer http.ResponseWriter, req *http.Request, path string, pathSegs []string) bool {
+	switch {
+	case req.Method == "POST" && len(pathSegs) == 2:
+		request := GoTestRequest{}
+		err := json.NewDecoder(req.Body).Decode(&request)
+		if err != nil {
+			ShowError(writer, 400, "Invalid test request", err)
+			return true
+		}
+
+		if _, _, err := goTestArgs(requestSrcDirs(req), request); err != nil {
+			ShowError(writer, 400, err.Error(), nil)
+			return true
+		}
+
+		ctx, cancel := operationContext(req, *testTimeout)
+		defer cancel()
+
+		send := func(event GoTestEvent) {}
+		var stream *JsonStream
+		if wantsJsonStream(req) {
+			stream = NewJsonStream(writer, req)
+			mutex := sync.Mutex{}
+			send = func(event GoTestEvent) {
+				mutex.Lock()
+				stream.Send(event)
+				mutex.Unlock()
+			}
+		}
+
+		report := runGoTest(ctx, requestUser(req), request, nil, send)
+		if stream != nil {
+			stream.Send(GoTestEvent{Type: "done", Report: &report})
+			return true
+		}
+
+		ShowJson(writer, 200, report)
+		return true
+	case req.Method == "GET" && len(pathSegs) == 3 && pathSegs[2] == "stream":
+		serveTaskStream(writer, req, goTestTask)
+		return true
+	case req.Method == "POST" && len(pathSegs) == 4 && pathSegs[2] == "stream":
+		taskStreamInput(writer, req, pathSegs[3])
+		return true
+	case req.Method == "DELETE" && len(pathSegs) == 3:
+		proc := findProcess(pathSegs[2])
+		if proc == nil || proc.User != requestUser(req) || proc.Kind != "test" {
+			ShowError(writer, 404, "Test run not found", nil)
+			return true
+		}
+
+		proc.kill()
+		writer.WriteHeader(204)
+		return true
+	}
+
+	return false
+}
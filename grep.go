@@ -0,0 +1,384 @@
+// Copyright 2014 Chris McGee <sirnewton_01@yahoo.ca>. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"io"
+	"net/http"
+	"os"
+	"path"
+	"path/filepath"
+	"regexp"
+	"runtime"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"unicode/utf8"
+)
+
+const (
+	// Lines with a match unless the request asks for fewer
+	defaultGrepMatches = 1000
+	maxGrepMatches     = 10000
+	// Files larger than this are generated or data, not worth a search
+	maxGrepFileSize = 4 * 1024 * 1024
+)
+
+// File with matches, the fields of Result let the Orion search page show
+// it like the hits of /filesearch
+type GrepResult struct {
+	Result
+	Matches []GrepMatch
+	// The commit of a search in a revision and where the content of the
+	//  file at the commit is, the Location is the file in the workspace
+	Commit          string `json:",omitempty"`
+	ContentLocation string `json:",omitempty"`
+}
+
+type GrepMatch struct {
+	Line int
+	Text string
+	// Start and end of each match in characters of the line
+	Spans [][2]int
+}
+
+type GrepResults struct {
+	Results []GrepResult
+	// There were more matches than the limit
+	Truncated bool `json:",omitempty"`
+}
+
+type grepOptions struct {
+	pattern  *regexp.Regexp
+	includes []string
+	excludes []string
+}
+
+func grepGlobs(value string) []string {
+	globs := []string{}
+	for _, glob := range strings.Split(value, ",") {
+		if glob = strings.TrimSpace(glob); glob != "" {
+			globs = append(globs, glob)
+		}
+	}
+	return globs
+}
+
+// A glob matches either the name of the file or its path from the root of
+// the search, so "*.go" and "vendor/*" both work
+func grepGlobMatch(globs []string, name string, relPath string) bool {
+	for _, glob := range globs {
+		if ok, _ := path.Match(glob, name); ok {
+			return true
+		}
+		if ok, _ := path.Match(glob, relPath); ok {
+			return true
+		}
+		// Everything under a directory
+		if strings.HasPrefix(relPath, strings.TrimSuffix(glob, "/*")+"/") && strings.HasSuffix(glob, "/*") {
+			return true
+		}
+	}
+	return false
+}
+
+// Searches a file line by line, binary files have no matches
+func grepFile(file string, options grepOptions, limit int) []GrepMatch {
+	f, err := os.Open(file)
+	if err != nil {
+		return []GrepMatch{}
+	}
+	defer f.Close()
+
+	return grepReader(f, options, limit)
+}
+
+func grepReader(r io.Reader, options grepOptions, limit int) []GrepMatch {
+	matches := []GrepMatch{}
+
+	reader := bufio.NewReader(r)
+	head, _ := reader.Peek(512)
+	// Binary files and the pointers of Git LFS files aren't searched
+	if bytes.IndexByte(head, 0) != -1 || isLfsPointer(head) {
+		return matches
+	}
+
+	scanner := bufio.NewScanner(reader)
+	scanner.Buffer(make([]byte, 64*1024), maxGrepFileSize)
+	line := 0
+	for scanner.Scan() && len(matches) < limit {
+		line++
+		text := scanner.Text()
+
+		found := options.pattern.FindAllStringIndex(text, -1)
+		if len(found) == 0 {
+			continue
+		}
+
+		match := GrepMatch{Line: line, Text: text, Spans: [][2]int{}}
+		for _, span := range found {
+			start := utf8.RuneCountInString(text[:span[0]])
+			match.Spans = append(match.Spans, [2]int{start, start + utf8.RuneCountInString(text[span[0]:span[1]])})
+		}
+		matches = append(matches, match)
+	}
+
+	return matches
+}
+
+// Walks the directory and hands the files to workers that search them
+// concurrently, each file with matches is passed to found
+func grepDir(ctx context.Context, dir string, location string, options grepOptions, limit int, found func(GrepResult) bool) {
+	type grepFileJob struct {
+		file    string
+		relPath string
+		info    os.FileInfo
+	}
+
+	jobs := make(chan grepFileJob)
+	done := make(chan struct{})
+	var stopOnce sync.Once
+	stop := func() { stopOnce.Do(func() { close(done) }) }
+
+	var foundMutex sync.Mutex
+	var wg sync.WaitGroup
+	for i := 0; i < runtime.NumCPU(); i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for job := range jobs {
+				matches := grepFile(job.file, options, limit)
+				if len(matches) == 0 {
+					continue
+				}
+
+				result := GrepResult{Matches: matches}
+				result.Result = Result{Id: "file:/" + job.file, Name: job.info.Name(), Length: job.info.Size(),
+					LastModified: job.info.ModTime().Unix() * 1000, Location: location + "/" + job.relPath,
+					Path: "/" + job.relPath}
+
+				foundMutex.Lock()
+				more := found(result)
+				foundMutex.Unlock()
+				if !more {
+					stop()
+				}
+			}
+		}()
+	}
+
+	filepath.Walk(dir, func(p string, info os.FileInfo, err error) error {
+		if err != nil {
+			return nil
+		}
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-done:
+			return filepath.SkipDir
+		default:
+		}
+
+		relPath, _ := filepath.Rel(dir, p)
+		relPath = filepath.ToSlash(relPath)
+
+		if info.IsDir() {
+			// Repositories and other hidden directories
+			if p != dir && (strings.HasPrefix(info.Name(), ".") || grepGlobMatch(options.excludes, info.Name(), relPath)) {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+
+		if !info.Mode().IsRegular() || info.Size() > maxGrepFileSize {
+			return nil
+		}
+		if len(options.includes) > 0 && !grepGlobMatch(options.includes, info.Name(), relPath) {
+			return nil
+		}
+		if grepGlobMatch(options.excludes, info.Name(), relPath) {
+			return nil
+		}
+
+		select {
+		case jobs <- grepFileJob{p, relPath, info}:
+		case <-done:
+			return filepath.SkipDir
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+		return nil
+	})
+
+	close(jobs)
+	wg.Wait()
+}
+
+// GET /grep?q=<text>&location=/file/<dir> searches the content of the files
+// of the workspace directory, the whole workspace by default. With
+// regEx=true the text is a regular expression, caseSensitive=true matches
+// the case and include and exclude take comma separated globs of file names
+// or paths such as *.go or vendor/*. Limit is the maximum number of lines.
+// With ref=<revision> the files of the location's repository are searched as
+// they are at the revision, e.g. a tag or an old commit.
+func grepHandler(writer http.ResponseWriter, req *http.Request, path string, pathSegs []string) bool {
+	switch {
+	case req.Method == "GET" && (len(pathSegs) == 1 || (len(pathSegs) == 2 && pathSegs[1] == "")):
+		query := req.URL.Query()
+
+		text := query.Get("q")
+		if text == "" {
+			ShowError(writer, 400, "Missing search text", nil)
+			return true
+		}
+		if query.Get("regEx") != "true" {
+			text = regexp.QuoteMeta(text)
+		}
+		if query.Get("caseSensitive") != "true" {
+			text = "(?i)" + text
+		}
+		pattern, err := regexp.Compile(text)
+		if err != nil {
+			ShowError(writer, 400, "Invalid regular expression", err)
+			return true
+		}
+		options := grepOptions{pattern, grepGlobs(query.Get("include")), grepGlobs(query.Get("exclude"))}
+
+		limit := defaultGrepMatches
+		if query.Get("limit") != "" {
+			limit, err = strconv.Atoi(query.Get("limit"))
+			if err != nil || limit <= 0 {
+				ShowError(writer, 400, "Invalid limit: "+query.Get("limit"), nil)
+				return true
+			}
+		}
+		if limit > maxGrepMatches {
+			limit = maxGrepMatches
+		}
+
+		// The directory in each source directory and its location
+		searchDirs := []string{}
+		locations := []string{}
+		location := strings.TrimSuffix(query.Get("location"), "/")
+		relPath := strings.TrimPrefix(location, "/file")
+		if relPath == location && location != "" {
+			ShowError(writer, 400, "The directory isn't a workspace location: "+location, nil)
+			return true
+		}
+		relPath = filepath.Clean("/" + relPath)
+
+		if relPath == "/GOROOT" || strings.HasPrefix(relPath, "/GOROOT/") {
+			searchDirs = append(searchDirs, filepath.Join(goroot, "src", strings.TrimPrefix(relPath, "/GOROOT")))
+			locations = append(locations, "/file"+relPath)
+		} else {
+			for _, srcDir := range requestSrcDirs(req) {
+				searchDirs = append(searchDirs, filepath.Join(srcDir, relPath))
+				locations = append(locations, strings.TrimSuffix("/file"+relPath, "/"))
+			}
+		}
+
+		ctx, cancel := operationContext(req, *searchTimeout)
+		defer cancel()
+
+		// A revision is searched in the objects of the repository of the
+		//  location, nothing is checked out
+		var target gitTarget
+		commit, committed := "", int64(0)
+		if ref := query.Get("ref"); ref != "" {
+			target, err = resolveGitTarget(requestSrcDirs(req), strings.Split(strings.TrimPrefix(location, "/"), "/"))
+			if err != nil {
+				ShowError(writer, 400, "A revision is searched in a repository, the location has to be in one", err)
+				return true
+			}
+			commit, committed, err = gitRevisionCommit(ctx, target, ref)
+			if err != nil {
+				ShowError(writer, 404, err.Error(), nil)
+				return true
+			}
+		}
+
+		results := GrepResults{Results: []GrepResult{}}
+		count := 0
+		found := func(result GrepResult) bool {
+			// Workers that were already searching when the limit was reached
+			if count >= limit {
+				results.Truncated = true
+				return false
+			}
+			if count+len(result.Matches) > limit {
+				result.Matches = result.Matches[:limit-count]
+				results.Truncated = true
+			}
+			count += len(result.Matches)
+			results.Results = append(results.Results, result)
+			return count < limit
+		}
+
+		// Streamed results go out one file per line as soon as they are found
+		var stream *JsonStream
+		if wantsJsonStream(req) {
+			stream = NewJsonStream(writer, req)
+			found = func(result GrepResult) bool {
+				if count >= limit {
+					return false
+				}
+				if count+len(result.Matches) > limit {
+					result.Matches = result.Matches[:limit-count]
+				}
+				count += len(result.Matches)
+				if stream.Send(result) != nil {
+					// The client is gone
+					cancel()
+					return false
+				}
+				return count < limit
+			}
+		}
+
+		if commit != "" {
+			if err := grepRevision(ctx, target, commit, committed, options, limit, found); err != nil && ctx.Err() == nil {
+				if stream != nil {
+					stream.Fail(500, "Unable to search the revision", err)
+					return true
+				}
+				ShowError(writer, 500, "Unable to search the revision", err)
+				return true
+			}
+			searchDirs = nil
+		}
+
+		for idx, dir := range searchDirs {
+			if count >= limit {
+				break
+			}
+			if info, err := os.Stat(dir); err != nil || !info.IsDir() {
+				continue
+			}
+			grepDir(ctx, dir, locations[idx], options, limit, found)
+		}
+
+		if stream != nil {
+			if ctx.Err() == context.DeadlineExceeded {
+				stream.Fail(504, "Search did not complete in time", ctx.Err())
+			}
+			return true
+		}
+
+		if ctx.Err() != nil {
+			ShowError(writer, 504, "Search did not complete in time", ctx.Err())
+			return true
+		}
+
+		sort.Slice(results.Results, func(i, j int) bool { return results.Results[i].Location < results.Results[j].Location })
+		ShowJson(writer, 200, results)
+		return true
+	}
+
+	return false
+}
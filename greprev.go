@@ -0,0 +1,181 @@
+// Copyright 2014 Chris McGee <sirnewton_01@yahoo.ca>. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"path"
+	"strconv"
+	"strings"
+)
+
+// File of a tree at a commit, from git ls-tree
+type gitBlob struct {
+	object string
+	size   int64
+	// Slash separated path relative to the repository and to the root of
+	//  the search
+	path    string
+	relPath string
+}
+
+// The commit of a revision and its time in milliseconds
+func gitRevisionCommit(ctx context.Context, target gitTarget, ref string) (string, int64, error) {
+	if err := validGitNames(ref); err != nil {
+		return "", 0, err
+	}
+
+	out, err := runGit(ctx, target.dir, "log", "-1", "--format=%H %ct", ref+"^{commit}", "--")
+	if err != nil {
+		return "", 0, errors.New("Unknown revision: " + ref)
+	}
+
+	fields := strings.Fields(string(out))
+	if len(fields) != 2 {
+		return "", 0, errors.New("Unknown revision: " + ref)
+	}
+	seconds, _ := strconv.ParseInt(fields[1], 10, 64)
+
+	return fields[0], seconds * 1000, nil
+}
+
+// Files of the target at the commit that the options search, the ones in
+// hidden directories are left out like in the workspace
+func gitSearchBlobs(ctx context.Context, target gitTarget, commit string, options grepOptions) ([]gitBlob, error) {
+	out, err := runGit(ctx, target.dir, "ls-tree", "-r", "-z", "-l", "--full-tree", commit, "--", target.pathspec())
+	if err != nil {
+		return nil, err
+	}
+
+	// Globs match the path from the root of the search
+	root := ""
+	if target.name != "" {
+		root = target.name + "/"
+	}
+
+	blobs := []gitBlob{}
+	for _, entry := range strings.Split(string(out), "\x00") {
+		// <mode> <type> <object> <size>\t<path>
+		parts := strings.SplitN(entry, "\t", 2)
+		if len(parts) != 2 {
+			continue
+		}
+		fields := strings.Fields(parts[0])
+		if len(fields) != 4 || fields[1] != "blob" || fields[0] == "120000" {
+			continue
+		}
+		size, err := strconv.ParseInt(fields[3], 10, 64)
+		if err != nil || size > maxGrepFileSize {
+			continue
+		}
+
+		blobPath := parts[1]
+		relPath := strings.TrimPrefix(blobPath, root)
+		if blobPath == target.name {
+			relPath = path.Base(blobPath)
+		}
+		name := path.Base(relPath)
+		skip := false
+		for dir := path.Dir(relPath); dir != "."; dir = path.Dir(dir) {
+			// Hidden directories and excluded ones
+			if strings.HasPrefix(path.Base(dir), ".") || grepGlobMatch(options.excludes, path.Base(dir), dir) {
+				skip = true
+			}
+		}
+		if skip || (len(options.includes) > 0 && !grepGlobMatch(options.includes, name, relPath)) ||
+			grepGlobMatch(options.excludes, name, relPath) {
+			continue
+		}
+
+		blobs = append(blobs, gitBlob{object: fields[2], size: size, path: blobPath, relPath: relPath})
+	}
+
+	return blobs, nil
+}
+
+// Searches the files of the target as they are at the commit, reading them
+// from the objects of the repository with git cat-file so that nothing is
+// checked out. Each file with matches is passed to found.
+func grepRevision(ctx context.Context, target gitTarget, commit string, committed int64, options grepOptions, limit int, found func(GrepResult) bool) error {
+	blobs, err := gitSearchBlobs(ctx, target, commit, options)
+	if err != nil || len(blobs) == 0 {
+		return err
+	}
+
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	cmd := exec.CommandContext(ctx, "git", "cat-file", "--batch")
+	cmd.Dir = target.dir
+	cmd.Env = append(os.Environ(), "GIT_TERMINAL_PROMPT=0")
+	stdin, err := cmd.StdinPipe()
+	if err != nil {
+		return err
+	}
+	stdout, err := cmd.StdoutPipe()
+	if err != nil {
+		return err
+	}
+	if err := cmd.Start(); err != nil {
+		return err
+	}
+	// cat-file is stopped when the search ends before it has written all
+	//  of the files
+	defer func() {
+		cancel()
+		cmd.Wait()
+	}()
+
+	go func() {
+		defer stdin.Close()
+		for _, blob := range blobs {
+			if _, err := io.WriteString(stdin, blob.object+"\n"); err != nil {
+				return
+			}
+		}
+	}()
+
+	reader := bufio.NewReader(stdout)
+	for _, blob := range blobs {
+		// <object> blob <size>, the content and a newline
+		header, err := reader.ReadString('\n')
+		if err != nil {
+			return ctx.Err()
+		}
+		fields := strings.Fields(header)
+		if len(fields) != 3 || fields[1] != "blob" {
+			return fmt.Errorf("Unexpected object %v of %v", strings.TrimSpace(header), blob.path)
+		}
+		size, _ := strconv.ParseInt(fields[2], 10, 64)
+
+		content := make([]byte, size+1)
+		if _, err := io.ReadFull(reader, content); err != nil {
+			return ctx.Err()
+		}
+
+		matches := grepReader(bytes.NewReader(content[:size]), options, limit)
+		if len(matches) == 0 {
+			continue
+		}
+
+		location := target.location + "/" + blob.path
+		result := GrepResult{Matches: matches, Commit: commit,
+			ContentLocation: "/gitapi/commit/" + commit + location + "?parts=body"}
+		result.Result = Result{Id: commit + ":" + blob.path, Name: path.Base(blob.path), Length: blob.size,
+			LastModified: committed, Location: location, Path: "/" + blob.relPath}
+		if !found(result) {
+			return nil
+		}
+	}
+
+	return nil
+}
@@ -0,0 +1,201 @@
+// Copyright 2014 Chris McGee <sirnewton_01@yahoo.ca>. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+// Position in the workspace found by guru
+type GoReference struct {
+	Location string
+	Line     int64
+	Column   int64
+	// Source line of the reference
+	Text string `json:",omitempty"`
+}
+
+type GoRefsResult struct {
+	// Description of the symbol, such as "func main.handler"
+	Desc       string
+	Definition GoReference
+	References []GoReference
+}
+
+type GoCall struct {
+	GoReference
+	// The calling or the called function
+	Name string
+	// Kind of call, such as "static function call" or "dynamic method call"
+	Desc string `json:",omitempty"`
+}
+
+type GoCallsResult struct {
+	Desc  string `json:",omitempty"`
+	Calls []GoCall
+}
+
+// The JSON of guru, from golang.org/x/tools/cmd/guru/serial
+type guruReferrers struct {
+	ObjPos  string `json:"objpos"`
+	Desc    string `json:"desc"`
+	Package string `json:"package"`
+	Refs    []struct {
+		Pos  string `json:"pos"`
+		Text string `json:"text"`
+	} `json:"refs"`
+}
+
+type guruCaller struct {
+	Pos    string `json:"pos"`
+	Desc   string `json:"desc"`
+	Caller string `json:"caller"`
+}
+
+type guruCallees struct {
+	Desc    string `json:"desc"`
+	Callees []struct {
+		Name string `json:"name"`
+		Pos  string `json:"pos"`
+	} `json:"callees"`
+}
+
+func guruReference(pos string) GoReference {
+	file, line, column := vetPosition(pos)
+	return GoReference{Location: workspaceLocation(file), Line: line, Column: column}
+}
+
+// Referrers prints the symbol and then the references package by package
+func parseGuruReferrers(output []byte) (GoRefsResult, error) {
+	result := GoRefsResult{References: []GoReference{}}
+
+	decoder := json.NewDecoder(bytes.NewReader(output))
+	for {
+		referrers := guruReferrers{}
+		err := decoder.Decode(&referrers)
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return result, err
+		}
+
+		if referrers.ObjPos != "" {
+			result.Desc = referrers.Desc
+			result.Definition = guruReference(referrers.ObjPos)
+		}
+		for _, ref := range referrers.Refs {
+			reference := guruReference(ref.Pos)
+			reference.Text = strings.TrimSpace(ref.Text)
+			result.References = append(result.References, reference)
+		}
+	}
+
+	return result, nil
+}
+
+// POST /go/refs/file/<location>?o=<byte offset> finds the references to the
+// symbol at the offset in the GOPATH, the body can have the unsaved content
+// of the file. POST /go/callers/file/... and /go/callees/file/... have the
+// calls to and from the function, in the scope of the packages of the
+// comma separated scope parameter, the package of the file by default.
+func guruHandler(writer http.ResponseWriter, req *http.Request, path string, pathSegs []string) bool {
+	switch {
+	case req.Method == "POST" && len(pathSegs) > 3 && pathSegs[2] == "file":
+		mode := map[string]string{"refs": "referrers", "callers": "callers", "callees": "callees"}[pathSegs[1]]
+		if mode == "" {
+			return false
+		}
+
+		offset, err := strconv.ParseInt(req.URL.Query().Get("o"), 10, 64)
+		if err != nil || offset < 0 {
+			ShowError(writer, 400, "Invalid offset: "+req.URL.Query().Get("o"), nil)
+			return true
+		}
+
+		p, err := bufferPath(requestSrcDirs(req), pathSegs)
+		if err != nil {
+			ShowError(writer, 400, err.Error(), nil)
+			return true
+		}
+
+		args := []string{"-json"}
+
+		// guru takes the unsaved files as an archive of names, sizes and contents
+		var stdin io.Reader
+		content, err := ioutil.ReadAll(req.Body)
+		if err != nil {
+			ShowError(writer, 400, "Unable to read the file content", err)
+			return true
+		}
+		if len(content) > 0 {
+			archive := &bytes.Buffer{}
+			archive.WriteString(p + "\n" + strconv.Itoa(len(content)) + "\n")
+			archive.Write(content)
+			stdin = archive
+			args = append(args, "-modified")
+		}
+
+		if mode != "referrers" {
+			scope := req.URL.Query().Get("scope")
+			if scope == "" {
+				scope = strings.Join(pathSegs[3:len(pathSegs)-1], "/")
+			}
+			args = append(args, "-scope", scope)
+		}
+		args = append(args, mode, p+":#"+strconv.FormatInt(offset, 10))
+
+		output, stderr, err := runGopathTool(req, stdin, "guru", args...)
+		if err != nil {
+			showGopathToolError(writer, "guru", stderr, err)
+			return true
+		}
+
+		switch mode {
+		case "referrers":
+			result, err := parseGuruReferrers(output)
+			if err != nil {
+				ShowError(writer, 500, "Unable to read the output of guru", err)
+				return true
+			}
+			ShowJson(writer, 200, result)
+		case "callers":
+			callers := []guruCaller{}
+			err := json.Unmarshal(output, &callers)
+			if err != nil {
+				ShowError(writer, 500, "Unable to read the output of guru", err)
+				return true
+			}
+
+			result := GoCallsResult{Calls: []GoCall{}}
+			for _, caller := range callers {
+				result.Calls = append(result.Calls, GoCall{guruReference(caller.Pos), caller.Caller, caller.Desc})
+			}
+			ShowJson(writer, 200, result)
+		case "callees":
+			callees := guruCallees{}
+			err := json.Unmarshal(output, &callees)
+			if err != nil {
+				ShowError(writer, 500, "Unable to read the output of guru", err)
+				return true
+			}
+
+			result := GoCallsResult{Desc: callees.Desc, Calls: []GoCall{}}
+			for _, callee := range callees.Callees {
+				result.Calls = append(result.Calls, GoCall{GoReference: guruReference(callee.Pos), Name: callee.Name})
+			}
+			ShowJson(writer, 200, result)
+		}
+		return true
+	}
+
+	return false
+}
@@ -2,12 +2,14 @@ package main
 
 import (
 	"code.google.com/p/go.net/websocket"
-	"encoding/json"
+	"context"
+	"math"
 	"net/http"
-	"net/http/cgi"
 	"os"
 	"path/filepath"
+	"strconv"
 	"strings"
+	"time"
 )
 
 type Handlers struct {
@@ -17,29 +19,59 @@ type Handlers struct {
 type handlerFunc func(http.ResponseWriter, *http.Request)
 type delegateFunc func(writer http.ResponseWriter, req *http.Request, path string, pathSegs []string) bool
 
+////////////////////////////////////////////////////////////////////////////////////////////////////
+// Context for an operation carried out on behalf of a request. It is cancelled when the browser
+//  goes away, the timeout for the type of operation expires or the server shuts down.
+////////////////////////////////////////////////////////////////////////////////////////////////////
+func operationContext(req *http.Request, timeout time.Duration) (context.Context, context.CancelFunc) {
+	return context.WithTimeout(req.Context(), timeout)
+}
+
+// Response writer that fails once its context is done
+type contextWriter struct {
+	http.ResponseWriter
+	ctx context.Context
+}
+
+func (w contextWriter) Write(b []byte) (int, error) {
+	if err := w.ctx.Err(); err != nil {
+		return 0, err
+	}
+
+	return w.ResponseWriter.Write(b)
+}
+
 ////////////////////////////////////////////////////////////////////////////////////////////////////
 //
 ////////////////////////////////////////////////////////////////////////////////////////////////////
 func (h *Handlers) wrapHandler(delegate delegateFunc) handlerFunc {
 	return func(writer http.ResponseWriter, req *http.Request) {
-		logger.Printf("HANDLER: %v %v\n", req.Method, req.URL.Path)
+		handlersLog.Printf("HANDLER: %v %v\n", req.Method, req.URL.Path)
+		touchUser(req)
+
+		access := startAccess(writer, req)
+		defer access.log()
+
+		// Lets errors be shown in the format that the client accepts
+		writer = requestWriter{access, req}
+
+		if handleCors(writer, req) {
+			return
+		}
 
 		if hostName != loopbackHost {
-			// Monitor the rate of requests
-			rateTrackerMutex.Lock()
-			if rateTracker > maxRatePerSecond {
-				http.Error(writer, "Too many requests", 503)
-				rateTrackerMutex.Unlock()
+			// Limit the rate of requests of each client
+			if wait := takeRateToken(clientIP(req)); wait > 0 {
+				writer.Header().Set("Retry-After", strconv.Itoa(int(math.Ceil(wait.Seconds()))))
+				http.Error(writer, "Too many requests", 429)
 				return
 			}
-			rateTracker++
-			rateTrackerMutex.Unlock()
 
 			// Check the magic cookie
 			// Since redirection is not generally possible if the cookie is not
 			//  present then we deny the request.
 			cookie, err := req.Cookie("MAGIC" + *port)
-			if err != nil || (*cookie).Value != magicKey {
+			if err != nil || !validMagicKey((*cookie).Value) {
 				// Denied
 				http.Error(writer, "Permission Denied", 401)
 				return
@@ -50,13 +82,28 @@ func (h *Handlers) wrapHandler(delegate delegateFunc) handlerFunc {
 		pathSegs := strings.Split(path, "/")[1:]
 		service := pathSegs[0]
 
-		logger.Printf("PATH SEGMENTS: %v\n", pathSegs)
-		logger.Printf("SERVICE: %v\n", service)
+		handlersLog.Printf("PATH SEGMENTS: %v\n", pathSegs)
+		handlersLog.Printf("SERVICE: %v\n", service)
+
+		if readOnlyDenied(req, pathSegs) {
+			ShowError(writer, 403, "This godev is a read-only mirror", nil)
+			return
+		}
+
+		if roleDenied(req, pathSegs) {
+			ShowError(writer, 403, "Your role doesn't permit this operation", nil)
+			return
+		}
 
+		start := time.Now()
 		handled := delegate(writer, req, path, pathSegs)
 
+		if *usageStats && handled {
+			recordUsage(usageOperation(req, pathSegs), time.Since(start))
+		}
+
 		if !handled {
-			logger.Printf("Unrecognized service %v\n", req.URL)
+			handlersLog.Infof("Unrecognized service %v\n", req.URL)
 			ShowError(writer, 404, "Unrecognized service "+req.Method+":"+req.URL.String(), nil)
 		}
 	}
@@ -67,6 +114,27 @@ func (h *Handlers) wrapHandler(delegate delegateFunc) handlerFunc {
 ////////////////////////////////////////////////////////////////////////////////////////////////////
 func (h *Handlers) wrapFileServer(delegate http.Handler) handlerFunc {
 	return func(writer http.ResponseWriter, req *http.Request) {
+		access := startAccess(writer, req)
+		defer access.log()
+		writer = access
+
+		if wantsHtml(req) {
+			writer = &notFoundWriter{ResponseWriter: writer, req: req}
+		}
+
+		// Browsers check whether the files of the bundles changed instead
+		//  of fetching them again, the file server answers with a 304
+		if req.Method == "GET" || req.Method == "HEAD" {
+			name := req.URL.Path
+			if strings.HasSuffix(name, "/") {
+				name += "index.html"
+			}
+			if etag := h.fs.fileETag(name); etag != "" {
+				writer.Header().Set("ETag", etag)
+				writer.Header().Set("Cache-Control", "no-cache")
+			}
+		}
+
 		delegate.ServeHTTP(writer, req)
 	}
 }
@@ -74,23 +142,51 @@ func (h *Handlers) wrapFileServer(delegate http.Handler) handlerFunc {
 ////////////////////////////////////////////////////////////////////////////////////////////////////
 //
 ////////////////////////////////////////////////////////////////////////////////////////////////////
-func (h *Handlers) wrapWebSocket(delegate http.Handler) handlerFunc {
+func (h *Handlers) wrapWebSocket(delegate websocket.Handler) handlerFunc {
+	// The server closes the sockets that are still open when it stops
+	tracked := websocket.Handler(func(ws *websocket.Conn) {
+		untrack, ok := trackSocket(ws)
+		if !ok {
+			return
+		}
+		defer untrack()
+
+		delegate(ws)
+	})
+
 	return func(writer http.ResponseWriter, req *http.Request) {
-		logger.Printf("WEBSOCK HANDLER: %v %v\n", req.Method, req.URL.Path)
+		handlersLog.Printf("WEBSOCK HANDLER: %v %v\n", req.Method, req.URL.Path)
 
 		if hostName != loopbackHost {
 			// Check the magic cookie
 			// Since redirection is not generally possible if the cookie is not
 			//  present then we deny the request.
 			cookie, err := req.Cookie("MAGIC" + *port)
-			if err != nil || (*cookie).Value != magicKey {
+			if err != nil || !validMagicKey((*cookie).Value) {
 				// Denied
 				http.Error(writer, "Permission Denied", 401)
 				return
 			}
 		}
 
-		delegate.ServeHTTP(writer, req)
+		pathSegs := strings.Split(req.URL.Path, "/")[1:]
+		if readOnlyDenied(req, pathSegs) {
+			http.Error(writer, "This godev is a read-only mirror", 403)
+			return
+		}
+
+		if roleDenied(req, pathSegs) {
+			http.Error(writer, "Your role doesn't permit this operation", 403)
+			return
+		}
+
+		if isShuttingDown() {
+			http.Error(writer, "The server is shutting down", 503)
+			return
+		}
+
+		touchUser(req)
+		tracked.ServeHTTP(writer, req)
 	}
 }
 
@@ -103,11 +199,8 @@ func (h *Handlers) defaultsHandler(writer http.ResponseWriter, req *http.Request
 	//  so the browser (or any proxy server) should not cache this information.
 	writer.Header().Add("cache-control", "no-cache, no-store")
 
-	h.fs.mutex.Lock()
-	b, err := json.Marshal(h.fs.data)
-	h.fs.mutex.Unlock()
-
-	if err != nil {
+	b := h.fs.snapshot().defaults
+	if b == nil {
 		ShowError(writer, 500, "Unable to marshal defaults", nil)
 		return
 	}
@@ -128,10 +221,10 @@ func (h *Handlers) bundleCgiHandler(writer http.ResponseWriter, req *http.Reques
 	}
 
 	// Check the bin directories of the gopaths to find a command that matches
-	//  the command specified here.
+	//  the command specified here, including the one of the installed bundles.
 	cmd := ""
 
-	for _, srcDir := range srcDirs {
+	for _, srcDir := range append(append([]string{}, srcDirs...), bundleSrcDir()) {
 		c := filepath.Join(srcDir, "../bin/"+cgiProgram)
 		_, err := os.Stat(c)
 		if err == nil {
@@ -141,16 +234,22 @@ func (h *Handlers) bundleCgiHandler(writer http.ResponseWriter, req *http.Reques
 	}
 
 	if cmd != "" {
-		logger.Printf("GODEV CGI CALL: %v\n", cmd)
-		handler := cgi.Handler{}
-		handler.Path = cmd
-		handler.Args = []string{"-godev"}
-		handler.Logger = logger
-		handler.InheritEnv = []string{"PATH", "GOPATH"} // TODO Add GOCERTFILE, GOKEYFILE, ...
-		handler.ServeHTTP(writer, req)
+		handlersLog.Printf("GODEV CGI CALL: %v\n", cmd)
+		ctx, cancel := operationContext(req, *cgiTimeout)
+		defer cancel()
+
+		// Commands that keep running serve the request over FastCGI
+		if processes := h.fs.snapshot().fastcgiProcesses(cgiProgram); processes > 0 {
+			if serveFastCGI(ctx, contextWriter{writer, ctx}, req.WithContext(ctx), cmd, processes) {
+				return true
+			}
+		}
+
+		// TODO Pass GOCERTFILE, GOKEYFILE, ... to the command
+		serveCGI(ctx, contextWriter{writer, ctx}, req.WithContext(ctx), cmd)
 		return true
 	} else {
-		logger.Printf("GODEV CGI MISS: %v\n", cgiProgram)
+		handlersLog.Printf("GODEV CGI MISS: %v\n", cgiProgram)
 	}
 
 	return false
@@ -164,11 +263,21 @@ func HandlersInitialize(fileSystem *ChainedFileSystem) (*Handlers, error) {
 	h := &Handlers{fs: fileSystem}
 
 	http.HandleFunc("/defaults.pref", h.defaultsHandler)
-	http.HandleFunc("/", h.wrapFileServer(http.FileServer(h.fs)))
+	http.HandleFunc("/assets/", h.assetsHandler)
+	http.HandleFunc("/service-worker.js", h.serviceWorkerHandler)
+	http.HandleFunc("/plugins/conflicts", h.wrapHandler(h.bundleConflictsHandler))
+
+	// Hashing the assets takes a moment, get it done before the first page load
+	go currentAssetManifest(h.fs)
+	// Start indexing the packages for the import suggestions of completion
+	lookupPackages("")
+
+	http.HandleFunc("/", h.wrapFileServer(compressedFiles(h.fs, http.FileServer(h.fs))))
 	http.HandleFunc("/login", loginHandler)
 	http.HandleFunc("/login/", loginHandler)
 	http.HandleFunc("/logout", logoutHandler)
 	http.HandleFunc("/logout/", logoutHandler)
+	http.HandleFunc("/readyz", readyHandler)
 	http.HandleFunc("/workspace", h.wrapHandler(workspaceHandler))
 	http.HandleFunc("/workspace/", h.wrapHandler(workspaceHandler))
 	http.HandleFunc("/file", h.wrapHandler(fileHandler))
@@ -179,22 +288,56 @@ func HandlersInitialize(fileSystem *ChainedFileSystem) (*Handlers, error) {
 	http.HandleFunc("/completion/", h.wrapHandler(completionHandler))
 	http.HandleFunc("/filesearch", h.wrapHandler(filesearchHandler))
 	http.HandleFunc("/filesearch/", h.wrapHandler(filesearchHandler))
+	http.HandleFunc("/onboarding", h.wrapHandler(onboardingHandler))
+	http.HandleFunc("/onboarding/", h.wrapHandler(onboardingHandler))
+	http.HandleFunc("/grep", h.wrapHandler(grepHandler))
+	http.HandleFunc("/grep/", h.wrapHandler(grepHandler))
 	http.HandleFunc("/xfer", h.wrapHandler(xferHandler))
 	http.HandleFunc("/xfer/", h.wrapHandler(xferHandler))
 	http.HandleFunc("/go/build", h.wrapHandler(buildHandler))
+	http.HandleFunc("/go/cache", h.wrapHandler(cacheHandler))
+	http.HandleFunc("/go/cache/", h.wrapHandler(cacheHandler))
 	http.HandleFunc("/go/build/", h.wrapHandler(buildHandler))
 	http.HandleFunc("/go/defs", h.wrapHandler(definitionHandler))
 	http.HandleFunc("/go/defs/", h.wrapHandler(definitionHandler))
+	http.HandleFunc("/go/vet", h.wrapHandler(vetHandler))
+	http.HandleFunc("/go/vet/", h.wrapHandler(vetHandler))
+	http.HandleFunc("/go/lint", h.wrapHandler(lintHandler))
+	http.HandleFunc("/go/lint/", h.wrapHandler(lintHandler))
+	http.HandleFunc("/go/explain", h.wrapHandler(explainHandler))
+	http.HandleFunc("/go/explain/", h.wrapHandler(explainHandler))
+	http.HandleFunc("/go/rename", h.wrapHandler(renameHandler))
+	http.HandleFunc("/go/rename/", h.wrapHandler(renameHandler))
+	http.HandleFunc("/go/refs/", h.wrapHandler(guruHandler))
+	http.HandleFunc("/go/callers/", h.wrapHandler(guruHandler))
+	http.HandleFunc("/go/callees/", h.wrapHandler(guruHandler))
 	http.HandleFunc("/go/fmt", h.wrapHandler(formatHandler))
 	http.HandleFunc("/go/fmt/", h.wrapHandler(formatHandler))
 	http.HandleFunc("/go/imports", h.wrapHandler(importsHandler))
 	http.HandleFunc("/go/imports/", h.wrapHandler(importsHandler))
 	http.HandleFunc("/go/outline", h.wrapHandler(outlineHandler))
 	http.HandleFunc("/go/outline/", h.wrapHandler(outlineHandler))
+	http.HandleFunc("/go/folding", h.wrapHandler(foldingHandler))
+	http.HandleFunc("/go/folding/", h.wrapHandler(foldingHandler))
+	http.HandleFunc("/go/selection", h.wrapHandler(selectionHandler))
+	http.HandleFunc("/go/selection/", h.wrapHandler(selectionHandler))
+	http.HandleFunc("/go/inlayhints/", h.wrapHandler(inlayHintsHandler))
+	http.HandleFunc("/go/semantictokens/", h.wrapHandler(semanticTokensHandler))
+	http.HandleFunc("/go/occurrences/", h.wrapHandler(occurrencesHandler))
+	http.HandleFunc("/go/ast", h.wrapHandler(astHandler))
+	http.HandleFunc("/go/ast/", h.wrapHandler(astHandler))
+	http.HandleFunc("/go/stacktrace/", h.wrapHandler(stackTraceHandler))
+	http.HandleFunc("/go/test", h.wrapHandler(goTestHandler))
+	http.HandleFunc("/go/test/", h.wrapHandler(goTestHandler))
+	http.HandleFunc("/go/test/socket", h.wrapWebSocket(websocket.Handler(goTestSocket)))
+	http.HandleFunc("/go/coverage", h.wrapHandler(coverageHandler))
+	http.HandleFunc("/go/coverage/", h.wrapHandler(coverageHandler))
 
 	// Bundle Extensibility
 	http.HandleFunc("/go/bundle-cgi", h.wrapHandler(h.bundleCgiHandler))
 	http.HandleFunc("/go/bundle-cgi/", h.wrapHandler(h.bundleCgiHandler))
+	http.HandleFunc("/bundles", h.wrapHandler(h.bundlesHandler))
+	http.HandleFunc("/bundles/", h.wrapHandler(h.bundlesHandler))
 
 	// GODOC
 	http.HandleFunc("/godoc/pkg", h.wrapHandler(docHandler))
@@ -211,14 +354,64 @@ func HandlersInitialize(fileSystem *ChainedFileSystem) (*Handlers, error) {
 	http.HandleFunc("/debug", h.wrapHandler(debugHandler))
 	http.HandleFunc("/debug/", h.wrapHandler(debugHandler))
 	http.HandleFunc("/debug/socket", h.wrapWebSocket(websocket.Handler(debugSocket)))
+	if *debug {
+		// Profiles of the server, the debug page has the rest of /debug
+		http.HandleFunc("/debug/pprof", h.wrapHandler(pprofHandler))
+		http.HandleFunc("/debug/pprof/", h.wrapHandler(pprofHandler))
+	}
 	http.HandleFunc("/test", h.wrapWebSocket(websocket.Handler(testSocket)))
+	http.HandleFunc("/test/", h.wrapHandler(testHandler))
+	http.HandleFunc("/repl", h.wrapHandler(replHandler))
+	http.HandleFunc("/repl/", h.wrapHandler(replHandler))
+	http.HandleFunc("/repl/socket", h.wrapWebSocket(websocket.Handler(replSocket)))
+	http.HandleFunc("/shell", h.wrapHandler(shellHandler))
+	http.HandleFunc("/shell/", h.wrapHandler(shellHandler))
 	http.HandleFunc("/blame", h.wrapHandler(blameHandler))
 	http.HandleFunc("/blame/", h.wrapHandler(blameHandler))
 	http.HandleFunc("/docker", h.wrapHandler(terminalHandler))
 	http.HandleFunc("/docker/", h.wrapHandler(terminalHandler))
 	http.HandleFunc("/docker/socket", h.wrapWebSocket(websocket.Handler(terminalSocket)))
-	//	http.HandleFunc("/gitapi", wrapHandler(gitapiHandler))
-	//	http.HandleFunc("/gitapi/", wrapHandler(gitapiHandler))
+	// Not /terminal/, which has the terminal page of the bundles
+	http.HandleFunc("/terminal/recordings", h.wrapHandler(terminalRecordingsHandler))
+	http.HandleFunc("/terminal/recordings/", h.wrapHandler(terminalRecordingsHandler))
+	http.HandleFunc("/terminal/play", h.wrapWebSocket(websocket.Handler(recordingPlaySocket)))
+	http.HandleFunc("/events", h.wrapHandler(eventsHandler))
+	http.HandleFunc("/events/", h.wrapHandler(eventsHandler))
+	http.HandleFunc("/events/socket", h.wrapWebSocket(websocket.Handler(eventsSocket)))
+	http.HandleFunc("/logs/", h.wrapHandler(logsHandler))
+	http.HandleFunc("/logs/tail", h.wrapWebSocket(websocket.Handler(logsSocket)))
+	http.HandleFunc("/open", h.wrapHandler(openHandler))
+	http.HandleFunc("/open/", h.wrapHandler(openHandler))
+	http.HandleFunc("/bookmarks", h.wrapHandler(bookmarksHandler))
+	http.HandleFunc("/bookmarks/", h.wrapHandler(bookmarksHandler))
+	http.HandleFunc("/recent", h.wrapHandler(recentHandler))
+	http.HandleFunc("/recent/", h.wrapHandler(recentHandler))
+	http.HandleFunc("/session", h.wrapHandler(sessionHandler))
+	http.HandleFunc("/session/", h.wrapHandler(sessionHandler))
+	http.HandleFunc("/drafts", h.wrapHandler(draftsHandler))
+	http.HandleFunc("/drafts/", h.wrapHandler(draftsHandler))
+	http.HandleFunc("/scratch", h.wrapHandler(scratchHandler))
+	http.HandleFunc("/scratch/", h.wrapHandler(scratchHandler))
+	http.HandleFunc("/claims", h.wrapHandler(claimsHandler))
+	http.HandleFunc("/claims/", h.wrapHandler(claimsHandler))
+	http.HandleFunc("/admin", h.wrapHandler(adminHandler))
+	http.HandleFunc("/admin/", h.wrapHandler(adminHandler))
+	http.HandleFunc("/roles", h.wrapHandler(rolesHandler))
+	http.HandleFunc("/invites", h.wrapHandler(invitesHandler))
+	http.HandleFunc("/invites/", h.wrapHandler(invitesHandler))
+	http.HandleFunc("/roles/", h.wrapHandler(rolesHandler))
+	http.HandleFunc("/gitapi", h.wrapHandler(gitapiHandler))
+	http.HandleFunc("/gitapi/", h.wrapHandler(gitapiHandler))
+	http.HandleFunc("/httpclient/", h.wrapHandler(httpClientHandler))
+	http.HandleFunc("/forward", h.wrapHandler(forwardHandler))
+	http.HandleFunc("/forward/", h.wrapHandler(forwardHandler))
+	http.HandleFunc("/preview", h.wrapHandler(previewHandler))
+	http.HandleFunc("/preview/", h.wrapHandler(previewHandler))
+	http.HandleFunc("/preview/static/", staticPreviewHandler)
+	http.HandleFunc("/secrets", h.wrapHandler(secretsHandler))
+	http.HandleFunc("/secrets/", h.wrapHandler(secretsHandler))
+	http.HandleFunc("/db", h.wrapHandler(dbHandler))
+	http.HandleFunc("/db/", h.wrapHandler(dbHandler))
 
 	return h, nil
 }
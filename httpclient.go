@@ -0,0 +1,385 @@
+// Copyright 2014 Chris McGee <sirnewton_01@yahoo.ca>. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"crypto/tls"
+	"encoding/json"
+	"errors"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptrace"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	// Most of a response body that is returned
+	maxHttpClientBody = 4 << 20
+)
+
+// Request of a .http file, the format of the REST clients of other editors:
+//
+//	@host = http://localhost:8080
+//
+//	### Create a user
+//	POST {{host}}/users HTTP/1.1
+//	Content-Type: application/json
+//	Authorization: Bearer {{apiToken}}
+//
+//	{"name": "gopher"}
+//
+// Requests are separated by ### lines, # and // start comments.
+type HttpFileRequest struct {
+	Name string
+	// Line of the request line, starting at 1
+	Line    int
+	Method  string
+	Url     string
+	Headers []HttpHeader
+	Body    string `json:",omitempty"`
+	// File next to the .http file that is sent as the body, from a
+	//  "< ./file.json" line
+	BodyFile string `json:",omitempty"`
+}
+
+type HttpHeader struct {
+	Name  string
+	Value string
+}
+
+type HttpFile struct {
+	Variables map[string]string
+	Requests  []HttpFileRequest
+}
+
+// Request to run, by name or by its index in the file. The variables
+// take precedence over those of the file, which take precedence over the
+// secrets of the user.
+type HttpClientRun struct {
+	Request   string
+	Variables map[string]string `json:",omitempty"`
+}
+
+type HttpClientResult struct {
+	// The request as it was sent, with the values of secrets masked
+	Request    HttpFileRequest
+	Status     string
+	StatusCode int
+	Proto      string
+	Headers    http.Header
+	Body       string
+	// The body was cut at 4MB
+	Truncated bool `json:",omitempty"`
+	Timing    HttpClientTiming
+}
+
+// Milliseconds from the start of the request
+type HttpClientTiming struct {
+	Dns       float64 `json:",omitempty"`
+	Connect   float64 `json:",omitempty"`
+	Tls       float64 `json:",omitempty"`
+	FirstByte float64
+	Total     float64
+}
+
+var (
+	httpFileVariable = regexp.MustCompile(`^@([A-Za-z0-9_.-]+)\s*=\s*(.*)$`)
+	httpFileName     = regexp.MustCompile(`^(?:#|//)\s*@name\s+(.+)$`)
+	httpMethod       = regexp.MustCompile(`^[A-Z]+$`)
+	httpReference    = regexp.MustCompile(`{{\s*([A-Za-z0-9_.-]+)\s*}}`)
+)
+
+func parseHttpFile(content string) HttpFile {
+	file := HttpFile{Variables: make(map[string]string), Requests: []HttpFileRequest{}}
+
+	var request *HttpFileRequest
+	name := ""
+	inBody := false
+	body := []string{}
+
+	finish := func() {
+		if request == nil {
+			return
+		}
+
+		// Trailing blank lines aren't part of the body
+		for len(body) > 0 && strings.TrimSpace(body[len(body)-1]) == "" {
+			body = body[:len(body)-1]
+		}
+		if len(body) > 0 && strings.HasPrefix(body[0], "< ") {
+			request.BodyFile = strings.TrimSpace(body[0][2:])
+		} else {
+			request.Body = strings.Join(body, "\n")
+		}
+
+		file.Requests = append(file.Requests, *request)
+		request, inBody, body = nil, false, []string{}
+	}
+
+	lines := strings.Split(strings.Replace(content, "\r\n", "\n", -1), "\n")
+	for idx, line := range lines {
+		trimmed := strings.TrimSpace(line)
+
+		switch {
+		case strings.HasPrefix(trimmed, "###"):
+			finish()
+			name = strings.TrimSpace(trimmed[3:])
+		case inBody:
+			body = append(body, line)
+		case request != nil && trimmed == "":
+			inBody = true
+		case request != nil && (strings.HasPrefix(trimmed, "#") || strings.HasPrefix(trimmed, "//")):
+		case request != nil:
+			colon := strings.Index(line, ":")
+			if colon == -1 {
+				continue
+			}
+			request.Headers = append(request.Headers, HttpHeader{strings.TrimSpace(line[:colon]), strings.TrimSpace(line[colon+1:])})
+		case httpFileName.MatchString(trimmed):
+			name = strings.TrimSpace(httpFileName.FindStringSubmatch(trimmed)[1])
+		case trimmed == "" || strings.HasPrefix(trimmed, "#") || strings.HasPrefix(trimmed, "//"):
+		case httpFileVariable.MatchString(trimmed):
+			m := httpFileVariable.FindStringSubmatch(trimmed)
+			file.Variables[m[1]] = strings.TrimSpace(m[2])
+		default:
+			request = &HttpFileRequest{Line: idx + 1, Method: "GET", Headers: []HttpHeader{}}
+
+			fields := strings.Fields(trimmed)
+			if len(fields) > 1 && httpMethod.MatchString(fields[0]) {
+				request.Method = fields[0]
+				fields = fields[1:]
+			}
+			request.Url = fields[0]
+
+			request.Name = name
+			if request.Name == "" {
+				request.Name = request.Method + " " + request.Url
+			}
+			name = ""
+		}
+	}
+	finish()
+
+	return file
+}
+
+// Replaces the {{name}} references of the text, values can refer to other
+// variables in turn.
+func expandHttpVariables(text string, lookup func(name string) (string, bool)) (string, error) {
+	var err error
+
+	for depth := 0; depth < 10 && httpReference.MatchString(text); depth++ {
+		text = httpReference.ReplaceAllStringFunc(text, func(ref string) string {
+			name := httpReference.FindStringSubmatch(ref)[1]
+			value, ok := lookup(name)
+			if !ok {
+				err = errors.New("Undefined variable: " + name)
+				return ""
+			}
+			return value
+		})
+		if err != nil {
+			return "", err
+		}
+	}
+
+	return text, nil
+}
+
+func findHttpRequest(file HttpFile, name string) (HttpFileRequest, bool) {
+	for _, request := range file.Requests {
+		if request.Name == name {
+			return request, true
+		}
+	}
+
+	if idx, err := strconv.Atoi(name); err == nil && idx >= 0 && idx < len(file.Requests) {
+		return file.Requests[idx], true
+	}
+
+	return HttpFileRequest{}, false
+}
+
+// The request with its variables filled in and the values of the secrets
+// that it uses, so that they can be masked
+func expandHttpRequest(user string, file HttpFile, run HttpClientRun) (HttpFileRequest, []string, error) {
+	request, ok := findHttpRequest(file, run.Request)
+	if !ok {
+		return request, nil, errors.New("No such request: " + run.Request)
+	}
+
+	secrets := []string{}
+	lookup := func(name string) (string, bool) {
+		if value, ok := run.Variables[name]; ok {
+			return value, true
+		}
+		if value, ok := file.Variables[name]; ok {
+			return value, true
+		}
+		value, ok := userSecret(user, name)
+		if ok {
+			secrets = append(secrets, value)
+		}
+		return value, ok
+	}
+
+	var err error
+	request.Url, err = expandHttpVariables(request.Url, lookup)
+	if err != nil {
+		return request, nil, err
+	}
+	for idx := range request.Headers {
+		request.Headers[idx].Value, err = expandHttpVariables(request.Headers[idx].Value, lookup)
+		if err != nil {
+			return request, nil, err
+		}
+	}
+	request.Body, err = expandHttpVariables(request.Body, lookup)
+	if err != nil {
+		return request, nil, err
+	}
+
+	return request, secrets, nil
+}
+
+func runHttpRequest(req *http.Request, dir string, request HttpFileRequest, secrets []string) (*HttpClientResult, error) {
+	var body io.Reader
+	if request.BodyFile != "" {
+		p := filepath.Join(dir, filepath.FromSlash(request.BodyFile))
+		if !inWorkspace(requestSrcDirs(req), filepath.Clean(p)) {
+			return nil, errors.New("The body file is outside of the workspace: " + request.BodyFile)
+		}
+		f, err := os.Open(p)
+		if err != nil {
+			return nil, err
+		}
+		defer f.Close()
+		body = f
+	} else {
+		body = strings.NewReader(request.Body)
+	}
+
+	ctx, cancel := operationContext(req, *httpClientTimeout)
+	defer cancel()
+
+	outgoing, err := http.NewRequest(request.Method, request.Url, body)
+	if err != nil {
+		return nil, err
+	}
+	for _, header := range request.Headers {
+		if strings.EqualFold(header.Name, "Host") {
+			outgoing.Host = header.Value
+			continue
+		}
+		outgoing.Header.Add(header.Name, header.Value)
+	}
+
+	result := &HttpClientResult{}
+	start := time.Now()
+	since := func() float64 {
+		return float64(time.Since(start)) / float64(time.Millisecond)
+	}
+	trace := &httptrace.ClientTrace{
+		DNSDone:              func(httptrace.DNSDoneInfo) { result.Timing.Dns = since() },
+		ConnectDone:          func(string, string, error) { result.Timing.Connect = since() },
+		TLSHandshakeDone:     func(tls.ConnectionState, error) { result.Timing.Tls = since() },
+		GotFirstResponseByte: func() { result.Timing.FirstByte = since() },
+	}
+	outgoing = outgoing.WithContext(httptrace.WithClientTrace(ctx, trace))
+
+	resp, err := http.DefaultClient.Do(outgoing)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	b, err := ioutil.ReadAll(io.LimitReader(resp.Body, maxHttpClientBody+1))
+	if err != nil {
+		return nil, err
+	}
+	result.Timing.Total = since()
+	if len(b) > maxHttpClientBody {
+		b = b[:maxHttpClientBody]
+		result.Truncated = true
+	}
+
+	result.Status = resp.Status
+	result.StatusCode = resp.StatusCode
+	result.Proto = resp.Proto
+	result.Headers = resp.Header
+	result.Body = string(b)
+
+	request.Url = maskSecrets(request.Url, secrets)
+	request.Body = maskSecrets(request.Body, secrets)
+	for idx := range request.Headers {
+		request.Headers[idx].Value = maskSecrets(request.Headers[idx].Value, secrets)
+	}
+	result.Request = request
+
+	return result, nil
+}
+
+// GET /httpclient/requests/file/<.http file> lists the requests of the
+// file, POST /httpclient/run/file/<.http file> sends the request of the
+// HttpClientRun in the body and returns the response with its timing.
+func httpClientHandler(writer http.ResponseWriter, req *http.Request, path string, pathSegs []string) bool {
+	if len(pathSegs) < 4 || pathSegs[2] != "file" {
+		return false
+	}
+
+	p, err := bufferPath(requestSrcDirs(req), pathSegs)
+	if err != nil {
+		ShowError(writer, 400, err.Error(), nil)
+		return true
+	}
+
+	switch {
+	case req.Method == "GET" && pathSegs[1] == "requests":
+		content, err := ioutil.ReadFile(p)
+		if err != nil {
+			ShowError(writer, 404, "Unable to read the file", err)
+			return true
+		}
+
+		ShowJson(writer, 200, parseHttpFile(string(content)))
+		return true
+	case req.Method == "POST" && pathSegs[1] == "run":
+		run := HttpClientRun{}
+		err := json.NewDecoder(req.Body).Decode(&run)
+		if err != nil {
+			ShowError(writer, 400, "Invalid request", err)
+			return true
+		}
+
+		content, err := ioutil.ReadFile(p)
+		if err != nil {
+			ShowError(writer, 404, "Unable to read the file", err)
+			return true
+		}
+
+		request, secrets, err := expandHttpRequest(requestUser(req), parseHttpFile(string(content)), run)
+		if err != nil {
+			ShowError(writer, 400, err.Error(), nil)
+			return true
+		}
+
+		result, err := runHttpRequest(req, filepath.Dir(p), request, secrets)
+		if err != nil {
+			ShowError(writer, 502, err.Error(), nil)
+			return true
+		}
+
+		ShowJson(writer, 200, result)
+		return true
+	}
+
+	return false
+}
@@ -13,7 +13,10 @@ import (
 func importsHandler(writer http.ResponseWriter, req *http.Request, path string, pathSegs []string) bool {
 	switch {
 	case req.Method == "POST":
-		cmd := exec.Command("goimports")
+		ctx, cancel := operationContext(req, *toolTimeout)
+		defer cancel()
+
+		cmd := exec.CommandContext(ctx, "goimports")
 		cmd.Stdin = req.Body
 
 		output, err := cmd.Output()
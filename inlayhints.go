@@ -0,0 +1,162 @@
+// Copyright 2014 Chris McGee <sirnewton_01@yahoo.ca>. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"go/ast"
+	"go/token"
+	"go/types"
+	"io/ioutil"
+	"net/http"
+)
+
+// Text that the editor shows inline at the offset without it being part of
+// the buffer.
+type InlayHint struct {
+	Offset int
+	Label  string
+	// parameter or type
+	Kind string
+}
+
+func inlayHintsHandler(writer http.ResponseWriter, req *http.Request, path string, pathSegs []string) bool {
+	switch {
+	case req.Method == "POST" && len(pathSegs) > 3:
+		filePath, err := bufferPath(requestSrcDirs(req), pathSegs)
+		if err != nil {
+			ShowError(writer, 400, "Invalid resource", err)
+			return true
+		}
+
+		buffer, err := ioutil.ReadAll(req.Body)
+		if err != nil {
+			ShowError(writer, 500, "Error reading the buffer", err)
+			return true
+		}
+
+		start, end, err := requestRange(req, len(buffer))
+		if err != nil {
+			ShowError(writer, 400, "Invalid range", err)
+			return true
+		}
+
+		checked, err := typeCheckBuffer(buffer, filePath)
+		if err != nil {
+			ShowError(writer, 400, "Error parsing go source", err)
+			return true
+		}
+
+		ShowJson(writer, 200, inlayHints(checked, start, end))
+		return true
+	}
+
+	return false
+}
+
+func inlayHints(checked *checkedBuffer, start int, end int) []InlayHint {
+	hints := []InlayHint{}
+	info := checked.info
+
+	inRange := func(pos token.Pos) bool {
+		offset := checked.offset(pos)
+		return offset >= start && offset <= end
+	}
+
+	typeHint := func(ident *ast.Ident) {
+		if ident.Name == "_" || !inRange(ident.End()) {
+			return
+		}
+		// Only the variables that the statement declares
+		if obj := info.Defs[ident]; obj != nil {
+			hints = append(hints, InlayHint{checked.offset(ident.End()), " " + checked.typeString(obj.Type()), "type"})
+		}
+	}
+
+	ast.Inspect(checked.file, func(n ast.Node) bool {
+		if n == nil {
+			return false
+		}
+		// Nothing below a node that lies entirely outside of the range
+		if checked.offset(n.End()) < start || checked.offset(n.Pos()) > end {
+			return false
+		}
+
+		switch x := n.(type) {
+		case *ast.AssignStmt:
+			if x.Tok == token.DEFINE {
+				for _, lhs := range x.Lhs {
+					if ident, ok := lhs.(*ast.Ident); ok {
+						typeHint(ident)
+					}
+				}
+			}
+		case *ast.RangeStmt:
+			if x.Tok == token.DEFINE {
+				for _, e := range []ast.Expr{x.Key, x.Value} {
+					if ident, ok := e.(*ast.Ident); ok {
+						typeHint(ident)
+					}
+				}
+			}
+		case *ast.CallExpr:
+			hints = append(hints, parameterHints(checked, x, inRange)...)
+		}
+
+		return true
+	})
+
+	return hints
+}
+
+// Names of the parameters in front of the arguments of a call, except
+// where the argument already says as much.
+func parameterHints(checked *checkedBuffer, call *ast.CallExpr, inRange func(token.Pos) bool) []InlayHint {
+	tv, ok := checked.info.Types[call.Fun]
+	if !ok || tv.IsType() || tv.Type == nil {
+		return nil
+	}
+	sig, ok := tv.Type.Underlying().(*types.Signature)
+	if !ok || sig.Params().Len() == 0 {
+		return nil
+	}
+
+	hints := []InlayHint{}
+	params := sig.Params()
+
+	for idx, arg := range call.Args {
+		if !inRange(arg.Pos()) {
+			continue
+		}
+
+		paramIdx := idx
+		variadic := sig.Variadic() && idx >= params.Len()-1
+		if variadic {
+			// The rest of the variadic arguments go without a hint
+			if idx > params.Len()-1 {
+				break
+			}
+			paramIdx = params.Len() - 1
+		}
+		if paramIdx >= params.Len() {
+			break
+		}
+
+		name := params.At(paramIdx).Name()
+		if name == "" || name == "_" {
+			continue
+		}
+		if ident, ok := arg.(*ast.Ident); ok && ident.Name == name {
+			continue
+		}
+
+		label := name + ":"
+		if variadic {
+			label = name + "...:"
+		}
+		hints = append(hints, InlayHint{checked.offset(arg.Pos()), label, "parameter"})
+	}
+
+	return hints
+}
@@ -0,0 +1,273 @@
+// Copyright 2014 Chris McGee <sirnewton_01@yahoo.ca>. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	// Ports tried after the configured one when it is taken
+	maxPortSearch = 100
+)
+
+// Running godev server of the user. Each server registers itself in
+// instances.json of ~/.godev, whatever its datadir is, so that several of
+// them can be told apart with "godev list".
+type Instance struct {
+	Pid  int
+	Host string `json:",omitempty"`
+	Port string `json:",omitempty"`
+	// Path of the Unix domain socket instead of the host and port
+	Socket string `json:",omitempty"`
+	Url    string
+	// Source directories that the instance serves
+	Workspaces []string
+	DataDir    string
+	Started    int64
+}
+
+var (
+	nextFreePort = flag.Bool("nextFreePort", false, "If the port is taken use the next free one instead of failing.")
+
+	// Unix domain socket of the listen flag
+	socketPath = ""
+
+	instancesMutex sync.Mutex
+)
+
+func instancesFile() string {
+	return filepath.Join(homeDir(), ".godev", "instances.json")
+}
+
+// The host of the listen flag, which also sets the port or the socket
+func listenFlagHost() (string, error) {
+	if *listenAddr == "" {
+		return "", nil
+	}
+
+	if strings.HasPrefix(*listenAddr, "unix://") {
+		socketPath = strings.TrimPrefix(*listenAddr, "unix://")
+		if socketPath == "" {
+			return "", errors.New("Invalid listen address: " + *listenAddr)
+		}
+		return "", nil
+	}
+
+	host, listenPort, err := net.SplitHostPort(*listenAddr)
+	if err != nil {
+		return "", errors.New("Invalid listen address: " + *listenAddr)
+	}
+	flag.Set("port", listenPort)
+
+	return host, nil
+}
+
+// Only the owner can connect to the socket, others can be let in with the
+// permissions of its directory. A socket that is left over from a server
+// that is gone is replaced.
+func listenSocket() (net.Listener, error) {
+	if conn, err := net.DialTimeout("unix", socketPath, 500*time.Millisecond); err == nil {
+		conn.Close()
+		return nil, errors.New("Another server is listening on " + socketPath)
+	}
+	if info, err := os.Lstat(socketPath); err == nil && info.Mode()&os.ModeSocket != 0 {
+		os.Remove(socketPath)
+	}
+
+	listener, err := net.Listen("unix", socketPath)
+	if err != nil {
+		return nil, err
+	}
+
+	err = os.Chmod(socketPath, 0600)
+	if err != nil {
+		listener.Close()
+		return nil, err
+	}
+
+	return listener, nil
+}
+
+// Listens on the socket or the port, or the next free port with the
+// nextFreePort flag. The port flag is updated to the port that was taken.
+func listenServer(host string) (net.Listener, error) {
+	if socketPath != "" {
+		return listenSocket()
+	}
+
+	first, err := strconv.Atoi(*port)
+	if err != nil {
+		return nil, fmt.Errorf("Invalid port: %v", *port)
+	}
+
+	tries := 1
+	if *nextFreePort {
+		tries = maxPortSearch
+	}
+
+	for p := first; p < first+tries && p <= 65535; p++ {
+		listener, err := net.Listen("tcp", net.JoinHostPort(host, strconv.Itoa(p)))
+		if err != nil {
+			if tries > 1 {
+				continue
+			}
+			return nil, err
+		}
+
+		if p != first {
+			logger.Printf("Port %v is taken, using %v\n", first, p)
+		}
+		*port = strconv.Itoa(p)
+		return listener, nil
+	}
+
+	return nil, fmt.Errorf("No free port between %v and %v", first, first+tries-1)
+}
+
+// Whether something still accepts connections at the instance's address
+func instanceAlive(instance Instance) bool {
+	network, address := "tcp", net.JoinHostPort(instance.Host, instance.Port)
+	if instance.Socket != "" {
+		network, address = "unix", instance.Socket
+	}
+
+	conn, err := net.DialTimeout(network, address, 500*time.Millisecond)
+	if err != nil {
+		return false
+	}
+	conn.Close()
+	return true
+}
+
+// Reads the registry without the instances that are gone, the mutex must
+// be held
+func readInstances() ([]Instance, error) {
+	instances := []Instance{}
+
+	b, err := ioutil.ReadFile(instancesFile())
+	if os.IsNotExist(err) {
+		return instances, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	registered := []Instance{}
+	err = json.Unmarshal(b, &registered)
+	if err != nil {
+		return nil, err
+	}
+
+	for _, instance := range registered {
+		if instance.Pid != os.Getpid() && instanceAlive(instance) {
+			instances = append(instances, instance)
+		}
+	}
+
+	return instances, nil
+}
+
+func writeInstances(instances []Instance) error {
+	err := os.MkdirAll(filepath.Dir(instancesFile()), 0700)
+	if err != nil {
+		return err
+	}
+
+	b, err := json.MarshalIndent(instances, "", "  ")
+	if err != nil {
+		return err
+	}
+
+	return ioutil.WriteFile(instancesFile(), b, 0600)
+}
+
+// Adds this server to the registry, the server removes it again when it
+// shuts down
+func registerInstance(url string) {
+	instancesMutex.Lock()
+	defer instancesMutex.Unlock()
+
+	instances, err := readInstances()
+	if err != nil {
+		logger.Printf("Unable to read the instances: %v\n", err)
+		instances = []Instance{}
+	}
+
+	instance := Instance{Pid: os.Getpid(), Host: hostName, Port: *port, Url: url,
+		Workspaces: srcDirs, DataDir: godevDataDir(), Started: time.Now().Unix() * 1000}
+	if socketPath != "" {
+		instance.Host, instance.Port, instance.Socket = "", "", socketPath
+	}
+	instances = append(instances, instance)
+
+	err = writeInstances(instances)
+	if err != nil {
+		logger.Printf("Unable to register the instance: %v\n", err)
+	}
+}
+
+func unregisterInstance() {
+	instancesMutex.Lock()
+	defer instancesMutex.Unlock()
+
+	instances, err := readInstances()
+	if err != nil {
+		logger.Printf("Unable to read the instances: %v\n", err)
+		return
+	}
+
+	err = writeInstances(instances)
+	if err != nil {
+		logger.Printf("Unable to unregister the instance: %v\n", err)
+	}
+}
+
+// godev list
+func listCommand(args []string) error {
+	flags := flag.NewFlagSet("list", flag.ExitOnError)
+	asJson := flags.Bool("json", false, "Print the instances as JSON.")
+	flags.Parse(args)
+
+	instancesMutex.Lock()
+	instances, err := readInstances()
+	instancesMutex.Unlock()
+	if err != nil {
+		return err
+	}
+
+	if *asJson {
+		b, err := json.MarshalIndent(instances, "", "  ")
+		if err != nil {
+			return err
+		}
+		fmt.Println(string(b))
+		return nil
+	}
+
+	if len(instances) == 0 {
+		fmt.Println("No godev instance is running")
+		return nil
+	}
+
+	for _, instance := range instances {
+		started := time.Unix(instance.Started/1000, 0).Format("2006-01-02 15:04")
+		fmt.Printf("%v\tpid %v, started %v\n", instance.Url, instance.Pid, started)
+		fmt.Printf("\t%v\n", strings.Join(instance.Workspaces, string(os.PathListSeparator)))
+	}
+
+	return nil
+}
@@ -0,0 +1,251 @@
+// Copyright 2014 Chris McGee <sirnewton_01@yahoo.ca>. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/url"
+	"path"
+	"strings"
+	"time"
+)
+
+const (
+	defaultInviteDuration = 2 * time.Hour
+	maxInviteDuration     = 24 * time.Hour
+)
+
+// What the key of an invite lets a guest do. Guests only get at the files
+// and directories of the workspace in Paths, and the terminals in
+// Terminals, which they can watch or also type in with Write.
+type GuestScope struct {
+	// Workspace paths, e.g. myproject/main.go or myproject/pkg
+	Paths []string `json:",omitempty"`
+	// Ids of the terminal sessions that are shared
+	Terminals []string `json:",omitempty"`
+	Write     bool
+}
+
+type InviteRequest struct {
+	Label     string
+	Paths     []string
+	Terminals []string
+	Write     bool
+	// Duration until the invite expires (e.g. "2h"), two hours unless given
+	Expires string
+}
+
+// The workspace path of a location such as /file/myproject/main.go
+func scopePath(location string) string {
+	p := path.Clean("/" + strings.TrimPrefix(strings.TrimPrefix(location, "/"), "file/"))
+	return strings.TrimPrefix(p, "/")
+}
+
+func (scope *GuestScope) pathAllowed(p string) bool {
+	p = scopePath(p)
+	for _, allowed := range scope.Paths {
+		if p == allowed || strings.HasPrefix(p, allowed+"/") {
+			return true
+		}
+	}
+
+	return false
+}
+
+func (scope *GuestScope) terminalAllowed(id string) bool {
+	for _, allowed := range scope.Terminals {
+		if id == allowed {
+			return true
+		}
+	}
+
+	return false
+}
+
+// Whether the guest can make the request, anything that isn't one of the
+// files or terminals is denied
+func (scope *GuestScope) allows(req *http.Request, pathSegs []string) bool {
+	readOnlyMethod := req.Method == "GET" || req.Method == "HEAD"
+
+	switch pathSegs[0] {
+	case "file":
+		return scope.pathAllowed(strings.Join(pathSegs[1:], "/")) && (readOnlyMethod || scope.Write)
+	case "workspace":
+		// The top of the workspace, which the editor loads
+		return readOnlyMethod && len(pathSegs) == 1
+	case "prefs":
+		// The guest's own preferences
+		return true
+	case "roles":
+		return readOnlyMethod
+	case "docker":
+		switch {
+		case len(pathSegs) == 2 && pathSegs[1] == "connect":
+			return len(scope.Terminals) > 0
+		case len(pathSegs) == 2 && pathSegs[1] == "socket":
+			return scope.terminalAllowed(req.URL.Query().Get("attach"))
+		case len(pathSegs) == 2 && pathSegs[1] == "sessions":
+			return readOnlyMethod
+		}
+	}
+
+	return false
+}
+
+// The key of the request, nil without one or on the loopback host
+func requestKey(req *http.Request) *MagicKey {
+	if hostName == loopbackHost {
+		return nil
+	}
+	cookie, err := req.Cookie("MAGIC" + *port)
+	if err != nil {
+		return nil
+	}
+
+	keysMutex.Lock()
+	defer keysMutex.Unlock()
+
+	k := findMagicKey(cookie.Value)
+	if k == nil || k.Pairing {
+		return nil
+	}
+	key := *k
+	return &key
+}
+
+// The scope of the request of a guest, nil for everyone else
+func requestScope(req *http.Request) *GuestScope {
+	if k := requestKey(req); k != nil {
+		return k.Scope
+	}
+
+	return nil
+}
+
+func newInvite(req *http.Request, inviteReq InviteRequest) (*MagicKey, error) {
+	if hostName == loopbackHost {
+		return nil, errors.New("Invites need a godev that can be reached remotely")
+	}
+
+	expires := defaultInviteDuration
+	if inviteReq.Expires != "" {
+		d, err := time.ParseDuration(inviteReq.Expires)
+		if err != nil || d <= 0 || d > maxInviteDuration {
+			return nil, errors.New("Invalid expiry, invites last at most " + maxInviteDuration.String())
+		}
+		expires = d
+	}
+
+	scope := &GuestScope{Write: inviteReq.Write}
+	for _, p := range inviteReq.Paths {
+		p = scopePath(p)
+		if p == "" {
+			return nil, errors.New("Invites can't share the whole workspace")
+		}
+		scope.Paths = append(scope.Paths, p)
+	}
+
+	user := requestUser(req)
+	for _, id := range inviteReq.Terminals {
+		session := findTerminalSession(id)
+		if session == nil || session.User != user {
+			return nil, errors.New("No such terminal: " + id)
+		}
+		scope.Terminals = append(scope.Terminals, id)
+	}
+	if len(scope.Paths) == 0 && len(scope.Terminals) == 0 {
+		return nil, errors.New("An invite has to share a file or a terminal")
+	}
+
+	label := inviteReq.Label
+	if label == "" {
+		label = "Guest"
+	}
+
+	key := addUserMagicKey("guest-"+newId(), label, expires, false)
+
+	keysMutex.Lock()
+	key.Scope = scope
+	if len(scope.Paths) > 0 {
+		key.Landing = "/edit/edit.html#/file/" + scope.Paths[0]
+	} else {
+		key.Landing = "/terminal/terminal.html#attach=" + url.QueryEscape(scope.Terminals[0])
+	}
+	saveMagicKeys()
+	grant := *key
+	keysMutex.Unlock()
+
+	return &grant, nil
+}
+
+func listInvites() []MagicKey {
+	invites := []MagicKey{}
+	for _, k := range listMagicKeys() {
+		if k.Scope != nil {
+			invites = append(invites, k)
+		}
+	}
+
+	return invites
+}
+
+// Revokes the invite, the guests' terminals are closed with it
+func revokeInvite(id string) bool {
+	keysMutex.Lock()
+	found := false
+	for _, k := range magicKeys {
+		if k.Id == id && k.Scope != nil {
+			found = removeMagicKey(id)
+			break
+		}
+	}
+	keysMutex.Unlock()
+
+	if found {
+		detachTerminalGuests(id)
+	}
+	return found
+}
+
+// GET /invites lists the invites that haven't expired, POST /invites
+// invites a guest to files or terminals with a URL to share and DELETE
+// /invites/<id> revokes one.
+func invitesHandler(writer http.ResponseWriter, req *http.Request, path string, pathSegs []string) bool {
+	switch {
+	case req.Method == "GET" && len(pathSegs) == 1:
+		ShowJson(writer, 200, listInvites())
+		return true
+	case req.Method == "POST" && len(pathSegs) == 1:
+		inviteReq := InviteRequest{}
+		err := json.NewDecoder(req.Body).Decode(&inviteReq)
+		if err != nil {
+			ShowError(writer, 400, "Invalid invite", err)
+			return true
+		}
+
+		key, err := newInvite(req, inviteReq)
+		if err != nil {
+			ShowError(writer, 400, err.Error(), nil)
+			return true
+		}
+
+		url := loginUrl(key.Key)
+		key.Key = ""
+		ShowJson(writer, 201, MagicKeyGrant{Key: *key, Url: url})
+		return true
+	case req.Method == "DELETE" && len(pathSegs) == 2:
+		if !revokeInvite(pathSegs[1]) {
+			ShowError(writer, 404, "No such invite", nil)
+			return true
+		}
+
+		writer.WriteHeader(204)
+		return true
+	}
+
+	return false
+}
@@ -0,0 +1,92 @@
+// Copyright 2014 Chris McGee <sirnewton_01@yahoo.ca>. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestScopePath(t *testing.T) {
+	tests := []struct {
+		location string
+		p        string
+	}{
+		{"/file/project/main.go", "project/main.go"},
+		{"file/project/pkg/", "project/pkg"},
+		{"project/main.go", "project/main.go"},
+		{"/file/project/../other/secret.go", "other/secret.go"},
+		{"/file/../../etc/passwd", "etc/passwd"},
+		{"/file/project//./main.go", "project/main.go"},
+		{"/file/", ""},
+		{"", ""},
+	}
+
+	for _, test := range tests {
+		if p := scopePath(test.location); p != test.p {
+			t.Errorf("scopePath(%q) = %q, expected %q", test.location, p, test.p)
+		}
+	}
+}
+
+func TestGuestScopeAllows(t *testing.T) {
+	readOnly := &GuestScope{Paths: []string{"project/pkg", "other/main.go"}, Terminals: []string{"term1"}}
+	writable := &GuestScope{Paths: []string{"project/pkg"}, Write: true}
+
+	tests := []struct {
+		scope   *GuestScope
+		method  string
+		url     string
+		allowed bool
+	}{
+		{readOnly, "GET", "/file/project/pkg", true},
+		{readOnly, "GET", "/file/project/pkg/a.go", true},
+		{readOnly, "HEAD", "/file/other/main.go", true},
+		{readOnly, "PUT", "/file/project/pkg/a.go", false},
+		{readOnly, "DELETE", "/file/project/pkg/a.go", false},
+		{readOnly, "POST", "/file/project/pkg", false},
+		{readOnly, "GET", "/file/project", false},
+		{readOnly, "GET", "/file/project/main.go", false},
+		{readOnly, "GET", "/file/project/pkgs/a.go", false},
+		{readOnly, "GET", "/file/other/main.go.orig", false},
+		{readOnly, "GET", "/file/project/pkg/../main.go", false},
+		{readOnly, "GET", "/file/project/pkg/../../other/secret.go", false},
+		{writable, "PUT", "/file/project/pkg/a.go", true},
+		{writable, "POST", "/file/project/pkg", true},
+		{writable, "DELETE", "/file/project/pkg/a.go", true},
+		{writable, "PUT", "/file/project/main.go", false},
+		{writable, "PUT", "/file/project/pkg/../main.go", false},
+		{readOnly, "GET", "/workspace", true},
+		{readOnly, "GET", "/workspace/project", false},
+		{readOnly, "POST", "/workspace", false},
+		{readOnly, "GET", "/prefs/user/editor", true},
+		{readOnly, "PUT", "/prefs/user/editor", true},
+		{readOnly, "GET", "/roles", true},
+		{readOnly, "PUT", "/roles", false},
+		{readOnly, "GET", "/docker/connect", true},
+		{writable, "GET", "/docker/connect", false},
+		{readOnly, "GET", "/docker/socket?attach=term1", true},
+		{readOnly, "GET", "/docker/socket?attach=term2", false},
+		{readOnly, "GET", "/docker/socket", false},
+		{readOnly, "GET", "/docker/sessions", true},
+		{readOnly, "DELETE", "/docker/sessions", false},
+		{readOnly, "GET", "/docker/images", false},
+		{writable, "GET", "/go/build", false},
+		{writable, "GET", "/shell", false},
+		{writable, "POST", "/gitapi/commit/project", false},
+		{writable, "GET", "/debug/sessions", false},
+		{writable, "GET", "/keys", false},
+	}
+
+	for _, test := range tests {
+		req := httptest.NewRequest(test.method, test.url, nil)
+		pathSegs := strings.Split(strings.TrimPrefix(req.URL.Path, "/"), "/")
+
+		if allowed := test.scope.allows(req, pathSegs); allowed != test.allowed {
+			t.Errorf("%v %v with %+v: allowed is %v, expected %v", test.method, test.url, test.scope, allowed, test.allowed)
+		}
+	}
+}
@@ -0,0 +1,383 @@
+// Copyright 2014 Chris McGee <sirnewton_01@yahoo.ca>. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"bytes"
+	"crypto/rand"
+	"crypto/subtle"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"rsc.io/qr"
+)
+
+// A key that grants access to a remote godev. Pairing keys are short lived
+// and can only be used once to log in a new device, which then gets a key
+// of its own. The keys of accounts log in as their user. The keys of
+// invites only let their guest at what they share.
+type MagicKey struct {
+	Id      string
+	Label   string
+	Key     string `json:",omitempty"`
+	Created int64
+	Expires int64
+	Pairing bool
+	User    string      `json:",omitempty"`
+	Scope   *GuestScope `json:",omitempty"`
+	// Page that the login lands on
+	Landing string `json:",omitempty"`
+}
+
+type MagicKeyGrant struct {
+	Key MagicKey
+	Url string
+}
+
+type MagicKeyRequest struct {
+	Label string
+	// Duration until the key expires (e.g. "24h"), keys without one never expire
+	Expires string
+}
+
+var (
+	keysMutex sync.Mutex
+	magicKeys = []*MagicKey{}
+)
+
+// The keys are all it takes to log in, so they come from crypto/rand like
+// the preview tokens instead of the seeded generator of the identifiers
+func newMagicKey() string {
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		panic(err)
+	}
+	return hex.EncodeToString(b)
+}
+
+// The keys are kept in the data directory so that the browsers and devices
+// stay logged in when the server restarts
+func keysFile() string {
+	return filepath.Join(godevDataDir(), "keys.json")
+}
+
+// Loads the keys that haven't expired yet
+func loadMagicKeys() {
+	keysMutex.Lock()
+	defer keysMutex.Unlock()
+
+	b, err := ioutil.ReadFile(keysFile())
+	if os.IsNotExist(err) {
+		return
+	}
+	loaded := []*MagicKey{}
+	if err == nil {
+		err = json.Unmarshal(b, &loaded)
+	}
+	if err != nil {
+		logger.Printf("Unable to read the keys: %v\n", err)
+		return
+	}
+
+	now := time.Now().Unix() * 1000
+	magicKeys = []*MagicKey{}
+	for _, k := range loaded {
+		if k.Key != "" && (k.Expires == 0 || k.Expires > now) {
+			magicKeys = append(magicKeys, k)
+		}
+	}
+}
+
+// Writes the keys that haven't expired yet, the mutex must be held
+func saveMagicKeys() {
+	now := time.Now().Unix() * 1000
+	keys := []*MagicKey{}
+	for _, k := range magicKeys {
+		if k.Expires == 0 || k.Expires > now {
+			keys = append(keys, k)
+		}
+	}
+
+	b, err := json.MarshalIndent(keys, "", "  ")
+	if err == nil {
+		err = os.MkdirAll(godevDataDir(), 0700)
+	}
+	if err == nil {
+		err = ioutil.WriteFile(keysFile()+".tmp", b, 0600)
+	}
+	if err == nil {
+		err = os.Rename(keysFile()+".tmp", keysFile())
+	}
+	if err != nil {
+		logger.Printf("Unable to save the keys: %v\n", err)
+	}
+}
+
+// The primary key of the owner from an earlier run, or a new one
+func primaryMagicKey() string {
+	keysMutex.Lock()
+	for _, k := range magicKeys {
+		if k.Label == "primary" && k.User == "" && k.Scope == nil && !k.Pairing && k.Expires == 0 {
+			keysMutex.Unlock()
+			return k.Key
+		}
+	}
+	keysMutex.Unlock()
+
+	return addMagicKey("primary", 0, false).Key
+}
+
+func loginUrl(key string) string {
+	return fmt.Sprintf("https://%v:%v%v/login?MAGIC=%v", hostName, *port, routePrefix(), key)
+}
+
+func addMagicKey(label string, expires time.Duration, pairing bool) *MagicKey {
+	return addUserMagicKey("", label, expires, pairing)
+}
+
+// Adds a key that logs in as the user of an account
+func addUserMagicKey(user string, label string, expires time.Duration, pairing bool) *MagicKey {
+	key := &MagicKey{Id: newId(), Label: label, Key: newMagicKey(), Created: time.Now().Unix() * 1000, Pairing: pairing, User: user}
+	if expires > 0 {
+		key.Expires = time.Now().Add(expires).Unix() * 1000
+	}
+
+	keysMutex.Lock()
+	magicKeys = append(magicKeys, key)
+	saveMagicKeys()
+	keysMutex.Unlock()
+
+	return key
+}
+
+// Looks up an unexpired key, the mutex must be held. The keys are compared
+// in constant time so that the timing doesn't give away how much of a
+// guess matches.
+func findMagicKey(key string) *MagicKey {
+	if key == "" {
+		return nil
+	}
+
+	now := time.Now().Unix() * 1000
+	for _, k := range magicKeys {
+		if subtle.ConstantTimeCompare([]byte(k.Key), []byte(key)) == 1 && (k.Expires == 0 || k.Expires > now) {
+			return k
+		}
+	}
+
+	return nil
+}
+
+// Whether the key of a cookie grants access to the services
+func validMagicKey(key string) bool {
+	keysMutex.Lock()
+	defer keysMutex.Unlock()
+
+	k := findMagicKey(key)
+	return k != nil && !k.Pairing
+}
+
+// The account user of the key of a cookie, empty for the keys of the owner
+func magicKeyUser(key string) string {
+	keysMutex.Lock()
+	defer keysMutex.Unlock()
+
+	k := findMagicKey(key)
+	if k == nil || k.Pairing {
+		return ""
+	}
+	return k.User
+}
+
+// The page that the key's login lands on, if it has one
+func magicKeyLanding(key string) string {
+	keysMutex.Lock()
+	defer keysMutex.Unlock()
+
+	k := findMagicKey(key)
+	if k == nil {
+		return ""
+	}
+	return k.Landing
+}
+
+// Checks the key given to the login and returns the one that the browser
+// should keep in its cookie.
+func loginMagicKey(key string) (string, bool) {
+	keysMutex.Lock()
+	k := findMagicKey(key)
+	if k != nil && k.Pairing {
+		removeMagicKey(k.Id)
+	}
+	keysMutex.Unlock()
+
+	switch {
+	case k == nil:
+		return "", false
+	case k.Pairing:
+		return addUserMagicKey(k.User, "Paired device", 0, false).Key, true
+	}
+
+	return k.Key, true
+}
+
+// Removes the key, the mutex must be held
+func removeMagicKey(id string) bool {
+	for idx, k := range magicKeys {
+		if k.Id == id {
+			magicKeys = append(magicKeys[:idx], magicKeys[idx+1:]...)
+			saveMagicKeys()
+			return true
+		}
+	}
+
+	return false
+}
+
+// Replaces all of the keys with a new one, which logs out every browser
+// and device that is still using one of the old keys.
+func rotateMagicKeys() *MagicKey {
+	keysMutex.Lock()
+	magicKeys = []*MagicKey{}
+	keysMutex.Unlock()
+
+	key := addMagicKey("primary", 0, false)
+	magicKey = key.Key
+
+	return key
+}
+
+func listMagicKeys() []MagicKey {
+	keysMutex.Lock()
+	defer keysMutex.Unlock()
+
+	now := time.Now().Unix() * 1000
+	keys := []MagicKey{}
+	for _, k := range magicKeys {
+		if k.Expires != 0 && k.Expires <= now {
+			continue
+		}
+
+		// The keys themselves are never shown again
+		key := *k
+		key.Key = ""
+		keys = append(keys, key)
+	}
+
+	return keys
+}
+
+// Renders a QR code with half blocks so that it can be scanned straight
+// from the terminal. Light modules are drawn for dark terminals.
+func terminalQrCode(text string) (string, error) {
+	code, err := qr.Encode(text, qr.L)
+	if err != nil {
+		return "", err
+	}
+
+	const quietZone = 2
+	light := func(x, y int) bool {
+		return x < 0 || y < 0 || x >= code.Size || y >= code.Size || !code.Black(x, y)
+	}
+
+	buf := &bytes.Buffer{}
+	for y := -quietZone; y < code.Size+quietZone; y += 2 {
+		for x := -quietZone; x < code.Size+quietZone; x++ {
+			top, bottom := light(x, y), light(x, y+1)
+			switch {
+			case top && bottom:
+				buf.WriteString("█")
+			case top:
+				buf.WriteString("▀")
+			case bottom:
+				buf.WriteString("▄")
+			default:
+				buf.WriteString(" ")
+			}
+		}
+		buf.WriteString("\n")
+	}
+
+	return buf.String(), nil
+}
+
+// Prints a short lived pairing URL, with a QR code for phones and tablets
+func printPairing() {
+	key := addMagicKey("Pairing", *pairingTimeout, true)
+	url := loginUrl(key.Key)
+
+	fmt.Printf("Pairing (valid for %v): %v\n", *pairingTimeout, url)
+
+	code, err := terminalQrCode(url)
+	if err != nil {
+		logger.Printf("Unable to render the pairing QR code: %v\n", err)
+		return
+	}
+	fmt.Print(code)
+}
+
+func adminKeysHandler(writer http.ResponseWriter, req *http.Request, path string, pathSegs []string) bool {
+	switch {
+	case req.Method == "GET" && len(pathSegs) == 2:
+		ShowJson(writer, 200, listMagicKeys())
+		return true
+	case req.Method == "POST" && len(pathSegs) == 2:
+		keyReq := MagicKeyRequest{}
+		err := json.NewDecoder(req.Body).Decode(&keyReq)
+		if err != nil {
+			ShowError(writer, 400, "Invalid key request", err)
+			return true
+		}
+
+		expires := time.Duration(0)
+		if keyReq.Expires != "" {
+			expires, err = time.ParseDuration(keyReq.Expires)
+			if err != nil || expires <= 0 {
+				ShowError(writer, 400, "Invalid expiry", err)
+				return true
+			}
+		}
+
+		key := addMagicKey(keyReq.Label, expires, false)
+		ShowJson(writer, 201, MagicKeyGrant{Key: *key, Url: loginUrl(key.Key)})
+		return true
+	case req.Method == "POST" && len(pathSegs) == 3 && pathSegs[2] == "pair":
+		key := addMagicKey("Pairing", *pairingTimeout, true)
+		ShowJson(writer, 201, MagicKeyGrant{Key: *key, Url: loginUrl(key.Key)})
+		return true
+	case req.Method == "POST" && len(pathSegs) == 3 && pathSegs[2] == "rotate":
+		key := rotateMagicKeys()
+
+		// Keep the browser that asked for it logged in
+		cookie := sessionCookie(req, key.Key)
+		http.SetCookie(writer, cookie)
+
+		sendMailAsync("rotation", MailData{Url: loginUrl(key.Key)})
+
+		ShowJson(writer, 200, MagicKeyGrant{Key: *key, Url: loginUrl(key.Key)})
+		return true
+	case req.Method == "DELETE" && len(pathSegs) == 3:
+		keysMutex.Lock()
+		removed := removeMagicKey(pathSegs[2])
+		keysMutex.Unlock()
+
+		if !removed {
+			ShowError(writer, 404, "No such key", nil)
+			return true
+		}
+
+		writer.WriteHeader(204)
+		return true
+	}
+
+	return false
+}
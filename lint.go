@@ -0,0 +1,268 @@
+// Copyright 2014 Chris McGee <sirnewton_01@yahoo.ca>. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// The linters of /go/lint, read from linters.json in the data directory.
+// A new tool is added there without changing godev:
+//
+//	{"Linters": [{
+//		"Name": "errcheck",
+//		"Command": "errcheck",
+//		"Args": ["{{pkg}}"]
+//	}]}
+type LinterConfig struct {
+	Linters []Linter
+}
+
+type Linter struct {
+	Name    string
+	Command string
+	// Arguments of the command. {{pkg}} is replaced by the import path of
+	//  the package, {{dir}} by its directory, which is also the working
+	//  directory, and {{file}} by the file being linted, if any.
+	Args []string
+	// Regular expression of the lines of the output that are findings,
+	//  with the named groups file, line, col and msg. The default matches
+	//  "file.go:12:5: message".
+	Pattern string `json:",omitempty"`
+	// Of the findings, SEV_WARN by default
+	Severity string `json:",omitempty"`
+	// Runs only when asked for by name
+	Disabled bool `json:",omitempty"`
+}
+
+type LinterInfo struct {
+	Linter
+	Available bool
+}
+
+var (
+	lintersMutex sync.Mutex
+
+	defaultLinters = LinterConfig{Linters: []Linter{
+		{Name: "staticcheck", Command: "staticcheck", Args: []string{"."}},
+		{Name: "golint", Command: "golint", Args: []string{"."}},
+	}}
+
+	defaultLintPattern = `^(?P<file>(?:[A-Za-z]:)?[^:]+):(?P<line>\d+)(?::(?P<col>\d+))?: (?P<msg>.*)$`
+)
+
+func lintersFile() string {
+	return filepath.Join(godevDataDir(), "linters.json")
+}
+
+// The file is read each time so that it can be edited while godev runs
+func loadLinters() (LinterConfig, error) {
+	lintersMutex.Lock()
+	defer lintersMutex.Unlock()
+
+	b, err := ioutil.ReadFile(lintersFile())
+	if os.IsNotExist(err) {
+		if linters := configuredLinters(); linters != nil {
+			return LinterConfig{Linters: linters}, nil
+		}
+		return defaultLinters, nil
+	}
+	if err != nil {
+		return LinterConfig{}, err
+	}
+
+	config := LinterConfig{}
+	err = json.Unmarshal(b, &config)
+	return config, err
+}
+
+// Directory of a package of the workspace
+func packageDir(srcDirs []string, pkg string) (string, error) {
+	for _, srcDir := range srcDirs {
+		p := filepath.Join(srcDir, filepath.FromSlash(pkg))
+		if info, err := os.Stat(p); err == nil && info.IsDir() {
+			return p, nil
+		}
+	}
+
+	return "", errors.New("No such package in the workspace: " + pkg)
+}
+
+// Runs the linter in the directory of the package and returns what it
+// found in the format of the compile errors
+func runLinter(req *http.Request, linter Linter, pkg string, dir string, file string) ([]CompileError, error) {
+	findings := []CompileError{}
+
+	pattern := linter.Pattern
+	if pattern == "" {
+		pattern = defaultLintPattern
+	}
+	finding, err := regexp.Compile(pattern)
+	if err != nil {
+		return findings, err
+	}
+	severity := linter.Severity
+	if severity == "" {
+		severity = SEV_WARN
+	}
+
+	replacer := strings.NewReplacer("{{pkg}}", pkg, "{{dir}}", dir, "{{file}}", file)
+	args := []string{}
+	for _, arg := range linter.Args {
+		args = append(args, replacer.Replace(arg))
+	}
+
+	ctx, cancel := operationContext(req, *buildTimeout)
+	defer cancel()
+
+	cmd := exec.CommandContext(ctx, linter.Command, args...)
+	cmd.Dir = dir
+	// Linters report their findings with a non-zero exit code
+	output, err := cmd.CombinedOutput()
+	if ctx.Err() != nil {
+		return findings, ctx.Err()
+	}
+	if _, ok := err.(*exec.ExitError); err != nil && !ok {
+		return findings, err
+	}
+
+	scanner := bufio.NewScanner(bytes.NewReader(output))
+	for scanner.Scan() {
+		m := finding.FindStringSubmatch(scanner.Text())
+		if m == nil {
+			continue
+		}
+
+		f := CompileError{Severity: severity, Msg: linter.Name, Code: linter.Name}
+		for idx, name := range finding.SubexpNames() {
+			switch name {
+			case "file":
+				p := m[idx]
+				if !filepath.IsAbs(p) {
+					p = filepath.Join(dir, p)
+				}
+				f.Location = workspaceLocation(p)
+			case "line":
+				f.Line, _ = strconv.ParseInt(m[idx], 10, 64)
+			case "col":
+				f.Column, _ = strconv.ParseInt(m[idx], 10, 64)
+			case "msg":
+				f.Msg = m[idx] + " (" + linter.Name + ")"
+			}
+		}
+		findings = append(findings, f)
+	}
+
+	return findings, nil
+}
+
+// GET /go/lint?pkg=<import path> runs the enabled linters on the package,
+// ?file=<location> only reports the findings in that file. A comma
+// separated linters parameter picks the linters by name instead.
+// GET /go/lint/linters lists them and whether they are installed.
+func lintHandler(writer http.ResponseWriter, req *http.Request, path string, pathSegs []string) bool {
+	switch {
+	case req.Method == "GET" && len(pathSegs) == 3 && pathSegs[2] == "linters":
+		config, err := loadLinters()
+		if err != nil {
+			ShowError(writer, 500, "Unable to read "+lintersFile(), err)
+			return true
+		}
+
+		infos := []LinterInfo{}
+		for _, linter := range config.Linters {
+			_, err := exec.LookPath(linter.Command)
+			infos = append(infos, LinterInfo{linter, err == nil})
+		}
+
+		ShowJson(writer, 200, infos)
+		return true
+	case req.Method == "GET" && len(pathSegs) == 2:
+		query := req.URL.Query()
+		pkg := query.Get("pkg")
+		location := query.Get("file")
+
+		file := ""
+		if location != "" {
+			if !strings.HasPrefix(location, "/file/") {
+				ShowError(writer, 400, "Not a workspace file: "+location, nil)
+				return true
+			}
+			pkg = filepath.ToSlash(filepath.Dir(location[len("/file/"):]))
+
+			var err error
+			file, err = bufferPath(requestSrcDirs(req), append([]string{"go", "lint"}, strings.Split(location[1:], "/")...))
+			if err != nil {
+				ShowError(writer, 400, err.Error(), nil)
+				return true
+			}
+		}
+		pkg = workspacePackage(pkg)
+		if pkg == "" || strings.HasPrefix(pkg, "-") {
+			ShowError(writer, 400, "Invalid package: "+pkg, nil)
+			return true
+		}
+
+		dir, err := packageDir(requestSrcDirs(req), pkg)
+		if err != nil {
+			ShowError(writer, 404, err.Error(), nil)
+			return true
+		}
+
+		config, err := loadLinters()
+		if err != nil {
+			ShowError(writer, 500, "Unable to read "+lintersFile(), err)
+			return true
+		}
+
+		selected := make(map[string]bool)
+		if names := query.Get("linters"); names != "" {
+			for _, name := range strings.Split(names, ",") {
+				selected[name] = true
+			}
+		}
+
+		findings := []CompileError{}
+		for _, linter := range config.Linters {
+			if (len(selected) != 0 && !selected[linter.Name]) || (len(selected) == 0 && linter.Disabled) {
+				continue
+			}
+
+			// Tools that aren't installed are skipped unless asked for
+			if _, err := exec.LookPath(linter.Command); err != nil && !selected[linter.Name] {
+				continue
+			}
+
+			linterFindings, err := runLinter(req, linter, pkg, dir, file)
+			if err != nil {
+				ShowError(writer, 500, "Error running "+linter.Name, err)
+				return true
+			}
+
+			for _, f := range linterFindings {
+				if location == "" || f.Location == location {
+					findings = append(findings, f)
+				}
+			}
+		}
+
+		ShowJson(writer, 200, findings)
+		return true
+	}
+
+	return false
+}
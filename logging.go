@@ -0,0 +1,298 @@
+// Copyright 2014 Chris McGee <sirnewton_01@yahoo.ca>. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+type logLevel int
+
+const (
+	levelDebug logLevel = iota
+	levelInfo
+	levelWarn
+	levelError
+	levelOff
+)
+
+// Logger of a subsystem of godev, which has a level of its own with the
+// logLevels flag
+type Logger struct {
+	subsystem string
+}
+
+// A line of the log with logJson
+type LogEntry struct {
+	Time      string `json:"time"`
+	Level     string `json:"level"`
+	Subsystem string `json:"subsystem"`
+	Message   string `json:"msg"`
+}
+
+// Rotates the log file once it reaches the maximum size, log.1 is the
+// latest of the rotated files
+type rotatingWriter struct {
+	path     string
+	maxSize  int64
+	maxFiles int
+	file     *os.File
+	size     int64
+}
+
+var (
+	logLevelName = flag.String("logLevel", "", "Least severe messages that are logged: debug, info, warn, error or off. (defaults to debug with -debug, otherwise warn)")
+	logLevels    = flag.String("logLevels", "", "Levels of subsystems that differ from logLevel, e.g. 'cfs=warn,build=debug'. The subsystems are godev, handlers, cfs, build and debug.")
+	logJson      = flag.Bool("logJson", false, "Write the log as JSON objects, one per line.")
+	logFilePath  = flag.String("logFile", "", "File to write the log to instead of the console. (empty writes to the console)")
+	logMaxSize   = flag.Int("logMaxSize", 10, "Size in megabytes that the log file is rotated at. (0 disables)")
+	logMaxFiles  = flag.Int("logMaxFiles", 5, "How many rotated log files are kept.")
+
+	levelNames = []string{"debug", "info", "warn", "error", "off"}
+
+	loggingMutex    sync.Mutex
+	logOutput       io.Writer = ioutil.Discard
+	logWriter       *rotatingWriter
+	defaultLogLevel = levelOff
+	subsystemLevels = make(map[string]logLevel)
+
+	logger      = &Logger{subsystem: "godev"}
+	handlersLog = &Logger{subsystem: "handlers"}
+	cfsLog      = &Logger{subsystem: "cfs"}
+	buildLog    = &Logger{subsystem: "build"}
+	debugLog    = &Logger{subsystem: "debug"}
+
+	logSubsystems = []*Logger{logger, handlersLog, cfsLog, buildLog, debugLog}
+)
+
+func parseLogLevel(name string) (logLevel, error) {
+	for level, levelName := range levelNames {
+		if strings.EqualFold(name, levelName) {
+			return logLevel(level), nil
+		}
+	}
+
+	return levelOff, errors.New("Invalid log level: " + name)
+}
+
+// Sets up the log from the flags, which happens again when the
+// configuration is reloaded
+func configureLogging() error {
+	level := levelWarn
+	if *debug {
+		level = levelDebug
+	}
+	if *logLevelName != "" {
+		l, err := parseLogLevel(*logLevelName)
+		if err != nil {
+			return err
+		}
+		level = l
+	}
+
+	levels := make(map[string]logLevel)
+	for _, entry := range strings.Split(*logLevels, ",") {
+		if strings.TrimSpace(entry) == "" {
+			continue
+		}
+		parts := strings.SplitN(entry, "=", 2)
+		if len(parts) != 2 || !logSubsystem(strings.TrimSpace(parts[0])) {
+			return errors.New("Invalid subsystem log level: " + entry)
+		}
+		l, err := parseLogLevel(strings.TrimSpace(parts[1]))
+		if err != nil {
+			return err
+		}
+		levels[strings.TrimSpace(parts[0])] = l
+	}
+
+	loggingMutex.Lock()
+	defer loggingMutex.Unlock()
+
+	if logWriter != nil && logWriter.path != *logFilePath {
+		logWriter.close()
+		logWriter = nil
+	}
+
+	switch {
+	case *logFilePath != "":
+		if logWriter == nil {
+			err := os.MkdirAll(filepath.Dir(*logFilePath), 0700)
+			if err != nil {
+				return err
+			}
+			logWriter = &rotatingWriter{path: *logFilePath}
+			err = logWriter.open()
+			if err != nil {
+				logWriter = nil
+				return err
+			}
+		}
+		logWriter.maxSize = int64(*logMaxSize) << 20
+		logWriter.maxFiles = *logMaxFiles
+		logOutput = logWriter
+	case *lsp:
+		// Standard output is the connection to the editor
+		logOutput = os.Stderr
+	case *debug:
+		logOutput = os.Stdout
+	default:
+		logOutput = os.Stderr
+	}
+
+	defaultLogLevel = level
+	subsystemLevels = levels
+
+	return nil
+}
+
+func logSubsystem(name string) bool {
+	for _, l := range logSubsystems {
+		if l.subsystem == name {
+			return true
+		}
+	}
+
+	return false
+}
+
+func (l *Logger) enabled(level logLevel) bool {
+	loggingMutex.Lock()
+	defer loggingMutex.Unlock()
+
+	min, ok := subsystemLevels[l.subsystem]
+	if !ok {
+		min = defaultLogLevel
+	}
+
+	return level >= min && level < levelOff
+}
+
+func (l *Logger) output(level logLevel, format string, args ...interface{}) {
+	if !l.enabled(level) {
+		return
+	}
+
+	now := time.Now()
+	message := strings.TrimRight(fmt.Sprintf(format, args...), "\n")
+
+	line := ""
+	if *logJson {
+		b, _ := json.Marshal(LogEntry{Time: now.Format(time.RFC3339Nano), Level: levelNames[level],
+			Subsystem: l.subsystem, Message: message})
+		line = string(b) + "\n"
+	} else {
+		line = now.Format("2006/01/02 15:04:05") + " " + strings.ToUpper(levelNames[level]) + " " +
+			l.subsystem + ": " + message + "\n"
+	}
+
+	loggingMutex.Lock()
+	defer loggingMutex.Unlock()
+
+	io.WriteString(logOutput, line)
+}
+
+func (l *Logger) Debugf(format string, args ...interface{}) {
+	l.output(levelDebug, format, args...)
+}
+
+func (l *Logger) Infof(format string, args ...interface{}) {
+	l.output(levelInfo, format, args...)
+}
+
+func (l *Logger) Warnf(format string, args ...interface{}) {
+	l.output(levelWarn, format, args...)
+}
+
+func (l *Logger) Errorf(format string, args ...interface{}) {
+	l.output(levelError, format, args...)
+}
+
+// Messages that don't say how severe they are, which are the details of
+// what godev does
+func (l *Logger) Printf(format string, args ...interface{}) {
+	l.output(levelDebug, format, args...)
+}
+
+func (l *Logger) Write(p []byte) (int, error) {
+	l.output(levelError, "%s", p)
+	return len(p), nil
+}
+
+// A standard logger for packages that want one, it logs errors
+func (l *Logger) std() *log.Logger {
+	return log.New(l, "", 0)
+}
+
+func (w *rotatingWriter) open() error {
+	file, err := os.OpenFile(w.path, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0600)
+	if err != nil {
+		return err
+	}
+
+	info, err := file.Stat()
+	if err != nil {
+		file.Close()
+		return err
+	}
+
+	w.file = file
+	w.size = info.Size()
+	return nil
+}
+
+func (w *rotatingWriter) close() {
+	if w.file != nil {
+		w.file.Close()
+		w.file = nil
+	}
+}
+
+// Moves log.n to log.n+1 and the log to log.1, and starts a new log
+func (w *rotatingWriter) rotate() error {
+	w.close()
+
+	for n := w.maxFiles - 1; n >= 1; n-- {
+		os.Rename(w.path+"."+strconv.Itoa(n), w.path+"."+strconv.Itoa(n+1))
+	}
+	if w.maxFiles > 0 {
+		os.Rename(w.path, w.path+".1")
+	} else {
+		os.Remove(w.path)
+	}
+	os.Remove(w.path + "." + strconv.Itoa(w.maxFiles+1))
+
+	return w.open()
+}
+
+// The logging mutex is held
+func (w *rotatingWriter) Write(p []byte) (int, error) {
+	if w.maxSize > 0 && w.size > 0 && w.size+int64(len(p)) > w.maxSize {
+		err := w.rotate()
+		if err != nil {
+			return 0, err
+		}
+	}
+	if w.file == nil {
+		return 0, os.ErrClosed
+	}
+
+	n, err := w.file.Write(p)
+	w.size += int64(n)
+
+	return n, err
+}
@@ -11,6 +11,7 @@ import (
 	"net/url"
 	"strings"
 	"sync"
+	"time"
 )
 
 type PersonaVerifyResult struct {
@@ -31,6 +32,16 @@ func loginHandler(w http.ResponseWriter, r *http.Request) {
 	loginMutex.Lock()
 	defer loginMutex.Unlock()
 
+	if difficulty := loginDifficulty(r); difficulty > 0 && loginAttempt(r) && !solvedChallenge(r, difficulty) {
+		serveLoginChallenge(w, r, difficulty)
+		return
+	}
+
+	if hostName != loopbackHost && strings.HasPrefix(r.URL.Path, "/login/oidc/") {
+		providerLoginHandler(w, r)
+		return
+	}
+
 	if hostName != loopbackHost && *remoteAccount != "" && strings.Index(r.URL.String(), "/persona") != -1 {
 		// Mozilla Persona
 		audience := "https://" + hostName + ":" + *port
@@ -66,16 +77,34 @@ func loginHandler(w http.ResponseWriter, r *http.Request) {
 			if verifyResult.Email == *remoteAccount && verifyResult.Status == "okay" && verifyResult.Issuer == "login.persona.org" && verifyResult.Audience == audience {
 				// If everything checks out then set the magic cookie to enable all service
 				//  requests.
-				cookie := &http.Cookie{Name: "MAGIC" + *port, Value: magicKey,
-					Path: "/", Domain: hostName, MaxAge: 2000000,
-					Secure: true, HttpOnly: false}
+				cookie := sessionCookie(r, magicKey)
 
 				http.SetCookie(w, cookie)
+				clearLoginFailures(r)
 				w.WriteHeader(200)
 				return
 			}
 		}
 
+		recordLoginFailure(r)
+		http.Error(w, "Permission Denied", 401)
+		return
+	}
+
+	if hostName != loopbackHost && r.Method == "POST" && strings.HasSuffix(r.URL.Path, "/form") {
+		// Password of an account, which gets a session of its own
+		name := r.FormValue("login")
+		if checkAccountPassword(name, r.FormValue("password")) {
+			key := addUserMagicKey(name, "Session", 2000000*time.Second, false)
+			cookie := sessionCookie(r, key.Key)
+
+			http.SetCookie(w, cookie)
+			clearLoginFailures(r)
+			ShowJson(w, 200, lookupAccount(name))
+			return
+		}
+
+		recordLoginFailure(r)
 		http.Error(w, "Permission Denied", 401)
 		return
 	}
@@ -85,28 +114,85 @@ func loginHandler(w http.ResponseWriter, r *http.Request) {
 	//  cookie for all future requests.
 
 	magicValues := r.URL.Query()["MAGIC"]
-	if len(magicValues) == 1 && magicValues[0] == magicKey {
+	cookieKey, validKey := "", false
+	if len(magicValues) == 1 {
+		cookieKey, validKey = loginMagicKey(magicValues[0])
+	}
+
+	if validKey {
 		// Redirect to the root URL setting the cookie
 		// Cookie lasts for a couple of weeks
-		cookie := &http.Cookie{Name: "MAGIC" + *port, Value: magicKey,
-			Path: "/", Domain: hostName, MaxAge: 2000000,
-			Secure: true, HttpOnly: false}
+		cookie := sessionCookie(r, cookieKey)
 
 		http.SetCookie(w, cookie)
-		http.Redirect(w, r, "/", 302)
+		clearLoginFailures(r)
+
+		// Land the user back where they left off in the last session, the
+		//  user of the key that was just checked and not of an old cookie
+		landingPage := magicKeyLanding(cookieKey)
+		if landingPage == "" {
+			landingPage = sessionLandingPage(keyUser(cookieKey))
+		}
+		if landingPage == "" {
+			landingPage = "/"
+		}
+		http.Redirect(w, r, requestPrefix(r)+landingPage, 302)
 		return
 	}
 
-	w.WriteHeader(200)
-	w.Write([]byte(`{"ForceEmail":false,"CanAddUsers":false}`))
+	if len(magicValues) > 0 {
+		recordLoginFailure(r)
+	}
+
+	options := LoginOptions{}
+	if hostName != loopbackHost {
+		options.Providers = loginProviderInfos()
+	}
+	ShowJson(w, 200, options)
 }
 
 func logoutHandler(w http.ResponseWriter, r *http.Request) {
+	// The session of an account ends for good
+	if cookie, err := r.Cookie("MAGIC" + *port); err == nil && magicKeyUser(cookie.Value) != "" {
+		keysMutex.Lock()
+		k := findMagicKey(cookie.Value)
+		if k != nil {
+			removeMagicKey(k.Id)
+		}
+		keysMutex.Unlock()
+	}
+
 	// Reset the cookie back to an empty value so that the user can
 	//  no longer access the services from this browser.
-	cookie := &http.Cookie{Name: "MAGIC" + *port, Value: "",
-		Path: "/", Domain: hostName, MaxAge: 2000000,
-		Secure: true, HttpOnly: false}
+	cookie := sessionCookie(r, "")
 
 	http.SetCookie(w, cookie)
 }
+
+// The user on whose behalf the request is made. Remote requests with the
+// key of an account are made by its user, the others by the owner of this
+// godev session, which is anonymous unless remote access has been bound to
+// a specific account.
+func requestUser(r *http.Request) string {
+	key := ""
+	if cookie, err := r.Cookie("MAGIC" + *port); err == nil {
+		key = cookie.Value
+	}
+
+	return keyUser(key)
+}
+
+// The user that logs in with the key
+func keyUser(key string) string {
+	if hostName != loopbackHost {
+		if user := magicKeyUser(key); user != "" {
+			return user
+		}
+	}
+
+	if hostName != loopbackHost && *remoteAccount != "" {
+		return *remoteAccount
+	}
+
+	return "anonymous"
+}
@@ -0,0 +1,434 @@
+// Copyright 2014 Chris McGee <sirnewton_01@yahoo.ca>. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"io"
+	"net/http"
+	"os"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"code.google.com/p/go.net/websocket"
+)
+
+const (
+	logPollInterval = 500 * time.Millisecond
+	defaultLogLines = 100
+	// Most of the file that is read at once, for the initial lines too
+	maxLogChunk = 1 << 20
+)
+
+// Line of a log for the browser, which gets them in batches
+type LogLine struct {
+	Text string `json:",omitempty"`
+	// Fields of a JSON line, which is then not sent as text
+	Record map[string]interface{} `json:",omitempty"`
+	// Class of the first highlighting rule that matches
+	Class string `json:",omitempty"`
+	Error string `json:",omitempty"`
+}
+
+// Settings of a tail, given as query parameters. The browser changes them
+// while tailing by sending them over the connection.
+type LogTailOptions struct {
+	// Only the lines matching the regular expression are sent
+	Filter    string
+	Highlight []LogHighlight
+
+	// Parses the lines as JSON records, such as those of structured
+	//  loggers. Where has a regular expression for the value of each
+	//  field that the records must match, nested fields are named with
+	//  dots as in "req.method". Fields are the only ones sent when given.
+	Json   bool
+	Where  map[string]string `json:",omitempty"`
+	Fields []string          `json:",omitempty"`
+}
+
+type LogHighlight struct {
+	Pattern string
+	Class   string
+}
+
+var (
+	defaultLogHighlights = []LogHighlight{
+		{`(?i)\b(panic|fatal|error|err)\b`, "error"},
+		{`(?i)\b(warn|warning)\b`, "warning"},
+		{`(?i)\b(debug|trace)\b`, "debug"},
+	}
+)
+
+type logFilter struct {
+	filter     *regexp.Regexp
+	highlights []*regexp.Regexp
+	classes    []string
+
+	json   bool
+	where  map[string]*regexp.Regexp
+	fields []string
+}
+
+func newLogFilter(options LogTailOptions) (*logFilter, error) {
+	f := &logFilter{}
+
+	if options.Filter != "" {
+		filter, err := regexp.Compile(options.Filter)
+		if err != nil {
+			return nil, err
+		}
+		f.filter = filter
+	}
+
+	if options.Highlight == nil {
+		options.Highlight = defaultLogHighlights
+	}
+	for _, h := range options.Highlight {
+		highlight, err := regexp.Compile(h.Pattern)
+		if err != nil {
+			return nil, err
+		}
+		f.highlights = append(f.highlights, highlight)
+		f.classes = append(f.classes, h.Class)
+	}
+
+	f.json = options.Json
+	f.fields = options.Fields
+	f.where = make(map[string]*regexp.Regexp)
+	for field, pattern := range options.Where {
+		where, err := regexp.Compile(pattern)
+		if err != nil {
+			return nil, err
+		}
+		f.where[field] = where
+	}
+
+	return f, nil
+}
+
+// Value of a field of a record, e.g. "req.method"
+func logField(record map[string]interface{}, name string) (interface{}, bool) {
+	var value interface{} = record
+
+	for _, seg := range strings.Split(name, ".") {
+		m, ok := value.(map[string]interface{})
+		if !ok {
+			return nil, false
+		}
+		value, ok = m[seg]
+		if !ok {
+			return nil, false
+		}
+	}
+
+	return value, true
+}
+
+// The record to send for a JSON line, nil when it doesn't match
+func (f *logFilter) record(text string) map[string]interface{} {
+	record := make(map[string]interface{})
+	if json.Unmarshal([]byte(text), &record) != nil {
+		return nil
+	}
+
+	for field, where := range f.where {
+		value, ok := logField(record, field)
+		if !ok {
+			return nil
+		}
+
+		s, isString := value.(string)
+		if !isString {
+			b, _ := json.Marshal(value)
+			s = string(b)
+		}
+		if !where.MatchString(s) {
+			return nil
+		}
+	}
+
+	if len(f.fields) == 0 {
+		return record
+	}
+
+	projection := make(map[string]interface{})
+	for _, field := range f.fields {
+		if value, ok := logField(record, field); ok {
+			projection[field] = value
+		}
+	}
+
+	return projection
+}
+
+func (f *logFilter) lines(texts []string) []LogLine {
+	lines := []LogLine{}
+
+	for _, text := range texts {
+		text = strings.TrimSuffix(text, "\r")
+		if f.filter != nil && !f.filter.MatchString(text) {
+			continue
+		}
+
+		line := LogLine{Text: text}
+		if f.json {
+			line.Record = f.record(text)
+
+			// Lines that aren't JSON pass unless there are conditions
+			if line.Record != nil {
+				line.Text = ""
+			} else if len(f.where) != 0 {
+				continue
+			}
+		}
+
+		for idx, highlight := range f.highlights {
+			if highlight.MatchString(text) {
+				line.Class = f.classes[idx]
+				break
+			}
+		}
+		lines = append(lines, line)
+	}
+
+	return lines
+}
+
+// The file of a tail request, either a workspace location or the output
+// file of one of the user's run configurations
+func logFile(req *http.Request) (string, error) {
+	location := req.URL.Query().Get("file")
+
+	if name := req.URL.Query().Get("config"); name != "" {
+		userDataMutex.Lock()
+		state, err := loadSession(requestUser(req))
+		userDataMutex.Unlock()
+		if err != nil {
+			return "", err
+		}
+
+		location = ""
+		for _, config := range state.RunConfigurations {
+			if config.Name == name {
+				location = config.OutputFile
+			}
+		}
+		if location == "" {
+			return "", errors.New("The run configuration " + name + " has no output file")
+		}
+	}
+
+	if !strings.HasPrefix(location, "/file/") {
+		return "", errors.New("Not a workspace file: " + location)
+	}
+
+	return bufferPath(requestSrcDirs(req), append([]string{"logs", "tail"}, strings.Split(location[1:], "/")...))
+}
+
+func logsSocket(ws *websocket.Conn) {
+	logsTask(ws)
+}
+
+// Sends the last lines of the file and, when following, those that are
+// appended to it. A file that is truncated or replaced, as happens with
+// log rotation, is followed from its start. The query parameters are
+// file or config, follow, lines, filter, highlight, json, where (a JSON
+// object of field patterns) and fields (comma separated).
+func logsTask(ws taskConn) {
+	defer ws.Close()
+
+	send := func(lines []LogLine) error {
+		if len(lines) == 0 {
+			return nil
+		}
+		b, err := json.Marshal(lines)
+		if err != nil {
+			return err
+		}
+		_, err = ws.Write(b)
+		return err
+	}
+	sendError := func(err error) {
+		send([]LogLine{{Error: err.Error()}})
+	}
+
+	query := ws.Request().URL.Query()
+	follow := query.Get("follow") != "false"
+	lineCount := defaultLogLines
+	if n, err := strconv.Atoi(query.Get("lines")); err == nil && n >= 0 {
+		lineCount = n
+	}
+
+	options := LogTailOptions{Filter: query.Get("filter"), Json: query.Get("json") == "true"}
+	if h := query.Get("highlight"); h != "" {
+		if err := json.Unmarshal([]byte(h), &options.Highlight); err != nil {
+			sendError(err)
+			return
+		}
+	}
+	if w := query.Get("where"); w != "" {
+		if err := json.Unmarshal([]byte(w), &options.Where); err != nil {
+			sendError(err)
+			return
+		}
+	}
+	if fields := query.Get("fields"); fields != "" {
+		options.Fields = strings.Split(fields, ",")
+	}
+	filter, err := newLogFilter(options)
+	if err != nil {
+		sendError(err)
+		return
+	}
+	filterMutex := sync.Mutex{}
+
+	p, err := logFile(ws.Request())
+	if err != nil {
+		sendError(err)
+		return
+	}
+
+	// New options from the browser apply to the lines that follow
+	closed := make(chan bool)
+	go func() {
+		defer close(closed)
+
+		buf := make([]byte, maxSseInput)
+		for {
+			n, err := ws.Read(buf)
+			if err != nil {
+				return
+			}
+
+			options := LogTailOptions{}
+			err = json.Unmarshal(buf[:n], &options)
+			if err != nil {
+				sendError(err)
+				continue
+			}
+
+			f, err := newLogFilter(options)
+			if err != nil {
+				sendError(err)
+				continue
+			}
+
+			filterMutex.Lock()
+			filter = f
+			filterMutex.Unlock()
+		}
+	}()
+
+	var file *os.File
+	var info os.FileInfo
+	offset := int64(0)
+	pending := ""
+	buf := make([]byte, maxLogChunk)
+	defer func() {
+		if file != nil {
+			file.Close()
+		}
+	}()
+
+	for first := true; ; first = false {
+		if !first {
+			select {
+			case <-closed:
+				return
+			case <-time.After(logPollInterval):
+			}
+		}
+
+		latest, err := os.Stat(p)
+		switch {
+		case err != nil && !follow:
+			sendError(err)
+			return
+		case err != nil:
+			// Not written yet or in the middle of a rotation
+			continue
+		case file == nil || !os.SameFile(info, latest) || latest.Size() < offset:
+			if file != nil {
+				file.Close()
+			}
+			file, err = os.Open(p)
+			if err != nil {
+				sendError(err)
+				return
+			}
+			info, offset, pending = latest, 0, ""
+
+			// Only the end of the file the first time around
+			if first && latest.Size() > maxLogChunk {
+				offset = latest.Size() - maxLogChunk
+			}
+		case latest.Size() == offset:
+			continue
+		}
+
+		_, err = file.Seek(offset, io.SeekStart)
+		if err != nil {
+			sendError(err)
+			return
+		}
+		n, err := io.ReadFull(file, buf)
+		if err != nil && err != io.EOF && err != io.ErrUnexpectedEOF {
+			sendError(err)
+			return
+		}
+		offset += int64(n)
+
+		data := string(buf[:n])
+		if first && offset > int64(n) {
+			// Starts in the middle of a line
+			if idx := strings.IndexByte(data, '\n'); idx != -1 {
+				data = data[idx+1:]
+			}
+		}
+
+		texts := strings.Split(pending+data, "\n")
+		pending = texts[len(texts)-1]
+		texts = texts[:len(texts)-1]
+
+		// Output without line breaks is sent in pieces, as is the last
+		//  line of a file that isn't followed
+		if len(pending) > maxLogChunk || !follow {
+			texts = append(texts, pending)
+			pending = ""
+		}
+
+		filterMutex.Lock()
+		lines := filter.lines(texts)
+		filterMutex.Unlock()
+
+		if first && len(lines) > lineCount {
+			lines = lines[len(lines)-lineCount:]
+		}
+
+		if err := send(lines); err != nil || !follow {
+			return
+		}
+	}
+}
+
+// GET /logs/stream?file=<location> tails the file for browsers that
+// can't use the /logs/tail WebSocket, new options are posted to
+// /logs/stream/<id>.
+func logsHandler(writer http.ResponseWriter, req *http.Request, path string, pathSegs []string) bool {
+	switch {
+	case req.Method == "GET" && len(pathSegs) == 2 && pathSegs[1] == "stream":
+		serveTaskStream(writer, req, logsTask)
+		return true
+	case req.Method == "POST" && len(pathSegs) == 3 && pathSegs[1] == "stream":
+		taskStreamInput(writer, req, pathSegs[2])
+		return true
+	}
+
+	return false
+}
@@ -0,0 +1,564 @@
+// Copyright 2014 Chris McGee <sirnewton_01@yahoo.ca>. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"errors"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"unicode/utf16"
+	"unicode/utf8"
+)
+
+// Error codes of JSON-RPC
+const (
+	lspParseError     = -32700
+	lspMethodNotFound = -32601
+	lspInvalidParams  = -32602
+	lspRequestFailed  = -32803
+)
+
+// Message from the editor of the Language Server Protocol, a request when
+// it has an id and a notification otherwise
+type lspMessage struct {
+	Id     *json.RawMessage `json:"id"`
+	Method string           `json:"method"`
+	Params json.RawMessage  `json:"params"`
+}
+
+// The result is null for requests that have none, the error replaces it
+type lspResponse struct {
+	Jsonrpc string           `json:"jsonrpc"`
+	Id      *json.RawMessage `json:"id"`
+	Result  interface{}      `json:"result"`
+}
+
+type lspErrorResponse struct {
+	Jsonrpc string           `json:"jsonrpc"`
+	Id      *json.RawMessage `json:"id"`
+	Error   *lspError        `json:"error"`
+}
+
+type lspError struct {
+	Code    int    `json:"code"`
+	Message string `json:"message"`
+}
+
+type lspPosition struct {
+	Line      int `json:"line"`
+	Character int `json:"character"`
+}
+
+type lspRange struct {
+	Start lspPosition `json:"start"`
+	End   lspPosition `json:"end"`
+}
+
+type lspLocation struct {
+	Uri   string   `json:"uri"`
+	Range lspRange `json:"range"`
+}
+
+type lspTextEdit struct {
+	Range   lspRange `json:"range"`
+	NewText string   `json:"newText"`
+}
+
+type lspTextDocumentParams struct {
+	TextDocument struct {
+		Uri  string `json:"uri"`
+		Text string `json:"text"`
+	} `json:"textDocument"`
+	Position       lspPosition `json:"position"`
+	ContentChanges []struct {
+		Text string `json:"text"`
+	} `json:"contentChanges"`
+}
+
+type lspCompletionItem struct {
+	Label               string        `json:"label"`
+	Kind                int           `json:"kind,omitempty"`
+	Detail              string        `json:"detail,omitempty"`
+	Documentation       string        `json:"documentation,omitempty"`
+	SortText            string        `json:"sortText,omitempty"`
+	TextEdit            *lspTextEdit  `json:"textEdit,omitempty"`
+	InsertTextFormat    int           `json:"insertTextFormat,omitempty"`
+	AdditionalTextEdits []lspTextEdit `json:"additionalTextEdits,omitempty"`
+}
+
+type lspDocumentSymbol struct {
+	Name           string   `json:"name"`
+	Kind           int      `json:"kind"`
+	Range          lspRange `json:"range"`
+	SelectionRange lspRange `json:"selectionRange"`
+}
+
+type lspCodeAction struct {
+	Title string `json:"title"`
+	Kind  string `json:"kind"`
+	Edit  struct {
+		Changes map[string][]lspTextEdit `json:"changes"`
+	} `json:"edit"`
+}
+
+var (
+	// CompletionItemKind of the LSP for the kinds of gocode
+	lspCompletionKinds = map[string]int{"func": 3, "var": 6, "const": 21, "type": 7, "package": 9}
+)
+
+// Connection of an editor. The editor owns the content of the documents
+// it has open, which is what the tools work on.
+type lspConn struct {
+	reader *bufio.Reader
+	writer io.Writer
+
+	writeMutex sync.Mutex
+	documents  map[string]string
+}
+
+// Serves the LSP over standard input and output for the godev -lsp mode
+func serveLspStdio() error {
+	return serveLsp(os.Stdin, os.Stdout)
+}
+
+// Serves the LSP to the editors that connect to the port. It has no login,
+// so it only listens on the loopback interface.
+func listenLsp(port string) {
+	listener, err := net.Listen("tcp", loopbackHost+":"+port)
+	if err != nil {
+		logger.Printf("Unable to listen for LSP connections: %v\n", err)
+		return
+	}
+
+	for {
+		conn, err := listener.Accept()
+		if err != nil {
+			logger.Printf("Unable to accept an LSP connection: %v\n", err)
+			return
+		}
+
+		go func() {
+			defer conn.Close()
+			err := serveLsp(conn, conn)
+			if err != nil {
+				logger.Printf("LSP connection ended: %v\n", err)
+			}
+		}()
+	}
+}
+
+func serveLsp(in io.Reader, out io.Writer) error {
+	c := &lspConn{reader: bufio.NewReader(in), writer: out, documents: make(map[string]string)}
+
+	for {
+		b, err := c.read()
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+
+		message := lspMessage{}
+		err = json.Unmarshal(b, &message)
+		if err != nil {
+			c.send(lspErrorResponse{"2.0", nil, &lspError{lspParseError, err.Error()}})
+			continue
+		}
+		if message.Method == "exit" {
+			return nil
+		}
+
+		result, lspErr := c.handle(message)
+		if message.Id == nil {
+			// Notifications have no response
+			continue
+		}
+		if lspErr != nil {
+			c.send(lspErrorResponse{"2.0", message.Id, lspErr})
+			continue
+		}
+		c.send(lspResponse{"2.0", message.Id, result})
+	}
+}
+
+// Reads the content of the next message after its headers
+func (c *lspConn) read() ([]byte, error) {
+	length := -1
+	for {
+		line, err := c.reader.ReadString('\n')
+		if err != nil {
+			return nil, err
+		}
+		line = strings.TrimSpace(line)
+		if line == "" {
+			break
+		}
+
+		if idx := strings.Index(line, ":"); idx != -1 && strings.EqualFold(line[:idx], "Content-Length") {
+			length, err = strconv.Atoi(strings.TrimSpace(line[idx+1:]))
+			if err != nil {
+				return nil, err
+			}
+		}
+	}
+	if length < 0 {
+		return nil, errors.New("Message without a Content-Length")
+	}
+
+	b := make([]byte, length)
+	_, err := io.ReadFull(c.reader, b)
+	return b, err
+}
+
+func (c *lspConn) send(response interface{}) {
+	b, err := json.Marshal(response)
+	if err != nil {
+		logger.Printf("Unable to encode an LSP response: %v\n", err)
+		return
+	}
+
+	c.writeMutex.Lock()
+	defer c.writeMutex.Unlock()
+
+	c.writer.Write([]byte("Content-Length: " + strconv.Itoa(len(b)) + "\r\n\r\n"))
+	c.writer.Write(b)
+}
+
+func (c *lspConn) handle(message lspMessage) (interface{}, *lspError) {
+	params := lspTextDocumentParams{}
+	if len(message.Params) > 0 {
+		err := json.Unmarshal(message.Params, &params)
+		if err != nil {
+			return nil, &lspError{lspInvalidParams, err.Error()}
+		}
+	}
+	uri := params.TextDocument.Uri
+
+	switch message.Method {
+	case "initialize":
+		return map[string]interface{}{
+			"capabilities": map[string]interface{}{
+				// The whole document is sent with each change
+				"textDocumentSync":           1,
+				"completionProvider":         map[string]interface{}{"triggerCharacters": []string{"."}},
+				"definitionProvider":         true,
+				"documentFormattingProvider": true,
+				"documentSymbolProvider":     true,
+				"codeActionProvider":         map[string]interface{}{"codeActionKinds": []string{"source.organizeImports"}},
+			},
+			"serverInfo": map[string]interface{}{"name": "godev"},
+		}, nil
+	case "initialized", "shutdown", "$/cancelRequest", "$/setTrace", "textDocument/didSave":
+		return nil, nil
+	case "textDocument/didOpen":
+		c.documents[uri] = params.TextDocument.Text
+		return nil, nil
+	case "textDocument/didChange":
+		if len(params.ContentChanges) > 0 {
+			c.documents[uri] = params.ContentChanges[len(params.ContentChanges)-1].Text
+		}
+		return nil, nil
+	case "textDocument/didClose":
+		delete(c.documents, uri)
+		return nil, nil
+	case "textDocument/completion":
+		return c.completion(uri, params.Position)
+	case "textDocument/definition":
+		return c.definition(uri, params.Position)
+	case "textDocument/formatting":
+		edits, err := c.replaceDocument(uri, formatHandler, "/go/fmt")
+		return edits, err
+	case "textDocument/codeAction":
+		edits, err := c.replaceDocument(uri, importsHandler, "/go/imports")
+		if err != nil || len(edits) == 0 {
+			return []lspCodeAction{}, err
+		}
+
+		action := lspCodeAction{Title: "Organize imports", Kind: "source.organizeImports"}
+		action.Edit.Changes = map[string][]lspTextEdit{uri: edits}
+		return []lspCodeAction{action}, nil
+	case "textDocument/documentSymbol":
+		return c.documentSymbols(uri)
+	}
+
+	return nil, &lspError{lspMethodNotFound, "Unsupported method: " + message.Method}
+}
+
+// Runs a handler of the web services on a request made up for the editor
+func callLspHandler(handler delegateFunc, target string, body string) (int, []byte) {
+	req, err := http.NewRequest("POST", target, strings.NewReader(body))
+	if err != nil {
+		return 400, []byte(err.Error())
+	}
+
+	w := &lspResponseWriter{header: make(http.Header), code: 200}
+	if !handler(w, req, req.URL.Path, strings.Split(req.URL.Path, "/")[1:]) {
+		return 404, nil
+	}
+
+	return w.code, w.body.Bytes()
+}
+
+// Keeps the response of a handler for the LSP
+type lspResponseWriter struct {
+	header http.Header
+	code   int
+	body   bytes.Buffer
+}
+
+func (w *lspResponseWriter) Header() http.Header {
+	return w.header
+}
+
+func (w *lspResponseWriter) WriteHeader(code int) {
+	w.code = code
+}
+
+func (w *lspResponseWriter) Write(b []byte) (int, error) {
+	return w.body.Write(b)
+}
+
+// The message of an Orion status in the response of a handler
+func lspHandlerError(code int, body []byte) *lspError {
+	status := Status{}
+	if json.Unmarshal(body, &status) == nil && status.Message != "" {
+		return &lspError{lspRequestFailed, status.Message}
+	}
+
+	return &lspError{lspRequestFailed, "Request failed with status " + strconv.Itoa(code)}
+}
+
+func (c *lspConn) document(uri string) (string, string, *lspError) {
+	text, ok := c.documents[uri]
+	if !ok {
+		return "", "", &lspError{lspInvalidParams, "The document is not open: " + uri}
+	}
+
+	u, err := url.Parse(uri)
+	if err != nil || u.Scheme != "file" {
+		return "", "", &lspError{lspInvalidParams, "Not a file: " + uri}
+	}
+	p := u.Path
+	// file:///C:/x on Windows
+	if len(p) > 2 && p[0] == '/' && p[2] == ':' {
+		p = p[1:]
+	}
+	location := workspaceLocation(filepath.FromSlash(p))
+	if location == "" {
+		return "", "", &lspError{lspInvalidParams, "The file is outside of the GOPATH: " + uri}
+	}
+
+	return text, location, nil
+}
+
+func (c *lspConn) completion(uri string, position lspPosition) (interface{}, *lspError) {
+	text, location, lspErr := c.document(uri)
+	if lspErr != nil {
+		return nil, lspErr
+	}
+
+	offset := lspOffset(text, position)
+	code, body := callLspHandler(completionHandler,
+		"/completion?ranked=true&path="+url.QueryEscape(location)+"&offset="+strconv.Itoa(offset), text)
+	if code != 200 {
+		return nil, lspHandlerError(code, body)
+	}
+
+	result := CompletionResult{}
+	err := json.Unmarshal(body, &result)
+	if err != nil {
+		return nil, &lspError{lspRequestFailed, err.Error()}
+	}
+
+	// The completions replace the prefix that was typed
+	replace := lspRange{lspPositionOf(text, offset-len(result.Prefix)), position}
+
+	items := []lspCompletionItem{}
+	for idx, completion := range result.Completions {
+		item := lspCompletionItem{
+			Label:         completion.Name,
+			Kind:          lspCompletionKinds[completion.Kind],
+			Detail:        completion.Detail,
+			Documentation: completion.Documentation,
+			// The completions are already in the order of their ranking
+			SortText: strconv.Itoa(100000 + idx),
+			TextEdit: &lspTextEdit{replace, completion.InsertText},
+		}
+		if completion.Snippet != "" {
+			item.TextEdit.NewText = completion.Snippet
+			item.InsertTextFormat = 2
+		}
+		for _, edit := range completion.AdditionalEdits {
+			item.AdditionalTextEdits = append(item.AdditionalTextEdits,
+				lspTextEdit{lspRange{lspPositionOf(text, edit.Offset), lspPositionOf(text, edit.Offset+edit.Length)}, edit.Text})
+		}
+		items = append(items, item)
+	}
+
+	return items, nil
+}
+
+func (c *lspConn) definition(uri string, position lspPosition) (interface{}, *lspError) {
+	text, location, lspErr := c.document(uri)
+	if lspErr != nil {
+		return nil, lspErr
+	}
+
+	code, body := callLspHandler(definitionHandler, "/go/defs"+location+"?o="+strconv.Itoa(lspOffset(text, position)), text)
+	if code == 204 {
+		return nil, nil
+	}
+	if code != 200 {
+		return nil, lspHandlerError(code, body)
+	}
+
+	definition := Definition{}
+	err := json.Unmarshal(body, &definition)
+	if err != nil {
+		return nil, &lspError{lspRequestFailed, err.Error()}
+	}
+
+	file := ""
+	if strings.HasPrefix(definition.Location, "/file/GOROOT/") {
+		file = filepath.Join(goroot, "src", "pkg", filepath.FromSlash(definition.Location[len("/file/GOROOT/"):]))
+	} else if strings.HasPrefix(definition.Location, "/file/") {
+		file, err = bufferPath(srcDirs, append([]string{"go", "defs"}, strings.Split(definition.Location[1:], "/")...))
+		if err != nil {
+			return nil, &lspError{lspRequestFailed, err.Error()}
+		}
+	} else {
+		return nil, nil
+	}
+
+	// Godef counts from 1, the LSP from 0
+	line, _ := strconv.Atoi(definition.Line)
+	column, _ := strconv.Atoi(definition.Column)
+	if line > 0 {
+		line--
+	}
+	if column > 0 {
+		column--
+	}
+	start := lspPosition{line, column}
+
+	return lspLocation{(&url.URL{Scheme: "file", Path: filepath.ToSlash(file)}).String(), lspRange{start, start}}, nil
+}
+
+// Edits that replace the document with the output of a tool that rewrites
+// it, such as gofmt
+func (c *lspConn) replaceDocument(uri string, handler delegateFunc, target string) ([]lspTextEdit, *lspError) {
+	text, _, lspErr := c.document(uri)
+	if lspErr != nil {
+		return nil, lspErr
+	}
+
+	code, body := callLspHandler(handler, target, text)
+	if code == 204 {
+		// The tool could not make sense of the document
+		return []lspTextEdit{}, nil
+	}
+	if code != 200 {
+		return nil, lspHandlerError(code, body)
+	}
+	if string(body) == text {
+		return []lspTextEdit{}, nil
+	}
+
+	return []lspTextEdit{{lspRange{lspPosition{0, 0}, lspPositionOf(text, len(text))}, string(body)}}, nil
+}
+
+func (c *lspConn) documentSymbols(uri string) (interface{}, *lspError) {
+	text, _, lspErr := c.document(uri)
+	if lspErr != nil {
+		return nil, lspErr
+	}
+
+	code, body := callLspHandler(outlineHandler, "/go/outline", text)
+	if code != 200 {
+		return nil, lspHandlerError(code, body)
+	}
+
+	entries := []Entry{}
+	err := json.Unmarshal(body, &entries)
+	if err != nil {
+		return nil, &lspError{lspRequestFailed, err.Error()}
+	}
+
+	lines := strings.Split(text, "\n")
+	symbols := []lspDocumentSymbol{}
+	for _, entry := range entries {
+		line, _ := strconv.Atoi(entry.Line)
+		if line < 1 || line > len(lines) {
+			continue
+		}
+
+		// SymbolKind of the LSP
+		kind := 12
+		switch {
+		case strings.HasPrefix(entry.Label, "type "):
+			kind = 23
+		case entry.Label == "IMPORT":
+			kind = 2
+		case entry.Label == "CONST":
+			kind = 14
+		}
+
+		r := lspRange{lspPosition{line - 1, 0}, lspPosition{line - 1, len(utf16.Encode([]rune(lines[line-1])))}}
+		symbols = append(symbols, lspDocumentSymbol{entry.Label, kind, r, r})
+	}
+
+	return symbols, nil
+}
+
+// Byte offset in the text of a position, the characters of which are
+// counted in UTF-16 code units
+func lspOffset(text string, position lspPosition) int {
+	offset := 0
+	for line := 0; line < position.Line; line++ {
+		idx := strings.Index(text[offset:], "\n")
+		if idx == -1 {
+			return len(text)
+		}
+		offset += idx + 1
+	}
+
+	for units := 0; units < position.Character && offset < len(text); {
+		r, size := utf8.DecodeRuneInString(text[offset:])
+		if r == '\n' {
+			break
+		}
+		units += len(utf16.Encode([]rune{r}))
+		offset += size
+	}
+
+	return offset
+}
+
+func lspPositionOf(text string, offset int) lspPosition {
+	if offset > len(text) {
+		offset = len(text)
+	}
+	if offset < 0 {
+		offset = 0
+	}
+
+	position := lspPosition{}
+	lineStart := strings.LastIndex(text[:offset], "\n") + 1
+	position.Line = strings.Count(text[:lineStart], "\n")
+	position.Character = len(utf16.Encode([]rune(text[lineStart:offset])))
+
+	return position
+}
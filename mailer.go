@@ -0,0 +1,229 @@
+// Copyright 2014 Chris McGee <sirnewton_01@yahoo.ca>. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"net"
+	"net/smtp"
+	"os"
+	"os/exec"
+	"strings"
+	"sync"
+	"text/template"
+	"time"
+)
+
+type MailMessage struct {
+	To      string
+	Subject string
+	Body    string
+}
+
+func (m *MailMessage) bytes(from string) []byte {
+	buf := &bytes.Buffer{}
+	fmt.Fprintf(buf, "From: %v\r\n", from)
+	fmt.Fprintf(buf, "To: %v\r\n", m.To)
+	fmt.Fprintf(buf, "Subject: %v\r\n", m.Subject)
+	fmt.Fprintf(buf, "Date: %v\r\n", time.Now().Format(time.RFC1123Z))
+	buf.WriteString("Content-Type: text/plain; charset=utf-8\r\n\r\n")
+	buf.WriteString(strings.Replace(m.Body, "\n", "\r\n", -1))
+	return buf.Bytes()
+}
+
+// Delivers mail on behalf of godev. Other ways of sending mail (e.g. the API
+// of a mail provider) can be plugged in with registerMailer.
+type Mailer interface {
+	Send(msg *MailMessage) error
+}
+
+var (
+	mailersMutex sync.Mutex
+	mailers      = map[string]func() (Mailer, error){
+		"smtp":     newSmtpMailer,
+		"sendmail": newSendmailMailer,
+		"dryrun":   newDryRunMailer,
+	}
+)
+
+func registerMailer(name string, factory func() (Mailer, error)) {
+	mailersMutex.Lock()
+	mailers[name] = factory
+	mailersMutex.Unlock()
+}
+
+type smtpMailer struct {
+	server string
+	auth   smtp.Auth
+}
+
+func newSmtpMailer() (Mailer, error) {
+	if *smtpServer == "" {
+		return nil, errors.New("The smtp mailer needs a server, provide one with the smtpServer flag")
+	}
+
+	mailer := &smtpMailer{server: *smtpServer}
+
+	// The password is taken from the environment to keep it out of the
+	//  process list.
+	if *smtpUser != "" {
+		host, _, err := net.SplitHostPort(*smtpServer)
+		if err != nil {
+			return nil, err
+		}
+		mailer.auth = smtp.PlainAuth("", *smtpUser, os.Getenv("GODEV_SMTP_PASSWORD"), host)
+	}
+
+	return mailer, nil
+}
+
+func (m *smtpMailer) Send(msg *MailMessage) error {
+	return smtp.SendMail(m.server, m.auth, *mailFrom, []string{msg.To}, msg.bytes(*mailFrom))
+}
+
+type sendmailMailer struct{}
+
+func newSendmailMailer() (Mailer, error) {
+	_, err := exec.LookPath("sendmail")
+	if err != nil {
+		return nil, err
+	}
+
+	return &sendmailMailer{}, nil
+}
+
+func (m *sendmailMailer) Send(msg *MailMessage) error {
+	cmd := exec.Command("sendmail", "-t", "-i")
+	cmd.Stdin = bytes.NewReader(msg.bytes(*mailFrom))
+
+	output, err := cmd.CombinedOutput()
+	if err != nil {
+		return fmt.Errorf("%v: %v", err, string(output))
+	}
+
+	return nil
+}
+
+// Logs the messages instead of sending them
+type dryRunMailer struct{}
+
+func newDryRunMailer() (Mailer, error) {
+	return &dryRunMailer{}, nil
+}
+
+func (m *dryRunMailer) Send(msg *MailMessage) error {
+	logger.Printf("MAIL (dry run) to %v: %v\n%v\n", msg.To, msg.Subject, msg.Body)
+	return nil
+}
+
+type mailTemplate struct {
+	subject string
+	body    *template.Template
+}
+
+var mailTemplates = map[string]mailTemplate{
+	"login": {"Access to godev on {{.Host}}", template.Must(template.New("login").Parse(
+		`godev is running on {{.Host}}. Open the following link to log in:
+
+{{.Url}}
+
+Keep this link private, anyone with it has access to your workspace.
+`))},
+	"rotation": {"godev access keys rotated on {{.Host}}", template.Must(template.New("rotation").Parse(
+		`The access keys of godev on {{.Host}} were rotated at {{.Time}}. Browsers and devices
+using the previous keys have been logged out. Log in again with the following link:
+
+{{.Url}}
+
+If you didn't rotate the keys then someone else has access to your workspace.
+`))},
+	"alert": {"godev security alert on {{.Host}}", template.Must(template.New("alert").Parse(
+		`{{.Message}}
+
+Time: {{.Time}}
+Address: {{.Address}}
+`))},
+}
+
+type MailData struct {
+	Host    string
+	Time    string
+	Url     string
+	Message string
+	Address string
+}
+
+var (
+	mailerOnce      sync.Once
+	activeMailer    Mailer
+	activeMailerErr error
+)
+
+func currentMailer() (Mailer, error) {
+	mailerOnce.Do(func() {
+		mailersMutex.Lock()
+		factory := mailers[*mailerKind]
+		mailersMutex.Unlock()
+
+		if factory == nil {
+			activeMailerErr = errors.New("Unknown mailer " + *mailerKind)
+			return
+		}
+
+		activeMailer, activeMailerErr = factory()
+	})
+
+	return activeMailer, activeMailerErr
+}
+
+// Sends one of the templated messages to the remote account. Nothing is
+// sent unless a mailer is configured.
+func sendMail(templateName string, data MailData) error {
+	if *mailerKind == "" || *remoteAccount == "" {
+		return nil
+	}
+
+	mailer, err := currentMailer()
+	if err != nil {
+		return err
+	}
+
+	tmpl, ok := mailTemplates[templateName]
+	if !ok {
+		return errors.New("Unknown mail template " + templateName)
+	}
+
+	data.Host = hostName
+	if data.Time == "" {
+		data.Time = time.Now().Format(time.RFC1123)
+	}
+
+	subject := &bytes.Buffer{}
+	err = template.Must(template.New("subject").Parse(tmpl.subject)).Execute(subject, data)
+	if err != nil {
+		return err
+	}
+
+	body := &bytes.Buffer{}
+	err = tmpl.body.Execute(body, data)
+	if err != nil {
+		return err
+	}
+
+	return mailer.Send(&MailMessage{To: *remoteAccount, Subject: subject.String(), Body: body.String()})
+}
+
+// Mail goes out in the background so that a slow mail server never holds up
+// the request that triggered it.
+func sendMailAsync(templateName string, data MailData) {
+	go func() {
+		err := sendMail(templateName, data)
+		if err != nil {
+			logger.Printf("Unable to send %v mail: %v\n", templateName, err)
+		}
+	}()
+}
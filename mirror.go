@@ -0,0 +1,149 @@
+// Copyright 2014 Chris McGee <sirnewton_01@yahoo.ca>. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"io/ioutil"
+	"net/http"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+)
+
+type MirrorStatus struct {
+	Target    string
+	LastRun   int64
+	LastError string `json:",omitempty"`
+	Updated   int
+	Deleted   int
+}
+
+var (
+	mirrorMutex  sync.Mutex
+	mirrorStatus = MirrorStatus{}
+)
+
+// Services that change the workspace or run code. A read-only mirror
+// serves everything else so that it can still be browsed and reviewed.
+var mutatingServices = map[string]bool{
+	"file":      true,
+	"workspace": true,
+	"xfer":      true,
+	"claims":    true,
+	"drafts":    true,
+	"admin":     true,
+	"gitapi":    true,
+	"bundles":   true,
+	"secrets":   true,
+}
+
+var executingServices = map[string]bool{
+	"debug":   true,
+	"test":    true,
+	"docker":  true,
+	"repl":    true,
+	"scratch": true,
+	"shell":   true,
+	// Send requests from the server
+	"httpclient": true,
+	"forward":    true,
+	"db":         true,
+}
+
+func readOnlyDenied(req *http.Request, pathSegs []string) bool {
+	if !*readOnly {
+		return false
+	}
+
+	service := pathSegs[0]
+
+	switch {
+	case service == "xfer" && len(pathSegs) > 1 && pathSegs[1] == "sync":
+		// Replication from the primary
+		return false
+	case executingServices[service]:
+		return true
+	case service == "go" && len(pathSegs) > 1 && pathSegs[1] == "rename":
+		// Writes the files of the workspace unless it is a dry run
+		return req.URL.Query().Get("dryRun") != "true"
+	case service == "go" && len(pathSegs) > 1 && pathSegs[1] == "fmt":
+		// Formats the files of the package in place
+		return req.URL.Query().Get("pkg") != ""
+	case service == "go" && len(pathSegs) > 1 && (pathSegs[1] == "build" || pathSegs[1] == "bundle-cgi" || pathSegs[1] == "test" || (pathSegs[1] == "coverage" && req.Method == "POST")):
+		return true
+	case mutatingServices[service]:
+		return req.Method != "GET" && req.Method != "HEAD"
+	}
+
+	return false
+}
+
+// Pushes each top-level folder of the GOPATH source directories, including
+// their version control metadata, to the standby instance.
+func mirrorWorkspace(target string) (SyncResult, error) {
+	result := SyncResult{}
+
+	for _, srcDir := range srcDirs {
+		infos, err := ioutil.ReadDir(srcDir)
+		if err != nil {
+			continue
+		}
+
+		for _, info := range infos {
+			if !info.IsDir() {
+				continue
+			}
+
+			client, err := newSyncClient(strings.TrimRight(target, "/") + "/" + info.Name())
+			if err != nil {
+				return result, err
+			}
+
+			r, err := client.push(filepath.Join(srcDir, info.Name()), true)
+			result.Updated += r.Updated
+			result.Deleted += r.Deleted
+			if err != nil {
+				return result, err
+			}
+		}
+	}
+
+	return result, nil
+}
+
+func startMirror(target string, interval time.Duration) {
+	if target == "" || interval <= 0 {
+		return
+	}
+
+	mirrorStatus.Target = target
+
+	go func() {
+		for {
+			result, err := mirrorWorkspace(target)
+
+			mirrorMutex.Lock()
+			mirrorStatus.LastRun = time.Now().Unix() * 1000
+			mirrorStatus.Updated = result.Updated
+			mirrorStatus.Deleted = result.Deleted
+			mirrorStatus.LastError = ""
+			if err != nil {
+				mirrorStatus.LastError = err.Error()
+				logger.Printf("Unable to mirror the workspace to %v: %v\n", target, err)
+			}
+			mirrorMutex.Unlock()
+
+			<-time.After(interval)
+		}
+	}()
+}
+
+func currentMirrorStatus() MirrorStatus {
+	mirrorMutex.Lock()
+	defer mirrorMutex.Unlock()
+
+	return mirrorStatus
+}
@@ -0,0 +1,69 @@
+// Copyright 2014 Chris McGee <sirnewton_01@yahoo.ca>. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"strings"
+)
+
+// Writes a large result as newline delimited JSON, one object per line,
+// so that the client can render it as it arrives. The client aborts by
+// closing the connection, which cancels the context of the request.
+type JsonStream struct {
+	writer  http.ResponseWriter
+	encoder *json.Encoder
+	ctx     context.Context
+	err     error
+}
+
+// Whether the client asked for the result as a stream instead of a single
+// JSON object.
+func wantsJsonStream(req *http.Request) bool {
+	return strings.Contains(req.Header.Get("Accept"), "application/x-ndjson")
+}
+
+func NewJsonStream(writer http.ResponseWriter, req *http.Request) *JsonStream {
+	writer.Header().Set("Content-Type", "application/x-ndjson")
+	writer.Header().Set("Cache-Control", "no-cache")
+	writer.WriteHeader(200)
+
+	return &JsonStream{writer: writer, encoder: json.NewEncoder(writer), ctx: req.Context()}
+}
+
+func (s *JsonStream) Send(obj interface{}) error {
+	if s.err != nil {
+		return s.err
+	}
+
+	if err := s.ctx.Err(); err != nil {
+		s.err = err
+		return err
+	}
+
+	s.err = s.encoder.Encode(obj)
+	if s.err != nil {
+		return s.err
+	}
+
+	if flusher, ok := s.writer.(http.Flusher); ok {
+		flusher.Flush()
+	}
+
+	return nil
+}
+
+// The status code has already gone out so errors that happen part way are
+// sent as an Orion status on the last line.
+func (s *JsonStream) Fail(httpCode uint, message string, err error) {
+	errStr := ""
+	if err != nil {
+		errStr = err.Error()
+	}
+
+	s.Send(Status{SEV_ERR, httpCode, message, errStr})
+}
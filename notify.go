@@ -0,0 +1,128 @@
+// Copyright 2014 Chris McGee <sirnewton_01@yahoo.ca>. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"flag"
+	"net/http"
+	"os/exec"
+	"runtime"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	readyTimeout  = 30 * time.Second
+	notifyTimeout = 10 * time.Second
+)
+
+var (
+	openBrowser   = flag.Bool("open", false, "Open the default browser at godev once it is ready.")
+	notifyCommand = flag.String("notifyCommand", "", "Desktop notification command for builds and test runs that took longer than notifyAfter, e.g. 'notify-send'. {{title}} and {{message}} in it are replaced, otherwise they are added as arguments. (empty disables)")
+	notifyAfter   = flag.Duration("notifyAfter", 20*time.Second, "How long a build or test run has to take to be worth a desktop notification.")
+
+	readyMutex  sync.Mutex
+	serverReady = false
+)
+
+func setServerReady() {
+	readyMutex.Lock()
+	defer readyMutex.Unlock()
+
+	serverReady = true
+}
+
+// GET /readyz answers 200 once the server is serving, it needs no login so
+// that scripts and process managers can wait for it
+func readyHandler(w http.ResponseWriter, r *http.Request) {
+	readyMutex.Lock()
+	ready := serverReady
+	readyMutex.Unlock()
+
+	if !ready {
+		http.Error(w, "starting", 503)
+		return
+	}
+	if isShuttingDown() {
+		http.Error(w, "stopping", 503)
+		return
+	}
+
+	w.Write([]byte("ok"))
+}
+
+// Waits for /readyz of this server and then opens the url in the default
+// browser
+func openBrowserWhenReady(serverUrl string, url string) {
+	// It is our own server, whatever its certificate is
+	client := &http.Client{Timeout: 2 * time.Second,
+		Transport: &http.Transport{TLSClientConfig: &tls.Config{InsecureSkipVerify: true}}}
+
+	deadline := time.Now().Add(readyTimeout)
+	for {
+		resp, err := client.Get(serverUrl + "/readyz")
+		if err == nil {
+			resp.Body.Close()
+			if resp.StatusCode == 200 {
+				break
+			}
+		}
+
+		if time.Now().After(deadline) {
+			logger.Printf("The server isn't ready, not opening the browser\n")
+			return
+		}
+		time.Sleep(200 * time.Millisecond)
+	}
+
+	var cmd *exec.Cmd
+	switch runtime.GOOS {
+	case "darwin":
+		cmd = exec.Command("open", url)
+	case "windows":
+		cmd = exec.Command("rundll32", "url.dll,FileProtocolHandler", url)
+	default:
+		cmd = exec.Command("xdg-open", url)
+	}
+
+	err := cmd.Start()
+	if err != nil {
+		logger.Printf("Unable to open the browser: %v\n", err)
+		return
+	}
+	go cmd.Wait()
+}
+
+// Runs the notification command for a task that took long enough for the
+// user to have gone elsewhere
+func notifyFinished(title string, message string, elapsed time.Duration) {
+	command := *notifyCommand
+	if command == "" || elapsed < *notifyAfter {
+		return
+	}
+
+	args := strings.Fields(command)
+	if strings.Contains(command, "{{title}}") || strings.Contains(command, "{{message}}") {
+		replacer := strings.NewReplacer("{{title}}", title, "{{message}}", message)
+		for i, arg := range args {
+			args[i] = replacer.Replace(arg)
+		}
+	} else {
+		args = append(args, title, message)
+	}
+
+	go func() {
+		ctx, cancel := context.WithTimeout(context.Background(), notifyTimeout)
+		defer cancel()
+
+		output, err := exec.CommandContext(ctx, args[0], args[1:]...).CombinedOutput()
+		if err != nil {
+			logger.Printf("The notification command failed: %v %v\n", err, string(output))
+		}
+	}()
+}
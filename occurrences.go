@@ -0,0 +1,142 @@
+// Copyright 2014 Chris McGee <sirnewton_01@yahoo.ca>. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"go/ast"
+	"go/token"
+	"go/types"
+	"io/ioutil"
+	"net/http"
+	"strconv"
+)
+
+type Occurrence struct {
+	Offset int
+	Length int
+	// definition, write or read
+	Kind string
+}
+
+func occurrencesHandler(writer http.ResponseWriter, req *http.Request, path string, pathSegs []string) bool {
+	switch {
+	case req.Method == "POST" && len(pathSegs) > 3:
+		filePath, err := bufferPath(requestSrcDirs(req), pathSegs)
+		if err != nil {
+			ShowError(writer, 400, "Invalid resource", err)
+			return true
+		}
+
+		buffer, err := ioutil.ReadAll(req.Body)
+		if err != nil {
+			ShowError(writer, 500, "Error reading the buffer", err)
+			return true
+		}
+
+		offset, err := strconv.Atoi(req.URL.Query().Get("offset"))
+		if err != nil || offset < 0 || offset > len(buffer) {
+			ShowError(writer, 400, "Invalid offset", err)
+			return true
+		}
+
+		checked, err := typeCheckBuffer(buffer, filePath)
+		if err != nil {
+			ShowError(writer, 400, "Error parsing go source", err)
+			return true
+		}
+
+		ShowJson(writer, 200, occurrences(checked, offset))
+		return true
+	}
+
+	return false
+}
+
+// All of the uses of the object named by the identifier at the offset
+func occurrences(checked *checkedBuffer, offset int) []Occurrence {
+	result := []Occurrence{}
+	info := checked.info
+
+	var target types.Object
+	ast.Inspect(checked.file, func(n ast.Node) bool {
+		if n == nil || target != nil || offset < checked.offset(n.Pos()) || offset > checked.offset(n.End()) {
+			return false
+		}
+		if ident, ok := n.(*ast.Ident); ok {
+			target = info.Defs[ident]
+			if target == nil {
+				target = info.Uses[ident]
+			}
+		}
+		return true
+	})
+	if target == nil {
+		return result
+	}
+
+	// Identifiers that are assigned to rather than read
+	writes := make(map[*ast.Ident]bool)
+	markWrite := func(expr ast.Expr) {
+		for {
+			switch x := expr.(type) {
+			case *ast.Ident:
+				writes[x] = true
+				return
+			case *ast.SelectorExpr:
+				writes[x.Sel] = true
+				return
+			case *ast.IndexExpr:
+				expr = x.X
+			case *ast.ParenExpr:
+				expr = x.X
+			default:
+				return
+			}
+		}
+	}
+
+	ast.Inspect(checked.file, func(n ast.Node) bool {
+		switch x := n.(type) {
+		case *ast.AssignStmt:
+			for _, lhs := range x.Lhs {
+				markWrite(lhs)
+			}
+		case *ast.IncDecStmt:
+			markWrite(x.X)
+		case *ast.RangeStmt:
+			if x.Tok == token.ASSIGN {
+				markWrite(x.Key)
+				if x.Value != nil {
+					markWrite(x.Value)
+				}
+			}
+		}
+		return true
+	})
+
+	ast.Inspect(checked.file, func(n ast.Node) bool {
+		ident, ok := n.(*ast.Ident)
+		if !ok {
+			return true
+		}
+
+		kind := ""
+		switch {
+		case info.Defs[ident] == target:
+			kind = "definition"
+		case info.Uses[ident] == target && writes[ident]:
+			kind = "write"
+		case info.Uses[ident] == target:
+			kind = "read"
+		default:
+			return true
+		}
+
+		result = append(result, Occurrence{checked.offset(ident.Pos()), len(ident.Name), kind})
+		return true
+	})
+
+	return result
+}
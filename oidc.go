@@ -0,0 +1,481 @@
+// Copyright 2014 Chris McGee <sirnewton_01@yahoo.ca>. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	// How long the user has to log in at the provider
+	loginStateExpiration = 10 * time.Minute
+)
+
+// Identity provider that users of a remote godev can log in with, instead
+// of a magic key. The email address that the provider vouches for has to
+// be the remoteAccount or one of the AllowedEmails of the configuration.
+type LoginProvider struct {
+	// Name in the login URLs, /login/oidc/<name>
+	Name  string
+	Title string `json:",omitempty"`
+	// "oidc" (the default) for OpenID Connect providers such as Google or a
+	//  corporate one, which are found with the discovery document of the
+	//  Issuer, or "github" for the OAuth2 of GitHub
+	Kind         string `json:",omitempty"`
+	Issuer       string `json:",omitempty"`
+	ClientId     string
+	ClientSecret string
+	Scopes       []string `json:",omitempty"`
+}
+
+// The part of the login providers that the login page gets to see
+type LoginProviderInfo struct {
+	Name  string
+	Title string
+	Url   string
+}
+
+type LoginOptions struct {
+	ForceEmail  bool
+	CanAddUsers bool
+	Providers   []LoginProviderInfo `json:",omitempty"`
+}
+
+type oidcDiscovery struct {
+	Issuer                string `json:"issuer"`
+	AuthorizationEndpoint string `json:"authorization_endpoint"`
+	TokenEndpoint         string `json:"token_endpoint"`
+}
+
+type oidcTokenResponse struct {
+	AccessToken string `json:"access_token"`
+	IdToken     string `json:"id_token"`
+	Error       string `json:"error"`
+	Description string `json:"error_description"`
+}
+
+type oidcClaims struct {
+	Issuer   string      `json:"iss"`
+	Audience interface{} `json:"aud"`
+	Expires  int64       `json:"exp"`
+	Nonce    string      `json:"nonce"`
+	Email    string      `json:"email"`
+	// A boolean, or a string with some providers
+	EmailVerified interface{} `json:"email_verified"`
+}
+
+// Login that was sent to a provider and hasn't come back yet
+type loginState struct {
+	provider string
+	nonce    string
+	expires  time.Time
+}
+
+var (
+	loginStatesMutex sync.Mutex
+	loginStates      = make(map[string]loginState)
+
+	discoveryMutex sync.Mutex
+	discoveries    = make(map[string]oidcDiscovery)
+
+	loginClient = &http.Client{Timeout: 30 * time.Second}
+)
+
+func configuredLoginProvider(name string) *LoginProvider {
+	for _, provider := range currentServerConfig().LoginProviders {
+		if provider.Name == name {
+			return &provider
+		}
+	}
+
+	return nil
+}
+
+func loginProviderInfos() []LoginProviderInfo {
+	infos := []LoginProviderInfo{}
+	for _, provider := range currentServerConfig().LoginProviders {
+		title := provider.Title
+		if title == "" {
+			title = provider.Name
+		}
+		infos = append(infos, LoginProviderInfo{Name: provider.Name, Title: title, Url: "/login/oidc/" + provider.Name})
+	}
+
+	return infos
+}
+
+func validateLoginProvider(provider LoginProvider) error {
+	if !validAccountName.MatchString(provider.Name) {
+		return errors.New("Invalid login provider name: " + provider.Name)
+	}
+	if provider.ClientId == "" || provider.ClientSecret == "" {
+		return errors.New("The login provider " + provider.Name + " needs a ClientId and ClientSecret")
+	}
+
+	switch provider.Kind {
+	case "", "oidc":
+		if !strings.HasPrefix(provider.Issuer, "https://") {
+			return errors.New("The login provider " + provider.Name + " needs an https Issuer")
+		}
+	case "github":
+	default:
+		return errors.New("Unknown kind of login provider: " + provider.Kind)
+	}
+
+	return nil
+}
+
+// Whether someone with the email address may log in
+func loginEmailAllowed(email string) bool {
+	if email == "" {
+		return false
+	}
+	if *remoteAccount != "" && strings.EqualFold(email, *remoteAccount) {
+		return true
+	}
+
+	for _, allowed := range currentServerConfig().AllowedEmails {
+		// @example.com allows everyone of the domain
+		if strings.HasPrefix(allowed, "@") && strings.HasSuffix(strings.ToLower(email), strings.ToLower(allowed)) {
+			return true
+		}
+		if strings.EqualFold(email, allowed) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// The callback as the browser reaches it, which is the proxy's URL behind one
+func loginRedirectUri(r *http.Request, provider *LoginProvider) string {
+	return externalUrl(r, "/login/oidc/"+provider.Name+"/callback")
+}
+
+func discoverProvider(issuer string) (oidcDiscovery, error) {
+	discoveryMutex.Lock()
+	defer discoveryMutex.Unlock()
+
+	if discovery, ok := discoveries[issuer]; ok {
+		return discovery, nil
+	}
+
+	discovery := oidcDiscovery{}
+	resp, err := loginClient.Get(strings.TrimSuffix(issuer, "/") + "/.well-known/openid-configuration")
+	if err != nil {
+		return discovery, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != 200 {
+		return discovery, errors.New("The discovery document of " + issuer + " is not available: " + resp.Status)
+	}
+	err = json.NewDecoder(resp.Body).Decode(&discovery)
+	if err != nil {
+		return discovery, err
+	}
+	if discovery.Issuer != strings.TrimSuffix(issuer, "/") && discovery.Issuer != issuer {
+		return discovery, errors.New("The discovery document is of another issuer: " + discovery.Issuer)
+	}
+
+	discoveries[issuer] = discovery
+	return discovery, nil
+}
+
+func addLoginState(provider string) (string, loginState, error) {
+	// The state and nonce tie the callback to this login, they can't be
+	//  guessable
+	id, err := previewToken()
+	if err != nil {
+		return "", loginState{}, err
+	}
+	nonce, err := previewToken()
+	if err != nil {
+		return "", loginState{}, err
+	}
+
+	loginStatesMutex.Lock()
+	defer loginStatesMutex.Unlock()
+
+	for id, state := range loginStates {
+		if time.Now().After(state.expires) {
+			delete(loginStates, id)
+		}
+	}
+
+	state := loginState{provider: provider, nonce: nonce, expires: time.Now().Add(loginStateExpiration)}
+	loginStates[id] = state
+
+	return id, state, nil
+}
+
+// Takes the state of a login that comes back, it can only be used once
+func takeLoginState(id string, provider string) (loginState, bool) {
+	loginStatesMutex.Lock()
+	defer loginStatesMutex.Unlock()
+
+	state, ok := loginStates[id]
+	delete(loginStates, id)
+	if !ok || state.provider != provider || time.Now().After(state.expires) {
+		return state, false
+	}
+
+	return state, true
+}
+
+// Sends the browser to the provider to log in
+func startProviderLogin(w http.ResponseWriter, r *http.Request, provider *LoginProvider) {
+	id, state, err := addLoginState(provider.Name)
+	if err != nil {
+		ShowError(w, 500, "Unable to start the login", err)
+		return
+	}
+
+	authUrl := ""
+	query := url.Values{"client_id": {provider.ClientId}, "redirect_uri": {loginRedirectUri(r, provider)},
+		"state": {id}, "response_type": {"code"}}
+
+	switch provider.Kind {
+	case "github":
+		authUrl = "https://github.com/login/oauth/authorize"
+		query.Set("scope", "user:email")
+	default:
+		discovery, err := discoverProvider(provider.Issuer)
+		if err != nil {
+			ShowError(w, 502, "Unable to reach the login provider", err)
+			return
+		}
+
+		authUrl = discovery.AuthorizationEndpoint
+		scopes := append([]string{"openid", "email"}, provider.Scopes...)
+		query.Set("scope", strings.Join(scopes, " "))
+		query.Set("nonce", state.nonce)
+	}
+
+	separator := "?"
+	if strings.Contains(authUrl, "?") {
+		separator = "&"
+	}
+	http.Redirect(w, r, authUrl+separator+query.Encode(), 302)
+}
+
+// Trades the code of the callback for the tokens of the user, the redirect
+// URI has to be the one that the code was sent to
+func exchangeLoginCode(provider *LoginProvider, tokenUrl string, code string, redirectUri string) (oidcTokenResponse, error) {
+	tokens := oidcTokenResponse{}
+
+	form := url.Values{"grant_type": {"authorization_code"}, "code": {code}, "redirect_uri": {redirectUri},
+		"client_id": {provider.ClientId}, "client_secret": {provider.ClientSecret}}
+	req, err := http.NewRequest("POST", tokenUrl, strings.NewReader(form.Encode()))
+	if err != nil {
+		return tokens, err
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	req.Header.Set("Accept", "application/json")
+
+	resp, err := loginClient.Do(req)
+	if err != nil {
+		return tokens, err
+	}
+	defer resp.Body.Close()
+
+	err = json.NewDecoder(resp.Body).Decode(&tokens)
+	if err != nil {
+		return tokens, err
+	}
+	if tokens.Error != "" {
+		return tokens, fmt.Errorf("%v %v", tokens.Error, tokens.Description)
+	}
+
+	return tokens, nil
+}
+
+// The verified email address of the ID token. The token comes straight from
+// the token endpoint over TLS, which OpenID Connect accepts in place of
+// checking its signature.
+func idTokenEmail(provider *LoginProvider, discovery oidcDiscovery, idToken string, nonce string) (string, error) {
+	parts := strings.Split(idToken, ".")
+	if len(parts) != 3 {
+		return "", errors.New("Malformed ID token")
+	}
+	payload, err := base64.RawURLEncoding.DecodeString(strings.TrimRight(parts[1], "="))
+	if err != nil {
+		return "", err
+	}
+
+	claims := oidcClaims{}
+	err = json.Unmarshal(payload, &claims)
+	if err != nil {
+		return "", err
+	}
+
+	audience := false
+	switch aud := claims.Audience.(type) {
+	case string:
+		audience = aud == provider.ClientId
+	case []interface{}:
+		for _, a := range aud {
+			audience = audience || a == provider.ClientId
+		}
+	}
+
+	switch {
+	case claims.Issuer != discovery.Issuer:
+		return "", errors.New("The ID token is of another issuer: " + claims.Issuer)
+	case !audience:
+		return "", errors.New("The ID token is meant for another client")
+	case time.Now().Unix() > claims.Expires:
+		return "", errors.New("The ID token has expired")
+	case claims.Nonce != nonce:
+		return "", errors.New("The ID token is of another login")
+	case claims.EmailVerified != true && claims.EmailVerified != "true":
+		return "", errors.New("The email address is not verified")
+	}
+
+	return claims.Email, nil
+}
+
+// The primary verified email address of the GitHub user
+func githubEmail(accessToken string) (string, error) {
+	req, err := http.NewRequest("GET", "https://api.github.com/user/emails", nil)
+	if err != nil {
+		return "", err
+	}
+	req.Header.Set("Authorization", "Bearer "+accessToken)
+	req.Header.Set("Accept", "application/vnd.github+json")
+
+	resp, err := loginClient.Do(req)
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != 200 {
+		return "", errors.New("Unable to read the email addresses: " + resp.Status)
+	}
+
+	emails := []struct {
+		Email    string
+		Primary  bool
+		Verified bool
+	}{}
+	err = json.NewDecoder(resp.Body).Decode(&emails)
+	if err != nil {
+		return "", err
+	}
+
+	for _, email := range emails {
+		if email.Primary && email.Verified {
+			return email.Email, nil
+		}
+	}
+
+	return "", errors.New("The GitHub user has no verified primary email address")
+}
+
+// The email address of the user that comes back from the provider
+func finishProviderLogin(r *http.Request, provider *LoginProvider) (string, error) {
+	query := r.URL.Query()
+	if e := query.Get("error"); e != "" {
+		return "", errors.New("The login was refused: " + e)
+	}
+
+	state, ok := takeLoginState(query.Get("state"), provider.Name)
+	if !ok {
+		return "", errors.New("The login has expired, please try again")
+	}
+
+	if provider.Kind == "github" {
+		tokens, err := exchangeLoginCode(provider, "https://github.com/login/oauth/access_token", query.Get("code"), loginRedirectUri(r, provider))
+		if err != nil {
+			return "", err
+		}
+		return githubEmail(tokens.AccessToken)
+	}
+
+	discovery, err := discoverProvider(provider.Issuer)
+	if err != nil {
+		return "", err
+	}
+	tokens, err := exchangeLoginCode(provider, discovery.TokenEndpoint, query.Get("code"), loginRedirectUri(r, provider))
+	if err != nil {
+		return "", err
+	}
+
+	return idTokenEmail(provider, discovery, tokens.IdToken, state.nonce)
+}
+
+// Shows the failure on the login page
+func redirectLoginError(w http.ResponseWriter, r *http.Request, message string) {
+	http.Redirect(w, r, requestPrefix(r)+"/mixloginstatic/LoginWindow.html?error="+base64.StdEncoding.EncodeToString([]byte(message)), 302)
+}
+
+// GET /login/oidc/<name> sends the browser to the provider, which sends it
+// back to GET /login/oidc/<name>/callback
+func providerLoginHandler(w http.ResponseWriter, r *http.Request) {
+	pathSegs := strings.Split(strings.Trim(r.URL.Path, "/"), "/")
+	if r.Method != "GET" || len(pathSegs) < 3 || len(pathSegs) > 4 {
+		http.NotFound(w, r)
+		return
+	}
+
+	provider := configuredLoginProvider(pathSegs[2])
+	if provider == nil {
+		ShowError(w, 404, "No such login provider", nil)
+		return
+	}
+
+	if len(pathSegs) == 3 {
+		startProviderLogin(w, r, provider)
+		return
+	}
+	if pathSegs[3] != "callback" {
+		http.NotFound(w, r)
+		return
+	}
+
+	email, err := finishProviderLogin(r, provider)
+	if err != nil {
+		logger.Printf("Login with %v failed: %v\n", provider.Name, err)
+		recordLoginFailure(r)
+		redirectLoginError(w, r, "Unable to log in: "+err.Error())
+		return
+	}
+
+	account := lookupAccount(email)
+	if !loginEmailAllowed(email) || (account != nil && account.Disabled) {
+		logger.Printf("Login with %v refused for %v\n", provider.Name, email)
+		recordLoginFailure(r)
+		redirectLoginError(w, r, email+" may not use this godev server")
+		return
+	}
+
+	// The remoteAccount gets the primary key, everyone else a session of
+	//  their own
+	user, cookieKey := *remoteAccount, magicKey
+	if *remoteAccount == "" || !strings.EqualFold(email, *remoteAccount) {
+		user = email
+		cookieKey = addUserMagicKey(email, "Session "+provider.Name, 2000000*time.Second, false).Key
+	}
+
+	cookie := sessionCookie(r, cookieKey)
+
+	http.SetCookie(w, cookie)
+	clearLoginFailures(r)
+
+	landingPage := sessionLandingPage(user)
+	if landingPage == "" {
+		landingPage = "/"
+	}
+	http.Redirect(w, r, requestPrefix(r)+landingPage, 302)
+}
@@ -0,0 +1,495 @@
+// Copyright 2014 Chris McGee <sirnewton_01@yahoo.ca>. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"go/build"
+	"go/parser"
+	"go/token"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"os/exec"
+	"path"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	// Imports that are looked up, each can take a go list in module mode
+	maxOnboardingImports = 50
+	maxOnboardingRuns    = 10
+	// Files in a top-level directory that make it worth excluding
+	largeDirFiles = 5000
+	// The same for directories of dependencies and build output
+	heavyDirFiles = 200
+)
+
+// What the analysis of a project that was just added to the workspace
+// found, each finding can have an action that takes care of it
+type OnboardingReport struct {
+	Location string
+	Analyzed int64
+	Findings []OnboardingFinding
+}
+
+type OnboardingFinding struct {
+	// tool, mode, import, size or run
+	Kind     string
+	Severity string
+	Message  string
+	Action   *OnboardingAction `json:",omitempty"`
+}
+
+// Request that the browser sends to act on a finding
+type OnboardingAction struct {
+	Label  string
+	Method string
+	Url    string
+	Body   interface{} `json:",omitempty"`
+}
+
+var (
+	onboardingMutex   sync.Mutex
+	onboardingRunning = make(map[string]bool)
+
+	// Tools that godev runs and where they are installed from
+	onboardingTools = []struct {
+		name string
+		pkg  string
+	}{
+		{"gocode", "github.com/nsf/gocode"},
+		{"godef", "github.com/rogpeppe/godef"},
+		{"gorename", "golang.org/x/tools/cmd/gorename"},
+		{"guru", "golang.org/x/tools/cmd/guru"},
+		{"goimports", "golang.org/x/tools/cmd/goimports"},
+		{"godoc", "golang.org/x/tools/cmd/godoc"},
+		{"dlv", "github.com/go-delve/delve/cmd/dlv"},
+	}
+
+	// Directories of dependencies and build output
+	heavyDirNames = map[string]bool{"node_modules": true, "bower_components": true, "dist": true,
+		"build": true, "target": true, "out": true, ".cache": true}
+
+	goModModule = regexp.MustCompile(`(?m)^module\s+"?([^\s"]+)"?`)
+)
+
+func init() {
+	registerGcTask("onboarding", gcOnboarding)
+}
+
+// Reports of the analyses that were done before the cutoff
+func gcOnboarding(cutoff time.Time, result *GcResult) error {
+	userDataMutex.Lock()
+	defer userDataMutex.Unlock()
+
+	for _, user := range dataUsers() {
+		reports := make(map[string]OnboardingReport)
+		err := loadUserData(user, "onboarding", &reports)
+		if err != nil {
+			return err
+		}
+
+		removed := 0
+		for location, report := range reports {
+			if report.Analyzed < cutoff.Unix()*1000 {
+				delete(reports, location)
+				removed++
+			}
+		}
+		if removed == 0 {
+			continue
+		}
+
+		err = saveUserData(user, "onboarding", reports)
+		if err != nil {
+			return err
+		}
+		result.Removed += removed
+	}
+
+	return nil
+}
+
+// Analyzes the new project in the background and notifies the user
+func startOnboarding(user string, dir string, location string) {
+	onboardingMutex.Lock()
+	if onboardingRunning[location] {
+		onboardingMutex.Unlock()
+		return
+	}
+	onboardingRunning[location] = true
+	onboardingMutex.Unlock()
+
+	go func() {
+		defer func() {
+			onboardingMutex.Lock()
+			delete(onboardingRunning, location)
+			onboardingMutex.Unlock()
+		}()
+
+		ctx, cancel := context.WithTimeout(context.Background(), *searchTimeout)
+		defer cancel()
+
+		report := analyzeProject(ctx, user, dir, location)
+
+		userDataMutex.Lock()
+		reports := make(map[string]OnboardingReport)
+		err := loadUserData(user, "onboarding", &reports)
+		if err == nil {
+			reports[location] = report
+			err = saveUserData(user, "onboarding", reports)
+		}
+		userDataMutex.Unlock()
+		if err != nil {
+			logger.Printf("Unable to save the onboarding report of %v: %v\n", location, err)
+		}
+
+		if len(report.Findings) > 0 {
+			publishEvent(Event{Type: "onboarding", User: user, Data: report})
+		}
+	}()
+}
+
+func analyzeProject(ctx context.Context, user string, dir string, location string) OnboardingReport {
+	report := OnboardingReport{Location: location, Findings: []OnboardingFinding{}}
+	add := func(finding OnboardingFinding) {
+		report.Findings = append(report.Findings, finding)
+	}
+
+	shellAction := func(label string, args ...string) *OnboardingAction {
+		if !shellAllowed("go") {
+			return nil
+		}
+		return &OnboardingAction{Label: label, Method: "POST", Url: "/shell/exec",
+			Body: ShellRequest{Command: "go", Args: args, Dir: location}}
+	}
+
+	// Tools
+	if _, err := exec.LookPath("go"); err != nil {
+		add(OnboardingFinding{Kind: "tool", Severity: SEV_ERR, Message: "The go tool isn't on the PATH of godev, nothing can be built"})
+	} else {
+		for _, tool := range onboardingTools {
+			if _, err := exec.LookPath(tool.name); err != nil {
+				add(OnboardingFinding{Kind: "tool", Severity: SEV_WARN,
+					Message: "The " + tool.name + " tool isn't installed, editor features that need it won't work",
+					Action:  shellAction("Install "+tool.name, "install", tool.pkg+"@latest")})
+			}
+		}
+	}
+	if _, err := os.Stat(filepath.Join(dir, ".git")); err == nil {
+		if _, err := exec.LookPath("git"); err != nil {
+			add(OnboardingFinding{Kind: "tool", Severity: SEV_WARN, Message: "The project is a git repository but git isn't installed"})
+		}
+	}
+
+	// Module or GOPATH mode
+	modulePath := ""
+	if b, err := ioutil.ReadFile(filepath.Join(dir, "go.mod")); err == nil {
+		if match := goModModule.FindSubmatch(b); match != nil {
+			modulePath = string(match[1])
+		}
+	}
+	gopathPath := strings.TrimPrefix(location, "/file/")
+
+	cmd := exec.CommandContext(ctx, "go", "env", "GO111MODULE")
+	cmd.Dir = dir
+	out, _ := cmd.Output()
+	moduleMode := strings.TrimSpace(string(out))
+
+	importPrefix := gopathPath
+	switch {
+	case modulePath != "" && moduleMode == "off":
+		add(OnboardingFinding{Kind: "mode", Severity: SEV_WARN,
+			Message: "The project has a go.mod but GO111MODULE=off builds it in GOPATH mode, its dependencies come from the GOPATH instead of go.sum"})
+	case modulePath != "":
+		importPrefix = modulePath
+		if modulePath != gopathPath {
+			add(OnboardingFinding{Kind: "mode", Severity: SEV_INFO,
+				Message: "The module path " + modulePath + " differs from where the project is in the GOPATH (" + gopathPath + "), tools in GOPATH mode won't find its packages by their import paths"})
+		}
+	case moduleMode != "off" && hasGoFiles(dir):
+		add(OnboardingFinding{Kind: "mode", Severity: SEV_WARN,
+			Message: "The project has no go.mod, the go tool builds it in module mode and fails",
+			Action:  shellAction("Create go.mod", "mod", "init", gopathPath)})
+	}
+
+	imports, mains, sizes := scanProject(ctx, dir)
+
+	// Imports that can't be found
+	checked := 0
+	for _, imp := range imports {
+		if ctx.Err() != nil || checked >= maxOnboardingImports {
+			break
+		}
+		if !strings.Contains(strings.Split(imp.path, "/")[0], ".") || imp.path == importPrefix || strings.HasPrefix(imp.path, importPrefix+"/") {
+			// The standard library and the packages of the project itself
+			continue
+		}
+		checked++
+
+		if _, err := build.Default.Import(imp.path, imp.dir, build.FindOnly); err != nil {
+			add(OnboardingFinding{Kind: "import", Severity: SEV_WARN,
+				Message: "The import " + imp.path + " can't be found",
+				Action:  shellAction("Get "+imp.path, "get", imp.path)})
+		}
+	}
+
+	// Directories worth excluding from searches
+	for _, size := range sizes {
+		add(OnboardingFinding{Kind: "size", Severity: SEV_INFO,
+			Message: fmt.Sprintf("%v has %v files, exclude %v/* from searches to keep them fast", size.dir, size.files, size.dir)})
+	}
+
+	// Run configurations of the commands that the user doesn't have yet
+	userDataMutex.Lock()
+	session, _ := loadSession(user)
+	userDataMutex.Unlock()
+
+	known := make(map[string]bool)
+	if session != nil {
+		for _, config := range session.RunConfigurations {
+			known[config.Cmd] = true
+		}
+	}
+	for idx, main := range mains {
+		if idx >= maxOnboardingRuns {
+			break
+		}
+
+		cmdPath := path.Join(importPrefix, main)
+		if known[cmdPath] {
+			continue
+		}
+
+		config := RunConfiguration{Name: path.Base(cmdPath), Cmd: cmdPath}
+		add(OnboardingFinding{Kind: "run", Severity: SEV_INFO, Message: "Run configuration for the command " + cmdPath,
+			Action: &OnboardingAction{Label: "Add run configuration", Method: "POST", Url: "/onboarding/runconfig", Body: config}})
+	}
+
+	report.Analyzed = time.Now().Unix() * 1000
+	return report
+}
+
+func hasGoFiles(dir string) bool {
+	found := false
+	walkSymbolFiles(dir, func(file string) {
+		found = true
+	})
+	return found
+}
+
+type projectImport struct {
+	path string
+	// Directory of the first file that imports it
+	dir string
+}
+
+type projectDirSize struct {
+	dir   string
+	files int
+}
+
+// Walks the project once for its imports, the directories of its commands
+// relative to it and the directories that are big
+func scanProject(ctx context.Context, dir string) ([]projectImport, []string, []projectDirSize) {
+	imports := []projectImport{}
+	seen := make(map[string]bool)
+	mains := make(map[string]bool)
+	topFiles := make(map[string]int)
+	sizes := []projectDirSize{}
+
+	filepath.Walk(dir, func(p string, info os.FileInfo, err error) error {
+		if err != nil {
+			return nil
+		}
+		if ctx.Err() != nil {
+			return ctx.Err()
+		}
+
+		rel, _ := filepath.Rel(dir, p)
+		rel = filepath.ToSlash(rel)
+		name := info.Name()
+
+		if info.IsDir() {
+			if p == dir {
+				return nil
+			}
+			if heavyDirNames[name] {
+				files := countFiles(p)
+				if files >= heavyDirFiles {
+					sizes = append(sizes, projectDirSize{rel, files})
+				}
+				return filepath.SkipDir
+			}
+			if name == ".git" || name == ".hg" {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+
+		topFiles[strings.SplitN(rel, "/", 2)[0]]++
+
+		// Go files of the packages that the go tool builds
+		if !strings.HasSuffix(name, ".go") || strings.HasSuffix(name, "_test.go") {
+			return nil
+		}
+		for _, seg := range strings.Split(rel, "/") {
+			if seg == "vendor" || seg == "testdata" || strings.HasPrefix(seg, ".") || strings.HasPrefix(seg, "_") {
+				return nil
+			}
+		}
+
+		f, err := parser.ParseFile(token.NewFileSet(), p, nil, parser.ImportsOnly)
+		if err != nil {
+			return nil
+		}
+		if f.Name.Name == "main" {
+			mains[path.Dir(rel)] = true
+		}
+		for _, spec := range f.Imports {
+			imp := strings.Trim(spec.Path.Value, "\"`")
+			if imp == "C" || seen[imp] {
+				continue
+			}
+			seen[imp] = true
+			imports = append(imports, projectImport{imp, filepath.Dir(p)})
+		}
+		return nil
+	})
+
+	for top, files := range topFiles {
+		if files >= largeDirFiles {
+			if info, err := os.Stat(filepath.Join(dir, top)); err == nil && info.IsDir() {
+				sizes = append(sizes, projectDirSize{top, files})
+			}
+		}
+	}
+	sort.Slice(sizes, func(i, j int) bool { return sizes[i].files > sizes[j].files })
+
+	mainDirs := []string{}
+	for main := range mains {
+		if main == "." {
+			main = ""
+		}
+		mainDirs = append(mainDirs, main)
+	}
+	sort.Strings(mainDirs)
+
+	return imports, mainDirs, sizes
+}
+
+func countFiles(dir string) int {
+	files := 0
+	filepath.Walk(dir, func(p string, info os.FileInfo, err error) error {
+		if err == nil && !info.IsDir() {
+			files++
+		}
+		return nil
+	})
+	return files
+}
+
+// GET /onboarding?location=/file/<project> has the report of the analysis
+// of the project, or of all projects without a location. POST analyzes it
+// again and POST /onboarding/runconfig adds a suggested run configuration
+// to the session.
+func onboardingHandler(writer http.ResponseWriter, req *http.Request, path string, pathSegs []string) bool {
+	user := requestUser(req)
+	location := strings.TrimSuffix(req.URL.Query().Get("location"), "/")
+
+	switch {
+	case req.Method == "GET" && len(pathSegs) == 1:
+		userDataMutex.Lock()
+		reports := make(map[string]OnboardingReport)
+		err := loadUserData(user, "onboarding", &reports)
+		userDataMutex.Unlock()
+		if err != nil {
+			ShowError(writer, 500, "Unable to load the onboarding reports", err)
+			return true
+		}
+
+		if location == "" {
+			list := []OnboardingReport{}
+			for _, report := range reports {
+				list = append(list, report)
+			}
+			sort.Slice(list, func(i, j int) bool { return list[i].Analyzed > list[j].Analyzed })
+
+			ShowJson(writer, 200, list)
+			return true
+		}
+
+		report, ok := reports[location]
+		if !ok {
+			ShowError(writer, 404, "The project hasn't been analyzed", nil)
+			return true
+		}
+
+		ShowJson(writer, 200, report)
+		return true
+	case req.Method == "POST" && len(pathSegs) == 1:
+		dir := ""
+		for _, srcDir := range requestSrcDirs(req) {
+			p := filepath.Join(srcDir, strings.TrimPrefix(location, "/file"))
+			if info, err := os.Stat(p); err == nil && info.IsDir() {
+				dir = p
+				break
+			}
+		}
+		if !strings.HasPrefix(location, "/file/") || dir == "" {
+			ShowError(writer, 400, "The location isn't a directory of the workspace: "+location, nil)
+			return true
+		}
+
+		startOnboarding(user, dir, location)
+
+		writer.WriteHeader(202)
+		return true
+	case req.Method == "POST" && len(pathSegs) == 2 && pathSegs[1] == "runconfig":
+		config := RunConfiguration{}
+		err := json.NewDecoder(req.Body).Decode(&config)
+		if err != nil || config.Name == "" || config.Cmd == "" {
+			ShowError(writer, 400, "Invalid run configuration", err)
+			return true
+		}
+
+		userDataMutex.Lock()
+		defer userDataMutex.Unlock()
+
+		state, err := loadSession(user)
+		if err != nil {
+			ShowError(writer, 500, "Unable to load session", err)
+			return true
+		}
+		for _, existing := range state.RunConfigurations {
+			if existing.Name == config.Name {
+				ShowError(writer, 409, "There is already a run configuration called "+config.Name, nil)
+				return true
+			}
+		}
+
+		state.RunConfigurations = append(state.RunConfigurations, config)
+		state.Saved = time.Now().Unix() * 1000
+		err = saveUserData(user, "session", state)
+		if err != nil {
+			ShowError(writer, 500, "Unable to save session", err)
+			return true
+		}
+		publishEvent(Event{Type: "session", User: user, Data: state.Saved})
+
+		ShowJson(writer, 201, config)
+		return true
+	}
+
+	return false
+}
@@ -0,0 +1,179 @@
+// Copyright 2014 Chris McGee <sirnewton_01@yahoo.ca>. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+// File to show in the editor of the browsers of the user
+type OpenRequest struct {
+	// Workspace location, e.g. /file/github.com/user/project/main.go
+	Location string
+	Line     int `json:",omitempty"`
+}
+
+type OpenResult struct {
+	// Number of browsers that were asked to open the file
+	Delivered int
+	Url       string
+}
+
+var (
+	// Position suffix of the file names in compiler errors and stack
+	//  traces, e.g. main.go:12:5 or main.go:12 +0x1d
+	filePosition = regexp.MustCompile(`^(.+?):(\d+)(?::\d+)?(?: \+0x[0-9a-f]+)?$`)
+)
+
+// Resolves a file given as a workspace location or a path on disk, which
+// may end with a line number.
+func openRequest(file string, line string) (OpenRequest, error) {
+	request := OpenRequest{}
+
+	file = strings.TrimSpace(file)
+	if m := filePosition.FindStringSubmatch(file); m != nil {
+		file = m[1]
+		request.Line, _ = strconv.Atoi(m[2])
+	}
+	if line != "" {
+		l, err := strconv.Atoi(line)
+		if err != nil || l < 1 {
+			return request, errors.New("Invalid line number: " + line)
+		}
+		request.Line = l
+	}
+
+	switch {
+	case file == "":
+		return request, errors.New("No file was given")
+	case strings.HasPrefix(file, "/file/"):
+		request.Location = file
+	default:
+		request.Location = workspaceLocation(file)
+		if request.Location == "" {
+			return request, errors.New("The file is outside of the workspace: " + file)
+		}
+	}
+
+	return request, nil
+}
+
+// The editor page showing the file at the line
+func (r OpenRequest) url() string {
+	u := "/edit/edit.html#" + r.Location
+	if r.Line > 0 {
+		u = u + ",line=" + strconv.Itoa(r.Line)
+	}
+
+	return u
+}
+
+// GET /open?file=<file>&line=<line> redirects to the editor, which makes
+// it work as a link from anywhere. POST /open with the same parameters
+// has the editors that the user already has open show the file instead.
+// The file is a workspace location or a path on disk.
+func openHandler(writer http.ResponseWriter, req *http.Request, path string, pathSegs []string) bool {
+	switch {
+	case req.Method == "GET" && len(pathSegs) == 1:
+		request, err := openRequest(req.URL.Query().Get("file"), req.URL.Query().Get("line"))
+		if err != nil {
+			ShowError(writer, 400, err.Error(), nil)
+			return true
+		}
+
+		http.Redirect(writer, req, requestPrefix(req)+request.url(), http.StatusFound)
+		return true
+	case req.Method == "POST" && len(pathSegs) == 1:
+		request, err := openRequest(req.FormValue("file"), req.FormValue("line"))
+		if err != nil {
+			ShowError(writer, 400, err.Error(), nil)
+			return true
+		}
+
+		result := OpenResult{Url: request.url()}
+		result.Delivered = publishEvent(Event{Type: "open", User: requestUser(req), Data: request})
+
+		if result.Delivered == 0 {
+			ShowJson(writer, 404, result)
+			return true
+		}
+
+		ShowJson(writer, 200, result)
+		return true
+	}
+
+	return false
+}
+
+// godev open [-url <server>] <file>[:<line>] [<line>]
+func openCommand(args []string) error {
+	flags := flag.NewFlagSet("open", flag.ExitOnError)
+	server := flags.String("url", "http://"+loopbackHost+":"+*port, "URL of the godev server.")
+	flags.Parse(args)
+
+	if flags.NArg() != 1 && flags.NArg() != 2 {
+		return errors.New("Usage: godev open [-url http://host:port] <file>[:<line>] [<line>]")
+	}
+
+	// The server resolves paths on its own file system
+	file := flags.Arg(0)
+	if !strings.HasPrefix(file, "/file/") && !filepath.IsAbs(file) {
+		abs, err := filepath.Abs(file)
+		if err != nil {
+			return err
+		}
+		file = abs
+	}
+
+	form := url.Values{"file": {file}}
+	if flags.NArg() == 2 {
+		form.Set("line", flags.Arg(1))
+	}
+
+	req, err := http.NewRequest("POST", strings.TrimSuffix(*server, "/")+"/open", strings.NewReader(form.Encode()))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+
+	// Remote instances only talk to clients that know the magic key
+	if magic := os.Getenv("GODEV_MAGIC"); magic != "" {
+		u, err := url.Parse(*server)
+		if err != nil {
+			return err
+		}
+		req.AddCookie(&http.Cookie{Name: "MAGIC" + u.Port(), Value: magic})
+	}
+
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	switch resp.StatusCode {
+	case 200:
+		return nil
+	case 404:
+		result := OpenResult{}
+		json.NewDecoder(resp.Body).Decode(&result)
+		fmt.Printf("No browser is connected, open %v%v\n", strings.TrimSuffix(*server, "/"), result.Url)
+		return nil
+	}
+
+	status := Status{}
+	json.NewDecoder(resp.Body).Decode(&status)
+	return fmt.Errorf("%v: %v %v", resp.Status, status.Message, status.DetailedMessage)
+}
@@ -0,0 +1,306 @@
+// Copyright 2014 Chris McGee <sirnewton_01@yahoo.ca>. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"bytes"
+	"go/ast"
+	"go/build"
+	"go/parser"
+	"go/printer"
+	"go/token"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	packageIndexMaxAge = 5 * time.Minute
+	// Packages of the same name offered for an identifier that isn't imported
+	maxImportSuggestions = 5
+)
+
+// Import paths of the packages of GOROOT and GOPATH by package name
+type packageIndex struct {
+	built    time.Time
+	packages map[string][]string
+}
+
+var (
+	packageIndexMutex    sync.Mutex
+	currentPackageIndex  *packageIndex
+	packageIndexBuilding bool
+)
+
+// Exported top-level declaration of a package
+type packageSymbol struct {
+	Name string
+	Kind string
+	Type string
+}
+
+type packageSymbols struct {
+	modTime time.Time
+	symbols []packageSymbol
+}
+
+var (
+	packageSymbolsMutex sync.Mutex
+	packageSymbolsCache = make(map[string]*packageSymbols)
+)
+
+// Returns the index, which may be stale or missing while it is being built
+// in the background so that completion never waits for a walk of GOPATH.
+func lookupPackages(name string) []string {
+	packageIndexMutex.Lock()
+	defer packageIndexMutex.Unlock()
+
+	if !packageIndexBuilding && (currentPackageIndex == nil || time.Since(currentPackageIndex.built) > packageIndexMaxAge) {
+		packageIndexBuilding = true
+		go func() {
+			index := buildPackageIndex()
+
+			packageIndexMutex.Lock()
+			currentPackageIndex = index
+			packageIndexBuilding = false
+			packageIndexMutex.Unlock()
+		}()
+	}
+
+	if currentPackageIndex == nil {
+		return nil
+	}
+
+	return currentPackageIndex.packages[name]
+}
+
+func buildPackageIndex() *packageIndex {
+	start := time.Now()
+	index := &packageIndex{packages: make(map[string][]string)}
+
+	for _, srcDir := range build.Default.SrcDirs() {
+		filepath.Walk(srcDir, func(path string, info os.FileInfo, err error) error {
+			if err != nil || !info.IsDir() {
+				return nil
+			}
+
+			name := info.Name()
+			if path != srcDir && (strings.HasPrefix(name, ".") || strings.HasPrefix(name, "_") ||
+				name == "testdata" || name == "internal" || name == "vendor") {
+				return filepath.SkipDir
+			}
+
+			importPath, err := filepath.Rel(srcDir, path)
+			if err != nil || importPath == "." {
+				return nil
+			}
+			importPath = filepath.ToSlash(importPath)
+
+			// The commands of the Go distribution aren't importable
+			if importPath == "cmd" && strings.HasPrefix(srcDir, build.Default.GOROOT) {
+				return filepath.SkipDir
+			}
+
+			pkg, err := build.ImportDir(path, 0)
+			if err != nil || pkg.Name == "main" {
+				return nil
+			}
+
+			index.packages[pkg.Name] = append(index.packages[pkg.Name], importPath)
+			return nil
+		})
+	}
+
+	// Standard library first, then the shortest paths
+	for _, paths := range index.packages {
+		sort.SliceStable(paths, func(i, j int) bool {
+			iStd, jStd := !strings.Contains(paths[i], "."), !strings.Contains(paths[j], ".")
+			if iStd != jStd {
+				return iStd
+			}
+			return len(paths[i]) < len(paths[j])
+		})
+	}
+
+	index.built = time.Now()
+	logger.Printf("Indexed %v package names in %v\n", len(index.packages), time.Since(start))
+	return index
+}
+
+func loadPackageSymbols(pkg *build.Package) []packageSymbol {
+	info, err := os.Stat(pkg.Dir)
+	if err != nil {
+		return nil
+	}
+
+	packageSymbolsMutex.Lock()
+	defer packageSymbolsMutex.Unlock()
+
+	cached := packageSymbolsCache[pkg.Dir]
+	if cached != nil && cached.modTime.Equal(info.ModTime()) {
+		return cached.symbols
+	}
+
+	fileset := token.NewFileSet()
+	symbols := []packageSymbol{}
+
+	typeString := func(expr ast.Expr) string {
+		if expr == nil {
+			return ""
+		}
+		b := &bytes.Buffer{}
+		printer.Fprint(b, fileset, expr)
+		return b.String()
+	}
+
+	for _, goFile := range pkg.GoFiles {
+		file, err := parser.ParseFile(fileset, filepath.Join(pkg.Dir, goFile), nil, 0)
+		if err != nil {
+			continue
+		}
+
+		for _, decl := range file.Decls {
+			switch d := decl.(type) {
+			case *ast.FuncDecl:
+				if d.Recv == nil && d.Name.IsExported() {
+					symbols = append(symbols, packageSymbol{d.Name.Name, "func", typeString(d.Type)})
+				}
+			case *ast.GenDecl:
+				for _, spec := range d.Specs {
+					switch s := spec.(type) {
+					case *ast.TypeSpec:
+						if s.Name.IsExported() {
+							symbols = append(symbols, packageSymbol{s.Name.Name, "type", typeString(s.Type)})
+						}
+					case *ast.ValueSpec:
+						kind := "var"
+						if d.Tok == token.CONST {
+							kind = "const"
+						}
+						for _, name := range s.Names {
+							if name.IsExported() {
+								symbols = append(symbols, packageSymbol{name.Name, kind, typeString(s.Type)})
+							}
+						}
+					}
+				}
+			}
+		}
+	}
+
+	packageSymbolsCache[pkg.Dir] = &packageSymbols{info.ModTime(), symbols}
+	return symbols
+}
+
+// Edit of the buffer that adds the import, it goes into the existing import
+// block if there is one.
+func importEdit(buffer []byte, importPath string) (TextEdit, bool) {
+	fileset := token.NewFileSet()
+	// Errors after the imports don't matter
+	file, _ := parser.ParseFile(fileset, "", buffer, parser.ImportsOnly)
+	if file == nil || file.Name == nil {
+		return TextEdit{}, false
+	}
+
+	quoted := strconv.Quote(importPath)
+
+	for _, spec := range file.Imports {
+		if spec.Path.Value == quoted {
+			return TextEdit{}, false
+		}
+	}
+
+	for _, decl := range file.Decls {
+		genDecl, ok := decl.(*ast.GenDecl)
+		if !ok || genDecl.Tok != token.IMPORT {
+			continue
+		}
+
+		if genDecl.Lparen.IsValid() && genDecl.Rparen.IsValid() {
+			offset := fileset.Position(genDecl.Rparen).Offset
+			// Goes on its own line just before the closing parenthesis
+			lineStart := bytes.LastIndexByte(buffer[:offset], '\n') + 1
+			if strings.TrimSpace(string(buffer[lineStart:offset])) == "" {
+				return TextEdit{Offset: lineStart, Text: "\t" + quoted + "\n"}, true
+			}
+			return TextEdit{Offset: offset, Text: "\n\t" + quoted + "\n"}, true
+		}
+
+		offset := fileset.Position(genDecl.End()).Offset
+		return TextEdit{Offset: offset, Text: "\nimport " + quoted}, true
+	}
+
+	offset := fileset.Position(file.Name.End()).Offset
+	return TextEdit{Offset: offset, Text: "\n\nimport " + quoted}, true
+}
+
+// Completions for a selector on a package that the buffer doesn't import
+// yet (e.g. "bytes.Buf"), each with the edit that adds the import.
+func importCompletions(buffer []byte, offset int, prefix string, srcDir string) []Completion {
+	if offset < 2 || offset > len(buffer) || buffer[offset-1] != '.' {
+		return nil
+	}
+
+	start := offset - 1
+	for start > 0 && isIdentChar(buffer[start-1]) {
+		start--
+	}
+	selector := string(buffer[start : offset-1])
+	if selector == "" || (start > 0 && buffer[start-1] == '.') {
+		return nil
+	}
+
+	completions := []Completion{}
+	importPaths := lookupPackages(selector)
+	if len(importPaths) > maxImportSuggestions {
+		importPaths = importPaths[:maxImportSuggestions]
+	}
+
+	for _, importPath := range importPaths {
+		pkg, err := build.Import(importPath, srcDir, 0)
+		if err != nil {
+			continue
+		}
+
+		edit, ok := importEdit(buffer, importPath)
+		if !ok {
+			continue
+		}
+
+		docs := loadPackageDocs(pkg)
+		for _, symbol := range loadPackageSymbols(pkg) {
+			score, matches, ok := fuzzyScore(prefix, symbol.Name)
+			if !ok {
+				continue
+			}
+
+			completion := Completion{
+				Name:            symbol.Name,
+				Kind:            symbol.Kind,
+				Detail:          symbol.Type,
+				Documentation:   docs[symbol.Name],
+				InsertText:      symbol.Name,
+				Snippet:         symbol.Name,
+				Score:           score,
+				Matches:         matches,
+				ImportPath:      importPath,
+				AdditionalEdits: []TextEdit{edit},
+			}
+
+			if symbol.Kind == "func" {
+				completion.InsertText, completion.Snippet, completion.Placeholders = callTemplate(symbol.Name, symbol.Type)
+			}
+			completion.Escape = len(completion.InsertText)
+
+			completions = append(completions, completion)
+		}
+	}
+
+	return completions
+}
@@ -0,0 +1,308 @@
+// Copyright 2014 Chris McGee <sirnewton_01@yahoo.ca>. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"go/ast"
+	"go/types"
+	"sort"
+	"strconv"
+	"strings"
+	"text/template"
+)
+
+// Preference node with the postfix templates of the user. Each key is the
+// name of a template and its value the JSON of a PostfixTemplate, an empty
+// value turns off the default template of that name.
+const postfixPrefsNode = "/prefs/user/godev/postfix"
+
+// Template for "expr.name" that replaces the expression and the name. The
+// template text sees the expression as {{.Expr}} and may contain ${1:text}
+// placeholders and a $0 for the cursor.
+type PostfixTemplate struct {
+	// The kinds of types it applies to: bool, number, iterable, nillable,
+	//  error or any.
+	Applies  []string
+	Template string
+	// Packages that the expanded template uses
+	Imports []string
+}
+
+var defaultPostfixTemplates = map[string]PostfixTemplate{
+	"if":     {[]string{"bool"}, "if {{.Expr}} {\n\t$0\n}", nil},
+	"not":    {[]string{"bool"}, "!{{.Expr}}$0", nil},
+	"for":    {[]string{"iterable"}, "for ${1:_}, ${2:v} := range {{.Expr}} {\n\t$0\n}", nil},
+	"err":    {[]string{"error"}, "if {{.Expr}} != nil {\n\treturn ${1:{{.Expr}}}\n}\n$0", nil},
+	"nil":    {[]string{"nillable"}, "if {{.Expr}} == nil {\n\t$0\n}", nil},
+	"notnil": {[]string{"nillable"}, "if {{.Expr}} != nil {\n\t$0\n}", nil},
+	"print":  {[]string{"any"}, "fmt.Println({{.Expr}})$0", []string{"fmt"}},
+	"var":    {[]string{"any"}, "${1:v} := {{.Expr}}$0", nil},
+}
+
+func postfixTemplates(user string) map[string]PostfixTemplate {
+	templates := make(map[string]PostfixTemplate)
+	for name, tmpl := range defaultPostfixTemplates {
+		templates[name] = tmpl
+	}
+
+	prefs, err := loadPrefs(user)
+	if err != nil {
+		logger.Printf("Unable to load the postfix templates: %v\n", err)
+		return templates
+	}
+
+	for name, value := range prefs[postfixPrefsNode] {
+		if value == "" {
+			delete(templates, name)
+			continue
+		}
+
+		tmpl := PostfixTemplate{}
+		err := json.Unmarshal([]byte(value), &tmpl)
+		if err != nil {
+			logger.Printf("Invalid postfix template %v: %v\n", name, err)
+			continue
+		}
+		templates[name] = tmpl
+	}
+
+	return templates
+}
+
+// Completions that replace the expression before the dot at the start of
+// the prefix with one of the templates that fits the type of the expression.
+func postfixCompletions(buffer []byte, start int, prefix string, filePath string, user string) []Completion {
+	if start < 2 || start > len(buffer) || buffer[start-1] != '.' || filePath == "" {
+		return nil
+	}
+
+	templates := postfixTemplates(user)
+	names := []string{}
+	for name := range templates {
+		if _, _, ok := fuzzyScore(prefix, name); ok {
+			names = append(names, name)
+		}
+	}
+	if len(names) == 0 {
+		return nil
+	}
+	sort.Strings(names)
+
+	exprStart, exprText, kinds := postfixExpr(buffer, start-1, filePath)
+	if kinds == nil {
+		return nil
+	}
+
+	// Multi-line templates continue at the indentation of the expression
+	lineStart := bytes.LastIndexByte(buffer[:exprStart], '\n') + 1
+	indent := ""
+	for _, c := range buffer[lineStart:exprStart] {
+		if c != ' ' && c != '\t' {
+			break
+		}
+		indent += string(c)
+	}
+
+	completions := []Completion{}
+	for _, name := range names {
+		tmpl := templates[name]
+		if !appliesTo(tmpl, kinds) {
+			continue
+		}
+
+		expansion := &bytes.Buffer{}
+		t, err := template.New(name).Parse(tmpl.Template)
+		if err == nil {
+			err = t.Execute(expansion, map[string]string{"Expr": exprText})
+		}
+		if err != nil {
+			logger.Printf("Invalid postfix template %v: %v\n", name, err)
+			continue
+		}
+
+		snippet := strings.Replace(expansion.String(), "\n", "\n"+indent, -1)
+		insertText, placeholders, escape := expandSnippet(snippet)
+
+		// The expression and the dot go away
+		edits := []TextEdit{{Offset: exprStart, Length: start - exprStart, Text: ""}}
+		for _, importPath := range tmpl.Imports {
+			if edit, ok := importEdit(buffer, importPath); ok {
+				edits = append(edits, edit)
+			}
+		}
+
+		score, matches, _ := fuzzyScore(prefix, name)
+		completions = append(completions, Completion{
+			Name:            name,
+			Kind:            "postfix",
+			Detail:          strings.Replace(insertText, "\n", " ", -1),
+			InsertText:      insertText,
+			Placeholders:    placeholders,
+			Escape:          escape,
+			Snippet:         snippet,
+			Score:           score,
+			Matches:         matches,
+			AdditionalEdits: edits,
+		})
+	}
+
+	return completions
+}
+
+func appliesTo(tmpl PostfixTemplate, kinds map[string]bool) bool {
+	for _, kind := range tmpl.Applies {
+		if kinds[kind] {
+			return true
+		}
+	}
+	return false
+}
+
+// Finds the expression that ends at the dot and the kinds of its type. The
+// buffer is type checked with the rest of its package, the dot and the
+// prefix blanked out so that the offsets stay the same.
+func postfixExpr(buffer []byte, dot int, filePath string) (int, string, map[string]bool) {
+	src := append([]byte{}, buffer...)
+	for i := dot; i < len(src) && (i == dot || isIdentChar(src[i])); i++ {
+		src[i] = ' '
+	}
+
+	checked, err := typeCheckBuffer(src, filePath)
+	if err != nil {
+		return 0, "", nil
+	}
+
+	// The outermost expression that ends at the dot
+	var expr ast.Expr
+	ast.Inspect(checked.file, func(n ast.Node) bool {
+		if n == nil || expr != nil {
+			return false
+		}
+		if e, ok := n.(ast.Expr); ok && checked.offset(e.End()) == dot {
+			if _, isKeyValue := e.(*ast.KeyValueExpr); !isKeyValue {
+				expr = e
+				return false
+			}
+		}
+		return checked.offset(n.Pos()) < dot
+	})
+	if expr == nil {
+		return 0, "", nil
+	}
+
+	tv, ok := checked.info.Types[expr]
+	if !ok || tv.Type == nil || tv.IsType() || tv.Type == types.Typ[types.Invalid] {
+		return 0, "", nil
+	}
+
+	start := checked.offset(expr.Pos())
+	return start, string(buffer[start:dot]), typeKinds(tv.Type)
+}
+
+func typeKinds(t types.Type) map[string]bool {
+	kinds := map[string]bool{"any": true}
+
+	errorType := types.Universe.Lookup("error").Type().Underlying().(*types.Interface)
+	if types.Implements(t, errorType) {
+		kinds["error"] = true
+	}
+
+	switch u := t.Underlying().(type) {
+	case *types.Basic:
+		switch {
+		case u.Info()&types.IsBoolean != 0:
+			kinds["bool"] = true
+		case u.Info()&types.IsString != 0:
+			kinds["iterable"] = true
+		case u.Info()&types.IsNumeric != 0:
+			kinds["number"] = true
+		}
+	case *types.Slice, *types.Map:
+		kinds["iterable"] = true
+		kinds["nillable"] = true
+	case *types.Array:
+		kinds["iterable"] = true
+	case *types.Pointer, *types.Chan, *types.Signature, *types.Interface:
+		kinds["nillable"] = true
+	}
+
+	return kinds
+}
+
+// Turns ${1:text}, $1 and $0 of a snippet into plain text with the offsets
+// of the placeholders and of the cursor.
+func expandSnippet(snippet string) (string, []Placeholder, int) {
+	text := &bytes.Buffer{}
+	placeholders := make(map[int]Placeholder)
+	escape := -1
+
+	for i := 0; i < len(snippet); i++ {
+		c := snippet[i]
+		if c == '\\' && i+1 < len(snippet) && (snippet[i+1] == '$' || snippet[i+1] == '}') {
+			i++
+			text.WriteByte(snippet[i])
+			continue
+		}
+		if c != '$' || i+1 >= len(snippet) {
+			text.WriteByte(c)
+			continue
+		}
+
+		// $n
+		j := i + 1
+		for j < len(snippet) && snippet[j] >= '0' && snippet[j] <= '9' {
+			j++
+		}
+		if j > i+1 {
+			n, _ := strconv.Atoi(snippet[i+1 : j])
+			if n == 0 {
+				escape = text.Len()
+			} else if _, exists := placeholders[n]; !exists {
+				placeholders[n] = Placeholder{Offset: text.Len()}
+			}
+			i = j - 1
+			continue
+		}
+
+		// ${n:text}
+		if snippet[i+1] == '{' {
+			end := strings.IndexByte(snippet[i:], '}')
+			colon := strings.IndexByte(snippet[i:], ':')
+			if end != -1 && colon != -1 && colon < end {
+				n, err := strconv.Atoi(snippet[i+2 : i+colon])
+				if err == nil {
+					value := snippet[i+colon+1 : i+end]
+					if _, exists := placeholders[n]; !exists && n != 0 {
+						placeholders[n] = Placeholder{Offset: text.Len(), Length: len(value)}
+					}
+					text.WriteString(value)
+					i = i + end
+					continue
+				}
+			}
+		}
+
+		text.WriteByte(c)
+	}
+
+	numbers := []int{}
+	for n := range placeholders {
+		numbers = append(numbers, n)
+	}
+	sort.Ints(numbers)
+
+	result := []Placeholder{}
+	for _, n := range numbers {
+		result = append(result, placeholders[n])
+	}
+
+	if escape == -1 {
+		escape = text.Len()
+	}
+
+	return text.String(), result, escape
+}
@@ -7,17 +7,50 @@ package main
 import (
 	"encoding/json"
 	"go/build"
+	"io/ioutil"
 	"net/http"
 	"os"
 	"path/filepath"
 	"strings"
 )
 
+// Preferences are kept at the end of the GOPATH
+func prefsFile() string {
+	gopaths := filepath.SplitList(build.Default.GOPATH)
+	return gopaths[len(gopaths)-1] + "/prefs.txt"
+}
+
+// Preferences of the user. Only the owner has those at the end of the
+// GOPATH, everyone else keeps theirs with their other data so that they
+// can't change the plugins that the owner's editor loads.
+func userPrefsFile(user string) string {
+	if isOwner(user) {
+		return prefsFile()
+	}
+	return filepath.Join(userDataDir(user), "prefs.txt")
+}
+
+// Reads all of the preference nodes of the user, there are none before the
+// first save
+func loadPrefs(user string) (map[string]map[string]string, error) {
+	prefs := make(map[string]map[string]string)
+
+	b, err := ioutil.ReadFile(userPrefsFile(user))
+	if os.IsNotExist(err) {
+		return prefs, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	err = json.Unmarshal(b, &prefs)
+	return prefs, err
+}
+
 func prefsHandler(writer http.ResponseWriter, req *http.Request, path string, pathSegs []string) bool {
 	switch {
 	case req.Method == "PUT":
-		gopaths := filepath.SplitList(build.Default.GOPATH)
-		prefFile := gopaths[len(gopaths)-1] + "/prefs.txt"
+		prefFile := userPrefsFile(requestUser(req))
 
 		var prefs map[string]map[string]string
 
@@ -86,6 +119,12 @@ func prefsHandler(writer http.ResponseWriter, req *http.Request, path string, pa
 
 		prefs[path] = prefNode
 
+		err = os.MkdirAll(filepath.Dir(prefFile), 0700)
+		if err != nil {
+			ShowError(writer, 500, "Could not create the preferences directory", err)
+			return true
+		}
+
 		file, err := os.Create(prefFile)
 
 		if err != nil {
@@ -100,8 +139,7 @@ func prefsHandler(writer http.ResponseWriter, req *http.Request, path string, pa
 		writer.WriteHeader(204)
 		return true
 	case req.Method == "DELETE":
-		gopaths := filepath.SplitList(build.Default.GOPATH)
-		prefFile := gopaths[len(gopaths)-1] + "/prefs.txt"
+		prefFile := userPrefsFile(requestUser(req))
 
 		var prefs map[string]map[string]string
 
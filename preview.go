@@ -0,0 +1,203 @@
+// Copyright 2014 Chris McGee <sirnewton_01@yahoo.ca>. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"net/http"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Workspace directory served as a website under /preview/static/<Token>/.
+// The token in the path is what grants access, so the site can be opened
+// on other devices, and the pages run in a sandbox of their own origin
+// that keeps their scripts away from the godev session.
+type StaticPreview struct {
+	Token string
+	// Workspace location of the directory
+	Location string
+	// Paths that don't exist get the index.html of the directory, for
+	//  single page applications that route in the browser
+	Spa     bool
+	User    string
+	Created int64
+	Url     string
+
+	dir string
+}
+
+var (
+	previewsMutex sync.Mutex
+	previews      = make(map[string]*StaticPreview)
+)
+
+func init() {
+	idleUserHooks = append(idleUserHooks, removePreviews)
+}
+
+func removePreviews(user string) {
+	previewsMutex.Lock()
+	defer previewsMutex.Unlock()
+
+	for token, preview := range previews {
+		if preview.User == user {
+			delete(previews, token)
+		}
+	}
+}
+
+// The token is all it takes to see the files, it can't be guessable
+func previewToken() (string, error) {
+	b := make([]byte, 16)
+	_, err := rand.Read(b)
+	return hex.EncodeToString(b), err
+}
+
+// GET /preview/static/<token>/<path> serves a file of the preview. It is
+// registered without the magic cookie check, the token stands in for it.
+func staticPreviewHandler(writer http.ResponseWriter, req *http.Request) {
+	segs := strings.SplitN(strings.TrimPrefix(req.URL.Path, "/preview/static/"), "/", 2)
+
+	previewsMutex.Lock()
+	preview := previews[segs[0]]
+	previewsMutex.Unlock()
+
+	if preview == nil || (req.Method != "GET" && req.Method != "HEAD") {
+		http.NotFound(writer, req)
+		return
+	}
+	if len(segs) == 1 {
+		http.Redirect(writer, req, requestPrefix(req)+"/preview/static/"+preview.Token+"/", http.StatusFound)
+		return
+	}
+
+	// A unique origin for the scripts of the site, which then need CORS
+	//  to fetch its own files
+	writer.Header().Set("Content-Security-Policy", "sandbox allow-scripts allow-forms allow-popups allow-modals allow-downloads")
+	writer.Header().Set("Access-Control-Allow-Origin", "*")
+	writer.Header().Set("X-Content-Type-Options", "nosniff")
+	writer.Header().Set("Cache-Control", "no-cache")
+
+	// Hidden files such as .git/config and .env stay private
+	for _, seg := range strings.Split(segs[1], "/") {
+		if strings.HasPrefix(seg, ".") {
+			http.NotFound(writer, req)
+			return
+		}
+	}
+
+	name := path.Clean("/" + segs[1])
+	p := filepath.Join(preview.dir, filepath.FromSlash(name))
+	info, err := os.Stat(p)
+	if err == nil && info.IsDir() {
+		p = filepath.Join(p, "index.html")
+		info, err = os.Stat(p)
+	}
+
+	// Routes of the application rather than its files
+	if err != nil && preview.Spa && path.Ext(name) == "" {
+		p = filepath.Join(preview.dir, "index.html")
+		info, err = os.Stat(p)
+	}
+	if err != nil || info.IsDir() {
+		http.NotFound(writer, req)
+		return
+	}
+
+	// Links in the directory can't lead out of it
+	realDir, err := filepath.EvalSymlinks(preview.dir)
+	if err == nil {
+		p, err = filepath.EvalSymlinks(p)
+	}
+	if err != nil || !strings.HasPrefix(p, realDir+string(filepath.Separator)) {
+		http.NotFound(writer, req)
+		return
+	}
+
+	f, err := os.Open(p)
+	if err != nil {
+		http.NotFound(writer, req)
+		return
+	}
+	defer f.Close()
+
+	http.ServeContent(writer, req, info.Name(), info.ModTime(), f)
+}
+
+// GET /preview lists the static previews of the user, POST /preview
+// starts one ({"Location": "/file/github.com/user/project/web", "Spa":
+// true}) and DELETE /preview/<token> stops it.
+func previewHandler(writer http.ResponseWriter, req *http.Request, path string, pathSegs []string) bool {
+	user := requestUser(req)
+
+	switch {
+	case req.Method == "GET" && (len(pathSegs) == 1 || (len(pathSegs) == 2 && pathSegs[1] == "")):
+		result := []StaticPreview{}
+
+		previewsMutex.Lock()
+		for _, preview := range previews {
+			if preview.User == user {
+				result = append(result, *preview)
+			}
+		}
+		previewsMutex.Unlock()
+
+		sort.Slice(result, func(i, j int) bool { return result[i].Created < result[j].Created })
+		ShowJson(writer, 200, result)
+		return true
+	case req.Method == "POST" && (len(pathSegs) == 1 || (len(pathSegs) == 2 && pathSegs[1] == "")):
+		preview := StaticPreview{}
+		err := json.NewDecoder(req.Body).Decode(&preview)
+		if err != nil {
+			ShowError(writer, 400, "Invalid preview", err)
+			return true
+		}
+
+		preview.dir, err = shellDir(requestSrcDirs(req), preview.Location)
+		if err != nil {
+			ShowError(writer, 400, err.Error(), nil)
+			return true
+		}
+
+		preview.Token, err = previewToken()
+		if err != nil {
+			ShowError(writer, 500, "Unable to create the token", err)
+			return true
+		}
+		preview.User = user
+		preview.Created = time.Now().Unix() * 1000
+		preview.Url = requestPrefix(req) + "/preview/static/" + preview.Token + "/"
+
+		previewsMutex.Lock()
+		previews[preview.Token] = &preview
+		previewsMutex.Unlock()
+
+		ShowJson(writer, 201, preview)
+		return true
+	case req.Method == "DELETE" && len(pathSegs) == 2:
+		previewsMutex.Lock()
+		defer previewsMutex.Unlock()
+
+		preview := previews[pathSegs[1]]
+		if preview == nil || preview.User != user {
+			ShowError(writer, 404, "No such preview", nil)
+			return true
+		}
+		delete(previews, pathSegs[1])
+
+		writer.WriteHeader(204)
+		return true
+	}
+
+	return false
+}
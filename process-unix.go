@@ -0,0 +1,22 @@
+// Copyright 2014 Chris McGee <sirnewton_01@yahoo.ca>. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+// +build linux darwin
+
+package main
+
+import (
+	"os/exec"
+	"syscall"
+)
+
+// Commands such as go and the bundle commands have children of their
+// own, a cancelled command kills its whole process group so that they don't
+// carry on and keep its output open.
+func killGroupOnCancel(cmd *exec.Cmd) {
+	cmd.SysProcAttr = &syscall.SysProcAttr{Setpgid: true}
+	cmd.Cancel = func() error {
+		return syscall.Kill(-cmd.Process.Pid, syscall.SIGKILL)
+	}
+}
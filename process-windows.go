@@ -0,0 +1,14 @@
+// Copyright 2014 Chris McGee <sirnewton_01@yahoo.ca>. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+// +build windows
+
+package main
+
+import (
+	"os/exec"
+)
+
+func killGroupOnCancel(cmd *exec.Cmd) {
+}
@@ -0,0 +1,107 @@
+// Copyright 2014 Chris McGee <sirnewton_01@yahoo.ca>. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"runtime"
+	"runtime/pprof"
+	"runtime/trace"
+	"strconv"
+	"time"
+)
+
+const (
+	maxProfileSeconds = 300
+)
+
+// Profile of the server that can be fetched
+type ProfileInfo struct {
+	Name  string
+	Count int
+}
+
+// Profiles of the godev server itself with -debug, in the format of
+// net/http/pprof so that "go tool pprof" reads them. The net/http/pprof
+// package isn't used since it puts its handlers on the default mux without
+// the check of the magic cookie.
+//
+// GET /debug/pprof lists the profiles, GET /debug/pprof/<name>?debug=<n>
+// has one of them, GET /debug/pprof/profile?seconds=<n> profiles the CPU
+// and GET /debug/pprof/trace?seconds=<n> traces the execution.
+func pprofHandler(writer http.ResponseWriter, req *http.Request, path string, pathSegs []string) bool {
+	switch {
+	case req.Method == "GET" && (len(pathSegs) == 2 || len(pathSegs) == 3 && pathSegs[2] == ""):
+		profiles := []ProfileInfo{}
+		for _, p := range pprof.Profiles() {
+			profiles = append(profiles, ProfileInfo{Name: p.Name(), Count: p.Count()})
+		}
+		profiles = append(profiles, ProfileInfo{Name: "profile"}, ProfileInfo{Name: "trace"})
+
+		ShowJson(writer, 200, profiles)
+		return true
+	case req.Method == "GET" && len(pathSegs) == 3 && (pathSegs[2] == "profile" || pathSegs[2] == "trace"):
+		seconds, err := strconv.Atoi(req.URL.Query().Get("seconds"))
+		if err != nil || seconds <= 0 {
+			seconds = 30
+			if pathSegs[2] == "trace" {
+				seconds = 1
+			}
+		}
+		if seconds > maxProfileSeconds {
+			ShowError(writer, 400, fmt.Sprintf("Profiles take at most %v seconds", maxProfileSeconds), nil)
+			return true
+		}
+
+		writer.Header().Set("Content-Type", "application/octet-stream")
+		writer.Header().Set("Content-Disposition", `attachment; filename="`+pathSegs[2]+`"`)
+
+		if pathSegs[2] == "profile" {
+			err = pprof.StartCPUProfile(writer)
+		} else {
+			err = trace.Start(writer)
+		}
+		if err != nil {
+			writer.Header().Del("Content-Disposition")
+			ShowError(writer, 409, "Already profiling", err)
+			return true
+		}
+
+		select {
+		case <-time.After(time.Duration(seconds) * time.Second):
+		case <-req.Context().Done():
+		}
+
+		if pathSegs[2] == "profile" {
+			pprof.StopCPUProfile()
+		} else {
+			trace.Stop()
+		}
+		return true
+	case req.Method == "GET" && len(pathSegs) == 3:
+		profile := pprof.Lookup(pathSegs[2])
+		if profile == nil {
+			ShowError(writer, 404, "No such profile: "+pathSegs[2], nil)
+			return true
+		}
+
+		debugLevel, _ := strconv.Atoi(req.URL.Query().Get("debug"))
+		if pathSegs[2] == "heap" && req.URL.Query().Get("gc") != "" {
+			runtime.GC()
+		}
+
+		if debugLevel > 0 {
+			writer.Header().Set("Content-Type", "text/plain; charset=utf-8")
+		} else {
+			writer.Header().Set("Content-Type", "application/octet-stream")
+			writer.Header().Set("Content-Disposition", `attachment; filename="`+pathSegs[2]+`"`)
+		}
+		profile.WriteTo(writer, debugLevel)
+		return true
+	}
+
+	return false
+}
@@ -0,0 +1,133 @@
+// Copyright 2014 Chris McGee <sirnewton_01@yahoo.ca>. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"flag"
+	"go/build"
+	"io/ioutil"
+	"os"
+	"path"
+	"path/filepath"
+	"regexp"
+	"strings"
+)
+
+// With "godev <dir>" the directory is the whole workspace instead of the
+// source directories of the GOPATH. A module is built in module mode from
+// within the directory. Any other directory gets a GOPATH of its own in the
+// data directory that has the directory at the import path of its name.
+var (
+	projectDir = ""
+	// Import path of the top of the project, e.g. the module path
+	projectImportPath = ""
+
+	moduleDirective = regexp.MustCompile(`(?m)^module\s+"?([^\s"]+)"?`)
+)
+
+// The directory of the command line, unless it is one of the commands
+func projectArg() string {
+	arg := flag.Arg(0)
+	switch arg {
+	case "", "backup", "restore", "sync", "open", "list":
+		return ""
+	}
+
+	if info, err := os.Stat(arg); err != nil || !info.IsDir() {
+		return ""
+	}
+
+	return arg
+}
+
+func openProject(dir string) error {
+	dir, err := filepath.Abs(dir)
+	if err != nil {
+		return err
+	}
+	dir, err = filepath.EvalSymlinks(dir)
+	if err != nil {
+		return err
+	}
+
+	if b, err := ioutil.ReadFile(filepath.Join(dir, "go.mod")); err == nil {
+		m := moduleDirective.FindSubmatch(b)
+		if m == nil {
+			return os.ErrInvalid
+		}
+		projectImportPath = string(m[1])
+		os.Setenv("GO111MODULE", "on")
+	} else {
+		projectImportPath = unsafeNameChars.ReplaceAllString(filepath.Base(dir), "_")
+
+		err = projectGopath(dir)
+		if err != nil {
+			return err
+		}
+		os.Setenv("GO111MODULE", "off")
+	}
+
+	// The go tool finds the module, and relative paths, from here
+	err = os.Chdir(dir)
+	if err != nil {
+		return err
+	}
+
+	projectDir = dir
+	srcDirs = []string{dir}
+	logger.Printf("Serving the project %v (%v)\n", dir, projectImportPath)
+
+	return nil
+}
+
+// Puts a GOPATH in front of the others that has the directory at its
+// import path
+func projectGopath(dir string) error {
+	sum := sha256.Sum256([]byte(dir))
+	gopath := filepath.Join(godevDataDir(), "projects", projectImportPath+"-"+hex.EncodeToString(sum[:4]))
+	link := filepath.Join(gopath, "src", projectImportPath)
+
+	if target, err := os.Readlink(link); err != nil || target != dir {
+		os.Remove(link)
+
+		err = os.MkdirAll(filepath.Dir(link), 0700)
+		if err != nil {
+			return err
+		}
+		err = os.Symlink(dir, link)
+		if err != nil {
+			return err
+		}
+	}
+
+	build.Default.GOPATH = gopath + string(filepath.ListSeparator) + build.Default.GOPATH
+	return os.Setenv("GOPATH", build.Default.GOPATH)
+}
+
+// Import path of a package given by its workspace path, which in project
+// mode is relative to the project. Other packages are left alone.
+func workspacePackage(pkg string) string {
+	if projectDir == "" || pkg == "" || strings.HasPrefix(pkg, "-") {
+		return pkg
+	}
+
+	if info, err := os.Stat(filepath.Join(projectDir, filepath.FromSlash(pkg))); err == nil && info.IsDir() {
+		return path.Join(projectImportPath, pkg)
+	}
+
+	return pkg
+}
+
+// Where new top-level folders go
+func topLevelDir() string {
+	if projectDir != "" {
+		return projectDir
+	}
+
+	gopaths := filepath.SplitList(build.Default.GOPATH)
+	return gopaths[len(gopaths)-1] + "/src"
+}
@@ -0,0 +1,181 @@
+// Copyright 2014 Chris McGee <sirnewton_01@yahoo.ca>. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"flag"
+	"net"
+	"net/http"
+	"strings"
+)
+
+// Behind a reverse proxy godev can be served under a base path, e.g.
+// https://example.com/godev/, and the browser sees the scheme and host of
+// the proxy. The proxy tells us about them with the X-Forwarded-Proto,
+// X-Forwarded-Host and X-Forwarded-Prefix headers, which are only believed
+// from the proxies that are trusted.
+var (
+	basePath       = flag.String("prefix", "", "Base path of all of the routes, e.g. /godev when a reverse proxy serves godev at /godev/ without taking the path off. (empty serves from the root)")
+	trustedProxies = flag.String("trustedProxies", "", "Addresses and CIDR ranges of the reverse proxies whose X-Forwarded-For, X-Forwarded-Proto, X-Forwarded-Host and X-Forwarded-Prefix headers are believed, separated by commas. Those of the requests on the Unix domain socket always are. (empty trusts no proxy)")
+)
+
+// The base path without the trailing slash, empty for the root
+func routePrefix() string {
+	prefix := strings.Trim(*basePath, "/")
+	if prefix == "" {
+		return ""
+	}
+
+	return "/" + prefix
+}
+
+// Takes the base path off the requests so that the handlers see the same
+// paths as without it. Anything outside of the base path doesn't exist.
+func prefixHandler(handler http.Handler) http.Handler {
+	prefix := routePrefix()
+	if prefix == "" {
+		return handler
+	}
+
+	stripped := http.StripPrefix(prefix, handler)
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch {
+		case r.URL.Path == prefix:
+			http.Redirect(w, r, prefix+"/", http.StatusMovedPermanently)
+		case strings.HasPrefix(r.URL.Path, prefix+"/"):
+			stripped.ServeHTTP(w, r)
+		default:
+			http.NotFound(w, r)
+		}
+	})
+}
+
+// Address of the other end of the connection, a proxy or the browser
+func peerIP(req *http.Request) string {
+	host, _, err := net.SplitHostPort(req.RemoteAddr)
+	if err != nil {
+		return req.RemoteAddr
+	}
+	return host
+}
+
+func trustedProxyAddress(addr string) bool {
+	ip := net.ParseIP(addr)
+	if ip == nil {
+		return false
+	}
+
+	for _, entry := range strings.Split(*trustedProxies, ",") {
+		entry = strings.TrimSpace(entry)
+		if _, network, err := net.ParseCIDR(entry); err == nil && network.Contains(ip) {
+			return true
+		}
+		if proxyIP := net.ParseIP(entry); proxyIP != nil && proxyIP.Equal(ip) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// Whether the request comes from a proxy that is trusted. Anybody else
+// could pick the domain of the login cookie and where the redirects go.
+func trustedProxy(req *http.Request) bool {
+	return socketPath != "" || trustedProxyAddress(peerIP(req))
+}
+
+// Values of a forwarded header from the first proxy to the last one, each
+// proxy in a chain appends its own
+func forwardedValues(req *http.Request, name string) []string {
+	values := []string{}
+	for _, header := range req.Header.Values(name) {
+		for _, value := range strings.Split(header, ",") {
+			values = append(values, strings.TrimSpace(value))
+		}
+	}
+
+	return values
+}
+
+// Value of a forwarded header that the nearest proxy set, those before it
+// are whatever the client sent. The headers of clients that aren't trusted
+// proxies are ignored.
+func forwardedHeader(req *http.Request, name string) string {
+	if !trustedProxy(req) {
+		return ""
+	}
+
+	values := forwardedValues(req, name)
+	if len(values) == 0 {
+		return ""
+	}
+
+	return values[len(values)-1]
+}
+
+// Address of the browser. Behind trusted proxies it is the last address of
+// X-Forwarded-For that isn't one of them, so that clients have rate limits
+// and login failures of their own.
+func clientIP(req *http.Request) string {
+	ip := peerIP(req)
+	if !trustedProxy(req) {
+		return ip
+	}
+
+	forwardedFor := forwardedValues(req, "X-Forwarded-For")
+	for idx := len(forwardedFor) - 1; idx >= 0; idx-- {
+		if forwardedFor[idx] == "" {
+			break
+		}
+		ip = forwardedFor[idx]
+		if !trustedProxyAddress(ip) {
+			break
+		}
+	}
+
+	return ip
+}
+
+// Scheme that the browser used
+func requestScheme(req *http.Request) string {
+	if proto := forwardedHeader(req, "X-Forwarded-Proto"); proto == "http" || proto == "https" {
+		return proto
+	}
+	if req.TLS != nil {
+		return "https"
+	}
+
+	return "http"
+}
+
+// Host and port that the browser reached
+func requestHost(req *http.Request) string {
+	if host := forwardedHeader(req, "X-Forwarded-Host"); host != "" {
+		return host
+	}
+
+	return req.Host
+}
+
+// URL of the path of godev as the browser sees it
+func externalUrl(req *http.Request, path string) string {
+	return requestScheme(req) + "://" + requestHost(req) + requestPrefix(req) + path
+}
+
+// The cookie with the magic key of a login, which only goes to godev's
+// part of the proxy's host and which scripts can't read
+func sessionCookie(req *http.Request, key string) *http.Cookie {
+	domain := hostName
+	if host := forwardedHeader(req, "X-Forwarded-Host"); host != "" {
+		domain = host
+		if h, _, err := net.SplitHostPort(host); err == nil {
+			domain = h
+		}
+	}
+
+	return &http.Cookie{Name: "MAGIC" + *port, Value: key,
+		Path: requestPrefix(req) + "/", Domain: domain, MaxAge: 2000000,
+		Secure: requestScheme(req) == "https" || hostName != loopbackHost, HttpOnly: true}
+}
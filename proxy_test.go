@@ -0,0 +1,54 @@
+// Copyright 2014 Chris McGee <sirnewton_01@yahoo.ca>. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"net/http/httptest"
+	"testing"
+)
+
+func TestForwardedHeaders(t *testing.T) {
+	defer func(proxies string) { *trustedProxies = proxies }(*trustedProxies)
+	*trustedProxies = "10.0.0.1, 192.168.0.0/24"
+
+	tests := []struct {
+		remoteAddr   string
+		forwardedFor []string
+		host         string
+		clientIP     string
+		forwardHost  string
+	}{
+		{"203.0.113.5:1234", nil, "", "203.0.113.5", ""},
+		// Anybody can send the headers
+		{"203.0.113.5:1234", []string{"198.51.100.7"}, "evil.example.com", "203.0.113.5", ""},
+		{"10.0.0.1:1234", nil, "godev.example.com", "10.0.0.1", "godev.example.com"},
+		{"10.0.0.1:1234", []string{"198.51.100.7"}, "godev.example.com", "198.51.100.7", "godev.example.com"},
+		// The proxy appends to what the client sent
+		{"10.0.0.1:1234", []string{"1.2.3.4, 198.51.100.7"}, "evil.example.com, godev.example.com", "198.51.100.7", "godev.example.com"},
+		{"10.0.0.1:1234", []string{"1.2.3.4", "198.51.100.7"}, "evil.example.com, godev.example.com", "198.51.100.7", "godev.example.com"},
+		// A chain of trusted proxies
+		{"10.0.0.1:1234", []string{"1.2.3.4, 198.51.100.7, 192.168.0.9"}, "", "198.51.100.7", ""},
+		{"10.0.0.1:1234", []string{"192.168.0.9"}, "", "192.168.0.9", ""},
+		{"[2001:db8::1]:1234", []string{"198.51.100.7"}, "", "2001:db8::1", ""},
+	}
+
+	for _, test := range tests {
+		req := httptest.NewRequest("GET", "/workspace", nil)
+		req.RemoteAddr = test.remoteAddr
+		for _, value := range test.forwardedFor {
+			req.Header.Add("X-Forwarded-For", value)
+		}
+		if test.host != "" {
+			req.Header.Set("X-Forwarded-Host", test.host)
+		}
+
+		if ip := clientIP(req); ip != test.clientIP {
+			t.Errorf("%v %v: the client is %v, expected %v", test.remoteAddr, test.forwardedFor, ip, test.clientIP)
+		}
+		if host := forwardedHeader(req, "X-Forwarded-Host"); host != test.forwardHost {
+			t.Errorf("%v %v: the host is %v, expected %v", test.remoteAddr, test.host, host, test.forwardHost)
+		}
+	}
+}
@@ -0,0 +1,74 @@
+// Copyright 2014 Chris McGee <sirnewton_01@yahoo.ca>. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"sync"
+	"time"
+)
+
+// Requests of each client in remote mode are limited by a token bucket, so
+// that one noisy client can't lock out everyone else. The limit also slows
+// down anyone trying to brute force the magic key.
+type tokenBucket struct {
+	tokens float64
+	last   time.Time
+}
+
+var (
+	rateLimitMutex sync.Mutex
+	rateBuckets    = make(map[string]*tokenBucket)
+	ratePerSecond  = defaultRatePerSecond
+	rateBurst      = defaultRateBurst
+)
+
+func setRateLimit(rate int, burst int) {
+	rateLimitMutex.Lock()
+	defer rateLimitMutex.Unlock()
+
+	ratePerSecond = rate
+	rateBurst = burst
+}
+
+// Takes a token of the client's bucket. If there is none it returns how long
+// until there is one.
+func takeRateToken(client string) time.Duration {
+	rateLimitMutex.Lock()
+	defer rateLimitMutex.Unlock()
+
+	now := time.Now()
+	bucket := rateBuckets[client]
+	if bucket == nil {
+		bucket = &tokenBucket{tokens: float64(rateBurst), last: now}
+		rateBuckets[client] = bucket
+	}
+
+	bucket.tokens += now.Sub(bucket.last).Seconds() * float64(ratePerSecond)
+	if bucket.tokens > float64(rateBurst) {
+		bucket.tokens = float64(rateBurst)
+	}
+	bucket.last = now
+
+	if bucket.tokens < 1 {
+		return time.Duration((1 - bucket.tokens) / float64(ratePerSecond) * float64(time.Second))
+	}
+
+	bucket.tokens--
+	return 0
+}
+
+// Forgets the clients whose buckets have filled up again, they are no
+// different from new ones
+func pruneRateBuckets() {
+	rateLimitMutex.Lock()
+	defer rateLimitMutex.Unlock()
+
+	full := time.Duration(float64(rateBurst) / float64(ratePerSecond) * float64(time.Second))
+	for client, bucket := range rateBuckets {
+		if time.Since(bucket.last) > full {
+			delete(rateBuckets, client)
+		}
+	}
+}
@@ -0,0 +1,67 @@
+// Copyright 2014 Chris McGee <sirnewton_01@yahoo.ca>. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestTakeRateToken(t *testing.T) {
+	defer setRateLimit(ratePerSecond, rateBurst)
+
+	tests := []struct {
+		name  string
+		rate  int
+		burst int
+		// Tokens taken in a row, then the time that passes before the last one
+		taken   int
+		elapsed time.Duration
+		limited bool
+	}{
+		{"first request", 10, 5, 0, 0, false},
+		{"within the burst", 10, 5, 4, 0, false},
+		{"burst used up", 10, 5, 5, 0, true},
+		{"refilled", 10, 5, 5, 200 * time.Millisecond, false},
+		{"partly refilled", 1, 5, 5, 500 * time.Millisecond, true},
+		{"refill capped by the burst", 10, 2, 2, time.Hour, false},
+		{"no burst", 10, 0, 0, 0, true},
+	}
+
+	for _, test := range tests {
+		setRateLimit(test.rate, test.burst)
+		client := "test " + test.name
+
+		for i := 0; i < test.taken; i++ {
+			if wait := takeRateToken(client); wait != 0 {
+				t.Fatalf("%v: token %v was refused for %v", test.name, i, wait)
+			}
+		}
+
+		rateLimitMutex.Lock()
+		if bucket := rateBuckets[client]; bucket != nil {
+			bucket.last = bucket.last.Add(-test.elapsed)
+		}
+		rateLimitMutex.Unlock()
+
+		wait := takeRateToken(client)
+		if test.limited && (wait <= 0 || wait > time.Second/time.Duration(test.rate)) {
+			t.Errorf("%v: waits %v, expected up to %v", test.name, wait, time.Second/time.Duration(test.rate))
+		}
+		if !test.limited && wait != 0 {
+			t.Errorf("%v: waits %v, expected a token", test.name, wait)
+		}
+	}
+
+	// The capped bucket has only its burst left
+	client := "test refill capped by the burst"
+	setRateLimit(10, 2)
+	if wait := takeRateToken(client); wait != 0 {
+		t.Errorf("The second token of the capped burst waits %v", wait)
+	}
+	if wait := takeRateToken(client); wait == 0 {
+		t.Errorf("The capped bucket has more than its burst")
+	}
+}
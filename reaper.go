@@ -0,0 +1,177 @@
+// Copyright 2014 Chris McGee <sirnewton_01@yahoo.ca>. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"io"
+	"net/http"
+	"os/exec"
+	"sort"
+	"sync"
+	"time"
+)
+
+// A process launched on behalf of a browser session (debug target, terminal,
+// test run) that must not outlive the session.
+type ChildProcess struct {
+	Id           string
+	User         string
+	Kind         string
+	Command      string
+	Started      int64
+	LastActivity int64
+
+	cmd  *exec.Cmd
+	conn io.Closer
+}
+
+const (
+	// User of the processes that the server shares between its users, which
+	//  none of them can list or kill
+	serverProcessUser = ""
+)
+
+var (
+	processesMutex sync.Mutex
+	childProcesses = make(map[string]*ChildProcess)
+
+	userActivityMutex sync.Mutex
+	userActivity      = make(map[string]time.Time)
+
+	// Functions to release whatever a user holds once they have gone idle
+	idleUserHooks = []func(user string){}
+)
+
+func registerProcess(user string, kind string, cmd *exec.Cmd, conn io.Closer) *ChildProcess {
+	now := time.Now().Unix() * 1000
+	p := &ChildProcess{Id: newId(), User: user, Kind: kind, Command: cmd.Path,
+		Started: now, LastActivity: now, cmd: cmd, conn: conn}
+
+	processesMutex.Lock()
+	childProcesses[p.Id] = p
+	processesMutex.Unlock()
+
+	return p
+}
+
+// Records traffic on the session, which also keeps its user active
+func (p *ChildProcess) touch() {
+	now := time.Now()
+
+	processesMutex.Lock()
+	p.LastActivity = now.Unix() * 1000
+	processesMutex.Unlock()
+
+	if p.User == serverProcessUser {
+		return
+	}
+
+	userActivityMutex.Lock()
+	userActivity[p.User] = now
+	userActivityMutex.Unlock()
+}
+
+func (p *ChildProcess) unregister() {
+	processesMutex.Lock()
+	delete(childProcesses, p.Id)
+	processesMutex.Unlock()
+}
+
+// Terminates the process and closes the connection of its session
+func (p *ChildProcess) kill() {
+	logger.Printf("REAPING %v PROCESS %v FOR %v\n", p.Kind, p.Command, p.User)
+
+	if p.cmd.Process != nil {
+		p.cmd.Process.Kill()
+	}
+	if p.conn != nil {
+		p.conn.Close()
+	}
+	p.unregister()
+}
+
+func listProcesses(user string) []ChildProcess {
+	processesMutex.Lock()
+	defer processesMutex.Unlock()
+
+	result := []ChildProcess{}
+	for _, p := range childProcesses {
+		if user == "" || p.User == user {
+			result = append(result, *p)
+		}
+	}
+
+	sort.Slice(result, func(i, j int) bool { return result[i].Started < result[j].Started })
+	return result
+}
+
+func findProcess(id string) *ChildProcess {
+	processesMutex.Lock()
+	defer processesMutex.Unlock()
+
+	return childProcesses[id]
+}
+
+func touchUser(r *http.Request) {
+	user := requestUser(r)
+
+	userActivityMutex.Lock()
+	userActivity[user] = time.Now()
+	userActivityMutex.Unlock()
+}
+
+// Periodically terminates the processes of sessions that have seen no
+// traffic within the timeout and releases the resources of idle users.
+func startReaper(timeout time.Duration) {
+	if timeout <= 0 {
+		return
+	}
+
+	go func() {
+		for {
+			<-time.After(timeout / 10)
+			reap(time.Now().Add(-timeout))
+		}
+	}()
+}
+
+func reap(deadline time.Time) {
+	idleUsers := []string{}
+
+	userActivityMutex.Lock()
+	for user, last := range userActivity {
+		if last.Before(deadline) {
+			idleUsers = append(idleUsers, user)
+			delete(userActivity, user)
+		}
+	}
+	userActivityMutex.Unlock()
+
+	isIdle := make(map[string]bool)
+	for _, user := range idleUsers {
+		isIdle[user] = true
+	}
+
+	stale := []*ChildProcess{}
+
+	processesMutex.Lock()
+	for _, p := range childProcesses {
+		if isIdle[p.User] || p.LastActivity < deadline.Unix()*1000 {
+			stale = append(stale, p)
+		}
+	}
+	processesMutex.Unlock()
+
+	for _, p := range stale {
+		p.kill()
+	}
+
+	for _, user := range idleUsers {
+		logger.Printf("USER %v IS IDLE\n", user)
+		for _, hook := range idleUserHooks {
+			hook(user)
+		}
+	}
+}
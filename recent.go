@@ -0,0 +1,221 @@
+// Copyright 2014 Chris McGee <sirnewton_01@yahoo.ca>. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"path"
+	"sort"
+	"time"
+)
+
+const (
+	maxRecentFiles   = 50
+	maxHistoryLength = 100
+)
+
+type RecentFile struct {
+	Location string
+	Name     string
+	Opened   int64
+	Edited   int64
+	Pinned   bool
+}
+
+type HistoryEntry struct {
+	Location string
+	Line     int
+}
+
+type RecentData struct {
+	Files []RecentFile
+	// Back/forward navigation, Index points to the current entry
+	History []HistoryEntry
+	Index   int
+}
+
+func loadRecent(user string) (*RecentData, error) {
+	data := &RecentData{Files: []RecentFile{}, History: []HistoryEntry{}, Index: -1}
+	err := loadUserData(user, "recent", data)
+
+	if data.Index >= len(data.History) || data.Index < -1 {
+		data.Index = len(data.History) - 1
+	}
+
+	return data, err
+}
+
+// Records that a file was opened or edited so that it shows up in the
+// recently used list on every device of the user.
+func recordRecentFile(user string, location string, edited bool) {
+	userDataMutex.Lock()
+	defer userDataMutex.Unlock()
+
+	data, err := loadRecent(user)
+	if err != nil {
+		logger.Printf("Unable to load recent files: %v\n", err)
+		return
+	}
+
+	now := time.Now().Unix() * 1000
+	entry := RecentFile{Location: location, Name: path.Base(location)}
+
+	for idx := range data.Files {
+		if data.Files[idx].Location == location {
+			entry = data.Files[idx]
+			data.Files = append(data.Files[:idx], data.Files[idx+1:]...)
+			break
+		}
+	}
+
+	if edited {
+		entry.Edited = now
+	} else {
+		entry.Opened = now
+	}
+
+	data.Files = append([]RecentFile{entry}, data.Files...)
+
+	// Drop the oldest unpinned entries once the list is full
+	for idx := len(data.Files) - 1; idx >= 0 && len(data.Files) > maxRecentFiles; idx-- {
+		if !data.Files[idx].Pinned {
+			data.Files = append(data.Files[:idx], data.Files[idx+1:]...)
+		}
+	}
+
+	err = saveUserData(user, "recent", data)
+	if err != nil {
+		logger.Printf("Unable to save recent files: %v\n", err)
+		return
+	}
+
+	publishEvent(Event{Type: "recent", User: user, Data: entry})
+}
+
+func recentHandler(writer http.ResponseWriter, req *http.Request, path string, pathSegs []string) bool {
+	user := requestUser(req)
+
+	userDataMutex.Lock()
+	defer userDataMutex.Unlock()
+
+	data, err := loadRecent(user)
+	if err != nil {
+		ShowError(writer, 500, "Unable to load recent files", err)
+		return true
+	}
+
+	isHistory := len(pathSegs) > 1 && pathSegs[1] == "history"
+
+	switch {
+	case req.Method == "GET" && len(pathSegs) == 1:
+		files := data.Files
+
+		// Pinned files stay at the top, the rest is most recent first
+		sort.SliceStable(files, func(i, j int) bool {
+			return files[i].Pinned && !files[j].Pinned
+		})
+
+		ShowJson(writer, 200, files)
+		return true
+	case req.Method == "PUT" && len(pathSegs) == 1:
+		update := RecentFile{}
+		err := json.NewDecoder(req.Body).Decode(&update)
+		if err != nil || update.Location == "" {
+			ShowError(writer, 400, "Invalid recent file", err)
+			return true
+		}
+
+		for idx := range data.Files {
+			if data.Files[idx].Location == update.Location {
+				data.Files[idx].Pinned = update.Pinned
+				update = data.Files[idx]
+
+				if !saveRecent(writer, user, data) {
+					return true
+				}
+
+				publishEvent(Event{Type: "recent", User: user, Data: update})
+				ShowJson(writer, 200, update)
+				return true
+			}
+		}
+
+		ShowError(writer, 404, "File is not in the recent list", nil)
+		return true
+	case req.Method == "DELETE" && len(pathSegs) == 1:
+		location := req.URL.Query().Get("location")
+		files := []RecentFile{}
+
+		// Without a location all of the unpinned files are cleared
+		for _, f := range data.Files {
+			if (location == "" && f.Pinned) || (location != "" && f.Location != location) {
+				files = append(files, f)
+			}
+		}
+
+		data.Files = files
+		if !saveRecent(writer, user, data) {
+			return true
+		}
+
+		writer.WriteHeader(204)
+		return true
+	case req.Method == "GET" && isHistory && len(pathSegs) == 2:
+		ShowJson(writer, 200, data)
+		return true
+	case req.Method == "POST" && isHistory && len(pathSegs) == 2:
+		entry := HistoryEntry{}
+		err := json.NewDecoder(req.Body).Decode(&entry)
+		if err != nil || entry.Location == "" {
+			ShowError(writer, 400, "Invalid history entry", err)
+			return true
+		}
+
+		// Navigating somewhere new discards the forward history
+		data.History = append(data.History[:data.Index+1], entry)
+		if len(data.History) > maxHistoryLength {
+			data.History = data.History[len(data.History)-maxHistoryLength:]
+		}
+		data.Index = len(data.History) - 1
+
+		if !saveRecent(writer, user, data) {
+			return true
+		}
+
+		ShowJson(writer, 201, entry)
+		return true
+	case req.Method == "POST" && isHistory && len(pathSegs) == 3 && (pathSegs[2] == "back" || pathSegs[2] == "forward"):
+		index := data.Index + 1
+		if pathSegs[2] == "back" {
+			index = data.Index - 1
+		}
+
+		if index < 0 || index >= len(data.History) {
+			ShowJson(writer, 204, "No more history")
+			return true
+		}
+
+		data.Index = index
+		if !saveRecent(writer, user, data) {
+			return true
+		}
+
+		ShowJson(writer, 200, data.History[index])
+		return true
+	}
+
+	return false
+}
+
+func saveRecent(writer http.ResponseWriter, user string, data *RecentData) bool {
+	err := saveUserData(user, "recent", data)
+	if err != nil {
+		ShowError(writer, 500, "Unable to save recent files", err)
+		return false
+	}
+
+	return true
+}
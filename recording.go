@@ -0,0 +1,367 @@
+// Copyright 2014 Chris McGee <sirnewton_01@yahoo.ca>. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"flag"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+	"unicode/utf8"
+
+	"code.google.com/p/go.net/websocket"
+)
+
+const (
+	recordingWidth  = 80
+	recordingHeight = 24
+	// Longest pause of a playback unless the client asks for another
+	defaultMaxIdle = 2 * time.Second
+)
+
+// Terminal session that was recorded in the asciicast v2 format of
+// asciinema, one JSON header line followed by one [time, "o", data] line
+// for each output of the terminal. The input isn't recorded, it would have
+// the passwords that are typed.
+type Recording struct {
+	Id    string
+	Title string
+	// Milliseconds since the epoch
+	Started int64
+	// Seconds of the session
+	Duration float64
+	Size     int64
+}
+
+type recordingHeader struct {
+	Version   int    `json:"version"`
+	Width     int    `json:"width"`
+	Height    int    `json:"height"`
+	Timestamp int64  `json:"timestamp"`
+	Title     string `json:"title,omitempty"`
+}
+
+type terminalRecorder struct {
+	mutex   sync.Mutex
+	file    *os.File
+	start   time.Time
+	partial []byte
+}
+
+var (
+	recordTerminals = flag.Bool("recordTerminals", false, "Record every terminal session, otherwise only those that ask for it.")
+
+	recordingIdPattern = regexp.MustCompile(`^[0-9a-f]+$`)
+
+	// Files of the terminals that are being recorded
+	recordingsMutex  sync.Mutex
+	activeRecordings = make(map[string]bool)
+)
+
+func init() {
+	registerGcTask("recordings", gcRecordings)
+}
+
+func recordingsDir(user string) string {
+	return filepath.Join(godevDataDir(), "recordings", unsafeNameChars.ReplaceAllString(user, "_"))
+}
+
+func recordingFile(user string, id string) string {
+	return filepath.Join(recordingsDir(user), id+".cast")
+}
+
+// Starts the recording of a terminal session of the user
+func startRecording(user string, title string) (*terminalRecorder, error) {
+	err := os.MkdirAll(recordingsDir(user), 0700)
+	if err != nil {
+		return nil, err
+	}
+
+	file, err := os.OpenFile(recordingFile(user, newId()), os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0600)
+	if err != nil {
+		return nil, err
+	}
+
+	recordingsMutex.Lock()
+	activeRecordings[file.Name()] = true
+	recordingsMutex.Unlock()
+
+	r := &terminalRecorder{file: file, start: time.Now()}
+	b, err := json.Marshal(recordingHeader{Version: 2, Width: recordingWidth, Height: recordingHeight,
+		Timestamp: r.start.Unix(), Title: title})
+	if err != nil {
+		r.close()
+		return nil, err
+	}
+	_, err = file.Write(append(b, '\n'))
+	if err != nil {
+		r.close()
+		return nil, err
+	}
+
+	return r, nil
+}
+
+// Records output of the terminal, a character that is split over two
+// outputs is recorded with the second one
+func (r *terminalRecorder) output(data []byte) {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	data = append(r.partial, data...)
+	end := len(data)
+	for i := len(data) - 1; i >= 0 && i >= len(data)-utf8.UTFMax; i-- {
+		if utf8.RuneStart(data[i]) {
+			if !utf8.FullRune(data[i:]) {
+				end = i
+			}
+			break
+		}
+	}
+	r.partial = append([]byte{}, data[end:]...)
+	if end == 0 {
+		return
+	}
+
+	elapsed := time.Since(r.start).Seconds()
+	b, err := json.Marshal([]interface{}{elapsed, "o", string(data[:end])})
+	if err != nil {
+		return
+	}
+	r.file.Write(append(b, '\n'))
+}
+
+func (r *terminalRecorder) close() {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	r.file.Close()
+
+	recordingsMutex.Lock()
+	delete(activeRecordings, r.file.Name())
+	recordingsMutex.Unlock()
+}
+
+// The recordings are all that is kept of the terminals' output, those of
+// the terminals that are still open stay
+func gcRecordings(cutoff time.Time, result *GcResult) error {
+	dirs, err := ioutil.ReadDir(filepath.Join(godevDataDir(), "recordings"))
+	if err != nil && !os.IsNotExist(err) {
+		return err
+	}
+
+	for _, dir := range dirs {
+		dirPath := filepath.Join(godevDataDir(), "recordings", dir.Name())
+		infos, _ := ioutil.ReadDir(dirPath)
+		for _, info := range infos {
+			p := filepath.Join(dirPath, info.Name())
+
+			recordingsMutex.Lock()
+			active := activeRecordings[p]
+			recordingsMutex.Unlock()
+
+			if info.ModTime().Before(cutoff) && !active {
+				gcRemove(p, result)
+			}
+		}
+	}
+
+	return nil
+}
+
+func readRecording(user string, id string) (Recording, error) {
+	recording := Recording{Id: id}
+
+	file, err := os.Open(recordingFile(user, id))
+	if err != nil {
+		return recording, err
+	}
+	defer file.Close()
+
+	info, err := file.Stat()
+	if err != nil {
+		return recording, err
+	}
+
+	header := recordingHeader{}
+	line, err := bufio.NewReader(file).ReadBytes('\n')
+	if err != nil {
+		return recording, err
+	}
+	err = json.Unmarshal(line, &header)
+	if err != nil {
+		return recording, err
+	}
+
+	recording.Title = header.Title
+	recording.Started = header.Timestamp * 1000
+	recording.Duration = info.ModTime().Sub(time.Unix(header.Timestamp, 0)).Seconds()
+	recording.Size = info.Size()
+
+	return recording, nil
+}
+
+func listRecordings(user string) ([]Recording, error) {
+	recordings := []Recording{}
+
+	names, err := ioutil.ReadDir(recordingsDir(user))
+	if os.IsNotExist(err) {
+		return recordings, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	for _, info := range names {
+		if filepath.Ext(info.Name()) != ".cast" {
+			continue
+		}
+		recording, err := readRecording(user, info.Name()[:len(info.Name())-len(".cast")])
+		if err != nil {
+			continue
+		}
+		recordings = append(recordings, recording)
+	}
+
+	sort.Slice(recordings, func(i, j int) bool {
+		return recordings[i].Started > recordings[j].Started
+	})
+
+	return recordings, nil
+}
+
+// GET /terminal/recordings lists the recordings of the user, GET
+// /terminal/recordings/<id> downloads one as an asciicast file and DELETE
+// removes it. /terminal/play?id=<id> plays one back over a WebSocket.
+func terminalRecordingsHandler(writer http.ResponseWriter, req *http.Request, path string, pathSegs []string) bool {
+	user := requestUser(req)
+
+	switch {
+	case req.Method == "GET" && len(pathSegs) == 2 && pathSegs[1] == "recordings":
+		recordings, err := listRecordings(user)
+		if err != nil {
+			ShowError(writer, 500, "Unable to list the recordings", err)
+			return true
+		}
+
+		ShowJson(writer, 200, recordings)
+		return true
+	case req.Method == "GET" && len(pathSegs) == 3 && pathSegs[1] == "recordings":
+		id := pathSegs[2]
+		if !recordingIdPattern.MatchString(id) {
+			ShowError(writer, 404, "No such recording", nil)
+			return true
+		}
+
+		file, err := os.Open(recordingFile(user, id))
+		if err != nil {
+			ShowError(writer, 404, "No such recording", err)
+			return true
+		}
+		defer file.Close()
+
+		info, err := file.Stat()
+		if err != nil {
+			ShowError(writer, 500, "Unable to read the recording", err)
+			return true
+		}
+
+		writer.Header().Set("Content-Type", "application/x-asciicast")
+		writer.Header().Set("Content-Disposition", `attachment; filename="`+id+`.cast"`)
+		http.ServeContent(writer, req, id+".cast", info.ModTime(), file)
+		return true
+	case req.Method == "DELETE" && len(pathSegs) == 3 && pathSegs[1] == "recordings":
+		id := pathSegs[2]
+		if !recordingIdPattern.MatchString(id) {
+			ShowError(writer, 404, "No such recording", nil)
+			return true
+		}
+
+		err := os.Remove(recordingFile(user, id))
+		if os.IsNotExist(err) {
+			ShowError(writer, 404, "No such recording", err)
+			return true
+		}
+		if err != nil {
+			ShowError(writer, 500, "Unable to remove the recording", err)
+			return true
+		}
+
+		ShowJson(writer, 200, map[string]string{"Id": id})
+		return true
+	}
+
+	return false
+}
+
+// Plays a recording back with its timing, faster with ?speed=<factor>.
+// Pauses are cut to ?maxIdle=<duration>, two seconds unless given.
+func recordingPlaySocket(ws *websocket.Conn) {
+	defer ws.Close()
+
+	query := ws.Request().URL.Query()
+	id := query.Get("id")
+	if !recordingIdPattern.MatchString(id) {
+		return
+	}
+
+	speed := 1.0
+	if s, err := strconv.ParseFloat(query.Get("speed"), 64); err == nil && s > 0 {
+		speed = s
+	}
+	maxIdle := defaultMaxIdle
+	if d, err := time.ParseDuration(query.Get("maxIdle")); err == nil && d > 0 {
+		maxIdle = d
+	}
+
+	file, err := os.Open(recordingFile(requestUser(ws.Request()), id))
+	if err != nil {
+		ws.Write([]byte("No such recording\r\n"))
+		return
+	}
+	defer file.Close()
+
+	scanner := bufio.NewScanner(file)
+	scanner.Buffer(make([]byte, 64*1024), 16*1024*1024)
+
+	// The header
+	if !scanner.Scan() {
+		return
+	}
+
+	last := 0.0
+	for scanner.Scan() {
+		event := []interface{}{}
+		if json.Unmarshal(scanner.Bytes(), &event) != nil || len(event) != 3 {
+			continue
+		}
+		at, ok := event[0].(float64)
+		kind, _ := event[1].(string)
+		data, _ := event[2].(string)
+		if !ok || kind != "o" {
+			continue
+		}
+
+		wait := time.Duration((at - last) / speed * float64(time.Second))
+		if wait > maxIdle {
+			wait = maxIdle
+		}
+		last = at
+		time.Sleep(wait)
+
+		_, err := ws.Write([]byte(data))
+		if err != nil {
+			return
+		}
+	}
+}
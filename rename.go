@@ -0,0 +1,172 @@
+// Copyright 2014 Chris McGee <sirnewton_01@yahoo.ca>. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"go/token"
+	"io"
+	"net/http"
+	"os"
+	"os/exec"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+type RenameResult struct {
+	// Workspace locations of the files that change, so that the editor
+	//  can reload them
+	Files     []string
+	Locations []RenameLocation
+	// The files were written, it was not a dry run
+	Applied bool
+	// Summary of gorename, such as "Renamed 4 occurrences in 2 files in 1 package."
+	Message string `json:",omitempty"`
+}
+
+// Line that has an occurrence of the identifier before the rename
+type RenameLocation struct {
+	Location string
+	Line     int64
+	Text     string
+}
+
+var (
+	renameHunk = regexp.MustCompile(`^@@ -(\d+)(?:,\d+)? \+\d+(?:,\d+)? @@`)
+)
+
+// Reads the unified diffs that gorename -d prints for each file it changes
+func parseRenameDiff(output []byte) RenameResult {
+	result := RenameResult{Files: []string{}, Locations: []RenameLocation{}}
+
+	location := ""
+	line := int64(0)
+
+	scanner := bufio.NewScanner(bytes.NewReader(output))
+	for scanner.Scan() {
+		text := scanner.Text()
+
+		switch {
+		case strings.HasPrefix(text, "--- "):
+			// The original file, the tab separates the timestamp
+			file := strings.SplitN(text[4:], "\t", 2)[0]
+			location = workspaceLocation(file)
+			if location != "" {
+				result.Files = append(result.Files, location)
+			}
+		case strings.HasPrefix(text, "+++ "):
+		case renameHunk.MatchString(text):
+			line, _ = strconv.ParseInt(renameHunk.FindStringSubmatch(text)[1], 10, 64)
+		case strings.HasPrefix(text, "-"):
+			if location != "" {
+				result.Locations = append(result.Locations, RenameLocation{location, line, text[1:]})
+			}
+			line++
+		case strings.HasPrefix(text, " "):
+			line++
+		}
+	}
+
+	return result
+}
+
+// Runs a tool of the GOPATH era such as gorename or guru in GOPATH mode,
+// which is how they find the packages of the workspace. Besides the output
+// it returns what the tool printed on stderr.
+func runGopathTool(req *http.Request, stdin io.Reader, tool string, args ...string) ([]byte, string, error) {
+	ctx, cancel := operationContext(req, *buildTimeout)
+	defer cancel()
+
+	cmd := exec.CommandContext(ctx, tool, args...)
+	cmd.Env = append(os.Environ(), "GO111MODULE=off")
+	cmd.Stdin = stdin
+	stderr := &bytes.Buffer{}
+	cmd.Stderr = stderr
+
+	output, err := cmd.Output()
+	if ctx.Err() != nil {
+		return output, stderr.String(), ctx.Err()
+	}
+
+	return output, stderr.String(), err
+}
+
+func showGopathToolError(writer http.ResponseWriter, tool string, stderr string, err error) {
+	if _, ok := err.(*exec.ExitError); ok {
+		// Why the tool refused, such as a conflict with another declaration
+		msg := strings.TrimSpace(stderr)
+		if msg == "" {
+			msg = tool + " failed: " + err.Error()
+		}
+		ShowError(writer, 400, msg, nil)
+		return
+	}
+
+	if strings.Contains(strings.ToLower(err.Error()), "not found") {
+		// Executable was not found, inform the user
+		ShowError(writer, 400, strings.ToUpper(tool[:1])+tool[1:]+" tool not found", err)
+		return
+	}
+
+	ShowError(writer, 500, "Error running "+tool, err)
+}
+
+// POST /go/rename/file/<location>?o=<byte offset>&to=<name> renames the
+// identifier at the offset of the saved file everywhere in the GOPATH and
+// returns the files that changed. With dryRun=true nothing is written, the
+// result has the lines that would change.
+func renameHandler(writer http.ResponseWriter, req *http.Request, path string, pathSegs []string) bool {
+	switch {
+	case req.Method == "POST" && len(pathSegs) > 3 && pathSegs[2] == "file":
+		query := req.URL.Query()
+		offset, err := strconv.ParseInt(query.Get("o"), 10, 64)
+		if err != nil || offset < 0 {
+			ShowError(writer, 400, "Invalid offset: "+query.Get("o"), nil)
+			return true
+		}
+		to := query.Get("to")
+		if !token.IsIdentifier(to) {
+			ShowError(writer, 400, "Invalid identifier: "+to, nil)
+			return true
+		}
+		if pathSegs[3] == "GOROOT" {
+			ShowError(writer, 400, "The standard library can't be changed", nil)
+			return true
+		}
+
+		p, err := bufferPath(requestSrcDirs(req), pathSegs)
+		if err != nil {
+			ShowError(writer, 400, err.Error(), nil)
+			return true
+		}
+
+		args := []string{"-offset", p + ":#" + strconv.FormatInt(offset, 10), "-to", to}
+
+		// The diffs tell which files are changed, also when applying
+		output, stderr, err := runGopathTool(req, nil, "gorename", append([]string{"-d"}, args...)...)
+		if err != nil {
+			showGopathToolError(writer, "gorename", stderr, err)
+			return true
+		}
+		result := parseRenameDiff(output)
+
+		if query.Get("dryRun") != "true" {
+			output, stderr, err = runGopathTool(req, nil, "gorename", args...)
+			if err != nil {
+				showGopathToolError(writer, "gorename", stderr, err)
+				return true
+			}
+			result.Applied = true
+			result.Message = strings.TrimSpace(string(output) + stderr)
+		}
+
+		ShowJson(writer, 200, result)
+		return true
+	}
+
+	return false
+}
@@ -0,0 +1,494 @@
+// Copyright 2014 Chris McGee <sirnewton_01@yahoo.ca>. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"go/ast"
+	"go/parser"
+	"go/token"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+
+	"code.google.com/p/go.net/websocket"
+)
+
+// Session of the REPL. Every input is compiled into a program along with
+// the inputs that came before it and the whole program is run again, so
+// the state of the session is the code that was evaluated successfully.
+type replSession struct {
+	Id   string
+	User string
+
+	imports []string
+	decls   []string
+	stmts   []string
+
+	// Separates the output of the earlier inputs from that of the new one
+	marker string
+	dir    string
+	mutex  sync.Mutex
+}
+
+type ReplResult struct {
+	Output string
+	// Compiler errors, the input is the file named "input"
+	Errors   string `json:",omitempty"`
+	TimedOut bool
+}
+
+// Changes that an input makes to the program
+type replInput struct {
+	imports []string
+	decls   []string
+	stmts   []string
+}
+
+var (
+	unusedImport = regexp.MustCompile(`"([^"]+)" imported (?:as (\w+) )?and not used`)
+
+	replMutex    sync.Mutex
+	replSessions = make(map[string]*replSession)
+)
+
+func init() {
+	idleUserHooks = append(idleUserHooks, closeReplSessions)
+}
+
+func newReplSession(user string) *replSession {
+	id := newId()
+	return &replSession{Id: id, User: user, marker: "\x1egodev-repl-" + id + "\x1e"}
+}
+
+func (s *replSession) close() {
+	if s.dir != "" {
+		removeTempDir(s.dir)
+	}
+}
+
+func closeReplSessions(user string) {
+	replMutex.Lock()
+	defer replMutex.Unlock()
+
+	for id, s := range replSessions {
+		if s.User == user {
+			s.close()
+			delete(replSessions, id)
+		}
+	}
+}
+
+func replSocket(ws *websocket.Conn) {
+	replTask(ws)
+}
+
+// Evaluates each input read from the connection writing the output back
+// as the program produces it.
+func replTask(ws taskConn) {
+	s := newReplSession(requestUser(ws.Request()))
+	defer s.close()
+
+	ws.Write([]byte("Go REPL, :reset starts over and :source shows the program so far\n"))
+
+	buf := make([]byte, maxSseInput)
+	for {
+		n, err := ws.Read(buf)
+		if err != nil {
+			break
+		}
+
+		result, err := s.eval(ws.Request().Context(), string(buf[:n]), ws)
+		if err != nil {
+			ws.Write([]byte(err.Error() + "\n"))
+			continue
+		}
+		if result.Errors != "" {
+			ws.Write([]byte(result.Errors))
+		}
+		if result.TimedOut {
+			ws.Write([]byte("Timed out\n"))
+		}
+	}
+
+	ws.Close()
+}
+
+func replHandler(writer http.ResponseWriter, req *http.Request, path string, pathSegs []string) bool {
+	user := requestUser(req)
+
+	switch {
+	case req.Method == "GET" && len(pathSegs) == 2 && pathSegs[1] == "stream":
+		// Same as the socket for browsers that can't open WebSockets
+		serveTaskStream(writer, req, replTask)
+		return true
+	case req.Method == "POST" && len(pathSegs) == 3 && pathSegs[1] == "stream":
+		taskStreamInput(writer, req, pathSegs[2])
+		return true
+	case req.Method == "POST" && (len(pathSegs) == 1 || (len(pathSegs) == 2 && pathSegs[1] == "")):
+		s := newReplSession(user)
+
+		replMutex.Lock()
+		replSessions[s.Id] = s
+		replMutex.Unlock()
+
+		ShowJson(writer, 201, s)
+		return true
+	case len(pathSegs) == 2:
+		replMutex.Lock()
+		s := replSessions[pathSegs[1]]
+		replMutex.Unlock()
+
+		if s == nil || s.User != user {
+			ShowError(writer, 404, "No such REPL session", nil)
+			return true
+		}
+
+		switch req.Method {
+		case "POST":
+			input, err := ioutil.ReadAll(io.LimitReader(req.Body, maxSseInput))
+			if err != nil {
+				ShowError(writer, 400, "Unable to read the input", err)
+				return true
+			}
+
+			output := &cappedBuffer{limit: maxScratchOutput}
+			result, err := s.eval(req.Context(), string(input), output)
+			if err != nil {
+				ShowError(writer, 500, "Unable to evaluate the input", err)
+				return true
+			}
+			result.Output = output.String()
+
+			ShowJson(writer, 200, result)
+			return true
+		case "DELETE":
+			replMutex.Lock()
+			delete(replSessions, s.Id)
+			replMutex.Unlock()
+
+			s.close()
+			writer.WriteHeader(204)
+			return true
+		}
+	}
+
+	return false
+}
+
+// Compiles the input into the program and runs it. Output of the input is
+// written to out while the program runs. Inputs that don't compile or run
+// successfully leave the session as it was.
+func (s *replSession) eval(ctx context.Context, input string, out io.Writer) (*ReplResult, error) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	result := &ReplResult{}
+	input = strings.TrimSpace(input)
+
+	switch input {
+	case "":
+		return result, nil
+	case ":reset":
+		s.imports, s.decls, s.stmts = nil, nil, nil
+		io.WriteString(out, "The session was reset\n")
+		return result, nil
+	case ":source":
+		io.WriteString(out, s.program(replInput{}))
+		return result, nil
+	}
+
+	if s.dir == "" {
+		dir, err := newTempDir("godev-repl")
+		if err != nil {
+			return nil, err
+		}
+		s.dir = dir
+	}
+
+	// The first interpretation of the input that compiles wins
+	var chosen *replInput
+	for _, candidate := range replCandidates(input) {
+		errs, err := s.build(ctx, candidate)
+		if err != nil {
+			return nil, err
+		}
+		if errs == "" {
+			c := candidate
+			chosen = &c
+			break
+		}
+		if result.Errors == "" {
+			result.Errors = errs
+		}
+	}
+	if chosen == nil {
+		return result, nil
+	}
+	result.Errors = ""
+
+	runCtx, cancel := context.WithTimeout(ctx, *scratchTimeout)
+	defer cancel()
+
+	memory := *scratchMemory << 20
+	output := &markerWriter{marker: []byte(s.marker), out: out}
+	cmd := limitedCommand(runCtx, filepath.Join(s.dir, scratchExecutable), memory)
+	cmd.Dir = s.dir
+	cmd.Env = append(os.Environ(), "GOMEMLIMIT="+strconv.FormatInt(memory, 10))
+	cmd.Stdout = output
+	cmd.Stderr = output
+
+	err := cmd.Run()
+	if _, ok := err.(*exec.ExitError); err != nil && !ok && runCtx.Err() == nil {
+		return nil, err
+	}
+
+	switch {
+	case runCtx.Err() == context.DeadlineExceeded:
+		result.TimedOut = true
+	case err != nil && !output.found:
+		io.WriteString(out, "The earlier inputs failed this time ("+err.Error()+"), :reset starts over\n")
+	case err != nil:
+		io.WriteString(out, err.Error()+"\n")
+	default:
+		s.imports = append(s.imports, chosen.imports...)
+		s.decls = append(s.decls, chosen.decls...)
+		s.stmts = append(s.stmts, chosen.stmts...)
+	}
+
+	return result, nil
+}
+
+// Ways the input could fit into the program, in order of preference
+func replCandidates(input string) []replInput {
+	fileset := token.NewFileSet()
+
+	if file, err := parser.ParseFile(fileset, "", "package p\n"+input, 0); err == nil && len(file.Decls) > 0 {
+		imports := []string{}
+		declares, onlyImports := false, true
+		for _, decl := range file.Decls {
+			switch d := decl.(type) {
+			case *ast.FuncDecl:
+				declares, onlyImports = true, false
+			case *ast.GenDecl:
+				onlyImports = onlyImports && d.Tok == token.IMPORT
+				switch d.Tok {
+				case token.IMPORT:
+					for _, spec := range d.Specs {
+						start, end := fileset.Position(spec.Pos()).Offset, fileset.Position(spec.End()).Offset
+						imports = append(imports, ("package p\n" + input)[start:end])
+					}
+				case token.TYPE:
+					declares = true
+				}
+			}
+		}
+
+		switch {
+		case onlyImports:
+			return []replInput{{imports: imports}}
+		case declares:
+			return []replInput{{decls: []string{input}}}
+		}
+		// Variables and constants belong with the statements
+	}
+
+	candidates := []replInput{}
+	if _, err := parser.ParseExpr(input); err == nil {
+		candidates = append(candidates, replInput{stmts: []string{"__print(" + input + ")"}})
+	}
+
+	return append(candidates, replInput{stmts: append([]string{input}, replUses(input)...)})
+}
+
+// Statements that use the variables the input declares so that the
+// compiler doesn't reject them before a later input gets to use them.
+func replUses(input string) []string {
+	file, err := parser.ParseFile(token.NewFileSet(), "", "package p\nfunc _() {\n"+input+"\n}", 0)
+	if err != nil || len(file.Decls) == 0 {
+		return nil
+	}
+
+	uses := []string{}
+	use := func(ident *ast.Ident) {
+		if ident.Name != "_" {
+			uses = append(uses, "_ = "+ident.Name)
+		}
+	}
+
+	for _, stmt := range file.Decls[0].(*ast.FuncDecl).Body.List {
+		switch x := stmt.(type) {
+		case *ast.AssignStmt:
+			if x.Tok == token.DEFINE {
+				for _, lhs := range x.Lhs {
+					if ident, ok := lhs.(*ast.Ident); ok {
+						use(ident)
+					}
+				}
+			}
+		case *ast.DeclStmt:
+			if d, ok := x.Decl.(*ast.GenDecl); ok && d.Tok == token.VAR {
+				for _, spec := range d.Specs {
+					for _, name := range spec.(*ast.ValueSpec).Names {
+						use(name)
+					}
+				}
+			}
+		}
+	}
+
+	return uses
+}
+
+// Source of the program with the input added. Line directives make the
+// compiler report errors in the input by its own lines.
+func (s *replSession) program(input replInput) string {
+	source := &bytes.Buffer{}
+
+	source.WriteString("package main\n\nimport (\n\t__fmt \"fmt\"\n\t__os \"os\"\n")
+	for _, imp := range append(s.imports, input.imports...) {
+		source.WriteString("\t" + imp + "\n")
+	}
+	source.WriteString(")\n\n")
+
+	for _, decl := range s.decls {
+		source.WriteString(decl + "\n\n")
+	}
+	for _, decl := range input.decls {
+		source.WriteString("//line input:1\n" + decl + "\n\n")
+	}
+
+	source.WriteString(`func __print(values ...interface{}) {
+	for idx, value := range values {
+		if idx > 0 {
+			__fmt.Print(", ")
+		}
+		__fmt.Printf("%#v", value)
+	}
+	__fmt.Println()
+}
+
+func main() {
+`)
+	for _, stmt := range s.stmts {
+		source.WriteString(stmt + "\n")
+	}
+
+	source.WriteString("__os.Stdout.WriteString(" + strconv.Quote(s.marker) + ")\n")
+	for idx, stmt := range input.stmts {
+		if idx == 0 {
+			source.WriteString("//line input:1\n")
+		}
+		source.WriteString(stmt + "\n")
+	}
+	source.WriteString("}\n")
+
+	return source.String()
+}
+
+// Compiles the program with the input, returning the compiler errors
+func (s *replSession) build(ctx context.Context, input replInput) (string, error) {
+	buildCtx, cancel := context.WithTimeout(ctx, *buildTimeout)
+	defer cancel()
+
+	source := []byte(s.program(input))
+
+	// Imports are added and removed as the code needs them
+	cmd := exec.CommandContext(buildCtx, "goimports")
+	cmd.Stdin = bytes.NewReader(source)
+	if imported, err := cmd.Output(); err == nil {
+		source = imported
+	}
+
+	var output []byte
+	for {
+		err := ioutil.WriteFile(filepath.Join(s.dir, "main.go"), source, 0600)
+		if err != nil {
+			return "", err
+		}
+
+		cmd = exec.CommandContext(buildCtx, "go", "build", "-o", scratchExecutable, "main.go")
+		cmd.Dir = s.dir
+		output, err = cmd.CombinedOutput()
+		if buildCtx.Err() != nil {
+			return "", buildCtx.Err()
+		}
+		if err == nil {
+			return "", nil
+		}
+
+		// Without goimports the imports that nothing uses yet are left out
+		//  until something does.
+		pruned := source
+		for _, match := range unusedImport.FindAllSubmatch(output, -1) {
+			name := ""
+			if len(match[2]) > 0 {
+				name = string(match[2]) + " "
+			}
+			line := regexp.MustCompile(`(?m)^\t` + regexp.QuoteMeta(name+strconv.Quote(string(match[1]))) + `\n`)
+			pruned = line.ReplaceAll(pruned, nil)
+		}
+		if bytes.Equal(pruned, source) {
+			break
+		}
+		source = pruned
+	}
+
+	errs := ""
+	for _, line := range strings.SplitAfter(string(output), "\n") {
+		if !strings.HasPrefix(line, "#") {
+			errs += line
+		}
+	}
+	if errs == "" {
+		return "", errors.New("Build failed")
+	}
+
+	return errs, nil
+}
+
+// Drops the output of the replayed inputs, which comes before the marker
+type markerWriter struct {
+	marker  []byte
+	out     io.Writer
+	pending []byte
+	found   bool
+}
+
+func (w *markerWriter) Write(p []byte) (int, error) {
+	if w.found {
+		_, err := w.out.Write(p)
+		return len(p), err
+	}
+
+	w.pending = append(w.pending, p...)
+	idx := bytes.Index(w.pending, w.marker)
+	if idx == -1 {
+		// Only the end could be the start of the marker
+		if keep := len(w.marker) - 1; len(w.pending) > keep {
+			w.pending = append([]byte{}, w.pending[len(w.pending)-keep:]...)
+		}
+		return len(p), nil
+	}
+
+	w.found = true
+	rest := w.pending[idx+len(w.marker):]
+	w.pending = nil
+	if len(rest) > 0 {
+		_, err := w.out.Write(rest)
+		return len(p), err
+	}
+
+	return len(p), nil
+}
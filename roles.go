@@ -0,0 +1,264 @@
+// Copyright 2014 Chris McGee <sirnewton_01@yahoo.ca>. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sync"
+)
+
+const (
+	ROLE_ADMIN     = "admin"
+	ROLE_DEVELOPER = "developer"
+	ROLE_REVIEWER  = "reviewer"
+	ROLE_GUEST     = "guest"
+)
+
+// Classes of endpoints that roles grant access to
+const (
+	CLASS_BROWSE   = "browse"
+	CLASS_ANNOTATE = "annotate"
+	CLASS_EDIT     = "edit"
+	CLASS_TERMINAL = "terminal"
+	CLASS_DEBUG    = "debug"
+	CLASS_ADMIN    = "admin"
+)
+
+var rolePermissions = map[string][]string{
+	ROLE_ADMIN:     {CLASS_BROWSE, CLASS_ANNOTATE, CLASS_EDIT, CLASS_TERMINAL, CLASS_DEBUG, CLASS_ADMIN},
+	ROLE_DEVELOPER: {CLASS_BROWSE, CLASS_ANNOTATE, CLASS_EDIT, CLASS_TERMINAL, CLASS_DEBUG},
+	ROLE_REVIEWER:  {CLASS_BROWSE, CLASS_ANNOTATE},
+	ROLE_GUEST:     {CLASS_BROWSE},
+}
+
+type RoleConfig struct {
+	// Role of users that aren't listed
+	Default string
+	Users   map[string]string
+}
+
+type RoleInfo struct {
+	User        string
+	Role        string
+	Permissions []string
+}
+
+var (
+	rolesMutex sync.Mutex
+	roles      *RoleConfig
+)
+
+func rolesFile() string {
+	return filepath.Join(godevDataDir(), "roles.json")
+}
+
+func loadRoles() *RoleConfig {
+	rolesMutex.Lock()
+	defer rolesMutex.Unlock()
+
+	if roles != nil {
+		return roles
+	}
+
+	roles = &RoleConfig{Default: ROLE_GUEST, Users: make(map[string]string)}
+
+	b, err := ioutil.ReadFile(rolesFile())
+	if err == nil {
+		err = json.Unmarshal(b, roles)
+		if err != nil {
+			logger.Printf("Unable to read the roles, everyone is a %v: %v\n", ROLE_GUEST, err)
+			roles = &RoleConfig{Default: ROLE_GUEST, Users: make(map[string]string)}
+		}
+	}
+
+	return roles
+}
+
+func saveRoles(config *RoleConfig) error {
+	b, err := json.MarshalIndent(config, "", "  ")
+	if err != nil {
+		return err
+	}
+
+	err = os.MkdirAll(godevDataDir(), 0700)
+	if err != nil {
+		return err
+	}
+
+	err = ioutil.WriteFile(rolesFile(), b, 0600)
+	if err != nil {
+		return err
+	}
+
+	rolesMutex.Lock()
+	roles = config
+	rolesMutex.Unlock()
+
+	return nil
+}
+
+// Gives the user a role, keeping the rest of the configuration
+func setUserRole(user string, role string) error {
+	current := loadRoles()
+
+	rolesMutex.Lock()
+	config := &RoleConfig{Default: current.Default, Users: make(map[string]string)}
+	for u, r := range current.Users {
+		config.Users[u] = r
+	}
+	rolesMutex.Unlock()
+
+	config.Users[user] = role
+	return saveRoles(config)
+}
+
+// Whether the user is the owner of the session, the one that godev runs for
+func isOwner(user string) bool {
+	return user == "anonymous" || user == *remoteAccount
+}
+
+func userRole(user string) string {
+	// The owner of the session can never lock themselves out
+	if isOwner(user) {
+		return ROLE_ADMIN
+	}
+
+	config := loadRoles()
+
+	rolesMutex.Lock()
+	defer rolesMutex.Unlock()
+
+	if role, ok := config.Users[user]; ok {
+		return role
+	}
+
+	return config.Default
+}
+
+// Classifies a request by what it could do to the workspace
+func endpointClass(req *http.Request, pathSegs []string) string {
+	service := pathSegs[0]
+	readOnlyMethod := req.Method == "GET" || req.Method == "HEAD"
+
+	switch {
+	case service == "admin" || service == "invites":
+		return CLASS_ADMIN
+	case service == "roles" || service == "bundles":
+		if readOnlyMethod {
+			return CLASS_BROWSE
+		}
+		return CLASS_ADMIN
+	case service == "docker" || service == "terminal" || service == "shell":
+		// Terminal sessions, the playback of their recordings and the
+		//  commands of the shell page, which run the code of the workspace
+		return CLASS_TERMINAL
+	case service == "logs" || service == "preview" || service == "onboarding":
+		// Tail the files of the workspace, serve its built apps and run the
+		//  analyses of projects, even through GET
+		return CLASS_DEBUG
+	case executingServices[service]:
+		return CLASS_DEBUG
+	case service == "go" && len(pathSegs) > 1 && pathSegs[1] == "rename":
+		// Writes the files of the workspace unless it is a dry run
+		if req.URL.Query().Get("dryRun") != "true" {
+			return CLASS_EDIT
+		}
+		return CLASS_BROWSE
+	case service == "go" && len(pathSegs) > 1 && pathSegs[1] == "fmt" && req.URL.Query().Get("pkg") != "":
+		// Formats the files of the package in place
+		return CLASS_EDIT
+	case service == "go" && len(pathSegs) > 1 && (pathSegs[1] == "build" || pathSegs[1] == "bundle-cgi" || pathSegs[1] == "test" || (pathSegs[1] == "coverage" && req.Method == "POST")):
+		return CLASS_DEBUG
+	case readOnlyMethod:
+		return CLASS_BROWSE
+	case mutatingServices[service]:
+		return CLASS_EDIT
+	}
+
+	// Personal state such as bookmarks, history and preferences
+	return CLASS_ANNOTATE
+}
+
+func roleAllows(role string, class string) bool {
+	for _, c := range rolePermissions[role] {
+		if c == class {
+			return true
+		}
+	}
+
+	return false
+}
+
+func roleDenied(req *http.Request, pathSegs []string) bool {
+	// Guests of an invite can only do what it shares
+	if scope := requestScope(req); scope != nil {
+		return !scope.allows(req, pathSegs)
+	}
+
+	return !roleAllows(userRole(requestUser(req)), endpointClass(req, pathSegs))
+}
+
+func rolesHandler(writer http.ResponseWriter, req *http.Request, path string, pathSegs []string) bool {
+	switch {
+	case req.Method == "GET" && len(pathSegs) == 1:
+		user := requestUser(req)
+		role := userRole(user)
+
+		ShowJson(writer, 200, RoleInfo{User: user, Role: role, Permissions: rolePermissions[role]})
+		return true
+	case req.Method == "GET" && len(pathSegs) == 2 && pathSegs[1] == "users":
+		config := loadRoles()
+
+		rolesMutex.Lock()
+		defer rolesMutex.Unlock()
+
+		ShowJson(writer, 200, config)
+		return true
+	case req.Method == "PUT" && len(pathSegs) == 2 && pathSegs[1] == "users":
+		config := &RoleConfig{}
+		err := json.NewDecoder(req.Body).Decode(config)
+		if err != nil {
+			ShowError(writer, 400, "Invalid role configuration", err)
+			return true
+		}
+
+		if config.Users == nil {
+			config.Users = make(map[string]string)
+		}
+		if config.Default == "" {
+			config.Default = ROLE_GUEST
+		}
+
+		for _, role := range append([]string{config.Default}, mapValues(config.Users)...) {
+			if _, ok := rolePermissions[role]; !ok {
+				ShowError(writer, 400, "Unknown role "+role, nil)
+				return true
+			}
+		}
+
+		err = saveRoles(config)
+		if err != nil {
+			ShowError(writer, 500, "Unable to save the roles", err)
+			return true
+		}
+
+		writer.WriteHeader(204)
+		return true
+	}
+
+	return false
+}
+
+func mapValues(m map[string]string) []string {
+	values := []string{}
+	for _, v := range m {
+		values = append(values, v)
+	}
+	return values
+}
@@ -0,0 +1,162 @@
+// Copyright 2014 Chris McGee <sirnewton_01@yahoo.ca>. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestEndpointClass(t *testing.T) {
+	tests := []struct {
+		method string
+		url    string
+		class  string
+	}{
+		{"GET", "/file/src/main.go", CLASS_BROWSE},
+		{"PUT", "/file/src/main.go", CLASS_EDIT},
+		{"GET", "/workspace", CLASS_BROWSE},
+		{"POST", "/prefs/user", CLASS_ANNOTATE},
+		{"GET", "/bundles", CLASS_BROWSE},
+		{"POST", "/bundles", CLASS_ADMIN},
+		{"GET", "/admin/users", CLASS_ADMIN},
+		{"GET", "/invites", CLASS_ADMIN},
+		{"GET", "/docker/sessions", CLASS_TERMINAL},
+		{"GET", "/terminal/recordings", CLASS_TERMINAL},
+		{"GET", "/terminal/play", CLASS_TERMINAL},
+		{"GET", "/logs/tail", CLASS_DEBUG},
+		{"GET", "/logs/stream", CLASS_DEBUG},
+		{"GET", "/preview", CLASS_DEBUG},
+		{"POST", "/preview", CLASS_DEBUG},
+		{"GET", "/onboarding", CLASS_DEBUG},
+		{"POST", "/onboarding", CLASS_DEBUG},
+		{"GET", "/secrets", CLASS_BROWSE},
+		{"PUT", "/secrets/token", CLASS_EDIT},
+		{"DELETE", "/secrets/token", CLASS_EDIT},
+		{"GET", "/debug/socket", CLASS_DEBUG},
+		{"POST", "/shell/exec", CLASS_TERMINAL},
+		{"GET", "/go/build/src/pkg", CLASS_DEBUG},
+		{"GET", "/go/bundle-cgi/cmd", CLASS_DEBUG},
+		{"POST", "/go/rename", CLASS_EDIT},
+		{"POST", "/go/rename?dryRun=true", CLASS_BROWSE},
+		{"GET", "/go/fmt?pkg=example.com/project", CLASS_EDIT},
+		{"POST", "/go/fmt", CLASS_ANNOTATE},
+		{"GET", "/go/coverage", CLASS_BROWSE},
+		{"POST", "/go/coverage", CLASS_DEBUG},
+	}
+
+	for _, test := range tests {
+		req := httptest.NewRequest(test.method, test.url, nil)
+		pathSegs := strings.Split(req.URL.Path, "/")[1:]
+
+		if class := endpointClass(req, pathSegs); class != test.class {
+			t.Errorf("%v %v is %v, expected %v", test.method, test.url, class, test.class)
+		}
+	}
+}
+
+func TestRoleDenied(t *testing.T) {
+	// Users are only told apart on a remote godev
+	defer func(h string) { hostName = h }(hostName)
+	hostName = "godev.example.com"
+	// The keys are saved in the data directory
+	defer func(dir string) { *dataDir = dir }(*dataDir)
+	*dataDir = t.TempDir()
+
+	rolesMutex.Lock()
+	defer func(r *RoleConfig) { roles = r }(roles)
+	roles = &RoleConfig{Default: ROLE_GUEST, Users: map[string]string{
+		"dev@example.com":      ROLE_DEVELOPER,
+		"reviewer@example.com": ROLE_REVIEWER,
+	}}
+	rolesMutex.Unlock()
+
+	developer := addUserMagicKey("dev@example.com", "test", 0, false)
+	reviewer := addUserMagicKey("reviewer@example.com", "test", 0, false)
+	guest := addUserMagicKey("guest@example.com", "test", 0, false)
+	invited := addUserMagicKey("invited@example.com", "test", 0, false)
+	invited.Scope = &GuestScope{Paths: []string{"shared"}}
+	defer func() {
+		for _, k := range []*MagicKey{developer, reviewer, guest, invited} {
+			removeMagicKey(k.Id)
+		}
+	}()
+
+	tests := []struct {
+		key    *MagicKey
+		method string
+		url    string
+		denied bool
+	}{
+		{developer, "PUT", "/file/src/main.go", false},
+		{developer, "GET", "/terminal/play", false},
+		{developer, "GET", "/logs/tail", false},
+		{developer, "PUT", "/secrets/token", false},
+		{developer, "GET", "/admin/users", true},
+		{reviewer, "GET", "/file/src/main.go", false},
+		{reviewer, "POST", "/prefs/user", false},
+		{reviewer, "PUT", "/file/src/main.go", true},
+		{reviewer, "PUT", "/secrets/token", true},
+		{reviewer, "GET", "/go/fmt?pkg=example.com/project", true},
+		{reviewer, "GET", "/preview", true},
+		{guest, "GET", "/file/src/main.go", false},
+		{guest, "GET", "/secrets", false},
+		{guest, "POST", "/prefs/user", true},
+		{guest, "GET", "/logs/tail", true},
+		{guest, "GET", "/terminal/play", true},
+		{guest, "GET", "/preview", true},
+		{guest, "GET", "/onboarding", true},
+		{guest, "DELETE", "/secrets/token", true},
+		{guest, "GET", "/go/fmt?pkg=example.com/project", true},
+		{guest, "PUT", "/prefs/user", true},
+		{reviewer, "POST", "/shell/exec", true},
+		{developer, "POST", "/shell/exec", false},
+		{invited, "GET", "/file/shared/main.go", false},
+		{invited, "GET", "/file/private/main.go", true},
+		{invited, "PUT", "/file/shared/main.go", true},
+		{invited, "GET", "/logs/tail", true},
+	}
+
+	for _, test := range tests {
+		req := httptest.NewRequest(test.method, test.url, nil)
+		req.AddCookie(&http.Cookie{Name: "MAGIC" + *port, Value: test.key.Key})
+		pathSegs := strings.Split(req.URL.Path, "/")[1:]
+
+		if denied := roleDenied(req, pathSegs); denied != test.denied {
+			t.Errorf("%v %v by %v: denied is %v, expected %v", test.method, test.url, test.key.User, denied, test.denied)
+		}
+	}
+}
+
+// Annotating writes the preferences, which only the owner may share with the
+// editor's plugin list
+func TestUserPrefsFile(t *testing.T) {
+	defer func(account string) { *remoteAccount = account }(*remoteAccount)
+	*remoteAccount = "owner@example.com"
+
+	tests := []struct {
+		user  string
+		owner bool
+	}{
+		{"anonymous", true},
+		{"owner@example.com", true},
+		{"reviewer@example.com", false},
+		{"guest-1234", false},
+		{"paired", false},
+	}
+
+	for _, test := range tests {
+		file := userPrefsFile(test.user)
+		if owner := file == prefsFile(); owner != test.owner {
+			t.Errorf("The preferences of %v are %v", test.user, file)
+		}
+		if !test.owner && filepath.Dir(file) != userDataDir(test.user) {
+			t.Errorf("The preferences of %v aren't in their data: %v", test.user, file)
+		}
+	}
+}
@@ -0,0 +1,38 @@
+// Copyright 2014 Chris McGee <sirnewton_01@yahoo.ca>. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+// +build linux darwin
+
+package main
+
+import (
+	"context"
+	"os"
+	"os/exec"
+	"runtime"
+	"strconv"
+	"syscall"
+)
+
+const scratchExecutable = "scratch"
+
+// The shell limits the data segment of the program before it replaces
+// itself with it. Limiting the address space instead would stop the Go
+// runtime from reserving its heap.
+func limitedCommand(ctx context.Context, program string, memory int64) *exec.Cmd {
+	return exec.CommandContext(ctx, "sh", "-c", "ulimit -d "+strconv.FormatInt(memory>>10, 10)+" && exec \"$0\"", program)
+}
+
+func peakMemory(state *os.ProcessState) int64 {
+	usage, ok := state.SysUsage().(*syscall.Rusage)
+	if !ok {
+		return 0
+	}
+
+	// Darwin reports bytes, linux kilobytes
+	if runtime.GOOS == "darwin" {
+		return int64(usage.Maxrss)
+	}
+	return int64(usage.Maxrss) << 10
+}
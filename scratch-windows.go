@@ -0,0 +1,24 @@
+// Copyright 2014 Chris McGee <sirnewton_01@yahoo.ca>. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+// +build windows
+
+package main
+
+import (
+	"context"
+	"os"
+	"os/exec"
+)
+
+const scratchExecutable = "scratch.exe"
+
+// Only the soft limit of the Go runtime applies on windows
+func limitedCommand(ctx context.Context, program string, memory int64) *exec.Cmd {
+	return exec.CommandContext(ctx, program)
+}
+
+func peakMemory(state *os.ProcessState) int64 {
+	return 0
+}
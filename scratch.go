@@ -0,0 +1,292 @@
+// Copyright 2014 Chris McGee <sirnewton_01@yahoo.ca>. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"bytes"
+	"context"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	maxScratchOutput = 1024 * 1024
+)
+
+// Single file program kept outside of the workspace for quick experiments
+type ScratchFile struct {
+	Name     string
+	Modified int64
+	Size     int64
+}
+
+type ScratchRun struct {
+	// Standard output and error of the program interleaved
+	Output    string
+	Truncated bool
+	// The program is only run when there are no build errors
+	BuildErrors []CompileError
+	VetErrors   []CompileError
+	ExitCode    int
+	// Milliseconds
+	Duration int64
+	// Bytes, where the platform reports it
+	PeakMemory     int64
+	TimedOut       bool
+	MemoryExceeded bool
+}
+
+var scratchName = regexp.MustCompile(`^[A-Za-z0-9_-]+$`)
+
+func init() {
+	registerGcTask("scratch", gcScratch)
+}
+
+func scratchDir(user string) string {
+	return filepath.Join(userDataDir(user), "scratch")
+}
+
+// Output that stops growing at a limit instead of failing the writes
+type cappedBuffer struct {
+	bytes.Buffer
+	limit     int
+	truncated bool
+}
+
+func (b *cappedBuffer) Write(p []byte) (int, error) {
+	if room := b.limit - b.Len(); len(p) > room {
+		if room > 0 {
+			b.Buffer.Write(p[:room])
+		}
+		b.truncated = true
+		return len(p), nil
+	}
+
+	return b.Buffer.Write(p)
+}
+
+func scratchHandler(writer http.ResponseWriter, req *http.Request, path string, pathSegs []string) bool {
+	user := requestUser(req)
+
+	if len(pathSegs) == 1 || (len(pathSegs) == 2 && pathSegs[1] == "") {
+		if req.Method != "GET" {
+			return false
+		}
+
+		result := []ScratchFile{}
+		infos, _ := ioutil.ReadDir(scratchDir(user))
+		for _, info := range infos {
+			if strings.HasSuffix(info.Name(), ".go") {
+				result = append(result, ScratchFile{strings.TrimSuffix(info.Name(), ".go"), info.ModTime().Unix() * 1000, info.Size()})
+			}
+		}
+
+		ShowJson(writer, 200, result)
+		return true
+	}
+
+	name := pathSegs[1]
+	if len(pathSegs) > 2 || !scratchName.MatchString(name) {
+		ShowError(writer, 400, "Invalid scratch file name "+name, nil)
+		return true
+	}
+	fileName := filepath.Join(scratchDir(user), name+".go")
+
+	switch {
+	case req.Method == "GET":
+		b, err := ioutil.ReadFile(fileName)
+		if os.IsNotExist(err) {
+			ShowError(writer, 404, "No scratch file named "+name, nil)
+			return true
+		}
+		if err != nil {
+			ShowError(writer, 500, "Unable to read the scratch file", err)
+			return true
+		}
+
+		writer.Header().Set("Content-Type", "text/plain; charset=utf-8")
+		writer.WriteHeader(200)
+		writer.Write(b)
+		return true
+	case req.Method == "PUT":
+		if !saveScratch(writer, req, fileName) {
+			return true
+		}
+
+		writer.WriteHeader(204)
+		return true
+	case req.Method == "DELETE":
+		err := os.Remove(fileName)
+		if err != nil && !os.IsNotExist(err) {
+			ShowError(writer, 500, "Unable to delete the scratch file", err)
+			return true
+		}
+
+		writer.WriteHeader(204)
+		return true
+	case req.Method == "POST":
+		// Builds and runs the saved file, or the body after saving it
+		if req.ContentLength != 0 && !saveScratch(writer, req, fileName) {
+			return true
+		}
+
+		source, err := ioutil.ReadFile(fileName)
+		if os.IsNotExist(err) {
+			ShowError(writer, 404, "No scratch file named "+name, nil)
+			return true
+		}
+		if err != nil {
+			ShowError(writer, 500, "Unable to read the scratch file", err)
+			return true
+		}
+
+		result, err := runScratch(req, source, "/scratch/"+name)
+		if err != nil {
+			ShowError(writer, 500, "Unable to run the scratch file", err)
+			return true
+		}
+
+		ShowJson(writer, 200, result)
+		return true
+	}
+
+	return false
+}
+
+func saveScratch(writer http.ResponseWriter, req *http.Request, fileName string) bool {
+	body, err := uploadBody(req)
+	if err != nil {
+		showUploadError(writer, err)
+		return false
+	}
+
+	source, err := ioutil.ReadAll(body)
+	if err == nil {
+		err = body.err
+	}
+	if err != nil {
+		showUploadError(writer, err)
+		return false
+	}
+
+	err = os.MkdirAll(filepath.Dir(fileName), 0700)
+	if err == nil {
+		err = ioutil.WriteFile(fileName, source, 0600)
+	}
+	if err != nil {
+		ShowError(writer, 500, "Unable to save the scratch file", err)
+		return false
+	}
+
+	return true
+}
+
+// Vets, builds and runs the program in a temporary directory under the
+// time and memory limits of scratch files.
+func runScratch(req *http.Request, source []byte, location string) (*ScratchRun, error) {
+	result := &ScratchRun{BuildErrors: []CompileError{}, VetErrors: []CompileError{}}
+
+	tmpDir, err := newTempDir("godev-scratch")
+	if err != nil {
+		return nil, err
+	}
+	defer removeTempDir(tmpDir)
+
+	err = ioutil.WriteFile(filepath.Join(tmpDir, "main.go"), source, 0600)
+	if err != nil {
+		return nil, err
+	}
+
+	ctx, cancel := operationContext(req, *buildTimeout)
+	defer cancel()
+
+	cmd := exec.CommandContext(ctx, "go", "build", "-o", scratchExecutable, "main.go")
+	cmd.Dir = tmpDir
+	result.BuildErrors, err = parseBuildOutput(ctx, cmd)
+	if err != nil {
+		return nil, err
+	}
+	for idx := range result.BuildErrors {
+		result.BuildErrors[idx].Location = location
+		for note := range result.BuildErrors[idx].Related {
+			result.BuildErrors[idx].Related[note].Location = location
+		}
+	}
+	if len(result.BuildErrors) > 0 {
+		return result, nil
+	}
+
+	cmd = exec.CommandContext(ctx, "go", "vet", "main.go")
+	cmd.Dir = tmpDir
+	result.VetErrors, err = parseBuildOutput(ctx, cmd)
+	if err != nil {
+		return nil, err
+	}
+	for idx := range result.VetErrors {
+		result.VetErrors[idx].Location = location
+	}
+
+	runCtx, runCancel := context.WithTimeout(req.Context(), *scratchTimeout)
+	defer runCancel()
+
+	output := &cappedBuffer{limit: maxScratchOutput}
+	memory := *scratchMemory << 20
+	cmd = limitedCommand(runCtx, filepath.Join(tmpDir, scratchExecutable), memory)
+	cmd.Dir = tmpDir
+	// Go programs collect garbage harder as they near the limit
+	cmd.Env = append(os.Environ(), "GOMEMLIMIT="+strconv.FormatInt(memory, 10))
+	cmd.Stdout = output
+	cmd.Stderr = output
+
+	start := time.Now()
+	err = cmd.Run()
+	result.Duration = int64(time.Since(start) / time.Millisecond)
+
+	if _, ok := err.(*exec.ExitError); err != nil && !ok && runCtx.Err() == nil {
+		return nil, err
+	}
+	if req.Context().Err() != nil {
+		return nil, req.Context().Err()
+	}
+
+	result.TimedOut = runCtx.Err() == context.DeadlineExceeded
+	if cmd.ProcessState != nil {
+		result.ExitCode = cmd.ProcessState.ExitCode()
+		result.PeakMemory = peakMemory(cmd.ProcessState)
+	}
+
+	result.Output = output.String()
+	result.Truncated = output.truncated
+	result.MemoryExceeded = strings.Contains(result.Output, "out of memory") ||
+		(result.PeakMemory > 0 && result.PeakMemory >= memory)
+
+	return result, nil
+}
+
+// Scratch files are meant to be thrown away, those that nobody touched
+// within the retention go.
+func gcScratch(cutoff time.Time, result *GcResult) error {
+	for _, user := range dataUsers() {
+		infos, err := ioutil.ReadDir(scratchDir(user))
+		if err != nil && !os.IsNotExist(err) {
+			return err
+		}
+
+		for _, info := range infos {
+			if info.ModTime().Before(cutoff) {
+				gcRemove(filepath.Join(scratchDir(user), info.Name()), result)
+			}
+		}
+	}
+
+	return nil
+}
@@ -0,0 +1,145 @@
+// Copyright 2014 Chris McGee <sirnewton_01@yahoo.ca>. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"regexp"
+	"sort"
+	"strings"
+	"time"
+)
+
+// Named value such as a password or an API token that the user keeps on
+// the server for the tools to use. The values never leave the server.
+type Secret struct {
+	Value   string `json:",omitempty"`
+	Updated int64
+}
+
+type SecretInfo struct {
+	Name    string
+	Updated int64
+}
+
+var (
+	validSecretName = regexp.MustCompile(`^[A-Za-z0-9_.-]+$`)
+)
+
+func loadSecrets(user string) (map[string]Secret, error) {
+	secrets := make(map[string]Secret)
+	err := loadUserData(user, "secrets", &secrets)
+	return secrets, err
+}
+
+// The value of a secret of the user, for the services that use them
+func userSecret(user string, name string) (string, bool) {
+	userDataMutex.Lock()
+	defer userDataMutex.Unlock()
+
+	secrets, err := loadSecrets(user)
+	if err != nil {
+		return "", false
+	}
+
+	secret, ok := secrets[name]
+	return secret.Value, ok
+}
+
+// Hides the values of the secrets in text that is shown to the user
+func maskSecrets(s string, secrets []string) string {
+	for _, secret := range secrets {
+		if secret != "" {
+			s = strings.Replace(s, secret, "****", -1)
+		}
+	}
+	return s
+}
+
+// GET /secrets lists the names of the secrets of the user, PUT
+// /secrets/<name> sets the value in the body ({"Value": ...}) and DELETE
+// /secrets/<name> removes it.
+func secretsHandler(writer http.ResponseWriter, req *http.Request, path string, pathSegs []string) bool {
+	user := requestUser(req)
+
+	switch {
+	case req.Method == "GET" && (len(pathSegs) == 1 || (len(pathSegs) == 2 && pathSegs[1] == "")):
+		userDataMutex.Lock()
+		secrets, err := loadSecrets(user)
+		userDataMutex.Unlock()
+		if err != nil {
+			ShowError(writer, 500, "Unable to load the secrets", err)
+			return true
+		}
+
+		infos := []SecretInfo{}
+		for name, secret := range secrets {
+			infos = append(infos, SecretInfo{name, secret.Updated})
+		}
+		sort.Slice(infos, func(i, j int) bool { return infos[i].Name < infos[j].Name })
+
+		ShowJson(writer, 200, infos)
+		return true
+	case req.Method == "PUT" && len(pathSegs) == 2:
+		name := pathSegs[1]
+		if !validSecretName.MatchString(name) {
+			ShowError(writer, 400, "Invalid secret name: "+name, nil)
+			return true
+		}
+
+		secret := Secret{}
+		err := json.NewDecoder(req.Body).Decode(&secret)
+		if err != nil || secret.Value == "" {
+			ShowError(writer, 400, "The secret has no value", err)
+			return true
+		}
+		secret.Updated = time.Now().Unix() * 1000
+
+		userDataMutex.Lock()
+		defer userDataMutex.Unlock()
+
+		secrets, err := loadSecrets(user)
+		if err != nil {
+			ShowError(writer, 500, "Unable to load the secrets", err)
+			return true
+		}
+		secrets[name] = secret
+
+		err = saveUserData(user, "secrets", secrets)
+		if err != nil {
+			ShowError(writer, 500, "Unable to save the secrets", err)
+			return true
+		}
+
+		ShowJson(writer, 200, SecretInfo{name, secret.Updated})
+		return true
+	case req.Method == "DELETE" && len(pathSegs) == 2:
+		userDataMutex.Lock()
+		defer userDataMutex.Unlock()
+
+		secrets, err := loadSecrets(user)
+		if err != nil {
+			ShowError(writer, 500, "Unable to load the secrets", err)
+			return true
+		}
+		if _, ok := secrets[pathSegs[1]]; !ok {
+			ShowError(writer, 404, "No such secret: "+pathSegs[1], nil)
+			return true
+		}
+		delete(secrets, pathSegs[1])
+
+		err = saveUserData(user, "secrets", secrets)
+		if err != nil {
+			ShowError(writer, 500, "Unable to save the secrets", err)
+			return true
+		}
+
+		writer.WriteHeader(204)
+		return true
+	}
+
+	return false
+}
@@ -0,0 +1,149 @@
+// Copyright 2014 Chris McGee <sirnewton_01@yahoo.ca>. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"math/big"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+const (
+	selfSignedValidity = 365 * 24 * time.Hour
+	// A certificate this close to expiring is replaced at startup
+	selfSignedRenewal = 30 * 24 * time.Hour
+)
+
+// SHA-256 fingerprint of the self-signed certificate, empty when the
+// certificate was provided
+var selfSignedFingerprint = ""
+
+// The certificate and key files of the configuration. Without them a
+// self-signed certificate for the host is generated into the data
+// directory, and kept for the next start.
+func serverCertFiles(config ServerConfig) (string, string, error) {
+	cert := configuredEnv("GOCERTFILE", config.CertFile)
+	key := configuredEnv("GOKEYFILE", config.KeyFile)
+
+	if cert != "" && key != "" {
+		selfSignedFingerprint = ""
+		return cert, key, nil
+	}
+	if cert != "" || key != "" {
+		return "", "", errors.New("Both a certificate file (GOCERTFILE) and a key file (GOKEYFILE) are needed, or neither for a self-signed certificate")
+	}
+
+	return selfSignedCertificate(hostName)
+}
+
+func selfSignedCertificate(host string) (string, string, error) {
+	dir := filepath.Join(godevDataDir(), "tls")
+	certFile := filepath.Join(dir, "self-signed-cert.pem")
+	keyFile := filepath.Join(dir, "self-signed-key.pem")
+
+	if fingerprint, ok := usableSelfSigned(certFile, keyFile, host); ok {
+		selfSignedFingerprint = fingerprint
+		return certFile, keyFile, nil
+	}
+
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return "", "", err
+	}
+	serial, err := rand.Int(rand.Reader, new(big.Int).Lsh(big.NewInt(1), 128))
+	if err != nil {
+		return "", "", err
+	}
+
+	template := x509.Certificate{
+		SerialNumber:          serial,
+		Subject:               pkix.Name{CommonName: host, Organization: []string{"godev"}},
+		NotBefore:             time.Now().Add(-1 * time.Hour),
+		NotAfter:              time.Now().Add(selfSignedValidity),
+		KeyUsage:              x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:           []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+		BasicConstraintsValid: true,
+	}
+	if ip := net.ParseIP(host); ip != nil {
+		template.IPAddresses = []net.IP{ip}
+	} else {
+		template.DNSNames = []string{host}
+	}
+
+	der, err := x509.CreateCertificate(rand.Reader, &template, &template, &key.PublicKey, key)
+	if err != nil {
+		return "", "", err
+	}
+	keyDer, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		return "", "", err
+	}
+
+	err = os.MkdirAll(dir, 0700)
+	if err != nil {
+		return "", "", err
+	}
+	err = ioutil.WriteFile(keyFile, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDer}), 0600)
+	if err != nil {
+		return "", "", err
+	}
+	err = ioutil.WriteFile(certFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0600)
+	if err != nil {
+		return "", "", err
+	}
+
+	logger.Printf("Generated a self-signed certificate for %v in %v\n", host, dir)
+	selfSignedFingerprint = certFingerprint(der)
+	return certFile, keyFile, nil
+}
+
+// Whether the certificate that was generated before is still good for the
+// host, and its fingerprint
+func usableSelfSigned(certFile string, keyFile string, host string) (string, bool) {
+	if _, err := os.Stat(keyFile); err != nil {
+		return "", false
+	}
+	b, err := ioutil.ReadFile(certFile)
+	if err != nil {
+		return "", false
+	}
+	block, _ := pem.Decode(b)
+	if block == nil {
+		return "", false
+	}
+	cert, err := x509.ParseCertificate(block.Bytes)
+	if err != nil {
+		return "", false
+	}
+
+	if time.Now().Add(selfSignedRenewal).After(cert.NotAfter) || cert.VerifyHostname(host) != nil {
+		return "", false
+	}
+
+	return certFingerprint(block.Bytes), true
+}
+
+func certFingerprint(der []byte) string {
+	sum := sha256.Sum256(der)
+	hex := []string{}
+	for _, b := range sum {
+		hex = append(hex, fmt.Sprintf("%02X", b))
+	}
+
+	return strings.Join(hex, ":")
+}
@@ -0,0 +1,220 @@
+// Copyright 2014 Chris McGee <sirnewton_01@yahoo.ca>. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"go/ast"
+	"go/build"
+	"go/types"
+	"io/ioutil"
+	"net/http"
+	"path/filepath"
+	"strings"
+)
+
+// Classification of an identifier by what it refers to
+type SemanticToken struct {
+	Offset int
+	Length int
+	// namespace, type, typeParameter, function, method, parameter,
+	//  variable, field, constant, label or builtin
+	Type string
+	// definition, readonly, deprecated and defaultLibrary
+	Modifiers []string `json:",omitempty"`
+}
+
+func semanticTokensHandler(writer http.ResponseWriter, req *http.Request, path string, pathSegs []string) bool {
+	switch {
+	case req.Method == "POST" && len(pathSegs) > 3:
+		filePath, err := bufferPath(requestSrcDirs(req), pathSegs)
+		if err != nil {
+			ShowError(writer, 400, "Invalid resource", err)
+			return true
+		}
+
+		buffer, err := ioutil.ReadAll(req.Body)
+		if err != nil {
+			ShowError(writer, 500, "Error reading the buffer", err)
+			return true
+		}
+
+		start, end, err := requestRange(req, len(buffer))
+		if err != nil {
+			ShowError(writer, 400, "Invalid range", err)
+			return true
+		}
+
+		checked, err := typeCheckBuffer(buffer, filePath)
+		if err != nil {
+			ShowError(writer, 400, "Error parsing go source", err)
+			return true
+		}
+
+		ShowJson(writer, 200, semanticTokens(checked, start, end))
+		return true
+	}
+
+	return false
+}
+
+func semanticTokens(checked *checkedBuffer, start int, end int) []SemanticToken {
+	tokens := []SemanticToken{}
+	info := checked.info
+
+	// Parameters are variables like any other to the type checker
+	params := make(map[types.Object]bool)
+	deprecated := make(map[types.Object]bool)
+
+	ast.Inspect(checked.file, func(n ast.Node) bool {
+		switch x := n.(type) {
+		case *ast.FuncType:
+			for _, list := range []*ast.FieldList{x.Params, x.Results} {
+				markFields(info, list, params)
+			}
+		case *ast.FuncDecl:
+			markFields(info, x.Recv, params)
+			if isDeprecated(x.Doc) {
+				deprecated[info.Defs[x.Name]] = true
+			}
+		case *ast.GenDecl:
+			for _, spec := range x.Specs {
+				switch s := spec.(type) {
+				case *ast.TypeSpec:
+					if isDeprecated(x.Doc) || isDeprecated(s.Doc) {
+						deprecated[info.Defs[s.Name]] = true
+					}
+				case *ast.ValueSpec:
+					if isDeprecated(x.Doc) || isDeprecated(s.Doc) {
+						for _, name := range s.Names {
+							deprecated[info.Defs[name]] = true
+						}
+					}
+				}
+			}
+		case *ast.Field:
+			if isDeprecated(x.Doc) {
+				for _, name := range x.Names {
+					deprecated[info.Defs[name]] = true
+				}
+			}
+		}
+		return true
+	})
+
+	// Documentation of the imported packages by import path
+	importedDocs := make(map[string]map[string]string)
+	dir := filepath.Dir(checked.fileset.Position(checked.file.Pos()).Filename)
+
+	isDeprecatedImport := func(obj types.Object) bool {
+		pkg := obj.Pkg()
+		if pkg == nil || pkg == checked.pkg || obj.Parent() != pkg.Scope() {
+			return false
+		}
+
+		docs, ok := importedDocs[pkg.Path()]
+		if !ok {
+			if buildPkg, err := build.Import(pkg.Path(), dir, 0); err == nil {
+				docs = loadPackageDocs(buildPkg)
+			}
+			importedDocs[pkg.Path()] = docs
+		}
+
+		return strings.Contains(docs[obj.Name()], "Deprecated:")
+	}
+
+	ast.Inspect(checked.file, func(n ast.Node) bool {
+		if n == nil {
+			return false
+		}
+		if checked.offset(n.End()) < start || checked.offset(n.Pos()) > end {
+			return false
+		}
+
+		ident, ok := n.(*ast.Ident)
+		if !ok {
+			return true
+		}
+
+		modifiers := []string{}
+		obj := info.Defs[ident]
+		if obj != nil {
+			modifiers = append(modifiers, "definition")
+		} else {
+			obj = info.Uses[ident]
+		}
+		if obj == nil {
+			return false
+		}
+
+		tokenType := ""
+		switch o := obj.(type) {
+		case *types.PkgName:
+			tokenType = "namespace"
+		case *types.TypeName:
+			tokenType = "type"
+			if _, ok := o.Type().(*types.TypeParam); ok {
+				tokenType = "typeParameter"
+			}
+			if o.Pkg() == nil {
+				modifiers = append(modifiers, "defaultLibrary")
+			}
+		case *types.Func:
+			tokenType = "function"
+			if sig, ok := o.Type().(*types.Signature); ok && sig.Recv() != nil {
+				tokenType = "method"
+			}
+		case *types.Var:
+			switch {
+			case o.IsField():
+				tokenType = "field"
+			case params[o]:
+				tokenType = "parameter"
+			default:
+				tokenType = "variable"
+			}
+		case *types.Const:
+			tokenType = "constant"
+			modifiers = append(modifiers, "readonly")
+			if o.Pkg() == nil {
+				modifiers = append(modifiers, "defaultLibrary")
+			}
+		case *types.Label:
+			tokenType = "label"
+		case *types.Builtin, *types.Nil:
+			tokenType = "builtin"
+			modifiers = append(modifiers, "defaultLibrary")
+		default:
+			return false
+		}
+
+		if deprecated[obj] || isDeprecatedImport(obj) {
+			modifiers = append(modifiers, "deprecated")
+		}
+
+		tokens = append(tokens, SemanticToken{checked.offset(ident.Pos()), len(ident.Name), tokenType, modifiers})
+		return false
+	})
+
+	return tokens
+}
+
+func markFields(info *types.Info, list *ast.FieldList, objs map[types.Object]bool) {
+	if list == nil {
+		return
+	}
+
+	for _, field := range list.List {
+		for _, name := range field.Names {
+			if obj := info.Defs[name]; obj != nil {
+				objs[obj] = true
+			}
+		}
+	}
+}
+
+// Deprecation follows the convention of a paragraph that starts with it
+func isDeprecated(doc *ast.CommentGroup) bool {
+	return doc != nil && strings.Contains(doc.Text(), "Deprecated:")
+}
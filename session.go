@@ -0,0 +1,118 @@
+// Copyright 2014 Chris McGee <sirnewton_01@yahoo.ca>. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+type EditorState struct {
+	Location string
+	Line     int
+	Column   int
+	Active   bool
+}
+
+type RunConfiguration struct {
+	Name   string
+	Cmd    string
+	Params string
+	Race   bool
+	Debug  bool
+	// Workspace location of the log that the program writes, for tailing
+	OutputFile string `json:",omitempty"`
+}
+
+type SessionState struct {
+	OpenEditors       []EditorState
+	Layout            map[string]string
+	RunConfigurations []RunConfiguration
+	ExpandedNodes     []string
+	Saved             int64
+}
+
+func loadSession(user string) (*SessionState, error) {
+	state := &SessionState{OpenEditors: []EditorState{}, Layout: map[string]string{},
+		RunConfigurations: []RunConfiguration{}, ExpandedNodes: []string{}}
+	err := loadUserData(user, "session", state)
+	return state, err
+}
+
+// Location of the page that the user was working on when the session was
+// last saved, empty if there is nothing to restore.
+func sessionLandingPage(user string) string {
+	userDataMutex.Lock()
+	state, err := loadSession(user)
+	userDataMutex.Unlock()
+
+	if err != nil {
+		return ""
+	}
+
+	for _, editor := range state.OpenEditors {
+		if editor.Active {
+			page := "/edit/edit.html#" + editor.Location
+			if editor.Line > 0 {
+				page = page + ",line=" + strconv.FormatInt(int64(editor.Line), 10)
+			}
+			return page
+		}
+	}
+
+	return ""
+}
+
+func sessionHandler(writer http.ResponseWriter, req *http.Request, path string, pathSegs []string) bool {
+	user := requestUser(req)
+
+	userDataMutex.Lock()
+	defer userDataMutex.Unlock()
+
+	switch {
+	case req.Method == "GET" && len(pathSegs) == 1:
+		state, err := loadSession(user)
+		if err != nil {
+			ShowError(writer, 500, "Unable to load session", err)
+			return true
+		}
+
+		ShowJson(writer, 200, state)
+		return true
+	case req.Method == "PUT" && len(pathSegs) == 1:
+		state := &SessionState{}
+		err := json.NewDecoder(req.Body).Decode(state)
+		if err != nil {
+			ShowError(writer, 400, "Invalid session state", err)
+			return true
+		}
+
+		state.Saved = time.Now().Unix() * 1000
+		err = saveUserData(user, "session", state)
+		if err != nil {
+			ShowError(writer, 500, "Unable to save session", err)
+			return true
+		}
+
+		// Other browsers of the same user can pick up the new layout
+		publishEvent(Event{Type: "session", User: user, Data: state.Saved})
+
+		writer.WriteHeader(204)
+		return true
+	case req.Method == "DELETE" && len(pathSegs) == 1:
+		err := saveUserData(user, "session", &SessionState{})
+		if err != nil {
+			ShowError(writer, 500, "Unable to clear session", err)
+			return true
+		}
+
+		writer.WriteHeader(204)
+		return true
+	}
+
+	return false
+}
@@ -0,0 +1,430 @@
+// Copyright 2014 Chris McGee <sirnewton_01@yahoo.ca>. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	maxShellAuditEntries = 200
+)
+
+// Command line of the shell page, run without a shell in between
+type ShellRequest struct {
+	Command string
+	Args    []string
+	// Workspace location of the working directory, e.g. /file/github.com/user/project
+	Dir string
+}
+
+type ShellOutput struct {
+	Output string
+}
+
+type ShellResult struct {
+	Output   string `json:",omitempty"`
+	ExitCode int
+	// Milliseconds
+	Duration int64
+}
+
+type ShellAuditEntry struct {
+	Time    int64
+	User    string
+	Command string
+	Args    []string
+	Dir     string
+	// Why the command was refused, empty when it ran
+	Denied   string `json:",omitempty"`
+	ExitCode int
+	Duration int64
+}
+
+var (
+	shellAuditMutex sync.Mutex
+
+	// The rules below keep the commands to the workspace and to what they
+	//  were asked to do, they are no sandbox: a Makefile, a git hook or a
+	//  cgo build runs whatever the workspace has. That is why the shell needs
+	//  the terminal permission of a role.
+
+	// Subcommands that the commands may run, those that run programs given
+	//  on the command line or change the configuration for later runs
+	//  aren't among them
+	shellSubcommands = map[string][]string{
+		"git": {"status", "log", "diff", "show", "branch", "tag", "add", "commit", "reset", "checkout", "switch",
+			"restore", "merge", "rebase", "cherry-pick", "revert", "stash", "fetch", "pull", "push", "clone",
+			"remote", "blame", "shortlog", "describe", "rev-parse", "ls-files", "mv", "rm", "clean", "grep",
+			"reflog", "init"},
+		"go": {"build", "vet", "fmt", "list", "doc", "version", "mod", "install", "clean", "env"},
+	}
+
+	// Arguments that would have the allowed commands run some other program
+	//  of the caller's choosing or keep settings for later runs, by command
+	//  or by command and subcommand. A flag is also denied in its -flag=value
+	//  form, abbreviated and with its value glued to it, and so is a short
+	//  flag combined with others. The working directory of git is the one of
+	//  the request.
+	shellDeniedArgs = map[string][]string{
+		"go":         {"-exec", "-toolexec", "-overlay"},
+		"go env":     {"-w", "-u"},
+		"git":        {"-c", "-C", "--config-env", "--exec-path", "--git-dir", "--work-tree", "--upload-pack", "--receive-pack"},
+		"git rebase": {"-x", "--exec"},
+		"git clone":  {"-c", "--config", "--template", "-u"},
+		"git push":   {"--exec"},
+		"git grep":   {"-O", "--open-files-in-pager"},
+		"make":       {"--eval", "-E"},
+	}
+
+	// Options of the command that come before the subcommand and take the
+	//  next argument as their value
+	shellValueArgs = map[string][]string{
+		"git": {"-c", "-C", "--config-env", "--git-dir", "--work-tree", "--namespace", "--super-prefix", "--attr-source"},
+	}
+
+	// Commands that parse their flags with the flag package, where -flag and
+	//  --flag are the same and short flags aren't combined
+	shellFlagPackageCommands = map[string]bool{"go": true}
+)
+
+func shellAuditFile() string {
+	return filepath.Join(godevDataDir(), "shell-audit.log")
+}
+
+func shellAllowed(command string) bool {
+	for _, c := range strings.Split(*shellCommands, ",") {
+		if strings.TrimSpace(c) == command && command != "" {
+			return true
+		}
+	}
+
+	return false
+}
+
+// Location of the working directory on disk, which has to be a directory
+// of the workspace.
+func shellDir(srcDirs []string, location string) (string, error) {
+	relPath := strings.TrimPrefix(location, "/file")
+	if relPath == location && location != "" {
+		return "", errors.New("The directory isn't a workspace location: " + location)
+	}
+
+	relPath = filepath.Clean("/" + relPath)
+	for _, srcDir := range srcDirs {
+		p := filepath.Join(srcDir, relPath)
+		if info, err := os.Stat(p); err == nil && info.IsDir() {
+			return p, nil
+		}
+	}
+
+	return "", errors.New("No such workspace directory: " + location)
+}
+
+func inWorkspace(srcDirs []string, p string) bool {
+	for _, srcDir := range srcDirs {
+		if p == srcDir || strings.HasPrefix(p, srcDir+string(filepath.Separator)) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// Whether the flag is the denied one. Long flags of the getopt style can be
+// abbreviated and short ones are combined like -xvf, a letter of a value that
+// is glued to a short flag is taken for a flag too.
+func shellFlagDenied(name string, denied string, flagPackage bool) bool {
+	if flagPackage {
+		return "-"+strings.TrimLeft(name, "-") == denied
+	}
+
+	switch {
+	case name == denied:
+		return true
+	case strings.HasPrefix(name, "--"):
+		return strings.HasPrefix(denied, "--") && len(name) > 2 && strings.HasPrefix(denied, name)
+	case len(denied) == 2 && denied[0] == '-' && denied[1] != '-':
+		return strings.ContainsRune(name[1:], rune(denied[1]))
+	}
+
+	return false
+}
+
+// Values in the argument that could be paths, the argument itself and the
+// value of a flag, whether after = or glued to a short flag
+func shellArgValues(arg string, flagPackage bool) []string {
+	switch {
+	case !strings.HasPrefix(arg, "-"):
+		values := []string{arg}
+		// Variables like those of make
+		if eq := strings.Index(arg, "="); eq != -1 {
+			values = append(values, arg[eq+1:])
+		}
+		return values
+	case strings.Contains(arg, "="):
+		value := arg[strings.Index(arg, "=")+1:]
+		return []string{value, strings.TrimLeft(value, "-")}
+	case strings.HasPrefix(arg, "--") || flagPackage:
+		return nil
+	}
+
+	// Any of the short flags can be the one that the rest belongs to
+	values := []string{}
+	for idx := 2; idx < len(arg); idx++ {
+		values = append(values, arg[idx:])
+	}
+	return values
+}
+
+// Checks the arguments against the rules of the command. Anything that
+// names a path outside of the workspace is refused.
+func validateShellArgs(srcDirs []string, command string, args []string, dir string) error {
+	subcommandIdx := -1
+	for idx := 0; idx < len(args); idx++ {
+		if !strings.HasPrefix(args[idx], "-") {
+			subcommandIdx = idx
+			break
+		}
+		for _, valueArg := range shellValueArgs[command] {
+			if args[idx] == valueArg {
+				idx++
+				break
+			}
+		}
+	}
+	subcommand := ""
+	if subcommandIdx != -1 {
+		subcommand = args[subcommandIdx]
+	}
+
+	if subcommands, ok := shellSubcommands[command]; ok && subcommand != "" {
+		allowed := false
+		for _, s := range subcommands {
+			allowed = allowed || subcommand == s
+		}
+		if !allowed {
+			return errors.New("The " + command + " " + subcommand + " command isn't allowed")
+		}
+	}
+
+	flagPackage := shellFlagPackageCommands[command]
+	for idx, arg := range args {
+		// The options of git itself that take a value come before its
+		//  subcommand, the same letters after it are the subcommand's
+		deniedArgs := append([]string{}, shellDeniedArgs[command+" "+subcommand]...)
+		for _, denied := range shellDeniedArgs[command] {
+			commandOnly := false
+			for _, valueArg := range shellValueArgs[command] {
+				commandOnly = commandOnly || denied == valueArg
+			}
+			if !commandOnly || subcommandIdx == -1 || idx < subcommandIdx {
+				deniedArgs = append(deniedArgs, denied)
+			}
+		}
+
+		if strings.HasPrefix(arg, "-") && arg != "-" {
+			name := arg
+			if eq := strings.Index(arg, "="); eq != -1 {
+				name = arg[:eq]
+			}
+
+			for _, denied := range deniedArgs {
+				if shellFlagDenied(name, denied, flagPackage) {
+					return errors.New("The " + denied + " argument isn't allowed")
+				}
+			}
+		}
+
+		for _, v := range shellArgValues(arg, flagPackage) {
+			if v == "" {
+				continue
+			}
+
+			escapes := filepath.IsAbs(v)
+			for _, seg := range strings.Split(filepath.ToSlash(v), "/") {
+				escapes = escapes || seg == ".."
+			}
+			if !escapes {
+				continue
+			}
+
+			p := v
+			if !filepath.IsAbs(p) {
+				p = filepath.Join(dir, p)
+			}
+			if !inWorkspace(srcDirs, filepath.Clean(p)) {
+				return errors.New("The path " + v + " is outside of the workspace")
+			}
+		}
+	}
+
+	return nil
+}
+
+func recordShellAudit(entry ShellAuditEntry) {
+	logger.Printf("SHELL %v: %v %v in %v (denied: %v, exit: %v)\n", entry.User, entry.Command, entry.Args, entry.Dir, entry.Denied, entry.ExitCode)
+
+	b, err := json.Marshal(entry)
+	if err != nil {
+		return
+	}
+
+	shellAuditMutex.Lock()
+	defer shellAuditMutex.Unlock()
+
+	os.MkdirAll(godevDataDir(), 0700)
+	f, err := os.OpenFile(shellAuditFile(), os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0600)
+	if err != nil {
+		logger.Printf("Unable to write the shell audit log: %v\n", err)
+		return
+	}
+	defer f.Close()
+
+	f.Write(append(b, '\n'))
+}
+
+// The most recent entries of the audit log, newest last
+func shellAuditEntries(limit int) ([]ShellAuditEntry, error) {
+	shellAuditMutex.Lock()
+	defer shellAuditMutex.Unlock()
+
+	entries := []ShellAuditEntry{}
+
+	f, err := os.Open(shellAuditFile())
+	if os.IsNotExist(err) {
+		return entries, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		entry := ShellAuditEntry{}
+		if json.Unmarshal(scanner.Bytes(), &entry) == nil {
+			entries = append(entries, entry)
+		}
+		if len(entries) > limit {
+			entries = entries[1:]
+		}
+	}
+
+	return entries, scanner.Err()
+}
+
+// Writer that sends each piece of output as it comes
+type shellStreamWriter struct {
+	stream *JsonStream
+	mutex  sync.Mutex
+}
+
+func (w *shellStreamWriter) Write(p []byte) (int, error) {
+	w.mutex.Lock()
+	defer w.mutex.Unlock()
+
+	err := w.stream.Send(ShellOutput{string(p)})
+	if err != nil {
+		return 0, err
+	}
+
+	return len(p), nil
+}
+
+// POST /shell/exec runs an allowed command. Clients that accept
+// application/x-ndjson get the output as it is written followed by the
+// result, the others get it all at once.
+func shellHandler(writer http.ResponseWriter, req *http.Request, path string, pathSegs []string) bool {
+	switch {
+	case req.Method == "POST" && len(pathSegs) == 2 && pathSegs[1] == "exec":
+		request := ShellRequest{}
+		err := json.NewDecoder(req.Body).Decode(&request)
+		if err != nil {
+			ShowError(writer, 400, "Invalid command", err)
+			return true
+		}
+
+		entry := ShellAuditEntry{Time: time.Now().Unix() * 1000, User: requestUser(req),
+			Command: request.Command, Args: request.Args, Dir: request.Dir}
+
+		if !shellAllowed(request.Command) {
+			entry.Denied = "The " + request.Command + " command isn't allowed"
+			recordShellAudit(entry)
+			ShowError(writer, 403, entry.Denied, nil)
+			return true
+		}
+
+		dir, err := shellDir(requestSrcDirs(req), request.Dir)
+		if err != nil {
+			entry.Denied = err.Error()
+			recordShellAudit(entry)
+			ShowError(writer, 400, entry.Denied, nil)
+			return true
+		}
+
+		err = validateShellArgs(requestSrcDirs(req), request.Command, request.Args, dir)
+		if err != nil {
+			entry.Denied = err.Error()
+			recordShellAudit(entry)
+			ShowError(writer, 403, entry.Denied, nil)
+			return true
+		}
+
+		ctx, cancel := operationContext(req, *buildTimeout)
+		defer cancel()
+
+		cmd := exec.CommandContext(ctx, request.Command, request.Args...)
+		cmd.Dir = dir
+
+		var stream *JsonStream
+		output := &cappedBuffer{limit: maxScratchOutput}
+		if wantsJsonStream(req) {
+			stream = NewJsonStream(writer, req)
+			w := &shellStreamWriter{stream: stream}
+			cmd.Stdout = w
+			cmd.Stderr = w
+		} else {
+			cmd.Stdout = output
+			cmd.Stderr = output
+		}
+
+		start := time.Now()
+		err = cmd.Run()
+		entry.Duration = int64(time.Since(start) / time.Millisecond)
+
+		if cmd.ProcessState != nil {
+			entry.ExitCode = cmd.ProcessState.ExitCode()
+		} else if err != nil {
+			entry.ExitCode = -1
+			output.WriteString(err.Error() + "\n")
+			if stream != nil {
+				stream.Send(ShellOutput{err.Error() + "\n"})
+			}
+		}
+		recordShellAudit(entry)
+
+		result := ShellResult{ExitCode: entry.ExitCode, Duration: entry.Duration}
+		if stream != nil {
+			stream.Send(result)
+			return true
+		}
+
+		result.Output = output.String()
+		ShowJson(writer, 200, result)
+		return true
+	}
+
+	return false
+}
@@ -0,0 +1,99 @@
+// Copyright 2014 Chris McGee <sirnewton_01@yahoo.ca>. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestValidateShellArgs(t *testing.T) {
+	workspace := filepath.Join(t.TempDir(), "src")
+	dir := filepath.Join(workspace, "github.com", "user", "project")
+
+	tests := []struct {
+		command string
+		args    string
+		valid   bool
+	}{
+		{"git", "status", true},
+		{"git", "log -Scache", true},
+		{"git", "log -C --stat", true},
+		{"git", "diff -- ../other/main.go", true},
+		{"git", "-c core.fsmonitor=cmd status", false},
+		{"git", "-ccore.fsmonitor=cmd status", false},
+		{"git", "-C .. status", false},
+		{"git", "-C.. status", false},
+		{"git", "--git-dir=/tmp/repo status", false},
+		{"git", "--git-d=/tmp/repo status", false},
+		{"git", "--exec-path=/tmp status", false},
+		{"git", "--namespace x config user.name", false},
+		{"git", "config user.name", false},
+		{"git", "submodule foreach cmd", false},
+		{"git", "difftool -x cmd", false},
+		{"git", "clone -c core.sshCommand=cmd ssh://x/y", false},
+		{"git", "clone --config=core.sshCommand=cmd ssh://x/y", false},
+		{"git", "clone --template=tpl ssh://x/y", false},
+		{"git", "clone ssh://x/y", true},
+		{"git", "grep -Ocmd x", false},
+		{"git", "grep -O cmd x", false},
+		{"git", "grep -nO cmd x", false},
+		{"git", "grep --open-files-in-pager=cmd x", false},
+		{"git", "grep --open=cmd x", false},
+		{"git", "grep -n TODO", true},
+		{"git", "log -c", true},
+		{"git", "rebase -x cmd main", false},
+		{"git", "rebase -ix cmd main", false},
+		{"git", "rebase --exe=cmd main", false},
+		{"git", "fetch --upload-pack=cmd origin", false},
+		{"git", "fetch --upload=cmd origin", false},
+		{"git", "clone -u cmd origin", false},
+		{"git", "push --exec=cmd origin", false},
+		{"git", "push --receive-pack=cmd origin", false},
+		{"git", "archive --exec=cmd HEAD", false},
+		{"git", "--exec-path status", false},
+		{"git", "log --exec-path", false},
+		{"git", "log /etc/passwd", false},
+		{"git", "log --output=/tmp/log", false},
+		{"git", "log --output=../../../../log", false},
+		{"make", "-j4 all", true},
+		{"make", "test", true},
+		{"make", "-C /etc", false},
+		{"make", "-C/etc", false},
+		{"make", "-sC/etc", false},
+		{"make", "-f ../../../../Makefile", false},
+		{"make", "VAR=../../../../x", false},
+		{"make", "--eval=all:", false},
+		{"make", "--ev=all:", false},
+		{"make", "-E all:", false},
+		{"go", "build ./...", true},
+		{"go", "build -x -o bin/x", true},
+		{"go", "list -m all", true},
+		{"go", "build -o /tmp/x", false},
+		{"go", "build -o=/tmp/x", false},
+		{"go", "build --toolexec=x", false},
+		{"go", "vet -exec x ./...", false},
+		{"go", "build -overlay=overlay.json", false},
+		{"go", "env -w GOFLAGS=-toolexec=cmd", false},
+		{"go", "env -u GOFLAGS", false},
+		{"go", "env GOPATH", true},
+		{"go", "run main.go", false},
+		{"go", "test ./...", false},
+		{"go", "generate ./...", false},
+		{"go", "tool cmd", false},
+		{"go", "mod tidy", true},
+	}
+
+	for _, test := range tests {
+		err := validateShellArgs([]string{workspace}, test.command, strings.Fields(test.args), dir)
+		if test.valid && err != nil {
+			t.Errorf("%v %v was refused: %v", test.command, test.args, err)
+		}
+		if !test.valid && err == nil {
+			t.Errorf("%v %v was allowed", test.command, test.args)
+		}
+	}
+}
@@ -0,0 +1,171 @@
+// Copyright 2014 Chris McGee <sirnewton_01@yahoo.ca>. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"code.google.com/p/go.net/websocket"
+	"context"
+	"flag"
+	"net"
+	"net/http"
+	"os"
+	"os/signal"
+	"sync"
+	"syscall"
+	"time"
+)
+
+var (
+	shutdownTimeout = flag.Duration("shutdownTimeout", 10*time.Second, "How long requests, builds, tests and the processes of the sessions get to finish when the server is stopped before they are cancelled.")
+
+	// The requests and the commands that they run are cancelled with it once
+	//  the server has stopped waiting for them
+	serverContext, cancelServer = context.WithCancel(context.Background())
+
+	httpServer   *http.Server
+	shutdownOnce sync.Once
+	shutdownDone = make(chan struct{})
+
+	socketsMutex sync.Mutex
+	openSockets  = make(map[*websocket.Conn]bool)
+	shuttingDown = false
+)
+
+func newServer(handler http.Handler) *http.Server {
+	return &http.Server{Handler: handler,
+		BaseContext: func(net.Listener) context.Context { return serverContext }}
+}
+
+// Stops the server gracefully on an interrupt (Ctrl-C) or SIGTERM, a second
+// one doesn't wait any longer
+func stopOnSignals() {
+	stop := make(chan os.Signal, 2)
+	signal.Notify(stop, os.Interrupt, syscall.SIGTERM)
+
+	go func() {
+		sig := <-stop
+		logger.Infof("Received %v, shutting down\n", sig)
+		shutdownServer()
+
+		<-stop
+		logger.Warnf("Stopping without waiting\n")
+		unregisterInstance()
+		os.Exit(1)
+	}()
+}
+
+func isShuttingDown() bool {
+	socketsMutex.Lock()
+	defer socketsMutex.Unlock()
+
+	return shuttingDown
+}
+
+// Keeps track of the websocket until the returned function is called, so
+// that it can be closed with a close frame when the server stops. Sockets
+// that come in while the server is stopping are refused.
+func trackSocket(ws *websocket.Conn) (func(), bool) {
+	socketsMutex.Lock()
+	defer socketsMutex.Unlock()
+
+	if shuttingDown {
+		return nil, false
+	}
+	openSockets[ws] = true
+
+	return func() {
+		socketsMutex.Lock()
+		delete(openSockets, ws)
+		socketsMutex.Unlock()
+	}, true
+}
+
+func closeSockets() {
+	socketsMutex.Lock()
+	sockets := []*websocket.Conn{}
+	for ws := range openSockets {
+		sockets = append(sockets, ws)
+	}
+	socketsMutex.Unlock()
+
+	for _, ws := range sockets {
+		ws.Close()
+	}
+}
+
+// Interrupts the processes of the sessions and waits for them to finish,
+// the ones that are still running when the context is done are killed
+func stopProcesses(ctx context.Context) {
+	processesMutex.Lock()
+	running := []*ChildProcess{}
+	for _, p := range childProcesses {
+		running = append(running, p)
+	}
+	processesMutex.Unlock()
+
+	for _, p := range running {
+		// Windows has no interrupt for other processes
+		if p.cmd.Process == nil || p.cmd.Process.Signal(os.Interrupt) != nil {
+			p.kill()
+		}
+	}
+
+	for _, p := range running {
+		for findProcess(p.Id) != nil && ctx.Err() == nil {
+			time.Sleep(50 * time.Millisecond)
+		}
+		if findProcess(p.Id) != nil {
+			p.kill()
+		}
+	}
+}
+
+// Stops accepting connections and gives what is running the shutdown
+// timeout to finish before cancelling it. The processes of the sessions are
+// interrupted and the websockets are closed with a close frame.
+func shutdownServer() {
+	shutdownOnce.Do(func() {
+		socketsMutex.Lock()
+		shuttingDown = true
+		socketsMutex.Unlock()
+
+		go func() {
+			defer close(shutdownDone)
+
+			ctx, cancel := context.WithTimeout(context.Background(), *shutdownTimeout)
+			defer cancel()
+
+			drained := make(chan error, 1)
+			go func() {
+				if httpServer == nil {
+					drained <- nil
+					return
+				}
+				drained <- httpServer.Shutdown(ctx)
+			}()
+
+			stopProcesses(ctx)
+			closeSockets()
+
+			if err := <-drained; err != nil {
+				logger.Warnf("Cancelling the requests that are still running after %v\n", *shutdownTimeout)
+			}
+			cancelServer()
+			if httpServer != nil {
+				// The cancelled requests still get to answer
+				grace, cancelGrace := context.WithTimeout(context.Background(), time.Second)
+				httpServer.Shutdown(grace)
+				cancelGrace()
+				httpServer.Close()
+			}
+
+			unregisterInstance()
+			if socketPath != "" {
+				os.Remove(socketPath)
+			}
+			logger.Infof("The server has stopped\n")
+		}()
+	})
+}
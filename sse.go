@@ -0,0 +1,239 @@
+// Copyright 2014 Chris McGee <sirnewton_01@yahoo.ca>. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"sync"
+	"time"
+)
+
+const (
+	sseKeepAlive = 30 * time.Second
+	maxSseInput  = 64 * 1024
+)
+
+// Connection of a task (run, debug or test) to the browser. A task talks
+// to either a WebSocket or, where those are blocked, an event stream.
+type taskConn interface {
+	io.ReadWriteCloser
+	Request() *http.Request
+}
+
+// Server-sent events carry the output of a task to the browser, which posts
+// any input back separately. Everything written is sent as a JSON string in
+// an "output" event.
+type sseConn struct {
+	Id     string
+	writer http.ResponseWriter
+	req    *http.Request
+	input  chan []byte
+	done   chan bool
+	mutex  sync.Mutex
+	closed bool
+}
+
+var (
+	sseMutex sync.Mutex
+	sseConns = make(map[string]*sseConn)
+)
+
+// Sends an event to the browser, the mutex must be held
+func (c *sseConn) event(name string, data []byte) error {
+	if c.closed {
+		return io.ErrClosedPipe
+	}
+
+	_, err := fmt.Fprintf(c.writer, "event: %v\ndata: %s\n\n", name, data)
+	if err != nil {
+		return err
+	}
+
+	if flusher, ok := c.writer.(http.Flusher); ok {
+		flusher.Flush()
+	}
+
+	return nil
+}
+
+func (c *sseConn) Write(b []byte) (int, error) {
+	data, err := json.Marshal(string(b))
+	if err != nil {
+		return 0, err
+	}
+
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	err = c.event("output", data)
+	if err != nil {
+		return 0, err
+	}
+
+	return len(b), nil
+}
+
+func (c *sseConn) Read(b []byte) (int, error) {
+	select {
+	case in := <-c.input:
+		// Input larger than the buffer is cut short, it is posted in small
+		//  pieces (e.g. key strokes) anyway.
+		return copy(b, in), nil
+	case <-c.done:
+		return 0, io.EOF
+	}
+}
+
+func (c *sseConn) Close() error {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	if !c.closed {
+		c.closed = true
+		close(c.done)
+	}
+
+	return nil
+}
+
+func (c *sseConn) Request() *http.Request {
+	return c.req
+}
+
+func sseHeaders(writer http.ResponseWriter) {
+	writer.Header().Set("Content-Type", "text/event-stream")
+	writer.Header().Set("Cache-Control", "no-cache")
+	// Keep buffering proxies from holding back the events
+	writer.Header().Set("X-Accel-Buffering", "no")
+	writer.WriteHeader(200)
+}
+
+// Runs the task streaming its output until it finishes or the browser goes
+// away. The first event tells the browser where to post its input.
+func serveTaskStream(writer http.ResponseWriter, req *http.Request, task func(conn taskConn)) {
+	conn := &sseConn{Id: newId(), writer: writer, req: req, input: make(chan []byte, 16), done: make(chan bool)}
+
+	sseMutex.Lock()
+	sseConns[conn.Id] = conn
+	sseMutex.Unlock()
+
+	defer func() {
+		sseMutex.Lock()
+		delete(sseConns, conn.Id)
+		sseMutex.Unlock()
+	}()
+
+	sseHeaders(writer)
+
+	start, _ := json.Marshal(conn)
+	conn.mutex.Lock()
+	conn.event("stream", start)
+	conn.mutex.Unlock()
+
+	finished := make(chan bool)
+	go func() {
+		task(conn)
+		close(finished)
+	}()
+
+	for {
+		select {
+		case <-finished:
+			conn.mutex.Lock()
+			conn.event("end", []byte("{}"))
+			conn.mutex.Unlock()
+			conn.Close()
+			return
+		case <-req.Context().Done():
+			// Nothing may be written once the handler returns
+			conn.Close()
+			return
+		case <-time.After(sseKeepAlive):
+			conn.mutex.Lock()
+			if !conn.closed {
+				fmt.Fprint(writer, ": keep-alive\n\n")
+				if flusher, ok := writer.(http.Flusher); ok {
+					flusher.Flush()
+				}
+			}
+			conn.mutex.Unlock()
+		}
+	}
+}
+
+// Passes input posted by the browser on to the task of the stream
+func taskStreamInput(writer http.ResponseWriter, req *http.Request, id string) {
+	sseMutex.Lock()
+	conn := sseConns[id]
+	sseMutex.Unlock()
+
+	if conn == nil || requestUser(conn.req) != requestUser(req) {
+		ShowError(writer, 404, "No such stream", nil)
+		return
+	}
+
+	input, err := ioutil.ReadAll(io.LimitReader(req.Body, maxSseInput))
+	if err != nil {
+		ShowError(writer, 400, "Unable to read the input", err)
+		return
+	}
+
+	select {
+	case conn.input <- input:
+		writer.WriteHeader(204)
+	case <-conn.done:
+		ShowError(writer, 410, "The task has finished", errors.New("stream closed"))
+	}
+}
+
+// The event bus as a stream of "event" events
+func serveEventStream(writer http.ResponseWriter, req *http.Request) {
+	c := subscribeEvents(requestUser(req))
+	defer unsubscribeEvents(c)
+
+	sseHeaders(writer)
+
+	flush := func() {
+		if flusher, ok := writer.(http.Flusher); ok {
+			flusher.Flush()
+		}
+	}
+
+	for {
+		select {
+		case e := <-c:
+			output, err := json.Marshal(e)
+			if err != nil {
+				continue
+			}
+
+			_, err = fmt.Fprintf(writer, "event: event\ndata: %s\n\n", output)
+			if err != nil {
+				return
+			}
+			flush()
+		case <-req.Context().Done():
+			return
+		case <-time.After(sseKeepAlive):
+			fmt.Fprint(writer, ": keep-alive\n\n")
+			flush()
+		}
+	}
+}
+
+func eventsHandler(writer http.ResponseWriter, req *http.Request, path string, pathSegs []string) bool {
+	switch {
+	case req.Method == "GET" && len(pathSegs) == 2 && pathSegs[1] == "stream":
+		serveEventStream(writer, req)
+		return true
+	}
+
+	return false
+}
@@ -0,0 +1,187 @@
+// Copyright 2014 Chris McGee <sirnewton_01@yahoo.ca>. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+// Pasted panic, test or log output with its references to source files
+type StackTrace struct {
+	// First line of the panic or fatal error, if there is one
+	Panic string `json:",omitempty"`
+	Links []StackLink
+}
+
+// Reference to a file and line in the text
+type StackLink struct {
+	// Line of the text, starting at 1, and the byte offsets of the
+	//  reference in it
+	Line  int
+	Start int
+	End   int
+
+	File     string
+	FileLine int
+	Column   int `json:",omitempty"`
+	// Function of the frame and its goroutine for stack traces
+	Function  string `json:",omitempty"`
+	Goroutine int    `json:",omitempty"`
+
+	// Workspace location and editor page, empty when the file isn't found
+	Location string `json:",omitempty"`
+	Url      string `json:",omitempty"`
+}
+
+var (
+	// file.go:12 and file.go:12:5, with Windows drive letters
+	stackFileRef    = regexp.MustCompile(`((?:[A-Za-z]:)?[^\s:"'()]+\.go):(\d+)(?::(\d+))?`)
+	stackGoroutine  = regexp.MustCompile(`^goroutine (\d+) \[`)
+	stackPanic      = regexp.MustCompile(`^(panic|fatal error): `)
+	stackModVersion = regexp.MustCompile(`@v[^/]*$`)
+)
+
+// Finds the workspace location of a file named in the output. Paths on
+// this machine go through the path mapper, those of other machines such
+// as a build server or the module cache are matched by their longest
+// suffix that exists in the workspace. Relative names are first looked
+// up in the directory of the package that printed them.
+func stackFileLocation(srcDirs []string, file string, dir string) string {
+	if filepath.IsAbs(file) {
+		if logicalPos := getLogicalPos(file); logicalPos != file {
+			return "/file" + logicalPos
+		}
+	} else if dir != "" {
+		p := filepath.Join(dir, file)
+		if _, err := os.Stat(p); err == nil {
+			return workspaceLocation(p)
+		}
+	}
+
+	segs := strings.Split(strings.Replace(file, "\\", "/", -1), "/")
+	for idx, seg := range segs {
+		segs[idx] = stackModVersion.ReplaceAllString(seg, "")
+	}
+
+	// A base name alone could be any file of the workspace
+	for idx := 0; idx < len(segs)-1; idx++ {
+		rel := filepath.FromSlash(strings.Join(segs[idx:], "/"))
+		if rel == "" || filepath.IsAbs(rel) {
+			continue
+		}
+
+		for _, srcDir := range srcDirs {
+			p := filepath.Join(srcDir, rel)
+			if info, err := os.Stat(p); err == nil && !info.IsDir() {
+				return workspaceLocation(p)
+			}
+		}
+	}
+
+	return ""
+}
+
+// Function of a frame from the line before its location, e.g.
+// "main.(*T).run(0xc000010000)" or "created by main.main in goroutine 1"
+func stackFunction(line string) string {
+	function := strings.TrimPrefix(strings.TrimSpace(line), "created by ")
+
+	if idx := strings.Index(function, " in goroutine "); idx != -1 {
+		function = function[:idx]
+	}
+	if idx := strings.LastIndex(function, "("); idx > 0 && strings.HasSuffix(function, ")") {
+		function = function[:idx]
+	}
+
+	return function
+}
+
+func parseStackTrace(srcDirs []string, text string, dir string) StackTrace {
+	trace := StackTrace{Links: []StackLink{}}
+	locations := make(map[string]string)
+
+	goroutine := 0
+	lines := strings.Split(strings.Replace(text, "\r\n", "\n", -1), "\n")
+	for idx, line := range lines {
+		if m := stackGoroutine.FindStringSubmatch(line); m != nil {
+			goroutine, _ = strconv.Atoi(m[1])
+			continue
+		}
+		if line == "" {
+			goroutine = 0
+		}
+		if trace.Panic == "" && stackPanic.MatchString(line) {
+			trace.Panic = line
+		}
+
+		for _, m := range stackFileRef.FindAllStringSubmatchIndex(line, -1) {
+			link := StackLink{Line: idx + 1, Start: m[0], End: m[1], File: line[m[2]:m[3]], Goroutine: goroutine}
+			link.FileLine, _ = strconv.Atoi(line[m[4]:m[5]])
+			if m[6] != -1 {
+				link.Column, _ = strconv.Atoi(line[m[6]:m[7]])
+			}
+
+			// Frames of a goroutine are the function followed by its
+			//  indented location
+			if goroutine != 0 && strings.HasPrefix(line, "\t") && idx > 0 && !strings.HasPrefix(lines[idx-1], "\t") {
+				link.Function = stackFunction(lines[idx-1])
+			}
+
+			location, ok := locations[link.File]
+			if !ok {
+				location = stackFileLocation(srcDirs, link.File, dir)
+				locations[link.File] = location
+			}
+			if location != "" {
+				link.Location = location
+				link.Url = OpenRequest{Location: location, Line: link.FileLine}.url()
+			}
+
+			trace.Links = append(trace.Links, link)
+		}
+	}
+
+	return trace
+}
+
+// POST /go/stacktrace/parse finds the file references in the text of the
+// body. The dir parameter is the workspace location of the package that
+// produced it, for resolving the base names in test failures.
+func stackTraceHandler(writer http.ResponseWriter, req *http.Request, path string, pathSegs []string) bool {
+	switch {
+	case req.Method == "POST" && len(pathSegs) == 3 && pathSegs[2] == "parse":
+		body, err := uploadBody(req)
+		if err != nil {
+			showUploadError(writer, err)
+			return true
+		}
+
+		text, err := ioutil.ReadAll(body)
+		if err != nil {
+			showUploadError(writer, err)
+			return true
+		}
+
+		dir := ""
+		if location := req.URL.Query().Get("dir"); location != "" {
+			dir, err = shellDir(requestSrcDirs(req), location)
+			if err != nil {
+				ShowError(writer, 400, err.Error(), nil)
+				return true
+			}
+		}
+
+		ShowJson(writer, 200, parseStackTrace(requestSrcDirs(req), string(text), dir))
+		return true
+	}
+
+	return false
+}
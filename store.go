@@ -0,0 +1,88 @@
+// Copyright 2014 Chris McGee <sirnewton_01@yahoo.ca>. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"math/rand"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"sync"
+)
+
+var (
+	// Guards read-modify-write cycles on the per-user data files
+	userDataMutex sync.Mutex
+
+	unsafeNameChars = regexp.MustCompile(`[^A-Za-z0-9@._-]`)
+)
+
+// Directory where godev keeps its own server-side state (bookmarks, sessions, etc.)
+func godevDataDir() string {
+	if *dataDir != "" {
+		return *dataDir
+	}
+
+	return filepath.Join(homeDir(), ".godev")
+}
+
+func homeDir() string {
+	home := os.Getenv("HOME")
+	if home == "" {
+		home = os.Getenv("USERPROFILE")
+	}
+
+	return home
+}
+
+// Directory holding the data files of a single user
+func userDataDir(user string) string {
+	return filepath.Join(godevDataDir(), "users", unsafeNameChars.ReplaceAllString(user, "_"))
+}
+
+// Loads the named JSON document of the user into v. A missing document
+// is not an error, v is left untouched in that case.
+func loadUserData(user string, name string, v interface{}) error {
+	b, err := ioutil.ReadFile(filepath.Join(userDataDir(user), name+".json"))
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+
+	return json.Unmarshal(b, v)
+}
+
+// Saves v as the named JSON document of the user. The document is written
+// to a temporary file first so that a crash never leaves a partial file behind.
+func saveUserData(user string, name string, v interface{}) error {
+	dir := userDataDir(user)
+	err := os.MkdirAll(dir, 0700)
+	if err != nil {
+		return err
+	}
+
+	b, err := json.Marshal(v)
+	if err != nil {
+		return err
+	}
+
+	file := filepath.Join(dir, name+".json")
+	err = ioutil.WriteFile(file+".tmp", b, 0600)
+	if err != nil {
+		return err
+	}
+
+	return os.Rename(file+".tmp", file)
+}
+
+// Generates an identifier for items kept in the user data documents
+func newId() string {
+	return strconv.FormatInt(rand.Int63(), 16)
+}
@@ -0,0 +1,303 @@
+// Copyright 2014 Chris McGee <sirnewton_01@yahoo.ca>. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"context"
+	"go/ast"
+	"go/parser"
+	"go/token"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Symbols of a query beyond this are left out
+const maxSymbolResults = 200
+
+// Declaration of a package, type, function or method in the workspace
+type indexedSymbol struct {
+	Name string
+	// package, type, func or method
+	Kind string
+	// Receiver type of a method
+	Recv string
+	Line int
+}
+
+// Symbols of the Go files of the source directories by file, kept up to
+// date as files are saved and as the watcher of the bundles sees changes
+type symbolIndex struct {
+	built time.Time
+	files map[string][]indexedSymbol
+}
+
+var (
+	symbolIndexMutex   sync.Mutex
+	currentSymbolIndex *symbolIndex
+	// Closed once the first build is done
+	symbolIndexReady = make(chan struct{})
+	// The watcher is keeping the index up to date, otherwise it is rebuilt
+	//  when it gets old
+	symbolIndexWatched  bool
+	symbolIndexBuilding bool
+	// Kinds of symbols of the fields of /filesearch queries
+	symbolIndexKinds = map[string][]string{"Symbol": {"package", "type", "func", "method"}, "Type": {"type"}}
+)
+
+func init() {
+	registerGcTask("symbols", gcSymbolIndex)
+}
+
+func startSymbolIndex() {
+	symbolIndexMutex.Lock()
+	symbolIndexBuilding = true
+	symbolIndexMutex.Unlock()
+
+	go func() {
+		rebuildSymbolIndex()
+		close(symbolIndexReady)
+	}()
+}
+
+func rebuildSymbolIndex() {
+	start := time.Now()
+	index := &symbolIndex{files: make(map[string][]indexedSymbol)}
+
+	for _, srcDir := range srcDirs {
+		walkSymbolFiles(srcDir, func(file string) {
+			index.files[file] = parseSymbols(file)
+		})
+	}
+	index.built = time.Now()
+
+	symbolIndexMutex.Lock()
+	currentSymbolIndex = index
+	symbolIndexBuilding = false
+	symbolIndexMutex.Unlock()
+
+	logger.Printf("Indexed the symbols of %v files in %v\n", len(index.files), time.Since(start))
+}
+
+// Calls fn for the Go files below the directory, skipping the directories
+// that the go tool ignores
+func walkSymbolFiles(dir string, fn func(file string)) {
+	filepath.Walk(dir, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return nil
+		}
+
+		name := info.Name()
+		if info.IsDir() {
+			if path != dir && (strings.HasPrefix(name, ".") || strings.HasPrefix(name, "_") ||
+				name == "testdata" || name == "vendor") {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+
+		if strings.HasSuffix(name, ".go") && !strings.HasPrefix(name, ".") && !strings.HasPrefix(name, "_") {
+			fn(path)
+		}
+		return nil
+	})
+}
+
+func parseSymbols(file string) []indexedSymbol {
+	fileset := token.NewFileSet()
+	// The declarations before a syntax error are still worth having
+	f, _ := parser.ParseFile(fileset, file, nil, 0)
+	if f == nil || f.Name == nil {
+		return nil
+	}
+
+	line := func(pos token.Pos) int {
+		return fileset.Position(pos).Line
+	}
+
+	symbols := []indexedSymbol{{Name: f.Name.Name, Kind: "package", Line: line(f.Name.Pos())}}
+	for _, decl := range f.Decls {
+		switch d := decl.(type) {
+		case *ast.FuncDecl:
+			if d.Recv == nil || len(d.Recv.List) == 0 {
+				symbols = append(symbols, indexedSymbol{Name: d.Name.Name, Kind: "func", Line: line(d.Name.Pos())})
+				continue
+			}
+
+			recv := d.Recv.List[0].Type
+			if star, ok := recv.(*ast.StarExpr); ok {
+				recv = star.X
+			}
+			name := ""
+			if ident, ok := recv.(*ast.Ident); ok {
+				name = ident.Name
+			}
+			symbols = append(symbols, indexedSymbol{Name: d.Name.Name, Kind: "method", Recv: name, Line: line(d.Name.Pos())})
+		case *ast.GenDecl:
+			for _, spec := range d.Specs {
+				if s, ok := spec.(*ast.TypeSpec); ok {
+					symbols = append(symbols, indexedSymbol{Name: s.Name.Name, Kind: "type", Line: line(s.Name.Pos())})
+				}
+			}
+		}
+	}
+
+	return symbols
+}
+
+// Brings the index up to date with a file or directory that changed, was
+// added or went away
+func updateSymbolIndex(path string) {
+	if !inWorkspace(srcDirs, path) {
+		return
+	}
+
+	symbolIndexMutex.Lock()
+	building := currentSymbolIndex == nil
+	symbolIndexMutex.Unlock()
+	if building {
+		// The build picks up the change
+		return
+	}
+
+	info, err := os.Stat(path)
+	files := make(map[string][]indexedSymbol)
+	switch {
+	case err == nil && info.IsDir():
+		walkSymbolFiles(path, func(file string) {
+			files[file] = parseSymbols(file)
+		})
+	case err == nil && strings.HasSuffix(path, ".go"):
+		files[path] = parseSymbols(path)
+	}
+
+	symbolIndexMutex.Lock()
+	defer symbolIndexMutex.Unlock()
+
+	if err != nil {
+		// Everything that was in a removed directory
+		prefix := path + string(filepath.Separator)
+		for file := range currentSymbolIndex.files {
+			if file == path || strings.HasPrefix(file, prefix) {
+				delete(currentSymbolIndex.files, file)
+			}
+		}
+	}
+	for file, symbols := range files {
+		currentSymbolIndex.files[file] = symbols
+	}
+}
+
+// Symbols of the files that went away without the index hearing about it,
+// such as when nothing is watching the bundles
+func gcSymbolIndex(cutoff time.Time, result *GcResult) error {
+	symbolIndexMutex.Lock()
+	files := []string{}
+	if currentSymbolIndex != nil {
+		for file := range currentSymbolIndex.files {
+			files = append(files, file)
+		}
+	}
+	symbolIndexMutex.Unlock()
+
+	dead := []string{}
+	for _, file := range files {
+		if _, err := os.Stat(file); os.IsNotExist(err) || !inWorkspace(srcDirs, file) {
+			dead = append(dead, file)
+		}
+	}
+
+	symbolIndexMutex.Lock()
+	defer symbolIndexMutex.Unlock()
+
+	for _, file := range dead {
+		if _, ok := currentSymbolIndex.files[file]; ok {
+			delete(currentSymbolIndex.files, file)
+			result.Removed++
+		}
+	}
+
+	return nil
+}
+
+// Finds the symbols of the kinds whose names match. Methods match by their
+// name or by Recv.Name. Only the first result of each package is kept,
+// which is the package clause of one of its files.
+func searchSymbols(ctx context.Context, pattern *regexp.Regexp, kinds []string, location string) ([]Result, error) {
+	select {
+	case <-symbolIndexReady:
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+
+	symbolIndexMutex.Lock()
+	defer symbolIndexMutex.Unlock()
+
+	if !symbolIndexWatched && !symbolIndexBuilding && time.Since(currentSymbolIndex.built) > packageIndexMaxAge {
+		symbolIndexBuilding = true
+		go rebuildSymbolIndex()
+	}
+
+	wanted := make(map[string]bool)
+	for _, kind := range kinds {
+		wanted[kind] = true
+	}
+
+	results := []Result{}
+	packages := make(map[string]bool)
+	for file, symbols := range currentSymbolIndex.files {
+		fileLocation := workspaceLocation(file)
+		if fileLocation == "" || !strings.HasPrefix(fileLocation, strings.TrimSuffix(location, "/")+"/") {
+			continue
+		}
+		dir := filepath.Dir(file)
+
+		for _, symbol := range symbols {
+			if !wanted[symbol.Kind] {
+				continue
+			}
+
+			name := symbol.Name
+			if symbol.Kind == "method" && symbol.Recv != "" {
+				name = symbol.Recv + "." + symbol.Name
+			}
+			if !pattern.MatchString(symbol.Name) && !pattern.MatchString(name) {
+				continue
+			}
+
+			if symbol.Kind == "package" {
+				if packages[dir] {
+					continue
+				}
+				packages[dir] = true
+			}
+
+			// The import path of the package that declares it
+			pkgPath := strings.TrimPrefix(filepath.ToSlash(filepath.Dir(fileLocation)), "/file/")
+			results = append(results, Result{Id: "file:/" + file, Name: name, Location: fileLocation,
+				Path: pkgPath, Kind: symbol.Kind, Line: symbol.Line})
+		}
+	}
+
+	// Exact and short names first
+	sort.Slice(results, func(i, j int) bool {
+		if len(results[i].Name) != len(results[j].Name) {
+			return len(results[i].Name) < len(results[j].Name)
+		}
+		if results[i].Name != results[j].Name {
+			return results[i].Name < results[j].Name
+		}
+		return results[i].Location < results[j].Location
+	})
+	if len(results) > maxSymbolResults {
+		results = results[:maxSymbolResults]
+	}
+
+	return results, nil
+}
@@ -0,0 +1,635 @@
+// Copyright 2014 Chris McGee <sirnewton_01@yahoo.ca>. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"bytes"
+	"compress/gzip"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+const (
+	syncChunkSize = 64 * 1024
+)
+
+// State of a directory tree used to find out which chunks of which files
+// differ between the two sides of a sync.
+type SyncManifest struct {
+	ChunkSize int
+	Files     []SyncFile
+}
+
+type SyncFile struct {
+	Path    string
+	Dir     bool
+	Size    int64
+	Mode    uint32
+	ModTime int64
+	Chunks  []string
+}
+
+// New content of a file. Chunks without data are copied from the existing
+// version of the file on the receiving side by their hash.
+type SyncDelta struct {
+	Path    string
+	Dir     bool
+	Mode    uint32
+	ModTime int64
+	Chunks  []SyncChunk
+}
+
+type SyncChunk struct {
+	Hash string
+	Data []byte `json:",omitempty"`
+}
+
+type SyncPatch struct {
+	Files  []SyncDelta
+	Delete []string
+}
+
+type SyncChunkRequest struct {
+	Path   string
+	Hashes []string
+}
+
+type SyncChunkResponse struct {
+	Chunks map[string][]byte
+}
+
+type SyncResult struct {
+	Updated int
+	Deleted int
+}
+
+func chunkHash(chunk []byte) string {
+	hash := sha256.Sum256(chunk)
+	return hex.EncodeToString(hash[:])
+}
+
+// Splits the file into chunks keyed by their hash
+func fileChunks(path string) ([]string, map[string][]byte, error) {
+	content, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	hashes := []string{}
+	chunks := make(map[string][]byte)
+
+	for offset := 0; offset < len(content); offset += syncChunkSize {
+		end := offset + syncChunkSize
+		if end > len(content) {
+			end = len(content)
+		}
+
+		hash := chunkHash(content[offset:end])
+		hashes = append(hashes, hash)
+		chunks[hash] = content[offset:end]
+	}
+
+	return hashes, chunks, nil
+}
+
+func buildSyncManifest(root string) (*SyncManifest, error) {
+	manifest := &SyncManifest{ChunkSize: syncChunkSize, Files: []SyncFile{}}
+
+	err := filepath.Walk(root, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if path == root || info.Mode()&os.ModeSymlink != 0 {
+			return nil
+		}
+
+		relPath, err := filepath.Rel(root, path)
+		if err != nil {
+			return err
+		}
+
+		file := SyncFile{Path: filepath.ToSlash(relPath), Dir: info.IsDir(), Mode: uint32(info.Mode().Perm()),
+			ModTime: info.ModTime().Unix(), Chunks: []string{}}
+
+		if !info.IsDir() {
+			file.Size = info.Size()
+			file.Chunks, _, err = fileChunks(path)
+			if err != nil {
+				return err
+			}
+		}
+
+		manifest.Files = append(manifest.Files, file)
+		return nil
+	})
+
+	return manifest, err
+}
+
+// Resolves a relative path of the sync protocol making sure that it cannot
+// escape from the root, neither with .. nor through a symbolic link.
+func syncPath(root string, relPath string) (string, error) {
+	root = filepath.Clean(root)
+	path := filepath.Join(root, filepath.FromSlash(relPath))
+
+	if relPath == "" || !strings.HasPrefix(path, root+string(filepath.Separator)) {
+		return "", errors.New("Invalid path in sync: " + relPath)
+	}
+
+	realRoot, err := filepath.EvalSymlinks(root)
+	if os.IsNotExist(err) {
+		// Nothing of a new project exists yet
+		return path, nil
+	}
+	if err != nil {
+		return "", err
+	}
+
+	// The part of the path that exists has to stay in the root once its
+	//  links are followed
+	existing := path
+	for existing != root {
+		if _, err := os.Lstat(existing); err == nil {
+			break
+		}
+		existing = filepath.Dir(existing)
+	}
+	realPath, err := filepath.EvalSymlinks(existing)
+	if err != nil {
+		return "", err
+	}
+	if realPath != realRoot && !strings.HasPrefix(realPath, realRoot+string(filepath.Separator)) {
+		return "", errors.New("The path " + relPath + " of the sync leads outside of the project")
+	}
+
+	return path, nil
+}
+
+func applySyncDelta(root string, delta SyncDelta) error {
+	path, err := syncPath(root, delta.Path)
+	if err != nil {
+		return err
+	}
+
+	if delta.Dir {
+		return os.MkdirAll(path, os.FileMode(delta.Mode)|0700)
+	}
+
+	err = os.MkdirAll(filepath.Dir(path), 0700)
+	if err != nil {
+		return err
+	}
+
+	existing := make(map[string][]byte)
+	if _, err := os.Stat(path); err == nil {
+		_, existing, err = fileChunks(path)
+		if err != nil {
+			return err
+		}
+	}
+
+	content := &bytes.Buffer{}
+	for _, chunk := range delta.Chunks {
+		data := chunk.Data
+		if data == nil {
+			data = existing[chunk.Hash]
+		}
+
+		if data == nil || chunkHash(data) != chunk.Hash {
+			return errors.New("Missing or corrupt chunk for " + delta.Path)
+		}
+
+		content.Write(data)
+	}
+
+	// Write the new version next to the old one so that an interrupted
+	//  sync never leaves a half written file behind.
+	err = ioutil.WriteFile(path+".godev-sync", content.Bytes(), os.FileMode(delta.Mode))
+	if err != nil {
+		return err
+	}
+
+	err = os.Rename(path+".godev-sync", path)
+	if err != nil {
+		return err
+	}
+
+	os.Chmod(path, os.FileMode(delta.Mode))
+	modTime := time.Unix(delta.ModTime, 0)
+	return os.Chtimes(path, modTime, modTime)
+}
+
+func applySyncPatch(root string, patch *SyncPatch) (SyncResult, error) {
+	result := SyncResult{}
+
+	for _, delta := range patch.Files {
+		err := applySyncDelta(root, delta)
+		if err != nil {
+			return result, err
+		}
+		result.Updated++
+	}
+
+	for _, relPath := range patch.Delete {
+		path, err := syncPath(root, relPath)
+		if err != nil {
+			return result, err
+		}
+
+		err = os.RemoveAll(path)
+		if err != nil {
+			return result, err
+		}
+		result.Deleted++
+	}
+
+	return result, nil
+}
+
+// Compares the source manifest against the target and returns the files
+// that need to be transferred and those that only exist on the target.
+func diffSyncManifests(source *SyncManifest, target *SyncManifest) ([]SyncFile, []string) {
+	targetFiles := make(map[string]SyncFile)
+	for _, f := range target.Files {
+		targetFiles[f.Path] = f
+	}
+
+	changed := []SyncFile{}
+	sourceFiles := make(map[string]bool)
+
+	for _, f := range source.Files {
+		sourceFiles[f.Path] = true
+
+		t, exists := targetFiles[f.Path]
+		if exists && t.Dir == f.Dir && t.Mode == f.Mode && strings.Join(t.Chunks, ",") == strings.Join(f.Chunks, ",") {
+			continue
+		}
+
+		changed = append(changed, f)
+	}
+
+	removed := []string{}
+	for _, f := range target.Files {
+		if !sourceFiles[f.Path] {
+			removed = append(removed, f.Path)
+		}
+	}
+
+	return changed, removed
+}
+
+func syncHandler(writer http.ResponseWriter, req *http.Request, path string, pathSegs []string) bool {
+	relPath := filepath.Clean("/" + strings.Join(pathSegs[2:], "/"))
+	root := ""
+
+	// A sync is of a project, deleting what isn't in the source would
+	//  otherwise empty the whole workspace
+	if relPath == string(filepath.Separator) {
+		ShowError(writer, 400, "Missing project of the sync", nil)
+		return true
+	}
+
+	for _, srcDir := range requestSrcDirs(req) {
+		p := filepath.Join(srcDir, relPath)
+		if _, err := os.Stat(p); err == nil {
+			root = p
+			break
+		}
+	}
+
+	switch {
+	case req.Method == "GET":
+		if root == "" {
+			// Nothing there yet, everything has to be sent
+			ShowJson(writer, 200, &SyncManifest{ChunkSize: syncChunkSize, Files: []SyncFile{}})
+			return true
+		}
+
+		manifest, err := buildSyncManifest(root)
+		if err != nil {
+			ShowError(writer, 500, "Unable to build sync manifest", err)
+			return true
+		}
+
+		ShowJson(writer, 200, manifest)
+		return true
+	case req.Method == "POST" && req.URL.Query().Get("chunks") != "":
+		body, err := uploadBody(req)
+		if err != nil {
+			showUploadError(writer, err)
+			return true
+		}
+
+		chunkReq := SyncChunkRequest{}
+		err = json.NewDecoder(body).Decode(&chunkReq)
+		if err != nil || root == "" {
+			ShowError(writer, 400, "Invalid chunk request", err)
+			return true
+		}
+
+		file, err := syncPath(root, chunkReq.Path)
+		if err != nil {
+			ShowError(writer, 400, "Invalid chunk request", err)
+			return true
+		}
+
+		_, chunks, err := fileChunks(file)
+		if err != nil {
+			ShowError(writer, 404, "Unable to read "+chunkReq.Path, err)
+			return true
+		}
+
+		response := SyncChunkResponse{Chunks: make(map[string][]byte)}
+		for _, hash := range chunkReq.Hashes {
+			if data, ok := chunks[hash]; ok {
+				response.Chunks[hash] = data
+			}
+		}
+
+		ShowJson(writer, 200, response)
+		return true
+	case req.Method == "POST":
+		if root == "" {
+			// New top-level folders go at the end of the GOPATH
+			filesDir := topLevelDir()
+			if account := requestAccount(req); account != nil {
+				filesDir = accountSrcDir(account)
+			}
+			root = filepath.Join(filesDir, relPath)
+		}
+
+		body, err := uploadBody(req)
+		if err != nil {
+			showUploadError(writer, err)
+			return true
+		}
+
+		patch := &SyncPatch{}
+		err = json.NewDecoder(body).Decode(patch)
+		if body.err != nil {
+			showUploadError(writer, body.err)
+			return true
+		}
+		if err != nil {
+			ShowError(writer, 400, "Invalid sync patch", err)
+			return true
+		}
+
+		// Nothing is applied when any of the files is locked
+		changes := append([]string{}, patch.Delete...)
+		for _, delta := range patch.Files {
+			changes = append(changes, delta.Path)
+		}
+		for _, change := range changes {
+			if showLocked(writer, req, "/file"+filepath.ToSlash(filepath.Join(relPath, filepath.FromSlash(change)))) {
+				return true
+			}
+		}
+
+		result, err := applySyncPatch(root, patch)
+		if err != nil {
+			ShowError(writer, 500, "Unable to apply sync patch", err)
+			return true
+		}
+
+		ShowJson(writer, 200, result)
+		return true
+	}
+
+	return false
+}
+
+// Client side of the sync protocol talking to a remote godev
+type syncClient struct {
+	url    string
+	cookie *http.Cookie
+}
+
+func newSyncClient(remote string) (*syncClient, error) {
+	u, err := url.Parse(remote)
+	if err != nil {
+		return nil, err
+	}
+
+	if !strings.Contains(u.Path, "/xfer/sync/") {
+		return nil, errors.New("The remote must be a URL of the form https://host:port/xfer/sync/<project>")
+	}
+
+	client := &syncClient{url: remote}
+
+	// Remote instances only talk to clients that know the magic key
+	if magic := os.Getenv("GODEV_MAGIC"); magic != "" {
+		client.cookie = &http.Cookie{Name: "MAGIC" + u.Port(), Value: magic}
+	}
+
+	return client, nil
+}
+
+func (c *syncClient) call(method string, query string, in interface{}, out interface{}) error {
+	var body io.Reader
+	if in != nil {
+		// Patches carry whole files so they are worth compressing
+		buf := &bytes.Buffer{}
+		gz := gzip.NewWriter(buf)
+		err := json.NewEncoder(gz).Encode(in)
+		if err != nil {
+			return err
+		}
+		err = gz.Close()
+		if err != nil {
+			return err
+		}
+		body = buf
+	}
+
+	req, err := http.NewRequest(method, c.url+query, body)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	if in != nil {
+		req.Header.Set("Content-Encoding", "gzip")
+	}
+	if c.cookie != nil {
+		req.AddCookie(c.cookie)
+	}
+
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != 200 {
+		status := Status{}
+		json.NewDecoder(resp.Body).Decode(&status)
+		return fmt.Errorf("%v: %v %v", resp.Status, status.Message, status.DetailedMessage)
+	}
+
+	return json.NewDecoder(resp.Body).Decode(out)
+}
+
+func (c *syncClient) push(localDir string, deleteRemoved bool) (SyncResult, error) {
+	result := SyncResult{}
+
+	local, err := buildSyncManifest(localDir)
+	if err != nil {
+		return result, err
+	}
+
+	remote := &SyncManifest{}
+	err = c.call("GET", "", nil, remote)
+	if err != nil {
+		return result, err
+	}
+
+	remoteChunks := make(map[string]map[string]bool)
+	for _, f := range remote.Files {
+		remoteChunks[f.Path] = make(map[string]bool)
+		for _, hash := range f.Chunks {
+			remoteChunks[f.Path][hash] = true
+		}
+	}
+
+	changed, removed := diffSyncManifests(local, remote)
+
+	// One file at a time keeps the requests to a reasonable size
+	for _, f := range changed {
+		delta := SyncDelta{Path: f.Path, Dir: f.Dir, Mode: f.Mode, ModTime: f.ModTime, Chunks: []SyncChunk{}}
+
+		if !f.Dir {
+			hashes, chunks, err := fileChunks(filepath.Join(localDir, filepath.FromSlash(f.Path)))
+			if err != nil {
+				return result, err
+			}
+
+			for _, hash := range hashes {
+				if remoteChunks[f.Path][hash] {
+					delta.Chunks = append(delta.Chunks, SyncChunk{Hash: hash})
+				} else {
+					delta.Chunks = append(delta.Chunks, SyncChunk{Hash: hash, Data: chunks[hash]})
+				}
+			}
+		}
+
+		r := SyncResult{}
+		err = c.call("POST", "", &SyncPatch{Files: []SyncDelta{delta}}, &r)
+		if err != nil {
+			return result, err
+		}
+		result.Updated += r.Updated
+	}
+
+	if deleteRemoved && len(removed) > 0 {
+		r := SyncResult{}
+		err = c.call("POST", "", &SyncPatch{Delete: removed}, &r)
+		if err != nil {
+			return result, err
+		}
+		result.Deleted += r.Deleted
+	}
+
+	return result, nil
+}
+
+func (c *syncClient) pull(localDir string, deleteRemoved bool) (SyncResult, error) {
+	result := SyncResult{}
+
+	remote := &SyncManifest{}
+	err := c.call("GET", "", nil, remote)
+	if err != nil {
+		return result, err
+	}
+
+	local := &SyncManifest{Files: []SyncFile{}}
+	if _, err := os.Stat(localDir); err == nil {
+		local, err = buildSyncManifest(localDir)
+		if err != nil {
+			return result, err
+		}
+	}
+
+	changed, removed := diffSyncManifests(remote, local)
+
+	patch := &SyncPatch{Files: []SyncDelta{}}
+	for _, f := range changed {
+		delta := SyncDelta{Path: f.Path, Dir: f.Dir, Mode: f.Mode, ModTime: f.ModTime, Chunks: []SyncChunk{}}
+
+		if !f.Dir {
+			existing := make(map[string][]byte)
+			if _, err := os.Stat(filepath.Join(localDir, filepath.FromSlash(f.Path))); err == nil {
+				_, existing, err = fileChunks(filepath.Join(localDir, filepath.FromSlash(f.Path)))
+				if err != nil {
+					return result, err
+				}
+			}
+
+			missing := []string{}
+			for _, hash := range f.Chunks {
+				if existing[hash] == nil {
+					missing = append(missing, hash)
+				}
+			}
+
+			fetched := SyncChunkResponse{}
+			if len(missing) > 0 {
+				err = c.call("POST", "?chunks=true", &SyncChunkRequest{Path: f.Path, Hashes: missing}, &fetched)
+				if err != nil {
+					return result, err
+				}
+			}
+
+			for _, hash := range f.Chunks {
+				delta.Chunks = append(delta.Chunks, SyncChunk{Hash: hash, Data: fetched.Chunks[hash]})
+			}
+		}
+
+		patch.Files = append(patch.Files, delta)
+	}
+
+	if deleteRemoved {
+		patch.Delete = removed
+	}
+
+	return applySyncPatch(localDir, patch)
+}
+
+// Implements "godev sync [-delete] push|pull <localdir> <url>"
+func syncCommand(args []string) error {
+	flags := flag.NewFlagSet("sync", flag.ExitOnError)
+	deleteRemoved := flags.Bool("delete", false, "Delete files on the receiving side that don't exist on the sending side.")
+	flags.Parse(args)
+
+	if flags.NArg() != 3 || (flags.Arg(0) != "push" && flags.Arg(0) != "pull") {
+		return errors.New("Usage: godev sync [-delete] push|pull <localdir> https://host:port/xfer/sync/<project>")
+	}
+
+	client, err := newSyncClient(flags.Arg(2))
+	if err != nil {
+		return err
+	}
+
+	var result SyncResult
+	if flags.Arg(0) == "push" {
+		result, err = client.push(flags.Arg(1), *deleteRemoved)
+	} else {
+		result, err = client.pull(flags.Arg(1), *deleteRemoved)
+	}
+
+	fmt.Printf("%v updated, %v deleted\n", result.Updated, result.Deleted)
+	return err
+}
@@ -0,0 +1,168 @@
+// Copyright 2014 Chris McGee <sirnewton_01@yahoo.ca>. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestSyncPath(t *testing.T) {
+	root := t.TempDir()
+	outside := t.TempDir()
+
+	if err := os.MkdirAll(filepath.Join(root, "pkg"), 0700); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Symlink(outside, filepath.Join(root, "out")); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Symlink(filepath.Join(root, "pkg"), filepath.Join(root, "in")); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		relPath string
+		valid   bool
+	}{
+		{"main.go", true},
+		{"pkg/file.go", true},
+		{"new/dir/file.go", true},
+		{"in/file.go", true},
+		{"", false},
+		{".", false},
+		{"..", false},
+		{"../file.go", false},
+		{"pkg/../../file.go", false},
+		{"out", false},
+		{"out/file.go", false},
+		{"out/new/file.go", false},
+	}
+
+	for _, test := range tests {
+		path, err := syncPath(root, test.relPath)
+		if test.valid && err != nil {
+			t.Errorf("syncPath(%q) failed: %v", test.relPath, err)
+		}
+		if !test.valid && err == nil {
+			t.Errorf("syncPath(%q) = %v, expected it to be refused", test.relPath, path)
+		}
+	}
+
+	// Nothing of a new project exists yet
+	if _, err := syncPath(filepath.Join(root, "project"), "main.go"); err != nil {
+		t.Errorf("syncPath of a new project failed: %v", err)
+	}
+}
+
+func TestApplySyncPatch(t *testing.T) {
+	content := []byte("package main\n")
+	chunk := SyncChunk{Hash: chunkHash(content), Data: content}
+
+	tests := []struct {
+		name    string
+		patch   SyncPatch
+		valid   bool
+		exists  []string
+		missing []string
+	}{
+		{
+			name:   "new file",
+			patch:  SyncPatch{Files: []SyncDelta{{Path: "cmd/main.go", Mode: 0600, Chunks: []SyncChunk{chunk}}}},
+			valid:  true,
+			exists: []string{"cmd/main.go", "old.go"},
+		},
+		{
+			name:   "new directory",
+			patch:  SyncPatch{Files: []SyncDelta{{Path: "assets", Dir: true, Mode: 0700}}},
+			valid:  true,
+			exists: []string{"assets"},
+		},
+		{
+			name:   "chunk of the existing file",
+			patch:  SyncPatch{Files: []SyncDelta{{Path: "old.go", Mode: 0600, Chunks: []SyncChunk{{Hash: chunk.Hash}}}}},
+			valid:  true,
+			exists: []string{"old.go"},
+		},
+		{
+			name:  "missing chunk",
+			patch: SyncPatch{Files: []SyncDelta{{Path: "new.go", Mode: 0600, Chunks: []SyncChunk{{Hash: chunkHash([]byte("x"))}}}}},
+		},
+		{
+			name:  "corrupt chunk",
+			patch: SyncPatch{Files: []SyncDelta{{Path: "new.go", Mode: 0600, Chunks: []SyncChunk{{Hash: chunk.Hash, Data: []byte("x")}}}}},
+		},
+		{
+			name:    "delete",
+			patch:   SyncPatch{Delete: []string{"old.go"}},
+			valid:   true,
+			missing: []string{"old.go"},
+		},
+		{
+			name:  "file outside of the root",
+			patch: SyncPatch{Files: []SyncDelta{{Path: "../escaped.go", Mode: 0600, Chunks: []SyncChunk{chunk}}}},
+		},
+		{
+			name:   "delete outside of the root",
+			patch:  SyncPatch{Delete: []string{"../outside"}},
+			exists: []string{"../outside"},
+		},
+		{
+			name:   "delete the root",
+			patch:  SyncPatch{Delete: []string{"."}},
+			exists: []string{"old.go"},
+		},
+		{
+			name:   "delete through a link",
+			patch:  SyncPatch{Delete: []string{"link/kept.go"}},
+			exists: []string{"../outside/kept.go"},
+		},
+	}
+
+	for _, test := range tests {
+		dir := t.TempDir()
+		root := filepath.Join(dir, "project")
+		outside := filepath.Join(dir, "outside")
+
+		for _, d := range []string{root, outside} {
+			if err := os.MkdirAll(d, 0700); err != nil {
+				t.Fatal(err)
+			}
+		}
+		if err := ioutil.WriteFile(filepath.Join(root, "old.go"), content, 0600); err != nil {
+			t.Fatal(err)
+		}
+		if err := ioutil.WriteFile(filepath.Join(outside, "kept.go"), content, 0600); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.Symlink(outside, filepath.Join(root, "link")); err != nil {
+			t.Fatal(err)
+		}
+
+		_, err := applySyncPatch(root, &test.patch)
+		if test.valid && err != nil {
+			t.Errorf("%v: the patch failed: %v", test.name, err)
+		}
+		if !test.valid && err == nil {
+			t.Errorf("%v: expected the patch to be refused", test.name)
+		}
+
+		for _, p := range test.exists {
+			if _, err := os.Stat(filepath.Join(root, p)); err != nil {
+				t.Errorf("%v: %v is missing: %v", test.name, p, err)
+			}
+		}
+		for _, p := range test.missing {
+			if _, err := os.Stat(filepath.Join(root, p)); err == nil {
+				t.Errorf("%v: %v is still there", test.name, p)
+			}
+		}
+		if _, err := os.Stat(filepath.Join(dir, "escaped.go")); err == nil {
+			t.Errorf("%v: the patch wrote outside of the root", test.name)
+		}
+	}
+}
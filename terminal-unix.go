@@ -8,13 +8,18 @@ package main
 
 import (
 	"io"
+	"os"
 	"os/exec"
 
 	"github.com/kr/pty"
 )
 
+// The web terminal speaks xterm with 256 colors and 24-bit colors
 func createShellCommand() *exec.Cmd {
-	return exec.Command("sh")
+	c := exec.Command("sh")
+	c.Env = append(os.Environ(), "TERM=xterm-256color", "COLORTERM=truecolor")
+
+	return c
 }
 
 func start(c *exec.Cmd) (io.ReadCloser, io.WriteCloser, error) {
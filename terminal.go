@@ -5,21 +5,196 @@
 package main
 
 import (
+	"flag"
+	"io"
 	"net/http"
+	"sync"
+	"time"
 
 	"code.google.com/p/go.net/websocket"
 )
 
 type ConnectResult struct {
 	AttachWsURI string `json:"attachWsURI"`
+	// What programs in the terminal may do with the browser's clipboard
+	Clipboard string `json:"clipboard"`
 }
 
-func terminalSocket(ws *websocket.Conn) {
+// Terminal of a user, which the guests of an invite can join with
+// /docker/socket?attach=<id> to watch it or type in it
+type TerminalSession struct {
+	Id      string
+	User    string
+	Started int64
+
+	in     io.Writer
+	mutex  sync.Mutex
+	guests map[taskConn]string
+}
+
+var (
+	terminalClipboard = flag.String("terminalClipboard", "off", "What programs in the web terminal may do with the browser's clipboard through OSC 52: off, write or readwrite.")
+
+	terminalsMutex   sync.Mutex
+	terminalSessions = make(map[string]*TerminalSession)
+)
+
+func findTerminalSession(id string) *TerminalSession {
+	terminalsMutex.Lock()
+	defer terminalsMutex.Unlock()
+
+	return terminalSessions[id]
+}
+
+func userTerminalSessions(user string) []*TerminalSession {
+	terminalsMutex.Lock()
+	defer terminalsMutex.Unlock()
+
+	sessions := []*TerminalSession{}
+	for _, session := range terminalSessions {
+		if session.User == user {
+			sessions = append(sessions, session)
+		}
+	}
+
+	return sessions
+}
+
+// Sends the output of the terminal to its guests
+func (session *TerminalSession) broadcast(data []byte) {
+	session.mutex.Lock()
+	defer session.mutex.Unlock()
+
+	for conn := range session.guests {
+		_, err := conn.Write(data)
+		if err != nil {
+			delete(session.guests, conn)
+			conn.Close()
+		}
+	}
+}
+
+func (session *TerminalSession) closeGuests() {
+	session.mutex.Lock()
+	defer session.mutex.Unlock()
+
+	for conn := range session.guests {
+		conn.Close()
+	}
+	session.guests = make(map[taskConn]string)
+}
+
+// Closes the terminals of the guests of an invite
+func detachTerminalGuests(keyId string) {
+	terminalsMutex.Lock()
+	sessions := []*TerminalSession{}
+	for _, session := range terminalSessions {
+		sessions = append(sessions, session)
+	}
+	terminalsMutex.Unlock()
+
+	for _, session := range sessions {
+		session.mutex.Lock()
+		for conn, id := range session.guests {
+			if id == keyId {
+				delete(session.guests, conn)
+				conn.Close()
+			}
+		}
+		session.mutex.Unlock()
+	}
+}
+
+// Joins a terminal session, guests without write access only watch it
+func attachTerminal(ws taskConn, id string) {
+	defer ws.Close()
+
+	session := findTerminalSession(id)
+	if session == nil {
+		ws.Write([]byte("The terminal is gone\r\n"))
+		return
+	}
+
+	key := requestKey(ws.Request())
+	keyId, write := "", true
+	if key != nil && key.Scope != nil {
+		keyId, write = key.Id, key.Scope.Write
+	} else if session.User != requestUser(ws.Request()) {
+		return
+	}
+
+	session.mutex.Lock()
+	session.guests[ws] = keyId
+	session.mutex.Unlock()
+
+	buf := make([]byte, 1024, 1024)
+	for {
+		n, err := ws.Read(buf)
+		if err != nil {
+			break
+		}
+		if !write {
+			continue
+		}
+
+		_, err = session.in.Write(buf[:n])
+		if err != nil {
+			break
+		}
+	}
+
+	session.mutex.Lock()
+	delete(session.guests, ws)
+	session.mutex.Unlock()
+}
+
+// The clipboard policy of the terminal, anything unknown turns it off
+func terminalClipboardPolicy() string {
+	switch *terminalClipboard {
+	case "write", "readwrite":
+		return *terminalClipboard
+	}
+
+	return "off"
+}
+
+func terminalSocket(socket *websocket.Conn) {
+	ws := framedSocket(socket)
+
+	if id := ws.Request().URL.Query().Get("attach"); id != "" {
+		attachTerminal(ws, id)
+		return
+	}
+
 	c := createShellCommand()
 	out, in, err := start(c)
 	if err != nil {
 		panic(err)
 	}
+	proc := registerProcess(requestUser(ws.Request()), "terminal", c, ws)
+	defer proc.unregister()
+
+	session := &TerminalSession{Id: newId(), User: requestUser(ws.Request()), Started: time.Now().Unix() * 1000,
+		in: in, guests: make(map[taskConn]string)}
+	terminalsMutex.Lock()
+	terminalSessions[session.Id] = session
+	terminalsMutex.Unlock()
+	defer func() {
+		terminalsMutex.Lock()
+		delete(terminalSessions, session.Id)
+		terminalsMutex.Unlock()
+		session.closeGuests()
+	}()
+
+	var recorder *terminalRecorder
+	if *recordTerminals || ws.Request().URL.Query().Get("record") == "true" {
+		recorder, err = startRecording(requestUser(ws.Request()), "Terminal")
+		if err != nil {
+			logger.Printf("Unable to record the terminal: %v\n", err)
+		} else {
+			defer recorder.close()
+		}
+	}
 
 	go func() {
 		for {
@@ -28,11 +203,16 @@ func terminalSocket(ws *websocket.Conn) {
 			if err != nil {
 				break
 			}
+			if recorder != nil {
+				recorder.output(buf[:n])
+			}
+			session.broadcast(buf[:n])
 
 			n, err = ws.Write(buf[:n])
 			if err != nil {
 				break
 			}
+			proc.touch()
 		}
 
 		ws.Close()
@@ -44,6 +224,7 @@ func terminalSocket(ws *websocket.Conn) {
 		if err != nil {
 			break
 		}
+		proc.touch()
 
 		n, err = in.Write(buf[:n])
 		if err != nil {
@@ -59,16 +240,33 @@ func terminalSocket(ws *websocket.Conn) {
 func terminalHandler(writer http.ResponseWriter, req *http.Request, path string, pathSegs []string) bool {
 	switch {
 	case req.Method == "POST" && len(pathSegs) == 2 && pathSegs[1] == "connect":
-		result := &ConnectResult{}
+		result := &ConnectResult{Clipboard: terminalClipboardPolicy()}
 
-		if hostName == loopbackHost {
-			result.AttachWsURI = "ws://" + hostName + ":" + *port + "/docker/socket"
+		// The host that the browser reached, which is a proxy in front of
+		//  a Unix domain socket
+		if hostName == loopbackHost && requestScheme(req) == "http" {
+			result.AttachWsURI = "ws://" + requestHost(req) + requestPrefix(req) + "/docker/socket"
 		} else {
-			result.AttachWsURI = "wss://" + hostName + ":" + *port + "/docker/socket"
+			result.AttachWsURI = "wss://" + requestHost(req) + requestPrefix(req) + "/docker/socket"
 		}
 
 		ShowJson(writer, 200, result)
 		return true
+	case req.Method == "GET" && len(pathSegs) == 2 && pathSegs[1] == "sessions":
+		// The shared terminals for guests, the user's own for everyone else
+		sessions := []*TerminalSession{}
+		if scope := requestScope(req); scope != nil {
+			for _, id := range scope.Terminals {
+				if session := findTerminalSession(id); session != nil {
+					sessions = append(sessions, session)
+				}
+			}
+		} else {
+			sessions = userTerminalSessions(requestUser(req))
+		}
+
+		ShowJson(writer, 200, sessions)
+		return true
 	}
 
 	return false
@@ -7,6 +7,7 @@ package main
 import (
 	"bufio"
 	"encoding/json"
+	"net/http"
 	"os"
 	"os/exec"
 	"path/filepath"
@@ -52,7 +53,23 @@ type RaceDetectorEntry struct {
 }
 
 func testSocket(ws *websocket.Conn) {
-	pkg := ws.Request().URL.Query().Get("pkg")
+	testTask(ws)
+}
+
+func testHandler(writer http.ResponseWriter, req *http.Request, path string, pathSegs []string) bool {
+	switch {
+	case req.Method == "GET" && len(pathSegs) == 2 && pathSegs[1] == "stream":
+		// Same as the socket for browsers that can't open WebSockets
+		serveTaskStream(writer, req, testTask)
+		return true
+	}
+
+	return false
+}
+
+// Runs the tests of a package reporting their progress as JSON messages
+func testTask(ws taskConn) {
+	pkg := workspacePackage(ws.Request().URL.Query().Get("pkg"))
 	race := ws.Request().URL.Query().Get("race")
 
 	if pkg == "" {
@@ -72,6 +89,7 @@ func testSocket(ws *websocket.Conn) {
 	if race == "true" {
 		cmd = exec.Command("go", "test", "-race", pkg, "-test.v")
 	}
+	cmd.Env = workspaceEnv(requestUser(ws.Request()))
 	stdout, err := cmd.StdoutPipe()
 	if err != nil {
 		ws.Write([]byte("\"Broken Pipe:" + err.Error() + "\""))
@@ -147,6 +165,8 @@ func testSocket(ws *websocket.Conn) {
 		ws.Close()
 		return
 	}
+	proc := registerProcess(requestUser(ws.Request()), "test", cmd, ws)
+	defer proc.unregister()
 	reader := bufio.NewReader(stdout)
 
 	regex1 := regexp.MustCompile(`^(\w+) \(([0-9.]+) seconds\)$`)
@@ -165,6 +185,7 @@ func testSocket(ws *websocket.Conn) {
 		}
 
 		line := string(l)
+		proc.touch()
 
 		// beginning of a test
 		if strings.HasPrefix(line, "=== RUN ") {
@@ -0,0 +1,141 @@
+// Copyright 2014 Chris McGee <sirnewton_01@yahoo.ca>. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"errors"
+	"go/ast"
+	"go/build"
+	"go/importer"
+	"go/parser"
+	"go/token"
+	"go/types"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Editor buffer that was type checked along with the other files of its
+// package. Type errors are expected while editing so the information is
+// as complete as the checker could make it.
+type checkedBuffer struct {
+	fileset *token.FileSet
+	file    *ast.File
+	pkg     *types.Package
+	info    *types.Info
+}
+
+var (
+	// Type checking imports from source, which is slow enough that the
+	//  packages are kept for a while.
+	typeCheckMutex  sync.Mutex
+	sourceImporter  types.Importer
+	importerCreated time.Time
+)
+
+// Location on disk of the file of a /go/<service>/file/... request
+func bufferPath(srcDirs []string, pathSegs []string) (string, error) {
+	if len(pathSegs) < 4 || pathSegs[2] != "file" {
+		return "", errors.New("No file location")
+	}
+
+	if pathSegs[3] == "GOROOT" {
+		return filepath.Join(goroot, "src", "pkg", filepath.Join(pathSegs[4:]...)), nil
+	}
+
+	relPath := filepath.Clean("/" + filepath.Join(pathSegs[3:]...))
+	for _, srcDir := range srcDirs {
+		p := filepath.Join(srcDir, relPath)
+		if _, err := os.Stat(filepath.Dir(p)); err == nil {
+			return p, nil
+		}
+	}
+
+	return "", errors.New("Invalid resource " + relPath)
+}
+
+// The start and end offsets of the request, the whole buffer by default
+func requestRange(req *http.Request, size int) (int, int, error) {
+	var err error
+	start, end := 0, size
+
+	if s := req.URL.Query().Get("start"); s != "" {
+		start, err = strconv.Atoi(s)
+	}
+	if e := req.URL.Query().Get("end"); e != "" && err == nil {
+		end, err = strconv.Atoi(e)
+	}
+	if err == nil && (start < 0 || end < start) {
+		err = errors.New("The range ends before it starts")
+	}
+
+	return start, end, err
+}
+
+func typeCheckBuffer(buffer []byte, filePath string) (*checkedBuffer, error) {
+	fileset := token.NewFileSet()
+	file, err := parser.ParseFile(fileset, filePath, buffer, parser.AllErrors|parser.ParseComments)
+	if file == nil {
+		return nil, err
+	}
+
+	files := []*ast.File{file}
+	dir, name := filepath.Split(filePath)
+	if pkg, err := build.ImportDir(dir, 0); err == nil {
+		goFiles := pkg.GoFiles
+		if strings.HasSuffix(name, "_test.go") {
+			goFiles = append(goFiles, pkg.TestGoFiles...)
+		}
+
+		for _, goFile := range goFiles {
+			if goFile == name {
+				continue
+			}
+			f, err := parser.ParseFile(fileset, filepath.Join(dir, goFile), nil, 0)
+			if err == nil && f.Name.Name == file.Name.Name {
+				files = append(files, f)
+			}
+		}
+	}
+
+	typeCheckMutex.Lock()
+	defer typeCheckMutex.Unlock()
+
+	if sourceImporter == nil || time.Since(importerCreated) > packageIndexMaxAge {
+		sourceImporter = importer.ForCompiler(token.NewFileSet(), "source", nil)
+		importerCreated = time.Now()
+	}
+
+	info := &types.Info{
+		Types:      make(map[ast.Expr]types.TypeAndValue),
+		Defs:       make(map[*ast.Ident]types.Object),
+		Uses:       make(map[*ast.Ident]types.Object),
+		Selections: make(map[*ast.SelectorExpr]*types.Selection),
+		Implicits:  make(map[ast.Node]types.Object),
+		Scopes:     make(map[ast.Node]*types.Scope),
+	}
+	conf := types.Config{Importer: sourceImporter, Error: func(error) {}}
+	pkg, _ := conf.Check(file.Name.Name, fileset, files, info)
+
+	return &checkedBuffer{fileset, file, pkg, info}, nil
+}
+
+func (c *checkedBuffer) offset(pos token.Pos) int {
+	return c.fileset.Position(pos).Offset
+}
+
+// Writes types the way they appear in the source of the package
+func (c *checkedBuffer) typeString(t types.Type) string {
+	return types.TypeString(t, func(p *types.Package) string {
+		if p == c.pkg {
+			return ""
+		}
+		return p.Name()
+	})
+}
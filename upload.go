@@ -0,0 +1,124 @@
+// Copyright 2014 Chris McGee <sirnewton_01@yahoo.ca>. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"compress/gzip"
+	"errors"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+var (
+	errUploadTooLarge      = errors.New("upload exceeds the maximum size")
+	errUnsupportedEncoding = errors.New("unsupported content encoding")
+)
+
+// Body of an upload that fails instead of silently stopping at the limit
+// like io.LimitReader does. It remembers the error of reading the upload so
+// that it can be told apart from errors writing it somewhere.
+type uploadReader struct {
+	r         io.Reader
+	remaining int64
+	err       error
+}
+
+func (u *uploadReader) Read(b []byte) (int, error) {
+	if u.err != nil {
+		return 0, u.err
+	}
+
+	// Read one byte past the limit to find out whether there is more
+	if int64(len(b)) > u.remaining+1 {
+		b = b[:u.remaining+1]
+	}
+
+	n, err := u.r.Read(b)
+	u.remaining -= int64(n)
+	if u.remaining < 0 {
+		u.err = errUploadTooLarge
+		return n - int(-u.remaining), u.err
+	}
+
+	if err != nil && err != io.EOF {
+		u.err = err
+	}
+
+	return n, err
+}
+
+// Body of an upload, decompressed if the client sent it gzipped. Slow
+// uplinks to a remote instance make compressing large saves worthwhile.
+// The size limit applies to the decompressed content.
+func uploadBody(req *http.Request) (*uploadReader, error) {
+	var body io.Reader = req.Body
+
+	switch strings.ToLower(strings.TrimSpace(req.Header.Get("Content-Encoding"))) {
+	case "", "identity":
+	case "gzip", "x-gzip":
+		gz, err := gzip.NewReader(req.Body)
+		if err != nil {
+			return nil, err
+		}
+		body = gz
+	default:
+		return nil, errUnsupportedEncoding
+	}
+
+	return &uploadReader{r: body, remaining: *maxUploadSize}, nil
+}
+
+func showUploadError(writer http.ResponseWriter, err error) {
+	switch err {
+	case errUploadTooLarge:
+		ShowError(writer, 413, "The upload is too large", err)
+	case errUnsupportedEncoding:
+		ShowError(writer, 415, "Uploads must be sent as is or gzipped", err)
+	default:
+		ShowError(writer, 400, "Unable to read the upload", err)
+	}
+}
+
+// Replaces the content of the file only once the whole upload has arrived
+// so that a failed save doesn't leave a truncated file behind.
+func saveUpload(filePath string, body io.Reader) error {
+	// Saving through a symbolic link must not replace the link itself
+	if target, err := filepath.EvalSymlinks(filePath); err == nil {
+		filePath = target
+	}
+
+	mode := os.FileMode(0644)
+	if info, err := os.Stat(filePath); err == nil {
+		mode = info.Mode() & os.ModePerm
+	}
+
+	tmpFile, err := ioutil.TempFile(filepath.Dir(filePath), ".godev-save")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmpFile.Name())
+
+	_, err = io.Copy(tmpFile, body)
+	if err != nil {
+		tmpFile.Close()
+		return err
+	}
+
+	err = tmpFile.Close()
+	if err != nil {
+		return err
+	}
+
+	err = os.Chmod(tmpFile.Name(), mode)
+	if err != nil {
+		return err
+	}
+
+	return os.Rename(tmpFile.Name(), filePath)
+}
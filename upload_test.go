@@ -0,0 +1,87 @@
+// Copyright 2014 Chris McGee <sirnewton_01@yahoo.ca>. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"bytes"
+	"compress/gzip"
+	"io/ioutil"
+	"net/http/httptest"
+	"testing"
+)
+
+func gzipped(b []byte) []byte {
+	buf := &bytes.Buffer{}
+	gz := gzip.NewWriter(buf)
+	gz.Write(b)
+	gz.Close()
+
+	return buf.Bytes()
+}
+
+func TestUploadReader(t *testing.T) {
+	defer func(size int64) { *maxUploadSize = size }(*maxUploadSize)
+	*maxUploadSize = 1024
+
+	small := bytes.Repeat([]byte("a"), 100)
+	limit := bytes.Repeat([]byte("b"), 1024)
+	large := bytes.Repeat([]byte("c"), 1025)
+
+	tests := []struct {
+		name     string
+		encoding string
+		body     []byte
+		size     int
+		err      error
+		// Unreadable bodies fail before anything is read
+		invalid bool
+	}{
+		{"small", "", small, 100, nil, false},
+		{"empty", "", []byte{}, 0, nil, false},
+		{"at the limit", "", limit, 1024, nil, false},
+		{"over the limit", "", large, 1024, errUploadTooLarge, false},
+		{"far over the limit", "identity", bytes.Repeat(large, 10), 1024, errUploadTooLarge, false},
+		{"gzipped", "gzip", gzipped(small), 100, nil, false},
+		{"gzipped at the limit", "x-gzip", gzipped(limit), 1024, nil, false},
+		{"gzipped over the limit", "gzip", gzipped(large), 1024, errUploadTooLarge, false},
+		{"gzip bomb", "GZIP", gzipped(bytes.Repeat(large, 1000)), 1024, errUploadTooLarge, false},
+		{"not gzipped", "gzip", small, 0, nil, true},
+		{"unsupported encoding", "br", small, 0, errUnsupportedEncoding, true},
+	}
+
+	for _, test := range tests {
+		req := httptest.NewRequest("PUT", "/file/project/main.go", bytes.NewReader(test.body))
+		if test.encoding != "" {
+			req.Header.Set("Content-Encoding", test.encoding)
+		}
+
+		body, err := uploadBody(req)
+		if test.invalid {
+			if err == nil || (test.err != nil && err != test.err) {
+				t.Errorf("%v: uploadBody failed with %v, expected %v", test.name, err, test.err)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%v: uploadBody failed: %v", test.name, err)
+			continue
+		}
+
+		b, err := ioutil.ReadAll(body)
+		if err != test.err {
+			t.Errorf("%v: the read failed with %v, expected %v", test.name, err, test.err)
+		}
+		if len(b) != test.size {
+			t.Errorf("%v: read %v bytes, expected %v", test.name, len(b), test.size)
+		}
+
+		// The error stays for whoever reads on
+		if test.err != nil {
+			if n, err := body.Read(make([]byte, 10)); n != 0 || err != test.err {
+				t.Errorf("%v: read %v bytes with %v after the failure", test.name, n, err)
+			}
+		}
+	}
+}
@@ -0,0 +1,134 @@
+// Copyright 2014 Chris McGee <sirnewton_01@yahoo.ca>. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+	"time"
+)
+
+// Counts and latencies of an editor operation. Nothing of this ever
+// leaves the machine, it only helps to tune slow setups.
+type OperationStats struct {
+	Operation     string
+	Count         int64
+	TotalMillis   int64
+	MaxMillis     int64
+	AverageMillis int64
+}
+
+type UsageSummary struct {
+	Since      int64
+	Operations []OperationStats
+}
+
+var (
+	usageMutex sync.Mutex
+	usage      = &UsageSummary{Operations: []OperationStats{}}
+)
+
+func usageFile() string {
+	return filepath.Join(godevDataDir(), "usage.json")
+}
+
+// Classifies a request into the operation it performs
+func usageOperation(req *http.Request, pathSegs []string) string {
+	switch {
+	case pathSegs[0] == "file" && req.Method == "PUT":
+		return "save"
+	case pathSegs[0] == "file" && req.Method == "GET":
+		return "open"
+	case pathSegs[0] == "go" && len(pathSegs) > 1:
+		return pathSegs[1]
+	}
+
+	return pathSegs[0]
+}
+
+func recordUsage(operation string, duration time.Duration) {
+	millis := int64(duration / time.Millisecond)
+
+	usageMutex.Lock()
+	defer usageMutex.Unlock()
+
+	for idx := range usage.Operations {
+		stats := &usage.Operations[idx]
+		if stats.Operation == operation {
+			stats.Count++
+			stats.TotalMillis += millis
+			if millis > stats.MaxMillis {
+				stats.MaxMillis = millis
+			}
+			stats.AverageMillis = stats.TotalMillis / stats.Count
+			return
+		}
+	}
+
+	usage.Operations = append(usage.Operations, OperationStats{Operation: operation, Count: 1,
+		TotalMillis: millis, MaxMillis: millis, AverageMillis: millis})
+}
+
+func saveUsage() error {
+	usageMutex.Lock()
+	b, err := json.Marshal(usage)
+	usageMutex.Unlock()
+
+	if err != nil {
+		return err
+	}
+
+	err = os.MkdirAll(godevDataDir(), 0700)
+	if err != nil {
+		return err
+	}
+
+	return ioutil.WriteFile(usageFile(), b, 0600)
+}
+
+// Picks up the statistics of previous sessions and writes them back
+// out to the usage file every so often.
+func startUsageStats() {
+	if !*usageStats {
+		return
+	}
+
+	b, err := ioutil.ReadFile(usageFile())
+	if err == nil {
+		err = json.Unmarshal(b, usage)
+	}
+	if err != nil || usage.Since == 0 {
+		usage = &UsageSummary{Since: time.Now().Unix() * 1000, Operations: []OperationStats{}}
+	}
+
+	go func() {
+		for {
+			<-time.After(1 * time.Minute)
+			err := saveUsage()
+			if err != nil {
+				logger.Printf("Unable to save usage statistics: %v\n", err)
+			}
+		}
+	}()
+}
+
+func usageSummary() UsageSummary {
+	usageMutex.Lock()
+	defer usageMutex.Unlock()
+
+	summary := UsageSummary{Since: usage.Since, Operations: append([]OperationStats{}, usage.Operations...)}
+
+	// Slowest operations first
+	sort.Slice(summary.Operations, func(i, j int) bool {
+		return summary.Operations[i].TotalMillis > summary.Operations[j].TotalMillis
+	})
+
+	return summary
+}
@@ -0,0 +1,134 @@
+// Copyright 2014 Chris McGee <sirnewton_01@yahoo.ca>. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"io"
+	"net/http"
+	"os/exec"
+	"strconv"
+	"strings"
+)
+
+// Finding of an analyzer in the output of go vet -json
+type vetDiagnostic struct {
+	Posn    string `json:"posn"`
+	Message string `json:"message"`
+	Related []struct {
+		Posn    string `json:"posn"`
+		Message string `json:"message"`
+	} `json:"related"`
+}
+
+// Splits a "file:line:col" position, file names can have drive letters
+func vetPosition(posn string) (string, int64, int64) {
+	file, line, column := posn, int64(0), int64(0)
+
+	for _, n := range []*int64{&column, &line} {
+		idx := strings.LastIndex(file, ":")
+		if idx == -1 {
+			break
+		}
+		v, err := strconv.ParseInt(file[idx+1:], 10, 64)
+		if err != nil {
+			break
+		}
+		*n = v
+		file = file[:idx]
+	}
+
+	// Only a line
+	if line == 0 {
+		line, column = column, 0
+	}
+
+	return file, line, column
+}
+
+// Runs go vet on the package and reports its findings as warnings in the
+// format of the compile errors
+func vetPackage(ctx context.Context, user string, pkg string) ([]CompileError, error) {
+	warnings := []CompileError{}
+
+	cmd := exec.CommandContext(ctx, "go", "vet", "-json", pkg)
+	cmd.Env = workspaceEnv(user)
+	output, _ := cmd.CombinedOutput()
+	if ctx.Err() != nil {
+		return warnings, ctx.Err()
+	}
+
+	// The JSON of each package follows a "# <package>" line
+	lines := []string{}
+	for _, line := range strings.Split(string(output), "\n") {
+		if !strings.HasPrefix(line, "#") {
+			lines = append(lines, line)
+		}
+	}
+
+	decoder := json.NewDecoder(strings.NewReader(strings.Join(lines, "\n")))
+	for {
+		result := make(map[string]map[string]json.RawMessage)
+		err := decoder.Decode(&result)
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			// Packages that don't compile have no findings, just the
+			//  errors that the build already reports
+			break
+		}
+
+		for _, analyzers := range result {
+			for analyzer, raw := range analyzers {
+				diagnostics := []vetDiagnostic{}
+				if json.Unmarshal(bytes.TrimSpace(raw), &diagnostics) != nil {
+					continue
+				}
+
+				for _, diagnostic := range diagnostics {
+					file, line, column := vetPosition(diagnostic.Posn)
+					warning := CompileError{Location: workspaceLocation(file), Line: line, Column: column,
+						Msg: diagnostic.Message + " (" + analyzer + ")", Severity: SEV_WARN, Code: analyzer}
+					for _, related := range diagnostic.Related {
+						file, line, column := vetPosition(related.Posn)
+						warning.Related = append(warning.Related, CompileNote{workspaceLocation(file), line, column, related.Message})
+					}
+					warnings = append(warnings, warning)
+				}
+			}
+		}
+	}
+
+	return warnings, nil
+}
+
+// GET /go/vet?pkg=<import path> has the findings of go vet for the package
+func vetHandler(writer http.ResponseWriter, req *http.Request, path string, pathSegs []string) bool {
+	switch {
+	case req.Method == "GET":
+		pkg := workspacePackage(req.URL.Query().Get("pkg"))
+		if pkg == "" || strings.HasPrefix(pkg, "-") {
+			ShowError(writer, 400, "Invalid package: "+pkg, nil)
+			return true
+		}
+
+		ctx, cancel := operationContext(req, *buildTimeout)
+		defer cancel()
+
+		warnings, err := vetPackage(ctx, requestUser(req), pkg)
+		if err != nil {
+			ShowError(writer, 500, "Error running go vet", err)
+			return true
+		}
+
+		ShowJson(writer, 200, warnings)
+		return true
+	}
+
+	return false
+}
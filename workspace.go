@@ -7,7 +7,6 @@ package main
 import (
 	"encoding/json"
 	"errors"
-	"go/build"
 	"io"
 	"net/http"
 	"os"
@@ -40,7 +39,7 @@ type WorkspacesList struct {
 	Workspaces []Workspace
 }
 
-func getWsProjects() ([]Project, []FileDetails) {
+func getWsProjects(srcDirs []string) ([]Project, []FileDetails) {
 	projects := make([]Project, 0, 0)
 	children := make([]FileDetails, 0, 0)
 
@@ -143,6 +142,8 @@ func getWsProjects() ([]Project, []FileDetails) {
 
 func workspaceHandler(writer http.ResponseWriter, req *http.Request, path string, pathSegs []string) bool {
 	numPathSegs := len(pathSegs)
+	// Accounts only see their own workspace
+	srcDirs := requestSrcDirs(req)
 
 	switch {
 	case req.Method == "POST" && numPathSegs == 2:
@@ -168,8 +169,10 @@ func workspaceHandler(writer http.ResponseWriter, req *http.Request, path string
 		//workspaceId := pathSegs[1]
 
 		// New top-level folders (ie projects) go at the end of the GOPATH
-		gopaths := filepath.SplitList(build.Default.GOPATH)
-		filesDir := gopaths[len(gopaths)-1] + "/src"
+		filesDir := topLevelDir()
+		if account := requestAccount(req); account != nil {
+			filesDir = accountSrcDir(account)
+		}
 
 		createOptions := req.Header.Get("X-Create-Options")
 
@@ -279,6 +282,8 @@ func workspaceHandler(writer http.ResponseWriter, req *http.Request, path string
 				return true
 			}
 
+			startOnboarding(requestUser(req), filepath.Join(filesDir, projectName), "/file/"+projectName)
+
 			writer.WriteHeader(201)
 			return true
 		} else {
@@ -294,6 +299,8 @@ func workspaceHandler(writer http.ResponseWriter, req *http.Request, path string
 		contentLocation := "/file/" + projectName
 		location := "/workspace/project/" + projectName
 
+		startOnboarding(requestUser(req), filepath.Join(filesDir, projectName), contentLocation)
+
 		newProject := Project{Id: projectName, ContentLocation: contentLocation, Location: location}
 
 		writer.Header().Set("Location", location)
@@ -303,12 +310,20 @@ func workspaceHandler(writer http.ResponseWriter, req *http.Request, path string
 		workspaceList := WorkspacesList{Id: "anonymous", UserName: "anonymous", Name: "anonymous"}
 		workspace := Workspace{Id: "1", Directory: true, ChildrenLocation: "/workspace/1", Location: "/workspace/1",
 			LastModified: 1, Name: "Go Development"}
-		workspace.Projects, workspace.Children = getWsProjects()
+		workspace.Projects, workspace.Children = getWsProjects(srcDirs)
 		workspaceList.Workspaces = []Workspace{workspace}
 		etag := "1"
 		writer.Header().Add("ETag", etag)
 
-		if numPathSegs == 1 {
+		if wantsJsonStream(req) {
+			// The listing of the workspace as one entry per line
+			stream := NewJsonStream(writer, req)
+			for _, child := range workspace.Children {
+				if stream.Send(child) != nil {
+					break
+				}
+			}
+		} else if numPathSegs == 1 {
 			// TODO Figure out if outputting all of the details (project, children) is too much for the plain workspace GET call
 			ShowJson(writer, 200, workspaceList)
 		} else {
@@ -0,0 +1,203 @@
+// Copyright 2014 Chris McGee <sirnewton_01@yahoo.ca>. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"context"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// Working tree of a repository that has another branch checked out, so
+// that two branches can be open side by side without a second clone. The
+// worktrees that godev creates are kept in a source directory of their own
+// and show up as top-level folders of the workspace.
+type WorktreeInfo struct {
+	// Name of the folder in the workspace
+	Name string
+	// Branch that is checked out, empty when the HEAD is detached
+	Branch string
+	Head   string
+	// Workspace location, empty for worktrees outside of the workspace
+	Location      string
+	CloneLocation string `json:",omitempty"`
+	// The worktree of the repository itself, which can't be removed
+	Main   bool
+	Locked bool
+	Type   string
+}
+
+type WorktreeResponse struct {
+	Children []WorktreeInfo
+	Type     string
+}
+
+// Source directory of the worktrees of this workspace
+func worktreesDir() string {
+	return filepath.Join(godevDataDir(), "worktrees", workspaceName(""))
+}
+
+// Adds the directory of the worktrees to the source directories, once at
+// startup since the source directories don't change while serving. In a
+// GOPATH the worktrees aren't at the import path of their repository, so
+// they build in module mode only.
+func registerWorktreesDir() {
+	dir := worktreesDir()
+
+	err := os.MkdirAll(dir, 0700)
+	if err != nil {
+		logger.Printf("Unable to create the worktrees directory %v: %v\n", dir, err)
+		return
+	}
+
+	srcDirs = append(srcDirs, dir)
+}
+
+// Reads the worktrees of the repository from git worktree list
+func gitWorktrees(ctx context.Context, target gitTarget) ([]WorktreeInfo, error) {
+	out, err := runGit(ctx, target.dir, "worktree", "list", "--porcelain")
+	if err != nil {
+		return nil, err
+	}
+
+	worktrees := []WorktreeInfo{}
+	for _, block := range strings.Split(strings.TrimSpace(string(out)), "\n\n") {
+		info := WorktreeInfo{Type: "Worktree", Main: len(worktrees) == 0}
+
+		for _, line := range strings.Split(block, "\n") {
+			fields := strings.SplitN(line, " ", 2)
+			value := ""
+			if len(fields) == 2 {
+				value = fields[1]
+			}
+
+			switch fields[0] {
+			case "worktree":
+				dir := filepath.FromSlash(value)
+				info.Name = filepath.Base(dir)
+				info.Location = workspaceLocation(dir)
+				if info.Location != "" {
+					info.CloneLocation = "/gitapi/clone" + info.Location
+				}
+			case "HEAD":
+				info.Head = value
+			case "branch":
+				info.Branch = strings.TrimPrefix(value, "refs/heads/")
+			case "locked":
+				info.Locked = true
+			}
+		}
+
+		worktrees = append(worktrees, info)
+	}
+
+	return worktrees, nil
+}
+
+// Name of a worktree folder that has a branch of the repository
+func worktreeName(target gitTarget, branch string) string {
+	return unsafeNameChars.ReplaceAllString(filepath.Base(target.dir)+"-"+branch, "_")
+}
+
+// Whether a top-level folder of the workspace has the name already
+func topLevelNameTaken(name string) bool {
+	for _, srcDir := range srcDirs {
+		if _, err := os.Lstat(filepath.Join(srcDir, name)); err == nil {
+			return true
+		}
+	}
+
+	return false
+}
+
+// /gitapi/worktrees/file/<repository> lists the worktrees with GET and
+// creates one with POST, which checks out the Branch of the body into a new
+// top-level folder of the workspace, named after the repository and the
+// branch unless the body has a Name. A branch that doesn't exist is created
+// from HEAD. DELETE /gitapi/worktrees/<name>/file/<repository> removes the
+// worktree, one with changes only with ?force=true.
+func worktreesRequest(ctx context.Context, writer http.ResponseWriter, req *http.Request, pathSegs []string, request GitRequest) bool {
+	params, target, err := gitapiParams(req, pathSegs)
+	if err != nil {
+		ShowError(writer, 404, "Invalid worktree location", err)
+		return true
+	}
+
+	switch {
+	case req.Method == "GET" && len(params) == 0:
+		worktrees, err := gitWorktrees(ctx, target)
+		if err != nil {
+			ShowError(writer, 500, "Unable to list the worktrees", err)
+			return true
+		}
+
+		ShowJson(writer, 200, WorktreeResponse{Type: "Worktree", Children: worktrees})
+		return true
+	case req.Method == "POST" && len(params) == 0:
+		if err = validGitNames(request.Branch, request.Name); err != nil || request.Branch == "" {
+			ShowError(writer, 400, "Invalid branch name", err)
+			return true
+		}
+
+		name := request.Name
+		if name == "" {
+			name = worktreeName(target, request.Branch)
+		}
+		if strings.ContainsAny(name, `/\`) || name == "." || name == ".." {
+			ShowError(writer, 400, "Invalid worktree name: "+name, nil)
+			return true
+		}
+		if topLevelNameTaken(name) {
+			ShowError(writer, 409, "There is already a top-level folder named "+name, nil)
+			return true
+		}
+
+		dir := filepath.Join(worktreesDir(), name)
+		args := []string{"worktree", "add", dir, request.Branch}
+		if _, err := runGit(ctx, target.dir, "rev-parse", "--verify", "-q", "refs/heads/"+request.Branch); err != nil {
+			args = []string{"worktree", "add", "-b", request.Branch, dir}
+		}
+
+		_, err = runGit(ctx, target.dir, args...)
+		if err != nil {
+			ShowError(writer, 500, "Unable to create the worktree", err)
+			return true
+		}
+
+		info := WorktreeInfo{Type: "Worktree", Name: name, Branch: request.Branch, Location: workspaceLocation(dir)}
+		info.CloneLocation = "/gitapi/clone" + info.Location
+		if out, err := runGit(ctx, dir, "rev-parse", "HEAD"); err == nil {
+			info.Head = strings.TrimSpace(string(out))
+		}
+
+		writer.Header().Add("Location", "/gitapi/worktrees/"+gitRefSeg(name)+target.location)
+		ShowJson(writer, 201, info)
+		return true
+	case req.Method == "DELETE" && len(params) == 1:
+		name := params[0]
+		if strings.ContainsAny(name, `/\`) || name == "." || name == ".." {
+			ShowError(writer, 400, "Invalid worktree name: "+name, nil)
+			return true
+		}
+
+		// Only the worktrees that godev created, not the repository itself
+		args := []string{"worktree", "remove"}
+		if req.URL.Query().Get("force") == "true" {
+			args = append(args, "--force")
+		}
+		_, err = runGit(ctx, target.dir, append(args, filepath.Join(worktreesDir(), name))...)
+		if err != nil {
+			ShowError(writer, 500, "Unable to remove the worktree", err)
+			return true
+		}
+
+		ShowJson(writer, 200, map[string]string{})
+		return true
+	}
+
+	return false
+}
@@ -7,7 +7,6 @@ package main
 import (
 	"archive/zip"
 	"io"
-	"io/ioutil"
 	"net/http"
 	"os"
 	"path/filepath"
@@ -39,12 +38,14 @@ func init() {
 
 func xferHandler(writer http.ResponseWriter, req *http.Request, path string, pathSegs []string) bool {
 	switch {
+	case len(pathSegs) > 2 && pathSegs[1] == "sync":
+		return syncHandler(writer, req, path, pathSegs)
 	case req.Method == "POST" && len(pathSegs) > 2:
 		path := filepath.Clean(strings.Join(pathSegs[2:], "/"))
 		containerPath := ""
 
-		for _, srcDir := range srcDirs {
-			p := filepath.Join(srcDir, path)
+		for _, srcDir := range requestSrcDirs(req) {
+			p := filepath.Join(srcDir, filepath.Clean("/"+path))
 			_, err := os.Stat(p)
 			if err == nil {
 				containerPath = p
@@ -58,7 +59,7 @@ func xferHandler(writer http.ResponseWriter, req *http.Request, path string, pat
 		}
 
 		xferOption := req.Header.Get("X-Xfer-Options")
-		tmpDir, err := ioutil.TempDir("", "godev-xfer")
+		tmpDir, err := newTempDir("godev-xfer")
 
 		if err != nil {
 			ShowError(writer, 500, "Unable to create temporary directory", err)
@@ -94,7 +95,7 @@ func xferHandler(writer http.ResponseWriter, req *http.Request, path string, pat
 
 		// Check if content is being transferred right away
 		if req.Header.Get("X-Xfer-Content-Length") == "" {
-			defer os.RemoveAll(info.TmpPath)
+			defer removeTempDir(info.TmpPath)
 			return performTransfer(info, req, writer)
 		}
 
@@ -114,7 +115,7 @@ func xferHandler(writer http.ResponseWriter, req *http.Request, path string, pat
 			info := transfers[idx]
 
 			if info != nil {
-				os.RemoveAll(info.TmpPath)
+				removeTempDir(info.TmpPath)
 			}
 
 			transfers[idx] = nil
@@ -139,7 +140,7 @@ func xferHandler(writer http.ResponseWriter, req *http.Request, path string, pat
 		lock.Unlock()
 
 		// Delete the temporary directory afterwards
-		defer os.RemoveAll(info.TmpPath)
+		defer removeTempDir(info.TmpPath)
 
 		if info == nil {
 			ShowError(writer, 400, "Invalid transfer", nil)
@@ -153,6 +154,12 @@ func xferHandler(writer http.ResponseWriter, req *http.Request, path string, pat
 }
 
 func performTransfer(info *TransferInfo, req *http.Request, writer http.ResponseWriter) bool {
+	if !info.IsZip {
+		if showLocked(writer, req, "/file/"+info.Location) {
+			return true
+		}
+	}
+
 	transferPath := filepath.Join(info.TmpPath, "transfer")
 	txFile, err := os.Create(transferPath)
 	if err != nil {
@@ -163,7 +170,17 @@ func performTransfer(info *TransferInfo, req *http.Request, writer http.Response
 
 	// The content is in the body of this request
 	if info.Source == "" {
-		_, err = io.Copy(txFile, req.Body)
+		body, err := uploadBody(req)
+		if err != nil {
+			showUploadError(writer, err)
+			return true
+		}
+
+		_, err = io.Copy(txFile, body)
+		if body.err != nil {
+			showUploadError(writer, body.err)
+			return true
+		}
 		if err != nil {
 			ShowError(writer, 500, "Error making the transfer", err)
 			return true
@@ -205,6 +222,13 @@ func performTransfer(info *TransferInfo, req *http.Request, writer http.Response
 		}
 		defer rc.Close()
 
+		// Nothing is extracted when any of the files is locked
+		for _, zFile := range rc.File {
+			if showLocked(writer, req, "/file/"+filepath.ToSlash(filepath.Join(info.Location, zFile.Name))) {
+				return true
+			}
+		}
+
 		for _, zFile := range rc.File {
 			osPath := filepath.Join(info.OsPath, zFile.Name)
 			parentDir := filepath.Dir(osPath)